@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"candle-lights/backend/shared"
+)
+
+// Particle failures as they're told to the user, after the strip's name
+const (
+	particleTimedOut      = "device timed out"
+	particleOffline       = "device is offline"
+	particleNotFound      = "device or command not found on Particle"
+	particleTokenRejected = "Particle token was rejected"
+	particleRateLimited   = "Particle is rate limiting requests"
+	particleCloudError    = "Particle cloud error"
+	particleFailed        = "Particle call failed"
+	deviceRateLimited     = "too many commands; try again shortly"
+)
+
+// classifyParticleError names what went wrong with a Particle call in a few
+// words. The result never carries the error's own text, which may quote the
+// request.
+func classifyParticleError(err error) string {
+	if shared.IsCommandTimeout(err) {
+		return particleTimedOut
+	}
+
+	var apiErr *shared.ParticleAPIError
+	if !errors.As(err, &apiErr) {
+		return particleFailed
+	}
+	message := strings.ToLower(apiErr.Message)
+	switch {
+	case strings.Contains(message, "offline") || strings.Contains(message, "not connected"):
+		return particleOffline
+	case apiErr.StatusCode == http.StatusNotFound:
+		return particleNotFound
+	case apiErr.StatusCode == http.StatusUnauthorized || apiErr.StatusCode == http.StatusForbidden:
+		return particleTokenRejected
+	case apiErr.StatusCode == http.StatusTooManyRequests:
+		return particleRateLimited
+	case apiErr.StatusCode >= 500:
+		return particleCloudError
+	default:
+		return particleFailed
+	}
+}
+
+// particleFailure is the directiveError for a failed Particle call. A call
+// refused by the device's own rate limit never reached Particle.
+func particleFailure(err error) *directiveError {
+	if shared.IsDeviceRateLimited(err) {
+		return &directiveError{Type: "RATE_LIMIT_EXCEEDED", Message: deviceRateLimited, Err: err}
+	}
+	return &directiveError{Type: "ENDPOINT_UNREACHABLE", Message: classifyParticleError(err), Err: err}
+}
+
+// patternTooLarge is told to the user for a pattern estimated not to fit in
+// the device's memory
+const patternTooLarge = "pattern is too large for the device"
+
+// applyFailure is the directiveError for a pattern that couldn't be applied
+// to a strip. A pattern too big for the device's memory is never sent.
+func applyFailure(err error) *directiveError {
+	var memErr *shared.MemoryLimitError
+	if errors.As(err, &memErr) {
+		return &directiveError{Type: "VALUE_OUT_OF_RANGE", Message: patternTooLarge, Err: err}
+	}
+	return particleFailure(err)
+}
+
+// stripErrorMessage is the message Alexa shows for a directive that failed
+// on the strip on pin: "Garage Left D6: device timed out". It names only the
+// device and pin, never the account or its tokens.
+func stripErrorMessage(device *shared.Device, pin int, message string) string {
+	return device.Name + " " + shared.PinLabel(pin) + ": " + message
+}
+
+// failDirective answers a directive that failed on the strip on pin, and
+// records the failure in the user's activity log under the directive's
+// messageId so support can find it from the Alexa logs
+func failDirective(ctx context.Context, request shared.AlexaRequest, userID string, device *shared.Device, pin int, derr *directiveError) (interface{}, error) {
+	message := stripErrorMessage(device, pin, derr.Message)
+	log.Printf("Directive %s failed: %s (%v)", request.Directive.Header.MessageID, message, derr.Err)
+
+	detail := derr.Message
+	if derr.Err != nil {
+		detail = derr.Err.Error()
+	}
+	header := request.Directive.Header
+	if err := shared.RecordActivity(ctx, shared.ActivityEntry{
+		ActivityID: header.MessageID,
+		UserID:     userID,
+		Action:     shared.ActivityAlexaDirectiveFailed,
+		Actor:      "alexa",
+		Subject:    userID,
+		Path:       header.Namespace + "." + header.Name,
+		EndpointID: request.Directive.Endpoint.EndpointID,
+		ErrorType:  derr.Type,
+		Message:    message,
+		Detail:     detail,
+	}); err != nil {
+		log.Printf("Failed to log directive failure %s: %v", header.MessageID, err)
+	}
+
+	return createErrorResponse(request, derr.Type, message)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"candle-lights/backend/shared"
+)
+
+func TestApplyFailureRefusesOversizedPattern(t *testing.T) {
+	device := shared.Device{
+		Name:            "garage",
+		ParticleID:      "p1",
+		FirmwareVersion: "v3.0.0",
+		Platform:        "photon",
+		FreeMemory:      1,
+		LEDStrips:       []shared.LEDStrip{{Pin: 6, LEDCount: 300}},
+	}
+	pattern := shared.Pattern{WLEDState: `{"on":true,"bri":128,"seg":[{"fx":2,"sx":150,"col":[[255,0,0]]}]}`}
+
+	sent := false
+	call := func(particleID, function, argument string) error {
+		sent = true
+		return nil
+	}
+	_, err := shared.ApplyPatternToStrip(device, 6, 300, pattern, call)
+	if sent {
+		t.Error("oversized pattern was sent to the device")
+	}
+	if derr := applyFailure(err); derr.Type != "VALUE_OUT_OF_RANGE" || derr.Message != patternTooLarge {
+		t.Errorf("applyFailure(%v) = %v, want VALUE_OUT_OF_RANGE: %s", err, derr, patternTooLarge)
+	}
+}
+
+func TestApplyFailureReportsParticleFailures(t *testing.T) {
+	if derr := applyFailure(&shared.ParticleAPIError{StatusCode: 404, Message: "device not found"}); derr.Type != "ENDPOINT_UNREACHABLE" || derr.Message != particleNotFound {
+		t.Errorf("404 = %v, want ENDPOINT_UNREACHABLE: %s", derr, particleNotFound)
+	}
+	if derr := applyFailure(context.DeadlineExceeded); derr.Type != "ENDPOINT_UNREACHABLE" {
+		t.Errorf("deadline = %v, want ENDPOINT_UNREACHABLE", derr)
+	}
+}
+
+func TestDirectiveErrorMessages(t *testing.T) {
+	device := &shared.Device{Name: "Garage Left", UserID: "lee"}
+	tests := []struct {
+		name     string
+		err      error
+		wantType string
+		want     string
+	}{
+		{"timeout", context.DeadlineExceeded, "ENDPOINT_UNREACHABLE", "Garage Left D6: device timed out"},
+		{"offline", &shared.ParticleAPIError{StatusCode: 400, Message: "Device is offline"}, "ENDPOINT_UNREACHABLE", "Garage Left D6: device is offline"},
+		{"not connected", &shared.ParticleAPIError{StatusCode: 400, Message: "Device not connected"}, "ENDPOINT_UNREACHABLE", "Garage Left D6: device is offline"},
+		{"not found", &shared.ParticleAPIError{StatusCode: 404, Message: "Function setBytecode not found"}, "ENDPOINT_UNREACHABLE", "Garage Left D6: device or command not found on Particle"},
+		{"token rejected", &shared.ParticleAPIError{StatusCode: 401, Message: "invalid_token"}, "ENDPOINT_UNREACHABLE", "Garage Left D6: Particle token was rejected"},
+		{"forbidden", &shared.ParticleAPIError{StatusCode: 403}, "ENDPOINT_UNREACHABLE", "Garage Left D6: Particle token was rejected"},
+		{"rate limited", &shared.ParticleAPIError{StatusCode: 429}, "ENDPOINT_UNREACHABLE", "Garage Left D6: Particle is rate limiting requests"},
+		{"cloud error", &shared.ParticleAPIError{StatusCode: 502, Message: "Bad gateway"}, "ENDPOINT_UNREACHABLE", "Garage Left D6: Particle cloud error"},
+		{"other status", &shared.ParticleAPIError{StatusCode: 400, Message: "bad argument"}, "ENDPOINT_UNREACHABLE", "Garage Left D6: Particle call failed"},
+		{"not from Particle", errors.New("dial tcp: access_token=secret"), "ENDPOINT_UNREACHABLE", "Garage Left D6: Particle call failed"},
+		{"device rate limit", &shared.DeviceRateLimitError{DeviceName: "Garage Left", RetryAfter: time.Second}, "RATE_LIMIT_EXCEEDED", "Garage Left D6: too many commands; try again shortly"},
+	}
+	for _, tt := range tests {
+		derr := particleFailure(tt.err)
+		if got := stripErrorMessage(device, 6, derr.Message); derr.Type != tt.wantType || got != tt.want {
+			t.Errorf("%s: %s %q, want %s %q", tt.name, derr.Type, got, tt.wantType, tt.want)
+		}
+	}
+}
+
+func TestFailedDirectiveIsExplainedAndLogged(t *testing.T) {
+	store := linkedStrip()
+	var logged []shared.ActivityEntry
+	defer shared.StubDynamoDB(func(call shared.DynamoDBStubCall) (map[string]interface{}, error) {
+		var entry shared.ActivityEntry
+		if call.Operation == "PutItem" && call.Unmarshal("Item", &entry) == nil && entry.ActivityID != "" {
+			logged = append(logged, entry)
+			return nil, nil
+		}
+		return store.handle(call)
+	})()
+	defer shared.StubParticleAPI(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"ok":false,"error":"Device is offline"}`))
+	})()
+
+	directive := powerDirective("TurnOff")
+	directive.Directive.Header.MessageID = "msg-123"
+	resp, err := handler(context.Background(), directive)
+	alexaResp, _ := resp.(shared.AlexaResponse)
+	payload, _ := alexaResp.Event.Payload.(shared.ErrorPayload)
+	if err != nil || payload.Type != "ENDPOINT_UNREACHABLE" || payload.Message != "garage D6: device is offline" {
+		t.Fatalf("TurnOff on an offline device = %+v, %v; want ENDPOINT_UNREACHABLE naming the strip", payload, err)
+	}
+	for _, secret := range []string{"lee", "token"} {
+		if strings.Contains(payload.Message, secret) {
+			t.Errorf("message %q gives away %q", payload.Message, secret)
+		}
+	}
+
+	if len(logged) != 1 {
+		t.Fatalf("%d activity entries, want 1", len(logged))
+	}
+	entry := logged[0]
+	if entry.ActivityID != "msg-123" || entry.UserID != "lee" || entry.Action != shared.ActivityAlexaDirectiveFailed ||
+		entry.EndpointID != shared.AlexaEndpointID("d1", 6) || entry.ErrorType != "ENDPOINT_UNREACHABLE" || entry.Message != payload.Message {
+		t.Errorf("activity entry = %+v, want the failure keyed by the messageId", entry)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+
+	"candle-lights/backend/shared"
+)
+
+// discoverEndpoints returns userID's discovery endpoints, from the cached
+// response while it's fresh (see shared.AlexaDiscoveryCache), so repeated
+// discoveries cost one read rather than a query of devices and patterns
+func discoverEndpoints(ctx context.Context, userID string) ([]shared.AlexaDiscoveryEndpoint, error) {
+	cache, err := shared.GetAlexaDiscoveryCache(ctx, userID)
+	if err != nil {
+		log.Printf("Failed to read discovery cache: %v", err)
+	}
+	if cache.Fresh(time.Now()) {
+		endpoints, err := cache.DiscoveryEndpoints()
+		if err == nil {
+			log.Printf("Using discovery response cached at %s", cache.BuiltAt.Format(time.RFC3339))
+			return endpoints, nil
+		}
+		log.Printf("Failed to decode discovery cache: %v", err)
+	}
+
+	var generation int64
+	if cache != nil {
+		generation = cache.Generation
+	}
+
+	endpoints, skipped, err := shared.BuildUserAlexaDiscovery(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range skipped {
+		log.Printf("Skipping device %s - %s", s.Name, s.Reason)
+	}
+
+	if err := shared.SaveAlexaDiscoveryCache(ctx, userID, endpoints, generation); err != nil {
+		log.Printf("Failed to cache discovery response: %v", err)
+	}
+	return endpoints, nil
+}
+
+// recordAlexaGrant exchanges the AcceptGrant's code for the token pair that
+// proactive events are sent with. It's skipped when events aren't set up.
+func recordAlexaGrant(ctx context.Context, request shared.AlexaRequest) error {
+	if !shared.AlexaEventsEnabled() {
+		return nil
+	}
+
+	var payload struct {
+		Grant struct {
+			Code string `json:"code"`
+		} `json:"grant"`
+	}
+	raw, _ := json.Marshal(request.Directive.Payload)
+	if err := json.Unmarshal(raw, &payload); err != nil || payload.Grant.Code == "" {
+		return fmt.Errorf("missing grant code")
+	}
+
+	userID, err := shared.ValidateAccessToken(ctx, granteeToken(request))
+	if err != nil || userID == "" {
+		return fmt.Errorf("invalid grantee token")
+	}
+
+	grant, err := shared.ExchangeAlexaGrantCode(ctx, payload.Grant.Code)
+	if err != nil {
+		return err
+	}
+	if err := shared.SaveAlexaGrant(ctx, usersTable, userID, grant); err != nil {
+		return err
+	}
+	log.Printf("AcceptGrant: recorded proactive events grant for user %s", userID)
+	return nil
+}
+
+// createAcceptGrantError answers an AcceptGrant that failed. Alexa then
+// tells the user linking failed, so they can try again.
+func createAcceptGrantError(request shared.AlexaRequest, message string) (interface{}, error) {
+	response := shared.AlexaResponse{
+		Event: shared.AlexaEvent{
+			Header: shared.AlexaHeader{
+				Namespace:      "Alexa.Authorization",
+				Name:           "ErrorResponse",
+				PayloadVersion: "3",
+				MessageID:      uuid.New().String(),
+			},
+			Payload: shared.ErrorPayload{
+				Type:    "ACCEPT_GRANT_FAILED",
+				Message: message,
+			},
+		},
+	}
+
+	return response, nil
+}
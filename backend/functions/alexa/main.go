@@ -11,7 +11,10 @@ import (
 	"time"
 
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/google/uuid"
 
 	"candle-lights/backend/shared"
@@ -20,6 +23,7 @@ import (
 var (
 	devicesTable  = os.Getenv("DEVICES_TABLE")
 	usersTable    = os.Getenv("USERS_TABLE")
+	patternsTable = os.Getenv("PATTERNS_TABLE")
 	alexaSkillID  = os.Getenv("ALEXA_SKILL_ID")
 )
 
@@ -28,10 +32,16 @@ func handler(ctx context.Context, request shared.AlexaRequest) (interface{}, err
 	log.Printf("Namespace: %s", request.Directive.Header.Namespace)
 	log.Printf("Name: %s", request.Directive.Header.Name)
 	log.Printf("MessageID: %s", request.Directive.Header.MessageID)
+	defer shared.FlushMetrics(ctx)
 
 	namespace := request.Directive.Header.Namespace
 	name := request.Directive.Header.Name
 
+	// Strips removed since discovery answer NO_SUCH_ENDPOINT
+	if removed, resp, err := checkRemovedEndpoint(ctx, request); removed {
+		return resp, err
+	}
+
 	switch namespace {
 	case "Alexa.Discovery":
 		return handleDiscovery(ctx, request)
@@ -48,8 +58,11 @@ func handler(ctx context.Context, request shared.AlexaRequest) (interface{}, err
 			return handleReportState(ctx, request)
 		}
 	case "Alexa.Authorization":
-		if name == "AcceptGrant" {
+		switch name {
+		case "AcceptGrant":
 			return handleAcceptGrant(ctx, request)
+		case "RevokeGrant":
+			return handleRevokeGrant(ctx, request)
 		}
 	}
 
@@ -83,58 +96,12 @@ func handleDiscovery(ctx context.Context, request shared.AlexaRequest) (interfac
 
 	log.Printf("Discovering devices for user: %s", userID)
 
-	// Get user's devices from DynamoDB
-	devices, err := getUserDevices(ctx, userID)
+	endpoints, err := discoverEndpoints(ctx, userID)
 	if err != nil {
 		log.Printf("Failed to get devices: %v", err)
 		return createErrorResponse(request, "INTERNAL_ERROR", "Failed to retrieve devices")
 	}
 
-	// Build endpoints for each LED strip on each device
-	endpoints := []shared.AlexaDiscoveryEndpoint{}
-
-	for _, device := range devices {
-		if !device.IsReady {
-			log.Printf("Skipping device %s - not ready", device.Name)
-			continue
-		}
-
-		// If device has no LED strips configured, skip it
-		if len(device.LEDStrips) == 0 {
-			log.Printf("Skipping device %s - no LED strips configured", device.Name)
-			continue
-		}
-
-		// Create an endpoint for each LED strip
-		for _, strip := range device.LEDStrips {
-			endpointID := fmt.Sprintf("%s-strip-D%d", device.DeviceID, strip.Pin)
-			friendlyName := fmt.Sprintf("%s Strip D%d", device.Name, strip.Pin)
-
-			endpoint := shared.AlexaDiscoveryEndpoint{
-				EndpointID:        endpointID,
-				ManufacturerName:  "Garage Lights",
-				FriendlyName:      friendlyName,
-				Description:       fmt.Sprintf("LED strip on pin D%d with %d LEDs", strip.Pin, strip.LEDCount),
-				DisplayCategories: []string{"LIGHT"},
-				Cookie: shared.Cookie{
-					"deviceId":   device.DeviceID,
-					"particleId": device.ParticleID,
-					"pin":        strconv.Itoa(strip.Pin),
-					"ledCount":   strconv.Itoa(strip.LEDCount),
-				},
-				Capabilities: buildCapabilities(),
-				AdditionalAttributes: &shared.AdditionalAttributes{
-					Manufacturer:    "Garage Lights",
-					Model:           "LED Strip Controller",
-					FirmwareVersion: device.FirmwareVersion,
-				},
-			}
-
-			endpoints = append(endpoints, endpoint)
-			log.Printf("Added endpoint: %s (%s)", endpointID, friendlyName)
-		}
-	}
-
 	log.Printf("Discovered %d endpoints", len(endpoints))
 
 	response := shared.AlexaResponse{
@@ -176,29 +143,43 @@ func handlePowerControl(ctx context.Context, request shared.AlexaRequest) (inter
 		return createErrorResponse(request, "ENDPOINT_UNREACHABLE", err.Error())
 	}
 
-	// Determine power state
-	powerState := "OFF"
-	patternNum := 0
-	if request.Directive.Header.Name == "TurnOn" {
-		powerState = "ON"
-		patternNum = 2 // Solid pattern when turning on
-	}
-
-	// Send command to device
-	patternArg := fmt.Sprintf("%d,%d,50", pin, patternNum)
-	if err := callParticleFunction(device.ParticleID, "setPattern", patternArg, particleToken); err != nil {
-		log.Printf("Failed to set power: %v", err)
-		return createErrorResponse(request, "ENDPOINT_UNREACHABLE", "Failed to control device")
-	}
+	currentState, _ := shared.GetAlexaDeviceState(ctx, request.Directive.Endpoint.EndpointID)
 
-	// Save state
 	state := &shared.AlexaDeviceState{
 		EndpointID: request.Directive.Endpoint.EndpointID,
 		UserID:     userID,
 		DeviceID:   deviceID,
 		Pin:        pin,
-		PowerState: powerState,
 	}
+	if currentState != nil {
+		state.Brightness = currentState.Brightness
+		state.ColorHue = currentState.ColorHue
+		state.ColorSaturation = currentState.ColorSaturation
+		state.PatternMode = currentState.PatternMode
+		state.RestorePatternID = currentState.RestorePatternID
+	}
+
+	// TurnOn plays what the strip had before it was turned off
+	powerState := "OFF"
+	if request.Directive.Header.Name == "TurnOn" {
+		powerState = "ON"
+		if derr := restoreStrip(ctx, userID, device, pin, currentState, particleToken); derr != nil {
+			return failDirective(ctx, request, userID, device, pin, derr)
+		}
+	} else {
+		patternArg := fmt.Sprintf("%d,0,50", device.ResolvePin(pin)) // Pattern 0 is off
+		if err := newTimedCaller(ctx, device, particleToken).Call(device.ParticleID, "setPattern", patternArg); err != nil {
+			log.Printf("Failed to set power: %v", err)
+			return failDirective(ctx, request, userID, device, pin, particleFailure(err))
+		}
+		// Remember the pattern on the strip for the next TurnOn
+		if patternID := stripPatternID(device, pin); patternID != "" {
+			state.RestorePatternID = patternID
+		}
+	}
+
+	// Save state
+	state.PowerState = powerState
 	shared.SaveAlexaDeviceState(ctx, state)
 
 	// Build response
@@ -243,16 +224,21 @@ func handleBrightnessControl(ctx context.Context, request shared.AlexaRequest) (
 		if currentState != nil {
 			currentBrightness = currentState.Brightness
 		}
-		brightness = shared.ClampBrightness(currentBrightness + adjustBrightness.BrightnessDelta)
+		brightness = int(shared.BrightnessPercent(currentBrightness + adjustBrightness.BrightnessDelta).Clamp())
 	}
 
 	// Convert to firmware value (0-255)
-	firmwareBrightness := shared.BrightnessPercentToFirmware(brightness)
+	firmwareBrightness := shared.BrightnessPercent(brightness).Byte()
+
+	// A direct brightness command stops any ramp on the strip
+	if err := shared.CancelStripRamp(ctx, deviceID, pin, "superseded by Alexa brightness command"); err != nil {
+		log.Printf("Failed to cancel ramp on %s: %v", request.Directive.Endpoint.EndpointID, err)
+	}
 
 	// Send command
-	brightnessArg := fmt.Sprintf("%d,%d", pin, firmwareBrightness)
-	if err := callParticleFunction(device.ParticleID, "setBright", brightnessArg, particleToken); err != nil {
-		return createErrorResponse(request, "ENDPOINT_UNREACHABLE", "Failed to set brightness")
+	brightnessArg := fmt.Sprintf("%d,%d", device.ResolvePin(pin), firmwareBrightness)
+	if err := newTimedCaller(ctx, device, particleToken).Call(device.ParticleID, "setBright", brightnessArg); err != nil {
+		return failDirective(ctx, request, userID, device, pin, particleFailure(err))
 	}
 
 	// Save state
@@ -305,14 +291,15 @@ func handleColorControl(ctx context.Context, request shared.AlexaRequest) (inter
 		rgb.R, rgb.G, rgb.B)
 
 	// Send color command
-	colorArg := fmt.Sprintf("%d,%d,%d,%d", pin, rgb.R, rgb.G, rgb.B)
-	if err := callParticleFunction(device.ParticleID, "setColor", colorArg, particleToken); err != nil {
-		return createErrorResponse(request, "ENDPOINT_UNREACHABLE", "Failed to set color")
+	timed := newTimedCaller(ctx, device, particleToken)
+	colorArg := fmt.Sprintf("%d,%d,%d,%d", device.ResolvePin(pin), rgb.R, rgb.G, rgb.B)
+	if err := timed.Call(device.ParticleID, "setColor", colorArg); err != nil {
+		return failDirective(ctx, request, userID, device, pin, particleFailure(err))
 	}
 
 	// Ensure pattern is set to solid for color to show
-	patternArg := fmt.Sprintf("%d,2,50", pin)
-	callParticleFunction(device.ParticleID, "setPattern", patternArg, particleToken)
+	patternArg := fmt.Sprintf("%d,2,50", device.ResolvePin(pin))
+	timed.Call(device.ParticleID, "setPattern", patternArg)
 
 	// Save state
 	state := &shared.AlexaDeviceState{
@@ -323,7 +310,7 @@ func handleColorControl(ctx context.Context, request shared.AlexaRequest) (inter
 		PowerState:      "ON",
 		ColorHue:        setColor.Color.Hue,
 		ColorSaturation: setColor.Color.Saturation,
-		Brightness:      int(setColor.Color.Brightness * 100),
+		Brightness:      int(shared.BrightnessPercentFromFraction(setColor.Color.Brightness)),
 		PatternMode:     shared.AlexaModeSolid,
 	}
 	shared.SaveAlexaDeviceState(ctx, state)
@@ -357,17 +344,8 @@ func handleModeControl(ctx context.Context, request shared.AlexaRequest) (interf
 
 	log.Printf("Setting mode: %s", setMode.Mode)
 
-	// Convert Alexa mode to firmware pattern number
-	patternNum, ok := shared.AlexaModeToPattern[setMode.Mode]
-	if !ok {
-		log.Printf("Unknown mode: %s", setMode.Mode)
-		return createErrorResponse(request, "VALUE_OUT_OF_RANGE", "Unknown mode")
-	}
-
-	// Send pattern command
-	patternArg := fmt.Sprintf("%d,%d,50", pin, patternNum)
-	if err := callParticleFunction(device.ParticleID, "setPattern", patternArg, particleToken); err != nil {
-		return createErrorResponse(request, "ENDPOINT_UNREACHABLE", "Failed to set mode")
+	if derr := applyAlexaMode(ctx, userID, device, pin, setMode.Mode, particleToken); derr != nil {
+		return failDirective(ctx, request, userID, device, pin, derr)
 	}
 
 	// Save state
@@ -418,12 +396,23 @@ func handleReportState(ctx context.Context, request shared.AlexaRequest) (interf
 	return buildStateReportResponse(request, state)
 }
 
-// handleAcceptGrant handles OAuth grant acceptance
+// handleAcceptGrant handles OAuth grant acceptance. Alexa sends it when the
+// skill is linked, from the AWS region serving the user's Alexa region, so
+// that region is recorded on the user for proactive events. Failing to
+// record it doesn't fail the grant; events then go to North America. With
+// proactive events set up, the grant's code is exchanged for the tokens
+// they're sent with, and the grant fails if it can't be, as Alexa expects.
 func handleAcceptGrant(ctx context.Context, request shared.AlexaRequest) (interface{}, error) {
 	log.Printf("=== handleAcceptGrant ===")
 
-	// AcceptGrant is used when proactive state updates are enabled
-	// For now, just acknowledge it
+	if err := recordAlexaRegion(ctx, request); err != nil {
+		log.Printf("AcceptGrant: could not record Alexa region: %v", err)
+	}
+	if err := recordAlexaGrant(ctx, request); err != nil {
+		log.Printf("AcceptGrant: could not record grant: %v", err)
+		return createAcceptGrantError(request, "Failed to exchange the grant code")
+	}
+
 	response := shared.AlexaResponse{
 		Event: shared.AlexaEvent{
 			Header: shared.AlexaHeader{
@@ -439,130 +428,124 @@ func handleAcceptGrant(ctx context.Context, request shared.AlexaRequest) (interf
 	return response, nil
 }
 
-// Helper functions
+// recordAlexaRegion stores the Alexa region of the AcceptGrant's grantee,
+// worked out from the AWS region this Lambda was invoked in
+func recordAlexaRegion(ctx context.Context, request shared.AlexaRequest) error {
+	awsRegion := os.Getenv("AWS_REGION")
+	region := shared.AlexaRegionForAWSRegion(awsRegion)
+	if region == "" {
+		return fmt.Errorf("AWS region %q doesn't serve an Alexa region", awsRegion)
+	}
 
-func buildCapabilities() []shared.AlexaCapability {
-	return []shared.AlexaCapability{
-		{
-			Type:      "AlexaInterface",
-			Interface: "Alexa",
-			Version:   "3",
-		},
-		{
-			Type:      "AlexaInterface",
-			Interface: "Alexa.PowerController",
-			Version:   "3",
-			Properties: &shared.CapabilityProperties{
-				Supported: []shared.SupportedProperty{
-					{Name: "powerState"},
-				},
-				ProactivelyReported: false,
-				Retrievable:         true,
-			},
-		},
-		{
-			Type:      "AlexaInterface",
-			Interface: "Alexa.BrightnessController",
-			Version:   "3",
-			Properties: &shared.CapabilityProperties{
-				Supported: []shared.SupportedProperty{
-					{Name: "brightness"},
-				},
-				ProactivelyReported: false,
-				Retrievable:         true,
-			},
+	token := granteeToken(request)
+	if token == "" {
+		return fmt.Errorf("missing grantee token")
+	}
+
+	userID, err := shared.ValidateAccessToken(ctx, token)
+	if err != nil || userID == "" {
+		return fmt.Errorf("invalid grantee token")
+	}
+
+	client, err := shared.InitDynamoDB()
+	if err != nil {
+		return err
+	}
+	_, err = client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(usersTable),
+		Key: map[string]types.AttributeValue{
+			"username": &types.AttributeValueMemberS{Value: userID},
 		},
-		{
-			Type:      "AlexaInterface",
-			Interface: "Alexa.ColorController",
-			Version:   "3",
-			Properties: &shared.CapabilityProperties{
-				Supported: []shared.SupportedProperty{
-					{Name: "color"},
-				},
-				ProactivelyReported: false,
-				Retrievable:         true,
-			},
+		UpdateExpression:    aws.String("SET alexaRegion = :region"),
+		ConditionExpression: aws.String("attribute_exists(username)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":region": &types.AttributeValueMemberS{Value: region},
 		},
-		{
-			Type:      "AlexaInterface",
-			Interface: "Alexa.ModeController",
-			Instance:  "LightStrip.Pattern",
-			Version:   "3",
-			Properties: &shared.CapabilityProperties{
-				Supported: []shared.SupportedProperty{
-					{Name: "mode"},
-				},
-				ProactivelyReported: false,
-				Retrievable:         true,
-			},
-			CapabilityResources: &shared.CapabilityResources{
-				FriendlyNames: []shared.FriendlyName{
-					{Type: "text", Value: shared.FriendlyNameVal{Text: "pattern", Locale: "en-US"}},
-					{Type: "text", Value: shared.FriendlyNameVal{Text: "effect", Locale: "en-US"}},
-					{Type: "text", Value: shared.FriendlyNameVal{Text: "mode", Locale: "en-US"}},
-				},
-			},
-			Configuration: &shared.ModeConfiguration{
-				Ordered: false,
-				SupportedModes: []shared.SupportedMode{
-					{
-						Value: shared.AlexaModeSolid,
-						ModeResources: &shared.CapabilityResources{
-							FriendlyNames: []shared.FriendlyName{
-								{Type: "text", Value: shared.FriendlyNameVal{Text: "solid", Locale: "en-US"}},
-								{Type: "text", Value: shared.FriendlyNameVal{Text: "static", Locale: "en-US"}},
-							},
-						},
-					},
-					{
-						Value: shared.AlexaModeCandle,
-						ModeResources: &shared.CapabilityResources{
-							FriendlyNames: []shared.FriendlyName{
-								{Type: "text", Value: shared.FriendlyNameVal{Text: "candle", Locale: "en-US"}},
-								{Type: "text", Value: shared.FriendlyNameVal{Text: "flicker", Locale: "en-US"}},
-							},
-						},
-					},
-					{
-						Value: shared.AlexaModePulse,
-						ModeResources: &shared.CapabilityResources{
-							FriendlyNames: []shared.FriendlyName{
-								{Type: "text", Value: shared.FriendlyNameVal{Text: "pulse", Locale: "en-US"}},
-								{Type: "text", Value: shared.FriendlyNameVal{Text: "breathing", Locale: "en-US"}},
-							},
-						},
-					},
-					{
-						Value: shared.AlexaModeWave,
-						ModeResources: &shared.CapabilityResources{
-							FriendlyNames: []shared.FriendlyName{
-								{Type: "text", Value: shared.FriendlyNameVal{Text: "wave", Locale: "en-US"}},
-							},
-						},
-					},
-					{
-						Value: shared.AlexaModeRainbow,
-						ModeResources: &shared.CapabilityResources{
-							FriendlyNames: []shared.FriendlyName{
-								{Type: "text", Value: shared.FriendlyNameVal{Text: "rainbow", Locale: "en-US"}},
-								{Type: "text", Value: shared.FriendlyNameVal{Text: "colorful", Locale: "en-US"}},
-							},
-						},
-					},
-					{
-						Value: shared.AlexaModeFire,
-						ModeResources: &shared.CapabilityResources{
-							FriendlyNames: []shared.FriendlyName{
-								{Type: "text", Value: shared.FriendlyNameVal{Text: "fire", Locale: "en-US"}},
-								{Type: "text", Value: shared.FriendlyNameVal{Text: "flame", Locale: "en-US"}},
-							},
-						},
-					},
-				},
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("AcceptGrant: user %s is in Alexa region %s (event gateway %s)", userID, region, shared.AlexaEventGatewayHost(region))
+	return nil
+}
+
+// handleRevokeGrant handles Alexa telling us the skill was disabled or its
+// account link removed. The grantee's tokens, endpoint states and region are
+// removed, as DELETE /api/settings/alexa-link does, so a later link starts
+// clean. The token may have expired by then; it still identifies the user.
+func handleRevokeGrant(ctx context.Context, request shared.AlexaRequest) (interface{}, error) {
+	log.Printf("=== handleRevokeGrant ===")
+
+	token := granteeToken(request)
+	if token == "" {
+		return createErrorResponse(request, "INVALID_AUTHORIZATION_CREDENTIAL", "Missing grantee token")
+	}
+
+	userID, err := shared.AccessTokenOwner(ctx, token)
+	if err != nil {
+		log.Printf("RevokeGrant: failed to look up token: %v", err)
+		return createErrorResponse(request, "INTERNAL_ERROR", "Failed to revoke grant")
+	}
+	if userID == "" {
+		// Already unlinked, from the settings page or an earlier revocation
+		log.Printf("RevokeGrant: token not found; nothing to revoke")
+	} else if _, err := shared.UnlinkAlexa(ctx, usersTable, userID); err != nil {
+		log.Printf("RevokeGrant: failed to unlink %s: %v", userID, err)
+		return createErrorResponse(request, "INTERNAL_ERROR", "Failed to revoke grant")
+	}
+
+	response := shared.AlexaResponse{
+		Event: shared.AlexaEvent{
+			Header: shared.AlexaHeader{
+				Namespace:      "Alexa.Authorization",
+				Name:           "RevokeGrant.Response",
+				PayloadVersion: "3",
+				MessageID:      uuid.New().String(),
 			},
+			Payload: map[string]interface{}{},
 		},
 	}
+
+	return response, nil
+}
+
+// Helper functions
+
+// granteeToken returns the grantee's access token from an Alexa.Authorization
+// directive, or "" if it has none
+func granteeToken(request shared.AlexaRequest) string {
+	var payload struct {
+		Grantee struct {
+			Token string `json:"token"`
+		} `json:"grantee"`
+	}
+	raw, _ := json.Marshal(request.Directive.Payload)
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		return ""
+	}
+	return payload.Grantee.Token
+}
+
+// checkRemovedEndpoint reports whether a directive targets an endpoint whose
+// strip has been removed, returning the NO_SUCH_ENDPOINT error to send
+func checkRemovedEndpoint(ctx context.Context, request shared.AlexaRequest) (bool, interface{}, error) {
+	endpointID := request.Directive.Endpoint.EndpointID
+	if endpointID == "" {
+		return false, nil, nil
+	}
+
+	tombstone, err := shared.GetAlexaEndpointTombstone(ctx, endpointID)
+	if err != nil {
+		log.Printf("Failed to check tombstone for %s: %v", endpointID, err)
+		return false, nil, nil
+	}
+	if tombstone == nil {
+		return false, nil, nil
+	}
+
+	log.Printf("Directive for removed endpoint %s (removed %s)", endpointID, tombstone.RemovedAt.Format(time.RFC3339))
+	resp, err := createErrorResponse(request, "NO_SUCH_ENDPOINT", "This light was removed; run device discovery to update your devices")
+	return true, resp, err
 }
 
 func validateEndpointToken(ctx context.Context, request shared.AlexaRequest) (string, error) {
@@ -595,20 +578,20 @@ func parseEndpointID(endpointID string) (deviceID string, pin int, err error) {
 	return deviceID, pin, nil
 }
 
-func getUserDevices(ctx context.Context, userID string) ([]shared.Device, error) {
+func getUserPatterns(ctx context.Context, userID string) ([]shared.Pattern, error) {
 	indexName := "userId-index"
-	var devices []shared.Device
+	var patterns []shared.Pattern
 
 	expressionValues := map[string]interface{}{
 		":userId": userID,
 	}
 
 	av, _ := attributevalue.MarshalMap(expressionValues)
-	if err := shared.Query(ctx, devicesTable, &indexName, "userId = :userId", av, &devices); err != nil {
+	if err := shared.Query(ctx, patternsTable, &indexName, "userId = :userId", av, &patterns); err != nil {
 		return nil, err
 	}
 
-	return devices, nil
+	return patterns, nil
 }
 
 func getDeviceAndToken(ctx context.Context, userID, deviceID string) (*shared.Device, string, error) {
@@ -641,6 +624,10 @@ func getDeviceAndToken(ctx context.Context, userID, deviceID string) (*shared.De
 		return nil, "", fmt.Errorf("failed to get user: %v", err)
 	}
 
+	if err := shared.DecryptParticleToken(ctx, usersTable, &user); err != nil {
+		return nil, "", fmt.Errorf("failed to read Particle token: %v", err)
+	}
+
 	if user.ParticleToken == "" {
 		return nil, "", fmt.Errorf("Particle token not configured")
 	}
@@ -805,7 +792,7 @@ func buildStateReportResponse(request shared.AlexaRequest, state *shared.AlexaDe
 			Value: map[string]float64{
 				"hue":        state.ColorHue,
 				"saturation": state.ColorSaturation,
-				"brightness": float64(state.Brightness) / 100,
+				"brightness": shared.BrightnessPercent(state.Brightness).Fraction(),
 			},
 			TimeOfSample:              now,
 			UncertaintyInMilliseconds: 0,
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+
+	"candle-lights/backend/shared"
+)
+
+// stubTables stands in for the tables the Alexa Lambda reads, keeping items
+// as sent, by their key value. Key values are unique across the tables in
+// these tests.
+type stubTables struct {
+	mu    sync.Mutex
+	items map[string]json.RawMessage
+}
+
+// stubKeyAttributes are the tables' hash keys; an item's key is the first of
+// these it has, since Alexa state rows also carry a deviceId
+var stubKeyAttributes = []string{"endpointId", "tokenHash", "patternId", "deviceId", "username"}
+
+func newStubTables(items ...interface{}) *stubTables {
+	s := &stubTables{items: map[string]json.RawMessage{}}
+	for _, item := range items {
+		s.put(item)
+	}
+	return s
+}
+
+func (s *stubTables) put(item interface{}) {
+	var fields map[string]interface{}
+	raw, _ := json.Marshal(shared.DynamoDBStubItem(item))
+	json.Unmarshal(raw, &fields)
+	for _, name := range stubKeyAttributes {
+		if value, ok := fields[name].(map[string]interface{}); ok {
+			s.items[value["S"].(string)] = raw
+			return
+		}
+	}
+	panic(fmt.Sprintf("no key attribute in %s", raw))
+}
+
+func (s *stubTables) handle(call shared.DynamoDBStubCall) (map[string]interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch call.Operation {
+	case "GetItem", "DeleteItem":
+		var key map[string]string
+		if err := call.Unmarshal("Key", &key); err != nil {
+			return nil, err
+		}
+		for _, value := range key {
+			if call.Operation == "DeleteItem" {
+				delete(s.items, value)
+			} else if item, ok := s.items[value]; ok {
+				return map[string]interface{}{"Item": item}, nil
+			}
+		}
+		return nil, nil
+	case "PutItem":
+		var item map[string]interface{}
+		if err := call.Unmarshal("Item", &item); err != nil {
+			return nil, err
+		}
+		for _, name := range stubKeyAttributes {
+			if value, ok := item[name].(string); ok {
+				s.items[value] = call.Input["Item"]
+				return nil, nil
+			}
+		}
+		return nil, fmt.Errorf("no key attribute in %s", call.Input["Item"])
+	case "Query":
+		// The tables share one name here, so a user's query sees all their
+		// rows; rows of another table decode without a key and match nothing
+		var values map[string]interface{}
+		if err := call.Unmarshal("ExpressionAttributeValues", &values); err != nil {
+			return nil, err
+		}
+		var items []json.RawMessage
+		for _, raw := range s.items {
+			var item map[string]interface{}
+			if err := json.Unmarshal(raw, &item); err != nil {
+				return nil, err
+			}
+			if owner, ok := item["userId"].(map[string]interface{}); ok && values[":userId"] != nil && owner["S"] == values[":userId"] {
+				items = append(items, raw)
+			}
+		}
+		return map[string]interface{}{"Items": items, "Count": len(items)}, nil
+	case "BatchWriteItem":
+		var requests map[string][]struct {
+			DeleteRequest struct {
+				Key map[string]map[string]string
+			}
+		}
+		if err := json.Unmarshal(call.Input["RequestItems"], &requests); err != nil {
+			return nil, err
+		}
+		for _, writes := range requests {
+			for _, write := range writes {
+				for _, value := range write.DeleteRequest.Key {
+					delete(s.items, value["S"])
+				}
+			}
+		}
+		return nil, nil
+	}
+	// Counters and the like find nothing
+	return nil, nil
+}
+
+func turnOn(endpointID string) shared.AlexaRequest {
+	return shared.AlexaRequest{Directive: shared.AlexaDirective{
+		Header:   shared.AlexaHeader{Namespace: "Alexa.PowerController", Name: "TurnOn", PayloadVersion: "3", MessageID: "m1"},
+		Endpoint: shared.AlexaEndpoint{EndpointID: endpointID, Scope: shared.AlexaScope{Type: "BearerToken", Token: "expired"}},
+	}}
+}
+
+func errorType(resp interface{}) string {
+	alexaResp, ok := resp.(shared.AlexaResponse)
+	if !ok {
+		return ""
+	}
+	payload, _ := alexaResp.Event.Payload.(shared.ErrorPayload)
+	return payload.Type
+}
+
+func TestDirectivesAfterStripRemoval(t *testing.T) {
+	store := newStubTables()
+	defer shared.StubDynamoDB(store.handle)()
+
+	ctx := context.Background()
+	endpointID := shared.AlexaEndpointID("d1", 6)
+	if err := shared.RemoveAlexaEndpoint(ctx, "d1", 6); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := handler(ctx, turnOn(endpointID))
+	if err != nil || errorType(resp) != "NO_SUCH_ENDPOINT" {
+		t.Errorf("directive to a removed strip = %+v, %v; want NO_SUCH_ENDPOINT", resp, err)
+	}
+
+	// Other strips on the device are handled as usual, reaching the token check
+	resp, _ = handler(ctx, turnOn(shared.AlexaEndpointID("d1", 7)))
+	if got := errorType(resp); got != "INVALID_AUTHORIZATION_CREDENTIAL" {
+		t.Errorf("directive to a remaining strip = %s, want INVALID_AUTHORIZATION_CREDENTIAL", got)
+	}
+
+	// Adding the strip back revives the endpoint
+	if err := shared.ClearAlexaEndpointTombstone(ctx, "d1", 6); err != nil {
+		t.Fatal(err)
+	}
+	resp, _ = handler(ctx, turnOn(endpointID))
+	if got := errorType(resp); got != "INVALID_AUTHORIZATION_CREDENTIAL" {
+		t.Errorf("directive to a re-added strip = %s, want INVALID_AUTHORIZATION_CREDENTIAL", got)
+	}
+}
+
+func TestExpiredTombstoneIsIgnored(t *testing.T) {
+	endpointID := shared.AlexaEndpointID("d1", 6)
+	store := newStubTables()
+	defer shared.StubDynamoDB(store.handle)()
+
+	tombstone, _ := json.Marshal(shared.DynamoDBStubItem(shared.AlexaEndpointTombstone{
+		Key:        "removed#" + endpointID,
+		EndpointID: endpointID,
+		ExpiresAt:  1,
+	}))
+	store.items["removed#"+endpointID] = tombstone
+
+	resp, _ := handler(context.Background(), turnOn(endpointID))
+	if got := errorType(resp); got != "INVALID_AUTHORIZATION_CREDENTIAL" {
+		t.Errorf("directive after the grace period = %s, want INVALID_AUTHORIZATION_CREDENTIAL", got)
+	}
+}
+
+func revokeGrant(token string) shared.AlexaRequest {
+	return shared.AlexaRequest{Directive: shared.AlexaDirective{
+		Header:  shared.AlexaHeader{Namespace: "Alexa.Authorization", Name: "RevokeGrant", PayloadVersion: "3", MessageID: "m1"},
+		Payload: map[string]interface{}{"grantee": map[string]interface{}{"type": "BearerToken", "token": token}},
+	}}
+}
+
+func TestDirectivesFailAfterRevokeGrant(t *testing.T) {
+	store := linkedStrip()
+	endpointID := shared.AlexaEndpointID("d1", 6)
+	store.put(shared.AlexaDeviceState{EndpointID: endpointID, UserID: "lee", DeviceID: "d1", Pin: 6, PowerState: "ON"})
+	defer shared.StubDynamoDB(store.handle)()
+	particle := &particleCalls{}
+	defer particle.serve()()
+
+	ctx := context.Background()
+	if resp, _ := handler(ctx, powerDirective("TurnOff")); errorType(resp) != "" {
+		t.Fatalf("directive before revoking = %s, want it handled", errorType(resp))
+	}
+	particle.take()
+
+	resp, err := handler(ctx, revokeGrant("token"))
+	alexaResp, _ := resp.(shared.AlexaResponse)
+	if err != nil || alexaResp.Event.Header.Name != "RevokeGrant.Response" {
+		t.Fatalf("RevokeGrant = %+v, %v; want RevokeGrant.Response", resp, err)
+	}
+	if _, ok := store.items[endpointID]; ok {
+		t.Error("the endpoint's state survived the revocation")
+	}
+
+	resp, _ = handler(ctx, powerDirective("TurnOn"))
+	if got := errorType(resp); got != "INVALID_AUTHORIZATION_CREDENTIAL" {
+		t.Errorf("directive with the revoked token = %s, want INVALID_AUTHORIZATION_CREDENTIAL", got)
+	}
+	if calls := particle.take(); len(calls) != 0 {
+		t.Errorf("revoked directive reached the device: %v", calls)
+	}
+
+	// Alexa may deliver the revocation again; there's nothing left to do
+	resp, _ = handler(ctx, revokeGrant("token"))
+	if alexaResp, _ := resp.(shared.AlexaResponse); alexaResp.Event.Header.Name != "RevokeGrant.Response" {
+		t.Errorf("repeated RevokeGrant = %+v, want RevokeGrant.Response", resp)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+
+	"candle-lights/backend/shared"
+)
+
+// directiveError is a failed directive, reported to Alexa as an ErrorResponse
+// (see failDirective)
+type directiveError struct {
+	Type    string
+	Message string // Told to the user after the strip's name; keep it short
+	Err     error  // Cause, for the logs
+}
+
+func (e *directiveError) Error() string {
+	return e.Type + ": " + e.Message
+}
+
+// applyAlexaMode plays mode on the strip on pin. Firmware modes map to a
+// built-in pattern number; other modes play the first of the user's
+// patterns that uses a matching effect, sent like any other pattern apply
+// (the strip's speed multiplier, the memory check, its physical pin).
+func applyAlexaMode(ctx context.Context, userID string, device *shared.Device, pin int, mode, particleToken string) *directiveError {
+	timed := newTimedCaller(ctx, device, particleToken)
+	if patternNum, ok := shared.AlexaModeToPattern[mode]; ok {
+		patternArg := fmt.Sprintf("%d,%d,50", device.ResolvePin(pin), patternNum)
+		if err := timed.Call(device.ParticleID, "setPattern", patternArg); err != nil {
+			return particleFailure(err)
+		}
+		return nil
+	}
+
+	patterns, err := getUserPatterns(ctx, userID)
+	if err != nil {
+		log.Printf("Failed to get patterns: %v", err)
+		return &directiveError{"INTERNAL_ERROR", "couldn't load patterns", err}
+	}
+
+	pattern := shared.FindPatternForAlexaMode(patterns, mode)
+	if pattern == nil {
+		log.Printf("Unknown mode: %s", mode)
+		return &directiveError{"VALUE_OUT_OF_RANGE", "unknown mode " + mode, nil}
+	}
+
+	log.Printf("Mode %s uses pattern %s", mode, pattern.Name)
+	warnings, err := shared.ApplyPatternToStrip(*device, pin, stripLEDCount(device, pin), *pattern, timed.Call)
+	for _, warning := range warnings {
+		log.Printf("Mode %s pattern %s: %s", mode, pattern.PatternID, warning)
+	}
+	shared.CountPatternApply("alexa", err == nil)
+	if err != nil {
+		log.Printf("Failed to apply pattern %s: %v", pattern.PatternID, err)
+		return applyFailure(err)
+	}
+	return nil
+}
+
+// restoreStrip turns the strip on pin back on with what it last played: the
+// Alexa mode in state, else the pattern saved at TurnOff or last applied to
+// the strip, else solid when there's no prior state.
+func restoreStrip(ctx context.Context, userID string, device *shared.Device, pin int, state *shared.AlexaDeviceState, particleToken string) *directiveError {
+	if state != nil && state.PatternMode != "" {
+		log.Printf("Restoring mode %s on %s pin %d", state.PatternMode, device.Name, pin)
+		return applyAlexaMode(ctx, userID, device, pin, state.PatternMode, particleToken)
+	}
+
+	timed := newTimedCaller(ctx, device, particleToken)
+	patternID := ""
+	if state != nil {
+		patternID = state.RestorePatternID
+	}
+	if patternID == "" {
+		patternID = stripPatternID(device, pin)
+	}
+
+	if patternID != "" {
+		pattern, err := getOwnedPattern(ctx, userID, patternID)
+		if err != nil {
+			log.Printf("Failed to load pattern %s to restore, using solid: %v", patternID, err)
+		} else if pattern != nil {
+			log.Printf("Restoring pattern %s on %s pin %d", pattern.Name, device.Name, pin)
+			warnings, err := shared.ApplyPatternToStrip(*device, pin, stripLEDCount(device, pin), *pattern, timed.Call)
+			for _, warning := range warnings {
+				log.Printf("Restoring pattern %s: %s", pattern.PatternID, warning)
+			}
+			shared.CountPatternApply("alexa", err == nil)
+			if err != nil {
+				log.Printf("Failed to restore pattern %s: %v", pattern.PatternID, err)
+				return applyFailure(err)
+			}
+			return nil
+		}
+	}
+
+	patternArg := fmt.Sprintf("%d,%d,50", device.ResolvePin(pin), shared.AlexaModeToPattern[shared.AlexaModeSolid])
+	if err := timed.Call(device.ParticleID, "setPattern", patternArg); err != nil {
+		log.Printf("Failed to set power: %v", err)
+		return particleFailure(err)
+	}
+	return nil
+}
+
+// getOwnedPattern loads patternID, returning nil when it's gone or belongs
+// to someone else
+func getOwnedPattern(ctx context.Context, userID, patternID string) (*shared.Pattern, error) {
+	patternKey, _ := attributevalue.MarshalMap(map[string]string{
+		"patternId": patternID,
+	})
+
+	var pattern shared.Pattern
+	if err := shared.GetItem(ctx, patternsTable, patternKey, &pattern); err != nil {
+		return nil, err
+	}
+	if pattern.PatternID == "" || pattern.UserID != userID {
+		return nil, nil
+	}
+	return &pattern, nil
+}
+
+// stripPatternID is the pattern last applied to the strip on pin, if any
+func stripPatternID(device *shared.Device, pin int) string {
+	for _, strip := range device.LEDStrips {
+		if strip.Pin == pin {
+			return strip.PatternID
+		}
+	}
+	return ""
+}
+
+// stripLEDCount is the LED count of the strip on pin, 8 when unknown
+func stripLEDCount(device *shared.Device, pin int) int {
+	ledCount := 8
+	for _, strip := range device.LEDStrips {
+		if strip.Pin == pin && strip.LEDCount > 0 {
+			ledCount = strip.LEDCount
+		}
+	}
+	return ledCount
+}
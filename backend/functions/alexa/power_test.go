@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"candle-lights/backend/shared"
+)
+
+// particleCalls records the cloud function calls the Particle API receives,
+// as "function(argument)" without the command nonce
+type particleCalls struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (p *particleCalls) serve() (restore func()) {
+	return shared.StubParticleAPI(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Arg string `json:"arg"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		argument, _, _ := strings.Cut(body.Arg, shared.CommandNonceSeparator)
+		p.mu.Lock()
+		p.calls = append(p.calls, r.URL.Path[strings.LastIndexByte(r.URL.Path, '/')+1:]+"("+argument+")")
+		p.mu.Unlock()
+		w.Write([]byte(`{"return_value":1}`))
+	})
+}
+
+func (p *particleCalls) take() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	calls := p.calls
+	p.calls = nil
+	return calls
+}
+
+// linkedStrip seeds the tables for lee, linked to Alexa with token "token",
+// owning device d1 with one strip on pin 6
+func linkedStrip() *stubTables {
+	hash := sha256.Sum256([]byte("token"))
+	return newStubTables(
+		shared.OAuthToken{TokenHash: hex.EncodeToString(hash[:]), UserID: "lee", ExpiresAt: time.Now().Add(time.Hour).Unix()},
+		shared.User{Username: "lee", IsActive: true, ParticleToken: "particle-token"},
+		shared.Device{DeviceID: "d1", UserID: "lee", Name: "garage", ParticleID: "p1", FirmwareVersion: "2.4.0",
+			LEDStrips: []shared.LEDStrip{{Pin: 6, LEDCount: 30}}},
+	)
+}
+
+func powerDirective(name string) shared.AlexaRequest {
+	return shared.AlexaRequest{Directive: shared.AlexaDirective{
+		Header:   shared.AlexaHeader{Namespace: "Alexa.PowerController", Name: name, PayloadVersion: "3", MessageID: "m1"},
+		Endpoint: shared.AlexaEndpoint{EndpointID: shared.AlexaEndpointID("d1", 6), Scope: shared.AlexaScope{Type: "BearerToken", Token: "token"}},
+	}}
+}
+
+func TestPowerRoundTripKeepsCandleMode(t *testing.T) {
+	store := linkedStrip()
+	store.put(shared.AlexaDeviceState{EndpointID: shared.AlexaEndpointID("d1", 6), UserID: "lee", DeviceID: "d1", Pin: 6,
+		PowerState: "ON", PatternMode: shared.AlexaModeCandle})
+	defer shared.StubDynamoDB(store.handle)()
+	particle := &particleCalls{}
+	defer particle.serve()()
+
+	ctx := context.Background()
+	for _, step := range []struct {
+		directive string
+		want      []string
+	}{
+		{"TurnOff", []string{"setPattern(6,0,50)"}},
+		{"TurnOn", []string{"setPattern(6,1,50)"}}, // Candle, not solid
+	} {
+		resp, err := handler(ctx, powerDirective(step.directive))
+		if err != nil || errorType(resp) != "" {
+			t.Fatalf("%s = %+v, %v", step.directive, resp, err)
+		}
+		if got := particle.take(); !reflect.DeepEqual(got, step.want) {
+			t.Errorf("%s sent %v, want %v", step.directive, got, step.want)
+		}
+	}
+
+	state, err := shared.GetAlexaDeviceState(ctx, shared.AlexaEndpointID("d1", 6))
+	if err != nil || state == nil || state.PowerState != "ON" || state.PatternMode != shared.AlexaModeCandle {
+		t.Errorf("state after the round trip = %+v, %v; want ON in candle mode", state, err)
+	}
+}
+
+func TestTurnOnWithoutPriorStateIsSolid(t *testing.T) {
+	defer shared.StubDynamoDB(linkedStrip().handle)()
+	particle := &particleCalls{}
+	defer particle.serve()()
+
+	resp, err := handler(context.Background(), powerDirective("TurnOn"))
+	if err != nil || errorType(resp) != "" {
+		t.Fatalf("TurnOn = %+v, %v", resp, err)
+	}
+	if got, want := particle.take(), []string{"setPattern(6,2,50)"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("TurnOn sent %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+    "context"
+    "log"
+
+    "github.com/aws/aws-lambda-go/events"
+
+    "candle-lights/backend/shared"
+)
+
+// AlexaUnlinkResponse is the body of DELETE /api/settings/alexa-link
+type AlexaUnlinkResponse struct {
+    shared.AlexaLinkStatus
+    shared.AlexaUnlinkResult
+}
+
+func handleGetAlexaLink(ctx context.Context, username string, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+    user, errResp := requireUser(ctx, username)
+    if errResp != nil {
+        return *errResp, nil
+    }
+
+    status, err := shared.GetAlexaLinkStatus(ctx, user)
+    if err != nil {
+        log.Printf("GetAlexaLink: Failed to get tokens for %s: %v", username, err)
+        return shared.CreateErrorResponse(500, "Database error"), nil
+    }
+    return shared.CreateSuccessResponse(200, status), nil
+}
+
+// handleUnlinkAlexa revokes the caller's Alexa link from our side: their
+// OAuth tokens, Alexa endpoint states and recorded region are removed, so
+// the skill stops working until it's linked again. Disabling the skill in
+// the Alexa app is still needed to drop the devices there.
+func handleUnlinkAlexa(ctx context.Context, username string, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+    result, err := shared.UnlinkAlexa(ctx, usersTable, username)
+    if err != nil {
+        log.Printf("UnlinkAlexa: Failed to unlink %s: %v", username, err)
+        return shared.CreateErrorResponse(500, "Failed to unlink Alexa"), nil
+    }
+
+    if err := shared.RecordActivity(ctx, shared.ActivityEntry{
+        UserID:  username,
+        Action:  shared.ActivityAlexaUnlinked,
+        Actor:   username,
+        Subject: username,
+    }); err != nil {
+        log.Printf("UnlinkAlexa: Failed to log activity: %v", err)
+    }
+
+    return shared.CreateSuccessResponse(200, AlexaUnlinkResponse{
+        AlexaLinkStatus:   shared.AlexaLinkStatus{LinkStatus: shared.AlexaUnlinked},
+        AlexaUnlinkResult: *result,
+    }), nil
+}
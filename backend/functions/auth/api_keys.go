@@ -0,0 +1,106 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "log"
+    "sort"
+    "strings"
+
+    "github.com/aws/aws-lambda-go/events"
+
+    "candle-lights/backend/shared"
+)
+
+// maxAPIKeysPerUser bounds how many keys one user can hold
+const maxAPIKeysPerUser = 10
+
+// CreateAPIKeyRequest is the body of POST /api/settings/api-keys
+type CreateAPIKeyRequest struct {
+    Label string `json:"label"`
+    Scope string `json:"scope"` // full (default), read-only, devices, or metrics
+}
+
+// CreateAPIKeyResponse carries the new key, which is only ever returned here
+type CreateAPIKeyResponse struct {
+    Key    string        `json:"key"`
+    APIKey shared.APIKey `json:"apiKey"`
+}
+
+func handleCreateAPIKey(ctx context.Context, username string, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+    var createReq CreateAPIKeyRequest
+    if err := json.Unmarshal([]byte(shared.GetRequestBody(request)), &createReq); err != nil {
+        return shared.CreateErrorResponse(400, "Invalid request body"), nil
+    }
+
+    createReq.Label = strings.TrimSpace(createReq.Label)
+    if createReq.Label == "" {
+        return shared.CreateErrorResponse(400, "label is required"), nil
+    }
+    if createReq.Scope == "" {
+        createReq.Scope = shared.APIKeyScopeFull
+    }
+    if !shared.ValidAPIKeyScope(createReq.Scope) {
+        return shared.CreateErrorResponse(400, "scope must be full, read-only, devices, or metrics"), nil
+    }
+    // Metrics keys only reach an admin route
+    if createReq.Scope == shared.APIKeyScopeMetrics {
+        if _, errResp := shared.RequireAdmin(ctx, usersTable, username); errResp != nil {
+            return *errResp, nil
+        }
+    }
+
+    existing, err := shared.ListAPIKeys(ctx, username)
+    if err != nil {
+        log.Printf("CreateAPIKey: Failed to list keys: %v", err)
+        return shared.CreateErrorResponse(500, "Database error"), nil
+    }
+    if len(existing) >= maxAPIKeysPerUser {
+        return shared.CreateErrorResponse(400, "API key limit reached; revoke a key first"), nil
+    }
+
+    apiKey, key, err := shared.CreateAPIKey(ctx, username, createReq.Label, createReq.Scope)
+    if err != nil {
+        log.Printf("CreateAPIKey: Failed to create key: %v", err)
+        return shared.CreateErrorResponse(500, "Failed to create API key"), nil
+    }
+
+    return shared.CreateSuccessResponse(201, CreateAPIKeyResponse{
+        Key:    key,
+        APIKey: *apiKey,
+    }), nil
+}
+
+func handleListAPIKeys(ctx context.Context, username string, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+    keys, err := shared.ListAPIKeys(ctx, username)
+    if err != nil {
+        log.Printf("ListAPIKeys: Failed to list keys: %v", err)
+        return shared.CreateErrorResponse(500, "Database error"), nil
+    }
+
+    sort.Slice(keys, func(i, j int) bool {
+        return keys[i].CreatedAt.After(keys[j].CreatedAt)
+    })
+
+    return shared.CreateSuccessResponse(200, keys), nil
+}
+
+func handleDeleteAPIKey(ctx context.Context, username string, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+    keyID := request.PathParameters["keyId"]
+    if keyID == "" {
+        return shared.CreateErrorResponse(400, "keyId is required"), nil
+    }
+
+    found, err := shared.DeleteAPIKey(ctx, username, keyID)
+    if err != nil {
+        log.Printf("DeleteAPIKey: Failed to revoke key %s: %v", keyID, err)
+        return shared.CreateErrorResponse(500, "Failed to revoke API key"), nil
+    }
+    if !found {
+        return shared.CreateErrorResponse(404, "API key not found"), nil
+    }
+
+    return shared.CreateSuccessResponse(200, map[string]string{
+        "message": "API key revoked",
+    }), nil
+}
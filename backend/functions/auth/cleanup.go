@@ -0,0 +1,297 @@
+package main
+
+import (
+    "context"
+    "encoding/base64"
+    "encoding/json"
+    "fmt"
+    "log"
+    "os"
+    "time"
+
+    "github.com/aws/aws-lambda-go/events"
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+    "github.com/aws/aws-sdk-go-v2/service/dynamodb"
+    "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+    "candle-lights/backend/shared"
+)
+
+var (
+    sessionsTable    = os.Getenv("SESSIONS_TABLE")
+    alexaTokensTable = os.Getenv("ALEXA_TOKENS_TABLE")
+    alexaStateTable  = os.Getenv("ALEXA_STATE_TABLE")
+)
+
+// cleanupPageSize is how many items each cleanup scan page reads
+const cleanupPageSize = 100
+
+// cleanupDeadlineMargin is how close to the invocation deadline a cleanup run
+// stops and hands back a progress token
+const cleanupDeadlineMargin = 5 * time.Second
+
+// cleanupCategory is one kind of orphaned row the cleanup looks for
+type cleanupCategory struct {
+    name  string
+    table func() string
+    key   string // The table's hash key, the only key attribute
+    // orphaned reports whether item should be deleted, given lookups shared
+    // across the run
+    orphaned func(ctx context.Context, item map[string]types.AttributeValue, lookups *cleanupLookups) (bool, error)
+}
+
+// cleanupCategories are checked in this order; progress tokens refer to them
+// by index, so new categories go at the end
+var cleanupCategories = []cleanupCategory{
+    {name: "alexaState", table: func() string { return alexaStateTable }, key: "endpointId", orphaned: orphanedAlexaState},
+    {name: "oauthTokens", table: func() string { return alexaTokensTable }, key: "tokenHash", orphaned: orphanedOAuthToken},
+    {name: "sessions", table: func() string { return sessionsTable }, key: "sessionId", orphaned: orphanedSession},
+}
+
+// CleanupRequest is the body of POST /api/admin/cleanup
+type CleanupRequest struct {
+    DryRun        *bool  `json:"dryRun"`                  // Defaults to true; only false deletes
+    ProgressToken string `json:"progressToken,omitempty"` // From the previous response, to carry on where it stopped
+}
+
+// CleanupCount reports one category's rows for this run
+type CleanupCount struct {
+    Category string `json:"category"`
+    Scanned  int    `json:"scanned"`
+    Orphaned int    `json:"orphaned"`         // Found this run (deleted unless a dry run)
+    Deleted  int    `json:"deleted"`
+    Failed   int    `json:"failed,omitempty"` // Orphaned rows that couldn't be deleted
+}
+
+// CleanupResult is the cleanup response. Each run covers as much as fits in
+// the invocation; counts are for this run only.
+type CleanupResult struct {
+    DryRun        bool           `json:"dryRun"`
+    Complete      bool           `json:"complete"`
+    ProgressToken string         `json:"progressToken,omitempty"` // Set while Complete is false
+    Counts        []CleanupCount `json:"counts"`
+    Errors        []string       `json:"errors,omitempty"`
+}
+
+// cleanupProgress is what a progress token carries
+type cleanupProgress struct {
+    Category int               `json:"c"`
+    StartKey map[string]string `json:"k,omitempty"` // ExclusiveStartKey within the category
+    DryRun   bool              `json:"d"`
+}
+
+func encodeCleanupProgress(p cleanupProgress) string {
+    payload, _ := json.Marshal(p)
+    return base64.RawURLEncoding.EncodeToString(payload)
+}
+
+func decodeCleanupProgress(token string) (cleanupProgress, error) {
+    var p cleanupProgress
+    payload, err := base64.RawURLEncoding.DecodeString(token)
+    if err != nil || json.Unmarshal(payload, &p) != nil || p.Category < 0 || p.Category >= len(cleanupCategories) {
+        return cleanupProgress{}, fmt.Errorf("invalid progressToken")
+    }
+    return p, nil
+}
+
+// cleanupLookups caches whether devices and users exist across a run
+type cleanupLookups struct {
+    devices map[string]bool
+    users   map[string]bool
+}
+
+func (l *cleanupLookups) deviceExists(ctx context.Context, deviceID string) (bool, error) {
+    if exists, ok := l.devices[deviceID]; ok {
+        return exists, nil
+    }
+    key, _ := attributevalue.MarshalMap(map[string]string{"deviceId": deviceID})
+    var device shared.Device
+    if err := shared.GetItem(ctx, devicesTable, key, &device); err != nil {
+        return false, err
+    }
+    l.devices[deviceID] = device.DeviceID != ""
+    return l.devices[deviceID], nil
+}
+
+func (l *cleanupLookups) userExists(ctx context.Context, username string) (bool, error) {
+    if exists, ok := l.users[username]; ok {
+        return exists, nil
+    }
+    key, _ := attributevalue.MarshalMap(map[string]string{"username": username})
+    var user shared.User
+    if err := shared.GetItem(ctx, usersTable, key, &user); err != nil {
+        return false, err
+    }
+    l.users[username] = user.Username != ""
+    return l.users[username], nil
+}
+
+// orphanedAlexaState: state rows for devices that have been deleted
+func orphanedAlexaState(ctx context.Context, item map[string]types.AttributeValue, lookups *cleanupLookups) (bool, error) {
+    var state shared.AlexaDeviceState
+    if err := attributevalue.UnmarshalMap(item, &state); err != nil {
+        return false, err
+    }
+    if state.DeviceID == "" {
+        return false, nil
+    }
+    exists, err := lookups.deviceExists(ctx, state.DeviceID)
+    return !exists, err
+}
+
+// orphanedOAuthToken: tokens past expiry that TTL hasn't removed yet, and
+// tokens of deleted users
+func orphanedOAuthToken(ctx context.Context, item map[string]types.AttributeValue, lookups *cleanupLookups) (bool, error) {
+    var token shared.OAuthToken
+    if err := attributevalue.UnmarshalMap(item, &token); err != nil {
+        return false, err
+    }
+    if token.ExpiresAt > 0 && token.ExpiresAt < time.Now().Unix() {
+        return true, nil
+    }
+    if token.UserID == "" {
+        return false, nil
+    }
+    exists, err := lookups.userExists(ctx, token.UserID)
+    return !exists, err
+}
+
+// orphanedSession: sessions of deleted users
+func orphanedSession(ctx context.Context, item map[string]types.AttributeValue, lookups *cleanupLookups) (bool, error) {
+    var session shared.Session
+    if err := attributevalue.UnmarshalMap(item, &session); err != nil {
+        return false, err
+    }
+    if session.Username == "" {
+        return false, nil
+    }
+    exists, err := lookups.userExists(ctx, session.Username)
+    return !exists, err
+}
+
+// handleCleanup finds rows left behind by deleted devices and users, and
+// deletes them unless dryRun. A run stops before the invocation deadline and
+// returns a progress token; posting it back continues from the same place.
+func handleCleanup(ctx context.Context, username string, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+    var cleanupReq CleanupRequest
+    if body := shared.GetRequestBody(request); body != "" {
+        if err := json.Unmarshal([]byte(body), &cleanupReq); err != nil {
+            return shared.CreateErrorResponse(400, "Invalid request body"), nil
+        }
+    }
+
+    dryRun := cleanupReq.DryRun == nil || *cleanupReq.DryRun
+    progress := cleanupProgress{DryRun: dryRun}
+    if cleanupReq.ProgressToken != "" {
+        var err error
+        progress, err = decodeCleanupProgress(cleanupReq.ProgressToken)
+        if err != nil {
+            return shared.CreateErrorResponse(400, err.Error()), nil
+        }
+        if progress.DryRun != dryRun {
+            return shared.CreateErrorResponse(400, "progressToken is from a run with a different dryRun"), nil
+        }
+    }
+
+    log.Printf("Cleanup: Started by %s, dryRun=%v, from category %d", username, dryRun, progress.Category)
+
+    result := runCleanup(ctx, progress)
+    return shared.CreateSuccessResponse(200, result), nil
+}
+
+// runCleanup works through the categories from progress until done or the
+// deadline is close
+func runCleanup(ctx context.Context, progress cleanupProgress) CleanupResult {
+    result := CleanupResult{DryRun: progress.DryRun}
+    lookups := &cleanupLookups{devices: map[string]bool{}, users: map[string]bool{}}
+
+    client, err := shared.InitDynamoDB()
+    if err != nil {
+        result.Errors = append(result.Errors, "Database error: "+err.Error())
+        result.ProgressToken = encodeCleanupProgress(progress)
+        return result
+    }
+
+    for progress.Category < len(cleanupCategories) {
+        category := cleanupCategories[progress.Category]
+        count := CleanupCount{Category: category.name}
+
+        var startKey map[string]types.AttributeValue
+        if len(progress.StartKey) > 0 {
+            startKey, _ = attributevalue.MarshalMap(progress.StartKey)
+        }
+
+        for {
+            if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < cleanupDeadlineMargin {
+                log.Printf("Cleanup: Stopping before the deadline in %s", category.name)
+                result.Counts = append(result.Counts, count)
+                result.ProgressToken = encodeCleanupProgress(progress)
+                return result
+            }
+
+            page, err := client.Scan(ctx, &dynamodb.ScanInput{
+                TableName:         aws.String(category.table()),
+                Limit:             aws.Int32(cleanupPageSize),
+                ExclusiveStartKey: startKey,
+            })
+            if err != nil {
+                log.Printf("Cleanup: Failed to scan %s: %v", category.name, err)
+                result.Errors = append(result.Errors, fmt.Sprintf("%s: scan failed: %v", category.name, err))
+                result.Counts = append(result.Counts, count)
+                result.ProgressToken = encodeCleanupProgress(progress)
+                return result
+            }
+
+            var orphans []map[string]types.AttributeValue
+            for _, item := range page.Items {
+                count.Scanned++
+                orphaned, err := category.orphaned(ctx, item, lookups)
+                if err != nil {
+                    log.Printf("Cleanup: Failed to check %s item: %v", category.name, err)
+                    result.Errors = append(result.Errors, fmt.Sprintf("%s: %v", category.name, err))
+                    continue
+                }
+                if orphaned {
+                    orphans = append(orphans, map[string]types.AttributeValue{category.key: item[category.key]})
+                }
+            }
+            count.Orphaned += len(orphans)
+
+            if progress.DryRun {
+                if len(orphans) > 0 {
+                    log.Printf("  [DRY RUN] Would delete %d %s rows", len(orphans), category.name)
+                }
+            } else if len(orphans) > 0 {
+                deleted, err := shared.BatchDeleteItems(ctx, category.table(), orphans)
+                count.Deleted += deleted
+                if err != nil {
+                    log.Printf("Cleanup: Failed to delete %s rows: %v", category.name, err)
+                    count.Failed += len(orphans) - deleted
+                    result.Errors = append(result.Errors, fmt.Sprintf("%s: delete failed: %v", category.name, err))
+                }
+            }
+
+            if len(page.LastEvaluatedKey) == 0 {
+                break
+            }
+            startKey = page.LastEvaluatedKey
+            var next map[string]string
+            if err := attributevalue.UnmarshalMap(startKey, &next); err != nil {
+                result.Errors = append(result.Errors, fmt.Sprintf("%s: unreadable scan position: %v", category.name, err))
+                result.Counts = append(result.Counts, count)
+                result.ProgressToken = encodeCleanupProgress(progress)
+                return result
+            }
+            progress.StartKey = next
+        }
+
+        log.Printf("Cleanup: %s scanned=%d, orphaned=%d, deleted=%d, failed=%d", category.name, count.Scanned, count.Orphaned, count.Deleted, count.Failed)
+        result.Counts = append(result.Counts, count)
+        progress.Category++
+        progress.StartKey = nil
+    }
+
+    result.Complete = true
+    return result
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "log"
+    "time"
+
+    "github.com/aws/aws-lambda-go/events"
+
+    "candle-lights/backend/shared"
+)
+
+// UpdateFeatureFlagsRequest is the body of PUT /api/admin/users/{username}/flags.
+// Each flag given is set on the user; null clears it, so the user follows the
+// global default again. Flags not given are left as they are.
+type UpdateFeatureFlagsRequest struct {
+    Flags map[string]*bool `json:"flags"`
+}
+
+// FeatureFlagsResponse is a user's own flags and what they resolve to
+type FeatureFlagsResponse struct {
+    Username     string          `json:"username,omitempty"`
+    FeatureFlags map[string]bool `json:"featureFlags,omitempty"` // The user's overrides
+    Features     map[string]bool `json:"features"`               // Every known feature, resolved
+}
+
+// handleGetFeatures returns which features are on for the caller, so the
+// frontend can hide what isn't
+func handleGetFeatures(ctx context.Context, username string, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+    user, errResp := requireUser(ctx, username)
+    if errResp != nil {
+        return *errResp, nil
+    }
+    return shared.CreateSuccessResponse(200, FeatureFlagsResponse{Features: user.Features()}), nil
+}
+
+// handleUpdateFeatureFlags sets or clears a user's feature flags. Admin only.
+func handleUpdateFeatureFlags(ctx context.Context, adminName string, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+    username := request.PathParameters["username"]
+    if username == "" {
+        return shared.CreateErrorResponse(400, "Username is required"), nil
+    }
+
+    var req UpdateFeatureFlagsRequest
+    if err := json.Unmarshal([]byte(shared.GetRequestBody(request)), &req); err != nil {
+        return shared.CreateErrorResponse(400, "Invalid request body"), nil
+    }
+    if len(req.Flags) == 0 {
+        return shared.CreateErrorResponse(400, "flags is required"), nil
+    }
+    for feature := range req.Flags {
+        if !shared.IsKnownFeature(feature) {
+            return shared.CreateErrorResponse(400, "Unknown feature: "+feature), nil
+        }
+    }
+
+    user, errResp := requireUser(ctx, username)
+    if errResp != nil {
+        return *errResp, nil
+    }
+
+    if user.FeatureFlags == nil {
+        user.FeatureFlags = make(map[string]bool)
+    }
+    for feature, enabled := range req.Flags {
+        if enabled == nil {
+            delete(user.FeatureFlags, feature)
+        } else {
+            user.FeatureFlags[feature] = *enabled
+        }
+    }
+    if len(user.FeatureFlags) == 0 {
+        user.FeatureFlags = nil
+    }
+    user.UpdatedAt = time.Now()
+
+    if err := shared.PutItem(ctx, usersTable, user); err != nil {
+        log.Printf("UpdateFeatureFlags: Failed to save user: %v", err)
+        return shared.CreateErrorResponse(500, "Failed to update user"), nil
+    }
+
+    log.Printf("UpdateFeatureFlags: %s set flags for user %s: %v", adminName, username, shared.SortedFeatureFlags(user.FeatureFlags))
+    return shared.CreateSuccessResponse(200, FeatureFlagsResponse{
+        Username:     username,
+        FeatureFlags: user.FeatureFlags,
+        Features:     user.Features(),
+    }), nil
+}
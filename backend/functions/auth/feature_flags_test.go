@@ -0,0 +1,102 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "reflect"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/aws/aws-lambda-go/events"
+
+    "candle-lights/backend/shared"
+)
+
+// stubUsers answers session and user lookups for sessions "session-<name>",
+// and keeps the users PutItem saves
+type stubUsers map[string]shared.User
+
+func (s stubUsers) handle(call shared.DynamoDBStubCall) (map[string]interface{}, error) {
+    switch call.Operation {
+    case "GetItem":
+        var key struct {
+            SessionID string `dynamodbav:"sessionId"`
+            Username  string `dynamodbav:"username"`
+        }
+        if err := call.Unmarshal("Key", &key); err != nil {
+            return nil, err
+        }
+        if name, ok := strings.CutPrefix(key.SessionID, "session-"); ok && s[name].Username != "" {
+            user := s[name]
+            return map[string]interface{}{"Item": shared.DynamoDBStubItem(shared.Session{
+                SessionID: key.SessionID,
+                Username:  user.Username,
+                CreatedAt: time.Now(),
+                ExpiresAt: time.Now().Add(time.Hour).Unix(),
+            })}, nil
+        }
+        if user, ok := s[key.Username]; ok {
+            return map[string]interface{}{"Item": shared.DynamoDBStubItem(user)}, nil
+        }
+    case "PutItem":
+        var user shared.User
+        if err := call.Unmarshal("Item", &user); err != nil {
+            return nil, err
+        }
+        s[user.Username] = user
+    }
+    return nil, nil
+}
+
+func TestFeatureFlagEndpoints(t *testing.T) {
+    t.Setenv("FEATURE_FLAGS", "sync=true,playlists=true")
+    users := stubUsers{
+        "admin": {Username: "admin", IsActive: true, IsAdmin: true},
+        "lee":   {Username: "lee", IsActive: true, FeatureFlags: map[string]bool{shared.FeaturePlaylists: false}},
+    }
+    defer shared.StubDynamoDB(users.handle)()
+
+    call := func(session, method, path, body string) (int, FeatureFlagsResponse) {
+        t.Helper()
+        resp, err := handler(context.Background(), events.APIGatewayProxyRequest{
+            HTTPMethod:     method,
+            Path:           path,
+            PathParameters: map[string]string{"username": "lee"},
+            Headers:        map[string]string{"Authorization": "Bearer " + session},
+            Body:           body,
+        })
+        if err != nil {
+            t.Fatal(err)
+        }
+        var parsed struct {
+            Data FeatureFlagsResponse `json:"data"`
+        }
+        json.Unmarshal([]byte(resp.Body), &parsed)
+        return resp.StatusCode, parsed.Data
+    }
+
+    // lee's own flag turns playlists off despite the default
+    status, got := call("session-lee", "GET", "/api/settings/features", "")
+    want := map[string]bool{shared.FeaturePlaylists: false, shared.FeatureSync: true, shared.FeatureZones: false}
+    if status != 200 || !reflect.DeepEqual(got.Features, want) {
+        t.Errorf("lee's features = %d %v, want %v", status, got.Features, want)
+    }
+
+    // Turning zones on and clearing the playlists override
+    status, got = call("session-admin", "PUT", "/api/admin/users/lee/flags", `{"flags":{"zones":true,"playlists":null}}`)
+    if status != 200 || !reflect.DeepEqual(got.FeatureFlags, map[string]bool{shared.FeatureZones: true}) {
+        t.Errorf("update = %d, flags %v; want only zones set", status, got.FeatureFlags)
+    }
+    status, got = call("session-lee", "GET", "/api/settings/features", "")
+    want = map[string]bool{shared.FeaturePlaylists: true, shared.FeatureSync: true, shared.FeatureZones: true}
+    if status != 200 || !reflect.DeepEqual(got.Features, want) {
+        t.Errorf("lee's features after the update = %d %v, want %v", status, got.Features, want)
+    }
+
+    for _, body := range []string{`{"flags":{"teleport":true}}`, `{"flags":{}}`, `not json`} {
+        if status, _ := call("session-admin", "PUT", "/api/admin/users/lee/flags", body); status != 400 {
+            t.Errorf("update with %s = %d, want 400", body, status)
+        }
+    }
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+    "context"
+    "log"
+    "sort"
+
+    "github.com/aws/aws-lambda-go/events"
+
+    "candle-lights/backend/shared"
+)
+
+// unknownFirmwareVersion groups devices that have never reported a version
+const unknownFirmwareVersion = "unknown"
+
+// FirmwareReport is the response of GET /api/admin/firmware-report
+type FirmwareReport struct {
+    TotalDevices int                     `json:"totalDevices"`
+    Versions     []FirmwareVersionCount  `json:"versions"`   // Newest first, with unknown and unparseable versions last
+    Advisories   []FirmwareAdvisoryCount `json:"advisories"` // Devices affected by each known issue
+}
+
+// FirmwareVersionCount is how many devices run one firmware version
+type FirmwareVersionCount struct {
+    Version  string                   `json:"version"`
+    Count    int                      `json:"count"`
+    Advisory *shared.FirmwareAdvisory `json:"advisory,omitempty"`
+}
+
+// FirmwareAdvisoryCount is how many devices one advisory applies to
+type FirmwareAdvisoryCount struct {
+    shared.FirmwareAdvisory
+    Count int `json:"count"`
+}
+
+// handleFirmwareReport counts devices by firmware version across every user,
+// to follow a rollout and find devices on versions with known issues
+func handleFirmwareReport(ctx context.Context, username string, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+    // This scans every device; it's an admin-only endpoint
+    var devices []shared.Device
+    if err := shared.Scan(ctx, devicesTable, &devices); err != nil {
+        log.Printf("FirmwareReport: Failed to scan devices: %v", err)
+        return shared.CreateErrorResponse(500, "Failed to load devices"), nil
+    }
+
+    return shared.CreateSuccessResponse(200, buildFirmwareReport(devices)), nil
+}
+
+// buildFirmwareReport tallies devices by version. Advisories are evaluated
+// now rather than read from the records, so newly listed issues count.
+func buildFirmwareReport(devices []shared.Device) FirmwareReport {
+    report := FirmwareReport{
+        TotalDevices: len(devices),
+        Versions:     []FirmwareVersionCount{},
+        Advisories:   []FirmwareAdvisoryCount{},
+    }
+
+    versionCounts := map[string]int{}
+    for _, device := range devices {
+        version := device.FirmwareVersion
+        if version == "" {
+            version = unknownFirmwareVersion
+        }
+        versionCounts[version]++
+    }
+
+    advisoryIndex := map[string]int{}
+    for version, count := range versionCounts {
+        entry := FirmwareVersionCount{Version: version, Count: count}
+        if version != unknownFirmwareVersion {
+            entry.Advisory = shared.FirmwareAdvisoryFor(version)
+        }
+        report.Versions = append(report.Versions, entry)
+
+        if entry.Advisory == nil {
+            continue
+        }
+        i, ok := advisoryIndex[entry.Advisory.ID]
+        if !ok {
+            i = len(report.Advisories)
+            advisoryIndex[entry.Advisory.ID] = i
+            report.Advisories = append(report.Advisories, FirmwareAdvisoryCount{FirmwareAdvisory: *entry.Advisory})
+        }
+        report.Advisories[i].Count += count
+    }
+
+    sort.Slice(report.Versions, func(i, j int) bool {
+        a, b := report.Versions[i].Version, report.Versions[j].Version
+        if a == unknownFirmwareVersion || b == unknownFirmwareVersion {
+            return b == unknownFirmwareVersion && a != unknownFirmwareVersion
+        }
+        return shared.CompareFirmwareVersions(a, b) > 0
+    })
+    sort.Slice(report.Advisories, func(i, j int) bool {
+        return report.Advisories[i].ID < report.Advisories[j].ID
+    })
+    return report
+}
@@ -3,10 +3,14 @@ package main
 import (
     "context"
     "encoding/json"
+    "errors"
     "fmt"
     "log"
     "os"
+    "sort"
+    "strings"
     "time"
+    _ "time/tzdata" // Quiet hours timezones
 
     "github.com/aws/aws-lambda-go/events"
     "github.com/aws/aws-lambda-go/lambda"
@@ -15,35 +19,156 @@ import (
     "candle-lights/backend/shared"
 )
 
-var usersTable = os.Getenv("USERS_TABLE")
+var (
+    usersTable         = os.Getenv("USERS_TABLE")
+    notificationsTable = os.Getenv("NOTIFICATIONS_TABLE")
+)
 
-func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
-    path := request.Path
-    method := request.HTTPMethod
+var router = newRouter()
+
+// newRouter registers the account, settings and admin routes
+func newRouter() *shared.Router {
+    r := shared.NewRouter("Auth")
+
+    // Sign-in: these authenticate the caller themselves
+    r.MustHandle("POST", shared.PathEquals("/api/auth/login"), shared.PolicyPublic,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleLogin(rc.Ctx, rc.Request)
+        })
+    r.MustHandle("POST", shared.PathEquals("/api/auth/register"), shared.PolicyPublic,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleRegister(rc.Ctx, rc.Request)
+        })
+    r.MustHandle("POST", shared.PathEquals("/api/auth/validate"), shared.PolicyPublic,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleValidate(rc.Ctx, rc.Request)
+        })
+    r.MustHandle("POST", shared.PathEquals("/api/auth/refresh"), shared.PolicyPublic,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleRefresh(rc.Ctx, rc.Request)
+        })
+    r.MustHandle("POST", shared.PathEquals("/api/auth/2fa/setup"), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleTwoFactorSetup(rc.Ctx, rc.Username, rc.Request)
+        })
+    r.MustHandle("POST", shared.PathEquals("/api/auth/2fa/confirm"), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleTwoFactorConfirm(rc.Ctx, rc.Username, rc.Request)
+        })
+    r.MustHandle("POST", shared.PathEquals("/api/auth/2fa/verify"), shared.PolicyPublic,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleTwoFactorVerify(rc.Ctx, rc.Request)
+        })
+
+    // Account settings
+    r.MustHandle("POST", shared.PathEquals("/api/settings/particle"), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleUpdateParticleSettings(rc.Ctx, rc.Username, rc.Request)
+        })
+    r.MustHandle("GET", shared.PathEquals("/api/settings/support-access"), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleGetSupportAccess(rc.Ctx, rc.Username, rc.Request)
+        })
+    r.MustHandle("POST", shared.PathEquals("/api/settings/support-access"), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleGrantSupportAccess(rc.Ctx, rc.Username, rc.Request)
+        })
+    r.MustHandle("DELETE", shared.PathEquals("/api/settings/support-access"), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleRevokeSupportAccess(rc.Ctx, rc.Username, rc.Request)
+        })
+    r.MustHandle("GET", shared.PathEquals("/api/settings/alexa-link"), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleGetAlexaLink(rc.Ctx, rc.Username, rc.Request)
+        })
+    r.MustHandle("DELETE", shared.PathEquals("/api/settings/alexa-link"), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleUnlinkAlexa(rc.Ctx, rc.Username, rc.Request)
+        })
+    r.MustHandle("GET", shared.PathEquals("/api/settings/features"), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleGetFeatures(rc.Ctx, rc.Username, rc.Request)
+        })
+    r.MustHandle("GET", shared.PathEquals("/api/settings/activity"), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleListActivity(rc.Ctx, rc.Username, rc.Request)
+        })
+    r.MustHandle("GET", shared.PathEquals("/api/settings/api-keys"), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleListAPIKeys(rc.Ctx, rc.Username, rc.Request)
+        })
+    r.MustHandle("POST", shared.PathEquals("/api/settings/api-keys"), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleCreateAPIKey(rc.Ctx, rc.Username, rc.Request)
+        })
+    r.MustHandle("DELETE", shared.PathPrefix("/api/settings/api-keys/"), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleDeleteAPIKey(rc.Ctx, rc.Username, rc.Request)
+        })
+    r.MustHandle("GET", shared.PathEquals("/api/settings/notifications"), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleGetNotificationSettings(rc.Ctx, rc.Username, rc.Request)
+        })
+    r.MustHandle("PUT", shared.PathEquals("/api/settings/notifications"), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleUpdateNotificationSettings(rc.Ctx, rc.Username, rc.Request)
+        })
+
+    // Administration
+    r.MustHandle("POST", shared.MatchAll(shared.PathPrefix("/api/admin/users/"), shared.PathSuffix("/suspend")), shared.PolicyAdmin,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleSetUserActive(rc.Ctx, rc.Username, rc.Request, false)
+        })
+    r.MustHandle("POST", shared.MatchAll(shared.PathPrefix("/api/admin/users/"), shared.PathSuffix("/unsuspend")), shared.PolicyAdmin,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleSetUserActive(rc.Ctx, rc.Username, rc.Request, true)
+        })
+    r.MustHandle("PUT", shared.MatchAll(shared.PathPrefix("/api/admin/users/"), shared.PathSuffix("/flags")), shared.PolicyAdmin,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleUpdateFeatureFlags(rc.Ctx, rc.Username, rc.Request)
+        })
+    r.MustHandle("POST", shared.PathPrefix("/api/admin/impersonate/"), shared.PolicyAdmin,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleImpersonate(rc.Ctx, rc.Username, rc.Request)
+        })
+    r.MustHandle("POST", shared.PathEquals("/api/admin/cleanup"), shared.PolicyAdmin,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleCleanup(rc.Ctx, rc.Username, rc.Request)
+        })
+    r.MustHandle("GET", shared.PathEquals("/api/admin/metrics"), shared.PolicyAdmin,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleMetrics(rc.Ctx, rc.Username, rc.Request)
+        })
+    r.MustHandle("GET", shared.PathEquals("/api/admin/firmware-report"), shared.PolicyAdmin,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleFirmwareReport(rc.Ctx, rc.Username, rc.Request)
+        })
+
+    // Notifications; unsubscribe links carry their own signed token
+    r.MustHandle("GET", shared.PathEquals("/api/notifications"), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleListNotifications(rc.Ctx, rc.Username, rc.Request)
+        })
+    r.MustHandle("GET", shared.PathEquals("/api/notifications/unsubscribe"), shared.PolicyPublic,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleUnsubscribe(rc.Ctx, rc.Request)
+        })
+    r.MustHandle("POST", shared.PathSuffix("/read"), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleMarkNotificationRead(rc.Ctx, rc.Username, rc.Request)
+        })
+
+    return r
+}
 
+func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
     log.Printf("=== Auth Handler Called ===")
-    log.Printf("Path: %s", path)
-    log.Printf("Method: %s", method)
+    log.Printf("Path: %s", request.Path)
+    log.Printf("Method: %s", request.HTTPMethod)
     log.Printf("Source IP: %s", request.RequestContext.Identity.SourceIP)
     log.Printf("User Agent: %s", request.Headers["User-Agent"])
 
-    switch {
-    case path == "/api/auth/login" && method == "POST":
-        log.Println("Routing to handleLogin")
-        return handleLogin(ctx, request)
-    case path == "/api/auth/register" && method == "POST":
-        log.Println("Routing to handleRegister")
-        return handleRegister(ctx, request)
-    case path == "/api/auth/validate" && method == "POST":
-        log.Println("Routing to handleValidate")
-        return handleValidate(ctx, request)
-    case path == "/api/settings/particle" && method == "POST":
-        log.Println("Routing to handleUpdateParticleSettings")
-        return handleUpdateParticleSettings(ctx, request)
-    default:
-        log.Printf("No matching route for path: %s, method: %s", path, method)
-        return shared.CreateErrorResponse(404, "Not found"), nil
-    }
+    return router.Dispatch(ctx, request)
 }
 
 func handleLogin(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
@@ -86,22 +211,32 @@ func handleLogin(ctx context.Context, request events.APIGatewayProxyRequest) (ev
 
     log.Printf("handleLogin: Password validated successfully for user: %s", user.Username)
 
-    // Check if password needs re-hashing (migration from cost 14 to 10)
-    if shared.NeedsRehash(user.PasswordHash) {
-        log.Printf("handleLogin: Migrating password hash for user: %s", user.Username)
-        newHash, err := shared.HashPassword(loginReq.Password)
-        if err == nil {
-            user.PasswordHash = newHash
-            user.UpdatedAt = time.Now()
-            if err := shared.PutItem(ctx, usersTable, user); err != nil {
-                log.Printf("handleLogin: Failed to update user password hash: %v", err)
-                // Continue login even if update fails
-            } else {
-                log.Printf("handleLogin: Successfully migrated password hash for user: %s", user.Username)
-            }
-        } else {
-            log.Printf("handleLogin: Failed to generate new hash for migration: %v", err)
+    suspended, err := shared.IsAccountSuspended(ctx, user.Username)
+    if err != nil {
+        log.Printf("handleLogin: Failed to check account status: %v", err)
+        return shared.CreateErrorResponse(500, "Database error"), nil
+    }
+    if suspended {
+        log.Printf("handleLogin: Account suspended: %s", user.Username)
+        return shared.AuthErrorResponse(shared.ErrAccountSuspended), nil
+    }
+
+    // Bring the stored hash to the configured bcrypt cost
+    shared.RehashPasswordIfNeeded(ctx, usersTable, &user, loginReq.Password)
+
+    // With 2FA the session is only created by handleTwoFactorVerify
+    if user.TwoFactorEnabled() {
+        token, err := shared.StartTwoFactorLogin(ctx, usersTable, user.Username, loginReq.RememberMe)
+        if err != nil {
+            log.Printf("handleLogin: Failed to start two-factor login: %v", err)
+            return shared.CreateErrorResponse(500, "Failed to start login"), nil
         }
+        log.Printf("handleLogin: Two-factor code required for user: %s", user.Username)
+        return shared.CreateSuccessResponse(200, TwoFactorPendingResponse{
+            TwoFactorRequired: true,
+            PendingToken:      token,
+            ExpiresIn:         int64(shared.TwoFactorPendingLoginDuration.Seconds()),
+        }), nil
     }
 
     // Create session
@@ -109,7 +244,7 @@ func handleLogin(ctx context.Context, request events.APIGatewayProxyRequest) (ev
     ipAddress := request.RequestContext.Identity.SourceIP
     log.Printf("handleLogin: Creating session for user: %s from IP: %s", user.Username, ipAddress)
 
-    session, err := shared.CreateSession(ctx, user.Username, userAgent, ipAddress)
+    session, err := shared.CreateSession(ctx, user.Username, userAgent, ipAddress, loginReq.RememberMe)
     if err != nil {
         log.Printf("handleLogin: Failed to create session: %v", err)
         return shared.CreateErrorResponse(500, "Failed to create session"), nil
@@ -117,10 +252,7 @@ func handleLogin(ctx context.Context, request events.APIGatewayProxyRequest) (ev
 
     log.Printf("handleLogin: Login successful for user: %s", user.Username)
 
-    response := shared.LoginResponse{
-        Token:    session.SessionID,
-        Username: user.Username,
-    }
+    response := newLoginResponse(session)
 
     return shared.CreateSuccessResponse(200, response), nil
 }
@@ -180,6 +312,7 @@ func handleRegister(ctx context.Context, request events.APIGatewayProxyRequest)
     user := shared.User{
         Username:     registerReq.Username,
         PasswordHash: passwordHash,
+        IsActive:     true,
         CreatedAt:    time.Now(),
         UpdatedAt:    time.Now(),
     }
@@ -197,7 +330,7 @@ func handleRegister(ctx context.Context, request events.APIGatewayProxyRequest)
     ipAddress := request.RequestContext.Identity.SourceIP
     log.Printf("handleRegister: Creating session for new user: %s from IP: %s", user.Username, ipAddress)
 
-    session, err := shared.CreateSession(ctx, user.Username, userAgent, ipAddress)
+    session, err := shared.CreateSession(ctx, user.Username, userAgent, ipAddress, false)
     if err != nil {
         log.Printf("handleRegister: Failed to create session: %v", err)
         return shared.CreateErrorResponse(500, "Failed to create session"), nil
@@ -205,10 +338,7 @@ func handleRegister(ctx context.Context, request events.APIGatewayProxyRequest)
 
     log.Printf("handleRegister: Registration successful for user: %s", user.Username)
 
-    response := shared.LoginResponse{
-        Token:    session.SessionID,
-        Username: user.Username,
-    }
+    response := newLoginResponse(session)
 
     return shared.CreateSuccessResponse(201, response), nil
 }
@@ -219,6 +349,9 @@ func handleValidate(ctx context.Context, request events.APIGatewayProxyRequest)
     username, err := shared.ValidateAuth(ctx, request)
     if err != nil {
         log.Printf("handleValidate: Auth validation failed: %v", err)
+        if errors.Is(err, shared.ErrAccountSuspended) {
+            return shared.AuthErrorResponse(err), nil
+        }
         return shared.CreateErrorResponse(401, "Invalid session"), nil
     }
 
@@ -229,20 +362,79 @@ func handleValidate(ctx context.Context, request events.APIGatewayProxyRequest)
 
     log.Printf("handleValidate: Session validated successfully for user: %s", username)
 
-    return shared.CreateSuccessResponse(200, map[string]string{
+    response := map[string]string{
         "username": username,
         "valid":    "true",
-    }), nil
+    }
+    if admin := shared.ImpersonatorFromContext(ctx); admin != "" {
+        response["impersonation"] = "true"
+        response["impersonatedBy"] = admin
+    }
+    return shared.CreateSuccessResponse(200, response), nil
 }
 
-func handleUpdateParticleSettings(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
-    // Validate authentication
-    username, err := shared.ValidateAuth(ctx, request)
+// handleRefresh replaces the caller's session with a fresh one (see
+// shared.RefreshSession) and returns it so the frontend can update its cookie
+func handleRefresh(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+    log.Println("=== handleRefresh: Starting ===")
+
+    sessionID := shared.GetSessionID(request)
+    if sessionID == "" {
+        return shared.CreateErrorResponse(401, "No session provided"), nil
+    }
+
+    current, err := shared.GetSession(ctx, sessionID)
     if err != nil {
-        log.Printf("UpdateParticleSettings: Auth validation failed: %v", err)
-        return shared.CreateErrorResponse(401, "Unauthorized"), nil
+        log.Printf("handleRefresh: Failed to look up session: %v", err)
+        return shared.CreateErrorResponse(500, "Failed to refresh session"), nil
+    }
+    if current == nil {
+        return shared.CreateErrorResponse(401, "Invalid session"), nil
+    }
+
+    // Suspended accounts keep their session but can't extend it. This checks
+    // the account directly rather than through ValidateAuth, which could
+    // rotate the session before the refresh below rotates it again.
+    suspended, err := shared.IsAccountSuspended(ctx, current.Username)
+    if err != nil {
+        log.Printf("handleRefresh: Failed to check account status: %v", err)
+        return shared.CreateErrorResponse(500, "Database error"), nil
+    }
+    if suspended {
+        return shared.AuthErrorResponse(shared.ErrAccountSuspended), nil
+    }
+
+    session, err := shared.RefreshSession(ctx, sessionID)
+    if err != nil {
+        log.Printf("handleRefresh: Failed to refresh session: %v", err)
+        return shared.CreateErrorResponse(500, "Failed to refresh session"), nil
+    }
+
+    if session == nil {
+        return shared.CreateErrorResponse(401, "Invalid session"), nil
+    }
+
+    return shared.CreateSuccessResponse(200, newLoginResponse(session)), nil
+}
+
+// newLoginResponse describes a session to the frontend
+func newLoginResponse(session *shared.Session) shared.LoginResponse {
+    expiresIn := session.ExpiresAt - time.Now().Unix()
+    if expiresIn < 0 {
+        expiresIn = 0
+    }
+
+    return shared.LoginResponse{
+        Token:          session.SessionID,
+        Username:       session.Username,
+        ExpiresAt:      session.ExpiresAt,
+        ExpiresIn:      expiresIn,
+        Impersonation:  session.Impersonation,
+        ImpersonatedBy: session.ImpersonatedBy,
     }
+}
 
+func handleUpdateParticleSettings(ctx context.Context, username string, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
     log.Printf("UpdateParticleSettings: User %s updating particle token", username)
 
     var updateReq struct {
@@ -250,8 +442,6 @@ func handleUpdateParticleSettings(ctx context.Context, request events.APIGateway
     }
 
     body := shared.GetRequestBody(request)
-    log.Printf("UpdateParticleSettings: Request body: %s", body)
-
     if err := json.Unmarshal([]byte(body), &updateReq); err != nil {
         log.Printf("UpdateParticleSettings: Failed to parse request: %v", err)
         return shared.CreateErrorResponse(400, "Invalid request body"), nil
@@ -282,14 +472,9 @@ func handleUpdateParticleSettings(ctx context.Context, request events.APIGateway
 
     log.Printf("UpdateParticleSettings: Found user %s, updating token", username)
 
-    // Update particle token
-    user.ParticleToken = updateReq.ParticleToken
-    user.UpdatedAt = time.Now()
-
-    log.Printf("UpdateParticleSettings: Attempting to save user to DynamoDB")
-    if err := shared.PutItem(ctx, usersTable, user); err != nil {
-        log.Printf("UpdateParticleSettings: Failed to update user in DynamoDB: %v", err)
-        return shared.CreateErrorResponse(500, fmt.Sprintf("Failed to update settings: %v", err)), nil
+    if err := shared.SaveParticleToken(ctx, usersTable, &user, updateReq.ParticleToken); err != nil {
+        log.Printf("UpdateParticleSettings: Failed to save token: %v", err)
+        return shared.CreateErrorResponse(500, "Failed to save Particle token"), nil
     }
 
     log.Printf("UpdateParticleSettings: Successfully updated token for user %s", username)
@@ -298,6 +483,236 @@ func handleUpdateParticleSettings(ctx context.Context, request events.APIGateway
     }), nil
 }
 
+// handleSetUserActive suspends or reinstates a user. Admin only.
+func handleSetUserActive(ctx context.Context, adminName string, request events.APIGatewayProxyRequest, active bool) (events.APIGatewayProxyResponse, error) {
+    username := request.PathParameters["username"]
+    if username == "" {
+        return shared.CreateErrorResponse(400, "Username is required"), nil
+    }
+
+    if username == adminName && !active {
+        return shared.CreateErrorResponse(400, "Cannot suspend your own account"), nil
+    }
+
+    key, _ := attributevalue.MarshalMap(map[string]string{
+        "username": username,
+    })
+
+    var user shared.User
+    if err := shared.GetItem(ctx, usersTable, key, &user); err != nil {
+        log.Printf("SetUserActive: Failed to get user: %v", err)
+        return shared.CreateErrorResponse(500, "Database error"), nil
+    }
+
+    if user.Username == "" {
+        return shared.CreateErrorResponse(404, "User not found"), nil
+    }
+
+    user.IsActive = active
+    user.UpdatedAt = time.Now()
+    if err := shared.PutItem(ctx, usersTable, user); err != nil {
+        log.Printf("SetUserActive: Failed to save user: %v", err)
+        return shared.CreateErrorResponse(500, "Failed to update user"), nil
+    }
+
+    log.Printf("SetUserActive: %s set isActive=%v for user %s", adminName, active, username)
+    return shared.CreateSuccessResponse(200, map[string]interface{}{
+        "username": username,
+        "isActive": active,
+    }), nil
+}
+
+// NotificationSettingsResponse is the body of the notification settings endpoints
+type NotificationSettingsResponse struct {
+    Email string `json:"email"`
+    shared.NotificationSettings
+}
+
+func handleGetNotificationSettings(ctx context.Context, username string, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+    key, _ := attributevalue.MarshalMap(map[string]string{
+        "username": username,
+    })
+
+    var user shared.User
+    if err := shared.GetItem(ctx, usersTable, key, &user); err != nil {
+        log.Printf("GetNotificationSettings: Failed to get user: %v", err)
+        return shared.CreateErrorResponse(500, "Database error"), nil
+    }
+
+    if user.Username == "" {
+        return shared.CreateErrorResponse(404, "User not found"), nil
+    }
+
+    resp := NotificationSettingsResponse{
+        Email: user.Email,
+        NotificationSettings: shared.NotificationSettings{
+            ThresholdMinutes: shared.DefaultOfflineThresholdMinutes,
+        },
+    }
+    if user.NotificationSettings != nil {
+        resp.NotificationSettings = *user.NotificationSettings
+    }
+
+    return shared.CreateSuccessResponse(200, resp), nil
+}
+
+func handleUpdateNotificationSettings(ctx context.Context, username string, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+    var updateReq NotificationSettingsResponse
+    body := shared.GetRequestBody(request)
+    if err := json.Unmarshal([]byte(body), &updateReq); err != nil {
+        return shared.CreateErrorResponse(400, "Invalid request body"), nil
+    }
+
+    updateReq.Email = strings.TrimSpace(updateReq.Email)
+    if updateReq.Email != "" && !strings.Contains(updateReq.Email, "@") {
+        return shared.CreateErrorResponse(400, "Invalid email address"), nil
+    }
+
+    settings := updateReq.NotificationSettings
+    if err := settings.Validate(); err != nil {
+        return shared.CreateErrorResponse(400, err.Error()), nil
+    }
+    if settings.ThresholdMinutes == 0 {
+        settings.ThresholdMinutes = shared.DefaultOfflineThresholdMinutes
+    }
+
+    key, _ := attributevalue.MarshalMap(map[string]string{
+        "username": username,
+    })
+
+    var user shared.User
+    if err := shared.GetItem(ctx, usersTable, key, &user); err != nil {
+        log.Printf("UpdateNotificationSettings: Failed to get user: %v", err)
+        return shared.CreateErrorResponse(500, "Database error"), nil
+    }
+
+    if user.Username == "" {
+        return shared.CreateErrorResponse(404, "User not found"), nil
+    }
+
+    if user.Email != updateReq.Email {
+        user.EmailVerified = false
+    }
+    user.Email = updateReq.Email
+    user.NotificationSettings = &settings
+    user.UpdatedAt = time.Now()
+
+    if err := shared.PutItem(ctx, usersTable, user); err != nil {
+        log.Printf("UpdateNotificationSettings: Failed to save user: %v", err)
+        return shared.CreateErrorResponse(500, "Failed to update settings"), nil
+    }
+
+    log.Printf("UpdateNotificationSettings: Updated settings for user %s (offlineAlerts=%v, weeklySummary=%v)", username, settings.OfflineAlerts, settings.WeeklySummary)
+    return shared.CreateSuccessResponse(200, NotificationSettingsResponse{
+        Email:                user.Email,
+        NotificationSettings: settings,
+    }), nil
+}
+
+func handleListNotifications(ctx context.Context, username string, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+    notifications, err := shared.GetUserNotifications(ctx, username)
+    if err != nil {
+        log.Printf("ListNotifications: Failed to query notifications: %v", err)
+        return shared.CreateErrorResponse(500, "Failed to retrieve notifications"), nil
+    }
+
+    if request.QueryStringParameters["unread"] == "true" {
+        unread := []shared.Notification{}
+        for _, n := range notifications {
+            if !n.Read {
+                unread = append(unread, n)
+            }
+        }
+        notifications = unread
+    }
+
+    // Newest first
+    sort.Slice(notifications, func(i, j int) bool {
+        return notifications[i].CreatedAt.After(notifications[j].CreatedAt)
+    })
+    if notifications == nil {
+        notifications = []shared.Notification{}
+    }
+
+    return shared.CreateSuccessResponse(200, notifications), nil
+}
+
+func handleMarkNotificationRead(ctx context.Context, username string, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+    notificationID := request.PathParameters["notificationId"]
+    key, _ := attributevalue.MarshalMap(map[string]string{
+        "notificationId": notificationID,
+    })
+
+    var notification shared.Notification
+    if err := shared.GetItem(ctx, notificationsTable, key, &notification); err != nil {
+        log.Printf("MarkNotificationRead: Failed to get notification: %v", err)
+        return shared.CreateErrorResponse(500, "Database error"), nil
+    }
+
+    if notification.NotificationID == "" || notification.UserID != username {
+        return shared.CreateErrorResponse(404, "Notification not found"), nil
+    }
+
+    notification.Read = true
+    if err := shared.PutItem(ctx, notificationsTable, notification); err != nil {
+        log.Printf("MarkNotificationRead: Failed to save notification: %v", err)
+        return shared.CreateErrorResponse(500, "Failed to update notification"), nil
+    }
+
+    return shared.CreateSuccessResponse(200, notification), nil
+}
+
+// handleUnsubscribe turns off the email named by a signed unsubscribe token.
+// It's the link in the email itself, so it needs no session and answers
+// with a page rather than JSON. Repeating it is harmless.
+func handleUnsubscribe(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+    target, err := shared.ParseUnsubscribeToken(request.QueryStringParameters["token"])
+    if err != nil {
+        log.Printf("Unsubscribe: Rejected token: %v", err)
+        return unsubscribePage(400, "This unsubscribe link is not valid. You can change your email settings on the settings page."), nil
+    }
+    if target.Email != shared.EmailWeeklySummary {
+        return unsubscribePage(400, "This unsubscribe link is not valid. You can change your email settings on the settings page."), nil
+    }
+
+    key, _ := attributevalue.MarshalMap(map[string]string{
+        "username": target.UserID,
+    })
+
+    var user shared.User
+    if err := shared.GetItem(ctx, usersTable, key, &user); err != nil {
+        log.Printf("Unsubscribe: Failed to get user: %v", err)
+        return unsubscribePage(500, "Something went wrong. Please try the link again later."), nil
+    }
+    if user.Username == "" {
+        return unsubscribePage(404, "This account no longer exists."), nil
+    }
+
+    if user.NotificationSettings != nil && user.NotificationSettings.WeeklySummary {
+        user.NotificationSettings.WeeklySummary = false
+        user.UpdatedAt = time.Now()
+        if err := shared.PutItem(ctx, usersTable, user); err != nil {
+            log.Printf("Unsubscribe: Failed to save user: %v", err)
+            return unsubscribePage(500, "Something went wrong. Please try the link again later."), nil
+        }
+        log.Printf("Unsubscribe: User %s unsubscribed from %s", user.Username, target.Email)
+    }
+
+    return unsubscribePage(200, "You won't receive the weekly summary email any more. You can turn it back on from the settings page."), nil
+}
+
+// unsubscribePage is a minimal HTML page for the unsubscribe link
+func unsubscribePage(statusCode int, message string) events.APIGatewayProxyResponse {
+    body := fmt.Sprintf(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Email preferences</title></head>
+<body><p>%s</p></body></html>`, message)
+    return events.APIGatewayProxyResponse{
+        StatusCode: statusCode,
+        Headers:    map[string]string{"Content-Type": "text/html; charset=utf-8"},
+        Body:       body,
+    }
+}
+
 func main() {
-    lambda.Start(handler)
+    lambda.Start(shared.WithMetrics("auth", shared.WithSessionRotation(shared.WithActivityLog(handler))))
 }
@@ -0,0 +1,87 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "testing"
+    "time"
+
+    "github.com/aws/aws-lambda-go/events"
+
+    "candle-lights/backend/shared"
+)
+
+func TestAdminRoutesRefuseOtherUsers(t *testing.T) {
+    restore := shared.StubDynamoDB(func(call shared.DynamoDBStubCall) (map[string]interface{}, error) {
+        if call.Operation != "GetItem" {
+            return nil, fmt.Errorf("unexpected %s", call.Operation)
+        }
+        var key struct {
+            SessionID string `dynamodbav:"sessionId"`
+            Username  string `dynamodbav:"username"`
+        }
+        if err := call.Unmarshal("Key", &key); err != nil {
+            return nil, err
+        }
+        if key.SessionID == "session-lee" {
+            return map[string]interface{}{"Item": shared.DynamoDBStubItem(shared.Session{
+                SessionID: key.SessionID,
+                Username:  "lee",
+                CreatedAt: time.Now(),
+                ExpiresAt: time.Now().Add(time.Hour).Unix(),
+            })}, nil
+        }
+        if key.Username == "lee" {
+            return map[string]interface{}{"Item": shared.DynamoDBStubItem(shared.User{Username: "lee", IsActive: true})}, nil
+        }
+        return nil, nil
+    })
+    defer restore()
+
+    routes := []struct{ method, path string }{
+        {"POST", "/api/admin/users/sam/suspend"},
+        {"POST", "/api/admin/users/sam/unsuspend"},
+        {"PUT", "/api/admin/users/sam/flags"},
+        {"POST", "/api/admin/impersonate/sam"},
+        {"POST", "/api/admin/cleanup"},
+        {"GET", "/api/admin/metrics"},
+        {"GET", "/api/admin/firmware-report"},
+    }
+    for _, route := range routes {
+        for _, caller := range []struct {
+            session    string
+            wantStatus int
+        }{{"", 401}, {"session-lee", 403}} {
+            request := events.APIGatewayProxyRequest{HTTPMethod: route.method, Path: route.path}
+            if caller.session != "" {
+                request.Headers = map[string]string{"Authorization": "Bearer " + caller.session}
+            }
+            resp, err := handler(context.Background(), request)
+            if err != nil || resp.StatusCode != caller.wantStatus {
+                t.Errorf("%s %s with %q = %d, %v; want %d", route.method, route.path, caller.session, resp.StatusCode, err, caller.wantStatus)
+            }
+        }
+    }
+}
+
+func TestForeignNotificationLooksMissing(t *testing.T) {
+    defer shared.StubDynamoDB(shared.StubOwnershipHandler("lee", "foreign", "sam"))()
+
+    var responses [2]events.APIGatewayProxyResponse
+    for i, id := range []string{"foreign", "missing"} {
+        resp, err := handler(context.Background(), events.APIGatewayProxyRequest{
+            HTTPMethod:     "POST",
+            Path:           "/api/notifications/" + id + "/read",
+            PathParameters: map[string]string{"notificationId": id},
+            Headers:        map[string]string{"Authorization": "Bearer session-lee"},
+        })
+        if err != nil {
+            t.Fatal(err)
+        }
+        responses[i] = resp
+    }
+    if responses[0].StatusCode != 404 || responses[0].Body != responses[1].Body {
+        t.Errorf("foreign = %d %s, missing = %d %s; want the same 404",
+            responses[0].StatusCode, responses[0].Body, responses[1].StatusCode, responses[1].Body)
+    }
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+    "context"
+    "log"
+    "os"
+
+    "github.com/aws/aws-lambda-go/events"
+
+    "candle-lights/backend/shared"
+)
+
+var devicesTable = os.Getenv("DEVICES_TABLE")
+
+// prometheusContentType is the Prometheus text exposition format
+const prometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// handleMetrics serves the metric totals in the Prometheus text format.
+// Callers must be admins, with a session or an API key; a metrics scoped key
+// can reach nothing else.
+func handleMetrics(ctx context.Context, username string, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+    series, err := shared.LoadMetricTotals(ctx)
+    if err != nil {
+        log.Printf("Metrics: Failed to load totals: %v", err)
+        return shared.CreateErrorResponse(500, "Failed to load metrics"), nil
+    }
+
+    // Online devices is a point-in-time gauge, so it's read now rather than
+    // accumulated. This scans every device; it's an admin-only endpoint.
+    var devices []shared.Device
+    if err := shared.Scan(ctx, devicesTable, &devices); err != nil {
+        log.Printf("Metrics: Failed to scan devices: %v", err)
+        return shared.CreateErrorResponse(500, "Failed to load metrics"), nil
+    }
+    online := 0
+    for _, device := range devices {
+        if device.IsOnline {
+            online++
+        }
+    }
+    series[shared.MetricDevicesOnline] = float64(online)
+
+    return events.APIGatewayProxyResponse{
+        StatusCode: 200,
+        Headers: map[string]string{
+            "Content-Type":                prometheusContentType,
+            "Access-Control-Allow-Origin": "*",
+        },
+        Body: shared.RenderPrometheus(series),
+    }, nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "log"
+    "time"
+
+    "github.com/aws/aws-lambda-go/events"
+
+    "candle-lights/backend/shared"
+)
+
+// GrantSupportAccessRequest is the body of POST /api/settings/support-access
+type GrantSupportAccessRequest struct {
+    Hours int `json:"hours,omitempty"` // Defaults to 24; at most 168
+}
+
+// SupportAccessResponse describes a user's support access grant
+type SupportAccessResponse struct {
+    Active    bool       `json:"active"`
+    GrantedAt *time.Time `json:"grantedAt,omitempty"`
+    ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+func newSupportAccessResponse(user shared.User) SupportAccessResponse {
+    if !user.SupportAccessActive(time.Now()) {
+        return SupportAccessResponse{}
+    }
+    return SupportAccessResponse{
+        Active:    true,
+        GrantedAt: user.SupportAccessGrantedAt,
+        ExpiresAt: user.SupportAccessExpiresAt,
+    }
+}
+
+// requireUser loads a user with getUser, or returns the error response to send
+func requireUser(ctx context.Context, username string) (*shared.User, *events.APIGatewayProxyResponse) {
+    user, err := getUser(ctx, username)
+    if err != nil {
+        log.Printf("requireUser: Failed to get user %s: %v", username, err)
+        resp := shared.CreateErrorResponse(500, "Database error")
+        return nil, &resp
+    }
+    if user == nil {
+        resp := shared.CreateErrorResponse(404, "User not found")
+        return nil, &resp
+    }
+    return user, nil
+}
+
+func handleGetSupportAccess(ctx context.Context, username string, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+    user, errResp := requireUser(ctx, username)
+    if errResp != nil {
+        return *errResp, nil
+    }
+    return shared.CreateSuccessResponse(200, newSupportAccessResponse(*user)), nil
+}
+
+// handleGrantSupportAccess lets admins impersonate the caller for the
+// requested number of hours. Granting again replaces the current grant.
+func handleGrantSupportAccess(ctx context.Context, username string, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+    var grantReq GrantSupportAccessRequest
+    if body := shared.GetRequestBody(request); body != "" {
+        if err := json.Unmarshal([]byte(body), &grantReq); err != nil {
+            return shared.CreateErrorResponse(400, "Invalid request body"), nil
+        }
+    }
+
+    duration := shared.DefaultSupportAccessDuration
+    if grantReq.Hours != 0 {
+        duration = time.Duration(grantReq.Hours) * time.Hour
+        if grantReq.Hours < 1 || duration > shared.MaxSupportAccessDuration {
+            return shared.CreateErrorResponse(400, "hours must be between 1 and 168"), nil
+        }
+    }
+
+    user, errResp := requireUser(ctx, username)
+    if errResp != nil {
+        return *errResp, nil
+    }
+
+    now := time.Now()
+    expiresAt := now.Add(duration)
+    user.SupportAccessGrantedAt = &now
+    user.SupportAccessExpiresAt = &expiresAt
+    user.UpdatedAt = now
+    if err := shared.PutItem(ctx, usersTable, user); err != nil {
+        log.Printf("GrantSupportAccess: Failed to save user: %v", err)
+        return shared.CreateErrorResponse(500, "Failed to grant support access"), nil
+    }
+
+    if err := shared.RecordActivity(ctx, shared.ActivityEntry{
+        UserID:  username,
+        Action:  shared.ActivitySupportAccessGranted,
+        Actor:   username,
+        Subject: username,
+    }); err != nil {
+        log.Printf("GrantSupportAccess: Failed to log activity: %v", err)
+    }
+
+    log.Printf("GrantSupportAccess: %s granted support access until %v", username, expiresAt)
+    return shared.CreateSuccessResponse(200, newSupportAccessResponse(*user)), nil
+}
+
+// handleRevokeSupportAccess ends the caller's grant. Impersonation sessions
+// under it stop working at once (see shared.ValidateAuth).
+func handleRevokeSupportAccess(ctx context.Context, username string, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+    user, errResp := requireUser(ctx, username)
+    if errResp != nil {
+        return *errResp, nil
+    }
+
+    if user.SupportAccessExpiresAt == nil {
+        return shared.CreateSuccessResponse(200, SupportAccessResponse{}), nil
+    }
+
+    user.SupportAccessGrantedAt = nil
+    user.SupportAccessExpiresAt = nil
+    user.UpdatedAt = time.Now()
+    if err := shared.PutItem(ctx, usersTable, user); err != nil {
+        log.Printf("RevokeSupportAccess: Failed to save user: %v", err)
+        return shared.CreateErrorResponse(500, "Failed to revoke support access"), nil
+    }
+
+    if err := shared.RecordActivity(ctx, shared.ActivityEntry{
+        UserID:  username,
+        Action:  shared.ActivitySupportAccessRevoked,
+        Actor:   username,
+        Subject: username,
+    }); err != nil {
+        log.Printf("RevokeSupportAccess: Failed to log activity: %v", err)
+    }
+
+    log.Printf("RevokeSupportAccess: %s revoked support access", username)
+    return shared.CreateSuccessResponse(200, SupportAccessResponse{}), nil
+}
+
+// handleImpersonate issues the calling admin a session acting as the user in
+// the path, provided that user has granted support access. The session ends
+// with the grant, and everything it changes is logged for both of them.
+func handleImpersonate(ctx context.Context, adminName string, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+    username := request.PathParameters["username"]
+    if username == "" {
+        return shared.CreateErrorResponse(400, "Username is required"), nil
+    }
+    if username == adminName {
+        return shared.CreateErrorResponse(400, "Cannot impersonate your own account"), nil
+    }
+
+    target, errResp := requireUser(ctx, username)
+    if errResp != nil {
+        return *errResp, nil
+    }
+
+    if !target.SupportAccessActive(time.Now()) {
+        log.Printf("Impersonate: %s has not granted support access; refusing %s", username, adminName)
+        return shared.CreateErrorResponse(403, "User has not granted support access"), nil
+    }
+
+    session, err := shared.CreateImpersonationSession(ctx, target, adminName,
+        request.Headers["User-Agent"], request.RequestContext.Identity.SourceIP)
+    if err != nil {
+        log.Printf("Impersonate: Failed to create session: %v", err)
+        return shared.CreateErrorResponse(500, "Failed to create session"), nil
+    }
+
+    shared.RecordImpersonatedActivity(ctx, shared.ActivityEntry{
+        Action:  shared.ActivityImpersonationStarted,
+        Actor:   adminName,
+        Subject: username,
+    })
+
+    return shared.CreateSuccessResponse(200, newLoginResponse(session)), nil
+}
+
+func handleListActivity(ctx context.Context, username string, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+    entries, err := shared.GetUserActivity(ctx, username)
+    if err != nil {
+        log.Printf("ListActivity: Failed to get activity: %v", err)
+        return shared.CreateErrorResponse(500, "Database error"), nil
+    }
+    if entries == nil {
+        entries = []shared.ActivityEntry{}
+    }
+    return shared.CreateSuccessResponse(200, entries), nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "log"
+    "strings"
+    "time"
+
+    "github.com/aws/aws-lambda-go/events"
+    "github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+
+    "candle-lights/backend/shared"
+)
+
+// TwoFactorSetupResponse is returned by POST /api/auth/2fa/setup. The secret
+// is shown for manual entry; otpauthUri is what the QR code encodes.
+type TwoFactorSetupResponse struct {
+    Secret     string `json:"secret"`
+    OTPAuthURI string `json:"otpauthUri"`
+}
+
+// TwoFactorConfirmRequest is the body of POST /api/auth/2fa/confirm
+type TwoFactorConfirmRequest struct {
+    Code string `json:"code"`
+}
+
+// TwoFactorConfirmResponse carries the recovery codes, which are only ever
+// returned here
+type TwoFactorConfirmResponse struct {
+    Enabled       bool     `json:"enabled"`
+    RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+// TwoFactorVerifyRequest is the body of POST /api/auth/2fa/verify. Code is a
+// TOTP code or a recovery code.
+type TwoFactorVerifyRequest struct {
+    PendingToken string `json:"pendingToken"`
+    Code         string `json:"code"`
+}
+
+// TwoFactorPendingResponse is what handleLogin returns instead of a session
+// for users with 2FA enabled
+type TwoFactorPendingResponse struct {
+    TwoFactorRequired bool   `json:"twoFactorRequired"`
+    PendingToken      string `json:"pendingToken"`
+    ExpiresIn         int64  `json:"expiresIn"`
+}
+
+// getUser loads a user record, returning nil when there isn't one
+func getUser(ctx context.Context, username string) (*shared.User, error) {
+    key, _ := attributevalue.MarshalMap(map[string]string{
+        "username": username,
+    })
+
+    var user shared.User
+    if err := shared.GetItem(ctx, usersTable, key, &user); err != nil {
+        return nil, err
+    }
+    if user.Username == "" {
+        return nil, nil
+    }
+    return &user, nil
+}
+
+// twoFactorErrorResponse maps errors from the shared 2FA helpers
+func twoFactorErrorResponse(err error) events.APIGatewayProxyResponse {
+    switch {
+    case errors.Is(err, shared.ErrTwoFactorRateLimited):
+        return shared.CreateErrorResponse(429, err.Error())
+    case errors.Is(err, shared.ErrTwoFactorAlreadyEnabled):
+        return shared.CreateErrorResponse(409, err.Error())
+    case errors.Is(err, shared.ErrTwoFactorNotConfigured):
+        return shared.CreateErrorResponse(503, err.Error())
+    default:
+        return shared.CreateErrorResponse(500, "Database error")
+    }
+}
+
+func handleTwoFactorSetup(ctx context.Context, username string, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+    secret, err := shared.GenerateTOTPSecret()
+    if err != nil {
+        log.Printf("TwoFactorSetup: Failed to generate secret: %v", err)
+        return shared.CreateErrorResponse(500, "Failed to start two-factor setup"), nil
+    }
+    encrypted, err := shared.EncryptTwoFactorSecret(secret)
+    if err != nil {
+        log.Printf("TwoFactorSetup: Failed to encrypt secret: %v", err)
+        return twoFactorErrorResponse(err), nil
+    }
+
+    if err := shared.StartTwoFactorSetup(ctx, usersTable, username, encrypted); err != nil {
+        log.Printf("TwoFactorSetup: Failed to save pending secret for %s: %v", username, err)
+        return twoFactorErrorResponse(err), nil
+    }
+
+    return shared.CreateSuccessResponse(200, TwoFactorSetupResponse{
+        Secret:     secret,
+        OTPAuthURI: shared.TOTPProvisioningURI(username, secret),
+    }), nil
+}
+
+func handleTwoFactorConfirm(ctx context.Context, username string, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+    var confirmReq TwoFactorConfirmRequest
+    if err := json.Unmarshal([]byte(shared.GetRequestBody(request)), &confirmReq); err != nil {
+        return shared.CreateErrorResponse(400, "Invalid request body"), nil
+    }
+    if strings.TrimSpace(confirmReq.Code) == "" {
+        return shared.CreateErrorResponse(400, "code is required"), nil
+    }
+
+    user, err := getUser(ctx, username)
+    if err != nil {
+        log.Printf("TwoFactorConfirm: Failed to get user: %v", err)
+        return shared.CreateErrorResponse(500, "Database error"), nil
+    }
+    if user == nil || user.TwoFactor == nil || user.TwoFactor.PendingSecret == "" {
+        if user != nil && user.TwoFactorEnabled() {
+            return twoFactorErrorResponse(shared.ErrTwoFactorAlreadyEnabled), nil
+        }
+        return shared.CreateErrorResponse(400, "Start two-factor setup first"), nil
+    }
+
+    if err := shared.CountTwoFactorAttempt(ctx, usersTable, username); err != nil {
+        log.Printf("TwoFactorConfirm: Attempt not counted for %s: %v", username, err)
+        return twoFactorErrorResponse(err), nil
+    }
+
+    secret, err := shared.DecryptTwoFactorSecret(user.TwoFactor.PendingSecret)
+    if err != nil {
+        log.Printf("TwoFactorConfirm: Failed to decrypt pending secret: %v", err)
+        return twoFactorErrorResponse(err), nil
+    }
+    step, ok := shared.VerifyTOTP(secret, confirmReq.Code, time.Now(), 0)
+    if !ok {
+        return shared.CreateErrorResponse(401, "Invalid code"), nil
+    }
+
+    codes, hashes, err := shared.GenerateRecoveryCodes()
+    if err != nil {
+        log.Printf("TwoFactorConfirm: Failed to generate recovery codes: %v", err)
+        return shared.CreateErrorResponse(500, "Failed to enable two-factor authentication"), nil
+    }
+
+    if err := shared.EnableTwoFactor(ctx, usersTable, username, user.TwoFactor, hashes, step); err != nil {
+        log.Printf("TwoFactorConfirm: Failed to enable 2FA for %s: %v", username, err)
+        return shared.CreateErrorResponse(500, "Failed to enable two-factor authentication"), nil
+    }
+
+    log.Printf("TwoFactorConfirm: Two-factor authentication enabled for %s", username)
+
+    return shared.CreateSuccessResponse(200, TwoFactorConfirmResponse{
+        Enabled:       true,
+        RecoveryCodes: codes,
+    }), nil
+}
+
+// handleTwoFactorVerify exchanges the pendingToken from handleLogin and a
+// TOTP or recovery code for a session
+func handleTwoFactorVerify(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+    var verifyReq TwoFactorVerifyRequest
+    if err := json.Unmarshal([]byte(shared.GetRequestBody(request)), &verifyReq); err != nil {
+        return shared.CreateErrorResponse(400, "Invalid request body"), nil
+    }
+    if strings.TrimSpace(verifyReq.Code) == "" {
+        return shared.CreateErrorResponse(400, "code is required"), nil
+    }
+
+    username, hash, ok := shared.ParsePendingLoginToken(verifyReq.PendingToken)
+    if !ok {
+        return shared.CreateErrorResponse(401, "Invalid or expired login"), nil
+    }
+
+    user, err := getUser(ctx, username)
+    if err != nil {
+        log.Printf("TwoFactorVerify: Failed to get user: %v", err)
+        return shared.CreateErrorResponse(500, "Database error"), nil
+    }
+    if user == nil || !user.TwoFactorEnabled() ||
+        user.TwoFactor.PendingLoginHash != hash ||
+        time.Now().Unix() > user.TwoFactor.PendingLoginExpiresAt {
+        return shared.CreateErrorResponse(401, "Invalid or expired login"), nil
+    }
+
+    if err := shared.CountTwoFactorAttempt(ctx, usersTable, username); err != nil {
+        log.Printf("TwoFactorVerify: Attempt not counted for %s: %v", username, err)
+        return twoFactorErrorResponse(err), nil
+    }
+
+    tf := user.TwoFactor
+    use, valid, err := shared.VerifySecondFactor(tf, verifyReq.Code, time.Now())
+    if err != nil {
+        log.Printf("TwoFactorVerify: Failed to check code: %v", err)
+        return twoFactorErrorResponse(err), nil
+    }
+    if !valid {
+        log.Printf("TwoFactorVerify: Invalid code for %s", username)
+        return shared.CreateErrorResponse(401, "Invalid code"), nil
+    }
+
+    use.PendingLoginHash = hash
+    if err := shared.SaveTwoFactorUse(ctx, usersTable, username, tf, use); err != nil {
+        log.Printf("TwoFactorVerify: Failed to save 2FA use for %s: %v", username, err)
+        if errors.Is(err, shared.ErrTwoFactorCodeUsed) {
+            return shared.CreateErrorResponse(401, "Invalid or expired login"), nil
+        }
+        return shared.CreateErrorResponse(500, "Database error"), nil
+    }
+
+    suspended, err := shared.IsAccountSuspended(ctx, username)
+    if err != nil {
+        log.Printf("TwoFactorVerify: Failed to check account status: %v", err)
+        return shared.CreateErrorResponse(500, "Database error"), nil
+    }
+    if suspended {
+        return shared.AuthErrorResponse(shared.ErrAccountSuspended), nil
+    }
+
+    userAgent := request.Headers["User-Agent"]
+    ipAddress := request.RequestContext.Identity.SourceIP
+    session, err := shared.CreateSession(ctx, username, userAgent, ipAddress, tf.PendingRememberMe)
+    if err != nil {
+        log.Printf("TwoFactorVerify: Failed to create session: %v", err)
+        return shared.CreateErrorResponse(500, "Failed to create session"), nil
+    }
+
+    log.Printf("TwoFactorVerify: Login successful for user: %s", username)
+
+    return shared.CreateSuccessResponse(200, newLoginResponse(session)), nil
+}
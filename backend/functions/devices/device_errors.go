@@ -0,0 +1,70 @@
+package main
+
+import (
+    "context"
+    "log"
+    "strings"
+    "time"
+
+    "github.com/aws/aws-lambda-go/events"
+    "github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+
+    "candle-lights/backend/shared"
+)
+
+// defaultDeviceErrorRange is how far back the errors list looks without ?from=
+const defaultDeviceErrorRange = 7 * 24 * time.Hour
+
+// handleListDeviceErrors returns errors the device reported, newest first.
+// ?code= filters by error code; ?from= and ?to= (RFC 3339) bound the range.
+func handleListDeviceErrors(ctx context.Context, username, deviceID string, query map[string]string) (events.APIGatewayProxyResponse, error) {
+    key, _ := attributevalue.MarshalMap(map[string]string{
+        "deviceId": deviceID,
+    })
+
+    var device shared.Device
+    if err := shared.GetItem(ctx, devicesTable, key, &device); err != nil {
+        return shared.CreateErrorResponse(500, "Database error"), nil
+    }
+
+    // Verify ownership
+    if device.DeviceID == "" || device.UserID != username {
+        return shared.CreateErrorResponse(404, "Device not found"), nil
+    }
+
+    to := time.Now()
+    if raw := query["to"]; raw != "" {
+        t, err := time.Parse(time.RFC3339, raw)
+        if err != nil {
+            return shared.CreateErrorResponse(400, "to must be an RFC 3339 time"), nil
+        }
+        to = t
+    }
+    from := to.Add(-defaultDeviceErrorRange)
+    if raw := query["from"]; raw != "" {
+        t, err := time.Parse(time.RFC3339, raw)
+        if err != nil {
+            return shared.CreateErrorResponse(400, "from must be an RFC 3339 time"), nil
+        }
+        from = t
+    }
+    if from.After(to) {
+        return shared.CreateErrorResponse(400, "from must not be after to"), nil
+    }
+
+    deviceErrors, err := shared.ListDeviceErrors(ctx, deviceID, strings.ToLower(query["code"]), from, to)
+    if err != nil {
+        log.Printf("Failed to list errors for device %s: %v", deviceID, err)
+        return shared.CreateErrorResponse(500, "Failed to retrieve device errors"), nil
+    }
+
+    return shared.CreateSuccessResponse(200, map[string]interface{}{
+        "deviceId":   deviceID,
+        "errorCount": device.ErrorCount,
+        "lastApply":  device.LastApply,
+        "errors":     deviceErrors,
+        // Applies where the device took most of its command timeout
+        "slowCallCount":  device.SlowCallCount,
+        "lastSlowCallAt": device.LastSlowCallAt,
+    }), nil
+}
@@ -3,6 +3,7 @@ package main
 import (
     "context"
     "encoding/json"
+    "fmt"
     "log"
     "os"
     "time"
@@ -18,51 +19,165 @@ import (
 
 var devicesTable = os.Getenv("DEVICES_TABLE")
 var patternsTable = os.Getenv("PATTERNS_TABLE")
+var usersTable = os.Getenv("USERS_TABLE")
+
+var router = newRouter()
+
+// newRouter registers the device and room routes, all for signed-in users
+func newRouter() *shared.Router {
+    r := shared.NewRouter("Devices")
+
+    r.MustHandle("GET", shared.PathEquals("/api/rooms"), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleListRooms(rc.Ctx, rc.Username)
+        })
+    r.MustHandle("POST", shared.MatchAll(shared.HasPathParams("room"), shared.PathSuffix("/devices")), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleAssignRoom(rc.Ctx, rc.Username, rc.Request.PathParameters["room"], rc.Request)
+        })
+    r.MustHandle("DELETE", shared.HasPathParams("room"), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleDeleteRoom(rc.Ctx, rc.Username, rc.Request.PathParameters["room"])
+        })
+
+    r.MustHandle("GET", shared.PathEquals("/api/devices"), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleListDevices(rc.Ctx, rc.Username, rc.Request.QueryStringParameters["room"])
+        })
+    r.MustHandle("POST", shared.PathEquals("/api/devices"), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleRegisterDevice(rc.Ctx, rc.Username, rc.Request)
+        })
+    r.MustHandle("GET", shared.PathEquals("/api/devices/alexa-debug"), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleAlexaDebug(rc.Ctx, rc.Username)
+        })
+    r.MustHandle("GET", deviceSubpath("errors"), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleListDeviceErrors(rc.Ctx, rc.Username, rc.Request.PathParameters["deviceId"], rc.Request.QueryStringParameters)
+        })
+    r.MustHandle("GET", shared.HasPathParams("deviceId"), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleGetDevice(rc.Ctx, rc.Username, rc.Request.PathParameters["deviceId"], rc.Request.QueryStringParameters["live"] == "true")
+        })
+    r.MustHandle("PUT", deviceSubpath("pattern"), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleAssignPattern(rc.Ctx, rc.Username, rc.Request.PathParameters["deviceId"], rc.Request)
+        })
+    r.MustHandle("PUT", deviceSubpath("pin-mapping"), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleUpdatePinMapping(rc.Ctx, rc.Username, rc.Request.PathParameters["deviceId"], rc.Request)
+        })
+    r.MustHandle("PUT", shared.HasPathParams("deviceId"), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleUpdateDevice(rc.Ctx, rc.Username, rc.Request.PathParameters["deviceId"], rc.Request)
+        })
+    r.MustHandle("DELETE", shared.HasPathParams("deviceId"), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleDeleteDevice(rc.Ctx, rc.Username, rc.Request.PathParameters["deviceId"])
+        })
+
+    return r
+}
+
+// deviceSubpath matches /api/devices/{deviceId}/<name>
+func deviceSubpath(name string) shared.RouteMatcher {
+    return func(request events.APIGatewayProxyRequest) bool {
+        deviceID := request.PathParameters["deviceId"]
+        return deviceID != "" && request.Path == "/api/devices/"+deviceID+"/"+name
+    }
+}
 
 func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
     log.Printf("=== Devices Handler Called ===")
     log.Printf("Path: %s", request.Path)
     log.Printf("Method: %s", request.HTTPMethod)
 
-    // Validate authentication
-    username, err := shared.ValidateAuth(ctx, request)
-    if err != nil || username == "" {
-        log.Printf("Authentication failed: err=%v, username=%s", err, username)
-        return shared.CreateErrorResponse(401, "Unauthorized"), nil
-    }
-
-    log.Printf("Authenticated user: %s", username)
-
-    path := request.Path
-    method := request.HTTPMethod
-    deviceID := request.PathParameters["deviceId"]
-
-    switch {
-    case path == "/api/devices" && method == "GET":
-        log.Println("Routing to handleListDevices")
-        return handleListDevices(ctx, username)
-    case path == "/api/devices" && method == "POST":
-        log.Println("Routing to handleRegisterDevice")
-        return handleRegisterDevice(ctx, username, request)
-    case deviceID != "" && method == "GET":
-        log.Printf("Routing to handleGetDevice for deviceID: %s", deviceID)
-        return handleGetDevice(ctx, username, deviceID)
-    case deviceID != "" && path == "/api/devices/"+deviceID+"/pattern" && method == "PUT":
-        log.Printf("Routing to handleAssignPattern for deviceID: %s", deviceID)
-        return handleAssignPattern(ctx, username, deviceID, request)
-    case deviceID != "" && method == "PUT":
-        log.Printf("Routing to handleUpdateDevice for deviceID: %s", deviceID)
-        return handleUpdateDevice(ctx, username, deviceID, request)
-    case deviceID != "" && method == "DELETE":
-        log.Printf("Routing to handleDeleteDevice for deviceID: %s", deviceID)
-        return handleDeleteDevice(ctx, username, deviceID)
-    default:
-        log.Printf("No matching route for path: %s, method: %s", path, method)
-        return shared.CreateErrorResponse(404, "Not found"), nil
+    return router.Dispatch(ctx, request)
+}
+
+func handleListDevices(ctx context.Context, username string, room string) (events.APIGatewayProxyResponse, error) {
+    devices, err := listUserDevices(ctx, username)
+    if err != nil {
+        return shared.CreateErrorResponse(500, "Failed to retrieve devices"), nil
+    }
+
+    // ?room=garage (or ?room=Unassigned) narrows the list to one room
+    if room != "" {
+        devices = shared.FilterDevicesByRoom(devices, room)
+    }
+    // Advisories are re-evaluated on read so a newly listed firmware issue
+    // shows before the device's next refresh
+    for i := range devices {
+        devices[i].Icon = devices[i].DisplayIcon()
+        devices[i].FirmwareAdvisory = shared.FirmwareAdvisoryFor(devices[i].FirmwareVersion)
     }
+
+    return shared.CreateSuccessResponse(200, devices), nil
 }
 
-func handleListDevices(ctx context.Context, username string) (events.APIGatewayProxyResponse, error) {
+// listUserDevices returns all of username's devices
+func listUserDevices(ctx context.Context, username string) ([]shared.Device, error) {
+    indexName := "userId-index"
+    keyCondition := "userId = :userId"
+    expressionValues := map[string]types.AttributeValue{
+        ":userId": &types.AttributeValueMemberS{Value: username},
+    }
+
+    var devices []shared.Device
+    if err := shared.Query(ctx, devicesTable, &indexName, keyCondition, expressionValues, &devices); err != nil {
+        return nil, err
+    }
+    return devices, nil
+}
+
+// AlexaDebugInfo summarizes what Alexa discovery would see for a user.
+// Token details are limited to existence and expiry - never token values.
+type AlexaDebugInfo struct {
+    Linked         bool                            `json:"linked"`
+    TokenExpiresAt *time.Time                      `json:"tokenExpiresAt,omitempty"`
+    TokenExpired   bool                            `json:"tokenExpired"`
+    Endpoints      []shared.AlexaDiscoveryEndpoint `json:"endpoints"`
+    FriendlyNames  []AlexaFriendlyName             `json:"friendlyNames"`
+    SkippedDevices []shared.AlexaSkippedDevice     `json:"skippedDevices"`
+    DeviceStates   []shared.AlexaDeviceState       `json:"deviceStates"`
+}
+
+// AlexaFriendlyName is the name Alexa will hear for an endpoint. RenamedFrom
+// is set when the strip's usual name collided with another and was changed.
+type AlexaFriendlyName struct {
+    EndpointID   string `json:"endpointId"`
+    FriendlyName string `json:"friendlyName"`
+    RenamedFrom  string `json:"renamedFrom,omitempty"`
+}
+
+// alexaFriendlyNames lists the final friendly name of each endpoint
+func alexaFriendlyNames(devices []shared.Device, endpoints []shared.AlexaDiscoveryEndpoint) []AlexaFriendlyName {
+    defaults := map[string]string{}
+    for _, device := range devices {
+        for _, strip := range device.LEDStrips {
+            defaults[shared.AlexaEndpointID(device.DeviceID, strip.Pin)] = shared.AlexaStripFriendlyName(device, strip.Pin)
+        }
+    }
+
+    names := make([]AlexaFriendlyName, 0, len(endpoints))
+    for _, endpoint := range endpoints {
+        name := AlexaFriendlyName{EndpointID: endpoint.EndpointID, FriendlyName: endpoint.FriendlyName}
+        if original := defaults[endpoint.EndpointID]; original != endpoint.FriendlyName {
+            name.RenamedFrom = original
+        }
+        names = append(names, name)
+    }
+    return names
+}
+
+// handleAlexaDebug reports the caller's Alexa linking and discovery state.
+// Only the devices are required; if the tokens, patterns, or Alexa states
+// can't be read the rest is returned with a warning.
+func handleAlexaDebug(ctx context.Context, username string) (events.APIGatewayProxyResponse, error) {
+    info := AlexaDebugInfo{}
+    var partial shared.PartialResults
+
     indexName := "userId-index"
     keyCondition := "userId = :userId"
     expressionValues := map[string]types.AttributeValue{
@@ -74,13 +189,54 @@ func handleListDevices(ctx context.Context, username string) (events.APIGatewayP
         return shared.CreateErrorResponse(500, "Failed to retrieve devices"), nil
     }
 
-    return shared.CreateSuccessResponse(200, devices), nil
+    var tokens []shared.OAuthToken
+    partial.Enrich(ctx, "Alexa link status", func(ctx context.Context) error {
+        var err error
+        tokens, err = shared.GetUserAccessTokens(ctx, username)
+        return err
+    })
+
+    // Report the token that expires last
+    for _, t := range tokens {
+        expiresAt := time.Unix(t.ExpiresAt, 0)
+        if info.TokenExpiresAt == nil || expiresAt.After(*info.TokenExpiresAt) {
+            info.TokenExpiresAt = &expiresAt
+        }
+    }
+    if info.TokenExpiresAt != nil {
+        info.Linked = true
+        info.TokenExpired = time.Now().After(*info.TokenExpiresAt)
+    }
+
+    // Without patterns, endpoints are listed without their pattern modes
+    var patterns []shared.Pattern
+    partial.Enrich(ctx, "pattern modes", func(ctx context.Context) error {
+        return shared.Query(ctx, patternsTable, &indexName, keyCondition, expressionValues, &patterns)
+    })
+
+    info.Endpoints, info.SkippedDevices = shared.BuildAlexaDiscoveryEndpoints(devices, shared.AlexaModesForPatterns(patterns))
+    info.FriendlyNames = alexaFriendlyNames(devices, info.Endpoints)
+
+    var states []shared.AlexaDeviceState
+    partial.Enrich(ctx, "Alexa device states", func(ctx context.Context) error {
+        var err error
+        states, err = shared.GetUserAlexaDeviceStates(ctx, username)
+        return err
+    })
+    if states == nil {
+        states = []shared.AlexaDeviceState{}
+    }
+    info.DeviceStates = states
+
+    return partial.Response(200, info), nil
 }
 
 func handleRegisterDevice(ctx context.Context, username string, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
     var deviceReq struct {
-        Name       string `json:"name"`
-        ParticleID string `json:"particleId"`
+        Name         string `json:"name"`
+        ParticleID   string `json:"particleId"`
+        Manufacturer string `json:"manufacturer,omitempty"`
+        FirmwareType string `json:"firmwareType,omitempty"`
     }
 
     body := shared.GetRequestBody(request)
@@ -91,18 +247,35 @@ func handleRegisterDevice(ctx context.Context, username string, request events.A
     if deviceReq.Name == "" || deviceReq.ParticleID == "" {
         return shared.CreateErrorResponse(400, "Name and particleId are required"), nil
     }
+    name, err := shared.ValidateName("device", deviceReq.Name)
+    if err != nil {
+        return shared.CreateErrorResponse(400, err.Error()), nil
+    }
+
+    // Only Particle devices are supported for now
+    if deviceReq.Manufacturer == "" {
+        deviceReq.Manufacturer = shared.ManufacturerParticle
+    }
+    if deviceReq.Manufacturer != shared.ManufacturerParticle {
+        return shared.CreateErrorResponse(400, "manufacturer must be \"particle\""), nil
+    }
+    if deviceReq.FirmwareType == "" {
+        deviceReq.FirmwareType = shared.FirmwareTypeCandleLights
+    }
 
     // Create device
     device := shared.Device{
-        DeviceID:   uuid.New().String(),
-        UserID:     username,
-        Name:       deviceReq.Name,
-        ParticleID: deviceReq.ParticleID,
-        IsOnline:   false,
-        LastSeen:   time.Now(),
-        CreatedAt:  time.Now(),
-        UpdatedAt:  time.Now(),
-    }
+        DeviceID:     uuid.New().String(),
+        UserID:       username,
+        ParticleID:   deviceReq.ParticleID,
+        Manufacturer: deviceReq.Manufacturer,
+        FirmwareType: deviceReq.FirmwareType,
+        IsOnline:     false,
+        LastSeen:     time.Now(),
+        CreatedAt:    time.Now(),
+        UpdatedAt:    time.Now(),
+    }
+    device.SetName(name)
 
     if err := shared.PutItem(ctx, devicesTable, device); err != nil {
         return shared.CreateErrorResponse(500, "Failed to register device"), nil
@@ -111,7 +284,11 @@ func handleRegisterDevice(ctx context.Context, username string, request events.A
     return shared.CreateSuccessResponse(201, device), nil
 }
 
-func handleGetDevice(ctx context.Context, username string, deviceID string) (events.APIGatewayProxyResponse, error) {
+// handleGetDevice returns the stored device record. With live set, the
+// Particle cloud's current status is merged over it (see
+// shared.LiveDeviceView); if Particle can't be reached the stored record is
+// returned with a warning.
+func handleGetDevice(ctx context.Context, username string, deviceID string, live bool) (events.APIGatewayProxyResponse, error) {
     key, _ := attributevalue.MarshalMap(map[string]string{
         "deviceId": deviceID,
     })
@@ -121,16 +298,34 @@ func handleGetDevice(ctx context.Context, username string, deviceID string) (eve
         return shared.CreateErrorResponse(500, "Database error"), nil
     }
 
-    if device.DeviceID == "" {
+    // Verify ownership
+    if device.DeviceID == "" || device.UserID != username {
         return shared.CreateErrorResponse(404, "Device not found"), nil
     }
 
-    // Verify ownership
-    if device.UserID != username {
-        return shared.CreateErrorResponse(403, "Access denied"), nil
+    device.Icon = device.DisplayIcon()
+    device.FirmwareAdvisory = shared.FirmwareAdvisoryFor(device.FirmwareVersion)
+    pinDefaults := device.PinDefaults()
+    device.PlatformPins = &pinDefaults
+    if !live {
+        return shared.CreateSuccessResponse(200, device), nil
     }
 
-    return shared.CreateSuccessResponse(200, device), nil
+    userKey, _ := attributevalue.MarshalMap(map[string]string{
+        "username": username,
+    })
+    var user shared.User
+    if err := shared.GetItem(ctx, usersTable, userKey, &user); err != nil {
+        return shared.CreateErrorResponse(500, "Database error"), nil
+    }
+
+    if err := shared.DecryptParticleToken(ctx, usersTable, &user); err != nil {
+        log.Printf("Failed to decrypt Particle token for %s: %v", username, err)
+        return shared.CreateErrorResponse(500, "Failed to read Particle token"), nil
+    }
+
+    view, warnings := shared.LiveDeviceView(ctx, device, user.ParticleToken)
+    return shared.CreateSuccessResponseWithWarnings(200, view, warnings), nil
 }
 
 func handleUpdateDevice(ctx context.Context, username string, deviceID string, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
@@ -144,21 +339,26 @@ func handleUpdateDevice(ctx context.Context, username string, deviceID string, r
         return shared.CreateErrorResponse(500, "Database error"), nil
     }
 
-    if existingDevice.DeviceID == "" {
-        return shared.CreateErrorResponse(404, "Device not found"), nil
-    }
-
     // Verify ownership
-    if existingDevice.UserID != username {
-        return shared.CreateErrorResponse(403, "Access denied"), nil
+    if existingDevice.DeviceID == "" || existingDevice.UserID != username {
+        return shared.CreateErrorResponse(404, "Device not found"), nil
     }
 
     // Parse updates
     var updates struct {
         Name      string            `json:"name,omitempty"`
+        Room      *string           `json:"room,omitempty"` // "" or "Unassigned" clears the room
         IsOnline  *bool             `json:"isOnline,omitempty"`
         IsHidden  *bool             `json:"isHidden,omitempty"`
         LEDStrips []shared.LEDStrip `json:"ledStrips,omitempty"`
+        // 0 goes back to the default timeout
+        CommandTimeoutSeconds *int `json:"commandTimeoutSeconds,omitempty"`
+        // 0 goes back to the default rate limit
+        CommandBurst      *int `json:"commandBurst,omitempty"`
+        CommandsPerMinute *int `json:"commandsPerMinute,omitempty"`
+        // "" goes back to the platform icon / no accent
+        Icon        *string `json:"icon,omitempty"`
+        AccentColor *string `json:"accentColor,omitempty"`
     }
 
     body := shared.GetRequestBody(request)
@@ -166,9 +366,26 @@ func handleUpdateDevice(ctx context.Context, username string, deviceID string, r
         return shared.CreateErrorResponse(400, "Invalid request body"), nil
     }
 
+    previousDevice := existingDevice
+
     // Update fields
+    var warnings []string
     if updates.Name != "" {
-        existingDevice.Name = updates.Name
+        name, err := shared.ValidateName("device", updates.Name)
+        if err != nil {
+            return shared.CreateErrorResponse(400, err.Error()), nil
+        }
+        if !shared.SameFriendlyName(name, existingDevice.Name) {
+            warnings = append(warnings, deviceNameCollisions(ctx, username, deviceID, name)...)
+        }
+        existingDevice.SetName(name)
+    }
+    if updates.Room != nil {
+        room := shared.NormalizeRoom(*updates.Room)
+        if len(room) > shared.MaxRoomNameLength {
+            return shared.CreateErrorResponse(400, "Room name is too long"), nil
+        }
+        existingDevice.Room = room
     }
     if updates.IsOnline != nil {
         existingDevice.IsOnline = *updates.IsOnline
@@ -179,17 +396,65 @@ func handleUpdateDevice(ctx context.Context, username string, deviceID string, r
     if updates.IsHidden != nil {
         existingDevice.IsHidden = *updates.IsHidden
     }
+    if updates.CommandTimeoutSeconds != nil {
+        if seconds := *updates.CommandTimeoutSeconds; seconds != 0 {
+            if err := shared.ValidateCommandTimeoutSeconds(seconds); err != nil {
+                return shared.CreateErrorResponse(400, err.Error()), nil
+            }
+        }
+        existingDevice.CommandTimeoutSeconds = *updates.CommandTimeoutSeconds
+    }
+    if updates.CommandBurst != nil || updates.CommandsPerMinute != nil {
+        burst, perMinute := existingDevice.CommandBurst, existingDevice.CommandsPerMinute
+        if updates.CommandBurst != nil {
+            burst = *updates.CommandBurst
+        }
+        if updates.CommandsPerMinute != nil {
+            perMinute = *updates.CommandsPerMinute
+        }
+        if err := shared.ValidateCommandRateLimit(burst, perMinute); err != nil {
+            return shared.CreateErrorResponse(400, err.Error()), nil
+        }
+        existingDevice.CommandBurst, existingDevice.CommandsPerMinute = burst, perMinute
+    }
+    if updates.Icon != nil {
+        icon, err := shared.NormalizeIcon(*updates.Icon)
+        if err != nil {
+            return shared.CreateErrorResponse(400, err.Error()), nil
+        }
+        existingDevice.Icon = icon
+    }
+    if updates.AccentColor != nil {
+        color, err := shared.NormalizeAccentColor(*updates.AccentColor)
+        if err != nil {
+            return shared.CreateErrorResponse(400, err.Error()), nil
+        }
+        existingDevice.AccentColor = color
+    }
     // Update LED strips if provided (allow empty array to clear strips)
+    previousStrips := existingDevice.LEDStrips
     if updates.LEDStrips != nil {
         // Validate LED strips
         for _, strip := range updates.LEDStrips {
             if strip.Pin < 0 || strip.Pin > 7 {
                 return shared.CreateErrorResponse(400, "Pin must be between 0 and 7 (D0-D7)"), nil
             }
-            if strip.LEDCount < 1 || strip.LEDCount > 60 {
-                return shared.CreateErrorResponse(400, "LED count must be between 1 and 60"), nil
+            if strip.LEDCount < 1 {
+                return shared.CreateErrorResponse(400, "LED count must be at least 1"), nil
+            }
+            if err := shared.ValidateSpeedMultiplier(strip.SpeedMultiplier); err != nil {
+                return shared.CreateErrorResponse(400, err.Error()), nil
             }
         }
+        // Pins the device's platform can drive (see PinDefaults)
+        if err := shared.ValidateStripPins(existingDevice, updates.LEDStrips); err != nil {
+            return shared.CreateErrorResponse(400, err.Error()), nil
+        }
+        // Limits come from the firmware's deviceInfo, or MAX_LEDS_PER_STRIP
+        if err := shared.ValidateStripLimits(existingDevice, updates.LEDStrips); err != nil {
+            return shared.CreateErrorResponse(422, err.Error()), nil
+        }
+        shared.CarryCommandSeqs(existingDevice.LEDStrips, updates.LEDStrips)
         existingDevice.LEDStrips = updates.LEDStrips
     }
 
@@ -199,7 +464,32 @@ func handleUpdateDevice(ctx context.Context, username string, deviceID string, r
         return shared.CreateErrorResponse(500, "Failed to update device"), nil
     }
 
-    return shared.CreateSuccessResponse(200, existingDevice), nil
+    removedPins, addedPins := shared.StripPinChanges(previousStrips, existingDevice.LEDStrips)
+    cleanUpAlexaEndpoints(ctx, deviceID, removedPins, addedPins)
+    if alexaEndpointsChanged(previousDevice, existingDevice) {
+        shared.RefreshAlexaDiscovery(ctx, username)
+    }
+
+    existingDevice.Icon = existingDevice.DisplayIcon()
+    return shared.CreateSuccessResponseWithWarnings(200, existingDevice, warnings), nil
+}
+
+// deviceNameCollisions warns when another of the user's devices already has
+// name. Both are still saved, but Alexa discovery has to tell their strips
+// apart by room or device ID, which users won't expect to say.
+func deviceNameCollisions(ctx context.Context, username, deviceID, name string) []string {
+    devices, err := listUserDevices(ctx, username)
+    if err != nil {
+        log.Printf("Failed to check device names for %s: %v", username, err)
+        return nil
+    }
+
+    for _, device := range devices {
+        if device.DeviceID != deviceID && shared.SameFriendlyName(device.Name, name) {
+            return []string{fmt.Sprintf("Another device is already named %q; Alexa will add the room or part of the device ID to tell their strips apart", device.Name)}
+        }
+    }
+    return nil
 }
 
 func handleDeleteDevice(ctx context.Context, username string, deviceID string) (events.APIGatewayProxyResponse, error) {
@@ -213,13 +503,9 @@ func handleDeleteDevice(ctx context.Context, username string, deviceID string) (
         return shared.CreateErrorResponse(500, "Database error"), nil
     }
 
-    if device.DeviceID == "" {
-        return shared.CreateErrorResponse(404, "Device not found"), nil
-    }
-
     // Verify ownership
-    if device.UserID != username {
-        return shared.CreateErrorResponse(403, "Access denied"), nil
+    if device.DeviceID == "" || device.UserID != username {
+        return shared.CreateErrorResponse(404, "Device not found"), nil
     }
 
     // Delete device
@@ -227,11 +513,49 @@ func handleDeleteDevice(ctx context.Context, username string, deviceID string) (
         return shared.CreateErrorResponse(500, "Failed to delete device"), nil
     }
 
+    removedPins, _ := shared.StripPinChanges(device.LEDStrips, nil)
+    cleanUpAlexaEndpoints(ctx, deviceID, removedPins, nil)
+    shared.RefreshAlexaDiscovery(ctx, username)
+
     return shared.CreateSuccessResponse(200, map[string]string{
         "message": "Device deleted successfully",
     }), nil
 }
 
+// cleanUpAlexaEndpoints retires the Alexa endpoints of removed strips and
+// revives those of strips added back. Failures are logged; the device change
+// has already been saved.
+func cleanUpAlexaEndpoints(ctx context.Context, deviceID string, removedPins, addedPins []int) {
+    for _, pin := range removedPins {
+        if err := shared.RemoveAlexaEndpoint(ctx, deviceID, pin); err != nil {
+            log.Printf("Warning: Failed to remove Alexa endpoint for device %s pin D%d: %v", deviceID, pin, err)
+        }
+    }
+    for _, pin := range addedPins {
+        if err := shared.ClearAlexaEndpointTombstone(ctx, deviceID, pin); err != nil {
+            log.Printf("Warning: Failed to clear Alexa tombstone for device %s pin D%d: %v", deviceID, pin, err)
+        }
+    }
+}
+
+// alexaEndpointsChanged reports whether an edit changed what Alexa discovery
+// says about the device's strips: their pins or LED counts, or the device's
+// name or room
+func alexaEndpointsChanged(before, after shared.Device) bool {
+    if before.Name != after.Name || before.AlexaName != after.AlexaName || before.Room != after.Room {
+        return true
+    }
+    if len(before.LEDStrips) != len(after.LEDStrips) {
+        return true
+    }
+    for i := range before.LEDStrips {
+        if before.LEDStrips[i].Pin != after.LEDStrips[i].Pin || before.LEDStrips[i].LEDCount != after.LEDStrips[i].LEDCount {
+            return true
+        }
+    }
+    return false
+}
+
 func handleAssignPattern(ctx context.Context, username string, deviceID string, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
     // Get device
     deviceKey, _ := attributevalue.MarshalMap(map[string]string{
@@ -243,13 +567,9 @@ func handleAssignPattern(ctx context.Context, username string, deviceID string,
         return shared.CreateErrorResponse(500, "Database error"), nil
     }
 
-    if device.DeviceID == "" {
-        return shared.CreateErrorResponse(404, "Device not found"), nil
-    }
-
     // Verify ownership
-    if device.UserID != username {
-        return shared.CreateErrorResponse(403, "Access denied"), nil
+    if device.DeviceID == "" || device.UserID != username {
+        return shared.CreateErrorResponse(404, "Device not found"), nil
     }
 
     // Parse request
@@ -276,14 +596,10 @@ func handleAssignPattern(ctx context.Context, username string, deviceID string,
         return shared.CreateErrorResponse(500, "Database error"), nil
     }
 
-    if pattern.PatternID == "" {
+    if pattern.PatternID == "" || pattern.UserID != username {
         return shared.CreateErrorResponse(404, "Pattern not found"), nil
     }
 
-    if pattern.UserID != username {
-        return shared.CreateErrorResponse(403, "Pattern access denied"), nil
-    }
-
     // Assign pattern to device
     device.AssignedPattern = assignReq.PatternID
     device.UpdatedAt = time.Now()
@@ -295,6 +611,50 @@ func handleAssignPattern(ctx context.Context, username string, deviceID string,
     return shared.CreateSuccessResponse(200, device), nil
 }
 
+// handleUpdatePinMapping replaces the device's logical-to-physical strip pin mapping.
+// An empty mapping restores the default of configured pin == physical pin.
+func handleUpdatePinMapping(ctx context.Context, username string, deviceID string, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+    deviceKey, _ := attributevalue.MarshalMap(map[string]string{
+        "deviceId": deviceID,
+    })
+
+    var device shared.Device
+    if err := shared.GetItem(ctx, devicesTable, deviceKey, &device); err != nil {
+        return shared.CreateErrorResponse(500, "Database error"), nil
+    }
+
+    // Verify ownership
+    if device.DeviceID == "" || device.UserID != username {
+        return shared.CreateErrorResponse(404, "Device not found"), nil
+    }
+
+    var mappingReq struct {
+        CustomPinMapping map[string]int `json:"customPinMapping"`
+    }
+
+    body := shared.GetRequestBody(request)
+    if err := json.Unmarshal([]byte(body), &mappingReq); err != nil {
+        return shared.CreateErrorResponse(400, "Invalid request body"), nil
+    }
+
+    if err := shared.ValidatePinMapping(mappingReq.CustomPinMapping); err != nil {
+        return shared.CreateErrorResponse(400, err.Error()), nil
+    }
+
+    if len(mappingReq.CustomPinMapping) == 0 {
+        device.CustomPinMapping = nil
+    } else {
+        device.CustomPinMapping = mappingReq.CustomPinMapping
+    }
+    device.UpdatedAt = time.Now()
+
+    if err := shared.PutItem(ctx, devicesTable, device); err != nil {
+        return shared.CreateErrorResponse(500, "Failed to update pin mapping"), nil
+    }
+
+    return shared.CreateSuccessResponse(200, device), nil
+}
+
 func main() {
-    lambda.Start(handler)
+    lambda.Start(shared.WithMetrics("devices", shared.WithSessionRotation(shared.WithActivityLog(handler))))
 }
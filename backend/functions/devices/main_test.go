@@ -0,0 +1,305 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "reflect"
+    "regexp"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/aws/aws-lambda-go/events"
+
+    "candle-lights/backend/shared"
+)
+
+// stubAccounts answers session and user lookups for the given users, each
+// signed in with the session ID "session-<username>", and lists no devices
+func stubAccounts(t *testing.T, users ...shared.User) {
+    byName := make(map[string]shared.User, len(users))
+    for _, user := range users {
+        byName[user.Username] = user
+    }
+
+    restore := shared.StubDynamoDB(func(call shared.DynamoDBStubCall) (map[string]interface{}, error) {
+        switch call.Operation {
+        case "GetItem":
+            var key struct {
+                SessionID string `dynamodbav:"sessionId"`
+                Username  string `dynamodbav:"username"`
+            }
+            if err := call.Unmarshal("Key", &key); err != nil {
+                return nil, err
+            }
+            if key.SessionID != "" {
+                username := key.SessionID[len("session-"):]
+                return map[string]interface{}{"Item": shared.DynamoDBStubItem(shared.Session{
+                    SessionID: key.SessionID,
+                    Username:  username,
+                    CreatedAt: time.Now(),
+                    ExpiresAt: time.Now().Add(time.Hour).Unix(),
+                })}, nil
+            }
+            if user, ok := byName[key.Username]; ok {
+                return map[string]interface{}{"Item": shared.DynamoDBStubItem(user)}, nil
+            }
+            return nil, nil
+        case "Query":
+            return map[string]interface{}{"Items": shared.DynamoDBStubItems(), "Count": 0}, nil
+        }
+        return nil, fmt.Errorf("unexpected %s", call.Operation)
+    })
+    t.Cleanup(restore)
+}
+
+func TestSuspendedUserIsRefused(t *testing.T) {
+    stubAccounts(t,
+        shared.User{Username: "sam", IsActive: false},
+        shared.User{Username: "ada", IsActive: true, IsAdmin: true},
+        shared.User{Username: "lee", IsActive: true},
+    )
+
+    tests := []struct {
+        username   string
+        wantStatus int
+        wantBody   string
+    }{
+        {"sam", 403, "account suspended"},
+        {"ada", 200, ""},
+        {"lee", 200, ""},
+    }
+
+    for _, tt := range tests {
+        resp, err := handler(context.Background(), events.APIGatewayProxyRequest{
+            HTTPMethod: "GET",
+            Path:       "/api/devices",
+            Headers:    map[string]string{"Authorization": "Bearer session-" + tt.username},
+        })
+        if err != nil {
+            t.Fatalf("%s: handler error: %v", tt.username, err)
+        }
+        if resp.StatusCode != tt.wantStatus {
+            t.Errorf("%s: status = %d, want %d (%s)", tt.username, resp.StatusCode, tt.wantStatus, resp.Body)
+        }
+        if !strings.Contains(resp.Body, tt.wantBody) {
+            t.Errorf("%s: body = %s, want it to mention %q", tt.username, resp.Body, tt.wantBody)
+        }
+    }
+}
+
+func TestRegisterDeviceValidatesManufacturer(t *testing.T) {
+    var saved []shared.Device
+    restore := shared.StubDynamoDB(func(call shared.DynamoDBStubCall) (map[string]interface{}, error) {
+        if call.Operation != "PutItem" {
+            return nil, fmt.Errorf("unexpected %s", call.Operation)
+        }
+        var device shared.Device
+        if err := call.Unmarshal("Item", &device); err != nil {
+            return nil, err
+        }
+        saved = append(saved, device)
+        return nil, nil
+    })
+    defer restore()
+
+    tests := []struct {
+        body             string
+        wantStatus       int
+        wantManufacturer string
+        wantFirmware     string
+    }{
+        {`{"name":"Garage","particleId":"p1"}`, 201, shared.ManufacturerParticle, shared.FirmwareTypeCandleLights},
+        {`{"name":"Garage","particleId":"p1","manufacturer":"particle","firmwareType":"wled"}`, 201, shared.ManufacturerParticle, shared.FirmwareTypeWLED},
+        {`{"name":"Garage","particleId":"p1","manufacturer":"wled"}`, 400, "", ""},
+        {`{"name":"Garage","particleId":"p1","manufacturer":"esp"}`, 400, "", ""},
+    }
+    for _, tt := range tests {
+        saved = nil
+        resp, err := handleRegisterDevice(context.Background(), "lee", events.APIGatewayProxyRequest{Body: tt.body})
+        if err != nil || resp.StatusCode != tt.wantStatus {
+            t.Errorf("%s = %d, %v; want %d", tt.body, resp.StatusCode, err, tt.wantStatus)
+            continue
+        }
+        if tt.wantStatus != 201 {
+            if len(saved) != 0 {
+                t.Errorf("%s saved a device", tt.body)
+            }
+            continue
+        }
+        if len(saved) != 1 || saved[0].Manufacturer != tt.wantManufacturer || saved[0].FirmwareType != tt.wantFirmware {
+            t.Errorf("%s saved %+v, want manufacturer %q and firmware %q", tt.body, saved, tt.wantManufacturer, tt.wantFirmware)
+        }
+    }
+}
+
+func TestForeignDevicesLookMissing(t *testing.T) {
+    defer shared.StubDynamoDB(shared.StubOwnershipHandler("lee", "foreign", "sam"))()
+
+    routes := []struct {
+        method, suffix, body string
+    }{
+        {"GET", "", ""},
+        {"GET", "/errors", ""},
+        {"PUT", "", `{"name":"Porch"}`},
+        {"PUT", "/pattern", `{"patternId":"p1","pin":6}`},
+        {"PUT", "/pin-mapping", `{"customPinMapping":{"strip6":2}}`},
+        {"DELETE", "", ""},
+    }
+    for _, route := range routes {
+        var responses [2]events.APIGatewayProxyResponse
+        for i, deviceID := range []string{"foreign", "missing"} {
+            resp, err := handler(context.Background(), events.APIGatewayProxyRequest{
+                HTTPMethod:     route.method,
+                Path:           "/api/devices/" + deviceID + route.suffix,
+                PathParameters: map[string]string{"deviceId": deviceID},
+                Headers:        map[string]string{"Authorization": "Bearer session-lee"},
+                Body:           route.body,
+            })
+            if err != nil {
+                t.Fatalf("%s %s: %v", route.method, route.suffix, err)
+            }
+            responses[i] = resp
+        }
+        if responses[0].StatusCode != 404 || responses[0].StatusCode != responses[1].StatusCode || responses[0].Body != responses[1].Body {
+            t.Errorf("%s /api/devices/{id}%s: foreign = %d %s, missing = %d %s; want the same 404", route.method, route.suffix,
+                responses[0].StatusCode, responses[0].Body, responses[1].StatusCode, responses[1].Body)
+        }
+    }
+}
+
+// TestDocumentedRoutesAreRouted checks shared.APIRoutes against the router:
+// every documented devices route reaches its auth check rather than a 404
+func TestDocumentedRoutesAreRouted(t *testing.T) {
+    param := regexp.MustCompile(`\{([^}]+)\}`)
+    found := 0
+    for _, doc := range shared.APIRoutes {
+        if doc.Service != "devices" {
+            continue
+        }
+        found++
+        request := events.APIGatewayProxyRequest{HTTPMethod: doc.Method, PathParameters: map[string]string{}}
+        request.Path = param.ReplaceAllStringFunc(doc.Path, func(name string) string {
+            request.PathParameters[name[1:len(name)-1]] = "x"
+            return "x"
+        })
+        resp, err := router.Dispatch(context.Background(), request)
+        if err != nil || resp.StatusCode != 401 {
+            t.Errorf("%s %s without a session = %d, %v; want 401", doc.Method, doc.Path, resp.StatusCode, err)
+        }
+    }
+    if found == 0 {
+        t.Error("no devices routes in shared.APIRoutes")
+    }
+}
+
+func TestStripLimitsAreEnforced(t *testing.T) {
+    devices := map[string]shared.Device{
+        "reported":   {DeviceID: "reported", UserID: "lee", Name: "Garage", MaxStrips: 2, MaxLEDs: 300},
+        "unreported": {DeviceID: "unreported", UserID: "lee", Name: "Porch"},
+    }
+    defer shared.StubDynamoDB(func(call shared.DynamoDBStubCall) (map[string]interface{}, error) {
+        if call.Operation == "GetItem" {
+            var key struct {
+                DeviceID string `dynamodbav:"deviceId"`
+            }
+            if err := call.Unmarshal("Key", &key); err != nil {
+                return nil, err
+            }
+            if device, ok := devices[key.DeviceID]; ok {
+                return map[string]interface{}{"Item": shared.DynamoDBStubItem(device)}, nil
+            }
+        }
+        // Sessions, owners and the writes after a successful update
+        return shared.StubOwnershipHandler("lee", "", "")(call)
+    })()
+
+    tests := []struct {
+        name       string
+        deviceID   string
+        strips     string
+        wantStatus int
+        wantBody   string
+    }{
+        {"at the firmware LED limit", "reported", `[{"pin":2,"ledCount":300}]`, 200, ""},
+        {"one LED over the firmware limit", "reported", `[{"pin":2,"ledCount":301}]`, 422, "maxLedsPerStrip, from firmware"},
+        {"one strip over the firmware limit", "reported", `[{"pin":2,"ledCount":8},{"pin":3,"ledCount":8},{"pin":4,"ledCount":8}]`, 422, "maxStrips"},
+        {"no deviceInfo, at the ceiling", "unreported", `[{"pin":2,"ledCount":1000}]`, 200, ""},
+        {"no deviceInfo, over the ceiling", "unreported", `[{"pin":2,"ledCount":1001}]`, 422, "maxLedsPerStrip, from ceiling"},
+    }
+    for _, tt := range tests {
+        resp, err := handler(context.Background(), events.APIGatewayProxyRequest{
+            HTTPMethod:     "PUT",
+            Path:           "/api/devices/" + tt.deviceID,
+            PathParameters: map[string]string{"deviceId": tt.deviceID},
+            Headers:        map[string]string{"Authorization": "Bearer session-lee"},
+            Body:           `{"ledStrips":` + tt.strips + `}`,
+        })
+        if err != nil || resp.StatusCode != tt.wantStatus || !strings.Contains(resp.Body, tt.wantBody) {
+            t.Errorf("%s: %d %s, %v; want %d with %q", tt.name, resp.StatusCode, resp.Body, err, tt.wantStatus, tt.wantBody)
+        }
+    }
+}
+
+func TestAlexaDebugReturnsPartialResults(t *testing.T) {
+    savedDevices, savedPatterns := devicesTable, patternsTable
+    devicesTable, patternsTable = "devices", "patterns"
+    defer func() { devicesTable, patternsTable = savedDevices, savedPatterns }()
+
+    device := shared.Device{DeviceID: "d1", UserID: "lee", Name: "Garage", IsReady: true, LEDStrips: []shared.LEDStrip{{Pin: 6, LEDCount: 30}}}
+    tests := []struct {
+        name         string
+        failing      string // Table whose queries are throttled; "" is the Alexa tables
+        wantStatus   int
+        wantWarnings []string
+    }{
+        {"nothing fails", "none", 200, nil},
+        {"patterns throttled", "patterns", 200, []string{"pattern modes unavailable: throttled"}},
+        {"Alexa tables throttled", "", 200, []string{"Alexa link status unavailable: throttled", "Alexa device states unavailable: throttled"}},
+        {"devices throttled", "devices", 500, nil},
+    }
+    for _, tt := range tests {
+        owners := shared.StubOwnershipHandler("lee", "", "")
+        restore := shared.StubDynamoDB(func(call shared.DynamoDBStubCall) (map[string]interface{}, error) {
+            if call.Operation != "Query" {
+                return owners(call)
+            }
+            if call.Table() == tt.failing {
+                return nil, shared.ErrDynamoDBStubThrottled
+            }
+            if call.Table() == "devices" {
+                return map[string]interface{}{"Items": shared.DynamoDBStubItems(device), "Count": 1}, nil
+            }
+            return map[string]interface{}{"Items": shared.DynamoDBStubItems(), "Count": 0}, nil
+        })
+        resp, err := handler(context.Background(), events.APIGatewayProxyRequest{
+            HTTPMethod: "GET",
+            Path:       "/api/devices/alexa-debug",
+            Headers:    map[string]string{"Authorization": "Bearer session-lee"},
+        })
+        restore()
+        if err != nil || resp.StatusCode != tt.wantStatus {
+            t.Errorf("%s: %d %s, %v; want %d", tt.name, resp.StatusCode, resp.Body, err, tt.wantStatus)
+            continue
+        }
+        if tt.wantStatus != 200 {
+            continue
+        }
+
+        var body struct {
+            Data     AlexaDebugInfo `json:"data"`
+            Partial  bool           `json:"partial"`
+            Warnings []string       `json:"warnings"`
+        }
+        if err := json.Unmarshal([]byte(resp.Body), &body); err != nil {
+            t.Fatal(err)
+        }
+        if body.Partial != (len(tt.wantWarnings) > 0) || !reflect.DeepEqual(body.Warnings, tt.wantWarnings) {
+            t.Errorf("%s: partial %v with warnings %q, want %q", tt.name, body.Partial, body.Warnings, tt.wantWarnings)
+        }
+        if len(body.Data.Endpoints) != 1 {
+            t.Errorf("%s: %d endpoints, want the device's strip still listed", tt.name, len(body.Data.Endpoints))
+        }
+    }
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "log"
+    "net/url"
+    "time"
+
+    "github.com/aws/aws-lambda-go/events"
+    "github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+
+    "candle-lights/backend/shared"
+)
+
+// AssignRoomRequest is the body of POST /api/rooms/{room}/devices
+type AssignRoomRequest struct {
+    DeviceIDs []string `json:"deviceIds"`
+}
+
+// handleListRooms returns the caller's rooms with device and strip counts.
+// Rooms exist as long as a device is in them.
+func handleListRooms(ctx context.Context, username string) (events.APIGatewayProxyResponse, error) {
+    devices, err := listUserDevices(ctx, username)
+    if err != nil {
+        return shared.CreateErrorResponse(500, "Failed to retrieve devices"), nil
+    }
+
+    return shared.CreateSuccessResponse(200, shared.SummarizeRooms(devices)), nil
+}
+
+// handleAssignRoom moves a set of devices into a room. Every device is
+// checked before any is changed, so a bad ID leaves all of them as they were.
+func handleAssignRoom(ctx context.Context, username string, roomParam string, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+    room, err := url.PathUnescape(roomParam)
+    if err != nil {
+        return shared.CreateErrorResponse(400, "Invalid room name"), nil
+    }
+    room = shared.NormalizeRoom(room)
+    if len(room) > shared.MaxRoomNameLength {
+        return shared.CreateErrorResponse(400, "Room name is too long"), nil
+    }
+
+    var assignReq AssignRoomRequest
+    if err := json.Unmarshal([]byte(shared.GetRequestBody(request)), &assignReq); err != nil {
+        return shared.CreateErrorResponse(400, "Invalid request body"), nil
+    }
+    if len(assignReq.DeviceIDs) == 0 {
+        return shared.CreateErrorResponse(400, "deviceIds is required"), nil
+    }
+
+    devices := make([]shared.Device, 0, len(assignReq.DeviceIDs))
+    for _, deviceID := range assignReq.DeviceIDs {
+        key, _ := attributevalue.MarshalMap(map[string]string{
+            "deviceId": deviceID,
+        })
+
+        var device shared.Device
+        if err := shared.GetItem(ctx, devicesTable, key, &device); err != nil {
+            return shared.CreateErrorResponse(500, "Database error"), nil
+        }
+        if device.DeviceID == "" || device.UserID != username {
+            return shared.CreateErrorResponse(404, "Device not found: "+deviceID), nil
+        }
+        devices = append(devices, device)
+    }
+
+    now := time.Now()
+    for i := range devices {
+        devices[i].Room = room
+        devices[i].UpdatedAt = now
+        if err := shared.PutItem(ctx, devicesTable, devices[i]); err != nil {
+            log.Printf("AssignRoom: Failed to update device %s: %v", devices[i].DeviceID, err)
+            return shared.CreateErrorResponse(500, "Failed to update device"), nil
+        }
+    }
+
+    log.Printf("AssignRoom: Moved %d devices to %q for user %s", len(devices), shared.DeviceRoom(devices[0]), username)
+    return shared.CreateSuccessResponse(200, devices), nil
+}
+
+// handleDeleteRoom removes a room by moving its devices to Unassigned
+func handleDeleteRoom(ctx context.Context, username string, roomParam string) (events.APIGatewayProxyResponse, error) {
+    room, err := url.PathUnescape(roomParam)
+    if err != nil {
+        return shared.CreateErrorResponse(400, "Invalid room name"), nil
+    }
+    if shared.NormalizeRoom(room) == "" {
+        return shared.CreateErrorResponse(400, "The Unassigned room cannot be deleted"), nil
+    }
+
+    devices, err := listUserDevices(ctx, username)
+    if err != nil {
+        return shared.CreateErrorResponse(500, "Failed to retrieve devices"), nil
+    }
+
+    moved := 0
+    now := time.Now()
+    for _, device := range shared.FilterDevicesByRoom(devices, room) {
+        device.Room = ""
+        device.UpdatedAt = now
+        if err := shared.PutItem(ctx, devicesTable, device); err != nil {
+            log.Printf("DeleteRoom: Failed to unassign device %s: %v", device.DeviceID, err)
+            return shared.CreateErrorResponse(500, "Failed to update device"), nil
+        }
+        moved++
+    }
+
+    return shared.CreateSuccessResponse(200, map[string]interface{}{
+        "message":      "Room deleted",
+        "devicesMoved": moved,
+    }), nil
+}
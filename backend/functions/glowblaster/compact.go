@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"candle-lights/backend/shared"
+)
+
+// charsPerToken approximates Claude's tokenizer for English text and JSON,
+// close enough to show what compaction saves
+const charsPerToken = 4
+
+// compactSummaryPrefix starts the synthetic user message that holds a
+// compacted conversation's summary
+const compactSummaryPrefix = "Previous conversation summary:\n"
+
+// compactSummaryAck is the synthetic assistant reply that follows the summary
+const compactSummaryAck = "Understood! I have the context from our previous conversation. How would you like to continue working on the pattern?"
+
+// claudeSender is the part of shared.ClaudeClient that compaction uses, so a
+// stub can stand in for Claude
+type claudeSender interface {
+	SendMessage(ctx context.Context, model, systemPrompt string, messages []shared.ClaudeMessage) (*shared.ClaudeResponse, error)
+	GetResponseText(resp *shared.ClaudeResponse) string
+}
+
+// newCompactSender makes the client compaction summarizes with; tests
+// replace it
+var newCompactSender = func() claudeSender {
+	return shared.NewClaudeClient()
+}
+
+// compactSummary is the summary that replaces a conversation's older
+// messages, with the usage of the Claude call that wrote it, if any
+type compactSummary struct {
+	Text       string
+	Summarized bool
+	Model      string
+	TokensIn   int
+	TokensOut  int
+}
+
+// summarizeMessages has Claude summarize old with GlowBlasterCompactPrompt.
+// The messages are sent as one transcript, since old may not end on a user
+// message as the Messages API requires.
+func summarizeMessages(ctx context.Context, client claudeSender, model string, old []shared.Message) (compactSummary, error) {
+	var transcript strings.Builder
+	for _, msg := range old {
+		speaker := "User"
+		if msg.Role == "assistant" {
+			speaker = "Assistant"
+		}
+		fmt.Fprintf(&transcript, "%s: %s\n\n", speaker, msg.Content)
+	}
+
+	resp, err := client.SendMessage(ctx, model, shared.GlowBlasterCompactPrompt, []shared.ClaudeMessage{
+		{Role: "user", Content: "Summarize this conversation:\n\n" + transcript.String()},
+	})
+	if err != nil {
+		return compactSummary{}, err
+	}
+
+	text := strings.TrimSpace(client.GetResponseText(resp))
+	if text == "" {
+		return compactSummary{}, fmt.Errorf("empty summary")
+	}
+	return compactSummary{
+		Text:       compactSummaryPrefix + text + "\n",
+		Summarized: true,
+		Model:      model,
+		TokensIn:   resp.Usage.InputTokens,
+		TokensOut:  resp.Usage.OutputTokens,
+	}, nil
+}
+
+// heuristicSummary lists what the user asked in old, for when Claude can't
+// summarize
+func heuristicSummary(old []shared.Message) compactSummary {
+	summary := compactSummaryPrefix
+	for _, msg := range old {
+		if msg.Role == "user" {
+			summary += "- User asked about: " + truncate(msg.Content, 100) + "\n"
+		}
+	}
+	return compactSummary{Text: summary}
+}
+
+// estimateTokens approximates the tokens messages take up in a chat request
+func estimateTokens(messages []shared.Message) int {
+	chars := 0
+	for _, msg := range messages {
+		chars += len(msg.Content)
+	}
+	return tokensForChars(chars)
+}
+
+// tokensForChars approximates the tokens in chars characters of text
+func tokensForChars(chars int) int {
+	return (chars + charsPerToken - 1) / charsPerToken
+}
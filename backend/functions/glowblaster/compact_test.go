@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"candle-lights/backend/shared"
+)
+
+// stubSender stands in for Claude in compaction, recording what it's asked
+type stubSender struct {
+	summary string
+	err     error
+	calls   int
+	model   string
+	system  string
+	prompt  string
+}
+
+func (s *stubSender) SendMessage(ctx context.Context, model, systemPrompt string, messages []shared.ClaudeMessage) (*shared.ClaudeResponse, error) {
+	s.calls++
+	s.model, s.system = model, systemPrompt
+	if len(messages) > 0 {
+		s.prompt = messages[0].Content
+	}
+	if s.err != nil {
+		return nil, s.err
+	}
+	resp := &shared.ClaudeResponse{}
+	resp.Usage.InputTokens = 1200
+	resp.Usage.OutputTokens = 80
+	return resp, nil
+}
+
+func (s *stubSender) GetResponseText(resp *shared.ClaudeResponse) string {
+	return s.summary
+}
+
+func useSender(sender *stubSender) (restore func()) {
+	previous := newCompactSender
+	newCompactSender = func() claudeSender { return sender }
+	return func() { newCompactSender = previous }
+}
+
+// longConversation is ten messages; the early ones settle on a brightness
+// and palette and carry a large WLED reply
+func longConversation(model string) shared.Conversation {
+	messages := exchange("Make the porch glow like the sea", "Here's an ocean pattern:\n```json\n"+strings.Repeat(`{"fx":9}`, 200)+"\n```")
+	messages = append(messages, exchange("Dim it to 40% brightness", "Done, 40% it is.")...)
+	messages = append(messages, exchange("Keep the ocean palette", "Keeping it.")...)
+	messages = append(messages, exchange("Slow it down", "Slower now.")...)
+	messages = append(messages, exchange("Perfect", "Glad you like it!")...)
+	return shared.Conversation{
+		ConversationID: "c1",
+		UserID:         "lee",
+		Model:          model,
+		Messages:       messages,
+		TotalTokens:    5000,
+		CurrentLCL:     "effect: wave",
+	}
+}
+
+func compact(t *testing.T, store *stubConversations, body string) (shared.CompactResponse, []string) {
+	t.Helper()
+	resp, err := handleCompact(context.Background(), "lee", "c1", events.APIGatewayProxyRequest{Body: body})
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatalf("compact = %d, %v: %s", resp.StatusCode, err, resp.Body)
+	}
+	var out struct {
+		Data     shared.CompactResponse `json:"data"`
+		Warnings []string               `json:"warnings"`
+	}
+	if err := json.Unmarshal([]byte(resp.Body), &out); err != nil {
+		t.Fatal(err)
+	}
+	return out.Data, out.Warnings
+}
+
+func TestCompactSummarizesWithClaude(t *testing.T) {
+	store := &stubConversations{items: map[string]shared.Conversation{"c1": longConversation(shared.DefaultModel)}}
+	defer shared.StubDynamoDB(store.handle)()
+	sender := &stubSender{summary: "Settled on the ocean palette at 40% brightness, slowed down."}
+	defer useSender(sender)()
+
+	out, warnings := compact(t, store, `{}`)
+	saved := store.items["c1"]
+
+	if sender.calls != 1 || sender.model != shared.DefaultModel || sender.system != shared.GlowBlasterCompactPrompt {
+		t.Errorf("Claude asked %d times with model %q; want once with the conversation's model and the compact prompt", sender.calls, sender.model)
+	}
+	for _, line := range []string{"User: Make the porch glow like the sea", "Assistant: Done, 40% it is.", "User: Keep the ocean palette"} {
+		if !strings.Contains(sender.prompt, line) {
+			t.Errorf("transcript sent for summary lacks %q", line)
+		}
+	}
+	if strings.Contains(sender.prompt, "Slow it down") {
+		t.Error("the recent messages kept were summarized too")
+	}
+
+	if len(saved.Messages) != 6 || saved.Messages[0].Role != "user" || saved.Messages[1].Role != "assistant" {
+		t.Fatalf("compacted to %d messages, want summary, acknowledgement and the 4 kept", len(saved.Messages))
+	}
+	summary := saved.Messages[0].Content
+	if !strings.HasPrefix(summary, compactSummaryPrefix+sender.summary) || !strings.Contains(summary, "effect: wave") {
+		t.Errorf("summary message = %q, want Claude's summary and the current LCL", summary)
+	}
+	ack := saved.Messages[1]
+	if ack.TokensIn != 1200 || ack.TokensOut != 80 || ack.Model != shared.DefaultModel || ack.CostMicrodollars == 0 {
+		t.Errorf("acknowledgement = %+v, want the summary call's usage and cost", ack)
+	}
+	if saved.TotalTokens != 5000+1280 || saved.TotalCost != ack.CostMicrodollars {
+		t.Errorf("totals = %d tokens, %d cost; want the summary call added", saved.TotalTokens, saved.TotalCost)
+	}
+
+	if !out.Summarized || out.TokensUsed != 1280 || len(warnings) != 0 {
+		t.Errorf("response = %+v, warnings %v; want a Claude summary using 1280 tokens", out, warnings)
+	}
+	if out.TokensBefore <= out.TokensAfter || out.TokensSaved != out.TokensBefore-out.TokensAfter {
+		t.Errorf("tokens before %d, after %d, saved %d; want the large reply's saving", out.TokensBefore, out.TokensAfter, out.TokensSaved)
+	}
+}
+
+func TestCompactFallsBackToQuestionList(t *testing.T) {
+	tests := []struct {
+		name      string
+		model     string
+		body      string
+		sender    *stubSender
+		wantCalls int
+		wantWarn  bool
+	}{
+		{"Claude fails", shared.DefaultModel, `{}`, &stubSender{err: errors.New("overloaded")}, 1, true},
+		{"empty summary", shared.DefaultModel, `{}`, &stubSender{summary: "  "}, 1, true},
+		{"summarize off", shared.DefaultModel, `{"summarize":false}`, &stubSender{summary: "unused"}, 0, false},
+		{"no model", "", `{}`, &stubSender{summary: "unused"}, 0, false},
+	}
+	for _, tt := range tests {
+		store := &stubConversations{items: map[string]shared.Conversation{"c1": longConversation(tt.model)}}
+		restoreDB := shared.StubDynamoDB(store.handle)
+		restoreSender := useSender(tt.sender)
+		out, warnings := compact(t, store, tt.body)
+		restoreSender()
+		restoreDB()
+
+		saved := store.items["c1"]
+		if tt.sender.calls != tt.wantCalls || (len(warnings) > 0) != tt.wantWarn {
+			t.Errorf("%s: %d Claude calls, warnings %v; want %d calls, warning %v", tt.name, tt.sender.calls, warnings, tt.wantCalls, tt.wantWarn)
+		}
+		if out.Summarized || out.TokensUsed != 0 || saved.TotalTokens != 5000 {
+			t.Errorf("%s: response %+v, total tokens %d; want no usage recorded", tt.name, out, saved.TotalTokens)
+		}
+		if summary := saved.Messages[0].Content; !strings.Contains(summary, "- User asked about: Dim it to 40% brightness") {
+			t.Errorf("%s: summary = %q, want the list of earlier questions", tt.name, summary)
+		}
+	}
+}
+
+func TestCompactWithoutAModelUsesTheDefault(t *testing.T) {
+	store := &stubConversations{items: map[string]shared.Conversation{"c1": longConversation("")}}
+	defer shared.StubDynamoDB(store.handle)()
+	sender := &stubSender{summary: "Ocean palette, 40%."}
+	defer useSender(sender)()
+
+	if out, _ := compact(t, store, `{"summarize":true}`); !out.Summarized || sender.model != shared.DefaultModel {
+		t.Errorf("summarized %v with model %q, want a summary from %s", out.Summarized, sender.model, shared.DefaultModel)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"candle-lights/backend/shared"
+)
+
+// handleCompileParams compiles one effect's raw parameters into a
+// single-segment state, for the pattern editor's live preview. It touches
+// no stored data and logs nothing per call, as the editor calls it on every
+// (debounced) slider change.
+func handleCompileParams(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var req shared.CompileParamsRequest
+	if err := json.Unmarshal([]byte(shared.GetRequestBody(request)), &req); err != nil {
+		return shared.CreateErrorResponse(400, "Invalid request body"), nil
+	}
+
+	frameCount := 0
+	if f := request.QueryStringParameters["includeFrames"]; f != "" {
+		n, err := strconv.Atoi(f)
+		if err != nil || n < 1 || n > shared.MaxPreviewFrames {
+			return shared.CreateErrorResponse(400, "includeFrames must be between 1 and "+strconv.Itoa(shared.MaxPreviewFrames)), nil
+		}
+		frameCount = n
+	}
+
+	state, warnings, errors := shared.BuildPlaygroundState(req)
+	if len(errors) > 0 {
+		return shared.CreateSuccessResponse(200, shared.CompileParamsResponse{
+			Success:  false,
+			Errors:   errors,
+			Warnings: warnings,
+		}), nil
+	}
+
+	bytecode, colorWarnings, err := shared.CompilePlaygroundState(state)
+	if err != nil {
+		return shared.CreateSuccessResponse(200, shared.CompileParamsResponse{
+			Success:  false,
+			Errors:   []string{err.Error()},
+			Warnings: warnings,
+		}), nil
+	}
+
+	response := shared.CompileParamsResponse{
+		Success:  true,
+		Bytecode: bytecode,
+		Warnings: append(warnings, colorWarnings...),
+		State:    state,
+	}
+	if frameCount > 0 {
+		frames, err := shared.SimulateWLEDFramesHex(state, frameCount, state.Segments[0].Stop)
+		if err != nil {
+			return shared.CreateErrorResponse(400, err.Error()), nil
+		}
+		response.Frames = frames
+	}
+	return shared.CreateSuccessResponse(200, response), nil
+}
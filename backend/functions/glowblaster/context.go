@@ -0,0 +1,127 @@
+package main
+
+import (
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"candle-lights/backend/shared"
+)
+
+// defaultContextTokens is the estimated token budget for the messages sent
+// with a chat request when GLOWBLASTER_CONTEXT_TOKENS is unset
+const defaultContextTokens = 30000
+
+// largeCodeBlockChars is the size above which a code block in an older reply
+// is stripped. Small snippets are kept; they cost little and may be referred to.
+const largeCodeBlockChars = 400
+
+// strippedBlockNote replaces a code block stripped from an older reply
+const strippedBlockNote = "[earlier pattern omitted; the latest version is further down]"
+
+// codeBlockPattern matches a fenced code block, including its fences
+var codeBlockPattern = regexp.MustCompile("(?s)```[^\\n]*\\n.*?```")
+
+// contextTokens is the message budget for chat requests, from
+// GLOWBLASTER_CONTEXT_TOKENS
+var contextTokens = contextTokensFromEnv()
+
+// contextTokensFromEnv reads GLOWBLASTER_CONTEXT_TOKENS, falling back to
+// defaultContextTokens when it's unset or not a positive number
+func contextTokensFromEnv() int {
+	raw := os.Getenv("GLOWBLASTER_CONTEXT_TOKENS")
+	if raw == "" {
+		return defaultContextTokens
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 1 {
+		log.Printf("Ignoring GLOWBLASTER_CONTEXT_TOKENS=%q: must be a positive number; using %d", raw, defaultContextTokens)
+		return defaultContextTokens
+	}
+	return n
+}
+
+// claudeContext is the history built for one Claude request
+type claudeContext struct {
+	Messages []shared.ClaudeMessage
+	Info     shared.ChatContext
+}
+
+// buildClaudeContext turns a conversation's messages into what's sent to
+// Claude, keeping the estimate for the messages within maxTokens:
+//
+//   - Large code blocks are stripped from assistant replies older than the
+//     latest one with a pattern, since each pattern supersedes the last.
+//   - Then the oldest messages are dropped until the rest fit. The summary
+//     left by compaction and its acknowledgement are never dropped, nor is
+//     the newest message, and what's kept always starts with a user message.
+func buildClaudeContext(messages []shared.Message, systemPrompt string, maxTokens int) claudeContext {
+	latestPattern := -1
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role == "assistant" && codeBlockPattern.MatchString(messages[i].Content) {
+			latestPattern = i
+			break
+		}
+	}
+
+	info := shared.ChatContext{
+		SystemPromptTokens: tokensForChars(len(systemPrompt)),
+		MaxMessageTokens:   maxTokens,
+	}
+	contents := make([]string, len(messages))
+	stripped := make([]int, len(messages))
+	for i, msg := range messages {
+		contents[i] = msg.Content
+		if msg.Role == "assistant" && i < latestPattern {
+			contents[i] = codeBlockPattern.ReplaceAllStringFunc(msg.Content, func(block string) string {
+				if len(block) <= largeCodeBlockChars {
+					return block
+				}
+				stripped[i]++
+				return strippedBlockNote
+			})
+		}
+	}
+
+	pinned := 0
+	if len(messages) > 0 && messages[0].Role == "user" && strings.HasPrefix(messages[0].Content, compactSummaryPrefix) {
+		pinned = 1
+		if len(messages) > 1 && messages[1].Role == "assistant" {
+			pinned = 2
+		}
+	}
+
+	chars := 0
+	for _, content := range contents {
+		chars += len(content)
+	}
+
+	// Drop from just after the pinned messages, keeping the newest
+	start := pinned
+	for start < len(messages)-1 && (tokensForChars(chars) > maxTokens || messages[start].Role != "user") {
+		chars -= len(contents[start])
+		start++
+	}
+	info.DroppedMessages = start - pinned
+
+	claudeMessages := make([]shared.ClaudeMessage, 0, pinned+len(messages)-start)
+	for i, msg := range messages {
+		if i < pinned || i >= start {
+			claudeMessages = append(claudeMessages, shared.ClaudeMessage{Role: msg.Role, Content: contents[i]})
+			info.StrippedBlocks += stripped[i]
+		}
+	}
+
+	info.Messages = len(claudeMessages)
+	info.EstimatedTokens = info.SystemPromptTokens + tokensForChars(chars)
+	return claudeContext{Messages: claudeMessages, Info: info}
+}
+
+// logClaudeContext records the size of a request's context
+func logClaudeContext(conversationID string, built claudeContext) {
+	info := built.Info
+	log.Printf("Conversation %s context: ~%d input tokens (system prompt ~%d), %d messages, %d dropped, %d code blocks stripped",
+		conversationID, info.EstimatedTokens, info.SystemPromptTokens, info.Messages, info.DroppedMessages, info.StrippedBlocks)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"candle-lights/backend/shared"
+)
+
+// wledReply is an assistant reply carrying a WLED block of about size chars
+func wledReply(fx, size int) string {
+	seg := `{"fx":` + string(rune('0'+fx)) + `,"col":[[255,120,0]]},`
+	block := `{"on":true,"seg":[` + strings.Repeat(seg, size/len(seg)) + `{}]}`
+	return "Here you go:\n```json\n" + block + "\n```\nEnjoy!"
+}
+
+// prose is a message of n chars with no code in it
+func prose(n int) string {
+	return strings.Repeat("glow ", n/5)
+}
+
+func TestBuildContextStripsOlderPatternBlocks(t *testing.T) {
+	snippet := "Try this:\n```json\n{\"bri\":128}\n```"
+	messages := exchange("Make it fire", wledReply(1, 2000))
+	messages = append(messages, exchange("Now sparkle", wledReply(2, 2000)+"\n"+snippet)...)
+	messages = append(messages, exchange("Paste mine:\n```json\n"+strings.Repeat(`{"fx":3},`, 100)+"\n```", "Nice one.")...)
+	messages = append(messages, exchange("Slower please", wledReply(4, 2000))...)
+	messages = append(messages, shared.Message{Role: "user", Content: "Perfect"})
+
+	built := buildClaudeContext(messages, "system prompt", 100000)
+	got := built.Messages
+	if len(got) != len(messages) || built.Info.DroppedMessages != 0 {
+		t.Fatalf("sent %d of %d messages, %d dropped; want all of them within a large budget", len(got), len(messages), built.Info.DroppedMessages)
+	}
+	for _, i := range []int{1, 3} {
+		if strings.Contains(got[i].Content, `"seg"`) || !strings.Contains(got[i].Content, strippedBlockNote) {
+			t.Errorf("older reply %d = %.80q..., want its pattern replaced by the note", i, got[i].Content)
+		}
+		if !strings.HasPrefix(got[i].Content, "Here you go:") || !strings.Contains(got[i].Content, "Enjoy!") {
+			t.Errorf("older reply %d lost its prose: %.80q...", i, got[i].Content)
+		}
+	}
+	if !strings.Contains(got[3].Content, snippet) {
+		t.Error("a small snippet in an older reply was stripped")
+	}
+	if got[4].Content != messages[4].Content {
+		t.Error("a large block in a user message was stripped")
+	}
+	if got[7].Content != messages[7].Content {
+		t.Error("the latest pattern was stripped")
+	}
+	if built.Info.StrippedBlocks != 2 {
+		t.Errorf("%d blocks stripped, want 2", built.Info.StrippedBlocks)
+	}
+
+	chars := 0
+	for _, msg := range got {
+		chars += len(msg.Content)
+	}
+	if want := tokensForChars(len("system prompt")) + tokensForChars(chars); built.Info.EstimatedTokens != want {
+		t.Errorf("estimated %d tokens, want %d for what's sent", built.Info.EstimatedTokens, want)
+	}
+}
+
+// summarizedConversation is a compacted conversation: the summary and its
+// acknowledgement, five exchanges of 1000-char messages, then a new question
+func summarizedConversation() []shared.Message {
+	messages := []shared.Message{
+		{Role: "user", Content: compactSummaryPrefix + "Ocean palette at 40%."},
+		{Role: "assistant", Content: "Got it."},
+	}
+	for i := 0; i < 5; i++ {
+		messages = append(messages, exchange(prose(1000), prose(1000))...)
+	}
+	return append(messages, shared.Message{Role: "user", Content: "Make it faster"})
+}
+
+func TestBuildContextDropsOldestFirst(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxTokens   int
+		wantDropped int
+	}{
+		{"everything fits", 100000, 0},
+		{"last two exchanges fit", 1100, 6},
+		{"would start with a reply", 800, 8},
+		{"only the newest question fits", 400, 10},
+		{"only the pinned messages and the newest", 1, 10},
+	}
+	for _, tt := range tests {
+		messages := summarizedConversation()
+		built := buildClaudeContext(messages, "", tt.maxTokens)
+		got := built.Messages
+
+		if built.Info.DroppedMessages != tt.wantDropped || len(got) != len(messages)-tt.wantDropped {
+			t.Errorf("%s: sent %d messages, %d dropped; want %d dropped", tt.name, len(got), built.Info.DroppedMessages, tt.wantDropped)
+			continue
+		}
+		if got[0].Content != messages[0].Content || got[1].Content != messages[1].Content {
+			t.Errorf("%s: the summary and its acknowledgement weren't kept", tt.name)
+		}
+		if got[len(got)-1].Content != "Make it faster" {
+			t.Errorf("%s: the newest message was dropped", tt.name)
+		}
+		if len(got) > 2 && got[2].Role != "user" {
+			t.Errorf("%s: history after the summary starts with a %s message", tt.name, got[2].Role)
+		}
+		for i := 2; i < len(got); i++ {
+			if got[i].Content != messages[tt.wantDropped+i].Content {
+				t.Errorf("%s: message %d sent isn't the one after those dropped", tt.name, i)
+				break
+			}
+		}
+		if built.Info.Messages != len(got) || built.Info.MaxMessageTokens != tt.maxTokens {
+			t.Errorf("%s: info %+v doesn't describe what was sent", tt.name, built.Info)
+		}
+	}
+}
+
+func TestBuildContextWithoutASummary(t *testing.T) {
+	messages := summarizedConversation()[2:]
+	built := buildClaudeContext(messages, "", 800)
+	got := built.Messages
+	if len(got) != 3 || got[0].Role != "user" || built.Info.DroppedMessages != 8 {
+		t.Errorf("sent %d messages starting with %s, %d dropped; want the last exchange and the question", len(got), got[0].Role, built.Info.DroppedMessages)
+	}
+}
+
+func TestContextTokensFromEnv(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want int
+	}{
+		{"", defaultContextTokens},
+		{"12000", 12000},
+		{"0", defaultContextTokens},
+		{"-5", defaultContextTokens},
+		{"lots", defaultContextTokens},
+	}
+	for _, tt := range tests {
+		t.Setenv("GLOWBLASTER_CONTEXT_TOKENS", tt.raw)
+		if got := contextTokensFromEnv(); got != tt.want {
+			t.Errorf("GLOWBLASTER_CONTEXT_TOKENS=%q: %d, want %d", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestChatReportsItsContext(t *testing.T) {
+	previous := contextTokens
+	contextTokens = 800
+	defer func() { contextTokens = previous }()
+
+	messages := summarizedConversation()
+	messages = messages[:len(messages)-1]
+	store := &stubConversations{items: map[string]shared.Conversation{
+		"c1": {ConversationID: "c1", UserID: "lee", Model: shared.DefaultModel, Messages: messages},
+	}}
+	defer shared.StubDynamoDB(store.handle)()
+	var sent []shared.ClaudeMessage
+	defer shared.StubClaudeAPI(func(req shared.ClaudeRequest) string {
+		sent = req.Messages
+		return "Faster it is."
+	})()
+
+	resp, err := handleChat(context.Background(), "lee", "c1", events.APIGatewayProxyRequest{Body: `{"message":"Make it faster"}`})
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatalf("chat = %d, %v: %s", resp.StatusCode, err, resp.Body)
+	}
+	var out struct {
+		Data shared.ChatResponse `json:"data"`
+	}
+	if err := json.Unmarshal([]byte(resp.Body), &out); err != nil {
+		t.Fatal(err)
+	}
+
+	info := out.Data.Context
+	if info == nil {
+		t.Fatal("chat response has no context info")
+	}
+	if info.Messages != len(sent) || info.DroppedMessages != 8 || info.MaxMessageTokens != 800 {
+		t.Errorf("context info %+v; Claude was sent %d messages, want 8 dropped", *info, len(sent))
+	}
+	if info.SystemPromptTokens != tokensForChars(len(shared.GlowBlasterSystemPrompt)) || info.EstimatedTokens <= info.SystemPromptTokens {
+		t.Errorf("context info %+v doesn't count the system prompt and messages", *info)
+	}
+	if saved := store.items["c1"]; len(saved.Messages) != len(messages)+2 {
+		t.Errorf("saved %d messages, want the whole history kept", len(saved.Messages))
+	}
+}
@@ -3,11 +3,14 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
@@ -21,65 +24,136 @@ import (
 var conversationsTable = os.Getenv("CONVERSATIONS_TABLE")
 var patternsTable = os.Getenv("PATTERNS_TABLE")
 
-func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
-	log.Printf("=== GlowBlaster Handler Called ===")
-	log.Printf("Path: %s", request.Path)
-	log.Printf("Method: %s", request.HTTPMethod)
+var router = newRouter()
 
-	// Validate authentication
-	username, err := shared.ValidateAuth(ctx, request)
-	if err != nil || username == "" {
-		log.Printf("Authentication failed: err=%v, username=%s", err, username)
-		return shared.CreateErrorResponse(401, "Unauthorized"), nil
-	}
-
-	log.Printf("Authenticated user: %s", username)
+func newRouter() *shared.Router {
+	r := shared.NewRouter("GlowBlaster")
+	r.RequireDocs() // Every route is listed in /api/openapi.json
 
-	path := request.Path
-	method := request.HTTPMethod
-	conversationID := request.PathParameters["conversationId"]
-	patternID := request.PathParameters["patternId"]
-
-	switch {
 	// Conversation endpoints
-	case path == "/api/glowblaster/conversations" && method == "GET":
-		return handleListConversations(ctx, username)
-	case path == "/api/glowblaster/conversations" && method == "POST":
-		return handleCreateConversation(ctx, username, request)
-	case strings.HasSuffix(path, "/chat") && method == "POST":
-		return handleChat(ctx, username, conversationID, request)
-	case strings.HasSuffix(path, "/compact") && method == "POST":
-		return handleCompact(ctx, username, conversationID, request)
-	case conversationID != "" && method == "GET" && !strings.Contains(path, "/chat"):
-		return handleGetConversation(ctx, username, conversationID)
-	case conversationID != "" && method == "DELETE":
-		return handleDeleteConversation(ctx, username, conversationID)
-
-	// Compile endpoint
-	case path == "/api/glowblaster/compile" && method == "POST":
-		return handleCompile(ctx, request)
+	r.MustHandleDoc(glowBlasterDoc("GET", "/api/glowblaster/conversations", shared.PolicyAuthenticated, "List conversations; ?includeArchived=true includes archived ones", nil, nil),
+		shared.PathEquals("/api/glowblaster/conversations"),
+		func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+			return handleListConversations(rc.Ctx, rc.Username, rc.Request.QueryStringParameters["includeArchived"] == "true")
+		})
+	r.MustHandleDoc(glowBlasterDoc("POST", "/api/glowblaster/conversations", shared.PolicyAuthenticated, "Start a conversation", shared.CreateConversationRequest{}, shared.Conversation{}),
+		shared.PathEquals("/api/glowblaster/conversations"),
+		func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+			return handleCreateConversation(rc.Ctx, rc.Username, rc.Request)
+		})
+	r.MustHandleDoc(glowBlasterDoc("POST", "/api/glowblaster/conversations/{conversationId}/chat", shared.PolicyAuthenticated, "Send a chat message", shared.ChatRequest{}, shared.ChatResponse{}),
+		shared.PathSuffix("/chat"),
+		func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+			return handleChat(rc.Ctx, rc.Username, rc.Request.PathParameters["conversationId"], rc.Request)
+		})
+	r.MustHandleDoc(glowBlasterDoc("POST", "/api/glowblaster/conversations/{conversationId}/compact", shared.PolicyAuthenticated, "Summarize older messages; summarize=false lists earlier questions instead of asking Claude", shared.CompactRequest{}, shared.CompactResponse{}),
+		shared.PathSuffix("/compact"),
+		func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+			return handleCompact(rc.Ctx, rc.Username, rc.Request.PathParameters["conversationId"], rc.Request)
+		})
+	r.MustHandleDoc(glowBlasterDoc("POST", "/api/glowblaster/conversations/{conversationId}/fork", shared.PolicyAuthenticated, "Fork a conversation", shared.ForkConversationRequest{}, shared.Conversation{}),
+		shared.PathSuffix("/fork"),
+		func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+			return handleForkConversation(rc.Ctx, rc.Username, rc.Request.PathParameters["conversationId"], rc.Request)
+		})
+	r.MustHandleDoc(glowBlasterDoc("GET", "/api/glowblaster/conversations/{conversationId}/lineage", shared.PolicyAuthenticated, "List a conversation's fork ancestors", nil, []shared.ConversationLineageEntry(nil)),
+		shared.PathSuffix("/lineage"),
+		func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+			return handleGetLineage(rc.Ctx, rc.Username, rc.Request.PathParameters["conversationId"])
+		})
+	r.MustHandleDoc(glowBlasterDoc("DELETE", "/api/glowblaster/conversations/{conversationId}/messages/{index}", shared.PolicyAuthenticated, "Delete a message", nil, shared.Conversation{}),
+		shared.HasPathParams("conversationId", "index"),
+		func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+			return handleDeleteMessage(rc.Ctx, rc.Username, rc.Request.PathParameters["conversationId"], rc.Request.PathParameters["index"])
+		})
+	r.MustHandleDoc(glowBlasterDoc("GET", "/api/glowblaster/conversations/{conversationId}", shared.PolicyAuthenticated, "Get a conversation", nil, shared.Conversation{}),
+		shared.HasPathParams("conversationId"),
+		func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+			return handleGetConversation(rc.Ctx, rc.Username, rc.Request.PathParameters["conversationId"])
+		})
+	r.MustHandleDoc(glowBlasterDoc("PUT", "/api/glowblaster/conversations/{conversationId}", shared.PolicyAuthenticated, "Rename or archive a conversation", shared.UpdateConversationRequest{}, shared.Conversation{}),
+		shared.HasPathParams("conversationId"),
+		func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+			return handleUpdateConversation(rc.Ctx, rc.Username, rc.Request.PathParameters["conversationId"], rc.Request)
+		})
+	r.MustHandleDoc(glowBlasterDoc("DELETE", "/api/glowblaster/conversations/{conversationId}", shared.PolicyAuthenticated, "Delete a conversation", nil, nil),
+		shared.HasPathParams("conversationId"),
+		func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+			return handleDeleteConversation(rc.Ctx, rc.Username, rc.Request.PathParameters["conversationId"])
+		})
+
+	// Compile endpoints - stateless, but CPU-heavy, so only for signed-in users
+	r.MustHandleDoc(glowBlasterDoc("POST", "/api/glowblaster/compile", shared.PolicyAuthenticated, "Compile a WLED state or LCL to bytecode", shared.CompileRequest{}, shared.CompileResponse{}),
+		shared.PathEquals("/api/glowblaster/compile"),
+		func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+			return handleCompile(rc.Ctx, rc.Request)
+		})
+	r.MustHandleDoc(glowBlasterDoc("POST", "/api/glowblaster/compile-params", shared.PolicyAuthenticated, "Compile one effect's raw parameters for live preview; ?includeFrames=N adds simulated frames", shared.CompileParamsRequest{}, shared.CompileParamsResponse{}),
+		shared.PathEquals("/api/glowblaster/compile-params"),
+		func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+			return handleCompileParams(rc.Request)
+		})
 
 	// Model endpoint
-	case path == "/api/glowblaster/models" && method == "GET":
-		return handleListModels(ctx)
+	r.MustHandleDoc(glowBlasterDoc("GET", "/api/glowblaster/models", shared.PolicyAuthenticated, "List the available models", nil, map[string]string(nil)),
+		shared.PathEquals("/api/glowblaster/models"),
+		func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+			return handleListModels(rc.Ctx)
+		})
+
+	// Maintenance: move conversations off retired models
+	r.MustHandleDoc(glowBlasterDoc("POST", "/api/glowblaster/admin/migrate-models", shared.PolicyAdmin, "Move conversations off retired models; ?dryRun=true reports only", nil, shared.ConversationModelMigrationResult{}),
+		shared.PathEquals("/api/glowblaster/admin/migrate-models"),
+		func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+			return handleMigrateModels(rc.Ctx, rc.Username, rc.Request)
+		})
 
 	// Pattern endpoints
-	case path == "/api/glowblaster/patterns" && method == "GET":
-		return handleListGlowBlasterPatterns(ctx, username)
-	case path == "/api/glowblaster/patterns" && method == "POST":
-		return handleSavePattern(ctx, username, request)
-	case patternID != "" && method == "PUT":
-		return handleUpdatePattern(ctx, username, patternID, request)
-	case patternID != "" && method == "DELETE":
-		return handleDeletePattern(ctx, username, patternID)
-
-	default:
-		log.Printf("No matching route for path: %s, method: %s", path, method)
-		return shared.CreateErrorResponse(404, "Not found"), nil
-	}
+	r.MustHandleDoc(glowBlasterDoc("GET", "/api/glowblaster/patterns", shared.PolicyAuthenticated, "List GlowBlaster patterns", nil, []shared.Pattern(nil)),
+		shared.PathEquals("/api/glowblaster/patterns"),
+		func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+			return handleListGlowBlasterPatterns(rc.Ctx, rc.Username)
+		})
+	r.MustHandleDoc(glowBlasterDoc("POST", "/api/glowblaster/patterns", shared.PolicyAuthenticated, "Save a conversation's pattern", shared.SavePatternRequest{}, shared.Pattern{}),
+		shared.PathEquals("/api/glowblaster/patterns"),
+		func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+			return handleSavePattern(rc.Ctx, rc.Username, rc.Request)
+		})
+	r.MustHandleDoc(glowBlasterDoc("PUT", "/api/glowblaster/patterns/{patternId}", shared.PolicyAuthenticated, "Update a GlowBlaster pattern", shared.SavePatternRequest{}, shared.Pattern{}),
+		shared.HasPathParams("patternId"),
+		func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+			return handleUpdatePattern(rc.Ctx, rc.Username, rc.Request.PathParameters["patternId"], rc.Request)
+		})
+	r.MustHandleDoc(glowBlasterDoc("DELETE", "/api/glowblaster/patterns/{patternId}", shared.PolicyAuthenticated, "Delete a GlowBlaster pattern", nil, nil),
+		shared.HasPathParams("patternId"),
+		func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+			return handleDeletePattern(rc.Ctx, rc.Username, rc.Request.PathParameters["patternId"])
+		})
+
+	// API reference
+	r.MustHandleDoc(shared.RouteDoc{Method: "GET", Path: "/api/openapi.json", Policy: shared.PolicyPublic, Service: "meta", Summary: "This OpenAPI document"},
+		shared.PathEquals("/api/openapi.json"),
+		func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+			return handleOpenAPISpec(r.Docs())
+		})
+
+	return r
 }
 
-func handleListConversations(ctx context.Context, username string) (events.APIGatewayProxyResponse, error) {
+// glowBlasterDoc describes a GlowBlaster route
+func glowBlasterDoc(method, path string, policy shared.AuthPolicy, summary string, request, response interface{}) shared.RouteDoc {
+	return shared.RouteDoc{Method: method, Path: path, Policy: policy, Service: "glowblaster", Summary: summary, Request: request, Response: response}
+}
+
+func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	log.Printf("=== GlowBlaster Handler Called ===")
+	log.Printf("Path: %s", request.Path)
+	log.Printf("Method: %s", request.HTTPMethod)
+
+	return router.Dispatch(ctx, request)
+}
+
+func handleListConversations(ctx context.Context, username string, includeArchived bool) (events.APIGatewayProxyResponse, error) {
 	indexName := "userId-index"
 	keyCondition := "userId = :userId"
 	expressionValues := map[string]types.AttributeValue{
@@ -92,6 +166,10 @@ func handleListConversations(ctx context.Context, username string) (events.APIGa
 		return shared.CreateErrorResponse(500, "Failed to retrieve conversations"), nil
 	}
 
+	if !includeArchived {
+		conversations = unarchivedConversations(conversations)
+	}
+
 	// Return without full message history for list view
 	summaries := make([]map[string]interface{}, len(conversations))
 	for i, conv := range conversations {
@@ -100,8 +178,10 @@ func handleListConversations(ctx context.Context, username string) (events.APIGa
 			"title":          conv.Title,
 			"model":          conv.Model,
 			"totalTokens":    conv.TotalTokens,
+			"totalCost":      conv.TotalCost,
 			"messageCount":   len(conv.Messages),
 			"hasPattern":     conv.CurrentLCL != "",
+			"archived":       conv.Archived,
 			"createdAt":      conv.CreatedAt,
 			"updatedAt":      conv.UpdatedAt,
 		}
@@ -110,6 +190,17 @@ func handleListConversations(ctx context.Context, username string) (events.APIGa
 	return shared.CreateSuccessResponse(200, summaries), nil
 }
 
+// unarchivedConversations drops archived conversations from a list
+func unarchivedConversations(conversations []shared.Conversation) []shared.Conversation {
+	kept := conversations[:0]
+	for _, conv := range conversations {
+		if !conv.Archived {
+			kept = append(kept, conv)
+		}
+	}
+	return kept
+}
+
 func handleCreateConversation(ctx context.Context, username string, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
 	var req shared.CreateConversationRequest
 	body := shared.GetRequestBody(request)
@@ -158,12 +249,66 @@ func handleGetConversation(ctx context.Context, username, conversationID string)
 		return shared.CreateErrorResponse(500, "Database error"), nil
 	}
 
-	if conversation.ConversationID == "" {
+	if conversation.ConversationID == "" || conversation.UserID != username {
 		return shared.CreateErrorResponse(404, "Conversation not found"), nil
 	}
 
-	if conversation.UserID != username {
-		return shared.CreateErrorResponse(403, "Access denied"), nil
+	return shared.CreateSuccessResponse(200, conversation), nil
+}
+
+// handleUpdateConversation renames a conversation and/or archives or
+// unarchives it
+func handleUpdateConversation(ctx context.Context, username, conversationID string, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var req shared.UpdateConversationRequest
+	if err := json.Unmarshal([]byte(shared.GetRequestBody(request)), &req); err != nil {
+		return shared.CreateErrorResponse(400, "Invalid request body"), nil
+	}
+	if req.Title == nil && req.Archived == nil {
+		return shared.CreateErrorResponse(400, "Nothing to update; send title and/or archived"), nil
+	}
+
+	var title string
+	if req.Title != nil {
+		title = strings.TrimSpace(*req.Title)
+		if title == "" {
+			return shared.CreateErrorResponse(400, "Title cannot be empty"), nil
+		}
+		if utf8.RuneCountInString(title) > shared.MaxConversationTitleLength {
+			return shared.CreateErrorResponse(400, fmt.Sprintf("Title must be at most %d characters", shared.MaxConversationTitleLength)), nil
+		}
+	}
+
+	key, _ := attributevalue.MarshalMap(map[string]string{
+		"conversationId": conversationID,
+	})
+
+	var conversation shared.Conversation
+	if err := shared.GetItem(ctx, conversationsTable, key, &conversation); err != nil {
+		log.Printf("Failed to get conversation: %v", err)
+		return shared.CreateErrorResponse(500, "Database error"), nil
+	}
+
+	if conversation.ConversationID == "" || conversation.UserID != username {
+		return shared.CreateErrorResponse(404, "Conversation not found"), nil
+	}
+
+	now := time.Now()
+	if req.Title != nil {
+		conversation.Title = title
+	}
+	if req.Archived != nil && *req.Archived != conversation.Archived {
+		conversation.Archived = *req.Archived
+		if conversation.Archived {
+			conversation.ArchivedAt = &now
+		} else {
+			conversation.ArchivedAt = nil
+		}
+	}
+	conversation.UpdatedAt = now
+
+	if err := shared.PutItem(ctx, conversationsTable, conversation); err != nil {
+		log.Printf("Failed to update conversation: %v", err)
+		return shared.CreateErrorResponse(500, "Failed to update conversation"), nil
 	}
 
 	return shared.CreateSuccessResponse(200, conversation), nil
@@ -179,14 +324,10 @@ func handleDeleteConversation(ctx context.Context, username, conversationID stri
 		return shared.CreateErrorResponse(500, "Database error"), nil
 	}
 
-	if conversation.ConversationID == "" {
+	if conversation.ConversationID == "" || conversation.UserID != username {
 		return shared.CreateErrorResponse(404, "Conversation not found"), nil
 	}
 
-	if conversation.UserID != username {
-		return shared.CreateErrorResponse(403, "Access denied"), nil
-	}
-
 	if err := shared.DeleteItem(ctx, conversationsTable, key); err != nil {
 		return shared.CreateErrorResponse(500, "Failed to delete conversation"), nil
 	}
@@ -196,8 +337,135 @@ func handleDeleteConversation(ctx context.Context, username, conversationID stri
 	}), nil
 }
 
-func handleChat(ctx context.Context, username, conversationID string, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
-	// Get conversation
+// maxLineageDepth bounds how far handleGetLineage follows ForkedFromID
+const maxLineageDepth = 10
+
+// handleForkConversation copies a conversation's messages up to and including
+// messageIndex into a new conversation that records where it came from
+func handleForkConversation(ctx context.Context, username, conversationID string, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var req shared.ForkConversationRequest
+	body := shared.GetRequestBody(request)
+	if body != "" {
+		if err := json.Unmarshal([]byte(body), &req); err != nil {
+			return shared.CreateErrorResponse(400, "Invalid request body"), nil
+		}
+	}
+
+	key, _ := attributevalue.MarshalMap(map[string]string{
+		"conversationId": conversationID,
+	})
+
+	var source shared.Conversation
+	if err := shared.GetItem(ctx, conversationsTable, key, &source); err != nil {
+		log.Printf("Failed to get conversation: %v", err)
+		return shared.CreateErrorResponse(500, "Database error"), nil
+	}
+
+	if source.ConversationID == "" || source.UserID != username {
+		return shared.CreateErrorResponse(404, "Conversation not found"), nil
+	}
+
+	forkIndex := len(source.Messages) - 1
+	if req.MessageIndex != nil {
+		forkIndex = *req.MessageIndex
+	}
+	if forkIndex < 0 || forkIndex >= len(source.Messages) {
+		return shared.CreateErrorResponse(400, fmt.Sprintf("message index %d out of range", forkIndex)), nil
+	}
+
+	title := req.Title
+	if title == "" {
+		title = source.Title + " (fork)"
+	}
+
+	messages := make([]shared.Message, forkIndex+1)
+	copy(messages, source.Messages[:forkIndex+1])
+
+	totalTokens := 0
+	var totalCost int64
+	for _, msg := range messages {
+		totalTokens += msg.TokensIn + msg.TokensOut
+		totalCost += msg.CostMicrodollars
+	}
+
+	now := time.Now()
+	fork := shared.Conversation{
+		ConversationID:       uuid.New().String(),
+		UserID:               username,
+		Title:                title,
+		Model:                source.Model,
+		Messages:             messages,
+		TotalTokens:          totalTokens,
+		TotalCost:            totalCost,
+		ForkedFromID:         source.ConversationID,
+		ForkedAtMessageIndex: forkIndex,
+		CreatedAt:            now,
+		UpdatedAt:            now,
+		ExpiresAt:            now.Unix() + shared.OneYearInSeconds,
+	}
+	recomputeCurrentPattern(&fork)
+
+	if err := shared.PutItem(ctx, conversationsTable, fork); err != nil {
+		log.Printf("Failed to save forked conversation: %v", err)
+		return shared.CreateErrorResponse(500, "Failed to fork conversation"), nil
+	}
+
+	log.Printf("Forked conversation %s at message %d into %s", source.ConversationID, forkIndex, fork.ConversationID)
+	return shared.CreateSuccessResponse(201, fork), nil
+}
+
+// handleGetLineage follows ForkedFromID from a conversation back to its
+// original, stopping at maxLineageDepth, a deleted or foreign conversation,
+// or a cycle
+func handleGetLineage(ctx context.Context, username, conversationID string) (events.APIGatewayProxyResponse, error) {
+	lineage := []shared.ConversationLineageEntry{}
+	visited := make(map[string]bool)
+
+	currentID := conversationID
+	for depth := 0; depth < maxLineageDepth && currentID != ""; depth++ {
+		if visited[currentID] {
+			log.Printf("Lineage cycle detected at conversation %s", currentID)
+			break
+		}
+		visited[currentID] = true
+
+		key, _ := attributevalue.MarshalMap(map[string]string{
+			"conversationId": currentID,
+		})
+
+		var conversation shared.Conversation
+		if err := shared.GetItem(ctx, conversationsTable, key, &conversation); err != nil {
+			log.Printf("Failed to get conversation %s: %v", currentID, err)
+			return shared.CreateErrorResponse(500, "Database error"), nil
+		}
+
+		if conversation.ConversationID == "" || conversation.UserID != username {
+			if depth == 0 {
+				return shared.CreateErrorResponse(404, "Conversation not found"), nil
+			}
+			// Ancestor was deleted (or isn't ours) - the chain ends here
+			break
+		}
+
+		lineage = append(lineage, shared.ConversationLineageEntry{
+			ConversationID: conversation.ConversationID,
+			Title:          conversation.Title,
+			Depth:          depth,
+		})
+		currentID = conversation.ForkedFromID
+	}
+
+	return shared.CreateSuccessResponse(200, lineage), nil
+}
+
+// handleDeleteMessage removes the last user/assistant exchange from a conversation
+// so a broken response doesn't pollute later prompts
+func handleDeleteMessage(ctx context.Context, username, conversationID, indexParam string) (events.APIGatewayProxyResponse, error) {
+	index, err := strconv.Atoi(indexParam)
+	if err != nil {
+		return shared.CreateErrorResponse(400, "Invalid message index"), nil
+	}
+
 	key, _ := attributevalue.MarshalMap(map[string]string{
 		"conversationId": conversationID,
 	})
@@ -208,12 +476,97 @@ func handleChat(ctx context.Context, username, conversationID string, request ev
 		return shared.CreateErrorResponse(500, "Database error"), nil
 	}
 
-	if conversation.ConversationID == "" {
+	if conversation.ConversationID == "" || conversation.UserID != username {
 		return shared.CreateErrorResponse(404, "Conversation not found"), nil
 	}
 
-	if conversation.UserID != username {
-		return shared.CreateErrorResponse(403, "Access denied"), nil
+	messages, err := removeLastMessagePair(conversation.Messages, index)
+	if err != nil {
+		return shared.CreateErrorResponse(400, err.Error()), nil
+	}
+
+	conversation.Messages = messages
+	recomputeCurrentPattern(&conversation)
+	conversation.UpdatedAt = time.Now()
+
+	if err := shared.PutItem(ctx, conversationsTable, conversation); err != nil {
+		log.Printf("Failed to save conversation: %v", err)
+		return shared.CreateErrorResponse(500, "Failed to save conversation"), nil
+	}
+
+	return shared.CreateSuccessResponse(200, conversation), nil
+}
+
+// removeLastMessagePair removes the message at index along with its paired
+// message, keeping the user/assistant alternation intact. Only the final
+// exchange can be removed so earlier context stays consistent.
+func removeLastMessagePair(messages []shared.Message, index int) ([]shared.Message, error) {
+	if index < 0 || index >= len(messages) {
+		return nil, fmt.Errorf("message index %d out of range", index)
+	}
+	if index == 0 {
+		return nil, fmt.Errorf("cannot delete the first message")
+	}
+
+	start, end := index, index+1
+	if messages[index].Role == "assistant" && messages[index-1].Role == "user" {
+		// Also remove the prompt that triggered this response
+		start = index - 1
+	} else if messages[index].Role == "user" && index+1 < len(messages) && messages[index+1].Role == "assistant" {
+		// Also remove the response to this prompt
+		end = index + 2
+	}
+
+	if end != len(messages) {
+		return nil, fmt.Errorf("only the last message pair can be deleted")
+	}
+
+	return messages[:start], nil
+}
+
+// recomputeCurrentPattern resets the conversation's current pattern from the
+// last remaining assistant message that contains one
+func recomputeCurrentPattern(conversation *shared.Conversation) {
+	conversation.CurrentLCL = ""
+	conversation.CurrentWLED = ""
+	conversation.CurrentWLEDBin = nil
+	conversation.CurrentBytecode = nil
+
+	for i := len(conversation.Messages) - 1; i >= 0; i-- {
+		msg := conversation.Messages[i]
+		if msg.Role != "assistant" {
+			continue
+		}
+		// WLED wins when a message has both, as in handleChat
+		if wledJSON := shared.ExtractWLEDFromResponse(msg.Content); wledJSON != "" {
+			if compiled, _, err := shared.CompileWLED(wledJSON); err == nil {
+				conversation.CurrentWLED = wledJSON
+				conversation.CurrentWLEDBin = compiled
+				conversation.CurrentBytecode = compiled
+				return
+			}
+		}
+		if lcl := shared.ExtractLCLFromResponse(msg.Content); lcl != "" {
+			conversation.CurrentLCL = lcl
+			return
+		}
+	}
+}
+
+func handleChat(ctx context.Context, username, conversationID string, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	// Get conversation
+	key, _ := attributevalue.MarshalMap(map[string]string{
+		"conversationId": conversationID,
+	})
+
+	var conversation shared.Conversation
+	if err := shared.GetItem(ctx, conversationsTable, key, &conversation); err != nil {
+		log.Printf("Failed to get conversation: %v", err)
+		return shared.CreateErrorResponse(500, "Database error"), nil
+	}
+
+	if conversation.ConversationID == "" || conversation.UserID != username {
+		return shared.CreateErrorResponse(404, "Conversation not found"), nil
 	}
 
 	// Parse request
@@ -228,10 +581,16 @@ func handleChat(ctx context.Context, username, conversationID string, request ev
 	}
 
 	// Determine model to use
+	var modelChanged *shared.ModelChange
 	model := conversation.Model
 	if req.Model != "" && shared.IsValidModel(req.Model) {
 		model = req.Model
 		conversation.Model = model
+	} else if !shared.IsValidModel(model) {
+		log.Printf("Conversation %s has invalid model %q, using %s", conversationID, model, shared.DefaultModel)
+		modelChanged = &shared.ModelChange{From: model, To: shared.DefaultModel, Reason: shared.ModelChangeInvalid}
+		model = shared.DefaultModel
+		conversation.Model = model
 	}
 
 	// Add user message
@@ -242,14 +601,27 @@ func handleChat(ctx context.Context, username, conversationID string, request ev
 	}
 	conversation.Messages = append(conversation.Messages, userMessage)
 
-	// Build Claude messages
-	claudeMessages := shared.ConvertMessagesToClaudeFormat(conversation.Messages)
+	// Build Claude messages, trimmed to the context budget
+	built := buildClaudeContext(conversation.Messages, shared.GlowBlasterSystemPrompt, contextTokens)
+	logClaudeContext(conversationID, built)
+	claudeMessages := built.Messages
 
 	// Call Claude API
 	client := shared.NewClaudeClient()
-	claudeResp, err := client.SendMessage(model, shared.GlowBlasterSystemPrompt, claudeMessages)
+	claudeResp, err := client.SendMessage(ctx, model, shared.GlowBlasterSystemPrompt, claudeMessages)
+	if errors.Is(err, shared.ErrModelNotFound) && model != shared.DefaultModel {
+		// The stored model has been retired; retry once on the default and keep it
+		log.Printf("Model %s not found for conversation %s, retrying with %s", model, conversationID, shared.DefaultModel)
+		modelChanged = &shared.ModelChange{From: model, To: shared.DefaultModel, Reason: shared.ModelChangeRetired}
+		model = shared.DefaultModel
+		conversation.Model = model
+		claudeResp, err = client.SendMessage(ctx, model, shared.GlowBlasterSystemPrompt, claudeMessages)
+	}
 	if err != nil {
 		log.Printf("Claude API error: %v", err)
+		if resp, ok := shared.TimeoutErrorResponse(err); ok {
+			return resp, nil
+		}
 		return shared.CreateErrorResponse(500, "AI service error: "+err.Error()), nil
 	}
 
@@ -258,15 +630,11 @@ func handleChat(ctx context.Context, username, conversationID string, request ev
 	tokensUsed := claudeResp.Usage.InputTokens + claudeResp.Usage.OutputTokens
 
 	// Add assistant message
-	assistantMessage := shared.Message{
-		Role:      "assistant",
-		Content:   responseText,
-		TokensIn:  claudeResp.Usage.InputTokens,
-		TokensOut: claudeResp.Usage.OutputTokens,
-		Timestamp: time.Now(),
-	}
+	assistantMessage := shared.NewAssistantMessage(model, responseText, claudeResp.Usage.InputTokens, claudeResp.Usage.OutputTokens, time.Now())
+	costUsed := assistantMessage.CostMicrodollars
 	conversation.Messages = append(conversation.Messages, assistantMessage)
 	conversation.TotalTokens += tokensUsed
+	conversation.TotalCost += assistantMessage.CostMicrodollars
 
 	// Extract and validate WLED JSON from response, retry if invalid
 	wledJSON := shared.ExtractWLEDFromResponse(responseText)
@@ -295,8 +663,10 @@ func handleChat(ctx context.Context, username, conversationID string, request ev
 				}
 				conversation.Messages = append(conversation.Messages, correctionMessage)
 
-				claudeMessages = shared.ConvertMessagesToClaudeFormat(conversation.Messages)
-				claudeResp, err = client.SendMessage(model, shared.GlowBlasterSystemPrompt, claudeMessages)
+				built = buildClaudeContext(conversation.Messages, shared.GlowBlasterSystemPrompt, contextTokens)
+				logClaudeContext(conversationID, built)
+				claudeMessages = built.Messages
+				claudeResp, err = client.SendMessage(ctx, model, shared.GlowBlasterSystemPrompt, claudeMessages)
 				if err != nil {
 					log.Printf("Claude API error on retry: %v", err)
 					break
@@ -306,15 +676,11 @@ func handleChat(ctx context.Context, username, conversationID string, request ev
 				retryTokens := claudeResp.Usage.InputTokens + claudeResp.Usage.OutputTokens
 				tokensUsed += retryTokens
 
-				assistantRetryMessage := shared.Message{
-					Role:      "assistant",
-					Content:   responseText,
-					TokensIn:  claudeResp.Usage.InputTokens,
-					TokensOut: claudeResp.Usage.OutputTokens,
-					Timestamp: time.Now(),
-				}
+				assistantRetryMessage := shared.NewAssistantMessage(model, responseText, claudeResp.Usage.InputTokens, claudeResp.Usage.OutputTokens, time.Now())
+				costUsed += assistantRetryMessage.CostMicrodollars
 				conversation.Messages = append(conversation.Messages, assistantRetryMessage)
 				conversation.TotalTokens += retryTokens
+				conversation.TotalCost += assistantRetryMessage.CostMicrodollars
 
 				wledJSON = shared.ExtractWLEDFromResponse(responseText)
 				continue
@@ -360,8 +726,10 @@ func handleChat(ctx context.Context, username, conversationID string, request ev
 			}
 			conversation.Messages = append(conversation.Messages, correctionMessage)
 
-			claudeMessages = shared.ConvertMessagesToClaudeFormat(conversation.Messages)
-			claudeResp, err = client.SendMessage(model, shared.GlowBlasterSystemPrompt, claudeMessages)
+			built = buildClaudeContext(conversation.Messages, shared.GlowBlasterSystemPrompt, contextTokens)
+			logClaudeContext(conversationID, built)
+			claudeMessages = built.Messages
+			claudeResp, err = client.SendMessage(ctx, model, shared.GlowBlasterSystemPrompt, claudeMessages)
 			if err != nil {
 				log.Printf("Claude API error on retry: %v", err)
 				break
@@ -371,15 +739,11 @@ func handleChat(ctx context.Context, username, conversationID string, request ev
 			retryTokens := claudeResp.Usage.InputTokens + claudeResp.Usage.OutputTokens
 			tokensUsed += retryTokens
 
-			assistantRetryMessage := shared.Message{
-				Role:      "assistant",
-				Content:   responseText,
-				TokensIn:  claudeResp.Usage.InputTokens,
-				TokensOut: claudeResp.Usage.OutputTokens,
-				Timestamp: time.Now(),
-			}
+			assistantRetryMessage := shared.NewAssistantMessage(model, responseText, claudeResp.Usage.InputTokens, claudeResp.Usage.OutputTokens, time.Now())
+			costUsed += assistantRetryMessage.CostMicrodollars
 			conversation.Messages = append(conversation.Messages, assistantRetryMessage)
 			conversation.TotalTokens += retryTokens
+			conversation.TotalCost += assistantRetryMessage.CostMicrodollars
 
 			wledJSON = shared.ExtractWLEDFromResponse(responseText)
 		} else {
@@ -387,6 +751,24 @@ func handleChat(ctx context.Context, username, conversationID string, request ev
 		}
 	}
 
+	// The current pattern is the WLED state when the response had one,
+	// otherwise any LCL block from older prompts
+	var lcl string
+	previewBytecode := wledBinary
+	if wledBinary != nil {
+		conversation.CurrentLCL = ""
+	} else if lcl = shared.ExtractLCLFromResponse(responseText); lcl != "" {
+		if compiled, _, err := shared.CompileLCL(lcl); err != nil {
+			log.Printf("LCL compile error: %v", err)
+		} else {
+			previewBytecode = compiled
+		}
+		conversation.CurrentLCL = lcl
+		conversation.CurrentWLED = ""
+		conversation.CurrentWLEDBin = nil
+		conversation.CurrentBytecode = previewBytecode
+	}
+
 	// Update title if this is the first message
 	if len(conversation.Messages) == 2 && conversation.Title == "New Pattern" {
 		// Extract a title from the user's first message
@@ -413,15 +795,20 @@ func handleChat(ctx context.Context, username, conversationID string, request ev
 	response := shared.ChatResponse{
 		Message:     responseText,
 		PatternName: patternName,
+		LCL:         lcl,
 		WLED:        wledJSON,
 		WLEDBinary:  wledBinary,
-		Bytecode:    wledBinary, // Also set legacy field for backwards compatibility
+		Bytecode:    previewBytecode, // Legacy field: the WLED binary, or compiled LCL
 		TokensUsed:  tokensUsed,
 		TotalTokens: conversation.TotalTokens,
+		Cost:        costUsed,
+		TotalCost:   conversation.TotalCost,
 		Debug: &shared.ChatDebugInfo{
 			SystemPrompt: shared.GlowBlasterSystemPrompt,
 			Messages:     claudeMessages,
 		},
+		ModelChanged: modelChanged,
+		Context:      &built.Info,
 	}
 
 	return shared.CreateSuccessResponse(200, response), nil
@@ -437,14 +824,10 @@ func handleCompact(ctx context.Context, username, conversationID string, request
 		return shared.CreateErrorResponse(500, "Database error"), nil
 	}
 
-	if conversation.ConversationID == "" {
+	if conversation.ConversationID == "" || conversation.UserID != username {
 		return shared.CreateErrorResponse(404, "Conversation not found"), nil
 	}
 
-	if conversation.UserID != username {
-		return shared.CreateErrorResponse(403, "Access denied"), nil
-	}
-
 	// Parse request
 	var req shared.CompactRequest
 	body := shared.GetRequestBody(request)
@@ -461,46 +844,78 @@ func handleCompact(ctx context.Context, username, conversationID string, request
 		}), nil
 	}
 
-	// Create summary of old messages
+	// Summarize old messages with Claude unless asked not to; by default only
+	// when the conversation's model is still available
 	oldMessages := conversation.Messages[:len(conversation.Messages)-keepRecent]
-	summary := "Previous conversation summary:\n"
-	for _, msg := range oldMessages {
-		if msg.Role == "user" {
-			summary += "- User asked about: " + truncate(msg.Content, 100) + "\n"
+	summarize := shared.IsValidModel(conversation.Model)
+	if req.Summarize != nil {
+		summarize = *req.Summarize
+	}
+
+	var warnings []string
+	summary := heuristicSummary(oldMessages)
+	if summarize {
+		model := conversation.Model
+		if !shared.IsValidModel(model) {
+			model = shared.DefaultModel
+		}
+		claudeSummary, err := summarizeMessages(ctx, newCompactSender(), model, oldMessages)
+		if err != nil {
+			log.Printf("Compact: Claude summary failed for conversation %s, listing questions instead: %v", conversationID, err)
+			warnings = append(warnings, "Couldn't generate a summary, so earlier questions were listed instead")
+		} else {
+			summary = claudeSummary
 		}
 	}
 
 	// Keep current LCL context
+	summaryText := summary.Text
 	if conversation.CurrentLCL != "" {
-		summary += "\nCurrent pattern LCL:\n```lcl\n" + conversation.CurrentLCL + "\n```\n"
+		summaryText += "\nCurrent pattern LCL:\n```lcl\n" + conversation.CurrentLCL + "\n```\n"
 	}
 
-	// Create compacted conversation
+	// Create compacted conversation. A Claude summary's usage is recorded on
+	// the acknowledgement, so it's counted like any other reply.
+	acknowledgement := shared.Message{
+		Role:      "assistant",
+		Content:   compactSummaryAck,
+		Timestamp: time.Now(),
+	}
+	tokensUsed := summary.TokensIn + summary.TokensOut
+	if summary.Summarized {
+		acknowledgement = shared.NewAssistantMessage(summary.Model, compactSummaryAck, summary.TokensIn, summary.TokensOut, time.Now())
+	}
 	compactedMessages := []shared.Message{
 		{
 			Role:      "user",
-			Content:   summary,
-			Timestamp: time.Now(),
-		},
-		{
-			Role:      "assistant",
-			Content:   "Understood! I have the context from our previous conversation. How would you like to continue working on the pattern?",
+			Content:   summaryText,
 			Timestamp: time.Now(),
 		},
+		acknowledgement,
 	}
 	compactedMessages = append(compactedMessages, conversation.Messages[len(conversation.Messages)-keepRecent:]...)
 
+	tokensBefore := estimateTokens(conversation.Messages)
+	tokensAfter := estimateTokens(compactedMessages)
+
 	conversation.Messages = compactedMessages
+	conversation.TotalTokens += tokensUsed
+	conversation.TotalCost += acknowledgement.CostMicrodollars
 	conversation.UpdatedAt = time.Now()
 
 	if err := shared.PutItem(ctx, conversationsTable, conversation); err != nil {
 		return shared.CreateErrorResponse(500, "Failed to compact conversation"), nil
 	}
 
-	return shared.CreateSuccessResponse(200, map[string]interface{}{
-		"message":      "Conversation compacted successfully",
-		"messageCount": len(conversation.Messages),
-	}), nil
+	return shared.CreateSuccessResponseWithWarnings(200, shared.CompactResponse{
+		Message:      "Conversation compacted successfully",
+		MessageCount: len(conversation.Messages),
+		Summarized:   summary.Summarized,
+		TokensUsed:   tokensUsed,
+		TokensBefore: tokensBefore,
+		TokensAfter:  tokensAfter,
+		TokensSaved:  max(tokensBefore-tokensAfter, 0),
+	}, warnings), nil
 }
 
 func handleCompile(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
@@ -523,11 +938,16 @@ func handleCompile(ctx context.Context, request events.APIGatewayProxyRequest) (
 	var bytecode []byte
 	var warnings []string
 	var err error
+	var palette []string
+	var segmentColors [][]string
+	var segmentSpeedLevels []int
+	var mergedState string
 
 	// Detect format: WLED JSON starts with {, LCL is YAML
 	if strings.HasPrefix(strings.TrimSpace(req.LCL), "{") {
-		// Try WLED JSON format
-		bytecode, warnings, err = shared.CompileWLED(req.LCL)
+		// Try WLED JSON format; ?autoMerge=true merges adjacent identical segments over the cap
+		var merged *shared.WLEDState
+		bytecode, warnings, merged, err = shared.CompileWLEDWithMerge(req.LCL, request.QueryStringParameters["autoMerge"] == "true")
 		if err != nil {
 			log.Printf("[Compile] WLED compilation error: %v", err)
 			return shared.CreateSuccessResponse(200, shared.CompileResponse{
@@ -536,6 +956,17 @@ func handleCompile(ctx context.Context, request events.APIGatewayProxyRequest) (
 			}), nil
 		}
 		log.Printf("[Compile] Success! WLED binary length: %d", len(bytecode))
+		if merged != nil {
+			if mergedState, err = shared.WLEDStateToJSON(merged); err != nil {
+				log.Printf("[Compile] Failed to encode merged state: %v", err)
+			}
+		}
+
+		// Report the colors that made it into the binary
+		if state, parseErr := shared.ParseBinaryToWLED(bytecode); parseErr == nil {
+			segmentColors = shared.WLEDSegmentColorsHex(state)
+			segmentSpeedLevels = shared.WLEDSegmentSpeedLevels(state)
+		}
 
 		// Log full bytecode in hex format (0x00 format)
 		var hexBytes []string
@@ -574,6 +1005,11 @@ func handleCompile(ctx context.Context, request events.APIGatewayProxyRequest) (
 		}
 		log.Printf("[Compile] Success! LCL bytecode length: %d, Warnings: %v", len(bytecode), warnings)
 
+		// Report the palette that made it into the bytecode
+		if info, inspectErr := shared.InspectLCLBytecode(bytecode); inspectErr == nil {
+			palette = info.Colors
+		}
+
 		// Log full bytecode in hex format
 		var hexBytes []string
 		for _, b := range bytecode {
@@ -591,9 +1027,13 @@ func handleCompile(ctx context.Context, request events.APIGatewayProxyRequest) (
 	}
 
 	return shared.CreateSuccessResponse(200, shared.CompileResponse{
-		Success:  true,
-		Bytecode: bytecode,
-		Warnings: warnings,
+		Success:            true,
+		Bytecode:           bytecode,
+		Warnings:           warnings,
+		Palette:            palette,
+		SegmentColors:      segmentColors,
+		SegmentSpeedLevels: segmentSpeedLevels,
+		MergedState:        mergedState,
 	}), nil
 }
 
@@ -616,6 +1056,7 @@ func handleListGlowBlasterPatterns(ctx context.Context, username string) (events
 			patterns = append(patterns, p)
 		}
 	}
+	shared.FillBinarySizes(patterns)
 
 	return shared.CreateSuccessResponse(200, patterns), nil
 }
@@ -627,8 +1068,13 @@ func handleSavePattern(ctx context.Context, username string, request events.APIG
 		return shared.CreateErrorResponse(400, "Invalid request body"), nil
 	}
 
-	if req.Name == "" {
-		return shared.CreateErrorResponse(400, "Name is required"), nil
+	name, err := shared.ValidateName("pattern", req.Name)
+	if err != nil {
+		return shared.CreateErrorResponse(400, err.Error()), nil
+	}
+	description, err := shared.ValidateDescription(req.Description)
+	if err != nil {
+		return shared.CreateErrorResponse(400, err.Error()), nil
 	}
 
 	// Variables for pattern data
@@ -693,19 +1139,14 @@ func handleSavePattern(ctx context.Context, username string, request events.APIG
 		wledBinary = compiled
 	}
 
-	// Use provided description or default
-	description := req.Description
-
 	now := time.Now()
 	pattern := shared.Pattern{
 		PatternID:      uuid.New().String(),
 		UserID:         username,
-		Name:           req.Name,
+		Name:           name,
 		Description:    description,
 		Type:           shared.PatternGlowBlaster,
 		Category:       shared.CategoryGlowBlaster,
-		WLEDState:      wledJSON,
-		WLEDBinary:     wledBinary,
 		Bytecode:       wledBinary, // Also set legacy field for backwards compatibility
 		FormatVersion:  formatVersion,
 		ConversationID: req.ConversationID, // Link to source conversation
@@ -714,6 +1155,15 @@ func handleSavePattern(ctx context.Context, username string, request events.APIG
 		CreatedAt:      now,
 		UpdatedAt:      now,
 	}
+	// LCL text goes in LCLSpec; WLEDState would take precedence over it
+	if formatVersion == shared.FormatVersionLCL {
+		pattern.LCLSpec = wledJSON
+	} else {
+		pattern.WLEDState = wledJSON
+		pattern.WLEDBinary = wledBinary
+	}
+	shared.NormalizePatternFormat(&pattern)
+	pattern.CompatibleEffectIDs = shared.ComputeCompatibleEffectIDs(&pattern)
 
 	if err := shared.PutItem(ctx, patternsTable, pattern); err != nil {
 		return shared.CreateErrorResponse(500, "Failed to save pattern"), nil
@@ -733,14 +1183,10 @@ func handleUpdatePattern(ctx context.Context, username string, patternID string,
 		return shared.CreateErrorResponse(500, "Database error"), nil
 	}
 
-	if pattern.PatternID == "" {
+	if pattern.PatternID == "" || pattern.UserID != username {
 		return shared.CreateErrorResponse(404, "Pattern not found"), nil
 	}
 
-	if pattern.UserID != username {
-		return shared.CreateErrorResponse(403, "Not authorized to update this pattern"), nil
-	}
-
 	// Parse update request
 	var req shared.SavePatternRequest
 	body := shared.GetRequestBody(request)
@@ -768,9 +1214,11 @@ func handleUpdatePattern(ctx context.Context, username string, patternID string,
 				return shared.CreateErrorResponse(400, "Invalid WLED JSON: "+err.Error()), nil
 			}
 		} else {
-			// Legacy LCL format
+			// Legacy LCL format. Drop any WLED state, which would take precedence.
 			pattern.LCLSpec = req.LCL
 			pattern.IntentLayer = req.LCL
+			pattern.WLEDState = ""
+			pattern.WLEDBinary = nil
 			pattern.FormatVersion = shared.FormatVersionLCL
 
 			// Recompile to bytecode
@@ -784,15 +1232,25 @@ func handleUpdatePattern(ctx context.Context, username string, patternID string,
 
 	// Update name if provided
 	if req.Name != "" {
-		pattern.Name = req.Name
+		name, err := shared.ValidateName("pattern", req.Name)
+		if err != nil {
+			return shared.CreateErrorResponse(400, err.Error()), nil
+		}
+		pattern.Name = name
 	}
 
 	// Update description if provided
 	if req.Description != "" {
-		pattern.Description = req.Description
+		description, err := shared.ValidateDescription(req.Description)
+		if err != nil {
+			return shared.CreateErrorResponse(400, err.Error()), nil
+		}
+		pattern.Description = description
 	}
 
 	pattern.UpdatedAt = time.Now()
+	shared.NormalizePatternFormat(&pattern)
+	pattern.CompatibleEffectIDs = shared.ComputeCompatibleEffectIDs(&pattern)
 
 	if err := shared.PutItem(ctx, patternsTable, pattern); err != nil {
 		return shared.CreateErrorResponse(500, "Failed to update pattern"), nil
@@ -812,14 +1270,10 @@ func handleDeletePattern(ctx context.Context, username string, patternID string)
 		return shared.CreateErrorResponse(500, "Database error"), nil
 	}
 
-	if pattern.PatternID == "" {
+	if pattern.PatternID == "" || pattern.UserID != username {
 		return shared.CreateErrorResponse(404, "Pattern not found"), nil
 	}
 
-	if pattern.UserID != username {
-		return shared.CreateErrorResponse(403, "Not authorized to delete this pattern"), nil
-	}
-
 	// Delete the pattern
 	if err := shared.DeleteItem(ctx, patternsTable, key); err != nil {
 		return shared.CreateErrorResponse(500, "Failed to delete pattern"), nil
@@ -833,14 +1287,46 @@ func handleDeletePattern(ctx context.Context, username string, patternID string)
 
 func handleListModels(ctx context.Context) (events.APIGatewayProxyResponse, error) {
 	client := shared.NewClaudeClient()
-	models, err := client.FetchLatestModels()
+	models, err := client.FetchLatestModels(ctx)
 	if err != nil {
 		log.Printf("Failed to fetch models: %v", err)
+		if resp, ok := shared.TimeoutErrorResponse(err); ok {
+			return resp, nil
+		}
 		return shared.CreateErrorResponse(500, "Failed to retrieve models: "+err.Error()), nil
 	}
 	return shared.CreateSuccessResponse(200, models), nil
 }
 
+// handleMigrateModels moves every conversation whose model Claude no longer
+// lists onto DefaultModel; ?dryRun=true only reports what would change
+func handleMigrateModels(ctx context.Context, username string, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	client := shared.NewClaudeClient()
+	available, err := client.ListModelIDs(ctx)
+	if err != nil {
+		log.Printf("Failed to fetch models: %v", err)
+		if resp, ok := shared.TimeoutErrorResponse(err); ok {
+			return resp, nil
+		}
+		return shared.CreateErrorResponse(500, "Failed to retrieve models: "+err.Error()), nil
+	}
+	if !available[shared.DefaultModel] {
+		// Don't move conversations onto a model that is itself retired
+		return shared.CreateErrorResponse(409, fmt.Sprintf("Default model %s is not available", shared.DefaultModel)), nil
+	}
+
+	dryRun := request.QueryStringParameters["dryRun"] == "true"
+	result, err := shared.MigrateConversationModels(ctx, conversationsTable, available, dryRun)
+	if err != nil {
+		log.Printf("Failed to migrate conversation models: %v", err)
+		return shared.CreateErrorResponse(500, "Failed to migrate conversations"), nil
+	}
+
+	log.Printf("MigrateModels: %s updated %d of %d conversations to %s (dryRun=%v, %d failed)",
+		username, result.Updated, result.Scanned, result.To, dryRun, result.Failed)
+	return shared.CreateSuccessResponse(200, result), nil
+}
+
 func truncate(s string, maxLen int) string {
 	if len(s) <= maxLen {
 		return s
@@ -849,5 +1335,5 @@ func truncate(s string, maxLen int) string {
 }
 
 func main() {
-	lambda.Start(handler)
+	lambda.Start(shared.WithMetrics("glowblaster", shared.WithSessionRotation(shared.WithActivityLog(handler))))
 }
@@ -0,0 +1,546 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"candle-lights/backend/shared"
+)
+
+func TestOnlyTheSpecIsPublic(t *testing.T) {
+	for _, doc := range router.Docs() {
+		if doc.Policy == shared.PolicyPublic && doc.Path != "/api/openapi.json" {
+			t.Errorf("%s %s is public", doc.Method, doc.Path)
+		}
+	}
+}
+
+func TestCompileRequiresSignIn(t *testing.T) {
+	for _, path := range []string{"/api/glowblaster/compile", "/api/glowblaster/compile-params"} {
+		resp, err := router.Dispatch(context.Background(), events.APIGatewayProxyRequest{
+			HTTPMethod: "POST",
+			Path:       path,
+			Body:       `{"lcl":"effect: solid"}`,
+		})
+		if err != nil || resp.StatusCode != 401 {
+			t.Errorf("POST %s without a session = %d, %v; want 401", path, resp.StatusCode, err)
+		}
+	}
+}
+
+func TestSpecListsEveryRoute(t *testing.T) {
+	resp, err := handler(context.Background(), events.APIGatewayProxyRequest{HTTPMethod: "GET", Path: "/api/openapi.json"})
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatalf("GET /api/openapi.json = %d, %v", resp.StatusCode, err)
+	}
+	if got := resp.Headers["Cache-Control"]; got != "public, max-age=3600" {
+		t.Errorf("Cache-Control = %q", got)
+	}
+	var spec struct {
+		Paths map[string]map[string]struct {
+			Policy string `json:"x-auth-policy"`
+		} `json:"paths"`
+	}
+	if err := json.Unmarshal([]byte(resp.Body), &spec); err != nil {
+		t.Fatal(err)
+	}
+
+	routes := append(router.Docs(), shared.APIRoutes...)
+	if len(router.Docs()) == 0 {
+		t.Fatal("the router has no documented routes")
+	}
+	for _, doc := range routes {
+		op, ok := spec.Paths[doc.Path][strings.ToLower(doc.Method)]
+		if !ok {
+			t.Errorf("%s %s is missing from the spec", doc.Method, doc.Path)
+		} else if op.Policy != doc.Policy.String() {
+			t.Errorf("%s %s is documented as %s, want %s", doc.Method, doc.Path, op.Policy, doc.Policy)
+		}
+	}
+}
+
+const (
+	redWLEDReply = "Here you go:\n```json\n{\"on\":true,\"bri\":128,\"seg\":[{\"start\":0,\"stop\":30,\"fx\":0,\"col\":[[255,0,0]]}]}\n```"
+	blueLCLReply = "Try this:\n```lcl\neffect: solid\nappearance:\n  color: blue\n```"
+)
+
+func exchange(prompt, reply string) []shared.Message {
+	return []shared.Message{{Role: "user", Content: prompt}, {Role: "assistant", Content: reply}}
+}
+
+func TestRemoveLastMessagePairKeepsAlternation(t *testing.T) {
+	twoExchanges := append(exchange("red", redWLEDReply), exchange("blue", blueLCLReply)...)
+	unanswered := append(exchange("red", redWLEDReply), shared.Message{Role: "user", Content: "blue"})
+
+	tests := []struct {
+		name     string
+		messages []shared.Message
+		index    int
+		wantLen  int
+		wantErr  string
+	}{
+		{"last reply takes its prompt", twoExchanges, 3, 2, ""},
+		{"last prompt takes its reply", twoExchanges, 2, 2, ""},
+		{"unanswered prompt", unanswered, 2, 2, ""},
+		{"earlier pair", twoExchanges, 1, 0, "only the last message pair"},
+		{"first message", twoExchanges, 0, 0, "cannot delete the first message"},
+		{"out of range", twoExchanges, 4, 0, "out of range"},
+		{"negative", twoExchanges, -1, 0, "out of range"},
+	}
+	for _, tt := range tests {
+		got, err := removeLastMessagePair(tt.messages, tt.index)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: err = %v, want %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || len(got) != tt.wantLen {
+			t.Errorf("%s: %d messages, %v; want %d", tt.name, len(got), err, tt.wantLen)
+			continue
+		}
+		for i, msg := range got {
+			if want := []string{"user", "assistant"}[i%2]; msg.Role != want {
+				t.Errorf("%s: message %d is %s, want %s", tt.name, i, msg.Role, want)
+			}
+		}
+	}
+}
+
+func TestRecomputeCurrentPattern(t *testing.T) {
+	conversation := shared.Conversation{
+		Messages:   append(exchange("red", redWLEDReply), exchange("thanks", "Glad you like it")...),
+		CurrentLCL: "effect: solid",
+	}
+	recomputeCurrentPattern(&conversation)
+	if conversation.CurrentWLED == "" || len(conversation.CurrentBytecode) == 0 || conversation.CurrentLCL != "" {
+		t.Errorf("current pattern = %q / %q, want the red WLED from the earlier reply", conversation.CurrentWLED, conversation.CurrentLCL)
+	}
+
+	conversation.Messages = append(conversation.Messages, exchange("blue", blueLCLReply)...)
+	recomputeCurrentPattern(&conversation)
+	if conversation.CurrentLCL == "" || conversation.CurrentWLED != "" || conversation.CurrentBytecode != nil {
+		t.Errorf("current pattern = %q / %q, want the blue LCL from the last reply", conversation.CurrentWLED, conversation.CurrentLCL)
+	}
+
+	conversation.Messages = exchange("hello", "What would you like?")
+	recomputeCurrentPattern(&conversation)
+	if conversation.CurrentLCL != "" || conversation.CurrentWLED != "" || conversation.CurrentBytecode != nil {
+		t.Errorf("current pattern = %q / %q, want none", conversation.CurrentWLED, conversation.CurrentLCL)
+	}
+}
+
+func TestDeleteMessageRestoresEarlierPattern(t *testing.T) {
+	stored := shared.Conversation{
+		ConversationID: "c1",
+		UserID:         "lee",
+		Messages:       append(exchange("red", redWLEDReply), exchange("blue", blueLCLReply)...),
+		CurrentLCL:     "effect: solid",
+	}
+	var saved []shared.Conversation
+	defer shared.StubDynamoDB(func(call shared.DynamoDBStubCall) (map[string]interface{}, error) {
+		switch call.Operation {
+		case "GetItem":
+			return map[string]interface{}{"Item": shared.DynamoDBStubItem(stored)}, nil
+		case "PutItem":
+			var conversation shared.Conversation
+			if err := call.Unmarshal("Item", &conversation); err != nil {
+				return nil, err
+			}
+			saved = append(saved, conversation)
+			return nil, nil
+		}
+		return nil, fmt.Errorf("unexpected %s", call.Operation)
+	})()
+
+	if resp, err := handleDeleteMessage(context.Background(), "sam", "c1", "3"); err != nil || resp.StatusCode != 404 {
+		t.Errorf("someone else's conversation = %d, %v; want 404", resp.StatusCode, err)
+	}
+	if resp, err := handleDeleteMessage(context.Background(), "lee", "c1", "1"); err != nil || resp.StatusCode != 400 {
+		t.Errorf("earlier pair = %d, %v; want 400", resp.StatusCode, err)
+	}
+	if len(saved) != 0 {
+		t.Fatalf("refused deletes saved the conversation")
+	}
+
+	resp, err := handleDeleteMessage(context.Background(), "lee", "c1", "3")
+	if err != nil || resp.StatusCode != 200 || len(saved) != 1 {
+		t.Fatalf("delete = %d, %v with %d saves; want 200 and one save", resp.StatusCode, err, len(saved))
+	}
+	if len(saved[0].Messages) != 2 || saved[0].CurrentWLED == "" || saved[0].CurrentLCL != "" {
+		t.Errorf("saved %d messages with pattern %q / %q, want the first exchange and its red WLED",
+			len(saved[0].Messages), saved[0].CurrentWLED, saved[0].CurrentLCL)
+	}
+}
+
+// stubConversations stands in for the conversations table
+type stubConversations struct {
+	mu    sync.Mutex
+	items map[string]shared.Conversation
+}
+
+func (s *stubConversations) handle(call shared.DynamoDBStubCall) (map[string]interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch call.Operation {
+	case "GetItem":
+		var key struct {
+			ConversationID string `dynamodbav:"conversationId"`
+		}
+		if err := call.Unmarshal("Key", &key); err != nil {
+			return nil, err
+		}
+		conversation, ok := s.items[key.ConversationID]
+		if !ok {
+			return nil, nil
+		}
+		return map[string]interface{}{"Item": shared.DynamoDBStubItem(conversation)}, nil
+	case "PutItem":
+		var conversation shared.Conversation
+		if err := call.Unmarshal("Item", &conversation); err != nil {
+			return nil, err
+		}
+		s.items[conversation.ConversationID] = conversation
+		return nil, nil
+	case "Query":
+		var values struct {
+			UserID string `dynamodbav:":userId"`
+		}
+		if err := call.Unmarshal("ExpressionAttributeValues", &values); err != nil {
+			return nil, err
+		}
+		var items []interface{}
+		for _, conversation := range s.items {
+			if conversation.UserID == values.UserID {
+				items = append(items, conversation)
+			}
+		}
+		return map[string]interface{}{"Items": shared.DynamoDBStubItems(items...), "Count": len(items)}, nil
+	}
+	return nil, fmt.Errorf("unexpected %s", call.Operation)
+}
+
+func TestLineageFollowsForkChain(t *testing.T) {
+	store := &stubConversations{items: map[string]shared.Conversation{
+		"root": {
+			ConversationID: "root",
+			UserID:         "lee",
+			Title:          "Sunset",
+			Messages:       append(exchange("red", redWLEDReply), exchange("blue", blueLCLReply)...),
+		},
+	}}
+	defer shared.StubDynamoDB(store.handle)()
+
+	fork := func(conversationID, body string) shared.Conversation {
+		resp, err := handleForkConversation(context.Background(), "lee", conversationID, events.APIGatewayProxyRequest{Body: body})
+		if err != nil || resp.StatusCode != 201 {
+			t.Fatalf("fork %s = %d, %v: %s", conversationID, resp.StatusCode, err, resp.Body)
+		}
+		var out struct {
+			Data shared.Conversation `json:"data"`
+		}
+		if err := json.Unmarshal([]byte(resp.Body), &out); err != nil {
+			t.Fatal(err)
+		}
+		return out.Data
+	}
+	child := fork("root", `{"messageIndex":1}`)
+	grandchild := fork(child.ConversationID, `{"title":"Sunset, dimmer"}`)
+
+	if child.ForkedFromID != "root" || child.ForkedAtMessageIndex != 1 || len(child.Messages) != 2 {
+		t.Errorf("child = from %q at %d with %d messages, want from root at 1 with 2", child.ForkedFromID, child.ForkedAtMessageIndex, len(child.Messages))
+	}
+
+	resp, err := handleGetLineage(context.Background(), "lee", grandchild.ConversationID)
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatalf("lineage = %d, %v", resp.StatusCode, err)
+	}
+	var out struct {
+		Data []shared.ConversationLineageEntry `json:"data"`
+	}
+	if err := json.Unmarshal([]byte(resp.Body), &out); err != nil {
+		t.Fatal(err)
+	}
+	want := []shared.ConversationLineageEntry{
+		{ConversationID: grandchild.ConversationID, Title: "Sunset, dimmer", Depth: 0},
+		{ConversationID: child.ConversationID, Title: "Sunset (fork)", Depth: 1},
+		{ConversationID: "root", Title: "Sunset", Depth: 2},
+	}
+	if fmt.Sprint(out.Data) != fmt.Sprint(want) {
+		t.Errorf("lineage = %+v, want %+v", out.Data, want)
+	}
+
+	if resp, _ := handleGetLineage(context.Background(), "sam", grandchild.ConversationID); resp.StatusCode != 404 {
+		t.Errorf("someone else's lineage = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestLineageStopsAtCycle(t *testing.T) {
+	store := &stubConversations{items: map[string]shared.Conversation{
+		"a": {ConversationID: "a", UserID: "lee", Title: "A", ForkedFromID: "b"},
+		"b": {ConversationID: "b", UserID: "lee", Title: "B", ForkedFromID: "a"},
+	}}
+	defer shared.StubDynamoDB(store.handle)()
+
+	resp, err := handleGetLineage(context.Background(), "lee", "a")
+	var out struct {
+		Data []shared.ConversationLineageEntry `json:"data"`
+	}
+	if err != nil || resp.StatusCode != 200 || json.Unmarshal([]byte(resp.Body), &out) != nil || len(out.Data) != 2 {
+		t.Errorf("lineage of a cycle = %d, %v: %s; want a and b once each", resp.StatusCode, err, resp.Body)
+	}
+}
+
+func TestForeignConversationsLookMissing(t *testing.T) {
+	defer shared.StubDynamoDB(shared.StubOwnershipHandler("lee", "foreign", "sam"))()
+
+	routes := []struct {
+		method, path, param, body string
+	}{
+		{"GET", "/api/glowblaster/conversations/%s", "conversationId", ""},
+		{"PUT", "/api/glowblaster/conversations/%s", "conversationId", `{"title":"Dusk"}`},
+		{"DELETE", "/api/glowblaster/conversations/%s", "conversationId", ""},
+		{"GET", "/api/glowblaster/conversations/%s/lineage", "conversationId", ""},
+		{"POST", "/api/glowblaster/conversations/%s/fork", "conversationId", `{}`},
+		{"POST", "/api/glowblaster/conversations/%s/chat", "conversationId", `{"message":"red"}`},
+		{"POST", "/api/glowblaster/conversations/%s/compact", "conversationId", `{"summarize":false}`},
+		{"DELETE", "/api/glowblaster/conversations/%s/messages/1", "conversationId", ""},
+		{"PUT", "/api/glowblaster/patterns/%s", "patternId", `{"name":"Dusk"}`},
+		{"DELETE", "/api/glowblaster/patterns/%s", "patternId", ""},
+	}
+	for _, route := range routes {
+		var responses [2]events.APIGatewayProxyResponse
+		for i, id := range []string{"foreign", "missing"} {
+			resp, err := handler(context.Background(), events.APIGatewayProxyRequest{
+				HTTPMethod:     route.method,
+				Path:           fmt.Sprintf(route.path, id),
+				PathParameters: map[string]string{route.param: id, "index": "1"},
+				Headers:        map[string]string{"Authorization": "Bearer session-lee"},
+				Body:           route.body,
+			})
+			if err != nil {
+				t.Fatalf("%s %s: %v", route.method, route.path, err)
+			}
+			responses[i] = resp
+		}
+		if responses[0].StatusCode != 404 || responses[0].StatusCode != responses[1].StatusCode || responses[0].Body != responses[1].Body {
+			t.Errorf("%s %s: foreign = %d %s, missing = %d %s; want the same 404", route.method, route.path,
+				responses[0].StatusCode, responses[0].Body, responses[1].StatusCode, responses[1].Body)
+		}
+	}
+}
+
+func TestChatKeepsCurrentPatternInStep(t *testing.T) {
+	const staleWLED = `{"on":true,"bri":10,"seg":[{"start":0,"stop":30,"fx":0,"col":[[0,255,0]]}]}`
+
+	tests := []struct {
+		name     string
+		reply    string
+		wantWLED bool
+		wantLCL  bool
+	}{
+		{"WLED block", redWLEDReply, true, false},
+		{"LCL block", blueLCLReply, false, true},
+		{"both prefer WLED", blueLCLReply + "\n\n" + redWLEDReply, true, false},
+		{"neither", "What colors would you like?", false, false},
+	}
+	for _, tt := range tests {
+		store := &stubConversations{items: map[string]shared.Conversation{
+			"c1": {
+				ConversationID: "c1",
+				UserID:         "lee",
+				Model:          shared.DefaultModel,
+				CurrentWLED:    staleWLED,
+				CurrentLCL:     "effect: solid",
+			},
+		}}
+		restoreDB := shared.StubDynamoDB(store.handle)
+		restoreClaude := shared.StubClaudeAPI(func(shared.ClaudeRequest) string { return tt.reply })
+
+		resp, err := handleChat(context.Background(), "lee", "c1", events.APIGatewayProxyRequest{Body: `{"message":"make it glow"}`})
+		restoreClaude()
+		restoreDB()
+		if err != nil || resp.StatusCode != 200 {
+			t.Errorf("%s: chat = %d, %v: %s", tt.name, resp.StatusCode, err, resp.Body)
+			continue
+		}
+		var out struct {
+			Data shared.ChatResponse `json:"data"`
+		}
+		if err := json.Unmarshal([]byte(resp.Body), &out); err != nil {
+			t.Fatal(err)
+		}
+		saved := store.items["c1"]
+
+		switch {
+		case tt.wantWLED:
+			if out.Data.WLED == "" || out.Data.LCL != "" || len(out.Data.Bytecode) == 0 {
+				t.Errorf("%s: response wled %q, lcl %q, %d bytecode bytes; want the WLED state only", tt.name, out.Data.WLED, out.Data.LCL, len(out.Data.Bytecode))
+			}
+			if saved.CurrentWLED != out.Data.WLED || saved.CurrentLCL != "" || !reflect.DeepEqual(saved.CurrentBytecode, out.Data.Bytecode) {
+				t.Errorf("%s: saved %q / %q, want the reply's WLED state", tt.name, saved.CurrentWLED, saved.CurrentLCL)
+			}
+		case tt.wantLCL:
+			if out.Data.LCL == "" || out.Data.WLED != "" || len(out.Data.Bytecode) == 0 {
+				t.Errorf("%s: response wled %q, lcl %q, %d bytecode bytes; want the compiled LCL only", tt.name, out.Data.WLED, out.Data.LCL, len(out.Data.Bytecode))
+			}
+			if saved.CurrentLCL != out.Data.LCL || saved.CurrentWLED != "" || saved.CurrentWLEDBin != nil {
+				t.Errorf("%s: saved %q / %q, want the reply's LCL", tt.name, saved.CurrentWLED, saved.CurrentLCL)
+			}
+		default:
+			// A reply without a pattern leaves the current one alone
+			if out.Data.WLED != "" || out.Data.LCL != "" || saved.CurrentWLED != staleWLED || saved.CurrentLCL != "effect: solid" {
+				t.Errorf("%s: response %q / %q, saved %q / %q; want the earlier pattern kept",
+					tt.name, out.Data.WLED, out.Data.LCL, saved.CurrentWLED, saved.CurrentLCL)
+			}
+		}
+	}
+}
+
+func TestSavePatternPrefersConversationWLED(t *testing.T) {
+	tests := []struct {
+		name       string
+		wled, lcl  string
+		wantFormat int
+		wantWLED   bool
+	}{
+		{"both", `{"on":true,"bri":128,"seg":[{"start":0,"stop":30,"fx":0,"col":[[255,0,0]]}]}`, "effect: solid", shared.FormatVersionWLED, true},
+		{"LCL only", "", "effect: solid\nappearance:\n  color: blue", shared.FormatVersionLCL, false},
+	}
+	for _, tt := range tests {
+		conversation := shared.Conversation{ConversationID: "c1", UserID: "lee", CurrentWLED: tt.wled, CurrentLCL: tt.lcl}
+		var saved []shared.Pattern
+		restore := shared.StubDynamoDB(func(call shared.DynamoDBStubCall) (map[string]interface{}, error) {
+			switch call.Operation {
+			case "GetItem":
+				return map[string]interface{}{"Item": shared.DynamoDBStubItem(conversation)}, nil
+			case "PutItem":
+				var pattern shared.Pattern
+				if err := call.Unmarshal("Item", &pattern); err != nil {
+					return nil, err
+				}
+				saved = append(saved, pattern)
+				return nil, nil
+			}
+			return nil, fmt.Errorf("unexpected %s", call.Operation)
+		})
+		resp, err := handleSavePattern(context.Background(), "lee", events.APIGatewayProxyRequest{Body: `{"name":"Glow","conversationId":"c1"}`})
+		restore()
+		if err != nil || resp.StatusCode != 201 || len(saved) != 1 {
+			t.Errorf("%s: save = %d, %v with %d puts: %s", tt.name, resp.StatusCode, err, len(saved), resp.Body)
+			continue
+		}
+		pattern := saved[0]
+		if pattern.FormatVersion != tt.wantFormat || len(pattern.Bytecode) == 0 {
+			t.Errorf("%s: saved format %d with %d bytecode bytes, want format %d", tt.name, pattern.FormatVersion, len(pattern.Bytecode), tt.wantFormat)
+		}
+		if tt.wantWLED && (pattern.WLEDState != tt.wled || pattern.LCLSpec != "") {
+			t.Errorf("%s: saved WLED %q, LCL %q; want the conversation's WLED state", tt.name, pattern.WLEDState, pattern.LCLSpec)
+		}
+		if !tt.wantWLED && (pattern.LCLSpec != tt.lcl || pattern.WLEDState != "") {
+			t.Errorf("%s: saved WLED %q, LCL %q; want the conversation's LCL", tt.name, pattern.WLEDState, pattern.LCLSpec)
+		}
+	}
+}
+
+// listedConversations returns the IDs handleListConversations lists for lee
+func listedConversations(t *testing.T, includeArchived bool) []string {
+	t.Helper()
+	resp, err := handleListConversations(context.Background(), "lee", includeArchived)
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatalf("list = %d, %v", resp.StatusCode, err)
+	}
+	var out struct {
+		Data []struct {
+			ConversationID string `json:"conversationId"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal([]byte(resp.Body), &out); err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, conv := range out.Data {
+		ids = append(ids, conv.ConversationID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestArchivedConversationsAreListedOnRequest(t *testing.T) {
+	store := &stubConversations{items: map[string]shared.Conversation{
+		"c1":     {ConversationID: "c1", UserID: "lee", Title: "Sunset"},
+		"c2":     {ConversationID: "c2", UserID: "lee", Title: "Ocean"},
+		"theirs": {ConversationID: "theirs", UserID: "sam", Title: "Forest"},
+	}}
+	defer shared.StubDynamoDB(store.handle)()
+
+	update := func(username, body string) events.APIGatewayProxyResponse {
+		resp, err := handleUpdateConversation(context.Background(), username, "c2", events.APIGatewayProxyRequest{Body: body})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	if resp := update("lee", `{"archived":true}`); resp.StatusCode != 200 || store.items["c2"].ArchivedAt == nil {
+		t.Fatalf("archive = %d %s", resp.StatusCode, resp.Body)
+	}
+	if got := listedConversations(t, false); !reflect.DeepEqual(got, []string{"c1"}) {
+		t.Errorf("list = %v, want [c1] without the archived conversation", got)
+	}
+	if got := listedConversations(t, true); !reflect.DeepEqual(got, []string{"c1", "c2"}) {
+		t.Errorf("list with includeArchived = %v, want [c1 c2]", got)
+	}
+
+	if resp := update("lee", `{"archived":false}`); resp.StatusCode != 200 || store.items["c2"].ArchivedAt != nil {
+		t.Fatalf("unarchive = %d %s", resp.StatusCode, resp.Body)
+	}
+	if got := listedConversations(t, false); !reflect.DeepEqual(got, []string{"c1", "c2"}) {
+		t.Errorf("list after unarchiving = %v, want [c1 c2]", got)
+	}
+}
+
+func TestUpdateConversationTitle(t *testing.T) {
+	store := &stubConversations{items: map[string]shared.Conversation{
+		"c2": {ConversationID: "c2", UserID: "lee", Title: "Ocean"},
+	}}
+	defer shared.StubDynamoDB(store.handle)()
+
+	tests := []struct {
+		name       string
+		username   string
+		body       string
+		wantStatus int
+		wantTitle  string
+	}{
+		{"trimmed", "lee", `{"title":"  Deep ocean  "}`, 200, "Deep ocean"},
+		{"at the limit", "lee", `{"title":"` + strings.Repeat("é", shared.MaxConversationTitleLength) + `"}`, 200, strings.Repeat("é", shared.MaxConversationTitleLength)},
+		{"too long", "lee", `{"title":"` + strings.Repeat("a", shared.MaxConversationTitleLength+1) + `"}`, 400, ""},
+		{"blank", "lee", `{"title":"   "}`, 400, ""},
+		{"nothing to update", "lee", `{}`, 400, ""},
+		{"someone else's", "sam", `{"title":"Mine now"}`, 404, ""},
+	}
+	for _, tt := range tests {
+		before := store.items["c2"].Title
+		resp, err := handleUpdateConversation(context.Background(), tt.username, "c2", events.APIGatewayProxyRequest{Body: tt.body})
+		if err != nil || resp.StatusCode != tt.wantStatus {
+			t.Errorf("%s: %d %s, %v; want %d", tt.name, resp.StatusCode, resp.Body, err, tt.wantStatus)
+			continue
+		}
+		want := tt.wantTitle
+		if tt.wantStatus != 200 {
+			want = before // Refused updates change nothing
+		}
+		if got := store.items["c2"].Title; got != want {
+			t.Errorf("%s: title %q, want %q", tt.name, got, want)
+		}
+	}
+}
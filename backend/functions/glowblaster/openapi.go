@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"candle-lights/backend/shared"
+)
+
+// openAPITitle and openAPIVersion go in the spec's info block
+const (
+	openAPITitle   = "Candle Lights API"
+	openAPIVersion = "1.0.0"
+)
+
+var (
+	openAPIOnce sync.Once
+	openAPIBody string
+)
+
+// handleOpenAPISpec serves the OpenAPI document for this router's routes and
+// shared.APIRoutes. The document only changes with a deploy, so it is built
+// once per container and cached by clients for an hour.
+func handleOpenAPISpec(docs []shared.RouteDoc) (events.APIGatewayProxyResponse, error) {
+	openAPIOnce.Do(func() {
+		routes := append(append([]shared.RouteDoc(nil), shared.APIRoutes...), docs...)
+		body, err := json.Marshal(shared.BuildOpenAPISpec(openAPITitle, openAPIVersion, routes))
+		if err != nil {
+			log.Printf("Failed to build OpenAPI spec: %v", err)
+			return
+		}
+		openAPIBody = string(body)
+	})
+	if openAPIBody == "" {
+		return shared.CreateErrorResponse(500, "Failed to build API spec"), nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Headers: map[string]string{
+			"Content-Type":                "application/json",
+			"Cache-Control":               "public, max-age=3600",
+			"Access-Control-Allow-Origin": "*",
+		},
+		Body: openAPIBody,
+	}, nil
+}
@@ -3,8 +3,10 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"log"
 	"os"
+	"time"
 
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -19,6 +21,7 @@ import (
 var (
 	patternsTable      = os.Getenv("PATTERNS_TABLE")
 	conversationsTable = os.Getenv("CONVERSATIONS_TABLE")
+	usersTable         = os.Getenv("USERS_TABLE")
 	ddbClient          *dynamodb.Client
 )
 
@@ -32,13 +35,24 @@ func init() {
 
 // MigrationRequest contains migration parameters
 type MigrationRequest struct {
-	DryRun       bool `json:"dryRun"`       // If true, don't write changes
-	MaxItems     int  `json:"maxItems"`     // Max items to migrate (0 = all)
-	MigrateConvs bool `json:"migrateConvs"` // Also migrate conversations
+	DryRun           bool `json:"dryRun"`           // If true, don't write changes
+	MaxItems         int  `json:"maxItems"`         // Max items to migrate (0 = all)
+	MigrateConvs     bool `json:"migrateConvs"`     // Also migrate conversations
+	MigrateUsers     bool `json:"migrateUsers"`     // Backfill new boolean fields on existing users
+	FixPatternColors bool `json:"fixPatternColors"` // Rewrite RGB that conflicts with colors[0]
+	FixFormats       bool `json:"fixFormats"`       // Make formatVersion, type, and category agree with pattern content
+	MigrateEffectIDs bool `json:"migrateEffectIds"` // Move legacy patterns' metadata effectId into effectId
+	BackfillBinaries bool `json:"backfillBinaries"` // Store the compiled wledBinary on WLED patterns without a current one
+
+	Concurrency   int    `json:"concurrency"`   // Patterns converted at once (default 4, at most 16)
+	ProgressEvery int    `json:"progressEvery"` // Log pattern migration progress every N patterns scanned (default 100)
+	ResumeToken   string `json:"resumeToken"`   // From a result whose pattern migration stopped short, to carry on from there
+	NotifyURL     string `json:"notifyUrl"`     // https URL the final MigrationResult is POSTed to, as JSON
 }
 
 // MigrationResult contains migration statistics
 type MigrationResult struct {
+	PatternsScanned      int      `json:"patternsScanned"`
 	PatternsMigrated     int      `json:"patternsMigrated"`
 	PatternsSkipped      int      `json:"patternsSkipped"`
 	PatternsFailed       int      `json:"patternsFailed"`
@@ -48,18 +62,65 @@ type MigrationResult struct {
 	DryRun               bool     `json:"dryRun"`
 	Errors               []string `json:"errors,omitempty"`
 	MigratedPatternNames []string `json:"migratedPatternNames,omitempty"`
+	UsersMigrated        int      `json:"usersMigrated"`
+	UsersFailed          int      `json:"usersFailed"`
+	PatternColorsFixed   int      `json:"patternColorsFixed"`
+	PatternColorsFailed  int      `json:"patternColorsFailed"`
+	FixedColorPatternIDs []string `json:"fixedColorPatternIds,omitempty"`
+
+	PatternFormats *shared.PatternFormatFixResult  `json:"patternFormats,omitempty"` // Per-pattern report of format fixes
+	EffectIDs      *shared.EffectIDMigrationResult `json:"effectIds,omitempty"`      // Per-pattern report of effectId moves
+	Binaries       *shared.BinaryBackfillResult    `json:"binaries,omitempty"`       // Per-pattern report of wledBinary backfills
+
+	// Set when the pattern migration stopped before the Lambda's deadline;
+	// pass it back as resumeToken to migrate the rest
+	ResumeToken string `json:"resumeToken,omitempty"`
 }
 
 func handler(ctx context.Context, request MigrationRequest) (MigrationResult, error) {
 	log.Printf("=== Migration Handler Called ===")
-	log.Printf("DryRun: %v, MaxItems: %d, MigrateConvs: %v", request.DryRun, request.MaxItems, request.MigrateConvs)
+	log.Printf("DryRun: %v, MaxItems: %d, MigrateConvs: %v, MigrateUsers: %v, FixPatternColors: %v, FixFormats: %v, MigrateEffectIDs: %v, BackfillBinaries: %v, Concurrency: %d, Resuming: %v", request.DryRun, request.MaxItems, request.MigrateConvs, request.MigrateUsers, request.FixPatternColors, request.FixFormats, request.MigrateEffectIDs, request.BackfillBinaries, request.Concurrency, request.ResumeToken != "")
 
 	result := MigrationResult{
 		DryRun: request.DryRun,
 	}
 
+	if request.Concurrency < 0 || request.Concurrency > maxMigrationConcurrency {
+		return result, fmt.Errorf("concurrency must be between 1 and %d", maxMigrationConcurrency)
+	}
+	if request.NotifyURL != "" {
+		if err := validateNotifyURL(request.NotifyURL); err != nil {
+			return result, fmt.Errorf("invalid notifyUrl: %v", err)
+		}
+	}
+	var startKey map[string]string
+	if request.ResumeToken != "" {
+		progress, err := decodeMigrationProgress(request.ResumeToken)
+		if err != nil {
+			return result, err
+		}
+		if progress.DryRun != request.DryRun {
+			return result, fmt.Errorf("resumeToken is from a run with a different dryRun")
+		}
+		startKey = progress.StartKey
+	}
+
+	// Normalize format fields first, so the WLED migration below sees each
+	// pattern's real format (LCL text saved as WLED state is moved to lclSpec)
+	if request.FixFormats {
+		formatResult, err := shared.FixPatternFormats(ctx, patternsTable, request.DryRun)
+		result.PatternFormats = formatResult
+		if formatResult != nil {
+			result.Errors = append(result.Errors, formatResult.Errors...)
+		}
+		if err != nil {
+			log.Printf("Pattern format fix-up error: %v", err)
+			result.Errors = append(result.Errors, "Pattern format fix-up failed: "+err.Error())
+		}
+	}
+
 	// Migrate patterns
-	if err := migratePatterns(ctx, &request, &result); err != nil {
+	if err := migratePatterns(ctx, &request, startKey, &result); err != nil {
 		log.Printf("Pattern migration error: %v", err)
 		result.Errors = append(result.Errors, "Pattern migration failed: "+err.Error())
 	}
@@ -72,78 +133,153 @@ func handler(ctx context.Context, request MigrationRequest) (MigrationResult, er
 		}
 	}
 
+	// Backfill user fields if requested
+	if request.MigrateUsers {
+		userResult, err := shared.MigrateUserTable(ctx, usersTable, request.DryRun)
+		if userResult != nil {
+			result.UsersMigrated = userResult.Migrated
+			result.UsersFailed = userResult.Failed
+			result.Errors = append(result.Errors, userResult.Errors...)
+		}
+		if err != nil {
+			log.Printf("User migration error: %v", err)
+			result.Errors = append(result.Errors, "User migration failed: "+err.Error())
+		}
+	}
+
+	// Fix patterns whose legacy RGB disagrees with their colors array
+	if request.FixPatternColors {
+		colorResult, err := shared.FixPatternColorConflicts(ctx, patternsTable, request.DryRun)
+		if colorResult != nil {
+			result.PatternColorsFixed = colorResult.Fixed
+			result.PatternColorsFailed = colorResult.Failed
+			result.FixedColorPatternIDs = colorResult.FixedIDs
+			result.Errors = append(result.Errors, colorResult.Errors...)
+		}
+		if err != nil {
+			log.Printf("Pattern color fix-up error: %v", err)
+			result.Errors = append(result.Errors, "Pattern color fix-up failed: "+err.Error())
+		}
+	}
+
+	// Move the deprecated metadata effectId override to its own field
+	if request.MigrateEffectIDs {
+		effectResult, err := shared.MigrateMetadataEffectIDs(ctx, patternsTable, request.DryRun)
+		result.EffectIDs = effectResult
+		if effectResult != nil {
+			result.Errors = append(result.Errors, effectResult.Errors...)
+		}
+		if err != nil {
+			log.Printf("Pattern effectId migration error: %v", err)
+			result.Errors = append(result.Errors, "Pattern effectId migration failed: "+err.Error())
+		}
+	}
+
+	// Last, so patterns the steps above converted to WLED are covered
+	if request.BackfillBinaries {
+		binaryResult, err := shared.BackfillPatternBinaries(ctx, patternsTable, request.DryRun)
+		result.Binaries = binaryResult
+		if binaryResult != nil {
+			result.Errors = append(result.Errors, binaryResult.Errors...)
+		}
+		if err != nil {
+			log.Printf("Pattern binary backfill error: %v", err)
+			result.Errors = append(result.Errors, "Pattern binary backfill failed: "+err.Error())
+		}
+	}
+
 	log.Printf("=== Migration Complete ===")
-	log.Printf("Patterns: migrated=%d, skipped=%d, failed=%d",
-		result.PatternsMigrated, result.PatternsSkipped, result.PatternsFailed)
+	log.Printf("Patterns: scanned=%d, migrated=%d, skipped=%d, failed=%d",
+		result.PatternsScanned, result.PatternsMigrated, result.PatternsSkipped, result.PatternsFailed)
+	if result.ResumeToken != "" {
+		log.Printf("Patterns: stopped before the deadline; resumeToken=%s", result.ResumeToken)
+	}
 	if request.MigrateConvs {
 		log.Printf("Conversations: migrated=%d, skipped=%d, failed=%d",
 			result.ConvsMigrated, result.ConvsSkipped, result.ConvsFailed)
 	}
+	if request.MigrateUsers {
+		log.Printf("Users: migrated=%d, failed=%d", result.UsersMigrated, result.UsersFailed)
+	}
+	if request.FixPatternColors {
+		log.Printf("Pattern colors: fixed=%d, failed=%d", result.PatternColorsFixed, result.PatternColorsFailed)
+	}
+	if result.PatternFormats != nil {
+		log.Printf("Pattern formats: scanned=%d, fixed=%d, failed=%d, invalid=%d", result.PatternFormats.Scanned,
+			result.PatternFormats.Fixed, result.PatternFormats.Failed, len(result.PatternFormats.Invalid))
+	}
+	if result.EffectIDs != nil {
+		log.Printf("Pattern effectIds: scanned=%d, migrated=%d, failed=%d, invalid=%d", result.EffectIDs.Scanned,
+			result.EffectIDs.Migrated, result.EffectIDs.Failed, len(result.EffectIDs.Invalid))
+	}
+	if result.Binaries != nil {
+		log.Printf("Pattern binaries: scanned=%d, backfilled=%d, refreshed=%d, failed=%d, invalid=%d", result.Binaries.Scanned,
+			result.Binaries.Backfilled, result.Binaries.Refreshed, result.Binaries.Failed, len(result.Binaries.Invalid))
+	}
+
+	if request.NotifyURL != "" {
+		if err := notifyMigrationResult(ctx, request.NotifyURL, result); err != nil {
+			log.Printf("Failed to send migration result to notifyUrl: %v", err)
+		}
+	}
 
 	return result, nil
 }
 
-func migratePatterns(ctx context.Context, request *MigrationRequest, result *MigrationResult) error {
-	// Scan all patterns
-	input := &dynamodb.ScanInput{
-		TableName: aws.String(patternsTable),
+// migratePatterns converts the patterns table's legacy patterns to WLED,
+// scanning from startKey (nil for the start). Each page's patterns are
+// converted by request.Concurrency workers, and the page finished before the
+// next is read, so when the deadline nears the run stops between pages and
+// leaves a ResumeToken for the rest.
+func migratePatterns(ctx context.Context, request *MigrationRequest, startKey map[string]string, result *MigrationResult) error {
+	var exclusiveStartKey map[string]types.AttributeValue
+	if len(startKey) > 0 {
+		exclusiveStartKey, _ = attributevalue.MarshalMap(startKey)
 	}
 
-	paginator := dynamodb.NewScanPaginator(ddbClient, input)
-	count := 0
+	migrator := newPatternMigrator(ctx, request, result)
 
-	for paginator.HasMorePages() {
-		page, err := paginator.NextPage(ctx)
+	for {
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < migrationDeadlineMargin {
+			log.Printf("Stopping pattern migration before the deadline")
+			result.ResumeToken = encodeMigrationProgress(migrationProgress{StartKey: startKey, DryRun: request.DryRun})
+			return nil
+		}
+
+		page, err := ddbClient.Scan(ctx, &dynamodb.ScanInput{
+			TableName:         aws.String(patternsTable),
+			ExclusiveStartKey: exclusiveStartKey,
+		})
 		if err != nil {
+			result.ResumeToken = encodeMigrationProgress(migrationProgress{StartKey: startKey, DryRun: request.DryRun})
 			return err
 		}
 
+		migrator.startPage(page.Items)
 		for _, item := range page.Items {
-			if request.MaxItems > 0 && count >= request.MaxItems {
+			if !migrator.add(item) {
+				migrator.wait()
 				log.Printf("Reached max items limit: %d", request.MaxItems)
 				return nil
 			}
+		}
+		migrator.wait()
 
-			var pattern shared.Pattern
-			if err := attributevalue.UnmarshalMap(item, &pattern); err != nil {
-				log.Printf("Failed to unmarshal pattern: %v", err)
-				result.PatternsFailed++
-				continue
-			}
-
-			// Skip if already WLED format
-			if pattern.FormatVersion == shared.FormatVersionWLED {
-				log.Printf("Skipping pattern %s (%s) - already WLED format", pattern.PatternID, pattern.Name)
-				result.PatternsSkipped++
-				continue
-			}
-
-			// Skip if no GlowBlaster data
-			if pattern.LCLSpec == "" && pattern.IntentLayer == "" && len(pattern.Bytecode) == 0 {
-				log.Printf("Skipping pattern %s (%s) - no LCL data", pattern.PatternID, pattern.Name)
-				result.PatternsSkipped++
-				continue
-			}
-
-			// Migrate the pattern
-			if err := migratePattern(ctx, &pattern, request.DryRun); err != nil {
-				log.Printf("Failed to migrate pattern %s (%s): %v", pattern.PatternID, pattern.Name, err)
-				result.PatternsFailed++
-				result.Errors = append(result.Errors, pattern.PatternID+": "+err.Error())
-				continue
-			}
-
-			log.Printf("Migrated pattern %s (%s)", pattern.PatternID, pattern.Name)
-			result.PatternsMigrated++
-			result.MigratedPatternNames = append(result.MigratedPatternNames, pattern.Name)
-			count++
+		if len(page.LastEvaluatedKey) == 0 {
+			return nil
+		}
+		exclusiveStartKey = page.LastEvaluatedKey
+		startKey = nil
+		if err := attributevalue.UnmarshalMap(exclusiveStartKey, &startKey); err != nil {
+			return fmt.Errorf("unreadable scan position: %v", err)
 		}
 	}
-
-	return nil
 }
 
-func migratePattern(ctx context.Context, pattern *shared.Pattern, dryRun bool) error {
+// migratePattern converts pattern to WLED. specErr is why its LCL spec
+// doesn't compile, if it doesn't; the conversion then falls back to the
+// bytecode as it does for a spec that doesn't parse.
+func migratePattern(ctx context.Context, pattern *shared.Pattern, specErr error, dryRun bool) error {
 	// Determine LED count (default 8)
 	ledCount := 8
 
@@ -151,7 +287,9 @@ func migratePattern(ctx context.Context, pattern *shared.Pattern, dryRun bool) e
 	var wledState *shared.WLEDState
 	var err error
 
-	if pattern.LCLSpec != "" {
+	if specErr != nil {
+		log.Printf("LCL spec doesn't compile: %v, trying bytecode", specErr)
+	} else if pattern.LCLSpec != "" {
 		// Try to parse LCL spec
 		wledState, err = convertLCLSpecToWLED(pattern.LCLSpec, ledCount)
 		if err != nil {
@@ -195,7 +333,8 @@ func migratePattern(ctx context.Context, pattern *shared.Pattern, dryRun bool) e
 		Key: map[string]types.AttributeValue{
 			"patternId": &types.AttributeValueMemberS{Value: pattern.PatternID},
 		},
-		UpdateExpression: aws.String("SET wledState = :wled, wledBinary = :bin, formatVersion = :v"),
+		// Drop precompiled bytecode - it was built from the old format
+		UpdateExpression: aws.String("SET wledState = :wled, wledBinary = :bin, formatVersion = :v REMOVE compiledCache"),
 		ExpressionAttributeValues: map[string]types.AttributeValue{
 			":wled": &types.AttributeValueMemberS{Value: string(wledJSON)},
 			":bin":  &types.AttributeValueMemberB{Value: wledBinary},
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"candle-lights/backend/shared"
+)
+
+// stubPageSize is how many patterns each stubbed Scan page holds
+const stubPageSize = 4
+
+// stubPatterns is an in-memory patterns table, scanned in key order
+type stubPatterns struct {
+	mu       sync.Mutex
+	items    map[string]map[string]interface{}
+	writes   []string // Pattern IDs updated
+	scans    int
+	failScan int // Scan number (from 1) to throttle, once
+}
+
+// newStubPatterns fills a table with migrate patterns that need converting
+// and skip patterns that don't, plus one that can't be read
+func newStubPatterns(migrate, skip int) *stubPatterns {
+	s := &stubPatterns{items: map[string]map[string]interface{}{}}
+	bytecode := []byte{'L', 'C', 'L', 1, 0, 0, 0, 0, 0x08, 200, 90}
+	for i := 0; i < migrate; i++ {
+		id := fmt.Sprintf("p%03d", i*2)
+		s.items[id] = shared.DynamoDBStubItem(shared.Pattern{PatternID: id, Name: "Legacy " + id, Type: shared.PatternCandle, Bytecode: bytecode})
+	}
+	for i := 0; i < skip; i++ {
+		id := fmt.Sprintf("p%03d", i*2+1)
+		pattern := shared.Pattern{PatternID: id, Name: "Current " + id, Type: shared.PatternSolid}
+		if i%2 == 0 {
+			pattern.WLEDState = `{"on":true,"seg":[{"fx":0}]}`
+		}
+		s.items[id] = shared.DynamoDBStubItem(pattern)
+	}
+	s.items["zzz"] = map[string]interface{}{
+		"patternId":  map[string]string{"S": "zzz"},
+		"brightness": map[string]string{"S": "bright"},
+	}
+	return s
+}
+
+func (s *stubPatterns) handle(call shared.DynamoDBStubCall) (map[string]interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch call.Operation {
+	case "Scan":
+		s.scans++
+		if s.scans == s.failScan {
+			return nil, shared.ErrDynamoDBStubThrottled
+		}
+		var start struct {
+			PatternID string `dynamodbav:"patternId"`
+		}
+		if call.Input["ExclusiveStartKey"] != nil {
+			if err := call.Unmarshal("ExclusiveStartKey", &start); err != nil {
+				return nil, err
+			}
+		}
+		var ids []string
+		for id := range s.items {
+			if id > start.PatternID {
+				ids = append(ids, id)
+			}
+		}
+		sort.Strings(ids)
+		response := map[string]interface{}{}
+		if len(ids) > stubPageSize {
+			ids = ids[:stubPageSize]
+			response["LastEvaluatedKey"] = map[string]interface{}{"patternId": map[string]string{"S": ids[len(ids)-1]}}
+		}
+		var items []interface{}
+		for _, id := range ids {
+			items = append(items, s.items[id])
+		}
+		response["Items"], response["Count"] = items, len(items)
+		return response, nil
+	case "UpdateItem":
+		var key struct {
+			PatternID string `dynamodbav:"patternId"`
+		}
+		var values struct {
+			WLED string `dynamodbav:":wled"`
+		}
+		if err := call.Unmarshal("Key", &key); err != nil {
+			return nil, err
+		}
+		if err := call.Unmarshal("ExpressionAttributeValues", &values); err != nil {
+			return nil, err
+		}
+		s.items[key.PatternID]["wledState"] = map[string]string{"S": values.WLED}
+		s.writes = append(s.writes, key.PatternID)
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unexpected %s", call.Operation)
+}
+
+// useStub points the migration's DynamoDB client at store
+func useStub(t *testing.T, store *stubPatterns) (restore func()) {
+	t.Helper()
+	restoreShared := shared.StubDynamoDB(store.handle)
+	previous := ddbClient
+	client, err := shared.InitDynamoDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ddbClient = client
+	return func() {
+		ddbClient = previous
+		restoreShared()
+	}
+}
+
+// counts is the part of a result a dry run must agree with a real run on
+func counts(r MigrationResult) string {
+	names := append([]string(nil), r.MigratedPatternNames...)
+	sort.Strings(names)
+	return fmt.Sprintf("scanned=%d migrated=%d skipped=%d failed=%d names=%v",
+		r.PatternsScanned, r.PatternsMigrated, r.PatternsSkipped, r.PatternsFailed, names)
+}
+
+func TestDryRunCountsMatchRealRun(t *testing.T) {
+	tests := []MigrationRequest{
+		{Concurrency: 1},
+		{Concurrency: 8, ProgressEvery: 5},
+		{Concurrency: 8, MaxItems: 7},
+	}
+	for _, request := range tests {
+		results := map[bool]MigrationResult{}
+		for _, dryRun := range []bool{true, false} {
+			store := newStubPatterns(12, 9)
+			restore := useStub(t, store)
+			request.DryRun = dryRun
+			result, err := handler(context.Background(), request)
+			restore()
+			if err != nil {
+				t.Fatal(err)
+			}
+			results[dryRun] = result
+
+			wantWrites := result.PatternsMigrated
+			if dryRun {
+				wantWrites = 0
+			}
+			if len(store.writes) != wantWrites {
+				t.Errorf("%+v: %d writes, want %d", request, len(store.writes), wantWrites)
+			}
+		}
+
+		dry, applied := results[true], results[false]
+		if counts(dry) != counts(applied) {
+			t.Errorf("%+v: dry run %s, real run %s", request, counts(dry), counts(applied))
+		}
+		want := 12
+		if request.MaxItems > 0 {
+			want = request.MaxItems
+		}
+		if applied.PatternsMigrated != want || applied.ResumeToken != "" {
+			t.Errorf("%+v: migrated %d, resumeToken %q; want %d and no token", request, applied.PatternsMigrated, applied.ResumeToken, want)
+		}
+		if request.MaxItems == 0 && (applied.PatternsSkipped != 9 || applied.PatternsFailed != 1) {
+			t.Errorf("%+v: skipped %d, failed %d; want 9 and the unreadable one", request, applied.PatternsSkipped, applied.PatternsFailed)
+		}
+	}
+}
+
+func TestMigrationResumesWhereItStopped(t *testing.T) {
+	store := newStubPatterns(12, 9)
+	store.failScan = 3
+	defer useStub(t, store)()
+
+	ctx := context.Background()
+	first, _ := handler(ctx, MigrationRequest{Concurrency: 4})
+	if first.ResumeToken == "" || first.PatternsScanned != 2*stubPageSize {
+		t.Fatalf("run with a failed third page scanned %d, resumeToken %q; want two pages and a token", first.PatternsScanned, first.ResumeToken)
+	}
+
+	// A token from a real run doesn't resume a dry run
+	if _, err := handler(ctx, MigrationRequest{DryRun: true, ResumeToken: first.ResumeToken}); err == nil {
+		t.Error("a dry run resumed a real run's token")
+	}
+
+	second, err := handler(ctx, MigrationRequest{Concurrency: 4, ResumeToken: first.ResumeToken})
+	if err != nil || second.ResumeToken != "" {
+		t.Fatalf("resumed run = %v, resumeToken %q", err, second.ResumeToken)
+	}
+	total := first.PatternsScanned + second.PatternsScanned
+	migrated := first.PatternsMigrated + second.PatternsMigrated
+	if total != len(store.items) || migrated != 12 || len(store.writes) != 12 {
+		t.Errorf("across both runs: scanned %d of %d, migrated %d with %d writes; want every pattern once and 12 migrated",
+			total, len(store.items), migrated, len(store.writes))
+	}
+	sort.Strings(store.writes)
+	for i := 1; i < len(store.writes); i++ {
+		if store.writes[i] == store.writes[i-1] {
+			t.Errorf("%s was migrated twice", store.writes[i])
+		}
+	}
+}
+
+func TestMigrationStopsBeforeTheDeadline(t *testing.T) {
+	store := newStubPatterns(3, 0)
+	defer useStub(t, store)()
+
+	ctx, cancel := context.WithTimeout(context.Background(), migrationDeadlineMargin/2)
+	defer cancel()
+	result, err := handler(ctx, MigrationRequest{})
+	if err != nil || result.ResumeToken == "" || store.scans != 0 {
+		t.Fatalf("run near the deadline = %v with %d scans, resumeToken %q; want a token and no scans", err, store.scans, result.ResumeToken)
+	}
+
+	result, _ = handler(context.Background(), MigrationRequest{ResumeToken: result.ResumeToken})
+	if result.PatternsMigrated != 3 {
+		t.Errorf("resumed run migrated %d, want 3", result.PatternsMigrated)
+	}
+}
+
+func TestMigrationRejectsBadRequests(t *testing.T) {
+	for _, request := range []MigrationRequest{
+		{Concurrency: maxMigrationConcurrency + 1},
+		{Concurrency: -1},
+		{NotifyURL: "http://example.com/hook"},
+		{NotifyURL: "https:///hook"},
+		{ResumeToken: "not a token!"},
+	} {
+		if _, err := handler(context.Background(), request); err == nil {
+			t.Errorf("%+v was accepted", request)
+		}
+	}
+}
+
+func TestNotifyMigrationResult(t *testing.T) {
+	var received MigrationResult
+	status := http.StatusNoContent
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("notification sent as %s %s", r.Method, r.Header.Get("Content-Type"))
+		}
+		json.NewDecoder(r.Body).Decode(&received)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	previous := http.DefaultClient
+	http.DefaultClient = server.Client()
+	defer func() { http.DefaultClient = previous }()
+
+	result := MigrationResult{PatternsScanned: 9, PatternsMigrated: 4, DryRun: true, ResumeToken: "abc"}
+	if err := notifyMigrationResult(context.Background(), server.URL, result); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(received, result) {
+		t.Errorf("notified %+v, want %+v", received, result)
+	}
+
+	status = http.StatusBadGateway
+	if err := notifyMigrationResult(context.Background(), server.URL, result); err == nil || !strings.Contains(err.Error(), "502") {
+		t.Errorf("notification to a failing endpoint = %v, want its status", err)
+	}
+}
+
+func TestMigrationProgressTokens(t *testing.T) {
+	progress := migrationProgress{StartKey: map[string]string{"patternId": "p007"}, DryRun: true}
+	decoded, err := decodeMigrationProgress(encodeMigrationProgress(progress))
+	if err != nil || !reflect.DeepEqual(decoded, progress) {
+		t.Errorf("round trip = %+v, %v; want %+v", decoded, err, progress)
+	}
+}
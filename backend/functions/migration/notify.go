@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// notifyTimeout bounds the POST of the final result to notifyUrl
+const notifyTimeout = 10 * time.Second
+
+// validateNotifyURL checks notifyUrl is an https URL with a host
+func validateNotifyURL(raw string) error {
+	u, err := url.Parse(raw)
+	switch {
+	case err != nil:
+		return fmt.Errorf("not a URL: %v", err)
+	case u.Scheme != "https":
+		return fmt.Errorf("must be https")
+	case u.Host == "":
+		return fmt.Errorf("has no host")
+	}
+	return nil
+}
+
+// notifyMigrationResult POSTs result as JSON to notifyURL, so operators hear
+// how a run went without watching its logs. A non-2xx response is an error.
+func notifyMigrationResult(ctx context.Context, notifyURL string, result MigrationResult) error {
+	body, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, notifyTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", notifyURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("notifyUrl returned status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"candle-lights/backend/shared"
+)
+
+// Pattern migration defaults and limits
+const (
+	defaultMigrationConcurrency = 4
+	maxMigrationConcurrency     = 16
+	defaultProgressEvery        = 100
+
+	// migrationDeadlineMargin leaves time to finish a page, run the steps
+	// after the pattern migration and send the result before Lambda's
+	// deadline
+	migrationDeadlineMargin = 30 * time.Second
+)
+
+// migrationProgress is what a resume token carries
+type migrationProgress struct {
+	StartKey map[string]string `json:"k,omitempty"` // ExclusiveStartKey of the patterns scan
+	DryRun   bool              `json:"d"`
+}
+
+func encodeMigrationProgress(p migrationProgress) string {
+	payload, _ := json.Marshal(p)
+	return base64.RawURLEncoding.EncodeToString(payload)
+}
+
+func decodeMigrationProgress(token string) (migrationProgress, error) {
+	var p migrationProgress
+	payload, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || json.Unmarshal(payload, &p) != nil {
+		return migrationProgress{}, fmt.Errorf("invalid resumeToken")
+	}
+	return p, nil
+}
+
+// patternMigrator converts patterns on a bounded pool of workers. Deciding
+// whether a pattern needs migrating happens on the caller's goroutine, in
+// scan order; only the conversion (and, unless a dry run, the write) runs
+// concurrently. Dry runs do the same conversion and differ only in skipping
+// the write, so they count the same as a real run on the same data.
+type patternMigrator struct {
+	ctx     context.Context
+	request *MigrationRequest
+	result  *MigrationResult
+
+	sem chan struct{}
+	wg  sync.WaitGroup
+
+	mu       sync.Mutex // Guards result and reserved
+	reserved int        // Migrations started or succeeded, against MaxItems
+
+	specErrors map[string]error // Current page's LCL specs that don't compile, by pattern ID
+}
+
+func newPatternMigrator(ctx context.Context, request *MigrationRequest, result *MigrationResult) *patternMigrator {
+	concurrency := request.Concurrency
+	if concurrency == 0 {
+		concurrency = defaultMigrationConcurrency
+	}
+	return &patternMigrator{
+		ctx:     ctx,
+		request: request,
+		result:  result,
+		sem:     make(chan struct{}, concurrency),
+	}
+}
+
+// startPage compiles the LCL specs of a scanned page in one batch (see
+// shared.CompileBatch), so add knows which can't be trusted for conversion.
+// Specs that don't parse are left to migratePattern. Call wait first.
+func (m *patternMigrator) startPage(items []map[string]types.AttributeValue) {
+	var ids []string
+	var specs []shared.PatternSpec
+	for _, item := range items {
+		var pattern shared.Pattern
+		if attributevalue.UnmarshalMap(item, &pattern) != nil || pattern.LCLSpec == "" {
+			continue
+		}
+		spec, err := shared.ParseIntentYAML(pattern.LCLSpec)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, pattern.PatternID)
+		specs = append(specs, *spec)
+	}
+
+	m.specErrors = map[string]error{}
+	_, errs := shared.CompileBatch(specs)
+	for i, err := range errs {
+		if err != nil {
+			m.specErrors[ids[i]] = err
+		}
+	}
+}
+
+// add skips a scanned pattern or queues its migration, returning false once
+// MaxItems patterns have been migrated
+func (m *patternMigrator) add(item map[string]types.AttributeValue) bool {
+	if max := m.request.MaxItems; max > 0 && m.reservedCount() >= max {
+		// Migrations still running may fail and free their places
+		m.wg.Wait()
+		if m.reservedCount() >= max {
+			return false
+		}
+	}
+
+	m.mu.Lock()
+	m.result.PatternsScanned++
+	m.logProgress()
+	m.mu.Unlock()
+
+	var pattern shared.Pattern
+	if err := attributevalue.UnmarshalMap(item, &pattern); err != nil {
+		log.Printf("Failed to unmarshal pattern: %v", err)
+		m.record(func(r *MigrationResult) { r.PatternsFailed++ })
+		return true
+	}
+
+	// Skip if already WLED format
+	if shared.ResolvePatternFormat(pattern) == shared.PatternFormatWLED {
+		log.Printf("Skipping pattern %s (%s) - already WLED format", pattern.PatternID, pattern.Name)
+		m.record(func(r *MigrationResult) { r.PatternsSkipped++ })
+		return true
+	}
+
+	// Skip if no GlowBlaster data
+	if pattern.LCLSpec == "" && pattern.IntentLayer == "" && len(pattern.Bytecode) == 0 {
+		log.Printf("Skipping pattern %s (%s) - no LCL data", pattern.PatternID, pattern.Name)
+		m.record(func(r *MigrationResult) { r.PatternsSkipped++ })
+		return true
+	}
+
+	m.mu.Lock()
+	m.reserved++
+	m.mu.Unlock()
+
+	specErr := m.specErrors[pattern.PatternID]
+	m.wg.Add(1)
+	m.sem <- struct{}{}
+	go func() {
+		defer func() {
+			<-m.sem
+			m.wg.Done()
+		}()
+
+		err := migratePattern(m.ctx, &pattern, specErr, m.request.DryRun)
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if err != nil {
+			log.Printf("Failed to migrate pattern %s (%s): %v", pattern.PatternID, pattern.Name, err)
+			m.reserved--
+			m.result.PatternsFailed++
+			m.result.Errors = append(m.result.Errors, pattern.PatternID+": "+err.Error())
+			return
+		}
+		log.Printf("Migrated pattern %s (%s)", pattern.PatternID, pattern.Name)
+		m.result.PatternsMigrated++
+		m.result.MigratedPatternNames = append(m.result.MigratedPatternNames, pattern.Name)
+	}()
+	return true
+}
+
+// wait blocks until every queued migration has finished
+func (m *patternMigrator) wait() {
+	m.wg.Wait()
+}
+
+func (m *patternMigrator) reservedCount() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.reserved
+}
+
+func (m *patternMigrator) record(update func(*MigrationResult)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	update(m.result)
+}
+
+// logProgress logs the counts so far every ProgressEvery patterns scanned.
+// m.mu must be held.
+func (m *patternMigrator) logProgress() {
+	every := m.request.ProgressEvery
+	if every <= 0 {
+		every = defaultProgressEvery
+	}
+	r := m.result
+	if r.PatternsScanned%every == 0 {
+		log.Printf("Progress: scanned=%d, migrated=%d, skipped=%d, failed=%d, in flight=%d",
+			r.PatternsScanned, r.PatternsMigrated, r.PatternsSkipped, r.PatternsFailed, m.reserved-r.PatternsMigrated)
+	}
+}
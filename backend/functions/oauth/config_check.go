@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+
+	"candle-lights/backend/shared"
+)
+
+// configCheckToken guards GET /oauth/config-check. Without it the endpoint
+// doesn't exist.
+var configCheckToken = os.Getenv("OAUTH_CONFIG_CHECK_TOKEN")
+
+// ConfigCheckTokenHeader carries configCheckToken
+const ConfigCheckTokenHeader = "X-Admin-Token"
+
+// Config check statuses
+const (
+	checkPass = "pass"
+	checkFail = "fail"
+	checkSkip = "skip"
+)
+
+// oauthEnvVars are reported by the env check. Values are never echoed.
+var oauthEnvVars = []string{
+	"ALEXA_CLIENT_ID",
+	"ALEXA_CLIENT_SECRET",
+	"DOMAIN_NAME",
+	"USERS_TABLE",
+	"ALEXA_TOKENS_TABLE",
+	"ALEXA_CODES_TABLE",
+}
+
+// ConfigCheck is one pass/fail result
+type ConfigCheck struct {
+	Name   string      `json:"name"`
+	Status string      `json:"status"`
+	Detail string      `json:"detail,omitempty"`
+	Info   interface{} `json:"info,omitempty"`
+}
+
+// ConfigCheckResponse is returned by GET /oauth/config-check, with status
+// 200 when every check passed or was skipped and 503 otherwise
+type ConfigCheckResponse struct {
+	OK     bool          `json:"ok"`
+	Checks []ConfigCheck `json:"checks"`
+}
+
+// envVarStatus is what the env check reports about one variable
+type envVarStatus struct {
+	Set    bool `json:"set"`
+	Length int  `json:"length"`
+}
+
+// handleConfigCheck runs the account-linking configuration checks for
+// deployment pipelines. It is authorized by ConfigCheckTokenHeader rather
+// than a user session.
+func handleConfigCheck(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	if configCheckToken == "" {
+		return shared.CreateErrorResponse(404, "Not found"), nil
+	}
+
+	provided := request.Headers[ConfigCheckTokenHeader]
+	if provided == "" {
+		provided = request.Headers[strings.ToLower(ConfigCheckTokenHeader)]
+	}
+	if subtle.ConstantTimeCompare([]byte(provided), []byte(configCheckToken)) != 1 {
+		log.Printf("Config check rejected: bad or missing %s", ConfigCheckTokenHeader)
+		return shared.CreateErrorResponse(401, "Unauthorized"), nil
+	}
+
+	checks := []ConfigCheck{
+		checkOAuthEnv(),
+		checkDomainName(),
+		{
+			Name:   "redirect_uri_allowlist",
+			Status: checkSkip,
+			Detail: "no redirect URI allowlist is configured; the token exchange only requires the URI used at authorize",
+		},
+		checkTable(ctx, "users_table", usersTable, "username"),
+		checkTable(ctx, "tokens_table", os.Getenv("ALEXA_TOKENS_TABLE"), "tokenHash"),
+		checkTable(ctx, "codes_table", os.Getenv("ALEXA_CODES_TABLE"), "code"),
+		checkAuthCodeRoundTrip(ctx),
+	}
+
+	response := ConfigCheckResponse{OK: true, Checks: checks}
+	for _, c := range checks {
+		if c.Status == checkFail {
+			response.OK = false
+		}
+	}
+
+	log.Printf("Config check finished: ok=%v", response.OK)
+	if !response.OK {
+		return createJSONResponse(503, response), nil
+	}
+	return createJSONResponse(200, response), nil
+}
+
+// checkOAuthEnv reports whether each OAuth variable is set, and its length
+func checkOAuthEnv() ConfigCheck {
+	check := ConfigCheck{Name: "env", Status: checkPass}
+	info := make(map[string]envVarStatus, len(oauthEnvVars))
+	var missing []string
+	for _, name := range oauthEnvVars {
+		value := os.Getenv(name)
+		info[name] = envVarStatus{Set: value != "", Length: len(value)}
+		if value == "" {
+			missing = append(missing, name)
+		}
+	}
+	check.Info = info
+	if len(missing) > 0 {
+		check.Status = checkFail
+		check.Detail = "not set: " + strings.Join(missing, ", ")
+	}
+	return check
+}
+
+// checkDomainName checks DOMAIN_NAME is a bare host name, as the login page
+// and redirect handling expect
+func checkDomainName() ConfigCheck {
+	check := ConfigCheck{Name: "domain_name", Status: checkPass}
+	if domainName == "" {
+		check.Status = checkFail
+		check.Detail = "DOMAIN_NAME is not set"
+		return check
+	}
+	parsed, err := url.Parse("https://" + domainName)
+	if err != nil || parsed.Host != domainName || parsed.Path != "" {
+		check.Status = checkFail
+		check.Detail = "DOMAIN_NAME must be a host name without a scheme or path"
+	}
+	return check
+}
+
+// checkTable reads a key that doesn't exist from table to show it is
+// reachable with the function's permissions
+func checkTable(ctx context.Context, name, table, keyName string) ConfigCheck {
+	check := ConfigCheck{Name: name, Status: checkPass}
+	if table == "" {
+		check.Status = checkFail
+		check.Detail = "table name is not set"
+		return check
+	}
+
+	key, _ := attributevalue.MarshalMap(map[string]string{
+		keyName: "config-check-probe",
+	})
+	var item map[string]interface{}
+	if err := shared.GetItem(ctx, table, key, &item); err != nil {
+		log.Printf("Config check: table %s did not respond: %v", name, err)
+		check.Status = checkFail
+		check.Detail = fmt.Sprintf("read failed: %v", err)
+	}
+	return check
+}
+
+// checkAuthCodeRoundTrip issues an auth code for a throwaway user and redeems
+// it through the token grant, then checks the code can't be redeemed twice.
+// The access token it creates is revoked afterwards.
+func checkAuthCodeRoundTrip(ctx context.Context) ConfigCheck {
+	check := ConfigCheck{Name: "auth_code_round_trip", Status: checkPass}
+	fail := func(format string, args ...interface{}) ConfigCheck {
+		check.Status = checkFail
+		check.Detail = fmt.Sprintf(format, args...)
+		log.Printf("Config check: auth code round trip failed: %s", check.Detail)
+		return check
+	}
+
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return fail("random user: %v", err)
+	}
+	// '#' keeps the throwaway user apart from real usernames
+	userID := "#config-check#" + hex.EncodeToString(suffix)
+	redirectURI := "https://" + domainName + "/oauth/config-check"
+
+	authCode, err := shared.GenerateAuthCode(ctx, userID, alexaClientID, redirectURI, "config-check")
+	if err != nil {
+		return fail("generating code: %v", err)
+	}
+
+	resp, err := handleAuthorizationCodeGrant(ctx, authCode.Code, redirectURI)
+	if err != nil {
+		return fail("redeeming code: %v", err)
+	}
+	if resp.StatusCode != 200 {
+		return fail("redeeming code returned %d: %s", resp.StatusCode, resp.Body)
+	}
+	var tokens shared.TokenResponse
+	if err := json.Unmarshal([]byte(resp.Body), &tokens); err != nil || tokens.AccessToken == "" {
+		return fail("token response has no access_token")
+	}
+	defer func() {
+		if err := shared.RevokeAccessToken(ctx, tokens.AccessToken); err != nil {
+			log.Printf("Config check: failed to revoke self-test token: %v", err)
+		}
+	}()
+
+	owner, err := shared.ValidateAccessToken(ctx, tokens.AccessToken)
+	if err != nil {
+		return fail("validating access token: %v", err)
+	}
+	if owner != userID {
+		return fail("issued access token does not validate")
+	}
+
+	again, err := handleAuthorizationCodeGrant(ctx, authCode.Code, redirectURI)
+	if err != nil {
+		return fail("redeeming code twice: %v", err)
+	}
+	if again.StatusCode == 200 {
+		return fail("auth code was accepted twice")
+	}
+	return check
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"log"
@@ -40,6 +41,8 @@ func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events
 		return handleAuthorizePost(ctx, request)
 	case path == "/oauth/token" && method == "POST":
 		return handleToken(ctx, request)
+	case path == "/oauth/config-check" && method == "GET":
+		return handleConfigCheck(ctx, request)
 	default:
 		return shared.CreateErrorResponse(404, "Not found"), nil
 	}
@@ -126,8 +129,57 @@ func handleAuthorizePost(ctx context.Context, request events.APIGatewayProxyRequ
 			clientID, redirectURI, state, scope, "Invalid username or password")), nil
 	}
 
+	// Accounts with 2FA also need a TOTP or recovery code
+	if user.TwoFactorEnabled() {
+		code := strings.TrimSpace(formData.Get("code"))
+		if code == "" {
+			return createHTMLResponse(401, renderLoginPageWithError(
+				clientID, redirectURI, state, scope, "Enter the code from your authenticator app")), nil
+		}
+		if err := shared.CountTwoFactorAttempt(ctx, usersTable, username); err != nil {
+			log.Printf("Two-factor attempt not counted for %s: %v", username, err)
+			if errors.Is(err, shared.ErrTwoFactorRateLimited) {
+				return createHTMLResponse(429, renderLoginPageWithError(
+					clientID, redirectURI, state, scope, "Too many attempts; try again in a few minutes")), nil
+			}
+			return createHTMLResponse(500, renderErrorPage("Internal server error")), nil
+		}
+		use, valid, err := shared.VerifySecondFactor(user.TwoFactor, code, time.Now())
+		if err != nil {
+			log.Printf("Failed to check two-factor code: %v", err)
+			return createHTMLResponse(500, renderErrorPage("Internal server error")), nil
+		}
+		if !valid {
+			log.Printf("Invalid two-factor code for user: %s", username)
+			return createHTMLResponse(401, renderLoginPageWithError(
+				clientID, redirectURI, state, scope, "Invalid two-factor code")), nil
+		}
+		if err := shared.SaveTwoFactorUse(ctx, usersTable, username, user.TwoFactor, use); err != nil {
+			log.Printf("Failed to save two-factor use: %v", err)
+			if errors.Is(err, shared.ErrTwoFactorCodeUsed) {
+				return createHTMLResponse(401, renderLoginPageWithError(
+					clientID, redirectURI, state, scope, "Invalid two-factor code")), nil
+			}
+			return createHTMLResponse(500, renderErrorPage("Internal server error")), nil
+		}
+	}
+
+	suspended, err := shared.IsAccountSuspended(ctx, username)
+	if err != nil {
+		log.Printf("Failed to check account status: %v", err)
+		return createHTMLResponse(500, renderErrorPage("Internal server error")), nil
+	}
+	if suspended {
+		log.Printf("Account suspended: %s", username)
+		return createHTMLResponse(403, renderLoginPageWithError(
+			clientID, redirectURI, state, scope, "This account is suspended")), nil
+	}
+
 	log.Printf("User authenticated successfully: %s", username)
 
+	// Bring the stored hash to the configured bcrypt cost
+	shared.RehashPasswordIfNeeded(ctx, usersTable, &user, password)
+
 	// Generate authorization code
 	authCode, err := shared.GenerateAuthCode(ctx, username, clientID, redirectURI, scope)
 	if err != nil {
@@ -245,6 +297,25 @@ func handleAuthorizationCodeGrant(ctx context.Context, code, redirectURI string)
 	// Delete the auth code (single use)
 	shared.DeleteAuthCode(ctx, code)
 
+	// The account may have been suspended since the code was issued
+	suspended, err := shared.IsAccountSuspended(ctx, authCode.UserID)
+	if err != nil {
+		log.Printf("Failed to check account status: %v", err)
+		return createTokenError("server_error", "Internal server error"), nil
+	}
+	if suspended {
+		log.Printf("Account suspended: %s", authCode.UserID)
+		return suspendedTokenError(), nil
+	}
+
+	// A new link starts clean: tokens and endpoint states left from an
+	// earlier link the user never unlinked (disabling the skill doesn't
+	// always reach us) are removed first
+	if _, err := shared.UnlinkAlexa(ctx, usersTable, authCode.UserID); err != nil {
+		log.Printf("Failed to clear previous Alexa link: %v", err)
+		return createTokenError("server_error", "Internal server error"), nil
+	}
+
 	// Create access token
 	token, accessToken, err := shared.CreateAccessToken(ctx, authCode.UserID, authCode.Scope)
 	if err != nil {
@@ -252,6 +323,10 @@ func handleAuthorizationCodeGrant(ctx context.Context, code, redirectURI string)
 		return createTokenError("server_error", "Failed to create access token"), nil
 	}
 
+	if err := shared.RecordAlexaLinked(ctx, usersTable, authCode.UserID, token.CreatedAt); err != nil {
+		log.Printf("Failed to record Alexa link time: %v", err)
+	}
+
 	// Build response
 	expiresIn := int(time.Until(time.Unix(token.ExpiresAt, 0)).Seconds())
 	response := shared.TokenResponse{
@@ -274,6 +349,9 @@ func handleRefreshTokenGrant(ctx context.Context, refreshToken string) (events.A
 
 	// Refresh the token
 	token, accessToken, err := shared.RefreshAccessToken(ctx, refreshToken)
+	if errors.Is(err, shared.ErrAccountSuspended) {
+		return suspendedTokenError(), nil
+	}
 	if err != nil {
 		log.Printf("Failed to refresh token: %v", err)
 		return createTokenError("server_error", "Internal server error"), nil
@@ -338,6 +416,14 @@ func createTokenError(errorCode, description string) events.APIGatewayProxyRespo
 	}
 }
 
+// suspendedTokenError refuses a token request for a suspended account. It is
+// an invalid_grant, but 403 rather than 400 like the rest of the API.
+func suspendedTokenError() events.APIGatewayProxyResponse {
+	resp := createTokenError("invalid_grant", "account suspended")
+	resp.StatusCode = 403
+	return resp
+}
+
 // HTML Templates
 
 const loginPageTemplate = `<!DOCTYPE html>
@@ -473,6 +559,11 @@ const loginPageTemplate = `<!DOCTYPE html>
                 <input type="password" id="password" name="password" required autocomplete="current-password">
             </div>
 
+            <div class="form-group">
+                <label for="code">Two-factor code (if enabled)</label>
+                <input type="text" id="code" name="code" inputmode="numeric" autocomplete="one-time-code" placeholder="123456 or recovery code">
+            </div>
+
             <button type="submit">Link Account</button>
         </form>
         <div class="alexa-notice">
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"candle-lights/backend/shared"
+)
+
+// allOffDeadline caps POST /api/particle/all-off. Devices are turned off in
+// parallel; strips not done by then are reported as timed out rather than
+// waited for.
+const allOffDeadline = 4 * time.Second
+
+// All-off strip statuses
+const (
+	allOffStatusOff     = "off"
+	allOffStatusFailed  = "failed"
+	allOffStatusTimeout = "timeout"
+	allOffStatusOffline = "offline"
+)
+
+// AllOffStripResult is the outcome for one strip
+type AllOffStripResult struct {
+	DeviceID   string `json:"deviceId"`
+	DeviceName string `json:"deviceName"`
+	Pin        int    `json:"pin"`
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+}
+
+// AllOffResponse is returned by POST /api/particle/all-off. Duplicate is set
+// when an all-off already ran within shared.AllOffDedupWindow and nothing was
+// sent this time.
+type AllOffResponse struct {
+	Duplicate bool                `json:"duplicate,omitempty"`
+	Strips    []AllOffStripResult `json:"strips"`
+	Off       int                 `json:"off"`
+	Failed    int                 `json:"failed"`
+}
+
+// handleAllOff turns off every strip on every device the user owns. It sends
+// straight to the devices, cancelling any ramp or trial on each strip first
+// so neither turns a strip back on.
+func handleAllOff(ctx context.Context, username string) (events.APIGatewayProxyResponse, error) {
+	log.Printf("=== handleAllOff: Starting for user %s ===", username)
+
+	userKey, _ := attributevalue.MarshalMap(map[string]string{
+		"username": username,
+	})
+
+	var user shared.User
+	if err := shared.GetItem(ctx, usersTable, userKey, &user); err != nil {
+		return shared.CreateErrorResponse(500, "Database error"), nil
+	}
+
+	if err := shared.DecryptParticleToken(ctx, usersTable, &user); err != nil {
+		log.Printf("Failed to decrypt Particle token for %s: %v", username, err)
+		return shared.CreateErrorResponse(500, "Failed to read Particle token"), nil
+	}
+
+	if user.ParticleToken == "" {
+		return shared.CreateErrorResponse(400, "Particle token not configured"), nil
+	}
+
+	claimed, err := shared.ClaimAllOff(ctx, usersTable, username, time.Now())
+	if err != nil {
+		log.Printf("Failed to claim all-off for %s: %v", username, err)
+		return shared.CreateErrorResponse(500, "Database error"), nil
+	}
+	if !claimed {
+		log.Printf("All-off for %s already running; skipping", username)
+		return shared.CreateSuccessResponse(200, AllOffResponse{Duplicate: true, Strips: []AllOffStripResult{}}), nil
+	}
+
+	indexName := "userId-index"
+	expressionValues := map[string]types.AttributeValue{
+		":userId": &types.AttributeValueMemberS{Value: username},
+	}
+
+	var devices []shared.Device
+	if err := shared.Query(ctx, devicesTable, &indexName, "userId = :userId", expressionValues, &devices); err != nil {
+		log.Printf("Failed to get devices: %v", err)
+		return shared.CreateErrorResponse(500, "Failed to get devices"), nil
+	}
+
+	deadlineCtx, cancel := context.WithTimeout(ctx, allOffDeadline)
+	defer cancel()
+
+	response := AllOffResponse{Strips: []AllOffStripResult{}}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, device := range devices {
+		wg.Add(1)
+		go func(device shared.Device) {
+			defer wg.Done()
+			results := turnOffDevice(deadlineCtx, device, user.ParticleToken)
+			mu.Lock()
+			response.Strips = append(response.Strips, results...)
+			mu.Unlock()
+		}(device)
+	}
+	wg.Wait()
+
+	for _, r := range response.Strips {
+		if r.Status == allOffStatusOff {
+			response.Off++
+		} else {
+			response.Failed++
+		}
+	}
+
+	log.Printf("All-off for %s: %d strips off, %d not", username, response.Off, response.Failed)
+	return shared.CreateSuccessResponse(200, response), nil
+}
+
+// turnOffDevice turns off each of the device's strips in turn (the Particle
+// cloud runs one function call per device at a time), then saves the config
+// so the strips stay off after a restart
+func turnOffDevice(ctx context.Context, device shared.Device, token string) []AllOffStripResult {
+	strips := device.LEDStrips
+	if len(strips) == 0 {
+		strips = device.PinDefaults().DefaultStrips()
+	}
+
+	results := make([]AllOffStripResult, len(strips))
+	for i, strip := range strips {
+		results[i] = AllOffStripResult{DeviceID: device.DeviceID, DeviceName: device.Name, Pin: strip.Pin}
+	}
+
+	if device.GetManufacturer() != shared.ManufacturerParticle {
+		for i := range results {
+			results[i].Status = allOffStatusFailed
+			results[i].Error = ErrNotImplemented.Error()
+		}
+		return results
+	}
+
+	// Stop anything scheduled to change the strips, even on an offline
+	// device, so they don't come back on when it reconnects
+	for _, strip := range strips {
+		if err := shared.CancelStripRamp(ctx, device.DeviceID, strip.Pin, "all off"); err != nil {
+			log.Printf("Failed to cancel ramp on device %s pin %d: %v", device.DeviceID, strip.Pin, err)
+		}
+		if err := shared.CancelStripTrial(ctx, device.DeviceID, strip.Pin); err != nil {
+			log.Printf("Failed to cancel trial on device %s pin %d: %v", device.DeviceID, strip.Pin, err)
+		}
+	}
+
+	if !device.IsOnline {
+		for i := range results {
+			results[i].Status = allOffStatusOffline
+		}
+		return results
+	}
+
+	call := func(particleID, function, argument string) error {
+		return callParticleFunctionWithContext(ctx, particleID, function, argument, token)
+	}
+
+	off := shared.AllOffPattern()
+	sent := 0
+	for i, strip := range strips {
+		_, err := shared.ApplyPatternToStrip(device, strip.Pin, strip.LEDCount, off, call)
+		results[i].Status, results[i].Error = allOffStatus(ctx, err)
+		if err == nil {
+			sent++
+		}
+	}
+
+	if sent > 0 {
+		if err := call(device.ParticleID, "saveConfig", "1"); err != nil {
+			log.Printf("saveConfig after all-off failed for %s: %v", device.Name, err)
+		}
+	}
+	return results
+}
+
+// allOffStatus maps a send error to a strip status and message
+func allOffStatus(ctx context.Context, err error) (string, string) {
+	switch {
+	case err == nil:
+		return allOffStatusOff, ""
+	case errors.Is(err, context.DeadlineExceeded) || ctx.Err() != nil:
+		return allOffStatusTimeout, "device did not respond in time"
+	default:
+		return allOffStatusFailed, err.Error()
+	}
+}
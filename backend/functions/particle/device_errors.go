@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"candle-lights/backend/shared"
+)
+
+// handleDeviceEvent ingests events forwarded by a Particle webhook. The
+// webhook authenticates with one of the user's API keys (devices scope) and
+// posts Particle's default JSON body; coreid must be one of the user's devices.
+// gl/error and gl/lux are handled.
+func handleDeviceEvent(ctx context.Context, username string, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var event shared.ParticleWebhookEvent
+	if err := json.Unmarshal([]byte(shared.GetRequestBody(request)), &event); err != nil {
+		return shared.CreateErrorResponse(400, "Invalid request body"), nil
+	}
+
+	if event.CoreID == "" {
+		return shared.CreateErrorResponse(400, "coreid is required"), nil
+	}
+	if event.Event != shared.DeviceErrorEventName && event.Event != shared.LuxEventName {
+		log.Printf("Ignoring unsupported device event %q from %s", event.Event, event.CoreID)
+		return shared.CreateErrorResponse(400, "Unsupported event: "+event.Event), nil
+	}
+
+	device, err := findDeviceByParticleID(ctx, username, event.CoreID)
+	if err != nil {
+		return shared.CreateErrorResponse(500, "Database error"), nil
+	}
+	if device == nil {
+		return shared.CreateErrorResponse(404, "Device not found"), nil
+	}
+
+	if event.Event == shared.LuxEventName {
+		return handleLuxEvent(ctx, *device, event)
+	}
+
+	deviceErr, err := shared.ParseDeviceErrorEvent(*device, event, time.Now())
+	if err != nil {
+		log.Printf("Invalid %s event from %s: %v", event.Event, event.CoreID, err)
+		return shared.CreateErrorResponse(400, err.Error()), nil
+	}
+
+	correlated := shared.CorrelateDeviceError(*device, deviceErr)
+	if correlated {
+		log.Printf("Device %s rejected pattern %s: %s %s", device.Name, deviceErr.PatternID, deviceErr.Code, deviceErr.Detail)
+	} else {
+		log.Printf("Device %s reported error: %s %s", device.Name, deviceErr.Code, deviceErr.Detail)
+	}
+
+	if err := shared.RecordDeviceError(ctx, devicesTable, deviceErr, correlated); err != nil {
+		log.Printf("Failed to record error for device %s: %v", device.DeviceID, err)
+		return shared.CreateErrorResponse(500, "Failed to record device error"), nil
+	}
+
+	return shared.CreateSuccessResponse(200, deviceErr), nil
+}
+
+// handleLuxEvent stores a device's light reading. Lux automations read it on
+// the virtual groups function's next scheduled check.
+func handleLuxEvent(ctx context.Context, device shared.Device, event shared.ParticleWebhookEvent) (events.APIGatewayProxyResponse, error) {
+	reading, err := shared.ParseLuxEvent(event, time.Now())
+	if err != nil {
+		log.Printf("Invalid %s event from %s: %v", event.Event, event.CoreID, err)
+		return shared.CreateErrorResponse(400, err.Error()), nil
+	}
+
+	if err := shared.RecordLuxReading(ctx, devicesTable, device.DeviceID, reading); err != nil {
+		log.Printf("Failed to record lux reading for device %s: %v", device.DeviceID, err)
+		return shared.CreateErrorResponse(500, "Failed to record lux reading"), nil
+	}
+
+	return shared.CreateSuccessResponse(200, reading), nil
+}
+
+// recordDeviceApply notes a successful apply so errors the device reports
+// shortly after can be tied to the pattern. pins are the strips it went to;
+// nil means all of them.
+func recordDeviceApply(ctx context.Context, device shared.Device, pattern shared.Pattern, pins []int) {
+	apply := shared.DeviceApply{
+		PatternID:   pattern.PatternID,
+		PatternName: pattern.Name,
+		Pins:        pins,
+		Source:      "particle",
+		At:          time.Now().UTC(),
+	}
+	if pins == nil {
+		for _, strip := range device.LEDStrips {
+			apply.Pins = append(apply.Pins, strip.Pin)
+		}
+	}
+	if err := shared.RecordDeviceApply(ctx, devicesTable, device.DeviceID, apply); err != nil {
+		log.Printf("Failed to record apply on device %s: %v", device.DeviceID, err)
+	}
+}
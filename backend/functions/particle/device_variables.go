@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"candle-lights/backend/shared"
+)
+
+// Bounds for GET /api/particle/devices/variables. Each device's variables are
+// read in parallel, so a device takes at most one variable timeout; the
+// overall deadline caps the endpoint however many devices there are.
+const (
+	bulkVariablesConcurrency = 8
+	bulkVariableTimeout      = 5 * time.Second
+	bulkVariablesDeadline    = 8 * time.Second
+)
+
+// singleVariableTimeout is the per-variable timeout for the single-device endpoint
+const singleVariableTimeout = 10 * time.Second
+
+// deviceVariableNames are the firmware variables read for a device
+var deviceVariableNames = []string{"deviceInfo", "numStrips", "strips"}
+
+// handleGetAllDeviceVariables reads firmware variables for all of the user's
+// online devices at once. Offline devices aren't contacted; their last known
+// values come from the device record, marked cached.
+func handleGetAllDeviceVariables(ctx context.Context, username string) (events.APIGatewayProxyResponse, error) {
+	log.Printf("=== handleGetAllDeviceVariables: Starting for user %s ===", username)
+
+	indexName := "userId-index"
+	expressionValues := map[string]types.AttributeValue{
+		":userId": &types.AttributeValueMemberS{Value: username},
+	}
+
+	var devices []shared.Device
+	if err := shared.Query(ctx, devicesTable, &indexName, "userId = :userId", expressionValues, &devices); err != nil {
+		log.Printf("Failed to get devices: %v", err)
+		return shared.CreateErrorResponse(500, "Failed to get devices"), nil
+	}
+
+	results := make(map[string]map[string]interface{}, len(devices))
+	var online []shared.Device
+	for _, device := range devices {
+		if device.IsOnline {
+			online = append(online, device)
+		} else {
+			results[device.DeviceID] = cachedDeviceVariables(device)
+		}
+	}
+
+	if len(online) == 0 {
+		return shared.CreateSuccessResponse(200, results), nil
+	}
+
+	userKey, _ := attributevalue.MarshalMap(map[string]string{
+		"username": username,
+	})
+
+	var user shared.User
+	if err := shared.GetItem(ctx, usersTable, userKey, &user); err != nil {
+		return shared.CreateErrorResponse(500, "Database error"), nil
+	}
+
+	if err := shared.DecryptParticleToken(ctx, usersTable, &user); err != nil {
+		log.Printf("Failed to decrypt Particle token for %s: %v", username, err)
+		return shared.CreateErrorResponse(500, "Failed to read Particle token"), nil
+	}
+
+	if user.ParticleToken == "" {
+		return shared.CreateErrorResponse(400, "Particle token not configured"), nil
+	}
+
+	deadlineCtx, cancel := context.WithTimeout(ctx, bulkVariablesDeadline)
+	defer cancel()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, bulkVariablesConcurrency)
+	for _, device := range online {
+		wg.Add(1)
+		go func(device shared.Device) {
+			defer wg.Done()
+
+			var result map[string]interface{}
+			select {
+			case sem <- struct{}{}:
+				result = readDeviceVariables(deadlineCtx, device, user.ParticleToken, bulkVariableTimeout)
+				<-sem
+			case <-deadlineCtx.Done():
+				result = deviceVariablesBase(device)
+				result["error"] = "timed out waiting to read device"
+			}
+
+			mu.Lock()
+			results[device.DeviceID] = result
+			mu.Unlock()
+		}(device)
+	}
+	wg.Wait()
+
+	log.Printf("Read variables for %d online devices, %d offline from cache", len(online), len(devices)-len(online))
+	return shared.CreateSuccessResponse(200, results), nil
+}
+
+// deviceVariablesBase is the identifying part of a device variables result
+func deviceVariablesBase(device shared.Device) map[string]interface{} {
+	return map[string]interface{}{
+		"deviceId":   device.DeviceID,
+		"particleId": device.ParticleID,
+		"name":       device.Name,
+	}
+}
+
+// cachedDeviceVariables builds a variables result from the stored device
+// record, for devices that can't be read live
+func cachedDeviceVariables(device shared.Device) map[string]interface{} {
+	result := deviceVariablesBase(device)
+	result["cached"] = true
+	result["isOnline"] = false
+	result["isReady"] = device.IsReady
+	result["readinessStatus"] = device.ReadinessStatus
+	if device.FirmwareVersion != "" {
+		result["firmwareVersion"] = device.FirmwareVersion
+	}
+	if device.Platform != "" {
+		result["platform"] = device.Platform
+	}
+	if device.FreeMemory > 0 {
+		result["freeMemory"] = device.FreeMemory
+	}
+
+	strips := make([]map[string]interface{}, 0, len(device.LEDStrips))
+	for _, strip := range device.LEDStrips {
+		strips = append(strips, map[string]interface{}{
+			"pin":         strip.Pin,
+			"physicalPin": device.ResolvePin(strip.Pin),
+			"ledCount":    strip.LEDCount,
+		})
+	}
+	result["numStrips"] = len(strips)
+	result["strips"] = strips
+	return result
+}
+
+// readDeviceVariables reads and parses a device's firmware variables, each
+// read bounded by timeout. Variables that can't be read are left out and the
+// first failure is reported in "error".
+func readDeviceVariables(ctx context.Context, device shared.Device, token string, timeout time.Duration) map[string]interface{} {
+	values := make(map[string]string, len(deviceVariableNames))
+	errs := make(map[string]error, len(deviceVariableNames))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, name := range deviceVariableNames {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			varCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			value, err := getParticleVariableWithContext(varCtx, device.ParticleID, name, token)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs[name] = err
+			} else {
+				values[name] = value
+			}
+		}(name)
+	}
+	wg.Wait()
+
+	result := deviceVariablesBase(device)
+
+	result["readiness"] = deviceInfoReadiness(device.ParticleID, values["deviceInfo"], errs["deviceInfo"])
+
+	// deviceInfo: "version|platform|maxStrips|maxLeds|maxColors|freeMem"
+	if deviceInfo, ok := values["deviceInfo"]; ok {
+		result["deviceInfo"] = deviceInfo
+		parts := strings.Split(deviceInfo, "|")
+		if len(parts) >= 2 {
+			result["firmwareVersion"] = parts[0]
+			result["platform"] = parts[1]
+		}
+		if len(parts) >= 3 {
+			if maxStrips, err := strconv.Atoi(parts[2]); err == nil {
+				result["maxStrips"] = maxStrips
+			}
+		}
+		if len(parts) >= 4 {
+			if maxLeds, err := strconv.Atoi(parts[3]); err == nil {
+				result["maxLedsPerStrip"] = maxLeds
+			}
+		}
+		if len(parts) >= 5 {
+			if maxColors, err := strconv.Atoi(parts[4]); err == nil {
+				result["maxColorsPerStrip"] = maxColors
+			}
+		}
+		if freeMemory, ok := shared.ParseDeviceInfoFreeMemory(deviceInfo); ok {
+			result["freeMemory"] = freeMemory
+		}
+	}
+
+	if numStrips, ok := values["numStrips"]; ok {
+		if n, err := strconv.Atoi(numStrips); err == nil {
+			result["numStrips"] = n
+		}
+	}
+
+	// strips: "D6:8:1:128:50:2;D2:12:5:255:30:1"
+	if stripsStr, ok := values["strips"]; ok {
+		result["stripsRaw"] = stripsStr
+		strips, warnings := parseStripsVariable(stripsStr)
+		for _, strip := range strips {
+			// Firmware reports physical pins; translate back through any custom mapping
+			strip["pin"] = device.LogicalPin(strip["physicalPin"].(int))
+		}
+		for _, w := range warnings {
+			log.Printf("WARN: device %s strips variable: %s", device.ParticleID, w.Message)
+		}
+		result["strips"] = strips
+		result["parseWarnings"] = warnings
+	} else {
+		result["strips"] = []map[string]interface{}{}
+		result["parseWarnings"] = []stripParseWarning{}
+	}
+
+	for _, name := range deviceVariableNames {
+		if err, ok := errs[name]; ok {
+			log.Printf("Failed to read %s from device %s: %v", name, device.ParticleID, err)
+			if _, set := result["error"]; !set {
+				result["error"] = fmt.Sprintf("failed to read %s: %v", name, err)
+			}
+		}
+	}
+
+	return result
+}
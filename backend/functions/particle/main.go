@@ -5,6 +5,7 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -17,6 +18,7 @@ import (
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/google/uuid"
 
 	"candle-lights/backend/shared"
@@ -28,7 +30,66 @@ var (
 	usersTable    = os.Getenv("USERS_TABLE")
 )
 
-const particleAPIBase = "https://api.particle.io/v1"
+// particleCallTimeout caps each Particle read; the request's own deadline
+// can shorten it
+const particleCallTimeout = 10 * time.Second
+
+// ErrNotImplemented is returned for device manufacturers we can't talk to yet
+var ErrNotImplemented = errors.New("not implemented")
+
+var router = newRouter()
+
+// newRouter registers the Particle routes, all for signed-in users
+func newRouter() *shared.Router {
+	r := shared.NewRouter("Particle")
+
+	r.MustHandle("POST", shared.PathEquals("/api/particle/command"), shared.PolicyAuthenticated,
+		func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+			return handleSendCommand(rc.Ctx, rc.Username, rc.Request)
+		})
+	r.MustHandle("POST", shared.PathEquals("/api/particle/all-off"), shared.PolicyAuthenticated,
+		func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+			return handleAllOff(rc.Ctx, rc.Username)
+		})
+	r.MustHandle("POST", shared.PathEquals("/api/particle/devices/refresh"), shared.PolicyAuthenticated,
+		func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+			return handleRefreshDevices(rc.Ctx, rc.Username, rc.Request)
+		})
+	r.MustHandle("POST", shared.PathEquals("/api/particle/validate-token"), shared.PolicyAuthenticated,
+		func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+			return handleValidateToken(rc.Ctx, rc.Username, rc.Request)
+		})
+	r.MustHandle("POST", shared.PathEquals("/api/particle/oauth/initiate"), shared.PolicyAuthenticated,
+		func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+			return handleOAuthInitiate(rc.Ctx, rc.Username)
+		})
+	r.MustHandle("POST", shared.PathEquals("/api/particle/events"), shared.PolicyAuthenticated,
+		func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+			return handleDeviceEvent(rc.Ctx, rc.Username, rc.Request)
+		})
+	r.MustHandle("GET", shared.PathEquals("/api/particle/devices/variables"), shared.PolicyAuthenticated,
+		func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+			return handleGetAllDeviceVariables(rc.Ctx, rc.Username)
+		})
+	r.MustHandle("POST", shared.PathEquals("/api/particle/devices/provision-all"), shared.PolicyAuthenticated,
+		func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+			return handleProvisionAll(rc.Ctx, rc.Username, rc.Request)
+		})
+	r.MustHandle("POST", shared.MatchAll(shared.HasPathParams("deviceId"), shared.PathSuffix("/provision")), shared.PolicyAuthenticated,
+		func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+			return handleProvisionDevice(rc.Ctx, rc.Username, rc.Request.PathParameters["deviceId"], rc.Request)
+		})
+	r.MustHandle("GET", shared.MatchAll(shared.HasPathParams("deviceId"), shared.PathSuffix("/variables")), shared.PolicyAuthenticated,
+		func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+			return handleGetDeviceVariables(rc.Ctx, rc.Username, rc.Request.PathParameters["deviceId"])
+		})
+	r.MustHandle("GET", shared.HasPathParams("deviceId"), shared.PolicyAuthenticated,
+		func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+			return handleGetDeviceInfo(rc.Ctx, rc.Username, rc.Request.PathParameters["deviceId"])
+		})
+
+	return r
+}
 
 func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
 	log.Printf("=== Particle Handler Called ===")
@@ -36,42 +97,7 @@ func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events
 	log.Printf("Method: %s", request.HTTPMethod)
 	log.Printf("PathParameters: %+v", request.PathParameters)
 
-	// Validate authentication
-	username, err := shared.ValidateAuth(ctx, request)
-	if err != nil || username == "" {
-		log.Printf("Authentication failed: err=%v, username=%s", err, username)
-		return shared.CreateErrorResponse(401, "Unauthorized"), nil
-	}
-
-	log.Printf("Authenticated user: %s", username)
-
-	path := request.Path
-	method := request.HTTPMethod
-	deviceID := request.PathParameters["deviceId"]
-
-	switch {
-	case path == "/api/particle/command" && method == "POST":
-		log.Println("Routing to handleSendCommand")
-		return handleSendCommand(ctx, username, request)
-	case path == "/api/particle/devices/refresh" && method == "POST":
-		log.Println("Routing to handleRefreshDevices")
-		return handleRefreshDevices(ctx, username)
-	case path == "/api/particle/validate-token" && method == "POST":
-		log.Println("Routing to handleValidateToken")
-		return handleValidateToken(ctx, username, request)
-	case path == "/api/particle/oauth/initiate" && method == "POST":
-		log.Println("Routing to handleOAuthInitiate")
-		return handleOAuthInitiate(ctx, username)
-	case deviceID != "" && method == "GET" && strings.HasSuffix(path, "/variables"):
-		log.Printf("Routing to handleGetDeviceVariables for deviceID: %s", deviceID)
-		return handleGetDeviceVariables(ctx, username, deviceID)
-	case deviceID != "" && method == "GET":
-		log.Printf("Routing to handleGetDeviceInfo for deviceID: %s", deviceID)
-		return handleGetDeviceInfo(ctx, username, deviceID)
-	default:
-		log.Printf("No matching route for path: %s, method: %s", path, method)
-		return shared.CreateErrorResponse(404, "Not found"), nil
-	}
+	return router.Dispatch(ctx, request)
 }
 
 func handleSendCommand(ctx context.Context, username string, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
@@ -82,6 +108,12 @@ func handleSendCommand(ctx context.Context, username string, request events.APIG
 		PatternID string `json:"patternId,omitempty"`
 		Command   string `json:"command,omitempty"`
 		Argument  string `json:"argument,omitempty"`
+
+		// With a pin the pattern goes to that strip only, optionally to
+		// LEDs [startLed, endLed)
+		Pin      *int `json:"pin,omitempty"`
+		StartLED *int `json:"startLed,omitempty"`
+		EndLED   *int `json:"endLed,omitempty"`
 	}
 
 	body := shared.GetRequestBody(request)
@@ -100,6 +132,10 @@ func handleSendCommand(ctx context.Context, username string, request events.APIG
 		return shared.CreateErrorResponse(400, "deviceId is required"), nil
 	}
 
+	if cmdReq.Pin == nil && (cmdReq.StartLED != nil || cmdReq.EndLED != nil) {
+		return shared.CreateErrorResponse(400, "pin is required with startLed/endLed"), nil
+	}
+
 	// Get device
 	log.Printf("Fetching device from DynamoDB: %s", cmdReq.DeviceID)
 	deviceKey, _ := attributevalue.MarshalMap(map[string]string{
@@ -122,7 +158,7 @@ func handleSendCommand(ctx context.Context, username string, request events.APIG
 	// Verify ownership
 	if device.UserID != username {
 		log.Printf("Access denied: device belongs to %s, not %s", device.UserID, username)
-		return shared.CreateErrorResponse(403, "Access denied"), nil
+		return shared.CreateErrorResponse(404, "Device not found"), nil
 	}
 
 	// Get user's Particle token
@@ -137,6 +173,11 @@ func handleSendCommand(ctx context.Context, username string, request events.APIG
 		return shared.CreateErrorResponse(500, "Database error"), nil
 	}
 
+	if err := shared.DecryptParticleToken(ctx, usersTable, &user); err != nil {
+		log.Printf("Failed to decrypt Particle token for %s: %v", username, err)
+		return shared.CreateErrorResponse(500, "Failed to read Particle token"), nil
+	}
+
 	if user.ParticleToken == "" {
 		log.Printf("User %s has no Particle token configured", username)
 		return shared.CreateErrorResponse(400, "Particle token not configured"), nil
@@ -144,6 +185,9 @@ func handleSendCommand(ctx context.Context, username string, request events.APIG
 
 	log.Printf("User has Particle token configured (length: %d chars)", len(user.ParticleToken))
 
+	// Responses report how many Particle requests it took, retries included
+	ctx, attempts := shared.WithParticleAttempts(ctx)
+
 	// If PatternID is provided, get pattern and send to device
 	if cmdReq.PatternID != "" {
 		log.Printf("Pattern ID provided: %s", cmdReq.PatternID)
@@ -168,22 +212,93 @@ func handleSendCommand(ctx context.Context, username string, request events.APIG
 
 		if pattern.UserID != username {
 			log.Printf("Pattern access denied: pattern belongs to %s, not %s", pattern.UserID, username)
-			return shared.CreateErrorResponse(403, "Pattern access denied"), nil
+			return shared.CreateErrorResponse(404, "Pattern not found"), nil
+		}
+
+		// A single strip, and the part of it to apply to
+		var strip *shared.LEDStrip
+		var window *shared.LEDWindow
+		var err error
+		preserveRest := request.QueryStringParameters["preserveRest"] == "true"
+		if cmdReq.Pin != nil {
+			for i := range device.LEDStrips {
+				if device.LEDStrips[i].Pin == *cmdReq.Pin {
+					strip = &device.LEDStrips[i]
+					break
+				}
+			}
+			if strip == nil {
+				return shared.CreateErrorResponse(404, "No strip configured on that pin"), nil
+			}
+			window, err = shared.ResolveLEDWindow(cmdReq.StartLED, cmdReq.EndLED, strip.LEDCount)
+			if err != nil {
+				return shared.CreateErrorResponse(400, err.Error()), nil
+			}
 		}
 
 		// Apply pattern to device
-		log.Printf("Applying pattern to device...")
-		if err := applyPatternToDevice(device, pattern, user.ParticleToken); err != nil {
+		log.Printf("Applying pattern to device (manufacturer=%s)...", device.GetManufacturer())
+		var warnings []string
+		var sources map[string]string
+		if strip != nil {
+			warnings, sources, err = dispatchPatternToStrip(ctx, device, *strip, window, preserveRest, pattern, user.ParticleToken)
+		} else {
+			warnings, sources, err = dispatchPattern(ctx, device, pattern, user.ParticleToken)
+		}
+		for _, w := range warnings {
+			log.Printf("Warning applying pattern %s: %s", pattern.Name, w)
+		}
+		if err != nil {
 			log.Printf("Failed to apply pattern: %v", err)
-			return shared.CreateErrorResponse(500, fmt.Sprintf("Failed to apply pattern: %v", err)), nil
+			if errors.Is(err, ErrNotImplemented) {
+				return shared.CreateErrorResponse(501, fmt.Sprintf("Manufacturer %s is not supported yet", device.GetManufacturer())), nil
+			}
+			if errors.Is(err, shared.ErrLEDWindowUnsupported) || errors.Is(err, shared.ErrLEDWindowTooManySegments) {
+				return shared.CreateErrorResponse(422, err.Error()), nil
+			}
+			var memErr *shared.MemoryLimitError
+			if errors.As(err, &memErr) {
+				return shared.CreateErrorResponse(422, fmt.Sprintf("Pattern is too large for %s: %v", device.Name, memErr)), nil
+			}
+			if shared.IsDeviceRateLimited(err) {
+				return shared.CreateErrorResponse(429, err.Error()), nil
+			}
+			return shared.CreateErrorResponse(500, fmt.Sprintf("Failed to apply pattern: %v%s", err, retriedSuffix(attempts))), nil
 		}
 
 		log.Printf("Successfully applied pattern %s to device %s", pattern.Name, device.Name)
-		return shared.CreateSuccessResponse(200, map[string]string{
-			"message": "Pattern applied successfully",
-			"device":  device.Name,
-			"pattern": pattern.Name,
-		}), nil
+		if err := shared.IncrementPatternApplyCount(ctx, patternsTable, pattern.PatternID); err != nil {
+			log.Printf("Failed to increment apply count for pattern %s: %v", pattern.PatternID, err)
+		}
+		var appliedPins []int
+		if strip != nil {
+			appliedPins = []int{strip.Pin}
+		}
+		recordDeviceApply(ctx, device, pattern, appliedPins)
+		result := map[string]interface{}{
+			"message":  "Pattern applied successfully",
+			"device":   device.Name,
+			"pattern":  pattern.Name,
+			"warnings": warnings,
+			"attempts": attempts.Attempts(),
+		}
+		if strip != nil {
+			result["pin"] = strip.Pin
+			result["window"] = effectiveWindow(window, strip.LEDCount)
+			result["preserveRest"] = window != nil && preserveRest
+			result["speedMultiplier"] = strip.EffectiveSpeedMultiplier()
+			if source := sources[strconv.Itoa(strip.Pin)]; source != "" {
+				result["binarySource"] = source
+			}
+		} else {
+			if speeds := stripSpeedMultipliers(device); len(speeds) > 0 {
+				result["speedMultipliers"] = speeds
+			}
+			if len(sources) > 0 {
+				result["binarySources"] = sources
+			}
+		}
+		return shared.CreateSuccessResponse(200, result), nil
 	}
 
 	// Otherwise, send custom command
@@ -264,20 +379,48 @@ func handleSendCommand(ctx context.Context, username string, request events.APIG
 		return shared.CreateErrorResponse(400, "command is required"), nil
 	}
 
-	if err := callParticleFunction(device.ParticleID, cmdReq.Command, cmdReq.Argument, user.ParticleToken); err != nil {
+	if device.GetManufacturer() != shared.ManufacturerParticle {
+		log.Printf("Custom commands are not supported for manufacturer %s", device.GetManufacturer())
+		return shared.CreateErrorResponse(501, fmt.Sprintf("Manufacturer %s is not supported yet", device.GetManufacturer())), nil
+	}
+
+	// A direct brightness command stops any ramp on the strip ("pin,value")
+	if cmdReq.Command == "setBright" {
+		if physical, err := strconv.Atoi(strings.SplitN(cmdReq.Argument, ",", 2)[0]); err == nil {
+			if err := shared.CancelStripRamp(ctx, device.DeviceID, device.LogicalPin(physical), "superseded by setBright command"); err != nil {
+				log.Printf("Failed to cancel ramp on device %s pin %d: %v", device.DeviceID, physical, err)
+			}
+		}
+	}
+
+	timed := newTimedCaller(ctx, device, user.ParticleToken)
+	if err := timed.Call(device.ParticleID, cmdReq.Command, cmdReq.Argument); err != nil {
 		log.Printf("Failed to send command: %v", err)
-		return shared.CreateErrorResponse(500, fmt.Sprintf("Failed to send command: %v", err)), nil
+		if shared.IsDeviceRateLimited(err) {
+			return shared.CreateErrorResponse(429, err.Error()), nil
+		}
+		return shared.CreateErrorResponse(500, fmt.Sprintf("Failed to send command: %v%s", err, retriedSuffix(attempts))), nil
 	}
 
 	log.Printf("Successfully sent command %s to device %s", cmdReq.Command, device.Name)
-	return shared.CreateSuccessResponse(200, map[string]string{
-		"message": "Command sent successfully",
-	}), nil
+	result := map[string]interface{}{
+		"message":  "Command sent successfully",
+		"attempts": attempts.Attempts(),
+	}
+	if warning := timed.RecordIfSlow(ctx, devicesTable); warning != "" {
+		result["warning"] = warning
+	}
+	return shared.CreateSuccessResponse(200, result), nil
 }
 
-func handleRefreshDevices(ctx context.Context, username string) (events.APIGatewayProxyResponse, error) {
+func handleRefreshDevices(ctx context.Context, username string, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
 	log.Printf("=== handleRefreshDevices V2 (Fixed Double-Marshal Bug): Starting for user %s ===", username)
 
+	opts, err := parseRefreshOptions(request.QueryStringParameters, username)
+	if err != nil {
+		return shared.CreateErrorResponse(400, err.Error()), nil
+	}
+
 	// Get user's Particle token
 	log.Printf("Fetching user from DynamoDB: %s", username)
 	userKey, _ := attributevalue.MarshalMap(map[string]string{
@@ -290,6 +433,11 @@ func handleRefreshDevices(ctx context.Context, username string) (events.APIGatew
 		return shared.CreateErrorResponse(500, "Database error"), nil
 	}
 
+	if err := shared.DecryptParticleToken(ctx, usersTable, &user); err != nil {
+		log.Printf("Failed to decrypt Particle token for %s: %v", username, err)
+		return shared.CreateErrorResponse(500, "Failed to read Particle token"), nil
+	}
+
 	if user.ParticleToken == "" {
 		log.Printf("User %s has no Particle token configured", username)
 		return shared.CreateErrorResponse(400, "Particle token not configured"), nil
@@ -300,11 +448,15 @@ func handleRefreshDevices(ctx context.Context, username string) (events.APIGatew
 
 	// Get devices from Particle cloud
 	log.Println("Calling Particle API to get devices...")
-	particleDevices, err := getParticleDevices(user.ParticleToken)
+	particleDevices, err := shared.ListParticleDevices(ctx, user.ParticleToken)
 	if err != nil {
 		log.Printf("Failed to get devices from Particle: %v", err)
+		if resp, ok := shared.TimeoutErrorResponse(err); ok {
+			return resp, nil
+		}
 		return shared.CreateErrorResponse(500, fmt.Sprintf("Failed to get devices from Particle: %v", err)), nil
 	}
+	sortParticleDevices(particleDevices)
 
 	log.Printf("Successfully retrieved %d devices from Particle", len(particleDevices))
 	for i, dev := range particleDevices {
@@ -312,104 +464,149 @@ func handleRefreshDevices(ctx context.Context, username string) (events.APIGatew
 			i+1, dev["id"], dev["name"], dev["connected"])
 	}
 
-	// Save devices to DynamoDB
-	savedCount := 0
-	for _, particleDev := range particleDevices {
-		particleID, ok := particleDev["id"].(string)
-		if !ok || particleID == "" {
-			log.Printf("Skipping device with invalid ID: %v", particleDev)
-			continue
-		}
-
-		name, _ := particleDev["name"].(string)
-		if name == "" {
-			name = particleID // Use Particle ID as fallback name
-		}
+	if opts.Async {
+		return startRefreshJob(ctx, username, particleDevices)
+	}
 
-		connected, _ := particleDev["connected"].(bool)
+	if opts.Offset > len(particleDevices) {
+		opts.Offset = len(particleDevices)
+	}
 
-		// Check device readiness if online
-		var isReady bool
-		var firmwareVersion, platform string
-		if connected {
-			isReady, firmwareVersion, platform = checkDeviceReadiness(particleID, user.ParticleToken)
-			log.Printf("Device %s readiness check: isReady=%v, firmware=%s, platform=%s",
-				particleID, isReady, firmwareVersion, platform)
-		} else {
-			log.Printf("Device %s is offline, skipping readiness check", particleID)
+	// Save devices to DynamoDB. Each is saved as it's processed, so a chunk
+	// cut short keeps the devices before it.
+	savedCount := 0
+	next := len(particleDevices)
+	deadline := refreshDeadline(ctx)
+	for i := opts.Offset; i < len(particleDevices); i++ {
+		// Always make progress, then stop at the limit or before the
+		// gateway times out
+		processed := i - opts.Offset
+		if processed > 0 && ((opts.Limit > 0 && processed >= opts.Limit) || time.Now().After(deadline)) {
+			next = i
+			break
 		}
-
-		// Check if device already exists for this user
-		log.Printf("Checking if device %s already exists for user %s", particleID, username)
-		existingDevice, err := findDeviceByParticleID(ctx, username, particleID)
-		if err != nil {
-			log.Printf("Error checking for existing device: %v", err)
+		if err := refreshParticleDevice(ctx, username, user.ParticleToken, particleDevices[i]); err != nil {
+			log.Printf("Failed to refresh device %v: %v", particleDevices[i]["id"], err)
 			continue
 		}
+		savedCount++
+	}
 
-		now := time.Now()
+	log.Printf("Saved %d devices to database (devices %d-%d of %d)", savedCount, opts.Offset, next, len(particleDevices))
 
-		if existingDevice != nil {
-			// Update existing device
-			log.Printf("Updating existing device: %s", existingDevice.DeviceID)
-			existingDevice.Name = name
-			existingDevice.IsOnline = connected
-			existingDevice.IsReady = isReady
-			// Only update firmware info if we got valid data (don't clear on transient errors)
-			if firmwareVersion != "" {
-				existingDevice.FirmwareVersion = firmwareVersion
-			}
-			if platform != "" {
-				existingDevice.Platform = platform
-			}
-			if connected {
-				existingDevice.LastSeen = now
-			}
-			existingDevice.UpdatedAt = now
+	response := map[string]interface{}{
+		"count":   savedCount,
+		"devices": particleDevices[opts.Offset:next],
+		"offset":  opts.Offset,
+		"total":   len(particleDevices),
+	}
+	if user.ParticleTokenExpiresAt != nil {
+		response["tokenExpiresAt"] = user.ParticleTokenExpiresAt
+	}
+	if warning := shared.ParticleTokenExpiryMessage(user, time.Now()); warning != "" {
+		response["tokenWarning"] = warning
+	}
+	if next < len(particleDevices) {
+		response["continuation"] = encodeRefreshContinuation(username, next)
+	}
+	return shared.CreateSuccessResponse(200, response), nil
+}
 
-			// Dereference pointer to pass value, not pointer
-			deviceValue := *existingDevice
-			log.Printf("About to PutItem - deviceValue type: %T, deviceId: %s, isReady: %v", deviceValue, deviceValue.DeviceID, deviceValue.IsReady)
-			if err := shared.PutItem(ctx, devicesTable, deviceValue); err != nil {
-				log.Printf("Failed to update device: %v", err)
-				continue
-			}
-			log.Printf("Successfully updated device: %s", existingDevice.DeviceID)
-		} else {
-			// Create new device
-			deviceID := uuid.New().String()
-			log.Printf("Creating new device with ID: %s", deviceID)
-
-			device := shared.Device{
-				DeviceID:        deviceID,
-				UserID:          username,
-				Name:            name,
-				ParticleID:      particleID,
-				IsOnline:        connected,
-				IsReady:         isReady,
-				FirmwareVersion: firmwareVersion,
-				Platform:        platform,
-				LastSeen:        now,
-				CreatedAt:       now,
-				UpdatedAt:       now,
-			}
+// refreshParticleDevice checks one device from the Particle device list and
+// creates or updates its record. particleDev gains the readiness fields the
+// refresh response reports.
+func refreshParticleDevice(ctx context.Context, username, token string, particleDev map[string]interface{}) error {
+	particleID, ok := particleDev["id"].(string)
+	if !ok || particleID == "" {
+		return fmt.Errorf("invalid device ID: %v", particleDev["id"])
+	}
 
-			log.Printf("About to PutItem - device type: %T, deviceId: %s, isReady: %v", device, device.DeviceID, device.IsReady)
-			if err := shared.PutItem(ctx, devicesTable, device); err != nil {
-				log.Printf("Failed to save new device: %v", err)
-				continue
-			}
-			log.Printf("Successfully created device: %s", deviceID)
-		}
-		savedCount++
+	name, _ := particleDev["name"].(string)
+	if name == "" {
+		name = particleID // Use Particle ID as fallback name
 	}
 
-	log.Printf("Saved %d devices to database", savedCount)
+	connected, _ := particleDev["connected"].(bool)
 
-	return shared.CreateSuccessResponse(200, map[string]interface{}{
-		"count":   savedCount,
-		"devices": particleDevices,
-	}), nil
+	// Check device readiness if online
+	readiness := shared.DeviceReadiness{Status: shared.ReadinessOffline}
+	var capabilities []string
+	if connected {
+		readiness = checkDeviceReadiness(ctx, particleID, token)
+		log.Printf("Device %s readiness check: status=%s, firmware=%s, platform=%s",
+			particleID, readiness.Status, readiness.FirmwareVersion, readiness.Platform)
+		capabilities = getDeviceCapabilities(ctx, particleID, token)
+	} else {
+		log.Printf("Device %s is offline, skipping readiness check", particleID)
+	}
+
+	// Check if device already exists for this user
+	log.Printf("Checking if device %s already exists for user %s", particleID, username)
+	existingDevice, err := findDeviceByParticleID(ctx, username, particleID)
+	if err != nil {
+		return fmt.Errorf("checking for existing device: %w", err)
+	}
+
+	now := time.Now()
+
+	if existingDevice != nil {
+		// Update existing device
+		log.Printf("Updating existing device: %s", existingDevice.DeviceID)
+		wasReady, previousName := existingDevice.IsReady, existingDevice.Name
+		existingDevice.SetName(name)
+		existingDevice.IsOnline = connected
+		// Firmware info is only updated from a ready check, and a
+		// transient error keeps a ready device ready
+		existingDevice.ApplyReadiness(readiness, now)
+		if len(capabilities) > 0 {
+			existingDevice.Capabilities = capabilities
+		}
+		if connected {
+			existingDevice.LastSeen = now
+		}
+		existingDevice.UpdatedAt = now
+
+		// Dereference pointer to pass value, not pointer
+		deviceValue := *existingDevice
+		log.Printf("About to PutItem - deviceValue type: %T, deviceId: %s, isReady: %v", deviceValue, deviceValue.DeviceID, deviceValue.IsReady)
+		if err := shared.PutItem(ctx, devicesTable, deviceValue); err != nil {
+			return fmt.Errorf("updating device: %w", err)
+		}
+		log.Printf("Successfully updated device: %s", existingDevice.DeviceID)
+		// A device that became ready, stopped being ready or was renamed
+		// changes what Alexa discovers
+		if existingDevice.IsReady != wasReady || existingDevice.Name != previousName {
+			shared.RefreshAlexaDiscovery(ctx, username)
+		}
+		particleDev["readinessStatus"] = existingDevice.ReadinessStatus
+		particleDev["readinessStaleSince"] = existingDevice.ReadinessStaleSince
+		return nil
+	}
+
+	// Create new device
+	deviceID := uuid.New().String()
+	log.Printf("Creating new device with ID: %s", deviceID)
+
+	device := shared.Device{
+		DeviceID:     deviceID,
+		UserID:       username,
+		ParticleID:   particleID,
+		IsOnline:     connected,
+		Capabilities: capabilities,
+		LastSeen:     now,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}
+	device.SetName(name)
+	device.ApplyReadiness(readiness, now)
+
+	log.Printf("About to PutItem - device type: %T, deviceId: %s, isReady: %v", device, device.DeviceID, device.IsReady)
+	if err := shared.PutItem(ctx, devicesTable, device); err != nil {
+		return fmt.Errorf("saving new device: %w", err)
+	}
+	log.Printf("Successfully created device: %s", deviceID)
+	particleDev["readinessStatus"] = device.ReadinessStatus
+	return nil
 }
 
 func handleGetDeviceVariables(ctx context.Context, username string, deviceID string) (events.APIGatewayProxyResponse, error) {
@@ -426,14 +623,10 @@ func handleGetDeviceVariables(ctx context.Context, username string, deviceID str
 		return shared.CreateErrorResponse(500, "Database error"), nil
 	}
 
-	if device.DeviceID == "" {
+	if device.DeviceID == "" || device.UserID != username {
 		return shared.CreateErrorResponse(404, "Device not found"), nil
 	}
 
-	if device.UserID != username {
-		return shared.CreateErrorResponse(403, "Access denied"), nil
-	}
-
 	// Get user's Particle token
 	userKey, _ := attributevalue.MarshalMap(map[string]string{
 		"username": username,
@@ -444,111 +637,24 @@ func handleGetDeviceVariables(ctx context.Context, username string, deviceID str
 		return shared.CreateErrorResponse(500, "Database error"), nil
 	}
 
-	if user.ParticleToken == "" {
-		return shared.CreateErrorResponse(400, "Particle token not configured"), nil
+	if err := shared.DecryptParticleToken(ctx, usersTable, &user); err != nil {
+		log.Printf("Failed to decrypt Particle token for %s: %v", username, err)
+		return shared.CreateErrorResponse(500, "Failed to read Particle token"), nil
 	}
 
-	// Read all firmware variables
-	result := map[string]interface{}{
-		"deviceId":   deviceID,
-		"particleId": device.ParticleID,
-		"name":       device.Name,
-	}
-
-	// Read deviceInfo variable: "version|platform|maxStrips|maxLeds|maxColors"
-	if deviceInfo, err := getParticleVariable(device.ParticleID, "deviceInfo", user.ParticleToken); err == nil {
-		result["deviceInfo"] = deviceInfo
-		parts := strings.Split(deviceInfo, "|")
-		if len(parts) >= 2 {
-			result["firmwareVersion"] = parts[0]
-			result["platform"] = parts[1]
-		}
-		if len(parts) >= 3 {
-			if maxStrips, err := strconv.Atoi(parts[2]); err == nil {
-				result["maxStrips"] = maxStrips
-			}
-		}
-		if len(parts) >= 4 {
-			if maxLeds, err := strconv.Atoi(parts[3]); err == nil {
-				result["maxLedsPerStrip"] = maxLeds
-			}
-		}
-		if len(parts) >= 5 {
-			if maxColors, err := strconv.Atoi(parts[4]); err == nil {
-				result["maxColorsPerStrip"] = maxColors
-			}
-		}
-	} else {
-		log.Printf("Failed to read deviceInfo: %v", err)
+	if user.ParticleToken == "" {
+		return shared.CreateErrorResponse(400, "Particle token not configured"), nil
 	}
 
-	// Read numStrips variable
-	if numStrips, err := getParticleVariable(device.ParticleID, "numStrips", user.ParticleToken); err == nil {
-		if n, err := strconv.Atoi(numStrips); err == nil {
-			result["numStrips"] = n
-		}
-	} else {
-		log.Printf("Failed to read numStrips: %v", err)
-	}
-
-	// Read strips variable: "D6:8:1:128:50:2;D2:12:5:255:30:1"
-	// Format: D{pin}:{ledCount}:{pattern}:{brightness}:{speed}:{colorCount}
-	if stripsStr, err := getParticleVariable(device.ParticleID, "strips", user.ParticleToken); err == nil {
-		result["stripsRaw"] = stripsStr
-		var strips []map[string]interface{}
-		if stripsStr != "" {
-			stripParts := strings.Split(stripsStr, ";")
-			for _, sp := range stripParts {
-				if sp == "" {
-					continue
-				}
-				parts := strings.Split(sp, ":")
-				if len(parts) >= 3 {
-					strip := map[string]interface{}{}
-					// Parse pin (e.g., "D6" -> 6)
-					pinStr := parts[0]
-					if strings.HasPrefix(pinStr, "D") {
-						pinStr = pinStr[1:]
-					}
-					if pin, err := strconv.Atoi(pinStr); err == nil {
-						strip["pin"] = pin
-					}
-					if ledCount, err := strconv.Atoi(parts[1]); err == nil {
-						strip["ledCount"] = ledCount
-					}
-					if pattern, err := strconv.Atoi(parts[2]); err == nil {
-						strip["pattern"] = pattern
-					}
-					// Parse additional fields if present (firmware v2.2.0+)
-					if len(parts) >= 4 {
-						if brightness, err := strconv.Atoi(parts[3]); err == nil {
-							strip["brightness"] = brightness
-						}
-					}
-					if len(parts) >= 5 {
-						if speed, err := strconv.Atoi(parts[4]); err == nil {
-							strip["speed"] = speed
-						}
-					}
-					if len(parts) >= 6 {
-						if colorCount, err := strconv.Atoi(parts[5]); err == nil {
-							strip["colorCount"] = colorCount
-						}
-					}
-					strips = append(strips, strip)
-				}
-			}
-		}
-		result["strips"] = strips
-	} else {
-		log.Printf("Failed to read strips: %v", err)
-		result["strips"] = []map[string]interface{}{}
-	}
+	result := readDeviceVariables(ctx, device, user.ParticleToken, singleVariableTimeout)
 
 	log.Printf("Device variables retrieved successfully")
 	return shared.CreateSuccessResponse(200, result), nil
 }
 
+// handleGetDeviceInfo serves the deprecated GET /api/particle/device/{deviceId}:
+// the stored device with Particle's live status merged over it, marked with
+// a Deprecation header pointing at GET /api/devices/{deviceId}?live=true
 func handleGetDeviceInfo(ctx context.Context, username string, deviceID string) (events.APIGatewayProxyResponse, error) {
 	log.Printf("=== handleGetDeviceInfo: Starting for user %s, deviceID %s ===", username, deviceID)
 
@@ -574,7 +680,7 @@ func handleGetDeviceInfo(ctx context.Context, username string, deviceID string)
 	// Verify ownership
 	if device.UserID != username {
 		log.Printf("Access denied: device belongs to %s, not %s", device.UserID, username)
-		return shared.CreateErrorResponse(403, "Access denied"), nil
+		return shared.CreateErrorResponse(404, "Device not found"), nil
 	}
 
 	// Get user's Particle token
@@ -589,6 +695,11 @@ func handleGetDeviceInfo(ctx context.Context, username string, deviceID string)
 		return shared.CreateErrorResponse(500, "Database error"), nil
 	}
 
+	if err := shared.DecryptParticleToken(ctx, usersTable, &user); err != nil {
+		log.Printf("Failed to decrypt Particle token for %s: %v", username, err)
+		return shared.CreateErrorResponse(500, "Failed to read Particle token"), nil
+	}
+
 	if user.ParticleToken == "" {
 		log.Printf("User %s has no Particle token configured", username)
 		return shared.CreateErrorResponse(400, "Particle token not configured"), nil
@@ -596,106 +707,206 @@ func handleGetDeviceInfo(ctx context.Context, username string, deviceID string)
 
 	log.Printf("User has Particle token configured (length: %d chars)", len(user.ParticleToken))
 
-	// Get device info from Particle cloud
-	log.Printf("Calling Particle API to get device info for: %s", device.ParticleID)
-	info, err := getParticleDeviceInfo(device.ParticleID, user.ParticleToken)
-	if err != nil {
-		log.Printf("Failed to get device info: %v", err)
-		return shared.CreateErrorResponse(500, fmt.Sprintf("Failed to get device info: %v", err)), nil
-	}
+	// Same merge as GET /api/devices/{deviceId}?live=true, which replaces this route
+	view, warnings := shared.LiveDeviceView(ctx, device, user.ParticleToken)
+	resp := shared.CreateSuccessResponseWithWarnings(200, view, warnings)
+	resp.Headers["Deprecation"] = "true"
+	resp.Headers["Link"] = fmt.Sprintf("</api/devices/%s?live=true>; rel=\"successor-version\"", device.DeviceID)
+	return resp, nil
+}
 
-	log.Printf("Successfully retrieved device info from Particle")
-	return shared.CreateSuccessResponse(200, info), nil
+// dispatchPattern sends a pattern using the transport for the device's
+// manufacturer. Besides warnings it returns where each strip's bytecode came
+// from (a BinarySource), keyed by pin.
+func dispatchPattern(ctx context.Context, device shared.Device, pattern shared.Pattern, token string) ([]string, map[string]string, error) {
+	switch device.GetManufacturer() {
+	case shared.ManufacturerParticle:
+		return applyPatternToDevice(ctx, device, pattern, token)
+	case shared.ManufacturerWLED:
+		return nil, nil, callWLEDHTTP(device, pattern)
+	default:
+		return nil, nil, fmt.Errorf("unknown manufacturer: %s", device.GetManufacturer())
+	}
 }
 
-func applyPatternToDevice(device shared.Device, pattern shared.Pattern, token string) error {
-	log.Printf("=== applyPatternToDevice: device=%s, pattern=%s ===", device.Name, pattern.Name)
+// dispatchPatternToStrip sends a pattern to one strip, or to window of it
+// when set. Only Particle devices can be addressed per strip.
+func dispatchPatternToStrip(ctx context.Context, device shared.Device, strip shared.LEDStrip, window *shared.LEDWindow, preserveRest bool, pattern shared.Pattern, token string) ([]string, map[string]string, error) {
+	if device.GetManufacturer() != shared.ManufacturerParticle {
+		return dispatchPattern(ctx, device, pattern, token)
+	}
+
+	log.Printf("=== dispatchPatternToStrip: device=%s, pin=%d, pattern=%s, window=%v ===",
+		device.Name, strip.Pin, pattern.Name, window)
 
-	// Convert pattern type to firmware pattern number
-	patternMap := map[string]int{
-		shared.PatternCandle:  1,
-		shared.PatternSolid:   2,
-		shared.PatternPulse:   3,
-		shared.PatternWave:    4,
-		shared.PatternRainbow: 5,
-		shared.PatternFire:    6,
+	timed := newTimedCaller(ctx, device, token)
+	call := timed.Call
+
+	var warnings []string
+	var source string
+	var err error
+	if window != nil {
+		// Windows are always compiled for the window
+		warnings, err = shared.ApplyPatternToStripWindow(device, strip.Pin, strip.LEDCount, *window, preserveRest, pattern, call)
+	} else {
+		warnings, source, err = shared.ApplyPatternToStripWithSource(device, strip.Pin, strip.LEDCount, pattern, call)
+	}
+	shared.CountPatternApply("particle", err == nil)
+	if err != nil {
+		return warnings, nil, err
+	}
+	var sources map[string]string
+	if source != "" {
+		sources = map[string]string{strconv.Itoa(strip.Pin): source}
 	}
 
-	patternNum := patternMap[pattern.Type]
-	log.Printf("Pattern type %s mapped to number %d", pattern.Type, patternNum)
+	log.Println("Sending saveConfig command")
+	if err := call(device.ParticleID, "saveConfig", "1"); err != nil {
+		log.Printf("saveConfig failed: %v", err)
+		return warnings, sources, err
+	}
+	if warning := timed.RecordIfSlow(ctx, devicesTable); warning != "" {
+		warnings = append(warnings, warning)
+	}
+	return warnings, sources, nil
+}
 
-	// If device has configured LED strips, apply pattern to each strip
-	if len(device.LEDStrips) > 0 {
-		log.Printf("Device has %d configured LED strips", len(device.LEDStrips))
+// stripSpeedMultipliers maps the pins of the device's strips that have a speed
+// multiplier other than 1.0 to it
+func stripSpeedMultipliers(device shared.Device) map[string]float64 {
+	speeds := make(map[string]float64)
+	for _, strip := range device.LEDStrips {
+		if m := strip.EffectiveSpeedMultiplier(); m != 1 {
+			speeds[strconv.Itoa(strip.Pin)] = m
+		}
+	}
+	return speeds
+}
 
-		for _, strip := range device.LEDStrips {
-			pin := strip.Pin
-			log.Printf("Applying pattern to strip on pin D%d", pin)
+// effectiveWindow is the window a strip apply covered: window, or the whole strip
+func effectiveWindow(window *shared.LEDWindow, ledCount int) shared.LEDWindow {
+	if window != nil {
+		return *window
+	}
+	return shared.LEDWindow{Start: 0, End: ledCount}
+}
 
-			// Send pattern command: "pin,pattern,speed"
-			patternArg := fmt.Sprintf("%d,%d,%d", pin, patternNum, pattern.Speed)
-			log.Printf("Sending setPattern command with arg: %s", patternArg)
-			if err := callParticleFunction(device.ParticleID, "setPattern", patternArg, token); err != nil {
-				log.Printf("setPattern failed for pin D%d: %v", pin, err)
-				return err
-			}
+// callWLEDHTTP will send a pattern straight to a WLED device's JSON API.
+// Stubbed until ESP8266/ESP32 devices are supported.
+func callWLEDHTTP(device shared.Device, pattern shared.Pattern) error {
+	log.Printf("callWLEDHTTP: device=%s, pattern=%s - not implemented", device.Name, pattern.Name)
+	return ErrNotImplemented
+}
 
-			// Send color command: "pin,R,G,B"
-			colorArg := fmt.Sprintf("%d,%d,%d,%d", pin, pattern.Red, pattern.Green, pattern.Blue)
-			log.Printf("Sending setColor command with arg: %s", colorArg)
-			if err := callParticleFunction(device.ParticleID, "setColor", colorArg, token); err != nil {
-				log.Printf("setColor failed for pin D%d: %v", pin, err)
-				return err
+// applyPatternToDevice sends a pattern to each of the device's strips (setBytecode
+// for bytecode firmware, setPattern/setColor/setBright for older firmware) and
+// saves the config. The returned warnings describe anything the firmware can't reproduce,
+// and the sources where each strip's bytecode came from, keyed by pin.
+func applyPatternToDevice(ctx context.Context, device shared.Device, pattern shared.Pattern, token string) ([]string, map[string]string, error) {
+	log.Printf("=== applyPatternToDevice: device=%s, pattern=%s, firmware=%s, bytecode=%v ===",
+		device.Name, pattern.Name, device.FirmwareVersion, device.SupportsBytecode())
+
+	timed := newTimedCaller(ctx, device, token)
+	call := timed.Call
+
+	strips := device.LEDStrips
+	if len(strips) == 0 {
+		// Fallback for devices without configured strips - apply to the
+		// platform's default pin
+		pins := device.PinDefaults()
+		log.Printf("No LED strips configured, using default pin %s", shared.PinLabel(pins.DefaultPin))
+		strips = pins.DefaultStrips()
+	}
+
+	// Check every strip fits before sending to any, so an oversized pattern
+	// doesn't leave the device half updated
+	if device.SupportsBytecode() {
+		for _, strip := range strips {
+			bytecode, _, err := shared.CompileForLEDCount(&pattern, strip.LEDCount)
+			if err != nil {
+				return nil, nil, err
 			}
-
-			// Send brightness command: "pin,brightness"
-			brightnessArg := fmt.Sprintf("%d,%d", pin, pattern.Brightness)
-			log.Printf("Sending setBright command with arg: %s", brightnessArg)
-			if err := callParticleFunction(device.ParticleID, "setBright", brightnessArg, token); err != nil {
-				log.Printf("setBright failed for pin D%d: %v", pin, err)
-				return err
+			if _, err := shared.CheckBytecodeMemory(device, bytecode, strip.LEDCount); err != nil {
+				log.Printf("Pattern %s rejected for pin %d: %v", pattern.Name, strip.Pin, err)
+				shared.CountPatternApply("particle", false)
+				return nil, nil, err
 			}
 		}
-	} else {
-		// Fallback for devices without configured strips - apply to default pin 6
-		log.Printf("No LED strips configured, using default pin D6")
-		pin := 6
-
-		// Send pattern command
-		patternArg := fmt.Sprintf("%d,%d,%d", pin, patternNum, pattern.Speed)
-		if err := callParticleFunction(device.ParticleID, "setPattern", patternArg, token); err != nil {
-			log.Printf("setPattern failed: %v", err)
-			return err
-		}
+	}
 
-		// Send color command
-		colorArg := fmt.Sprintf("%d,%d,%d,%d", pin, pattern.Red, pattern.Green, pattern.Blue)
-		if err := callParticleFunction(device.ParticleID, "setColor", colorArg, token); err != nil {
-			log.Printf("setColor failed: %v", err)
-			return err
+	var warnings []string
+	sources := make(map[string]string)
+	for _, strip := range strips {
+		log.Printf("Applying pattern to strip on pin %d (%d LEDs)", strip.Pin, strip.LEDCount)
+		stripWarnings, source, err := shared.ApplyPatternToStripWithSource(device, strip.Pin, strip.LEDCount, pattern, call)
+		warnings = appendUnique(warnings, stripWarnings...)
+		if source != "" {
+			sources[strconv.Itoa(strip.Pin)] = source
 		}
-
-		// Send brightness command
-		brightnessArg := fmt.Sprintf("%d,%d", pin, pattern.Brightness)
-		if err := callParticleFunction(device.ParticleID, "setBright", brightnessArg, token); err != nil {
-			log.Printf("setBright failed: %v", err)
-			return err
+		shared.CountPatternApply("particle", err == nil)
+		if err != nil {
+			log.Printf("Failed to apply pattern to pin %d: %v", strip.Pin, err)
+			return warnings, sources, err
 		}
 	}
 
 	// Save configuration to flash
 	log.Println("Sending saveConfig command")
-	if err := callParticleFunction(device.ParticleID, "saveConfig", "1", token); err != nil {
+	if err := call(device.ParticleID, "saveConfig", "1"); err != nil {
 		log.Printf("saveConfig failed: %v", err)
-		return err
+		return warnings, sources, err
 	}
 
 	log.Println("Pattern applied successfully")
-	return nil
+	if warning := timed.RecordIfSlow(ctx, devicesTable); warning != "" {
+		warnings = append(warnings, warning)
+	}
+	return warnings, sources, nil
+}
+
+// appendUnique appends the values not already in list, so per-strip warnings
+// that repeat for every strip are reported once
+func appendUnique(list []string, values ...string) []string {
+	for _, v := range values {
+		found := false
+		for _, existing := range list {
+			if existing == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// retriedSuffix notes on an error message that Particle requests were
+// retried, e.g. " (after 3 attempts)", or is "" when none were
+func retriedSuffix(attempts *shared.ParticleAttempts) string {
+	if attempts.Retries() == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (after %d attempts)", attempts.Attempts())
 }
 
-func callParticleFunction(deviceID, functionName, argument, token string) error {
-	url := fmt.Sprintf("%s/devices/%s/%s", particleAPIBase, deviceID, functionName)
+// callParticleFunction calls a cloud function, retrying transient failures
+// (see shared.RetryParticleCall). The call gives up when ctx is done.
+func callParticleFunction(ctx context.Context, deviceID, functionName, argument, token string) error {
+	_, err := shared.RetryParticleCall(ctx, functionName, func(ctx context.Context) error {
+		return callParticleFunctionOnce(ctx, deviceID, functionName, argument, token)
+	})
+	return err
+}
+
+// callParticleFunctionOnce makes one attempt at a cloud function call,
+// logging the request and response in full
+func callParticleFunctionOnce(ctx context.Context, deviceID, functionName, argument, token string) (err error) {
+	start := time.Now()
+	defer func() { shared.ObserveParticleCall("function", start, err) }()
+
+	url := fmt.Sprintf("%s/devices/%s/%s", shared.ParticleAPIBase(), deviceID, functionName)
 
 	log.Printf("=== callParticleFunction ===")
 	log.Printf("URL: %s", url)
@@ -709,7 +920,7 @@ func callParticleFunction(deviceID, functionName, argument, token string) error
 	jsonData, _ := json.Marshal(data)
 	log.Printf("Request body: %s", string(jsonData))
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
 	if err != nil {
 		log.Printf("Failed to create HTTP request: %v", err)
 		return err
@@ -734,70 +945,71 @@ func callParticleFunction(deviceID, functionName, argument, token string) error
 	log.Printf("Response body: %s", string(body))
 
 	if resp.StatusCode != http.StatusOK {
-		errMsg := fmt.Sprintf("Particle API error (status %d): %s", resp.StatusCode, string(body))
-		log.Printf("ERROR: %s", errMsg)
-		return fmt.Errorf(errMsg)
+		log.Printf("ERROR: Particle API error (status %d): %s", resp.StatusCode, string(body))
+		return newParticleAPIError(resp.StatusCode, body)
 	}
 
 	log.Println("Particle function call successful")
 	return nil
 }
 
-func getParticleDevices(token string) ([]map[string]interface{}, error) {
-	url := fmt.Sprintf("%s/devices", particleAPIBase)
+// newTimedCaller calls cloud functions on device under its command timeout
+// (Device.CommandTimeout), noting calls slow enough to warn about. A call
+// that times out is checked against the device's lastCmdId before failing.
+func newTimedCaller(ctx context.Context, device shared.Device, token string) *shared.TimedCaller {
+	return shared.NewTimedCaller(ctx, device, func(ctx context.Context, particleID, function, argument string) error {
+		return callParticleFunction(ctx, particleID, function, argument, token)
+	}).VerifyWith(func(ctx context.Context, particleID, variable string) (string, error) {
+		return getParticleVariableWithContext(ctx, particleID, variable, token)
+	}).SequenceWith(devicesTable)
+}
 
-	log.Printf("=== getParticleDevices ===")
-	log.Printf("URL: %s", url)
-	log.Printf("Token (first 10 chars): %s...", safeTokenDisplay(token))
+// callParticleFunctionWithContext calls a cloud function, giving up when ctx
+// is done. It logs less than callParticleFunction, for bulk callers.
+func callParticleFunctionWithContext(ctx context.Context, deviceID, functionName, argument, token string) (err error) {
+	start := time.Now()
+	defer func() { shared.ObserveParticleCall("function", start, err) }()
+
+	url := fmt.Sprintf("%s/devices/%s/%s", shared.ParticleAPIBase(), deviceID, functionName)
+	jsonData, _ := json.Marshal(map[string]string{"arg": argument})
 
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
 	if err != nil {
-		log.Printf("Failed to create HTTP request: %v", err)
-		return nil, err
+		return err
 	}
-
+	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", "Bearer "+token)
-	log.Printf("Request headers: Authorization=Bearer %s...", safeTokenDisplay(token))
 
-	client := &http.Client{}
-	log.Println("Sending HTTP request to Particle API...")
-	resp, err := client.Do(req)
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		log.Printf("HTTP request failed: %v", err)
-		return nil, err
+		return err
 	}
 	defer resp.Body.Close()
 
-	log.Printf("Response status: %d %s", resp.StatusCode, resp.Status)
-
 	body, _ := io.ReadAll(resp.Body)
-	log.Printf("Response body: %s", string(body))
-
 	if resp.StatusCode != http.StatusOK {
-		errMsg := fmt.Sprintf("Particle API error (status %d): %s", resp.StatusCode, string(body))
-		log.Printf("ERROR: %s", errMsg)
-		return nil, fmt.Errorf(errMsg)
-	}
-
-	var devices []map[string]interface{}
-	if err := json.Unmarshal(body, &devices); err != nil {
-		log.Printf("Failed to parse response JSON: %v", err)
-		return nil, err
+		return newParticleAPIError(resp.StatusCode, body)
 	}
-
-	log.Printf("Successfully parsed %d devices from response", len(devices))
-	return devices, nil
+	return nil
 }
 
-func getParticleDeviceInfo(deviceID, token string) (map[string]interface{}, error) {
-	url := fmt.Sprintf("%s/devices/%s", particleAPIBase, deviceID)
+// getParticleDeviceInfo fetches a device's details. Running out of time
+// fails with a shared.DependencyTimeoutError.
+func getParticleDeviceInfo(ctx context.Context, deviceID, token string) (info map[string]interface{}, err error) {
+	start := time.Now()
+	defer func() { shared.ObserveParticleCall("device", start, err) }()
+
+	url := fmt.Sprintf("%s/devices/%s", shared.ParticleAPIBase(), deviceID)
 
 	log.Printf("=== getParticleDeviceInfo ===")
 	log.Printf("URL: %s", url)
 	log.Printf("Device ID: %s", deviceID)
 	log.Printf("Token (first 10 chars): %s...", safeTokenDisplay(token))
 
-	req, err := http.NewRequest("GET", url, nil)
+	ctx, cancel := shared.WithCallTimeout(ctx, particleCallTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		log.Printf("Failed to create HTTP request: %v", err)
 		return nil, err
@@ -806,12 +1018,11 @@ func getParticleDeviceInfo(deviceID, token string) (map[string]interface{}, erro
 	req.Header.Set("Authorization", "Bearer "+token)
 	log.Printf("Request headers: Authorization=Bearer %s...", safeTokenDisplay(token))
 
-	client := &http.Client{}
 	log.Println("Sending HTTP request to Particle API...")
-	resp, err := client.Do(req)
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		log.Printf("HTTP request failed: %v", err)
-		return nil, err
+		return nil, shared.DependencyTimeout("Particle", err)
 	}
 	defer resp.Body.Close()
 
@@ -836,31 +1047,49 @@ func getParticleDeviceInfo(deviceID, token string) (map[string]interface{}, erro
 	return result, nil
 }
 
-// getParticleVariable gets a specific variable from a Particle device
-func getParticleVariable(deviceID, variableName, token string) (string, error) {
-	url := fmt.Sprintf("%s/devices/%s/%s", particleAPIBase, deviceID, variableName)
+// getParticleVariableWithContext reads a variable, retrying transient
+// failures (see shared.RetryParticleCall) and giving up when ctx is done
+func getParticleVariableWithContext(ctx context.Context, deviceID, variableName, token string) (string, error) {
+	var value string
+	_, err := shared.RetryParticleCall(ctx, variableName, func(ctx context.Context) error {
+		var err error
+		value, err = getParticleVariableOnce(ctx, deviceID, variableName, token)
+		return err
+	})
+	return value, err
+}
+
+// getParticleVariableOnce makes one attempt at reading a variable, each
+// under particleCallTimeout
+func getParticleVariableOnce(ctx context.Context, deviceID, variableName, token string) (value string, err error) {
+	start := time.Now()
+	defer func() { shared.ObserveParticleCall("variable", start, err) }()
+
+	url := fmt.Sprintf("%s/devices/%s/%s", shared.ParticleAPIBase(), deviceID, variableName)
 
 	log.Printf("Getting variable %s from device %s", variableName, deviceID)
 
-	req, err := http.NewRequest("GET", url, nil)
+	ctx, cancel := shared.WithCallTimeout(ctx, particleCallTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return "", err
 	}
 
 	req.Header.Set("Authorization", "Bearer "+token)
 
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return "", err
+		return "", shared.DependencyTimeout("Particle", err)
 	}
 	defer resp.Body.Close()
 
+	body, _ := io.ReadAll(resp.Body)
 	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("failed to get variable: status %d", resp.StatusCode)
+		return "", newParticleAPIError(resp.StatusCode, body)
 	}
 
-	body, _ := io.ReadAll(resp.Body)
 	var result map[string]interface{}
 	if err := json.Unmarshal(body, &result); err != nil {
 		return "", err
@@ -881,22 +1110,206 @@ func getParticleVariable(deviceID, variableName, token string) (string, error) {
 	return "", fmt.Errorf("no result in response")
 }
 
+// particleAPIError is a non-200 response from the Particle API
+type particleAPIError struct {
+	StatusCode int
+	Message    string // Particle's "error" field, when it sent one
+}
+
+func newParticleAPIError(statusCode int, body []byte) *particleAPIError {
+	var parsed struct {
+		Error string `json:"error"`
+	}
+	json.Unmarshal(body, &parsed)
+	return &particleAPIError{StatusCode: statusCode, Message: parsed.Error}
+}
+
+// ParticleStatus is the HTTP status, for shared.IsCommandTimeout
+func (e *particleAPIError) ParticleStatus() int {
+	return e.StatusCode
+}
+
+func (e *particleAPIError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("particle API status %d: %s", e.StatusCode, e.Message)
+	}
+	return fmt.Sprintf("particle API status %d", e.StatusCode)
+}
+
 // checkDeviceReadiness checks if a device has valid firmware by reading deviceInfo variable
-func checkDeviceReadiness(particleID, token string) (isReady bool, firmwareVersion, platform string) {
-	deviceInfo, err := getParticleVariable(particleID, "deviceInfo", token)
+func checkDeviceReadiness(ctx context.Context, particleID, token string) shared.DeviceReadiness {
+	deviceInfo, err := getParticleVariableWithContext(ctx, particleID, "deviceInfo", token)
+	return deviceInfoReadiness(particleID, deviceInfo, err)
+}
+
+// deviceInfoReadiness classifies the result of reading deviceInfo. Particle
+// answers 404 when the firmware doesn't register the variable and 408 when
+// the device doesn't respond; anything else is a failed check, not a verdict
+// on the device.
+func deviceInfoReadiness(particleID, deviceInfo string, err error) shared.DeviceReadiness {
 	if err != nil {
 		log.Printf("Device %s: could not read deviceInfo variable: %v", particleID, err)
-		return false, "", ""
+		var apiErr *particleAPIError
+		switch {
+		case errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound:
+			return shared.DeviceReadiness{Status: shared.ReadinessNoFirmwareVariable, Message: err.Error()}
+		case errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusRequestTimeout:
+			return shared.DeviceReadiness{Status: shared.ReadinessOffline, Message: err.Error()}
+		default:
+			return shared.DeviceReadiness{Status: shared.ReadinessTransientError, Message: err.Error()}
+		}
 	}
 
-	// deviceInfo format: "version|platform|maxStrips|maxLeds"
+	// deviceInfo format: "version|platform|maxStrips|maxLeds|maxColors|freeMem"
 	parts := strings.Split(deviceInfo, "|")
-	if len(parts) >= 2 {
-		log.Printf("Device %s: firmware=%s, platform=%s", particleID, parts[0], parts[1])
-		return true, parts[0], parts[1]
+	if len(parts) < 2 {
+		log.Printf("WARN: device %s deviceInfo %q missing platform field", particleID, deviceInfo)
+		return shared.DeviceReadiness{Status: shared.ReadinessNoFirmwareVariable, Message: "deviceInfo is missing the platform field"}
+	}
+
+	firmwareVersion := strings.TrimSpace(parts[0])
+	platform := strings.TrimSpace(parts[1])
+	if firmwareVersion == "" || platform == "" {
+		log.Printf("WARN: device %s deviceInfo %q has empty version or platform", particleID, deviceInfo)
+		return shared.DeviceReadiness{Status: shared.ReadinessNoFirmwareVariable, Message: "deviceInfo has an empty version or platform"}
+	}
+
+	// Older firmware doesn't report free memory; the platform default is used then
+	freeMemory, _ := shared.ParseDeviceInfoFreeMemory(deviceInfo)
+	maxStrips, maxLEDs := shared.ParseDeviceInfoLimits(deviceInfo)
+
+	log.Printf("Device %s: firmware=%s, platform=%s, freeMemory=%d, maxStrips=%d, maxLeds=%d",
+		particleID, firmwareVersion, platform, freeMemory, maxStrips, maxLEDs)
+	return shared.DeviceReadiness{
+		Status:          shared.ReadinessReady,
+		FirmwareVersion: firmwareVersion,
+		Platform:        platform,
+		FreeMemory:      freeMemory,
+		MaxStrips:       maxStrips,
+		MaxLEDs:         maxLEDs,
+	}
+}
+
+// getDeviceCapabilities lists the cloud functions a device's firmware
+// registers, plus shared.CommandSeqCapability when it has that variable, or
+// nil if the device info can't be read
+func getDeviceCapabilities(ctx context.Context, particleID, token string) []string {
+	info, err := getParticleDeviceInfo(ctx, particleID, token)
+	if err != nil {
+		log.Printf("Device %s: could not read device info for capabilities: %v", particleID, err)
+		return nil
+	}
+
+	functions, _ := info["functions"].([]interface{})
+	capabilities := make([]string, 0, len(functions))
+	for _, fn := range functions {
+		if name, ok := fn.(string); ok {
+			capabilities = append(capabilities, name)
+		}
+	}
+	// Firmware that honours strip command sequences echoes them in lastSeq
+	if variables, ok := info["variables"].(map[string]interface{}); ok {
+		if _, ok := variables[shared.CommandSeqCapability]; ok {
+			capabilities = append(capabilities, shared.CommandSeqCapability)
+		}
 	}
+	return capabilities
+}
 
-	return false, "", ""
+// stripParseWarning describes a strips variable entry that could not be parsed
+type stripParseWarning struct {
+	Index   int    `json:"index"`   // Position of the entry in the variable
+	Entry   string `json:"entry"`   // Raw entry text
+	Message string `json:"message"` // Why it failed
+}
+
+// stripFields names the colon-separated fields of a strips entry in order.
+// The first three are required; the rest were added in firmware v2.2.0.
+var stripFields = []string{"pin", "ledCount", "pattern", "brightness", "speed", "colorCount"}
+
+const requiredStripFields = 3
+
+// parseStripsVariable parses the firmware strips variable,
+// "D{pin}:{ledCount}:{pattern}:{brightness}:{speed}:{colorCount}" entries
+// separated by ";". Each strip is keyed by field name, with the pin reported
+// as "physicalPin". Entries missing a required field or with a non-numeric
+// required field are dropped with a warning; bad optional fields are omitted
+// with a warning. Empty entries (e.g. a trailing ";") are ignored.
+func parseStripsVariable(raw string) ([]map[string]interface{}, []stripParseWarning) {
+	strips := []map[string]interface{}{}
+	warnings := []stripParseWarning{}
+
+	if strings.TrimSpace(raw) == "" {
+		return strips, warnings
+	}
+
+	for index, entry := range strings.Split(raw, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		warn := func(format string, args ...interface{}) {
+			warnings = append(warnings, stripParseWarning{
+				Index:   index,
+				Entry:   entry,
+				Message: fmt.Sprintf("entry '%s' ", entry) + fmt.Sprintf(format, args...),
+			})
+		}
+
+		parts := strings.Split(entry, ":")
+		if len(parts) < requiredStripFields {
+			warn("missing %s field", stripFields[len(parts)])
+			continue
+		}
+		if len(parts) > len(stripFields) {
+			warn("has %d fields, expected at most %d; extra fields ignored", len(parts), len(stripFields))
+			parts = parts[:len(stripFields)]
+		}
+
+		strip := map[string]interface{}{}
+		valid := true
+		for i, part := range parts {
+			field := stripFields[i]
+			value := strings.TrimSpace(part)
+			if i == 0 {
+				// Pin is reported as "D6"; accept a bare number too
+				value = strings.TrimPrefix(value, "D")
+			}
+
+			if value == "" {
+				if i < requiredStripFields {
+					warn("missing %s field", field)
+					valid = false
+					break
+				}
+				warn("has empty %s field", field)
+				continue
+			}
+
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				warn("has non-numeric %s '%s'", field, part)
+				if i < requiredStripFields {
+					valid = false
+					break
+				}
+				continue
+			}
+
+			if field == "pin" {
+				strip["physicalPin"] = n
+			} else {
+				strip[field] = n
+			}
+		}
+
+		if valid {
+			strips = append(strips, strip)
+		}
+	}
+
+	return strips, warnings
 }
 
 // safeTokenDisplay returns the first N characters of a token for logging
@@ -928,18 +1341,46 @@ func handleValidateToken(ctx context.Context, username string, request events.AP
 	log.Printf("Validating token (first 10 chars): %s...", safeTokenDisplay(req.ParticleToken))
 
 	// Try to get devices from Particle API to validate the token
-	devices, err := getParticleDevices(req.ParticleToken)
+	devices, err := shared.ListParticleDevices(ctx, req.ParticleToken)
 	if err != nil {
 		log.Printf("Token validation failed: %v", err)
+		if resp, ok := shared.TimeoutErrorResponse(err); ok {
+			return resp, nil
+		}
 		return shared.CreateErrorResponse(401, "Invalid Particle token"), nil
 	}
 
 	log.Printf("Token validation successful! Found %d devices", len(devices))
 
-	return shared.CreateSuccessResponse(200, map[string]interface{}{
-		"message": fmt.Sprintf("Token is valid! Found %d device(s)", len(devices)),
-		"devices": len(devices),
-	}), nil
+	// Listing devices only needs read access; the token info says whether
+	// the token can also call functions, and when it expires. A null
+	// expiresAt means the token doesn't expire.
+	response := map[string]interface{}{
+		"valid":       true,
+		"deviceCount": len(devices),
+		"devices":     len(devices),
+		"expiresAt":   nil,
+	}
+	message := fmt.Sprintf("Token is valid! Found %d device(s)", len(devices))
+
+	info, err := shared.GetParticleTokenInfo(ctx, req.ParticleToken)
+	if err != nil {
+		log.Printf("Failed to get token info: %v", err)
+		response["canCallFunctions"] = nil
+		message += "; couldn't check its expiry or scopes"
+	} else {
+		response["expiresAt"] = info.ExpiresAt
+		response["canCallFunctions"] = info.CanCallFunctions()
+		if !info.CanCallFunctions() {
+			message += ", but it can't call device functions, so patterns can't be sent"
+		}
+		if info.ExpiresAt != nil {
+			message += fmt.Sprintf(". It expires %s", info.ExpiresAt.UTC().Format("Jan 2, 2006"))
+		}
+	}
+	response["message"] = message
+
+	return shared.CreateSuccessResponse(200, response), nil
 }
 
 func handleOAuthInitiate(ctx context.Context, username string) (events.APIGatewayProxyResponse, error) {
@@ -972,15 +1413,19 @@ func handleOAuthInitiate(ctx context.Context, username string) (events.APIGatewa
 func findDeviceByParticleID(ctx context.Context, username, particleID string) (*shared.Device, error) {
 	log.Printf("=== findDeviceByParticleID: username=%s, particleID=%s ===", username, particleID)
 
-	// Scan the devices table for a device with this Particle ID and user ID
+	// Only the user's own devices can match, so read just their partition
+	indexName := "userId-index"
+	expressionValues := map[string]types.AttributeValue{
+		":userId": &types.AttributeValueMemberS{Value: username},
+	}
 	var devices []shared.Device
-	if err := shared.Scan(ctx, devicesTable, &devices); err != nil {
-		log.Printf("Failed to scan devices table: %v", err)
+	if err := shared.Query(ctx, devicesTable, &indexName, "userId = :userId", expressionValues, &devices); err != nil {
+		log.Printf("Failed to query devices table: %v", err)
 		return nil, err
 	}
 
 	for _, device := range devices {
-		if device.UserID == username && device.ParticleID == particleID {
+		if device.ParticleID == particleID {
 			log.Printf("Found existing device: deviceID=%s, particleID=%s", device.DeviceID, device.ParticleID)
 			return &device, nil
 		}
@@ -991,5 +1436,5 @@ func findDeviceByParticleID(ctx context.Context, username, particleID string) (*
 }
 
 func main() {
-	lambda.Start(handler)
+	lambda.Start(handleEvent)
 }
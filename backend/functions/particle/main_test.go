@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"candle-lights/backend/shared"
+)
+
+func TestParseStripsVariable(t *testing.T) {
+	tests := []struct {
+		name       string
+		raw        string
+		wantStrips []map[string]interface{}
+		wantWarns  int
+	}{
+		{"empty", "", []map[string]interface{}{}, 0},
+		{
+			"full entries and trailing separator",
+			"D6:8:1:128:50:2;D2:12:5:255:30:1;",
+			[]map[string]interface{}{
+				{"physicalPin": 6, "ledCount": 8, "pattern": 1, "brightness": 128, "speed": 50, "colorCount": 2},
+				{"physicalPin": 2, "ledCount": 12, "pattern": 5, "brightness": 255, "speed": 30, "colorCount": 1},
+			},
+			0,
+		},
+		{
+			"pre-2.2.0 entry without optional fields",
+			"6:8:1",
+			[]map[string]interface{}{{"physicalPin": 6, "ledCount": 8, "pattern": 1}},
+			0,
+		},
+		{
+			"missing required field drops the entry",
+			"D6:8;D2:12:5",
+			[]map[string]interface{}{{"physicalPin": 2, "ledCount": 12, "pattern": 5}},
+			1,
+		},
+		{
+			"non-numeric required field drops the entry",
+			"D6:eight:1",
+			[]map[string]interface{}{},
+			1,
+		},
+		{
+			"bad optional field is omitted",
+			"D6:8:1:bright:50",
+			[]map[string]interface{}{{"physicalPin": 6, "ledCount": 8, "pattern": 1, "speed": 50}},
+			1,
+		},
+		{
+			"extra fields are ignored",
+			"D6:8:1:128:50:2:9",
+			[]map[string]interface{}{{"physicalPin": 6, "ledCount": 8, "pattern": 1, "brightness": 128, "speed": 50, "colorCount": 2}},
+			1,
+		},
+	}
+
+	for _, tt := range tests {
+		strips, warnings := parseStripsVariable(tt.raw)
+		if !reflect.DeepEqual(strips, tt.wantStrips) {
+			t.Errorf("%s: strips = %v, want %v", tt.name, strips, tt.wantStrips)
+		}
+		if len(warnings) != tt.wantWarns {
+			t.Errorf("%s: got %d warnings %+v, want %d", tt.name, len(warnings), warnings, tt.wantWarns)
+		}
+	}
+}
+
+func TestParseStripsVariableWarningIndex(t *testing.T) {
+	_, warnings := parseStripsVariable("D6:8:1;D2:x:5")
+	if len(warnings) != 1 {
+		t.Fatalf("got %d warnings, want 1", len(warnings))
+	}
+	if w := warnings[0]; w.Index != 1 || w.Entry != "D2:x:5" {
+		t.Errorf("warning = %+v, want index 1 for entry D2:x:5", w)
+	}
+}
+
+func TestDispatchPatternByManufacturer(t *testing.T) {
+	// An oversized pattern fails the Particle path's memory check before
+	// anything is sent, which tells it apart from the other transports
+	pattern := shared.Pattern{Name: "red", WLEDState: `{"on":true,"bri":128,"seg":[{"fx":0,"col":[[255,0,0]]}]}`}
+	strip := shared.LEDStrip{Pin: 6, LEDCount: 300}
+
+	tests := []struct {
+		manufacturer string
+		check        func(err error) bool
+		want         string
+	}{
+		{"", isMemoryLimit, "the Particle path"},
+		{shared.ManufacturerParticle, isMemoryLimit, "the Particle path"},
+		{shared.ManufacturerWLED, func(err error) bool { return errors.Is(err, ErrNotImplemented) }, "ErrNotImplemented"},
+		{"esp-home", func(err error) bool { return err != nil && strings.Contains(err.Error(), "unknown manufacturer") }, "an unknown manufacturer error"},
+	}
+	for _, tt := range tests {
+		device := shared.Device{
+			DeviceID:        "dispatch-" + tt.manufacturer,
+			Name:            "garage",
+			ParticleID:      "p1",
+			Manufacturer:    tt.manufacturer,
+			FirmwareVersion: "v3.0.0",
+			FreeMemory:      1,
+			LEDStrips:       []shared.LEDStrip{strip},
+		}
+		if _, _, err := dispatchPattern(context.Background(), device, pattern, "token"); !tt.check(err) {
+			t.Errorf("dispatchPattern(%q) = %v, want %s", tt.manufacturer, err, tt.want)
+		}
+		if tt.manufacturer == shared.ManufacturerWLED {
+			if _, _, err := dispatchPatternToStrip(context.Background(), device, strip, nil, false, pattern, "token"); !tt.check(err) {
+				t.Errorf("dispatchPatternToStrip(%q) = %v, want %s", tt.manufacturer, err, tt.want)
+			}
+		}
+	}
+}
+
+func isMemoryLimit(err error) bool {
+	var memErr *shared.MemoryLimitError
+	return errors.As(err, &memErr)
+}
+
+// TestDocumentedRoutesAreRouted checks shared.APIRoutes against the router:
+// every documented particle route reaches its auth check rather than a 404
+func TestDocumentedRoutesAreRouted(t *testing.T) {
+	param := regexp.MustCompile(`\{([^}]+)\}`)
+	found := 0
+	for _, doc := range shared.APIRoutes {
+		if doc.Service != "particle" {
+			continue
+		}
+		found++
+		request := events.APIGatewayProxyRequest{HTTPMethod: doc.Method, PathParameters: map[string]string{}}
+		request.Path = param.ReplaceAllStringFunc(doc.Path, func(name string) string {
+			request.PathParameters[name[1:len(name)-1]] = "x"
+			return "x"
+		})
+		resp, err := router.Dispatch(context.Background(), request)
+		if err != nil || resp.StatusCode != 401 {
+			t.Errorf("%s %s without a session = %d, %v; want 401", doc.Method, doc.Path, resp.StatusCode, err)
+		}
+	}
+	if found == 0 {
+		t.Error("no particle routes in shared.APIRoutes")
+	}
+}
+
+func TestDeviceInfoReadinessKeepsLimits(t *testing.T) {
+	tests := []struct {
+		deviceInfo           string
+		wantStrips, wantLEDs int
+	}{
+		{"3.1.0|argon|4|300|16|41000", 4, 300},
+		{"2.4.0|photon", 0, 0}, // Older firmware; the ceiling applies
+	}
+	for _, tt := range tests {
+		readiness := deviceInfoReadiness("p1", tt.deviceInfo, nil)
+		if readiness.Status != shared.ReadinessReady || readiness.MaxStrips != tt.wantStrips || readiness.MaxLEDs != tt.wantLEDs {
+			t.Errorf("%q: %+v, want ready with maxStrips %d, maxLeds %d", tt.deviceInfo, readiness, tt.wantStrips, tt.wantLEDs)
+		}
+	}
+}
+
+// commandStore answers lookups of lee, with a plaintext Particle token, and
+// their device d1
+func commandStore(call shared.DynamoDBStubCall) (map[string]interface{}, error) {
+	if call.Operation != "GetItem" {
+		return nil, nil
+	}
+	var key map[string]string
+	if err := call.Unmarshal("Key", &key); err != nil {
+		return nil, err
+	}
+	switch {
+	case key["username"] == "lee":
+		return map[string]interface{}{"Item": shared.DynamoDBStubItem(shared.User{Username: "lee", IsActive: true, ParticleToken: "particle-token"})}, nil
+	case key["deviceId"] == "d1":
+		return map[string]interface{}{"Item": shared.DynamoDBStubItem(shared.Device{DeviceID: "d1", UserID: "lee", Name: "garage", ParticleID: "p1", FirmwareVersion: "2.4.0"})}, nil
+	}
+	return nil, nil
+}
+
+func TestSendCommandRetriesTransientFailures(t *testing.T) {
+	tests := []struct {
+		name         string
+		statuses     []int // Particle's answers in turn, then 200
+		wantStatus   int
+		wantAttempts int
+		wantErr      string
+	}{
+		{"first try", nil, 200, 1, ""},
+		{"one 502", []int{502}, 200, 2, ""},
+		{"502 then 503", []int{502, 503}, 200, 3, ""},
+		{"5xx every time", []int{502, 503, 500}, 500, 3, "(after 3 attempts)"},
+		{"invalid token", []int{401}, 500, 1, "status 401: invalid_token"},
+	}
+	defer shared.StubDynamoDB(commandStore)()
+	for _, tt := range tests {
+		var requests atomic.Int32
+		restore := shared.StubParticleAPI(func(w http.ResponseWriter, r *http.Request) {
+			if n := int(requests.Add(1)); n <= len(tt.statuses) {
+				w.WriteHeader(tt.statuses[n-1])
+				w.Write([]byte(`{"error":"invalid_token"}`))
+				return
+			}
+			w.Write([]byte(`{"return_value":1}`))
+		})
+		resp, err := handleSendCommand(context.Background(), "lee", events.APIGatewayProxyRequest{
+			Body: `{"deviceId":"d1","command":"setPattern","argument":"6,1"}`,
+		})
+		restore()
+
+		var body struct {
+			Data struct {
+				Attempts int `json:"attempts"`
+			} `json:"data"`
+			Error string `json:"error"`
+		}
+		json.Unmarshal([]byte(resp.Body), &body)
+		if err != nil || resp.StatusCode != tt.wantStatus || int(requests.Load()) != tt.wantAttempts {
+			t.Errorf("%s: status %d, %v after %d requests; want %d after %d",
+				tt.name, resp.StatusCode, err, requests.Load(), tt.wantStatus, tt.wantAttempts)
+		}
+		if tt.wantStatus == 200 && body.Data.Attempts != tt.wantAttempts {
+			t.Errorf("%s: response reports %d attempts, want %d", tt.name, body.Data.Attempts, tt.wantAttempts)
+		}
+		if !strings.Contains(body.Error, tt.wantErr) || (tt.wantAttempts == 1 && strings.Contains(body.Error, "attempts")) {
+			t.Errorf("%s: error %q, want it to contain %q", tt.name, body.Error, tt.wantErr)
+		}
+	}
+}
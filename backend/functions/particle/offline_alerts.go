@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+	_ "time/tzdata" // Quiet hours timezones
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2"
+	sestypes "github.com/aws/aws-sdk-go-v2/service/sesv2/types"
+	"github.com/google/uuid"
+
+	"candle-lights/backend/shared"
+)
+
+var (
+	notificationFromEmail = os.Getenv("NOTIFICATION_FROM_EMAIL")
+	sesClient             *sesv2.Client
+)
+
+// handleScheduledOfflineCheck runs on the refresh schedule. For every user with
+// offline alerts enabled it updates device online state from Particle and
+// sends at most one offline alert per offline episode, plus a recovery alert
+// when the device reconnects.
+func handleScheduledOfflineCheck(ctx context.Context) error {
+	log.Printf("=== Scheduled offline check ===")
+
+	// Every user has to be checked, so this scans the whole table
+	var users []shared.User
+	if err := shared.Scan(ctx, usersTable, &users); err != nil {
+		return fmt.Errorf("failed to scan users: %v", err)
+	}
+
+	checked := 0
+	for _, user := range users {
+		if user.NotificationSettings == nil || !user.NotificationSettings.OfflineAlerts || user.ParticleToken == "" {
+			continue
+		}
+		if err := shared.DecryptParticleToken(ctx, usersTable, &user); err != nil {
+			log.Printf("Offline check skipped for user %s: %v", user.Username, err)
+			continue
+		}
+		if err := checkUserDevicesOffline(ctx, user); err != nil {
+			log.Printf("Offline check failed for user %s: %v", user.Username, err)
+			continue
+		}
+		checked++
+	}
+
+	log.Printf("Offline check complete: %d users checked", checked)
+	return nil
+}
+
+// checkUserDevicesOffline refreshes one user's devices and alerts on changes
+func checkUserDevicesOffline(ctx context.Context, user shared.User) error {
+	particleDevices, err := shared.ListParticleDevices(ctx, user.ParticleToken)
+	if err != nil {
+		return fmt.Errorf("failed to get devices from Particle: %v", err)
+	}
+
+	type particleStatus struct {
+		connected bool
+		lastHeard time.Time
+	}
+	statuses := make(map[string]particleStatus, len(particleDevices))
+	for _, dev := range particleDevices {
+		id, _ := dev["id"].(string)
+		connected, _ := dev["connected"].(bool)
+		status := particleStatus{connected: connected}
+		if lastHeard, ok := dev["last_heard"].(string); ok {
+			status.lastHeard, _ = time.Parse(time.RFC3339, lastHeard)
+		}
+		statuses[id] = status
+	}
+
+	indexName := "userId-index"
+	expressionValues := map[string]types.AttributeValue{
+		":userId": &types.AttributeValueMemberS{Value: user.Username},
+	}
+
+	var devices []shared.Device
+	if err := shared.Query(ctx, devicesTable, &indexName, "userId = :userId", expressionValues, &devices); err != nil {
+		return fmt.Errorf("failed to query devices: %v", err)
+	}
+
+	settings := *user.NotificationSettings
+	now := time.Now()
+	quiet := settings.InQuietHours(now)
+
+	for _, device := range devices {
+		status, ok := statuses[device.ParticleID]
+		if !ok || device.IsHidden {
+			continue
+		}
+
+		changed := device.IsOnline != status.connected
+		device.IsOnline = status.connected
+		if status.lastHeard.After(device.LastSeen) {
+			device.LastSeen = status.lastHeard
+			changed = true
+		}
+
+		// Alerts during quiet hours are held, not dropped: state is left
+		// unchanged so the next check after quiet hours sends them
+		switch {
+		case !device.IsOnline && device.OfflineAlertSentAt == nil && now.Sub(device.LastSeen) >= settings.Threshold():
+			if quiet {
+				log.Printf("Device %s offline but in quiet hours; holding alert", device.DeviceID)
+				break
+			}
+			if err := notifyUser(ctx, user, device, shared.NotificationDeviceOffline); err != nil {
+				log.Printf("Failed to send offline alert for device %s: %v", device.DeviceID, err)
+				break
+			}
+			sentAt := now
+			device.OfflineAlertSentAt = &sentAt
+			device.OfflineAlertCount++
+			changed = true
+		case device.IsOnline && device.OfflineAlertSentAt != nil:
+			if quiet {
+				log.Printf("Device %s recovered but in quiet hours; holding alert", device.DeviceID)
+				break
+			}
+			if err := notifyUser(ctx, user, device, shared.NotificationDeviceRecovered); err != nil {
+				log.Printf("Failed to send recovery alert for device %s: %v", device.DeviceID, err)
+				break
+			}
+			device.OfflineAlertSentAt = nil
+			changed = true
+		}
+
+		if changed {
+			device.UpdatedAt = now
+			if err := shared.PutItem(ctx, devicesTable, device); err != nil {
+				log.Printf("Failed to save device %s: %v", device.DeviceID, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// notifyUser emails the alert, or stores it as an in-app notification when the
+// user has no email address or email isn't configured
+func notifyUser(ctx context.Context, user shared.User, device shared.Device, notificationType string) error {
+	alert := shared.BuildDeviceAlert(notificationType, device.Name, device.LastSeen)
+
+	if user.Email != "" && notificationFromEmail != "" {
+		err := sendAlertEmail(ctx, user.Email, alert)
+		if err == nil {
+			log.Printf("Sent %s email for device %s to user %s", notificationType, device.DeviceID, user.Username)
+			return nil
+		}
+		log.Printf("Failed to email user %s, falling back to in-app notification: %v", user.Username, err)
+	}
+
+	notification := &shared.Notification{
+		NotificationID: uuid.New().String(),
+		UserID:         user.Username,
+		Type:           notificationType,
+		DeviceID:       device.DeviceID,
+		Title:          alert.Subject,
+		Message:        alert.Text,
+	}
+	if err := shared.CreateNotification(ctx, notification); err != nil {
+		return err
+	}
+	log.Printf("Stored %s notification for device %s for user %s", notificationType, device.DeviceID, user.Username)
+	return nil
+}
+
+func sendAlertEmail(ctx context.Context, to string, alert shared.AlertEmail) error {
+	if sesClient == nil {
+		cfg, err := config.LoadDefaultConfig(ctx)
+		if err != nil {
+			return err
+		}
+		sesClient = sesv2.NewFromConfig(cfg)
+	}
+
+	_, err := sesClient.SendEmail(ctx, &sesv2.SendEmailInput{
+		FromEmailAddress: aws.String(notificationFromEmail),
+		Destination: &sestypes.Destination{
+			ToAddresses: []string{to},
+		},
+		Content: &sestypes.EmailContent{
+			Simple: &sestypes.Message{
+				Subject: &sestypes.Content{Data: aws.String(alert.Subject)},
+				Body: &sestypes.Body{
+					Text: &sestypes.Content{Data: aws.String(alert.Text)},
+					Html: &sestypes.Content{Data: aws.String(alert.HTML)},
+				},
+			},
+		},
+	})
+	return err
+}
+
+// handleEvent dispatches scheduled offline checks, queued device refreshes,
+// and API Gateway requests, which share this function
+func handleEvent(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	var probe struct {
+		Source  string `json:"source"`
+		Records []struct {
+			EventSourceARN string `json:"eventSourceARN"`
+		} `json:"Records"`
+	}
+	if err := json.Unmarshal(raw, &probe); err == nil && probe.Source == "aws.events" {
+		defer shared.FlushMetrics(ctx)
+		return nil, handleScheduledOfflineCheck(ctx)
+	}
+	if len(probe.Records) > 0 && refreshJobQueueARN != "" && probe.Records[0].EventSourceARN == refreshJobQueueARN {
+		defer shared.FlushMetrics(ctx)
+
+		var event events.SQSEvent
+		if err := json.Unmarshal(raw, &event); err != nil {
+			return nil, err
+		}
+		return handleRefreshJobMessages(ctx, event), nil
+	}
+
+	var request events.APIGatewayProxyRequest
+	if err := json.Unmarshal(raw, &request); err != nil {
+		return nil, err
+	}
+	return shared.WithMetrics("particle", shared.WithSessionRotation(shared.WithActivityLog(handler)))(ctx, request)
+}
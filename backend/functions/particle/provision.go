@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/google/uuid"
+
+	"candle-lights/backend/shared"
+)
+
+// provisionVariableTimeout bounds each firmware variable read during
+// provisioning, so a slow device can't hold up saving its record
+const provisionVariableTimeout = 8 * time.Second
+
+// ProvisionRequest is the optional body of POST /api/particle/devices/{particleId}/provision.
+// API Gateway names the path parameter deviceId, as sibling routes must share
+// a name, but it carries the Particle device ID.
+type ProvisionRequest struct {
+	Name *string `json:"name,omitempty"`
+	Room *string `json:"room,omitempty"`
+}
+
+// ProvisionReport describes what provisioning did for one device
+type ProvisionReport struct {
+	Device        shared.Device       `json:"device"`
+	Created       bool                `json:"created"` // false when an existing record was updated
+	IsOnline      bool                `json:"isOnline"`
+	IsReady       bool                `json:"isReady"`
+	StripsFound   int                 `json:"stripsFound"`
+	Warnings      []string            `json:"warnings"`
+	MissingSteps  []string            `json:"missingSteps"` // Steps that didn't complete; re-run provisioning to retry them
+	ParseWarnings []stripParseWarning `json:"parseWarnings,omitempty"`
+}
+
+// handleProvisionDevice sets up a Particle device in one call: it checks the
+// device is visible with the user's token, creates or updates its record,
+// reads the firmware variables and fills in LED strips from them. Steps that
+// fail after the device is found are listed in the report instead of failing
+// the call, so the device is always saved.
+func handleProvisionDevice(ctx context.Context, username, particleID string, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	log.Printf("=== handleProvisionDevice: user=%s, particleID=%s ===", username, particleID)
+
+	var provisionReq ProvisionRequest
+	if body := shared.GetRequestBody(request); strings.TrimSpace(body) != "" {
+		if err := json.Unmarshal([]byte(body), &provisionReq); err != nil {
+			return shared.CreateErrorResponse(400, "Invalid request body"), nil
+		}
+	}
+
+	var room *string
+	if provisionReq.Room != nil {
+		normalized := shared.NormalizeRoom(*provisionReq.Room)
+		if len(normalized) > shared.MaxRoomNameLength {
+			return shared.CreateErrorResponse(400, "Room name is too long"), nil
+		}
+		room = &normalized
+	}
+
+	// A blank name keeps the device's current name
+	var name string
+	if provisionReq.Name != nil && shared.NormalizeName(*provisionReq.Name) != "" {
+		validated, err := shared.ValidateName("device", *provisionReq.Name)
+		if err != nil {
+			return shared.CreateErrorResponse(400, err.Error()), nil
+		}
+		name = validated
+	}
+
+	userKey, _ := attributevalue.MarshalMap(map[string]string{
+		"username": username,
+	})
+
+	var user shared.User
+	if err := shared.GetItem(ctx, usersTable, userKey, &user); err != nil {
+		return shared.CreateErrorResponse(500, "Database error"), nil
+	}
+
+	if err := shared.DecryptParticleToken(ctx, usersTable, &user); err != nil {
+		log.Printf("Failed to decrypt Particle token for %s: %v", username, err)
+		return shared.CreateErrorResponse(500, "Failed to read Particle token"), nil
+	}
+
+	if user.ParticleToken == "" {
+		return shared.CreateErrorResponse(400, "Particle token not configured"), nil
+	}
+
+	// The device must be visible with the user's token before anything is saved
+	info, err := getParticleDeviceInfo(ctx, particleID, user.ParticleToken)
+	if err != nil {
+		log.Printf("Provision: device %s not visible to user %s: %v", particleID, username, err)
+		return shared.CreateErrorResponse(404, "Device not found in your Particle account"), nil
+	}
+
+	existing, err := findDeviceByParticleID(ctx, username, particleID)
+	if err != nil {
+		return shared.CreateErrorResponse(500, "Database error"), nil
+	}
+
+	report, err := provisionParticleDevice(ctx, user, particleID, info, existing, name, room)
+	if err != nil {
+		return shared.CreateErrorResponse(500, "Failed to save device"), nil
+	}
+
+	status := 200
+	if report.Created {
+		status = 201
+	}
+	return shared.CreateSuccessResponse(status, report), nil
+}
+
+// provisionParticleDevice creates or updates the record for a device
+// Particle reported as info, reading its firmware variables when it's online.
+// An empty name keeps the existing name, falling back to Particle's; a nil
+// room leaves the room alone. Only saving the record can fail.
+func provisionParticleDevice(ctx context.Context, user shared.User, particleID string, info map[string]interface{}, existing *shared.Device, name string, room *string) (ProvisionReport, error) {
+	username := user.Username
+	report := ProvisionReport{
+		Warnings:     []string{},
+		MissingSteps: []string{},
+	}
+
+	connected, _ := info["connected"].(bool)
+	report.IsOnline = connected
+
+	now := time.Now()
+	var device shared.Device
+	if existing != nil {
+		device = *existing
+	} else {
+		report.Created = true
+		device = shared.Device{
+			DeviceID:   uuid.New().String(),
+			UserID:     username,
+			ParticleID: particleID,
+			CreatedAt:  now,
+		}
+	}
+
+	switch {
+	case name != "":
+		device.SetName(name)
+	case device.Name == "":
+		particleName, _ := info["name"].(string)
+		if particleName = shared.NormalizeName(particleName); particleName == "" {
+			particleName = particleID
+		}
+		device.SetName(particleName)
+	}
+	if room != nil {
+		device.Room = *room
+	}
+
+	device.IsOnline = connected
+	if functions, ok := info["functions"].([]interface{}); ok && len(functions) > 0 {
+		capabilities := make([]string, 0, len(functions))
+		for _, fn := range functions {
+			if name, ok := fn.(string); ok {
+				capabilities = append(capabilities, name)
+			}
+		}
+		device.Capabilities = capabilities
+	}
+
+	if connected {
+		device.LastSeen = now
+		provisionFromVariables(ctx, &device, user.ParticleToken, &report)
+	} else {
+		device.ApplyReadiness(shared.DeviceReadiness{Status: shared.ReadinessOffline}, now)
+		report.Warnings = append(report.Warnings, "Device is offline; firmware details and strips were not read")
+		report.MissingSteps = append(report.MissingSteps, "deviceInfo", "strips")
+	}
+	device.UpdatedAt = now
+
+	if err := shared.PutItem(ctx, devicesTable, device); err != nil {
+		log.Printf("Provision: failed to save device %s: %v", device.DeviceID, err)
+		return report, err
+	}
+	// Provisioning can change the strips, readiness, name and room Alexa sees
+	shared.RefreshAlexaDiscovery(ctx, username)
+
+	report.Device = device
+	report.IsReady = device.IsReady
+	report.StripsFound = len(device.LEDStrips)
+
+	log.Printf("Provision: %s device %s (created=%v, ready=%v, strips=%d, missing=%v)",
+		username, device.DeviceID, report.Created, report.IsReady, report.StripsFound, report.MissingSteps)
+	return report, nil
+}
+
+// provisionFromVariables reads the firmware variables into device, recording
+// anything that couldn't be read in report. Strips already on the device keep
+// their assigned patterns when the firmware reports the same pin.
+func provisionFromVariables(ctx context.Context, device *shared.Device, token string, report *ProvisionReport) {
+	vars := readDeviceVariables(ctx, *device, token, provisionVariableTimeout)
+
+	readiness, _ := vars["readiness"].(shared.DeviceReadiness)
+	device.ApplyReadiness(readiness, time.Now())
+	if readiness.Status != shared.ReadinessReady {
+		// Firmware details from an earlier provision are kept rather than cleared
+		report.MissingSteps = append(report.MissingSteps, "deviceInfo")
+		switch readiness.Status {
+		case shared.ReadinessNoFirmwareVariable:
+			report.Warnings = append(report.Warnings, "Could not read deviceInfo; the device may not be running candle-lights firmware")
+		default:
+			report.Warnings = append(report.Warnings, "Could not reach the device to read deviceInfo; try again shortly")
+		}
+	}
+
+	if _, read := vars["stripsRaw"]; !read {
+		report.MissingSteps = append(report.MissingSteps, "strips")
+		report.Warnings = append(report.Warnings, "Could not read strips; existing strip configuration was left as is")
+		return
+	}
+
+	strips, _ := vars["strips"].([]map[string]interface{})
+	if warnings, ok := vars["parseWarnings"].([]stripParseWarning); ok && len(warnings) > 0 {
+		report.ParseWarnings = warnings
+		for _, w := range warnings {
+			report.Warnings = append(report.Warnings, fmt.Sprintf("strips entry %d: %s", w.Index, w.Message))
+		}
+	}
+
+	patternByPin := make(map[int]string, len(device.LEDStrips))
+	for _, strip := range device.LEDStrips {
+		patternByPin[strip.Pin] = strip.PatternID
+	}
+
+	ledStrips := make([]shared.LEDStrip, 0, len(strips))
+	for _, strip := range strips {
+		pin, _ := strip["pin"].(int)
+		ledCount, _ := strip["ledCount"].(int)
+		ledStrips = append(ledStrips, shared.LEDStrip{
+			Pin:       pin,
+			LEDCount:  ledCount,
+			PatternID: patternByPin[pin],
+		})
+	}
+	if len(ledStrips) == 0 {
+		report.Warnings = append(report.Warnings, fmt.Sprintf("Firmware reports no LED strips configured; patterns will go to the default pin %s",
+			shared.PinLabel(device.PinDefaults().DefaultPin)))
+	}
+	// The firmware is already driving these pins, so they're kept, but the
+	// strips can't be saved from the device page until they're moved
+	if err := shared.ValidateStripPins(*device, ledStrips); err != nil {
+		report.Warnings = append(report.Warnings, fmt.Sprintf("Firmware strips don't match the platform's pins: %v", err))
+	}
+	if err := shared.ValidateStripLimits(*device, ledStrips); err != nil {
+		report.Warnings = append(report.Warnings, fmt.Sprintf("Firmware strips exceed a limit (%v); existing strip configuration was left as is", err))
+		return
+	}
+	device.LEDStrips = ledStrips
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"candle-lights/backend/shared"
+)
+
+// provisionAllConcurrency is how many devices provision-all sets up at once
+const provisionAllConcurrency = 4
+
+// newDeviceNamePrefix names devices provision-all creates: "New Device 1",
+// "New Device 2", ... skipping names already in use
+const newDeviceNamePrefix = "New Device "
+
+// Per-device outcomes of provision-all
+const (
+	provisionAllProvisioned    = "provisioned"
+	provisionAllWouldProvision = "wouldProvision" // dryRun
+	provisionAllSkipped        = "skipped"        // Already in the devices table
+	provisionAllFailed         = "failed"
+)
+
+// ProvisionAllRequest is the optional body of POST /api/particle/devices/provision-all
+type ProvisionAllRequest struct {
+	Room   *string `json:"room,omitempty"` // Room for every new device
+	DryRun bool    `json:"dryRun,omitempty"`
+}
+
+// ProvisionAllDevice is one Particle device's line in the provision-all
+// report
+type ProvisionAllDevice struct {
+	ParticleID   string           `json:"particleId"`
+	Status       string           `json:"status"`
+	Name         string           `json:"name"`                   // Name given, or that would be given, to a new device
+	DeviceID     string           `json:"deviceId,omitempty"`     // The record provisioned or skipped
+	ExistingName string           `json:"existingName,omitempty"` // skipped: the name it already has
+	IsOnline     bool             `json:"isOnline"`
+	Report       *ProvisionReport `json:"report,omitempty"` // provisioned only
+	Error        string           `json:"error,omitempty"`
+}
+
+// ProvisionAllResult is the provision-all response
+type ProvisionAllResult struct {
+	DryRun      bool                 `json:"dryRun"`
+	Provisioned int                  `json:"provisioned"` // With dryRun, how many would be
+	Skipped     int                  `json:"skipped"`
+	Failed      int                  `json:"failed"`
+	Devices     []ProvisionAllDevice `json:"devices"`
+}
+
+// handleProvisionAll provisions every device visible in the user's Particle
+// account that isn't in the devices table yet, as handleProvisionDevice
+// would, naming them "New Device N". Devices already present are reported
+// as skipped with their current names. With dryRun nothing is written.
+func handleProvisionAll(ctx context.Context, username string, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	log.Printf("=== handleProvisionAll: user=%s ===", username)
+
+	var provisionReq ProvisionAllRequest
+	if body := shared.GetRequestBody(request); strings.TrimSpace(body) != "" {
+		if err := json.Unmarshal([]byte(body), &provisionReq); err != nil {
+			return shared.CreateErrorResponse(400, "Invalid request body"), nil
+		}
+	}
+
+	var room *string
+	if provisionReq.Room != nil {
+		normalized := shared.NormalizeRoom(*provisionReq.Room)
+		if len(normalized) > shared.MaxRoomNameLength {
+			return shared.CreateErrorResponse(400, "Room name is too long"), nil
+		}
+		room = &normalized
+	}
+
+	userKey, _ := attributevalue.MarshalMap(map[string]string{
+		"username": username,
+	})
+
+	var user shared.User
+	if err := shared.GetItem(ctx, usersTable, userKey, &user); err != nil {
+		return shared.CreateErrorResponse(500, "Database error"), nil
+	}
+
+	if err := shared.DecryptParticleToken(ctx, usersTable, &user); err != nil {
+		log.Printf("Failed to decrypt Particle token for %s: %v", username, err)
+		return shared.CreateErrorResponse(500, "Failed to read Particle token"), nil
+	}
+
+	if user.ParticleToken == "" {
+		return shared.CreateErrorResponse(400, "Particle token not configured"), nil
+	}
+
+	particleDevices, err := shared.ListParticleDevices(ctx, user.ParticleToken)
+	if err != nil {
+		log.Printf("ProvisionAll: failed to get devices from Particle: %v", err)
+		if resp, ok := shared.TimeoutErrorResponse(err); ok {
+			return resp, nil
+		}
+		return shared.CreateErrorResponse(500, fmt.Sprintf("Failed to get devices from Particle: %v", err)), nil
+	}
+	sortParticleDevices(particleDevices)
+
+	indexName := "userId-index"
+	expressionValues := map[string]types.AttributeValue{
+		":userId": &types.AttributeValueMemberS{Value: username},
+	}
+	var devices []shared.Device
+	if err := shared.Query(ctx, devicesTable, &indexName, "userId = :userId", expressionValues, &devices); err != nil {
+		log.Printf("ProvisionAll: failed to get devices: %v", err)
+		return shared.CreateErrorResponse(500, "Failed to get devices"), nil
+	}
+	byParticleID := make(map[string]shared.Device, len(devices))
+	usedNames := make(map[string]bool, len(devices))
+	for _, device := range devices {
+		byParticleID[device.ParticleID] = device
+		usedNames[strings.ToLower(device.Name)] = true
+	}
+
+	result := ProvisionAllResult{DryRun: provisionReq.DryRun, Devices: make([]ProvisionAllDevice, 0, len(particleDevices))}
+	var pending []int
+	next := 1
+	for _, particleDev := range particleDevices {
+		particleID, _ := particleDev["id"].(string)
+		if particleID == "" {
+			continue
+		}
+		connected, _ := particleDev["connected"].(bool)
+		line := ProvisionAllDevice{ParticleID: particleID, IsOnline: connected}
+
+		if existing, ok := byParticleID[particleID]; ok {
+			line.Status = provisionAllSkipped
+			line.DeviceID = existing.DeviceID
+			line.ExistingName = existing.Name
+			result.Devices = append(result.Devices, line)
+			continue
+		}
+
+		for usedNames[strings.ToLower(fmt.Sprintf("%s%d", newDeviceNamePrefix, next))] {
+			next++
+		}
+		line.Name = fmt.Sprintf("%s%d", newDeviceNamePrefix, next)
+		usedNames[strings.ToLower(line.Name)] = true
+		line.Status = provisionAllWouldProvision
+		result.Devices = append(result.Devices, line)
+		pending = append(pending, len(result.Devices)-1)
+	}
+
+	if !provisionReq.DryRun && len(pending) > 0 {
+		provisionAllDevices(ctx, user, result.Devices, pending, room)
+	}
+
+	for _, line := range result.Devices {
+		switch line.Status {
+		case provisionAllProvisioned, provisionAllWouldProvision:
+			result.Provisioned++
+		case provisionAllSkipped:
+			result.Skipped++
+		case provisionAllFailed:
+			result.Failed++
+		}
+	}
+
+	log.Printf("ProvisionAll: %s provisioned=%d, skipped=%d, failed=%d (dryRun=%v)",
+		username, result.Provisioned, result.Skipped, result.Failed, result.DryRun)
+	return shared.CreateSuccessResponse(200, result), nil
+}
+
+// provisionAllDevices provisions lines[i] for each i in pending, at most
+// provisionAllConcurrency at a time. Devices not started by the refresh
+// deadline are failed so the response beats API Gateway's timeout; calling
+// again picks them up.
+func provisionAllDevices(ctx context.Context, user shared.User, lines []ProvisionAllDevice, pending []int, room *string) {
+	deadlineCtx, cancel := context.WithDeadline(ctx, refreshDeadline(ctx))
+	defer cancel()
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, provisionAllConcurrency)
+	for _, i := range pending {
+		wg.Add(1)
+		go func(line *ProvisionAllDevice) {
+			defer wg.Done()
+
+			select {
+			case sem <- struct{}{}:
+				provisionAllDevice(ctx, user, line, room)
+				<-sem
+			case <-deadlineCtx.Done():
+				line.Status = provisionAllFailed
+				line.Error = "Not started before the time limit; call provision-all again"
+			}
+		}(&lines[i])
+	}
+	wg.Wait()
+}
+
+// provisionAllDevice provisions one new device with the single-device logic,
+// recording the outcome on line
+func provisionAllDevice(ctx context.Context, user shared.User, line *ProvisionAllDevice, room *string) {
+	info, err := getParticleDeviceInfo(ctx, line.ParticleID, user.ParticleToken)
+	if err != nil {
+		log.Printf("ProvisionAll: failed to get device info for %s: %v", line.ParticleID, err)
+		line.Status = provisionAllFailed
+		line.Error = fmt.Sprintf("Failed to get device info: %v", err)
+		return
+	}
+
+	start := time.Now()
+	report, err := provisionParticleDevice(ctx, user, line.ParticleID, info, nil, line.Name, room)
+	if err != nil {
+		line.Status = provisionAllFailed
+		line.Error = "Failed to save device"
+		return
+	}
+	log.Printf("ProvisionAll: provisioned %s as %s in %v", line.ParticleID, report.Device.DeviceID, time.Since(start))
+
+	line.Status = provisionAllProvisioned
+	line.DeviceID = report.Device.DeviceID
+	line.IsOnline = report.IsOnline
+	line.Report = &report
+}
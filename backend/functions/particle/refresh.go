@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/google/uuid"
+
+	"candle-lights/backend/shared"
+)
+
+var (
+	applyJobsTable     = os.Getenv("APPLY_JOBS_TABLE")
+	refreshJobQueueURL = os.Getenv("REFRESH_JOB_QUEUE_URL")
+	refreshJobQueueARN = os.Getenv("REFRESH_JOB_QUEUE_ARN")
+	sqsClient          *sqs.Client
+)
+
+// errBadContinuation covers malformed tokens and other users' tokens
+var errBadContinuation = errors.New("invalid continuation token")
+
+// maxRefreshLimit caps ?limit, the devices refreshed per chunked call
+const maxRefreshLimit = 50
+
+// refreshTimeBudget is how long a synchronous refresh starts new devices
+// for. API Gateway gives up at 29 seconds and one device's readiness checks
+// can take several.
+const refreshTimeBudget = 18 * time.Second
+
+// refreshJobAttempts is how many deliveries a queued device gets before its
+// target is failed
+const refreshJobAttempts = 3
+
+// refreshOptions are the query parameters of POST /api/particle/devices/refresh
+type refreshOptions struct {
+	Limit  int  // Devices per call, 0 for as many as fit the time budget
+	Offset int  // Index into the sorted Particle device list
+	Async  bool // Queue the refresh and return an apply-jobs jobId
+}
+
+// refreshContinuation is the payload of a continuation token
+type refreshContinuation struct {
+	UserID string `json:"u"`
+	Offset int    `json:"o"`
+}
+
+// refreshJobMessage is the SQS message that refreshes one Particle device
+type refreshJobMessage struct {
+	JobID      string `json:"jobId"`
+	TargetKey  string `json:"targetKey"`
+	UserID     string `json:"userId"`
+	ParticleID string `json:"particleId"`
+	Name       string `json:"name,omitempty"`
+	Connected  bool   `json:"connected"`
+}
+
+// RefreshJobResponse is returned when a refresh is handed to the queue
+type RefreshJobResponse struct {
+	Message string          `json:"message"`
+	Job     shared.ApplyJob `json:"job"`
+}
+
+// parseRefreshOptions reads ?limit, ?continuation, and ?async
+func parseRefreshOptions(params map[string]string, username string) (refreshOptions, error) {
+	var opts refreshOptions
+	if raw := params["limit"]; raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit < 1 || limit > maxRefreshLimit {
+			return opts, fmt.Errorf("limit must be between 1 and %d", maxRefreshLimit)
+		}
+		opts.Limit = limit
+	}
+	if token := params["continuation"]; token != "" {
+		offset, err := decodeRefreshContinuation(token, username)
+		if err != nil {
+			return opts, err
+		}
+		opts.Offset = offset
+	}
+	opts.Async = params["async"] == "true"
+	if opts.Async && opts.Offset > 0 {
+		return opts, errors.New("async can't be combined with continuation")
+	}
+	return opts, nil
+}
+
+// encodeRefreshContinuation returns the token that resumes a refresh at offset
+func encodeRefreshContinuation(username string, offset int) string {
+	payload, _ := json.Marshal(refreshContinuation{UserID: username, Offset: offset})
+	return base64.RawURLEncoding.EncodeToString(payload)
+}
+
+// decodeRefreshContinuation returns the offset in token. Tokens from another
+// user are rejected.
+func decodeRefreshContinuation(token, username string) (int, error) {
+	payload, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return 0, errBadContinuation
+	}
+	var c refreshContinuation
+	if err := json.Unmarshal(payload, &c); err != nil || c.UserID != username || c.Offset < 0 {
+		return 0, errBadContinuation
+	}
+	return c.Offset, nil
+}
+
+// sortParticleDevices orders the device list by ID so continuation offsets
+// point at the same devices from call to call
+func sortParticleDevices(devices []map[string]interface{}) {
+	sort.SliceStable(devices, func(i, j int) bool {
+		a, _ := devices[i]["id"].(string)
+		b, _ := devices[j]["id"].(string)
+		return a < b
+	})
+}
+
+// refreshDeadline is when a synchronous refresh stops starting new devices
+func refreshDeadline(ctx context.Context) time.Time {
+	deadline := time.Now().Add(refreshTimeBudget)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		return ctxDeadline
+	}
+	return deadline
+}
+
+// startRefreshJob records an apply job with one target per Particle device
+// and queues one message per device. Progress is read from
+// GET /api/apply-jobs/{jobId}; targets are keyed by Particle ID.
+func startRefreshJob(ctx context.Context, username string, particleDevices []map[string]interface{}) (events.APIGatewayProxyResponse, error) {
+	if refreshJobQueueURL == "" || applyJobsTable == "" {
+		return shared.CreateErrorResponse(400, "Async refresh is not available"), nil
+	}
+
+	now := time.Now()
+	job := shared.ApplyJob{
+		JobID:     uuid.New().String(),
+		UserID:    username,
+		Kind:      shared.ApplyJobKindDeviceRefresh,
+		Status:    shared.ApplyJobRunning,
+		Targets:   make(map[string]shared.ApplyJobTarget, len(particleDevices)),
+		CreatedAt: now,
+		UpdatedAt: now,
+		ExpiresAt: shared.ApplyJobExpiresAt(now),
+	}
+
+	var messages []refreshJobMessage
+	for _, particleDev := range particleDevices {
+		particleID, ok := particleDev["id"].(string)
+		if !ok || particleID == "" {
+			log.Printf("Skipping device with invalid ID: %v", particleDev)
+			continue
+		}
+		name, _ := particleDev["name"].(string)
+		connected, _ := particleDev["connected"].(bool)
+
+		key := shared.ApplyTargetKey(particleID, 0)
+		job.Targets[key] = shared.ApplyJobTarget{DeviceID: particleID, DeviceName: name, Status: shared.ApplyTargetPending}
+		messages = append(messages, refreshJobMessage{
+			JobID:      job.JobID,
+			TargetKey:  key,
+			UserID:     username,
+			ParticleID: particleID,
+			Name:       name,
+			Connected:  connected,
+		})
+	}
+	job.Total = len(job.Targets)
+	if len(messages) == 0 {
+		job.Status = shared.ApplyJobCompleted
+	}
+
+	if err := shared.PutItem(ctx, applyJobsTable, job); err != nil {
+		log.Printf("Failed to create refresh job: %v", err)
+		return shared.CreateErrorResponse(500, "Failed to create refresh job"), nil
+	}
+
+	if queued, err := enqueueRefreshMessages(ctx, messages); err != nil {
+		// Messages that did go out still run; fail the rest so the job can finish
+		log.Printf("Failed to queue refresh job %s after %d of %d messages: %v", job.JobID, queued, len(messages), err)
+		for _, msg := range messages[queued:] {
+			if _, finishErr := shared.FinishApplyTarget(ctx, job.JobID, msg.TargetKey, shared.ApplyTargetFailed, "Failed to queue: "+err.Error(), nil); finishErr != nil {
+				log.Printf("Failed to mark target %s of job %s failed: %v", msg.TargetKey, job.JobID, finishErr)
+			}
+		}
+		if queued == 0 {
+			return shared.CreateErrorResponse(500, "Failed to queue refresh job"), nil
+		}
+	}
+
+	log.Printf("Queued refresh job %s: %d devices", job.JobID, len(messages))
+
+	return shared.CreateSuccessResponse(202, RefreshJobResponse{
+		Message: fmt.Sprintf("Refreshing %d devices; poll /api/apply-jobs/%s for progress", len(messages), job.JobID),
+		Job:     job,
+	}), nil
+}
+
+// enqueueRefreshMessages sends messages in SQS batches, returning how many
+// were queued before any error
+func enqueueRefreshMessages(ctx context.Context, messages []refreshJobMessage) (int, error) {
+	if len(messages) == 0 {
+		return 0, nil
+	}
+
+	if sqsClient == nil {
+		cfg, err := config.LoadDefaultConfig(ctx)
+		if err != nil {
+			return 0, err
+		}
+		sqsClient = sqs.NewFromConfig(cfg)
+	}
+
+	const batchSize = 10 // SQS SendMessageBatch limit
+	for start := 0; start < len(messages); start += batchSize {
+		end := start + batchSize
+		if end > len(messages) {
+			end = len(messages)
+		}
+
+		entries := make([]sqstypes.SendMessageBatchRequestEntry, 0, end-start)
+		for i, msg := range messages[start:end] {
+			body, err := json.Marshal(msg)
+			if err != nil {
+				return start, err
+			}
+			entries = append(entries, sqstypes.SendMessageBatchRequestEntry{
+				Id:          aws.String(strconv.Itoa(i)),
+				MessageBody: aws.String(string(body)),
+			})
+		}
+
+		output, err := sqsClient.SendMessageBatch(ctx, &sqs.SendMessageBatchInput{
+			QueueUrl: aws.String(refreshJobQueueURL),
+			Entries:  entries,
+		})
+		if err != nil {
+			return start, err
+		}
+		if len(output.Failed) > 0 {
+			return start, fmt.Errorf("%d messages rejected: %s", len(output.Failed), aws.ToString(output.Failed[0].Message))
+		}
+	}
+	return len(messages), nil
+}
+
+// handleRefreshJobMessages refreshes one device per message. A device that
+// fails to save is redelivered until refreshJobAttempts, then failed.
+func handleRefreshJobMessages(ctx context.Context, event events.SQSEvent) events.SQSEventResponse {
+	var response events.SQSEventResponse
+	tokens := make(map[string]string)
+	for _, record := range event.Records {
+		var msg refreshJobMessage
+		if err := json.Unmarshal([]byte(record.Body), &msg); err != nil || msg.JobID == "" {
+			log.Printf("Ignoring malformed refresh job message %s: %v", record.MessageId, err)
+			continue
+		}
+
+		token, ok := tokens[msg.UserID]
+		if !ok {
+			var err error
+			if token, err = particleTokenForUser(ctx, msg.UserID); err != nil {
+				log.Printf("Failed to get user %s for refresh job %s, will retry: %v", msg.UserID, msg.JobID, err)
+				response.BatchItemFailures = append(response.BatchItemFailures, events.SQSBatchItemFailure{
+					ItemIdentifier: record.MessageId,
+				})
+				continue
+			}
+			tokens[msg.UserID] = token
+		}
+		if token == "" {
+			finishRefreshJobTarget(ctx, msg, shared.ApplyTargetFailed, "Particle token not configured")
+			continue
+		}
+
+		particleDev := map[string]interface{}{
+			"id":        msg.ParticleID,
+			"name":      msg.Name,
+			"connected": msg.Connected,
+		}
+		if err := refreshParticleDevice(ctx, msg.UserID, token, particleDev); err != nil {
+			attempts, _ := strconv.Atoi(record.Attributes["ApproximateReceiveCount"])
+			if attempts < refreshJobAttempts {
+				log.Printf("Refresh job %s target %s failed, will retry: %v", msg.JobID, msg.TargetKey, err)
+				response.BatchItemFailures = append(response.BatchItemFailures, events.SQSBatchItemFailure{
+					ItemIdentifier: record.MessageId,
+				})
+				continue
+			}
+			finishRefreshJobTarget(ctx, msg, shared.ApplyTargetFailed, err.Error())
+			continue
+		}
+		finishRefreshJobTarget(ctx, msg, shared.ApplyTargetSucceeded, "")
+	}
+	return response
+}
+
+// particleTokenForUser is the user's Particle token, "" when they have none
+func particleTokenForUser(ctx context.Context, username string) (string, error) {
+	userKey, _ := attributevalue.MarshalMap(map[string]string{
+		"username": username,
+	})
+
+	var user shared.User
+	if err := shared.GetItem(ctx, usersTable, userKey, &user); err != nil {
+		return "", err
+	}
+	if err := shared.DecryptParticleToken(ctx, usersTable, &user); err != nil {
+		return "", err
+	}
+	return user.ParticleToken, nil
+}
+
+// finishRefreshJobTarget records a target's final status, ignoring duplicates
+func finishRefreshJobTarget(ctx context.Context, msg refreshJobMessage, status, errMsg string) {
+	job, err := shared.FinishApplyTarget(ctx, msg.JobID, msg.TargetKey, status, errMsg, nil)
+	if errors.Is(err, shared.ErrApplyTargetDone) {
+		log.Printf("Refresh job %s target %s already finished", msg.JobID, msg.TargetKey)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to finish refresh job %s target %s: %v", msg.JobID, msg.TargetKey, err)
+		return
+	}
+	if job != nil {
+		log.Printf("Completed refresh job %s: %d succeeded, %d failed", job.JobID, job.Succeeded, job.Failed)
+	}
+}
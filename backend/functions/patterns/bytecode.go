@@ -0,0 +1,204 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "log"
+    "time"
+
+    "github.com/aws/aws-lambda-go/events"
+    "github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+
+    "candle-lights/backend/shared"
+)
+
+// upgradeLEDCount is the strip length used for the upgraded WLED state (same default as the migration)
+const upgradeLEDCount = 8
+
+// Where an upgrade took its pattern spec from
+const (
+    upgradeSourceLCLSpec  = "lclSpec"
+    upgradeSourceBytecode = "bytecode"
+    upgradeSourceFields   = "patternFields"
+)
+
+// BytecodeUpgradeResponse reports what an upgrade produced
+type BytecodeUpgradeResponse struct {
+    PatternID string                  `json:"patternId"`
+    Source    string                  `json:"source"`   // lclSpec, bytecode, or patternFields
+    Produced  []string                `json:"produced"` // lclSpec, lclV4, wledBinary
+    Lossy     bool                    `json:"lossy"`    // True when the result may not match the original exactly
+    Previous  *shared.LCLBytecodeInfo `json:"previous,omitempty"`
+    Current   *shared.LCLBytecodeInfo `json:"current"`
+    Warnings  []string                `json:"warnings,omitempty"`
+    Pattern   shared.Pattern          `json:"pattern"`
+}
+
+func getOwnedPattern(ctx context.Context, username string, patternID string) (*shared.Pattern, *events.APIGatewayProxyResponse) {
+    key, _ := attributevalue.MarshalMap(map[string]string{
+        "patternId": patternID,
+    })
+
+    var pattern shared.Pattern
+    if err := shared.GetItem(ctx, patternsTable, key, &pattern); err != nil {
+        resp := shared.CreateErrorResponse(500, "Database error")
+        return nil, &resp
+    }
+
+    // Verify ownership
+    if pattern.PatternID == "" || pattern.UserID != username {
+        resp := shared.CreateErrorResponse(404, "Pattern not found")
+        return nil, &resp
+    }
+
+    return &pattern, nil
+}
+
+// handleDecodeBytecode reports the version and contents of a pattern's LCL bytecode
+func handleDecodeBytecode(ctx context.Context, username string, patternID string) (events.APIGatewayProxyResponse, error) {
+    pattern, errResp := getOwnedPattern(ctx, username, patternID)
+    if errResp != nil {
+        return *errResp, nil
+    }
+
+    if len(pattern.Bytecode) == 0 {
+        return shared.CreateErrorResponse(400, "Pattern has no LCL bytecode"), nil
+    }
+
+    info, err := shared.InspectLCLBytecode(pattern.Bytecode)
+    if err != nil {
+        return shared.CreateErrorResponse(400, "Failed to decode bytecode: "+err.Error()), nil
+    }
+
+    return shared.CreateSuccessResponse(200, info), nil
+}
+
+// handleUpgradeBytecode rebuilds a pattern's bytecode in the v4 format current
+// firmware runs, plus WLED binary when the pattern has no WLED state yet.
+// The spec comes from LCLSpec when present, else from the old bytecode, else
+// from the pattern's basic fields.
+func handleUpgradeBytecode(ctx context.Context, username string, patternID string) (events.APIGatewayProxyResponse, error) {
+    pattern, errResp := getOwnedPattern(ctx, username, patternID)
+    if errResp != nil {
+        return *errResp, nil
+    }
+
+    resp := BytecodeUpgradeResponse{PatternID: pattern.PatternID, Produced: []string{}}
+
+    if len(pattern.Bytecode) > 0 {
+        previous, err := shared.InspectLCLBytecode(pattern.Bytecode)
+        if err != nil {
+            resp.Warnings = append(resp.Warnings, "Existing bytecode could not be decoded: "+err.Error())
+        } else {
+            resp.Previous = previous
+        }
+    }
+
+    var spec *shared.PatternSpec
+    if pattern.LCLSpec != "" {
+        parsed, err := shared.ParseLCLSpec(pattern.LCLSpec)
+        if err != nil {
+            resp.Warnings = append(resp.Warnings, "LCL spec could not be parsed, falling back: "+err.Error())
+        } else {
+            spec = parsed
+            resp.Source = upgradeSourceLCLSpec
+        }
+    }
+
+    if spec == nil && resp.Previous != nil {
+        reconstructed, warnings := resp.Previous.ToPatternSpec()
+        spec = reconstructed
+        resp.Source = upgradeSourceBytecode
+        resp.Warnings = append(resp.Warnings, resp.Previous.Warnings...)
+        resp.Warnings = append(resp.Warnings, warnings...)
+        if resp.Previous.Format == shared.LCLFormatOpcode {
+            resp.Lossy = true
+            resp.Warnings = append(resp.Warnings, "Reconstructed from v2 bytecode: only literal effect, color, and parameter values carry over")
+        }
+        if len(warnings) > 0 {
+            resp.Lossy = true
+        }
+    }
+
+    if spec == nil {
+        spec = specFromPatternFields(pattern)
+        resp.Source = upgradeSourceFields
+        resp.Lossy = true
+        resp.Warnings = append(resp.Warnings, "Pattern has no usable LCL spec or bytecode: rebuilt from its type, color, brightness, and speed")
+    }
+
+    // Keep a source spec so the pattern can be recompiled later
+    if resp.Source != upgradeSourceLCLSpec {
+        specJSON, err := json.Marshal(spec)
+        if err != nil {
+            return shared.CreateErrorResponse(500, "Failed to encode pattern spec"), nil
+        }
+        pattern.LCLSpec = string(specJSON)
+        resp.Produced = append(resp.Produced, "lclSpec")
+    }
+
+    // CompileLCLv4 fills in defaults on the spec, so convert a copy to WLED
+    wledSpec := *spec
+    bytecode, err := shared.CompileLCLv4(spec)
+    if err != nil {
+        return shared.CreateErrorResponse(400, "Failed to compile v4 bytecode: "+err.Error()), nil
+    }
+    pattern.Bytecode = bytecode
+    resp.Produced = append(resp.Produced, "lclV4")
+
+    if pattern.WLEDState != "" {
+        resp.Warnings = append(resp.Warnings, "Pattern already has a WLED state; it was left unchanged")
+    } else if wledState, err := shared.ConvertLCLToWLED(&wledSpec, upgradeLEDCount); err != nil {
+        resp.Warnings = append(resp.Warnings, "WLED conversion failed: "+err.Error())
+    } else if wledBinary, err := shared.CompileWLEDToBinary(wledState); err != nil {
+        resp.Warnings = append(resp.Warnings, "WLED compile failed: "+err.Error())
+    } else if wledJSON, err := json.Marshal(wledState); err != nil {
+        resp.Warnings = append(resp.Warnings, "WLED state could not be encoded: "+err.Error())
+    } else {
+        resp.Warnings = append(resp.Warnings, shared.ConvertLCLToWLEDWarnings(&wledSpec)...)
+        pattern.WLEDState = string(wledJSON)
+        pattern.WLEDBinary = wledBinary
+        resp.Produced = append(resp.Produced, "wledBinary")
+    }
+    shared.NormalizePatternFormat(pattern)
+
+    pattern.UpdatedAt = time.Now()
+    // Replaces any compilations of the previous version
+    pattern.CompiledCache = shared.PrecompileCommonLEDCounts(pattern)
+    pattern.CompatibleEffectIDs = shared.ComputeCompatibleEffectIDs(pattern)
+
+    if err := shared.PutItem(ctx, patternsTable, *pattern); err != nil {
+        return shared.CreateErrorResponse(500, "Failed to update pattern"), nil
+    }
+
+    resp.Current, _ = shared.InspectLCLBytecode(pattern.Bytecode)
+    resp.Pattern = *pattern
+
+    log.Printf("Upgraded bytecode for pattern %s from %s (produced %v, lossy=%v)", pattern.PatternID, resp.Source, resp.Produced, resp.Lossy)
+    return shared.CreateSuccessResponse(200, resp), nil
+}
+
+// specFromPatternFields builds a best-effort spec for patterns with no LCL source
+func specFromPatternFields(pattern *shared.Pattern) *shared.PatternSpec {
+    effect := shared.PatternSolid
+    switch pattern.Type {
+    case shared.PatternCandle, shared.PatternPulse, shared.PatternWave, shared.PatternRainbow, shared.PatternFire:
+        effect = pattern.Type
+    }
+
+    var colors []string
+    for _, c := range pattern.Colors {
+        colors = append(colors, fmt.Sprintf("#%02X%02X%02X", c.R, c.G, c.B))
+    }
+    if len(colors) == 0 && (pattern.Red != 0 || pattern.Green != 0 || pattern.Blue != 0) {
+        colors = append(colors, fmt.Sprintf("#%02X%02X%02X", pattern.Red, pattern.Green, pattern.Blue))
+    }
+
+    return &shared.PatternSpec{
+        Effect:     effect,
+        Colors:     colors,
+        Brightness: pattern.Brightness,
+        Speed:      pattern.Speed,
+    }
+}
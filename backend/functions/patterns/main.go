@@ -1,10 +1,18 @@
 package main
 
 import (
+    "bytes"
     "context"
+    "encoding/base64"
     "encoding/json"
+    "fmt"
+    "image"
+    "image/color"
+    "image/draw"
+    "image/gif"
     "log"
     "os"
+    "strconv"
     "time"
 
     "github.com/aws/aws-lambda-go/events"
@@ -18,47 +26,78 @@ import (
 
 var patternsTable = os.Getenv("PATTERNS_TABLE")
 
+var router = newRouter()
+
+// newRouter registers the pattern and effect routes, all for signed-in users
+func newRouter() *shared.Router {
+    r := shared.NewRouter("Patterns")
+
+    r.MustHandle("GET", shared.PathEquals("/api/effects"), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleListEffects()
+        })
+    r.MustHandle("GET", shared.PathEquals("/api/patterns"), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleListPatterns(rc.Ctx, rc.Username, rc.Request)
+        })
+    r.MustHandle("POST", shared.PathEquals("/api/patterns"), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleCreatePattern(rc.Ctx, rc.Username, rc.Request)
+        })
+    r.MustHandle("POST", shared.PathEquals("/api/patterns/install-starters"), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleInstallStarters(rc.Ctx, rc.Username)
+        })
+    r.MustHandle("GET", shared.PathEquals("/api/patterns/stats"), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handlePatternStats(rc.Ctx, rc.Username)
+        })
+    r.MustHandle("GET", shared.PathEquals("/api/patterns/favorites"), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleListFavoritePatterns(rc.Ctx, rc.Username)
+        })
+    r.MustHandle("POST", shared.MatchAll(shared.HasPathParams("patternId"), shared.PathSuffix("/favorite")), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleSetFavorite(rc.Ctx, rc.Username, rc.Request.PathParameters["patternId"], true)
+        })
+    r.MustHandle("POST", shared.MatchAll(shared.HasPathParams("patternId"), shared.PathSuffix("/unfavorite")), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleSetFavorite(rc.Ctx, rc.Username, rc.Request.PathParameters["patternId"], false)
+        })
+    r.MustHandle("GET", shared.MatchAll(shared.HasPathParams("patternId"), shared.PathSuffix("/decode")), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleDecodeBytecode(rc.Ctx, rc.Username, rc.Request.PathParameters["patternId"])
+        })
+    r.MustHandle("POST", shared.MatchAll(shared.HasPathParams("patternId"), shared.PathSuffix("/upgrade-bytecode")), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleUpgradeBytecode(rc.Ctx, rc.Username, rc.Request.PathParameters["patternId"])
+        })
+    r.MustHandle("GET", shared.MatchAll(shared.HasPathParams("patternId"), shared.PathSuffix("/preview")), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handlePatternPreview(rc.Ctx, rc.Username, rc.Request.PathParameters["patternId"], rc.Request)
+        })
+    r.MustHandle("GET", shared.HasPathParams("patternId"), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleGetPattern(rc.Ctx, rc.Username, rc.Request.PathParameters["patternId"])
+        })
+    r.MustHandle("PUT", shared.HasPathParams("patternId"), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleUpdatePattern(rc.Ctx, rc.Username, rc.Request.PathParameters["patternId"], rc.Request)
+        })
+    r.MustHandle("DELETE", shared.HasPathParams("patternId"), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleDeletePattern(rc.Ctx, rc.Username, rc.Request.PathParameters["patternId"])
+        })
+
+    return r
+}
+
 func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
     log.Printf("=== Patterns Handler Called ===")
     log.Printf("Path: %s", request.Path)
     log.Printf("Method: %s", request.HTTPMethod)
 
-    // Validate authentication
-    username, err := shared.ValidateAuth(ctx, request)
-    if err != nil || username == "" {
-        log.Printf("Authentication failed: err=%v, username=%s", err, username)
-        return shared.CreateErrorResponse(401, "Unauthorized"), nil
-    }
-
-    log.Printf("Authenticated user: %s", username)
-
-    path := request.Path
-    method := request.HTTPMethod
-    patternID := request.PathParameters["patternId"]
-
-    switch {
-    case path == "/api/effects" && method == "GET":
-        log.Println("Routing to handleListEffects")
-        return handleListEffects()
-    case path == "/api/patterns" && method == "GET":
-        log.Println("Routing to handleListPatterns")
-        return handleListPatterns(ctx, username)
-    case path == "/api/patterns" && method == "POST":
-        log.Println("Routing to handleCreatePattern")
-        return handleCreatePattern(ctx, username, request)
-    case patternID != "" && method == "GET":
-        log.Printf("Routing to handleGetPattern for patternID: %s", patternID)
-        return handleGetPattern(ctx, username, patternID)
-    case patternID != "" && method == "PUT":
-        log.Printf("Routing to handleUpdatePattern for patternID: %s", patternID)
-        return handleUpdatePattern(ctx, username, patternID, request)
-    case patternID != "" && method == "DELETE":
-        log.Printf("Routing to handleDeletePattern for patternID: %s", patternID)
-        return handleDeletePattern(ctx, username, patternID)
-    default:
-        log.Printf("No matching route for path: %s, method: %s", path, method)
-        return shared.CreateErrorResponse(404, "Not found"), nil
-    }
+    return router.Dispatch(ctx, request)
 }
 
 // EffectResponse represents an effect for the API
@@ -78,6 +117,8 @@ type EffectResponse struct {
     Custom3Desc string `json:"custom3Desc,omitempty"`
     MinColors   int    `json:"minColors"`
     MaxColors   int    `json:"maxColors"`
+    SpeedCurve  *shared.SpeedCurve `json:"speedCurve,omitempty"` // How the 0-100 speed slider maps to sx
+    OverrideAllowed bool `json:"overrideAllowed"` // Can be set as a legacy pattern's effectId
 }
 
 func handleListEffects() (events.APIGatewayProxyResponse, error) {
@@ -125,19 +166,36 @@ func handleListEffects() (events.APIGatewayProxyResponse, error) {
         {ID: 91, Name: "Bouncing Balls", Description: "Physics-based bouncing balls", HasSpeed: true, HasIntensity: true, HasCustom1: true, HasCustom2: true, MinColors: 1, MaxColors: 3, SpeedDesc: "Gravity", IntensDesc: "Ball count", Custom1Desc: "Fade", Custom2Desc: "Trail"},
         {ID: 92, Name: "Sinelon", Description: "Sine wave oscillating dot", HasSpeed: true, HasIntensity: true, HasCustom1: true, MinColors: 1, MaxColors: 2, SpeedDesc: "Speed", IntensDesc: "Fade rate", Custom1Desc: "Width"},
     }
+    for i := range effects {
+        effects[i].OverrideAllowed = shared.IsEffectSupported(effects[i].ID)
+        if effects[i].HasSpeed {
+            curve := shared.EffectSpeedCurve(effects[i].ID)
+            effects[i].SpeedCurve = &curve
+        }
+    }
     return shared.CreateSuccessResponse(200, effects), nil
 }
 
-func handleListPatterns(ctx context.Context, username string) (events.APIGatewayProxyResponse, error) {
-    indexName := "userId-index"
-    keyCondition := "userId = :userId"
-    expressionValues := map[string]types.AttributeValue{
-        ":userId": &types.AttributeValueMemberS{Value: username},
+func handleListPatterns(ctx context.Context, username string, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+    patterns, err := queryUserPatterns(ctx, username)
+    if err != nil {
+        return shared.CreateErrorResponse(500, "Failed to retrieve patterns"), nil
     }
 
-    var patterns []shared.Pattern
-    if err := shared.Query(ctx, patternsTable, &indexName, keyCondition, expressionValues, &patterns); err != nil {
-        return shared.CreateErrorResponse(500, "Failed to retrieve patterns"), nil
+    // Optional ordering and paging: ?sortBy=applyCount&limit=10
+    // sortBy is favoritesFirst (default), name, createdAt, updatedAt, or applyCount
+    if sortBy := request.QueryStringParameters["sortBy"]; shared.SortPatterns(patterns, sortBy) != nil {
+        return shared.CreateErrorResponse(400, fmt.Sprintf("Unsupported sortBy %q", sortBy)), nil
+    }
+
+    if limitParam := request.QueryStringParameters["limit"]; limitParam != "" {
+        limit, err := strconv.Atoi(limitParam)
+        if err != nil || limit < 1 {
+            return shared.CreateErrorResponse(400, "limit must be a positive integer"), nil
+        }
+        if limit < len(patterns) {
+            patterns = patterns[:limit]
+        }
     }
 
     // Debug: Log pattern details including WLED state
@@ -149,9 +207,77 @@ func handleListPatterns(ctx context.Context, username string) (events.APIGateway
             p.Name, p.Type, p.FormatVersion, hasWLEDState, len(p.WLEDState), hasWLEDBinary, hasBytecode)
     }
 
+    shared.FillBinarySizes(patterns)
+
+    // An empty list is the cue to offer the starter patterns
+    if len(patterns) == 0 {
+        return shared.CreateResponse(200, PatternListResponse{
+            APIResponse:       shared.APIResponse{Success: true, Data: []shared.Pattern{}},
+            StartersAvailable: true,
+        }), nil
+    }
+
     return shared.CreateSuccessResponse(200, patterns), nil
 }
 
+// handlePatternStats reports apply counts across the user's patterns
+func handlePatternStats(ctx context.Context, username string) (events.APIGatewayProxyResponse, error) {
+    patterns, err := queryUserPatterns(ctx, username)
+    if err != nil {
+        return shared.CreateErrorResponse(500, "Failed to retrieve patterns"), nil
+    }
+
+    return shared.CreateSuccessResponse(200, shared.ComputePatternStats(patterns)), nil
+}
+
+// handleListFavoritePatterns returns the user's favorites in summary form
+// for the quick-access bar
+func handleListFavoritePatterns(ctx context.Context, username string) (events.APIGatewayProxyResponse, error) {
+    patterns, err := queryUserPatterns(ctx, username)
+    if err != nil {
+        return shared.CreateErrorResponse(500, "Failed to retrieve patterns"), nil
+    }
+
+    favorites := shared.FilterFavoritePatterns(patterns)
+    shared.SortPatterns(favorites, shared.PatternSortName)
+
+    summaries := make([]shared.PatternSummary, 0, len(favorites))
+    for _, p := range favorites {
+        summaries = append(summaries, shared.SummarizePattern(p))
+    }
+
+    return shared.CreateSuccessResponse(200, summaries), nil
+}
+
+// handleSetFavorite marks or unmarks a pattern as a favorite
+func handleSetFavorite(ctx context.Context, username string, patternID string, favorite bool) (events.APIGatewayProxyResponse, error) {
+    if _, errResp := getOwnedPattern(ctx, username, patternID); errResp != nil {
+        return *errResp, nil
+    }
+
+    pattern, err := shared.SetPatternFavorite(ctx, patternsTable, patternID, favorite)
+    if err != nil {
+        log.Printf("Failed to set favorite on pattern %s: %v", patternID, err)
+        return shared.CreateErrorResponse(500, "Failed to update pattern"), nil
+    }
+
+    return shared.CreateSuccessResponse(200, pattern), nil
+}
+
+func queryUserPatterns(ctx context.Context, username string) ([]shared.Pattern, error) {
+    indexName := "userId-index"
+    keyCondition := "userId = :userId"
+    expressionValues := map[string]types.AttributeValue{
+        ":userId": &types.AttributeValueMemberS{Value: username},
+    }
+
+    var patterns []shared.Pattern
+    if err := shared.Query(ctx, patternsTable, &indexName, keyCondition, expressionValues, &patterns); err != nil {
+        return nil, err
+    }
+    return patterns, nil
+}
+
 func handleCreatePattern(ctx context.Context, username string, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
     var pattern shared.Pattern
     body := shared.GetRequestBody(request)
@@ -160,9 +286,19 @@ func handleCreatePattern(ctx context.Context, username string, request events.AP
     }
 
     // Validate pattern
-    if pattern.Name == "" || pattern.Type == "" {
+    if pattern.Type == "" {
         return shared.CreateErrorResponse(400, "Name and type are required"), nil
     }
+    name, err := shared.ValidateName("pattern", pattern.Name)
+    if err != nil {
+        return shared.CreateErrorResponse(400, err.Error()), nil
+    }
+    pattern.Name = name
+    description, err := shared.ValidateDescription(pattern.Description)
+    if err != nil {
+        return shared.CreateErrorResponse(400, err.Error()), nil
+    }
+    pattern.Description = description
 
     // Validate pattern type
     validTypes := map[string]bool{
@@ -197,6 +333,17 @@ func handleCreatePattern(ctx context.Context, username string, request events.AP
         }
     }
 
+    if pattern.PreviewFrameCount < 0 || pattern.PreviewFrameCount > shared.MaxPreviewFrames {
+        return shared.CreateErrorResponse(400, "previewFrameCount must be between 0 and "+strconv.Itoa(shared.MaxPreviewFrames)), nil
+    }
+
+    // Keep legacy RGB and the colors array in agreement
+    fields := providedFields(body)
+    rgbSet := fields["red"] || fields["green"] || fields["blue"]
+    if err := shared.ReconcilePatternColors(&pattern, rgbSet, fields["colors"]); err != nil {
+        return shared.CreateErrorResponse(400, err.Error()), nil
+    }
+
     // Set defaults
     if pattern.Brightness == 0 {
         pattern.Brightness = 128
@@ -205,10 +352,24 @@ func handleCreatePattern(ctx context.Context, username string, request events.AP
         pattern.Speed = 50
     }
 
-    // If WLED state provided, set format version (compilation done client-side via /api/glowblaster/compile)
-    if pattern.WLEDState != "" {
-        pattern.FormatVersion = 2 // FormatVersionWLED
-        log.Printf("Saving pattern with WLED state (length: %d)", len(pattern.WLEDState))
+    // Keep formatVersion, type, and category in line with the content (compilation done client-side via /api/glowblaster/compile)
+    if changes := shared.NormalizePatternFormat(&pattern); len(changes) > 0 {
+        log.Printf("Normalized new pattern format: %v", changes)
+    }
+    if request.QueryStringParameters["autoMerge"] == "true" {
+        if err := autoMergeSegments(&pattern); err != nil {
+            return shared.CreateErrorResponse(400, err.Error()), nil
+        }
+    }
+    if err := shared.NormalizePatternEffectID(&pattern); err != nil {
+        return shared.CreateErrorResponse(400, err.Error()), nil
+    }
+    if err := shared.ValidatePatternFormat(pattern); err != nil {
+        return shared.CreateErrorResponse(400, err.Error()), nil
+    }
+    // Applies send the stored binary as is to strips of the authored length
+    if err := shared.StoreCompiledBinary(&pattern); err != nil {
+        return shared.CreateErrorResponse(400, err.Error()), nil
     }
 
     // Create pattern
@@ -216,6 +377,8 @@ func handleCreatePattern(ctx context.Context, username string, request events.AP
     pattern.UserID = username
     pattern.CreatedAt = time.Now()
     pattern.UpdatedAt = time.Now()
+    pattern.CompiledCache = shared.PrecompileCommonLEDCounts(&pattern)
+    pattern.CompatibleEffectIDs = shared.ComputeCompatibleEffectIDs(&pattern)
 
     if err := shared.PutItem(ctx, patternsTable, pattern); err != nil {
         return shared.CreateErrorResponse(500, "Failed to create pattern"), nil
@@ -224,6 +387,34 @@ func handleCreatePattern(ctx context.Context, username string, request events.AP
     return shared.CreateSuccessResponse(201, pattern), nil
 }
 
+// autoMergeSegments merges adjacent identical segments of a WLED pattern
+// over the segment cap (?autoMerge=true). The pattern in the response then
+// carries the merged state.
+func autoMergeSegments(pattern *shared.Pattern) error {
+    changes, err := shared.AutoMergePatternSegments(pattern)
+    if err != nil {
+        return err
+    }
+    if len(changes) > 0 {
+        log.Printf("Auto-merged pattern %q segments: %v", pattern.Name, changes)
+    }
+    return nil
+}
+
+// providedFields reports which top-level keys a JSON request body contains,
+// so explicitly sent zero values can be told apart from omitted fields
+func providedFields(body string) map[string]bool {
+    var raw map[string]json.RawMessage
+    fields := make(map[string]bool)
+    if err := json.Unmarshal([]byte(body), &raw); err != nil {
+        return fields
+    }
+    for k := range raw {
+        fields[k] = true
+    }
+    return fields
+}
+
 func handleGetPattern(ctx context.Context, username string, patternID string) (events.APIGatewayProxyResponse, error) {
     key, _ := attributevalue.MarshalMap(map[string]string{
         "patternId": patternID,
@@ -234,13 +425,9 @@ func handleGetPattern(ctx context.Context, username string, patternID string) (e
         return shared.CreateErrorResponse(500, "Database error"), nil
     }
 
-    if pattern.PatternID == "" {
-        return shared.CreateErrorResponse(404, "Pattern not found"), nil
-    }
-
     // Verify ownership
-    if pattern.UserID != username {
-        return shared.CreateErrorResponse(403, "Access denied"), nil
+    if pattern.PatternID == "" || pattern.UserID != username {
+        return shared.CreateErrorResponse(404, "Pattern not found"), nil
     }
 
     return shared.CreateSuccessResponse(200, pattern), nil
@@ -257,13 +444,9 @@ func handleUpdatePattern(ctx context.Context, username string, patternID string,
         return shared.CreateErrorResponse(500, "Database error"), nil
     }
 
-    if existingPattern.PatternID == "" {
-        return shared.CreateErrorResponse(404, "Pattern not found"), nil
-    }
-
     // Verify ownership
-    if existingPattern.UserID != username {
-        return shared.CreateErrorResponse(403, "Access denied"), nil
+    if existingPattern.PatternID == "" || existingPattern.UserID != username {
+        return shared.CreateErrorResponse(404, "Pattern not found"), nil
     }
 
     // Parse updates
@@ -275,25 +458,41 @@ func handleUpdatePattern(ctx context.Context, username string, patternID string,
 
     // Update fields
     if updates.Name != "" {
-        existingPattern.Name = updates.Name
+        name, err := shared.ValidateName("pattern", updates.Name)
+        if err != nil {
+            return shared.CreateErrorResponse(400, err.Error()), nil
+        }
+        existingPattern.Name = name
     }
     if updates.Description != "" {
-        existingPattern.Description = updates.Description
+        description, err := shared.ValidateDescription(updates.Description)
+        if err != nil {
+            return shared.CreateErrorResponse(400, err.Error()), nil
+        }
+        existingPattern.Description = description
     }
     if updates.Type != "" {
         existingPattern.Type = updates.Type
     }
-    if updates.Red >= 0 && updates.Red <= 255 {
+    // Only touch RGB fields the request actually sent; zero is a valid value
+    fields := providedFields(body)
+    if updates.Red < 0 || updates.Red > 255 ||
+        updates.Green < 0 || updates.Green > 255 ||
+        updates.Blue < 0 || updates.Blue > 255 {
+        return shared.CreateErrorResponse(400, "RGB values must be between 0 and 255"), nil
+    }
+    if fields["red"] {
         existingPattern.Red = updates.Red
     }
-    if updates.Green >= 0 && updates.Green <= 255 {
+    if fields["green"] {
         existingPattern.Green = updates.Green
     }
-    if updates.Blue >= 0 && updates.Blue <= 255 {
+    if fields["blue"] {
         existingPattern.Blue = updates.Blue
     }
     // Update colors array if provided
-    if len(updates.Colors) > 0 {
+    colorsSet := len(updates.Colors) > 0
+    if colorsSet {
         // Validate colors
         for _, color := range updates.Colors {
             if color.R < 0 || color.R > 255 ||
@@ -304,6 +503,11 @@ func handleUpdatePattern(ctx context.Context, username string, patternID string,
         }
         existingPattern.Colors = updates.Colors
     }
+    // Keep legacy RGB and the colors array in agreement
+    rgbSet := fields["red"] || fields["green"] || fields["blue"]
+    if err := shared.ReconcilePatternColors(&existingPattern, rgbSet, colorsSet); err != nil {
+        return shared.CreateErrorResponse(400, err.Error()), nil
+    }
     if updates.Brightness > 0 {
         existingPattern.Brightness = updates.Brightness
     }
@@ -312,16 +516,49 @@ func handleUpdatePattern(ctx context.Context, username string, patternID string,
     }
     if updates.Metadata != nil {
         existingPattern.Metadata = updates.Metadata
+        // An effectId in new metadata replaces the override unless effectId is also sent
+        if _, ok := updates.Metadata["effectId"]; ok && !fields["effectId"] {
+            existingPattern.EffectID = nil
+        }
+    }
+    if fields["effectId"] {
+        // null removes the override
+        existingPattern.EffectID = updates.EffectID
+    }
+    if updates.PreviewFrameCount > 0 {
+        if updates.PreviewFrameCount > shared.MaxPreviewFrames {
+            return shared.CreateErrorResponse(400, "previewFrameCount must be between 0 and "+strconv.Itoa(shared.MaxPreviewFrames)), nil
+        }
+        existingPattern.PreviewFrameCount = updates.PreviewFrameCount
     }
 
     // Update WLED state if provided (compilation done client-side via /api/glowblaster/compile)
     if updates.WLEDState != "" {
         existingPattern.WLEDState = updates.WLEDState
-        existingPattern.FormatVersion = 2 // FormatVersionWLED
         log.Printf("Updating pattern with WLED state (length: %d)", len(updates.WLEDState))
     }
+    if changes := shared.NormalizePatternFormat(&existingPattern); len(changes) > 0 {
+        log.Printf("Normalized pattern %s format: %v", existingPattern.PatternID, changes)
+    }
+    if request.QueryStringParameters["autoMerge"] == "true" {
+        if err := autoMergeSegments(&existingPattern); err != nil {
+            return shared.CreateErrorResponse(400, err.Error()), nil
+        }
+    }
+    if err := shared.NormalizePatternEffectID(&existingPattern); err != nil {
+        return shared.CreateErrorResponse(400, err.Error()), nil
+    }
+    if err := shared.ValidatePatternFormat(existingPattern); err != nil {
+        return shared.CreateErrorResponse(400, err.Error()), nil
+    }
+    if err := shared.StoreCompiledBinary(&existingPattern); err != nil {
+        return shared.CreateErrorResponse(400, err.Error()), nil
+    }
 
     existingPattern.UpdatedAt = time.Now()
+    // Replaces any compilations of the previous version
+    existingPattern.CompiledCache = shared.PrecompileCommonLEDCounts(&existingPattern)
+    existingPattern.CompatibleEffectIDs = shared.ComputeCompatibleEffectIDs(&existingPattern)
 
     if err := shared.PutItem(ctx, patternsTable, existingPattern); err != nil {
         return shared.CreateErrorResponse(500, "Failed to update pattern"), nil
@@ -341,13 +578,9 @@ func handleDeletePattern(ctx context.Context, username string, patternID string)
         return shared.CreateErrorResponse(500, "Database error"), nil
     }
 
-    if pattern.PatternID == "" {
-        return shared.CreateErrorResponse(404, "Pattern not found"), nil
-    }
-
     // Verify ownership
-    if pattern.UserID != username {
-        return shared.CreateErrorResponse(403, "Access denied"), nil
+    if pattern.PatternID == "" || pattern.UserID != username {
+        return shared.CreateErrorResponse(404, "Pattern not found"), nil
     }
 
     // Delete pattern
@@ -360,6 +593,115 @@ func handleDeletePattern(ctx context.Context, username string, patternID string)
     }), nil
 }
 
+// previewPixelSize is the width/height in pixels of each LED in preview GIFs
+const previewPixelSize = 16
+
+// handlePatternPreview renders a WLED pattern as an animated GIF
+func handlePatternPreview(ctx context.Context, username string, patternID string, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+    key, _ := attributevalue.MarshalMap(map[string]string{
+        "patternId": patternID,
+    })
+
+    var pattern shared.Pattern
+    if err := shared.GetItem(ctx, patternsTable, key, &pattern); err != nil {
+        return shared.CreateErrorResponse(500, "Database error"), nil
+    }
+
+    // Verify ownership
+    if pattern.PatternID == "" || pattern.UserID != username {
+        return shared.CreateErrorResponse(404, "Pattern not found"), nil
+    }
+
+    if pattern.WLEDState == "" {
+        return shared.CreateErrorResponse(400, "Pattern has no WLED state to preview"), nil
+    }
+
+    frameCount := shared.DefaultPreviewFrames
+    if pattern.PreviewFrameCount > 0 {
+        frameCount = pattern.PreviewFrameCount
+    }
+    if f := request.QueryStringParameters["frames"]; f != "" {
+        n, err := strconv.Atoi(f)
+        if err != nil || n < 1 || n > shared.MaxPreviewFrames {
+            return shared.CreateErrorResponse(400, "frames must be between 1 and "+strconv.Itoa(shared.MaxPreviewFrames)), nil
+        }
+        frameCount = n
+    }
+
+    state, err := shared.ParseWLEDJSON(pattern.WLEDState)
+    if err != nil {
+        return shared.CreateErrorResponse(400, "Invalid WLED state: "+err.Error()), nil
+    }
+
+    // Preview across the full extent of the pattern's segments
+    ledCount := 0
+    for _, seg := range state.Segments {
+        if seg.Stop > ledCount {
+            ledCount = seg.Stop
+        }
+    }
+    if ledCount == 0 {
+        ledCount = 8
+    }
+
+    frames, err := shared.SimulateWLEDFrames(state, frameCount, ledCount)
+    if err != nil {
+        return shared.CreateErrorResponse(400, err.Error()), nil
+    }
+
+    gifBytes, err := encodePreviewGIF(frames)
+    if err != nil {
+        log.Printf("Failed to encode preview GIF: %v", err)
+        return shared.CreateErrorResponse(500, "Failed to render preview"), nil
+    }
+
+    return events.APIGatewayProxyResponse{
+        StatusCode: 200,
+        Headers: map[string]string{
+            "Content-Type":                "image/gif",
+            "Cache-Control":               "private, max-age=300",
+            "Access-Control-Allow-Origin": "*",
+        },
+        Body:            base64.StdEncoding.EncodeToString(gifBytes),
+        IsBase64Encoded: true,
+    }, nil
+}
+
+// encodePreviewGIF draws each frame as a row of LED squares
+func encodePreviewGIF(frames [][]shared.RGBColor) ([]byte, error) {
+    anim := &gif.GIF{}
+    for _, frame := range frames {
+        bounds := image.Rect(0, 0, len(frame)*previewPixelSize, previewPixelSize)
+        img := image.NewPaletted(bounds, previewPalette(frame))
+        for i, c := range frame {
+            rect := image.Rect(i*previewPixelSize, 0, (i+1)*previewPixelSize, previewPixelSize)
+            draw.Draw(img, rect, &image.Uniform{C: color.RGBA{R: c.R, G: c.G, B: c.B, A: 255}}, image.Point{}, draw.Src)
+        }
+        anim.Image = append(anim.Image, img)
+        anim.Delay = append(anim.Delay, shared.SimulatorFrameMs/10) // GIF delay is in 1/100s
+    }
+
+    var buf bytes.Buffer
+    if err := gif.EncodeAll(&buf, anim); err != nil {
+        return nil, err
+    }
+    return buf.Bytes(), nil
+}
+
+// previewPalette builds a GIF palette from the distinct colors in a frame (max 256)
+func previewPalette(frame []shared.RGBColor) color.Palette {
+    palette := color.Palette{color.RGBA{A: 255}}
+    seen := map[shared.RGBColor]bool{{}: true}
+    for _, c := range frame {
+        if seen[c] || len(palette) >= 256 {
+            continue
+        }
+        seen[c] = true
+        palette = append(palette, color.RGBA{R: c.R, G: c.G, B: c.B, A: 255})
+    }
+    return palette
+}
+
 func main() {
-    lambda.Start(handler)
+    lambda.Start(shared.WithMetrics("patterns", shared.WithSessionRotation(shared.WithActivityLog(handler))))
 }
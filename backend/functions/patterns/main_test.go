@@ -0,0 +1,124 @@
+package main
+
+import (
+    "context"
+    "regexp"
+    "strings"
+    "testing"
+
+    "github.com/aws/aws-lambda-go/events"
+
+    "candle-lights/backend/shared"
+)
+
+func TestForeignPatternsLookMissing(t *testing.T) {
+    defer shared.StubDynamoDB(shared.StubOwnershipHandler("lee", "foreign", "sam"))()
+
+    routes := []struct {
+        method, suffix, body string
+    }{
+        {"GET", "", ""},
+        {"GET", "/decode", ""},
+        {"GET", "/preview", ""},
+        {"PUT", "", `{"name":"Dusk"}`},
+        {"DELETE", "", ""},
+        {"POST", "/favorite", ""},
+        {"POST", "/unfavorite", ""},
+        {"POST", "/upgrade-bytecode", ""},
+    }
+    for _, route := range routes {
+        var responses [2]events.APIGatewayProxyResponse
+        for i, patternID := range []string{"foreign", "missing"} {
+            resp, err := handler(context.Background(), events.APIGatewayProxyRequest{
+                HTTPMethod:     route.method,
+                Path:           "/api/patterns/" + patternID + route.suffix,
+                PathParameters: map[string]string{"patternId": patternID},
+                Headers:        map[string]string{"Authorization": "Bearer session-lee"},
+                Body:           route.body,
+            })
+            if err != nil {
+                t.Fatalf("%s %s: %v", route.method, route.suffix, err)
+            }
+            responses[i] = resp
+        }
+        if responses[0].StatusCode != 404 || responses[0].StatusCode != responses[1].StatusCode || responses[0].Body != responses[1].Body {
+            t.Errorf("%s /api/patterns/{id}%s: foreign = %d %s, missing = %d %s; want the same 404", route.method, route.suffix,
+                responses[0].StatusCode, responses[0].Body, responses[1].StatusCode, responses[1].Body)
+        }
+    }
+}
+
+// TestDocumentedRoutesAreRouted checks shared.APIRoutes against the router:
+// every documented patterns route reaches its auth check rather than a 404
+func TestDocumentedRoutesAreRouted(t *testing.T) {
+    param := regexp.MustCompile(`\{([^}]+)\}`)
+    found := 0
+    for _, doc := range shared.APIRoutes {
+        if doc.Service != "patterns" {
+            continue
+        }
+        found++
+        request := events.APIGatewayProxyRequest{HTTPMethod: doc.Method, PathParameters: map[string]string{}}
+        request.Path = param.ReplaceAllStringFunc(doc.Path, func(name string) string {
+            request.PathParameters[name[1:len(name)-1]] = "x"
+            return "x"
+        })
+        resp, err := router.Dispatch(context.Background(), request)
+        if err != nil || resp.StatusCode != 401 {
+            t.Errorf("%s %s without a session = %d, %v; want 401", doc.Method, doc.Path, resp.StatusCode, err)
+        }
+    }
+    if found == 0 {
+        t.Error("no patterns routes in shared.APIRoutes")
+    }
+}
+
+func TestCreatePatternCleansNameAndDescription(t *testing.T) {
+    var stored []shared.Pattern
+    ownership := shared.StubOwnershipHandler("lee", "", "")
+    defer shared.StubDynamoDB(func(call shared.DynamoDBStubCall) (map[string]interface{}, error) {
+        if call.Operation == "PutItem" {
+            var pattern shared.Pattern
+            if err := call.Unmarshal("Item", &pattern); err != nil {
+                return nil, err
+            }
+            stored = append(stored, pattern)
+            return nil, nil
+        }
+        return ownership(call)
+    })()
+
+    create := func(body string) events.APIGatewayProxyResponse {
+        resp, err := handler(context.Background(), events.APIGatewayProxyRequest{
+            HTTPMethod: "POST",
+            Path:       "/api/patterns",
+            Headers:    map[string]string{"Authorization": "Bearer session-lee"},
+            Body:       body,
+        })
+        if err != nil {
+            t.Fatal(err)
+        }
+        return resp
+    }
+
+    resp := create(`{"name":"  Warm\u200b  Candle\u0007 ","description":" Cosy\u202e\nevenings ","type":"candle"}`)
+    if resp.StatusCode != 201 || len(stored) != 1 {
+        t.Fatalf("create = %d %s with %d stored, want 201 and one pattern", resp.StatusCode, resp.Body, len(stored))
+    }
+    if stored[0].Name != "Warm Candle" || stored[0].Description != "Cosy\nevenings" {
+        t.Errorf("stored %q / %q, want the cleaned name and description", stored[0].Name, stored[0].Description)
+    }
+
+    for _, body := range []string{
+        `{"name":" \u200b\t","type":"candle"}`,
+        `{"name":"` + strings.Repeat("n", shared.MaxNameLength+1) + `","type":"candle"}`,
+        `{"name":"Dusk","description":"` + strings.Repeat("d", shared.MaxDescriptionLength+1) + `","type":"candle"}`,
+    } {
+        if resp := create(body); resp.StatusCode != 400 {
+            t.Errorf("create %.40s... = %d, want 400", body, resp.StatusCode)
+        }
+    }
+    if len(stored) != 1 {
+        t.Errorf("%d patterns stored, want only the valid one", len(stored))
+    }
+}
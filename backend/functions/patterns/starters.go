@@ -0,0 +1,70 @@
+package main
+
+import (
+    "context"
+    "log"
+    "time"
+
+    "github.com/aws/aws-lambda-go/events"
+    "github.com/google/uuid"
+
+    "candle-lights/backend/shared"
+)
+
+// PatternListResponse is GET /api/patterns: the usual envelope with the
+// patterns as data, plus startersAvailable for users with none yet
+type PatternListResponse struct {
+    shared.APIResponse
+    StartersAvailable bool `json:"startersAvailable,omitempty"`
+}
+
+// InstallStartersResponse is returned by POST /api/patterns/install-starters
+type InstallStartersResponse struct {
+    Installed []shared.Pattern `json:"installed"`
+    Skipped   []string         `json:"skipped"` // Starter keys the user already has
+}
+
+// handleInstallStarters adds the starter patterns the user doesn't already
+// have, so it can be called again safely
+func handleInstallStarters(ctx context.Context, username string) (events.APIGatewayProxyResponse, error) {
+    existing, err := queryUserPatterns(ctx, username)
+    if err != nil {
+        return shared.CreateErrorResponse(500, "Failed to retrieve patterns"), nil
+    }
+
+    have := make(map[string]bool)
+    for _, p := range existing {
+        if key := shared.StarterKey(p); key != "" {
+            have[key] = true
+        }
+    }
+
+    response := InstallStartersResponse{
+        Installed: []shared.Pattern{},
+        Skipped:   []string{},
+    }
+    now := time.Now()
+    for _, starter := range shared.StarterPatterns {
+        if have[starter.Key] {
+            response.Skipped = append(response.Skipped, starter.Key)
+            continue
+        }
+
+        pattern, err := starter.BuildPattern(username, now)
+        if err != nil {
+            log.Printf("InstallStarters: Failed to build %s: %v", starter.Key, err)
+            return shared.CreateErrorResponse(500, "Failed to compile starter patterns"), nil
+        }
+        pattern.PatternID = uuid.New().String()
+
+        if err := shared.PutItem(ctx, patternsTable, pattern); err != nil {
+            log.Printf("InstallStarters: Failed to save %s: %v", starter.Key, err)
+            return shared.CreateErrorResponse(500, "Failed to save starter patterns"), nil
+        }
+        response.Installed = append(response.Installed, pattern)
+    }
+
+    log.Printf("InstallStarters: Installed %d, skipped %d for %s", len(response.Installed), len(response.Skipped), username)
+
+    return shared.CreateSuccessResponse(201, response), nil
+}
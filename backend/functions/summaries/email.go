@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	htmltemplate "html/template"
+	"text/template"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2"
+	sestypes "github.com/aws/aws-sdk-go-v2/service/sesv2/types"
+
+	"candle-lights/backend/shared"
+)
+
+var sesClient *sesv2.Client
+
+// summaryEmailData is what the email templates render
+type summaryEmailData struct {
+	WeeklySummary
+	Username       string
+	DashboardURL   string
+	UnsubscribeURL string
+}
+
+const summarySubject = "Your week of lights"
+
+var summaryFuncs = map[string]interface{}{
+	"date": func(d summaryEmailData) string {
+		return d.From.Format("Jan 2") + " - " + d.To.Format("Jan 2, 2006")
+	},
+}
+
+var summaryHTML = htmltemplate.Must(htmltemplate.New("summary").Funcs(summaryFuncs).Parse(`<p>Hi {{.Username}}, here's your week ({{date .}}).</p>
+
+{{if .TopPatterns}}<h3>{{if .FirstSummary}}Your most used patterns{{else}}Patterns that ran most{{end}}</h3>
+<table>
+{{range .TopPatterns}}<tr><td>{{.Name}}</td><td>{{.Applies}} time{{if ne .Applies 1}}s{{end}}</td></tr>
+{{end}}</table>{{end}}
+
+{{if .OfflineDevices}}<h3>Devices that went offline</h3>
+<table>
+{{range .OfflineDevices}}<tr><td>{{.Name}}</td><td>{{.Episodes}} time{{if ne .Episodes 1}}s{{end}}{{if .OfflineNow}} (still offline){{end}}</td></tr>
+{{end}}</table>{{end}}
+
+{{if .ClaudeTokens}}<p>Glow Blaster used <strong>{{.ClaudeTokens}}</strong> Claude tokens.</p>{{end}}
+{{if .Changes}}<p>You made <strong>{{.Changes}}</strong> change{{if ne .Changes 1}}s{{end}} in the app.</p>{{end}}
+
+<p><a href="{{.DashboardURL}}">Open the dashboard</a></p>
+<p style="font-size: small"><a href="{{.UnsubscribeURL}}">Unsubscribe from the weekly summary</a></p>`))
+
+var summaryText = template.Must(template.New("summary").Funcs(summaryFuncs).Parse(`Hi {{.Username}}, here's your week ({{date .}}).
+{{if .TopPatterns}}
+{{if .FirstSummary}}Your most used patterns{{else}}Patterns that ran most{{end}}:
+{{range .TopPatterns}}  {{.Name}}: {{.Applies}}
+{{end}}{{end}}{{if .OfflineDevices}}
+Devices that went offline:
+{{range .OfflineDevices}}  {{.Name}}: {{.Episodes}}{{if .OfflineNow}} (still offline){{end}}
+{{end}}{{end}}{{if .ClaudeTokens}}
+Glow Blaster used {{.ClaudeTokens}} Claude tokens.
+{{end}}{{if .Changes}}
+Changes made in the app: {{.Changes}}
+{{end}}
+Dashboard: {{.DashboardURL}}
+
+Unsubscribe from the weekly summary: {{.UnsubscribeURL}}
+`))
+
+// renderSummaryEmail renders the summary email for username, with a link
+// that unsubscribes them
+func renderSummaryEmail(username string, summary WeeklySummary) (shared.AlertEmail, error) {
+	token, err := shared.IssueUnsubscribeToken(shared.UnsubscribeTarget{UserID: username, Email: shared.EmailWeeklySummary})
+	if err != nil {
+		return shared.AlertEmail{}, err
+	}
+	data := summaryEmailData{
+		WeeklySummary:  summary,
+		Username:       username,
+		DashboardURL:   shared.DashboardURL(),
+		UnsubscribeURL: shared.UnsubscribeURL(token),
+	}
+
+	var html, text bytes.Buffer
+	if err := summaryHTML.Execute(&html, data); err != nil {
+		return shared.AlertEmail{}, err
+	}
+	if err := summaryText.Execute(&text, data); err != nil {
+		return shared.AlertEmail{}, err
+	}
+	return shared.AlertEmail{Subject: summarySubject, Text: text.String(), HTML: html.String()}, nil
+}
+
+func sendSummaryEmail(ctx context.Context, to string, email shared.AlertEmail) error {
+	if sesClient == nil {
+		cfg, err := config.LoadDefaultConfig(ctx)
+		if err != nil {
+			return err
+		}
+		sesClient = sesv2.NewFromConfig(cfg)
+	}
+
+	_, err := sesClient.SendEmail(ctx, &sesv2.SendEmailInput{
+		FromEmailAddress: aws.String(notificationFromEmail),
+		Destination: &sestypes.Destination{
+			ToAddresses: []string{to},
+		},
+		Content: &sestypes.EmailContent{
+			Simple: &sestypes.Message{
+				Subject: &sestypes.Content{Data: aws.String(email.Subject)},
+				Body: &sestypes.Body{
+					Text: &sestypes.Content{Data: aws.String(email.Text)},
+					Html: &sestypes.Content{Data: aws.String(email.HTML)},
+				},
+			},
+		},
+	})
+	return err
+}
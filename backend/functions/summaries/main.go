@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"candle-lights/backend/shared"
+)
+
+var (
+	usersTable            = os.Getenv("USERS_TABLE")
+	patternsTable         = os.Getenv("PATTERNS_TABLE")
+	devicesTable          = os.Getenv("DEVICES_TABLE")
+	conversationsTable    = os.Getenv("CONVERSATIONS_TABLE")
+	activityLogTable      = os.Getenv("ACTIVITY_LOG_TABLE")
+	weeklySummariesTable  = os.Getenv("WEEKLY_SUMMARIES_TABLE")
+	notificationFromEmail = os.Getenv("NOTIFICATION_FROM_EMAIL")
+)
+
+// deadlineMargin is how close to the Lambda timeout the job stops starting
+// users. The next scheduled run picks up where it stopped.
+const deadlineMargin = 30 * time.Second
+
+// summaryRecord is a user's last summary, keyed "user#{username}": the week
+// it was sent for, and the running totals it was computed from
+type summaryRecord struct {
+	SummaryID      string         `dynamodbav:"summaryId"`
+	Week           string         `dynamodbav:"week"`                     // summaryWeek of the last summary
+	SentAt         *time.Time     `dynamodbav:"sentAt,omitempty"`         // Unset when there was nothing to send
+	PatternApplies map[string]int `dynamodbav:"patternApplies,omitempty"` // patternId -> applyCount
+	OfflineAlerts  map[string]int `dynamodbav:"offlineAlerts,omitempty"`  // deviceId -> offlineAlertCount
+}
+
+// summaryRun marks a week's job finished, keyed "run#{week}", so the
+// remaining scheduled runs that week return straight away
+type summaryRun struct {
+	SummaryID  string    `dynamodbav:"summaryId"`
+	Week       string    `dynamodbav:"week"`
+	FinishedAt time.Time `dynamodbav:"finishedAt"`
+	ExpiresAt  int64     `dynamodbav:"expiresAt"` // TTL
+}
+
+// summaryWeek names the ISO week of t, e.g. "2026-W42"
+func summaryWeek(t time.Time) string {
+	year, week := t.ISOWeek()
+	return fmt.Sprintf("%d-W%02d", year, week)
+}
+
+func recordKey(summaryID string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"summaryId": &types.AttributeValueMemberS{Value: summaryID},
+	}
+}
+
+// handleWeeklySummaries emails each opted-in user with an email address a
+// summary of their week. It runs several times each Sunday: users already
+// sent this week's summary are skipped, so a run that stops at its deadline
+// is finished by the next one.
+func handleWeeklySummaries(ctx context.Context) error {
+	log.Printf("=== Weekly summaries ===")
+	if notificationFromEmail == "" || !shared.EmailLinksEnabled() {
+		log.Printf("Weekly summaries need NOTIFICATION_FROM_EMAIL and EMAIL_LINK_SECRET; skipping")
+		return nil
+	}
+
+	now := time.Now().UTC()
+	week := summaryWeek(now)
+
+	var run summaryRun
+	if err := shared.GetItem(ctx, weeklySummariesTable, recordKey("run#"+week), &run); err != nil {
+		return fmt.Errorf("failed to read run record: %v", err)
+	}
+	if run.Week == week {
+		log.Printf("Weekly summaries for %s already finished at %s", week, run.FinishedAt.Format(time.RFC3339))
+		return nil
+	}
+
+	client, err := shared.InitDynamoDB()
+	if err != nil {
+		return err
+	}
+
+	sent, skipped, failed := 0, 0, 0
+	paginator := dynamodb.NewScanPaginator(client, &dynamodb.ScanInput{
+		TableName:            aws.String(usersTable),
+		ProjectionExpression: aws.String("username, email, notificationSettings"),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to scan users: %v", err)
+		}
+
+		var users []shared.User
+		if err := attributevalue.UnmarshalListOfMaps(page.Items, &users); err != nil {
+			return fmt.Errorf("failed to read users: %v", err)
+		}
+
+		for _, user := range users {
+			if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < deadlineMargin {
+				log.Printf("Weekly summaries stopping before the timeout (%d sent, %d skipped, %d failed); the next run continues", sent, skipped, failed)
+				return nil
+			}
+			if user.Email == "" || user.NotificationSettings == nil || !user.NotificationSettings.WeeklySummary {
+				continue
+			}
+
+			didSend, err := summarizeUser(ctx, user, week, now)
+			switch {
+			case err != nil:
+				log.Printf("Weekly summary failed for user %s: %v", user.Username, err)
+				failed++
+			case didSend:
+				sent++
+			default:
+				skipped++
+			}
+		}
+	}
+
+	log.Printf("Weekly summaries for %s complete: %d sent, %d skipped, %d failed", week, sent, skipped, failed)
+	if failed > 0 {
+		// Leave the run open so the next run retries the failures
+		return nil
+	}
+	run = summaryRun{
+		SummaryID:  "run#" + week,
+		Week:       week,
+		FinishedAt: time.Now().UTC(),
+		ExpiresAt:  now.Add(30 * 24 * time.Hour).Unix(),
+	}
+	if err := shared.PutItem(ctx, weeklySummariesTable, run); err != nil {
+		log.Printf("Failed to record the %s run as finished: %v", week, err)
+	}
+	return nil
+}
+
+// summarizeUser sends user this week's summary unless it has already been
+// sent, reporting whether an email went out. Weeks with nothing to report
+// send nothing but still record the totals. The record is saved after the
+// email is sent, so a failure to save can repeat the email on the next run
+// but never skips it.
+func summarizeUser(ctx context.Context, user shared.User, week string, now time.Time) (bool, error) {
+	summaryID := "user#" + user.Username
+	var previous summaryRecord
+	if err := shared.GetItem(ctx, weeklySummariesTable, recordKey(summaryID), &previous); err != nil {
+		return false, err
+	}
+	if previous.Week == week {
+		return false, nil
+	}
+
+	summary, record, err := buildWeeklySummary(ctx, user.Username, previous, now)
+	if err != nil {
+		return false, err
+	}
+	record.SummaryID = summaryID
+	record.Week = week
+
+	sent := false
+	if !summary.Empty() {
+		email, err := renderSummaryEmail(user.Username, summary)
+		if err != nil {
+			return false, err
+		}
+		if err := sendSummaryEmail(ctx, user.Email, email); err != nil {
+			return false, err
+		}
+		sentAt := time.Now().UTC()
+		record.SentAt = &sentAt
+		sent = true
+		log.Printf("Sent weekly summary for %s to user %s", week, user.Username)
+	}
+
+	if err := shared.PutItem(ctx, weeklySummariesTable, record); err != nil {
+		return sent, fmt.Errorf("failed to save summary record: %v", err)
+	}
+	return sent, nil
+}
+
+func main() {
+	lambda.Start(handleWeeklySummaries)
+}
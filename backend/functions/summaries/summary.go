@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"candle-lights/backend/shared"
+)
+
+// summaryWindow is the period each summary covers
+const summaryWindow = 7 * 24 * time.Hour
+
+// maxTopPatterns bounds the patterns listed in a summary
+const maxTopPatterns = 5
+
+// PatternUsage is how often a pattern was applied during the week
+type PatternUsage struct {
+	Name    string
+	Applies int
+}
+
+// DeviceOffline is a device that went offline during the week
+type DeviceOffline struct {
+	Name       string
+	Episodes   int  // Offline alerts raised for it this week
+	OfflineNow bool // Still offline when the summary was built
+}
+
+// WeeklySummary is what one user's email reports
+type WeeklySummary struct {
+	From, To time.Time
+	// Without last week's counts to compare with, TopPatterns are all-time
+	// totals rather than this week's, and OfflineDevices is empty
+	FirstSummary   bool
+	TopPatterns    []PatternUsage
+	OfflineDevices []DeviceOffline
+	ClaudeTokens   int
+	Changes        int // Changes made through the app (activity log entries)
+}
+
+// Empty reports whether there's nothing worth emailing
+func (s WeeklySummary) Empty() bool {
+	return len(s.TopPatterns) == 0 && len(s.OfflineDevices) == 0 && s.ClaudeTokens == 0 && s.Changes == 0
+}
+
+// buildWeeklySummary aggregates the week ending now for user. Each table is
+// read only through the user's own partition of its userId-index, limited
+// to the last week where the table has timestamps. Pattern applies and
+// offline alerts are running totals, so the week's share is the change from
+// the counts saved with the previous summary; the new counts are returned in
+// record for the next one.
+func buildWeeklySummary(ctx context.Context, username string, previous summaryRecord, now time.Time) (WeeklySummary, summaryRecord, error) {
+	since := now.Add(-summaryWindow)
+	summary := WeeklySummary{From: since, To: now, FirstSummary: previous.Week == ""}
+	record := summaryRecord{
+		PatternApplies: map[string]int{},
+		OfflineAlerts:  map[string]int{},
+	}
+
+	var patterns []shared.Pattern
+	if err := queryUser(ctx, patternsTable, username, "", since, "patternId, #name, applyCount", &patterns); err != nil {
+		return summary, record, err
+	}
+	for _, pattern := range patterns {
+		record.PatternApplies[pattern.PatternID] = pattern.ApplyCount
+		applies := pattern.ApplyCount - previous.PatternApplies[pattern.PatternID]
+		if applies > 0 {
+			summary.TopPatterns = append(summary.TopPatterns, PatternUsage{Name: pattern.Name, Applies: applies})
+		}
+	}
+	sort.SliceStable(summary.TopPatterns, func(i, j int) bool {
+		if summary.TopPatterns[i].Applies != summary.TopPatterns[j].Applies {
+			return summary.TopPatterns[i].Applies > summary.TopPatterns[j].Applies
+		}
+		return summary.TopPatterns[i].Name < summary.TopPatterns[j].Name
+	})
+	if len(summary.TopPatterns) > maxTopPatterns {
+		summary.TopPatterns = summary.TopPatterns[:maxTopPatterns]
+	}
+
+	var devices []shared.Device
+	if err := queryUser(ctx, devicesTable, username, "", since, "deviceId, #name, isOnline, isHidden, offlineAlertCount", &devices); err != nil {
+		return summary, record, err
+	}
+	for _, device := range devices {
+		record.OfflineAlerts[device.DeviceID] = device.OfflineAlertCount
+		episodes := device.OfflineAlertCount - previous.OfflineAlerts[device.DeviceID]
+		if device.IsHidden || summary.FirstSummary || episodes <= 0 {
+			continue
+		}
+		summary.OfflineDevices = append(summary.OfflineDevices, DeviceOffline{Name: device.Name, Episodes: episodes, OfflineNow: !device.IsOnline})
+	}
+	sort.SliceStable(summary.OfflineDevices, func(i, j int) bool {
+		return summary.OfflineDevices[i].Episodes > summary.OfflineDevices[j].Episodes
+	})
+
+	var conversations []shared.Conversation
+	if err := queryUser(ctx, conversationsTable, username, "updatedAt", since, "messages", &conversations); err != nil {
+		return summary, record, err
+	}
+	for _, conversation := range conversations {
+		for _, message := range conversation.Messages {
+			if !message.Timestamp.Before(since) {
+				summary.ClaudeTokens += message.TokensIn + message.TokensOut
+			}
+		}
+	}
+
+	changes, err := countUserSince(ctx, activityLogTable, username, "createdAt", since)
+	if err != nil {
+		return summary, record, err
+	}
+	summary.Changes = changes
+
+	return summary, record, nil
+}
+
+// queryUser reads username's items from table's userId-index, following
+// pages. With timeAttr set only items whose timeAttr is at or after since are
+// returned. projection may use #name for the reserved word name.
+func queryUser(ctx context.Context, table, username, timeAttr string, since time.Time, projection string, results interface{}) error {
+	client, err := shared.InitDynamoDB()
+	if err != nil {
+		return err
+	}
+
+	input := userQueryInput(table, username, timeAttr, since)
+	input.ProjectionExpression = aws.String(projection)
+	if strings.Contains(projection, "#name") {
+		if input.ExpressionAttributeNames == nil {
+			input.ExpressionAttributeNames = map[string]string{}
+		}
+		input.ExpressionAttributeNames["#name"] = "name"
+	}
+
+	var items []map[string]types.AttributeValue
+	paginator := dynamodb.NewQueryPaginator(client, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		items = append(items, page.Items...)
+	}
+	return attributevalue.UnmarshalListOfMaps(items, results)
+}
+
+// countUserSince counts username's items in table whose timeAttr is at or
+// after since
+func countUserSince(ctx context.Context, table, username, timeAttr string, since time.Time) (int, error) {
+	client, err := shared.InitDynamoDB()
+	if err != nil {
+		return 0, err
+	}
+
+	input := userQueryInput(table, username, timeAttr, since)
+	input.Select = types.SelectCount
+
+	count := 0
+	paginator := dynamodb.NewQueryPaginator(client, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return 0, err
+		}
+		count += int(page.Count)
+	}
+	return count, nil
+}
+
+// userQueryInput queries table's userId-index for username, filtered to
+// timeAttr at or after since when timeAttr is set. Timestamps are stored as
+// RFC 3339 UTC strings, which compare in time order.
+func userQueryInput(table, username, timeAttr string, since time.Time) *dynamodb.QueryInput {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(table),
+		IndexName:              aws.String("userId-index"),
+		KeyConditionExpression: aws.String("userId = :userId"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":userId": &types.AttributeValueMemberS{Value: username},
+		},
+	}
+	if timeAttr != "" {
+		input.FilterExpression = aws.String("#since >= :since")
+		input.ExpressionAttributeNames = map[string]string{"#since": timeAttr}
+		input.ExpressionAttributeValues[":since"] = &types.AttributeValueMemberS{Value: since.UTC().Format(time.RFC3339)}
+	}
+	return input
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "math"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/aws/aws-lambda-go/events"
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/config"
+    "github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+    "github.com/aws/aws-sdk-go-v2/service/sqs"
+    sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+    "github.com/google/uuid"
+
+    "candle-lights/backend/shared"
+)
+
+var (
+    applyJobsTable   = os.Getenv("APPLY_JOBS_TABLE")
+    applyJobQueueURL = os.Getenv("APPLY_JOB_QUEUE_URL")
+    applyJobQueueARN = os.Getenv("APPLY_JOB_QUEUE_ARN")
+    applyJobDLQARN   = os.Getenv("APPLY_JOB_DLQ_ARN")
+)
+
+// defaultAsyncApplyThreshold is the largest group applied synchronously when
+// APPLY_ASYNC_THRESHOLD isn't set
+const defaultAsyncApplyThreshold = 10
+
+// Particle calls are retried within one delivery before SQS redelivers
+const (
+    applySendAttempts = 3
+    applyRetryBackoff = 2 * time.Second
+)
+
+// applyJobMessage is the SQS message that sends a prepared pattern to one strip
+type applyJobMessage struct {
+    JobID      string   `json:"jobId"`
+    TargetKey  string   `json:"targetKey"`
+    UserID     string   `json:"userId"`
+    DeviceID   string   `json:"deviceId"`
+    DeviceName string   `json:"deviceName,omitempty"`
+    ParticleID string   `json:"particleId"`
+    Pin        int      `json:"pin"`       // Logical pin, as stored on the strip
+    DevicePin  int      `json:"devicePin"` // Physical pin sent to the firmware
+    PatternID  string   `json:"patternId"`
+    Bytecode   []byte   `json:"bytecode"`
+    Warnings   []string `json:"warnings,omitempty"`
+
+    CommandTimeoutSeconds int `json:"commandTimeoutSeconds,omitempty"` // The device's, at queue time
+    CommandBurst          int `json:"commandBurst,omitempty"`          // The device's rate limit, at queue time
+    CommandsPerMinute     int `json:"commandsPerMinute,omitempty"`
+
+    delaySeconds int // SQS delay spacing the device's messages within its rate limit
+}
+
+// maxSQSDelaySeconds is the longest delay SQS allows on a message
+const maxSQSDelaySeconds = 900
+
+// ApplyJobResponse is returned when an apply is handed to the queue worker
+type ApplyJobResponse struct {
+    Message string          `json:"message"`
+    Job     shared.ApplyJob `json:"job"`
+}
+
+// asyncApplyThreshold is the largest fan-out applied synchronously
+func asyncApplyThreshold() int {
+    if value, err := strconv.Atoi(os.Getenv("APPLY_ASYNC_THRESHOLD")); err == nil && value >= 0 {
+        return value
+    }
+    return defaultAsyncApplyThreshold
+}
+
+// useApplyQueue reports whether a fan-out to targets strips goes through the
+// queue worker. Without a queue configured everything stays synchronous.
+func useApplyQueue(targets int) bool {
+    return applyJobQueueURL != "" && applyJobsTable != "" && targets > asyncApplyThreshold()
+}
+
+// startApplyJob compiles the pattern once per LED count, with any group
+// overrides and variation applied, records a job, and queues one message per strip. Strips
+// that can't be applied (missing, offline, not owned, or failing to compile)
+// are failed up front.
+func startApplyJob(ctx context.Context, username, groupID string, members []shared.VirtualGroupMember, pattern shared.Pattern, overrides shared.OutputOverrides, variation *groupVariation) (events.APIGatewayProxyResponse, error) {
+    devices, err := loadMemberDevices(ctx, members)
+    if err != nil {
+        log.Printf("Failed to load devices for apply job: %v", err)
+        return shared.CreateErrorResponse(500, "Database error"), nil
+    }
+    deviceByID := make(map[string]shared.Device, len(devices))
+    for _, device := range devices {
+        deviceByID[device.DeviceID] = device
+    }
+
+    now := time.Now()
+    job := shared.ApplyJob{
+        JobID:     uuid.New().String(),
+        UserID:    username,
+        GroupID:   groupID,
+        PatternID: pattern.PatternID,
+        Status:    shared.ApplyJobRunning,
+        Targets:   make(map[string]shared.ApplyJobTarget, len(members)),
+        CreatedAt: now,
+        UpdatedAt: now,
+        ExpiresAt: shared.ApplyJobExpiresAt(now),
+    }
+
+    type compiled struct {
+        bytecode []byte
+        source   string
+        warnings []string
+        err      error
+    }
+    // Strips with their own speed multiplier or variation colors compile differently
+    type compileKey struct {
+        ledCount int
+        speed    float64
+        colors   string
+    }
+    compiledByLEDCount := make(map[compileKey]compiled)
+
+    var messages []applyJobMessage
+    for position, member := range members {
+        key := shared.ApplyTargetKey(member.DeviceID, member.Pin)
+        if _, dup := job.Targets[key]; dup {
+            continue
+        }
+        target := shared.ApplyJobTarget{DeviceID: member.DeviceID, Pin: member.Pin, Status: shared.ApplyTargetPending}
+
+        device, ok := deviceByID[member.DeviceID]
+        switch {
+        case !ok:
+            target.Error = "Device not found"
+        case device.UserID != username:
+            target.Error = "Access denied"
+        case !device.IsOnline:
+            target.Error = "Device is offline"
+        }
+        target.DeviceName = device.Name
+
+        if target.Error == "" {
+            ledCount := 8 // default
+            for _, strip := range device.LEDStrips {
+                if strip.Pin == member.Pin {
+                    ledCount = strip.LEDCount
+                    break
+                }
+            }
+
+            memberOverrides, variationApplied, variationWarning := variation.forMember(device, position, overrides)
+            ck := compileKey{ledCount: ledCount, speed: device.StripSpeedMultiplier(member.Pin), colors: strings.Join(memberOverrides.Colors, "/")}
+            c, ok := compiledByLEDCount[ck]
+            if !ok {
+                c.bytecode, c.source, c.warnings, c.err = shared.CompileForLEDCountWithOverrides(&pattern, ledCount, shared.StripOutputOverrides(device, member.Pin, memberOverrides))
+                compiledByLEDCount[ck] = c
+            }
+            target.Warnings = c.warnings
+            if variationWarning != "" {
+                target.Warnings = append(append([]string(nil), c.warnings...), variationWarning)
+            }
+            target.Variation = variationApplied
+            target.BinarySource = c.source
+            if c.err == nil {
+                // Checked per device, as free memory differs between devices
+                _, c.err = shared.CheckBytecodeMemory(device, c.bytecode, ledCount)
+            }
+            if c.err != nil {
+                target.Error = c.err.Error()
+            } else {
+                messages = append(messages, applyJobMessage{
+                    JobID:      job.JobID,
+                    TargetKey:  key,
+                    UserID:     username,
+                    DeviceID:   device.DeviceID,
+                    DeviceName: device.Name,
+                    ParticleID: device.ParticleID,
+                    Pin:        member.Pin,
+                    DevicePin:  device.ResolvePin(member.Pin),
+                    PatternID:  pattern.PatternID,
+                    Bytecode:   c.bytecode,
+                    Warnings:   target.Warnings,
+
+                    CommandTimeoutSeconds: device.CommandTimeoutSeconds,
+                    CommandBurst:          device.CommandBurst,
+                    CommandsPerMinute:     device.CommandsPerMinute,
+                })
+            }
+        }
+
+        if target.Error != "" {
+            target.Status = shared.ApplyTargetFailed
+            job.Failed++
+        }
+        job.Targets[key] = target
+    }
+    job.Total = len(job.Targets)
+    scheduleApplyMessages(ctx, messages, deviceByID)
+    if len(messages) == 0 {
+        job.Status = shared.ApplyJobCompleted
+    }
+
+    if err := shared.PutItem(ctx, applyJobsTable, job); err != nil {
+        log.Printf("Failed to create apply job: %v", err)
+        return shared.CreateErrorResponse(500, "Failed to create apply job"), nil
+    }
+
+    if queued, err := enqueueApplyMessages(ctx, messages); err != nil {
+        // Messages that did go out still run; fail the rest so the job can finish
+        log.Printf("Failed to queue apply job %s after %d of %d messages: %v", job.JobID, queued, len(messages), err)
+        for _, msg := range messages[queued:] {
+            if _, finishErr := shared.FinishApplyTarget(ctx, job.JobID, msg.TargetKey, shared.ApplyTargetFailed, "Failed to queue: "+err.Error(), msg.Warnings); finishErr != nil {
+                log.Printf("Failed to mark target %s of job %s failed: %v", msg.TargetKey, job.JobID, finishErr)
+            }
+        }
+        if queued == 0 {
+            return shared.CreateErrorResponse(500, "Failed to queue apply job"), nil
+        }
+    }
+
+    log.Printf("Queued apply job %s: %d strips queued, %d failed up front, %d LED counts compiled",
+        job.JobID, len(messages), job.Failed, len(compiledByLEDCount))
+
+    message := fmt.Sprintf("Applying pattern to %d strips; poll /api/apply-jobs/%s for progress", len(messages), job.JobID)
+    if !overrides.IsZero() {
+        message += fmt.Sprintf(" (group overrides: %s)", overrides)
+    }
+    if variation.Variation != "" {
+        message += fmt.Sprintf(" (variation: %s)", variation.Variation)
+    }
+
+    return shared.CreateSuccessResponse(202, ApplyJobResponse{
+        Message: message,
+        Job:     job,
+    }), nil
+}
+
+// scheduleApplyMessages delays each device's messages so they arrive within
+// its rate limit, rather than all at once with most of them refused
+func scheduleApplyMessages(ctx context.Context, messages []applyJobMessage, deviceByID map[string]shared.Device) {
+    byDevice := make(map[string][]int)
+    for i, msg := range messages {
+        byDevice[msg.DeviceID] = append(byDevice[msg.DeviceID], i)
+    }
+
+    for deviceID, indexes := range byDevice {
+        schedule := shared.DeviceCommandSchedule(ctx, deviceByID[deviceID], len(indexes))
+        for n, i := range indexes {
+            delay := int(math.Ceil(schedule[n].Seconds()))
+            if delay > maxSQSDelaySeconds {
+                delay = maxSQSDelaySeconds
+            }
+            messages[i].delaySeconds = delay
+        }
+        if last := schedule[len(schedule)-1]; last > 0 {
+            log.Printf("Spreading %d strips on device %s over %v for its rate limit", len(indexes), deviceID, last)
+        }
+    }
+}
+
+// enqueueApplyMessages sends messages in SQS batches, returning how many were
+// queued before any error
+func enqueueApplyMessages(ctx context.Context, messages []applyJobMessage) (int, error) {
+    if len(messages) == 0 {
+        return 0, nil
+    }
+
+    if sqsClient == nil {
+        cfg, err := config.LoadDefaultConfig(ctx)
+        if err != nil {
+            return 0, err
+        }
+        sqsClient = sqs.NewFromConfig(cfg)
+    }
+
+    const batchSize = 10 // SQS SendMessageBatch limit
+    for start := 0; start < len(messages); start += batchSize {
+        end := start + batchSize
+        if end > len(messages) {
+            end = len(messages)
+        }
+
+        entries := make([]sqstypes.SendMessageBatchRequestEntry, 0, end-start)
+        for i, msg := range messages[start:end] {
+            body, err := json.Marshal(msg)
+            if err != nil {
+                return start, err
+            }
+            entries = append(entries, sqstypes.SendMessageBatchRequestEntry{
+                Id:           aws.String(strconv.Itoa(i)),
+                MessageBody:  aws.String(string(body)),
+                DelaySeconds: int32(msg.delaySeconds),
+            })
+        }
+
+        output, err := sqsClient.SendMessageBatch(ctx, &sqs.SendMessageBatchInput{
+            QueueUrl: aws.String(applyJobQueueURL),
+            Entries:  entries,
+        })
+        if err != nil {
+            return start, err
+        }
+        if len(output.Failed) > 0 {
+            return start, fmt.Errorf("%d messages rejected: %s", len(output.Failed), aws.ToString(output.Failed[0].Message))
+        }
+    }
+    return len(messages), nil
+}
+
+// handleGetApplyJob returns an apply job's per-strip progress
+func handleGetApplyJob(ctx context.Context, username, jobID string) (events.APIGatewayProxyResponse, error) {
+    jobKey, _ := attributevalue.MarshalMap(map[string]string{
+        "jobId": jobID,
+    })
+
+    var job shared.ApplyJob
+    if err := shared.GetItem(ctx, applyJobsTable, jobKey, &job); err != nil {
+        log.Printf("Failed to get apply job: %v", err)
+        return shared.CreateErrorResponse(500, "Database error"), nil
+    }
+
+    if job.JobID == "" || job.UserID != username {
+        return shared.CreateErrorResponse(404, "Apply job not found"), nil
+    }
+
+    return shared.CreateSuccessResponse(200, job), nil
+}
+
+// handleApplyJobMessages sends queued patterns to their strips. Failed
+// messages are reported individually so SQS redelivers only those; after the
+// queue's receive limit they move to the dead-letter queue.
+func handleApplyJobMessages(ctx context.Context, event events.SQSEvent) events.SQSEventResponse {
+    var response events.SQSEventResponse
+    for _, record := range event.Records {
+        var msg applyJobMessage
+        if err := json.Unmarshal([]byte(record.Body), &msg); err != nil || msg.JobID == "" {
+            log.Printf("Ignoring malformed apply job message %s: %v", record.MessageId, err)
+            continue
+        }
+
+        if err := applyJobTarget(ctx, msg); err != nil {
+            log.Printf("Apply job %s target %s failed, will retry: %v", msg.JobID, msg.TargetKey, err)
+            response.BatchItemFailures = append(response.BatchItemFailures, events.SQSBatchItemFailure{
+                ItemIdentifier: record.MessageId,
+            })
+        }
+    }
+    return response
+}
+
+// applyJobTarget sends one strip's bytecode, retrying transient Particle errors
+func applyJobTarget(ctx context.Context, msg applyJobMessage) error {
+    user, errResp := getUserWithToken(ctx, msg.UserID)
+    if errResp != nil {
+        return finishApplyJobTarget(ctx, msg, shared.ApplyTargetFailed, "Particle token not configured")
+    }
+
+    device := shared.Device{
+        DeviceID:              msg.DeviceID,
+        Name:                  msg.DeviceName,
+        ParticleID:            msg.ParticleID,
+        CommandTimeoutSeconds: msg.CommandTimeoutSeconds,
+        CommandBurst:          msg.CommandBurst,
+        CommandsPerMinute:     msg.CommandsPerMinute,
+    }
+    timed := newTimedCaller(ctx, device, user.ParticleToken)
+
+    var sendErr error
+    for attempt := 1; attempt <= applySendAttempts; attempt++ {
+        sendErr = sendBytecodeToDevice(timed.Call, msg.ParticleID, msg.DevicePin, msg.Bytecode)
+        if sendErr == nil {
+            break
+        }
+        log.Printf("Apply job %s target %s attempt %d failed: %v", msg.JobID, msg.TargetKey, attempt, sendErr)
+        if attempt < applySendAttempts {
+            time.Sleep(applyRetryBackoff * time.Duration(attempt))
+        }
+    }
+    shared.CountPatternApply("apply-jobs", sendErr == nil)
+
+    if sendErr != nil {
+        if err := shared.RecordApplyFailure(ctx, msg.JobID, msg.TargetKey, sendErr.Error()); err != nil {
+            if errors.Is(err, shared.ErrApplyTargetDone) {
+                return nil
+            }
+            log.Printf("Failed to record failure for apply job %s target %s: %v", msg.JobID, msg.TargetKey, err)
+        }
+        return sendErr
+    }
+
+    if warning := timed.RecordIfSlow(ctx, devicesTable); warning != "" {
+        msg.Warnings = append(msg.Warnings, warning)
+    }
+
+    if msg.PatternID != "" {
+        if err := setStripPatternID(ctx, msg.DeviceID, msg.Pin, msg.PatternID); err != nil {
+            log.Printf("Warning: Failed to update device %s strip patternId: %v", msg.DeviceID, err)
+        }
+        if err := shared.IncrementPatternApplyCount(ctx, patternsTable, msg.PatternID); err != nil {
+            log.Printf("Warning: Failed to increment apply count for pattern %s: %v", msg.PatternID, err)
+        }
+    }
+
+    return finishApplyJobTarget(ctx, msg, shared.ApplyTargetSucceeded, "")
+}
+
+// finishApplyJobTarget records a target's final status, ignoring duplicates
+func finishApplyJobTarget(ctx context.Context, msg applyJobMessage, status, errMsg string) error {
+    job, err := shared.FinishApplyTarget(ctx, msg.JobID, msg.TargetKey, status, errMsg, msg.Warnings)
+    if errors.Is(err, shared.ErrApplyTargetDone) {
+        log.Printf("Apply job %s target %s already finished", msg.JobID, msg.TargetKey)
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    if job != nil {
+        log.Printf("Completed apply job %s: %d succeeded, %d failed", job.JobID, job.Succeeded, job.Failed)
+    }
+    return nil
+}
+
+// handleApplyJobDeadLetters permanently fails targets whose messages ran out
+// of retries, keeping the last error the worker recorded
+func handleApplyJobDeadLetters(ctx context.Context, event events.SQSEvent) error {
+    for _, record := range event.Records {
+        var msg applyJobMessage
+        if err := json.Unmarshal([]byte(record.Body), &msg); err != nil || msg.JobID == "" {
+            log.Printf("Ignoring malformed apply job dead letter %s: %v", record.MessageId, err)
+            continue
+        }
+
+        jobKey, _ := attributevalue.MarshalMap(map[string]string{
+            "jobId": msg.JobID,
+        })
+
+        var job shared.ApplyJob
+        if err := shared.GetItem(ctx, applyJobsTable, jobKey, &job); err != nil {
+            return err
+        }
+
+        errMsg := job.Targets[msg.TargetKey].Error
+        if errMsg == "" {
+            errMsg = "Gave up after repeated failures"
+        }
+
+        if err := finishApplyJobTarget(ctx, msg, shared.ApplyTargetFailed, errMsg); err != nil {
+            return fmt.Errorf("failed to mark apply job %s target %s failed: %v", msg.JobID, msg.TargetKey, err)
+        }
+        log.Printf("Apply job %s target %s permanently failed: %s", msg.JobID, msg.TargetKey, errMsg)
+    }
+    return nil
+}
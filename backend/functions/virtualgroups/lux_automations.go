@@ -0,0 +1,413 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "log"
+    "strconv"
+    "time"
+
+    "github.com/aws/aws-lambda-go/events"
+    "github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+    "github.com/google/uuid"
+
+    "candle-lights/backend/shared"
+)
+
+// luxTickReserve is the time a scheduled check leaves for an automation that
+// has to apply a pattern; automations it can't reach wait for the next check
+const luxTickReserve = 20 * time.Second
+
+func handleListLuxAutomations(ctx context.Context, username string) (events.APIGatewayProxyResponse, error) {
+    automations, err := shared.GetUserLuxAutomations(ctx, username)
+    if err != nil {
+        log.Printf("Failed to query lux automations: %v", err)
+        return shared.CreateErrorResponse(500, "Failed to retrieve lux automations"), nil
+    }
+    if automations == nil {
+        automations = []shared.LuxAutomation{}
+    }
+    return shared.CreateSuccessResponse(200, automations), nil
+}
+
+func handleCreateLuxAutomation(ctx context.Context, username string, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+    luxReq, errResp := parseLuxAutomationRequest(ctx, username, request)
+    if errResp != nil {
+        return *errResp, nil
+    }
+
+    existing, err := shared.GetUserLuxAutomations(ctx, username)
+    if err != nil {
+        log.Printf("Failed to query lux automations: %v", err)
+        return shared.CreateErrorResponse(500, "Database error"), nil
+    }
+    if len(existing) >= shared.MaxLuxAutomationsPerUser {
+        return shared.CreateErrorResponse(400, fmt.Sprintf("At most %d lux automations are allowed", shared.MaxLuxAutomationsPerUser)), nil
+    }
+
+    now := time.Now()
+    automation := shared.LuxAutomation{
+        AutomationID: uuid.New().String(),
+        UserID:       username,
+        CreatedAt:    now,
+        UpdatedAt:    now,
+    }
+    luxReq.Apply(&automation)
+
+    if err := shared.SaveLuxAutomation(ctx, automation); err != nil {
+        log.Printf("Failed to create lux automation: %v", err)
+        return shared.CreateErrorResponse(500, "Failed to create lux automation"), nil
+    }
+
+    return shared.CreateSuccessResponse(201, automation), nil
+}
+
+func handleGetLuxAutomation(ctx context.Context, username, automationID string) (events.APIGatewayProxyResponse, error) {
+    automation, errResp := getOwnedLuxAutomation(ctx, username, automationID)
+    if errResp != nil {
+        return *errResp, nil
+    }
+    return shared.CreateSuccessResponse(200, automation), nil
+}
+
+// handleListLuxAutomationRuns returns the automation's recent scheduler
+// runs, newest first: ?limit of them, default and most
+// shared.MaxLuxAutomationRuns
+func handleListLuxAutomationRuns(ctx context.Context, username, automationID string, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+    if _, errResp := getOwnedLuxAutomation(ctx, username, automationID); errResp != nil {
+        return *errResp, nil
+    }
+
+    limit := shared.MaxLuxAutomationRuns
+    if raw := request.QueryStringParameters["limit"]; raw != "" {
+        n, err := strconv.Atoi(raw)
+        if err != nil || n < 1 || n > shared.MaxLuxAutomationRuns {
+            return shared.CreateErrorResponse(400, fmt.Sprintf("limit must be between 1 and %d", shared.MaxLuxAutomationRuns)), nil
+        }
+        limit = n
+    }
+
+    runs, err := shared.ListLuxAutomationRuns(ctx, automationID, limit)
+    if err != nil {
+        log.Printf("Failed to list lux automation runs: %v", err)
+        return shared.CreateErrorResponse(500, "Failed to list runs"), nil
+    }
+    return shared.CreateSuccessResponse(200, runs), nil
+}
+
+// handleUpdateLuxAutomation replaces an automation's settings. It is judged
+// afresh from the next reading, so one already on the new side of its
+// thresholds acts at the next check.
+func handleUpdateLuxAutomation(ctx context.Context, username, automationID string, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+    automation, errResp := getOwnedLuxAutomation(ctx, username, automationID)
+    if errResp != nil {
+        return *errResp, nil
+    }
+
+    luxReq, errResp := parseLuxAutomationRequest(ctx, username, request)
+    if errResp != nil {
+        return *errResp, nil
+    }
+
+    luxReq.Apply(automation)
+    automation.UpdatedAt = time.Now()
+    if err := shared.SaveLuxAutomation(ctx, *automation); err != nil {
+        log.Printf("Failed to update lux automation: %v", err)
+        return shared.CreateErrorResponse(500, "Failed to update lux automation"), nil
+    }
+
+    return shared.CreateSuccessResponse(200, automation), nil
+}
+
+func handleDeleteLuxAutomation(ctx context.Context, username, automationID string) (events.APIGatewayProxyResponse, error) {
+    if _, errResp := getOwnedLuxAutomation(ctx, username, automationID); errResp != nil {
+        return *errResp, nil
+    }
+
+    if err := shared.DeleteLuxAutomation(ctx, automationID); err != nil {
+        log.Printf("Failed to delete lux automation: %v", err)
+        return shared.CreateErrorResponse(500, "Failed to delete lux automation"), nil
+    }
+
+    return shared.CreateSuccessResponse(200, map[string]string{
+        "message": "Lux automation deleted successfully",
+    }), nil
+}
+
+func getOwnedLuxAutomation(ctx context.Context, username, automationID string) (*shared.LuxAutomation, *events.APIGatewayProxyResponse) {
+    automation, err := shared.GetLuxAutomation(ctx, automationID)
+    if err != nil {
+        log.Printf("Failed to get lux automation: %v", err)
+        resp := shared.CreateErrorResponse(500, "Database error")
+        return nil, &resp
+    }
+
+    if automation == nil || automation.UserID != username {
+        resp := shared.CreateErrorResponse(404, "Lux automation not found")
+        return nil, &resp
+    }
+
+    return automation, nil
+}
+
+// parseLuxAutomationRequest reads and validates a lux automation body,
+// checking that the sensor device, groups, and patterns are the user's
+func parseLuxAutomationRequest(ctx context.Context, username string, request events.APIGatewayProxyRequest) (*shared.LuxAutomationRequest, *events.APIGatewayProxyResponse) {
+    var luxReq shared.LuxAutomationRequest
+    if err := json.Unmarshal([]byte(shared.GetRequestBody(request)), &luxReq); err != nil {
+        resp := shared.CreateErrorResponse(400, "Invalid request body")
+        return nil, &resp
+    }
+    if err := luxReq.Validate(); err != nil {
+        resp := shared.CreateErrorResponse(400, err.Error())
+        return nil, &resp
+    }
+
+    owned := func(table, keyName, id string, out interface{}, owner func() string, what string) *events.APIGatewayProxyResponse {
+        key, _ := attributevalue.MarshalMap(map[string]string{keyName: id})
+        if err := shared.GetItem(ctx, table, key, out); err != nil {
+            log.Printf("Failed to get %s: %v", what, err)
+            resp := shared.CreateErrorResponse(500, "Database error")
+            return &resp
+        }
+        if owner() != username {
+            resp := shared.CreateErrorResponse(400, fmt.Sprintf("%s %s not found", what, id))
+            return &resp
+        }
+        return nil
+    }
+
+    var device shared.Device
+    if errResp := owned(devicesTable, "deviceId", luxReq.DeviceID, &device, func() string { return device.UserID }, "Device"); errResp != nil {
+        return nil, errResp
+    }
+
+    for _, action := range []*shared.LuxAction{luxReq.Below, luxReq.Above} {
+        if action == nil {
+            continue
+        }
+        var group shared.VirtualGroup
+        if errResp := owned(virtualGroupsTable, "groupId", action.GroupID, &group, func() string { return group.UserID }, "Virtual group"); errResp != nil {
+            return nil, errResp
+        }
+        if action.PatternID != "" {
+            var pattern shared.Pattern
+            if errResp := owned(patternsTable, "patternId", action.PatternID, &pattern, func() string { return pattern.UserID }, "Pattern"); errResp != nil {
+                return nil, errResp
+            }
+        }
+    }
+
+    return &luxReq, nil
+}
+
+// handleLuxAutomationTick evaluates every enabled lux automation against its
+// sensor's latest reading. It runs on a schedule; each tick's runs share a
+// runId.
+func handleLuxAutomationTick(ctx context.Context) error {
+    automations, err := shared.ListEnabledLuxAutomations(ctx)
+    if err != nil {
+        return err
+    }
+
+    runID := shared.NewLuxRunID()
+    log.Printf("Evaluating %d lux automations (run %s)", len(automations), runID)
+    for _, automation := range automations {
+        if !timeBudgetAllows(ctx, luxTickReserve) {
+            log.Printf("Out of time; remaining lux automations wait for the next check")
+            break
+        }
+        run := shared.LuxAutomationRun{
+            AutomationID: automation.AutomationID,
+            RunID:        runID,
+            UserID:       automation.UserID,
+            EvaluatedAt:  time.Now(),
+        }
+        evaluateLuxAutomation(ctx, automation, &run, run.EvaluatedAt)
+        if err := shared.RecordLuxAutomationRun(ctx, run); err != nil {
+            log.Printf("Lux automation %s: failed to record run %s: %v", automation.AutomationID, runID, err)
+        }
+    }
+    return nil
+}
+
+// evaluateLuxAutomation runs the automation's action if its sensor's reading
+// has crossed to the other side of its thresholds, noting the decision on
+// run. The new side is only recorded once the action reaches at least one
+// strip, so an action held off by the cool-down or failed outright is tried
+// again at the next check.
+func evaluateLuxAutomation(ctx context.Context, automation shared.LuxAutomation, run *shared.LuxAutomationRun, now time.Time) {
+    skip := func(reason string) {
+        run.Decision, run.Reason = shared.LuxRunSkipped, reason
+    }
+    fail := func(reason string) {
+        run.Decision, run.Reason = shared.LuxRunFailed, reason
+    }
+
+    sensorKey, _ := attributevalue.MarshalMap(map[string]string{
+        "deviceId": automation.DeviceID,
+    })
+    var sensor shared.Device
+    if err := shared.GetItem(ctx, devicesTable, sensorKey, &sensor); err != nil {
+        log.Printf("Lux automation %s: failed to get sensor device: %v", automation.AutomationID, err)
+        fail("Failed to get sensor device")
+        return
+    }
+    if sensor.DeviceID == "" || sensor.UserID != automation.UserID {
+        fail("Sensor device not found")
+        recordLuxResult(ctx, automation, "Sensor device not found")
+        return
+    }
+    if sensor.LastLux == nil || now.Sub(sensor.LastLux.At) > shared.LuxReadingMaxAge {
+        skip("No recent reading from the sensor")
+        return
+    }
+    lux := sensor.LastLux.Lux
+    run.Lux = &lux
+
+    state := automation.Transition(sensor.LastLux.Lux)
+    if state == "" {
+        skip("Reading hasn't crossed a threshold")
+        return
+    }
+    run.State = state
+    action := automation.Action(state)
+    if action == nil {
+        automation.State = state
+        skip(fmt.Sprintf("No %s action", state))
+        recordLuxResult(ctx, automation, fmt.Sprintf("%.0f lux: no %s action", sensor.LastLux.Lux, state))
+        return
+    }
+    run.GroupID = action.GroupID
+    run.PatternID = action.PatternID
+
+    groupKey, _ := attributevalue.MarshalMap(map[string]string{
+        "groupId": action.GroupID,
+    })
+    var group shared.VirtualGroup
+    if err := shared.GetItem(ctx, virtualGroupsTable, groupKey, &group); err != nil {
+        log.Printf("Lux automation %s: failed to get group: %v", automation.AutomationID, err)
+        fail("Failed to get virtual group")
+        return
+    }
+    if group.GroupID == "" || group.UserID != automation.UserID {
+        fail("Virtual group not found")
+        recordLuxResult(ctx, automation, "Virtual group not found")
+        return
+    }
+
+    // Hold off while the user has recently commanded any of the group's devices
+    devices, err := loadMemberDevices(ctx, group.Members)
+    if err != nil {
+        log.Printf("Lux automation %s: failed to load group devices: %v", automation.AutomationID, err)
+        fail("Failed to load group devices")
+        return
+    }
+    var manualAt time.Time
+    for _, device := range devices {
+        if device.LastApply != nil && device.LastApply.At.After(manualAt) {
+            manualAt = device.LastApply.At
+        }
+    }
+    if wait := automation.CooldownRemaining(manualAt, now); wait > 0 {
+        reason := fmt.Sprintf("waiting %d more minutes after a manual command", int(wait.Minutes())+1)
+        skip("Cool-down: " + reason)
+        recordLuxResult(ctx, automation, fmt.Sprintf("%.0f lux: %s", sensor.LastLux.Lux, reason))
+        return
+    }
+
+    userKey, _ := attributevalue.MarshalMap(map[string]string{
+        "username": automation.UserID,
+    })
+    var user shared.User
+    if err := shared.GetItem(ctx, usersTable, userKey, &user); err != nil {
+        log.Printf("Lux automation %s: failed to get user: %v", automation.AutomationID, err)
+        fail("Failed to get user")
+        return
+    }
+    if err := shared.DecryptParticleToken(ctx, usersTable, &user); err != nil {
+        log.Printf("Lux automation %s: failed to decrypt Particle token: %v", automation.AutomationID, err)
+        fail("Failed to read Particle token")
+        return
+    }
+    if user.ParticleToken == "" {
+        fail("Particle token not configured")
+        recordLuxResult(ctx, automation, "Particle token not configured")
+        return
+    }
+
+    pattern := shared.Pattern{Name: "Off", WLEDState: offWLEDState}
+    overrides := shared.OutputOverrides{}
+    if !action.Off {
+        patternKey, _ := attributevalue.MarshalMap(map[string]string{
+            "patternId": action.PatternID,
+        })
+        pattern = shared.Pattern{}
+        if err := shared.GetItem(ctx, patternsTable, patternKey, &pattern); err != nil {
+            log.Printf("Lux automation %s: failed to get pattern: %v", automation.AutomationID, err)
+            fail("Failed to get pattern")
+            return
+        }
+        if pattern.PatternID == "" || pattern.UserID != automation.UserID {
+            fail("Pattern not found")
+            recordLuxResult(ctx, automation, "Pattern not found")
+            return
+        }
+        overrides = shared.GroupOutputOverrides(group)
+    }
+
+    cancelMemberRamps(ctx, group.Members, "superseded by a lux automation")
+    results, succeeded, failed := applyPatternToMembers(ctx, automation.UserID, group.Members, pattern, overrides, user.ParticleToken)
+    log.Printf("Lux automation %s: %.0f lux, applied %s to group %s (%d succeeded, %d failed)",
+        automation.AutomationID, sensor.LastLux.Lux, pattern.Name, group.Name, succeeded, failed)
+    run.Succeeded, run.Failed = succeeded, failed
+    for _, result := range results {
+        run.Members = append(run.Members, shared.LuxRunMemberResult{
+            DeviceID: result.DeviceID,
+            Pin:      result.Pin,
+            Success:  result.Success,
+            Error:    result.Error,
+        })
+    }
+    recordLuxActivity(ctx, automation, run, pattern.Name, group.Name)
+    if succeeded == 0 {
+        fail(fmt.Sprintf("%s failed on all %d members of %s", pattern.Name, failed, group.Name))
+        recordLuxResult(ctx, automation, fmt.Sprintf("%.0f lux: %s failed on all %d members of %s", sensor.LastLux.Lux, pattern.Name, failed, group.Name))
+        return
+    }
+
+    if pattern.PatternID != "" {
+        updateGroupPatternID(ctx, group, pattern.PatternID)
+    }
+
+    // Set after the sends, so the applies just recorded aren't taken for manual commands
+    actionAt := time.Now()
+    automation.State = state
+    automation.LastActionAt = &actionAt
+    run.Decision = shared.LuxRunFired
+    recordLuxResult(ctx, automation, fmt.Sprintf("%.0f lux: applied %s to %s (%d succeeded, %d failed)", sensor.LastLux.Lux, pattern.Name, group.Name, succeeded, failed))
+}
+
+// recordLuxActivity adds the automation's apply to its owner's activity
+// log, tagged with the run so the two can be matched up
+func recordLuxActivity(ctx context.Context, automation shared.LuxAutomation, run *shared.LuxAutomationRun, patternName, groupName string) {
+    err := shared.RecordActivity(ctx, shared.ActivityEntry{
+        UserID:  automation.UserID,
+        Action:  shared.ActivityLuxAutomation,
+        Actor:   "lux-automation:" + automation.AutomationID,
+        Subject: fmt.Sprintf("%s to %s (%d succeeded, %d failed)", patternName, groupName, run.Succeeded, run.Failed),
+        RunID:   run.RunID,
+    })
+    if err != nil {
+        log.Printf("Lux automation %s: failed to record activity for run %s: %v", automation.AutomationID, run.RunID, err)
+    }
+}
+
+// recordLuxResult saves the automation's evaluation state with result
+func recordLuxResult(ctx context.Context, automation shared.LuxAutomation, result string) {
+    automation.LastResult = result
+    if err := shared.SaveLuxAutomationState(ctx, automation); err != nil {
+        log.Printf("Lux automation %s: failed to save state: %v", automation.AutomationID, err)
+    }
+}
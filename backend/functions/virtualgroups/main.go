@@ -5,17 +5,19 @@ import (
     "context"
     "encoding/base64"
     "encoding/json"
+    "errors"
     "fmt"
     "io"
     "log"
     "net/http"
     "os"
-    "strings"
     "time"
 
     "github.com/aws/aws-lambda-go/events"
     "github.com/aws/aws-lambda-go/lambda"
+    "github.com/aws/aws-sdk-go-v2/aws"
     "github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+    "github.com/aws/aws-sdk-go-v2/service/dynamodb"
     "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
     "github.com/google/uuid"
 
@@ -29,7 +31,108 @@ var (
     usersTable         = os.Getenv("USERS_TABLE")
 )
 
-const particleAPIBase = "https://api.particle.io/v1"
+var router = newRouter()
+
+// newRouter registers the virtual group, ramp, trial, automation and text
+// command routes, all for signed-in users
+func newRouter() *shared.Router {
+    r := shared.NewRouter("VirtualGroups")
+
+    r.MustHandle("GET", shared.PathEquals("/api/virtual-groups"), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleListGroups(rc.Ctx, rc.Username)
+        })
+    r.MustHandle("POST", shared.PathEquals("/api/virtual-groups"), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleCreateGroup(rc.Ctx, rc.Username, rc.Request)
+        })
+    r.MustHandle("POST", shared.PathEquals("/api/virtual-groups/retry"), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleRetryApply(rc.Ctx, rc.Username, rc.Request)
+        })
+    r.MustHandle("GET", shared.PathEquals("/api/automations/lux"), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleListLuxAutomations(rc.Ctx, rc.Username)
+        })
+    r.MustHandle("POST", shared.PathEquals("/api/automations/lux"), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleCreateLuxAutomation(rc.Ctx, rc.Username, rc.Request)
+        })
+    r.MustHandle("GET", shared.MatchAll(shared.HasPathParams("automationId"), shared.PathSuffix("/runs")), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleListLuxAutomationRuns(rc.Ctx, rc.Username, rc.Request.PathParameters["automationId"], rc.Request)
+        })
+    r.MustHandle("GET", shared.HasPathParams("automationId"), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleGetLuxAutomation(rc.Ctx, rc.Username, rc.Request.PathParameters["automationId"])
+        })
+    r.MustHandle("PUT", shared.HasPathParams("automationId"), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleUpdateLuxAutomation(rc.Ctx, rc.Username, rc.Request.PathParameters["automationId"], rc.Request)
+        })
+    r.MustHandle("DELETE", shared.HasPathParams("automationId"), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleDeleteLuxAutomation(rc.Ctx, rc.Username, rc.Request.PathParameters["automationId"])
+        })
+    r.MustHandle("POST", shared.PathEquals("/api/command/text"), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleTextCommand(rc.Ctx, rc.Username, rc.Request)
+        })
+    r.MustHandle("POST", shared.PathSuffix("/try"), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleStartTrial(rc.Ctx, rc.Username, rc.Request.PathParameters["deviceId"], rc.Request.PathParameters["pin"], rc.Request)
+        })
+    r.MustHandle("POST", shared.MatchAll(shared.HasPathParams("pin"), shared.PathSuffix("/ramp")), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleStartStripRamp(rc.Ctx, rc.Username, rc.Request.PathParameters["deviceId"], rc.Request.PathParameters["pin"], rc.Request)
+        })
+    r.MustHandle("GET", shared.MatchAll(shared.HasPathParams("pin"), shared.PathSuffix("/ramp")), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleGetStripRamp(rc.Ctx, rc.Username, rc.Request.PathParameters["deviceId"], rc.Request.PathParameters["pin"])
+        })
+    r.MustHandle("POST", shared.MatchAll(shared.HasPathParams("groupId"), shared.PathSuffix("/ramp")), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleStartGroupRamp(rc.Ctx, rc.Username, rc.Request.PathParameters["groupId"], rc.Request)
+        })
+    r.MustHandle("POST", shared.MatchAll(shared.HasPathParams("rampId"), shared.PathSuffix("/cancel")), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleCancelRamp(rc.Ctx, rc.Username, rc.Request.PathParameters["rampId"])
+        })
+    r.MustHandle("GET", shared.HasPathParams("rampId"), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleGetRamp(rc.Ctx, rc.Username, rc.Request.PathParameters["rampId"])
+        })
+    r.MustHandle("GET", shared.HasPathParams("jobId"), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleGetApplyJob(rc.Ctx, rc.Username, rc.Request.PathParameters["jobId"])
+        })
+    r.MustHandle("POST", shared.MatchAll(shared.HasPathParams("trialId"), shared.PathSuffix("/keep")), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleKeepTrial(rc.Ctx, rc.Username, rc.Request.PathParameters["trialId"])
+        })
+    r.MustHandle("POST", shared.MatchAll(shared.HasPathParams("trialId"), shared.PathSuffix("/cancel")), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleCancelTrial(rc.Ctx, rc.Username, rc.Request.PathParameters["trialId"])
+        })
+    r.MustHandle("POST", shared.MatchAll(shared.HasPathParams("groupId"), shared.PathSuffix("/apply")), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleApplyPattern(rc.Ctx, rc.Username, rc.Request.PathParameters["groupId"], rc.Request)
+        })
+    r.MustHandle("GET", shared.HasPathParams("groupId"), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleGetGroup(rc.Ctx, rc.Username, rc.Request.PathParameters["groupId"])
+        })
+    r.MustHandle("PUT", shared.HasPathParams("groupId"), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleUpdateGroup(rc.Ctx, rc.Username, rc.Request.PathParameters["groupId"], rc.Request)
+        })
+    r.MustHandle("DELETE", shared.HasPathParams("groupId"), shared.PolicyAuthenticated,
+        func(rc *shared.RequestContext) (events.APIGatewayProxyResponse, error) {
+            return handleDeleteGroup(rc.Ctx, rc.Username, rc.Request.PathParameters["groupId"])
+        })
+
+    return r
+}
 
 func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
     log.Printf("=== VirtualGroups Handler Called ===")
@@ -37,42 +140,7 @@ func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events
     log.Printf("Method: %s", request.HTTPMethod)
     log.Printf("PathParameters: %+v", request.PathParameters)
 
-    // Validate authentication
-    username, err := shared.ValidateAuth(ctx, request)
-    if err != nil || username == "" {
-        log.Printf("Authentication failed: err=%v, username=%s", err, username)
-        return shared.CreateErrorResponse(401, "Unauthorized"), nil
-    }
-
-    log.Printf("Authenticated user: %s", username)
-
-    path := request.Path
-    method := request.HTTPMethod
-    groupID := request.PathParameters["groupId"]
-
-    switch {
-    case path == "/api/virtual-groups" && method == "GET":
-        log.Println("Routing to handleListGroups")
-        return handleListGroups(ctx, username)
-    case path == "/api/virtual-groups" && method == "POST":
-        log.Println("Routing to handleCreateGroup")
-        return handleCreateGroup(ctx, username, request)
-    case groupID != "" && strings.HasSuffix(path, "/apply") && method == "POST":
-        log.Printf("Routing to handleApplyPattern for groupId: %s", groupID)
-        return handleApplyPattern(ctx, username, groupID, request)
-    case groupID != "" && method == "GET":
-        log.Printf("Routing to handleGetGroup for groupId: %s", groupID)
-        return handleGetGroup(ctx, username, groupID)
-    case groupID != "" && method == "PUT":
-        log.Printf("Routing to handleUpdateGroup for groupId: %s", groupID)
-        return handleUpdateGroup(ctx, username, groupID, request)
-    case groupID != "" && method == "DELETE":
-        log.Printf("Routing to handleDeleteGroup for groupId: %s", groupID)
-        return handleDeleteGroup(ctx, username, groupID)
-    default:
-        log.Printf("No matching route for path: %s, method: %s", path, method)
-        return shared.CreateErrorResponse(404, "Not found"), nil
-    }
+    return router.Dispatch(ctx, request)
 }
 
 func handleListGroups(ctx context.Context, username string) (events.APIGatewayProxyResponse, error) {
@@ -87,14 +155,21 @@ func handleListGroups(ctx context.Context, username string) (events.APIGatewayPr
         log.Printf("Failed to query virtual groups: %v", err)
         return shared.CreateErrorResponse(500, "Failed to retrieve virtual groups"), nil
     }
+    for i := range groups {
+        groups[i].Icon = groups[i].DisplayIcon()
+    }
 
     return shared.CreateSuccessResponse(200, groups), nil
 }
 
 func handleCreateGroup(ctx context.Context, username string, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
     var groupReq struct {
-        Name    string                     `json:"name"`
-        Members []shared.VirtualGroupMember `json:"members"`
+        Name              string                      `json:"name"`
+        Members           []shared.VirtualGroupMember `json:"members"`
+        BrightnessPercent *int                        `json:"brightnessPercent,omitempty"`
+        ColorOverride     *string                     `json:"colorOverride,omitempty"`
+        Icon              string                      `json:"icon,omitempty"`
+        AccentColor       string                      `json:"accentColor,omitempty"`
     }
 
     body := shared.GetRequestBody(request)
@@ -102,14 +177,28 @@ func handleCreateGroup(ctx context.Context, username string, request events.APIG
         return shared.CreateErrorResponse(400, "Invalid request body"), nil
     }
 
-    if groupReq.Name == "" {
-        return shared.CreateErrorResponse(400, "Name is required"), nil
+    name, err := shared.ValidateName("group", groupReq.Name)
+    if err != nil {
+        return shared.CreateErrorResponse(400, err.Error()), nil
     }
 
     if len(groupReq.Members) == 0 {
         return shared.CreateErrorResponse(400, "At least one member is required"), nil
     }
 
+    if errMsg := normalizeGroupOverrides(groupReq.BrightnessPercent, groupReq.ColorOverride); errMsg != "" {
+        return shared.CreateErrorResponse(400, errMsg), nil
+    }
+
+    icon, err := shared.NormalizeIcon(groupReq.Icon)
+    if err != nil {
+        return shared.CreateErrorResponse(400, err.Error()), nil
+    }
+    accentColor, err := shared.NormalizeAccentColor(groupReq.AccentColor)
+    if err != nil {
+        return shared.CreateErrorResponse(400, err.Error()), nil
+    }
+
     // Validate that all devices belong to the user
     for _, member := range groupReq.Members {
         deviceKey, _ := attributevalue.MarshalMap(map[string]string{
@@ -122,23 +211,25 @@ func handleCreateGroup(ctx context.Context, username string, request events.APIG
             return shared.CreateErrorResponse(500, "Database error"), nil
         }
 
-        if device.DeviceID == "" {
+        if device.DeviceID == "" || device.UserID != username {
             return shared.CreateErrorResponse(400, fmt.Sprintf("Device %s not found", member.DeviceID)), nil
         }
-
-        if device.UserID != username {
-            return shared.CreateErrorResponse(403, fmt.Sprintf("Access denied to device %s", member.DeviceID)), nil
-        }
     }
 
     now := time.Now()
     group := shared.VirtualGroup{
         GroupID:   uuid.New().String(),
         UserID:    username,
-        Name:      groupReq.Name,
+        Name:      name,
         Members:   groupReq.Members,
         CreatedAt: now,
         UpdatedAt: now,
+
+        BrightnessPercent: groupReq.BrightnessPercent,
+        ColorOverride:     groupReq.ColorOverride,
+
+        Icon:        icon,
+        AccentColor: accentColor,
     }
 
     if err := shared.PutItem(ctx, virtualGroupsTable, group); err != nil {
@@ -146,6 +237,7 @@ func handleCreateGroup(ctx context.Context, username string, request events.APIG
         return shared.CreateErrorResponse(500, "Failed to create virtual group"), nil
     }
 
+    group.Icon = group.DisplayIcon()
     return shared.CreateSuccessResponse(201, group), nil
 }
 
@@ -160,14 +252,11 @@ func handleGetGroup(ctx context.Context, username string, groupID string) (event
         return shared.CreateErrorResponse(500, "Database error"), nil
     }
 
-    if group.GroupID == "" {
+    if group.GroupID == "" || group.UserID != username {
         return shared.CreateErrorResponse(404, "Virtual group not found"), nil
     }
 
-    if group.UserID != username {
-        return shared.CreateErrorResponse(403, "Access denied"), nil
-    }
-
+    group.Icon = group.DisplayIcon()
     return shared.CreateSuccessResponse(200, group), nil
 }
 
@@ -183,18 +272,18 @@ func handleUpdateGroup(ctx context.Context, username string, groupID string, req
         return shared.CreateErrorResponse(500, "Database error"), nil
     }
 
-    if existingGroup.GroupID == "" {
+    if existingGroup.GroupID == "" || existingGroup.UserID != username {
         return shared.CreateErrorResponse(404, "Virtual group not found"), nil
     }
 
-    if existingGroup.UserID != username {
-        return shared.CreateErrorResponse(403, "Access denied"), nil
-    }
-
     // Parse updates
     var updates struct {
-        Name    string                      `json:"name,omitempty"`
-        Members []shared.VirtualGroupMember `json:"members,omitempty"`
+        Name              string                      `json:"name,omitempty"`
+        Members           []shared.VirtualGroupMember `json:"members,omitempty"`
+        BrightnessPercent *int                        `json:"brightnessPercent"`
+        ColorOverride     *string                     `json:"colorOverride"`
+        Icon              *string                     `json:"icon,omitempty"`        // "" goes back to the default icon
+        AccentColor       *string                     `json:"accentColor,omitempty"` // "" clears the accent
     }
 
     body := shared.GetRequestBody(request)
@@ -204,7 +293,37 @@ func handleUpdateGroup(ctx context.Context, username string, groupID string, req
 
     // Update fields
     if updates.Name != "" {
-        existingGroup.Name = updates.Name
+        name, err := shared.ValidateName("group", updates.Name)
+        if err != nil {
+            return shared.CreateErrorResponse(400, err.Error()), nil
+        }
+        existingGroup.Name = name
+    }
+
+    // Overrides present in the body are set, or cleared when null
+    if errMsg := normalizeGroupOverrides(updates.BrightnessPercent, updates.ColorOverride); errMsg != "" {
+        return shared.CreateErrorResponse(400, errMsg), nil
+    }
+    provided := providedFields(body)
+    if provided["brightnessPercent"] {
+        existingGroup.BrightnessPercent = updates.BrightnessPercent
+    }
+    if provided["colorOverride"] {
+        existingGroup.ColorOverride = updates.ColorOverride
+    }
+    if updates.Icon != nil {
+        icon, err := shared.NormalizeIcon(*updates.Icon)
+        if err != nil {
+            return shared.CreateErrorResponse(400, err.Error()), nil
+        }
+        existingGroup.Icon = icon
+    }
+    if updates.AccentColor != nil {
+        color, err := shared.NormalizeAccentColor(*updates.AccentColor)
+        if err != nil {
+            return shared.CreateErrorResponse(400, err.Error()), nil
+        }
+        existingGroup.AccentColor = color
     }
 
     if updates.Members != nil {
@@ -224,13 +343,9 @@ func handleUpdateGroup(ctx context.Context, username string, groupID string, req
                 return shared.CreateErrorResponse(500, "Database error"), nil
             }
 
-            if device.DeviceID == "" {
+            if device.DeviceID == "" || device.UserID != username {
                 return shared.CreateErrorResponse(400, fmt.Sprintf("Device %s not found", member.DeviceID)), nil
             }
-
-            if device.UserID != username {
-                return shared.CreateErrorResponse(403, fmt.Sprintf("Access denied to device %s", member.DeviceID)), nil
-            }
         }
 
         existingGroup.Members = updates.Members
@@ -243,9 +358,42 @@ func handleUpdateGroup(ctx context.Context, username string, groupID string, req
         return shared.CreateErrorResponse(500, "Failed to update virtual group"), nil
     }
 
+    existingGroup.Icon = existingGroup.DisplayIcon()
     return shared.CreateSuccessResponse(200, existingGroup), nil
 }
 
+// providedFields returns the top-level keys present in a JSON body, so a
+// field sent as null can be told apart from one left out
+func providedFields(body string) map[string]bool {
+    var raw map[string]json.RawMessage
+    fields := make(map[string]bool)
+    if err := json.Unmarshal([]byte(body), &raw); err != nil {
+        return fields
+    }
+    for k := range raw {
+        fields[k] = true
+    }
+    return fields
+}
+
+// normalizeGroupOverrides validates group overrides from a request and puts
+// the color in "#RRGGBB" form, returning an error message if one is invalid
+func normalizeGroupOverrides(brightnessPercent *int, color *string) string {
+    if brightnessPercent != nil {
+        if err := shared.ValidateBrightnessPercent(*brightnessPercent); err != nil {
+            return err.Error()
+        }
+    }
+    if color != nil {
+        normalized, err := shared.NormalizeHexColor(*color)
+        if err != nil {
+            return "colorOverride: " + err.Error()
+        }
+        *color = normalized
+    }
+    return ""
+}
+
 func handleDeleteGroup(ctx context.Context, username string, groupID string) (events.APIGatewayProxyResponse, error) {
     // Get group to verify ownership
     key, _ := attributevalue.MarshalMap(map[string]string{
@@ -258,14 +406,10 @@ func handleDeleteGroup(ctx context.Context, username string, groupID string) (ev
         return shared.CreateErrorResponse(500, "Database error"), nil
     }
 
-    if group.GroupID == "" {
+    if group.GroupID == "" || group.UserID != username {
         return shared.CreateErrorResponse(404, "Virtual group not found"), nil
     }
 
-    if group.UserID != username {
-        return shared.CreateErrorResponse(403, "Access denied"), nil
-    }
-
     // Delete group
     if err := shared.DeleteItem(ctx, virtualGroupsTable, key); err != nil {
         log.Printf("Failed to delete virtual group: %v", err)
@@ -282,8 +426,24 @@ type MemberResult struct {
     DeviceID   string `json:"deviceId"`
     DeviceName string `json:"deviceName"`
     Pin        int    `json:"pin"`
-    Success    bool   `json:"success"`
-    Error      string `json:"error,omitempty"`
+    Success    bool     `json:"success"`
+    Error      string   `json:"error,omitempty"`
+    Warnings   []string `json:"warnings,omitempty"` // Substitutions made while compiling for this member
+    // Sizes reported by simulated applies
+    BytecodeBytes int `json:"bytecodeBytes,omitempty"`
+    ArgumentBytes int `json:"argumentBytes,omitempty"` // setBytecode argument, limited to particleArgumentLimit
+    // Failed members of a group apply; POST /api/virtual-groups/retry takes it
+    RetryToken string `json:"retryToken,omitempty"`
+    // The strip's speed multiplier the pattern was sent with
+    SpeedMultiplier float64 `json:"speedMultiplier,omitempty"`
+    // The group apply variation the member received, e.g. "alternateColors #FF0000"
+    Variation string `json:"variation,omitempty"`
+    // Where the bytecode sent came from: stored, cached, or compiled
+    BinarySource string `json:"binarySource,omitempty"`
+    // Particle requests sent for the member, retries included
+    Attempts int `json:"attempts,omitempty"`
+
+    colors []string // Colors from the variation, carried by the member's retry token
 }
 
 // ApplyResult represents the aggregated result of applying a pattern to all members
@@ -294,6 +454,7 @@ type ApplyResult struct {
     Results    []MemberResult `json:"results"`
     Succeeded  int            `json:"succeeded"`
     Failed     int            `json:"failed"`
+    Simulated  bool           `json:"simulated,omitempty"` // Nothing was sent or saved; results are what would happen
 }
 
 func handleApplyPattern(ctx context.Context, username string, groupID string, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
@@ -302,6 +463,7 @@ func handleApplyPattern(ctx context.Context, username string, groupID string, re
     // Parse request
     var applyReq struct {
         PatternID string `json:"patternId"`
+        groupVariation
     }
 
     body := shared.GetRequestBody(request)
@@ -313,6 +475,15 @@ func handleApplyPattern(ctx context.Context, username string, groupID string, re
         return shared.CreateErrorResponse(400, "patternId is required"), nil
     }
 
+    if err := applyReq.groupVariation.validate(); err != nil {
+        return shared.CreateErrorResponse(400, err.Error()), nil
+    }
+    variation := &applyReq.groupVariation
+
+    // A simulated apply runs every check and compiles for every member, but
+    // sends nothing to Particle and writes nothing
+    simulate := request.QueryStringParameters["simulate"] == "true"
+
     // Get group
     groupKey, _ := attributevalue.MarshalMap(map[string]string{
         "groupId": groupID,
@@ -324,14 +495,10 @@ func handleApplyPattern(ctx context.Context, username string, groupID string, re
         return shared.CreateErrorResponse(500, "Database error"), nil
     }
 
-    if group.GroupID == "" {
+    if group.GroupID == "" || group.UserID != username {
         return shared.CreateErrorResponse(404, "Virtual group not found"), nil
     }
 
-    if group.UserID != username {
-        return shared.CreateErrorResponse(403, "Access denied"), nil
-    }
-
     // Get pattern
     patternKey, _ := attributevalue.MarshalMap(map[string]string{
         "patternId": applyReq.PatternID,
@@ -343,14 +510,10 @@ func handleApplyPattern(ctx context.Context, username string, groupID string, re
         return shared.CreateErrorResponse(500, "Database error"), nil
     }
 
-    if pattern.PatternID == "" {
+    if pattern.PatternID == "" || pattern.UserID != username {
         return shared.CreateErrorResponse(404, "Pattern not found"), nil
     }
 
-    if pattern.UserID != username {
-        return shared.CreateErrorResponse(403, "Pattern access denied"), nil
-    }
-
     // Get user's Particle token
     userKey, _ := attributevalue.MarshalMap(map[string]string{
         "username": username,
@@ -362,78 +525,233 @@ func handleApplyPattern(ctx context.Context, username string, groupID string, re
         return shared.CreateErrorResponse(500, "Database error"), nil
     }
 
+    if err := shared.DecryptParticleToken(ctx, usersTable, &user); err != nil {
+        log.Printf("Failed to decrypt Particle token for %s: %v", username, err)
+        return shared.CreateErrorResponse(500, "Failed to read Particle token"), nil
+    }
+
     if user.ParticleToken == "" {
         return shared.CreateErrorResponse(400, "Particle token not configured"), nil
     }
 
+    // Group overrides apply only here; applying to a member device directly
+    // goes through the particle function and shows the pattern as authored
+    overrides := shared.GroupOutputOverrides(group)
+
+    if simulate {
+        return simulateApplyPattern(ctx, username, group, pattern, overrides, variation), nil
+    }
+
+    // Large groups go through the queue worker to stay within the API Gateway timeout
+    if useApplyQueue(len(group.Members)) {
+        resp, err := startApplyJob(ctx, username, groupID, group.Members, pattern, overrides, variation)
+        if resp.StatusCode == 202 {
+            updateGroupPatternID(ctx, group, applyReq.PatternID)
+        }
+        return resp, err
+    }
+
     // Apply pattern to each member
-    results := make([]MemberResult, 0, len(group.Members))
-    succeeded := 0
-    failed := 0
+    results, succeeded, failed := runPatternOnMembers(ctx, username, group.Members, pattern, overrides, variation, user.ParticleToken, false)
+    attachRetryTokens(username, groupID, applyReq.PatternID, results)
 
-    // Cache devices to avoid repeated lookups
-    deviceCache := make(map[string]*shared.Device)
+    updateGroupPatternID(ctx, group, applyReq.PatternID)
 
-    for _, member := range group.Members {
-        log.Printf("Processing member: deviceId=%s, pin=%d", member.DeviceID, member.Pin)
+    result := ApplyResult{
+        Success:   failed == 0,
+        PatternID: applyReq.PatternID,
+        Results:   results,
+        Succeeded: succeeded,
+        Failed:    failed,
+    }
 
-        // Get device (with caching)
-        device, ok := deviceCache[member.DeviceID]
-        if !ok {
-            deviceKey, _ := attributevalue.MarshalMap(map[string]string{
-                "deviceId": member.DeviceID,
-            })
+    if failed == 0 {
+        result.Message = fmt.Sprintf("Pattern applied successfully to all %d members", succeeded)
+    } else if succeeded == 0 {
+        result.Message = fmt.Sprintf("Pattern failed to apply to all %d members", failed)
+    } else {
+        result.Message = fmt.Sprintf("Pattern applied to %d members, failed on %d members", succeeded, failed)
+    }
+    if !overrides.IsZero() && succeeded > 0 {
+        result.Message += fmt.Sprintf(" (group overrides: %s)", overrides)
+    }
+    if variation.Variation != "" && succeeded > 0 {
+        result.Message += fmt.Sprintf(" (variation: %s)", variation.Variation)
+    }
 
-            var d shared.Device
-            if err := shared.GetItem(ctx, devicesTable, deviceKey, &d); err != nil {
-                log.Printf("Failed to get device %s: %v", member.DeviceID, err)
-                results = append(results, MemberResult{
-                    DeviceID: member.DeviceID,
-                    Pin:      member.Pin,
-                    Success:  false,
-                    Error:    "Database error",
-                })
-                failed++
-                continue
-            }
-            device = &d
-            deviceCache[member.DeviceID] = device
+    return shared.CreateSuccessResponse(200, result), nil
+}
+
+// updateGroupPatternID records patternID as the group's current pattern
+func updateGroupPatternID(ctx context.Context, group shared.VirtualGroup, patternID string) {
+    group.PatternID = patternID
+    group.UpdatedAt = time.Now()
+    if err := shared.PutItem(ctx, virtualGroupsTable, group); err != nil {
+        log.Printf("Warning: Failed to update group patternId: %v", err)
+    }
+}
+
+// applyPatternToMembers compiles and sends a pattern to each group member strip,
+// recording the pattern on the strip. Members are handled device by device so
+// every strip a device has in the group is recorded with a single write.
+// Patterns without an ID (e.g. the text command "off" state) are sent but not
+// recorded. overrides adjust the compiled output without changing what is
+// recorded. Results are returned in member order.
+func applyPatternToMembers(ctx context.Context, username string, members []shared.VirtualGroupMember, pattern shared.Pattern, overrides shared.OutputOverrides, token string) ([]MemberResult, int, int) {
+    return runPatternOnMembers(ctx, username, members, pattern, overrides, nil, token, false)
+}
+
+// simulateApplyPattern reports what applying pattern to group would do
+// without sending to devices or saving anything. Members that would succeed
+// are reported as succeeded, with their compiled sizes.
+func simulateApplyPattern(ctx context.Context, username string, group shared.VirtualGroup, pattern shared.Pattern, overrides shared.OutputOverrides, variation *groupVariation) events.APIGatewayProxyResponse {
+    results, succeeded, failed := runPatternOnMembers(ctx, username, group.Members, pattern, overrides, variation, "", true)
+
+    result := ApplyResult{
+        Success:   failed == 0,
+        PatternID: pattern.PatternID,
+        Results:   results,
+        Succeeded: succeeded,
+        Failed:    failed,
+        Simulated: true,
+    }
+    if failed == 0 {
+        result.Message = fmt.Sprintf("Simulation: pattern would apply to all %d members", succeeded)
+    } else {
+        result.Message = fmt.Sprintf("Simulation: pattern would apply to %d members and fail on %d", succeeded, failed)
+    }
+    if !overrides.IsZero() {
+        result.Message += fmt.Sprintf(" (group overrides: %s)", overrides)
+    }
+    if variation.Variation != "" {
+        result.Message += fmt.Sprintf(" (variation: %s)", variation.Variation)
+    }
+
+    return shared.CreateSuccessResponse(200, result)
+}
+
+// runPatternOnMembers applies pattern to members, or with simulate set only
+// checks and compiles it for each of them. A non-nil variation varies the
+// overrides by each member's position in members.
+func runPatternOnMembers(ctx context.Context, username string, members []shared.VirtualGroupMember, pattern shared.Pattern, overrides shared.OutputOverrides, variation *groupVariation, token string, simulate bool) ([]MemberResult, int, int) {
+    results := make([]MemberResult, len(members))
+
+    // Group member indexes by device, keeping first-seen device order
+    var deviceOrder []string
+    memberIndexes := make(map[string][]int)
+    for i, member := range members {
+        if _, ok := memberIndexes[member.DeviceID]; !ok {
+            deviceOrder = append(deviceOrder, member.DeviceID)
         }
+        memberIndexes[member.DeviceID] = append(memberIndexes[member.DeviceID], i)
+    }
 
-        if device.DeviceID == "" {
-            results = append(results, MemberResult{
-                DeviceID: member.DeviceID,
-                Pin:      member.Pin,
-                Success:  false,
-                Error:    "Device not found",
-            })
-            failed++
+    outOfTime := false
+    for _, deviceID := range deviceOrder {
+        if outOfTime {
+            for _, i := range memberIndexes[deviceID] {
+                results[i] = MemberResult{DeviceID: deviceID, Pin: members[i].Pin, Error: errTimeBudgetExceeded, colors: variation.colorsFor(i)}
+            }
             continue
         }
+        outOfTime = applyPatternToDeviceMembers(ctx, username, deviceID, members, memberIndexes[deviceID], pattern, overrides, variation, token, simulate, results)
+    }
 
-        if device.UserID != username {
-            results = append(results, MemberResult{
-                DeviceID:   device.DeviceID,
-                DeviceName: device.Name,
-                Pin:        member.Pin,
-                Success:    false,
-                Error:      "Access denied",
-            })
+    succeeded := 0
+    failed := 0
+    for _, r := range results {
+        if r.Success {
+            succeeded++
+        } else {
             failed++
-            continue
         }
+    }
+    return results, succeeded, failed
+}
 
-        if !device.IsOnline {
-            results = append(results, MemberResult{
-                DeviceID:   device.DeviceID,
-                DeviceName: device.Name,
-                Pin:        member.Pin,
-                Success:    false,
-                Error:      "Device is offline",
-            })
-            failed++
-            continue
+// errTimeBudgetExceeded fails the members a group apply had no time left for
+const errTimeBudgetExceeded = "time budget exceeded"
+
+// applyTimeReserve is kept back from the invocation deadline for the writes
+// after the last send and for returning the response
+const applyTimeReserve = 2 * time.Second
+
+// timeBudgetAllows reports whether a call that may take up to timeout can
+// finish before ctx's deadline, with applyTimeReserve to spare
+func timeBudgetAllows(ctx context.Context, timeout time.Duration) bool {
+    deadline, ok := ctx.Deadline()
+    if !ok {
+        return true
+    }
+    return time.Until(deadline) > timeout+applyTimeReserve
+}
+
+// applyPatternToDeviceMembers applies pattern to the members at indexes, which
+// all belong to deviceID, filling in their results. The strips that took the
+// pattern are updated on one copy of the device and saved once. With simulate
+// set the pattern is compiled and checked but not sent or recorded. Members
+// that can't be sent within the time left before ctx's deadline, given the
+// device's command timeout, fail with errTimeBudgetExceeded; the return value
+// reports that so the caller fails the rest of the group too.
+func applyPatternToDeviceMembers(ctx context.Context, username string, deviceID string, members []shared.VirtualGroupMember, indexes []int, pattern shared.Pattern, overrides shared.OutputOverrides, variation *groupVariation, token string, simulate bool, results []MemberResult) bool {
+    fail := func(device *shared.Device, errMsg string) {
+        for _, i := range indexes {
+            results[i] = MemberResult{DeviceID: deviceID, Pin: members[i].Pin, Success: false, Error: errMsg, colors: variation.colorsFor(i)}
+            if device != nil {
+                results[i].DeviceName = device.Name
+            }
+        }
+    }
+
+    deviceKey, _ := attributevalue.MarshalMap(map[string]string{
+        "deviceId": deviceID,
+    })
+
+    var device shared.Device
+    if err := shared.GetItem(ctx, devicesTable, deviceKey, &device); err != nil {
+        log.Printf("Failed to get device %s: %v", deviceID, err)
+        fail(nil, "Database error")
+        return false
+    }
+
+    if device.DeviceID == "" {
+        fail(nil, "Device not found")
+        return false
+    }
+
+    if device.UserID != username {
+        fail(&device, "Access denied")
+        return false
+    }
+
+    if !device.IsOnline {
+        fail(&device, "Device is offline")
+        return false
+    }
+
+    ctx, attempts := shared.WithParticleAttempts(ctx)
+    timed := newTimedCaller(ctx, device, token)
+
+    // Pace the strips to the device's rate limit up front, rather than have
+    // calls refused part way through the group
+    if !simulate {
+        if delay := shared.DeviceCommandDelay(ctx, device, len(indexes)); delay > 0 {
+            if !timeBudgetAllows(ctx, delay+device.CommandTimeout()) {
+                rateErr := &shared.DeviceRateLimitError{DeviceName: device.Name, RetryAfter: delay}
+                log.Printf("Not applying to %s: %v", device.Name, rateErr)
+                fail(&device, rateErr.Error())
+                return false
+            }
+            log.Printf("Pacing %d strips on %s over %v for its rate limit", len(indexes), device.Name, delay)
+            timed.AllowRateWait(delay)
         }
+    }
+
+    outOfTime := false
+    var appliedPins []int
+    for _, i := range indexes {
+        member := members[i]
+        log.Printf("Processing member: deviceId=%s, pin=%d", member.DeviceID, member.Pin)
 
         // Find the strip for this pin to get LED count
         var ledCount int = 8 // default
@@ -444,193 +762,317 @@ func handleApplyPattern(ctx context.Context, username string, groupID string, re
             }
         }
 
+        memberOverrides, variationApplied, variationWarning := variation.forMember(device, i, overrides)
+        withVariation := func(result MemberResult) MemberResult {
+            if variationWarning != "" {
+                result.Warnings = append(result.Warnings, variationWarning)
+            }
+            if result.Success {
+                result.Variation = variationApplied
+            }
+            result.colors = memberOverrides.Colors
+            return result
+        }
+
+        if simulate {
+            results[i] = withVariation(simulateMember(device, member.Pin, pattern, memberOverrides, ledCount))
+            continue
+        }
+
+        if outOfTime || !timeBudgetAllows(ctx, device.CommandTimeout()) {
+            if !outOfTime {
+                log.Printf("Out of time for group apply at device %s pin %d", device.Name, member.Pin)
+            }
+            outOfTime = true
+            results[i] = withVariation(MemberResult{DeviceID: device.DeviceID, DeviceName: device.Name, Pin: member.Pin, Error: errTimeBudgetExceeded})
+            continue
+        }
+
         // Compile and send pattern
-        err := compileAndSendPattern(device, member.Pin, pattern, ledCount, user.ParticleToken)
+        attemptsBefore := attempts.Attempts()
+        warnings, source, err := compileAndSendPattern(&device, member.Pin, pattern, memberOverrides, ledCount, timed.Call)
+        memberAttempts := attempts.Attempts() - attemptsBefore
+        for _, w := range warnings {
+            log.Printf("Warning for device %s pin %d: %s", device.Name, member.Pin, w)
+        }
+        shared.CountPatternApply("virtualgroups", err == nil)
         if err != nil {
             log.Printf("Failed to apply pattern to device %s pin %d: %v", device.Name, member.Pin, err)
-            results = append(results, MemberResult{
+            results[i] = withVariation(MemberResult{
                 DeviceID:   device.DeviceID,
                 DeviceName: device.Name,
                 Pin:        member.Pin,
                 Success:    false,
                 Error:      err.Error(),
+                Warnings:   warnings,
+                Attempts:   memberAttempts,
             })
-            failed++
             continue
         }
 
-        // Update strip's patternId in device
-        stripUpdated := false
-        for i, strip := range device.LEDStrips {
-            if strip.Pin == member.Pin {
-                device.LEDStrips[i].PatternID = applyReq.PatternID
-                stripUpdated = true
-                break
-            }
-        }
-
-        if stripUpdated {
-            device.UpdatedAt = time.Now()
-            if err := shared.PutItem(ctx, devicesTable, *device); err != nil {
-                log.Printf("Warning: Failed to update device %s strip patternId: %v", device.DeviceID, err)
+        if pattern.PatternID != "" {
+            if err := shared.IncrementPatternApplyCount(ctx, patternsTable, pattern.PatternID); err != nil {
+                log.Printf("Warning: Failed to increment apply count for pattern %s: %v", pattern.PatternID, err)
             }
         }
 
-        results = append(results, MemberResult{
+        appliedPins = append(appliedPins, member.Pin)
+        results[i] = withVariation(MemberResult{
             DeviceID:   device.DeviceID,
             DeviceName: device.Name,
             Pin:        member.Pin,
             Success:    true,
+            Warnings:   warnings,
+
+            SpeedMultiplier: device.StripSpeedMultiplier(member.Pin),
+            BinarySource:    source,
+            Attempts:        memberAttempts,
         })
-        succeeded++
     }
 
-    // Update group's patternId
-    group.PatternID = applyReq.PatternID
-    group.UpdatedAt = time.Now()
-    if err := shared.PutItem(ctx, virtualGroupsTable, group); err != nil {
-        log.Printf("Warning: Failed to update group patternId: %v", err)
+    if warning := timed.RecordIfSlow(ctx, devicesTable); warning != "" {
+        for _, i := range indexes {
+            if results[i].Success {
+                results[i].Warnings = append(results[i].Warnings, warning)
+            }
+        }
     }
 
-    result := ApplyResult{
-        Success:   failed == 0,
-        PatternID: applyReq.PatternID,
-        Results:   results,
-        Succeeded: succeeded,
-        Failed:    failed,
+    if len(appliedPins) > 0 && pattern.PatternID != "" {
+        if err := saveStripPatternIDs(ctx, device, appliedPins, pattern.PatternID); err != nil {
+            log.Printf("Warning: Failed to update device %s strip patternIds: %v", device.DeviceID, err)
+        }
     }
 
-    if failed == 0 {
-        result.Message = fmt.Sprintf("Pattern applied successfully to all %d members", succeeded)
-    } else if succeeded == 0 {
-        result.Message = fmt.Sprintf("Pattern failed to apply to all %d members", failed)
-    } else {
-        result.Message = fmt.Sprintf("Pattern applied to %d members, failed on %d members", succeeded, failed)
+    // Written after the strip save, which puts the whole device back
+    if len(appliedPins) > 0 {
+        apply := shared.DeviceApply{
+            PatternID:   pattern.PatternID,
+            PatternName: pattern.Name,
+            Pins:        appliedPins,
+            Source:      "virtualgroups",
+            At:          time.Now().UTC(),
+        }
+        if err := shared.RecordDeviceApply(ctx, devicesTable, device.DeviceID, apply); err != nil {
+            log.Printf("Warning: Failed to record apply on device %s: %v", device.DeviceID, err)
+        }
     }
-
-    return shared.CreateSuccessResponse(200, result), nil
+    return outOfTime
 }
 
-func compileAndSendPattern(device *shared.Device, pin int, pattern shared.Pattern, ledCount int, token string) error {
-    var bytecode []byte
+// maxDeviceSaveAttempts bounds retries when a device changes between read and write
+const maxDeviceSaveAttempts = 3
 
-    // If pattern has WLED JSON state, parse it, update LED count, and recompile
-    if pattern.WLEDState != "" {
-        log.Printf("[compileAndSendPattern] Using WLED state for pattern %s", pattern.Name)
-        var wledJson map[string]interface{}
-        if err := json.Unmarshal([]byte(pattern.WLEDState), &wledJson); err != nil {
-            return fmt.Errorf("failed to parse WLED state: %v", err)
-        }
+// saveStripPatternIDs records patternID on the strips at pins and writes the
+// device once. The write is conditional on updatedAt being unchanged since
+// the device was read; if another writer got there first, the device is
+// re-read and the strip updates reapplied so neither write is lost.
+func saveStripPatternIDs(ctx context.Context, device shared.Device, pins []int, patternID string) error {
+    client, err := shared.InitDynamoDB()
+    if err != nil {
+        return err
+    }
 
-        // Update all segment stop values to match device LED count
-        if segs, ok := wledJson["seg"].([]interface{}); ok {
-            for _, seg := range segs {
-                if segMap, ok := seg.(map[string]interface{}); ok {
-                    segMap["stop"] = ledCount
-                }
-            }
+    for attempt := 1; ; attempt++ {
+        if !setStripPatternIDs(&device, pins, patternID) {
+            return nil
         }
 
-        updatedWledState, _ := json.Marshal(wledJson)
-        var err error
-        bytecode, _, err = shared.CompileWLED(string(updatedWledState))
+        loadedAt, err := attributevalue.Marshal(device.UpdatedAt)
         if err != nil {
-            return fmt.Errorf("failed to compile WLED: %v", err)
+            return err
         }
-    } else {
-        // Build WLED JSON from pattern fields (legacy patterns)
-        effectMap := map[string]int{
-            "solid":   0,
-            "pulse":   2,
-            "wave":    67,
-            "rainbow": 9,
-            "fire":    66,
-            "candle":  71,
-        }
-
-        effectId := effectMap[pattern.Type]
-        if pattern.Metadata != nil {
-            if eid, ok := pattern.Metadata["effectId"]; ok {
-                fmt.Sscanf(eid, "%d", &effectId)
-            }
+        device.UpdatedAt = time.Now()
+        item, err := attributevalue.MarshalMap(device)
+        if err != nil {
+            return err
         }
 
-        speed := 128
-        intensity := 128
-        custom1 := 128
+        _, err = client.PutItem(ctx, &dynamodb.PutItemInput{
+            TableName:           aws.String(devicesTable),
+            Item:                item,
+            ConditionExpression: aws.String("updatedAt = :loadedAt"),
+            ExpressionAttributeValues: map[string]types.AttributeValue{
+                ":loadedAt": loadedAt,
+            },
+        })
+        var conflict *types.ConditionalCheckFailedException
+        if err == nil || !errors.As(err, &conflict) || attempt == maxDeviceSaveAttempts {
+            return err
+        }
 
-        if pattern.Metadata != nil {
-            if s, ok := pattern.Metadata["speed"]; ok {
-                fmt.Sscanf(s, "%d", &speed)
-            }
-            if i, ok := pattern.Metadata["intensity"]; ok {
-                fmt.Sscanf(i, "%d", &intensity)
-            }
-            if c, ok := pattern.Metadata["custom1"]; ok {
-                fmt.Sscanf(c, "%d", &custom1)
-            }
+        log.Printf("Device %s changed during apply; re-reading (attempt %d)", device.DeviceID, attempt)
+        deviceID := device.DeviceID
+        deviceKey, _ := attributevalue.MarshalMap(map[string]string{
+            "deviceId": deviceID,
+        })
+        device = shared.Device{}
+        if err := shared.GetItem(ctx, devicesTable, deviceKey, &device); err != nil {
+            return err
+        }
+        if device.DeviceID == "" {
+            return fmt.Errorf("device %s was deleted", deviceID)
         }
+    }
+}
 
-        // Build colors array
-        var colors [][]int
-        if len(pattern.Colors) > 0 {
-            for _, c := range pattern.Colors {
-                colors = append(colors, []int{clamp(c.R), clamp(c.G), clamp(c.B)})
+// setStripPatternIDs sets patternID on each strip whose pin is in pins,
+// reporting whether any strip matched
+func setStripPatternIDs(device *shared.Device, pins []int, patternID string) bool {
+    updated := false
+    for i, strip := range device.LEDStrips {
+        for _, pin := range pins {
+            if strip.Pin == pin {
+                device.LEDStrips[i].PatternID = patternID
+                updated = true
+                break
             }
-        } else {
-            colors = [][]int{{clamp(pattern.Red), clamp(pattern.Green), clamp(pattern.Blue)}}
-        }
-
-        wledJson := map[string]interface{}{
-            "on":  true,
-            "bri": clamp(pattern.Brightness),
-            "seg": []map[string]interface{}{
-                {
-                    "id":    0,
-                    "start": 0,
-                    "stop":  ledCount,
-                    "fx":    effectId,
-                    "sx":    clamp(speed),
-                    "ix":    clamp(intensity),
-                    "c1":    clamp(custom1),
-                    "col":   colors,
-                    "on":    true,
-                },
-            },
         }
+    }
+    return updated
+}
 
-        wledJsonBytes, _ := json.Marshal(wledJson)
-        var err error
-        bytecode, _, err = shared.CompileWLED(string(wledJsonBytes))
-        if err != nil {
-            return fmt.Errorf("failed to compile WLED: %v", err)
-        }
+// compileAndSendPattern compiles the pattern for a strip and sends it to the device.
+// The returned warnings describe any substitutions made along the way (effect
+// fallbacks, rescaled segments, dropped colors) so callers can surface them.
+func compileAndSendPattern(device *shared.Device, pin int, pattern shared.Pattern, overrides shared.OutputOverrides, ledCount int, call shared.ParticleCaller) ([]string, string, error) {
+    bytecode, source, warnings, err := compileForStrip(device, pin, pattern, overrides, ledCount)
+    if err != nil {
+        return warnings, source, err
     }
 
     // Send bytecode to device
-    return sendBytecodeToDevice(device.ParticleID, pin, bytecode, token)
+    return warnings, source, sendBytecodeToDevice(call, device.ParticleID, device.ResolvePin(pin), bytecode)
+}
+
+// compileForStrip compiles the pattern for the strip on pin, with the strip's
+// speed multiplier added to overrides, and checks it fits in the device's
+// memory. It also returns where the bytecode came from (BinarySource*).
+func compileForStrip(device *shared.Device, pin int, pattern shared.Pattern, overrides shared.OutputOverrides, ledCount int) ([]byte, string, []string, error) {
+    log.Printf("[compileForStrip] Compiling pattern %s for %d LEDs", pattern.Name, ledCount)
+
+    overrides = shared.StripOutputOverrides(*device, pin, overrides)
+    bytecode, source, warnings, err := shared.CompileForLEDCountWithOverrides(&pattern, ledCount, overrides)
+    if err != nil {
+        return nil, "", warnings, err
+    }
+
+    if _, err := shared.CheckBytecodeMemory(*device, bytecode, ledCount); err != nil {
+        return nil, source, warnings, err
+    }
+    return bytecode, source, warnings, nil
 }
 
-func clamp(val int) int {
-    if val < 0 {
-        return 0
+// simulateMember compiles and checks the pattern for one strip as
+// compileAndSendPattern would, and also checks the setBytecode argument fits
+// Particle's function argument limit
+func simulateMember(device shared.Device, pin int, pattern shared.Pattern, overrides shared.OutputOverrides, ledCount int) MemberResult {
+    result := MemberResult{DeviceID: device.DeviceID, DeviceName: device.Name, Pin: pin}
+
+    bytecode, source, warnings, err := compileForStrip(&device, pin, pattern, overrides, ledCount)
+    result.Warnings = warnings
+    result.BinarySource = source
+    if err != nil {
+        result.Error = err.Error()
+        return result
     }
-    if val > 255 {
-        return 255
+
+    result.BytecodeBytes = len(bytecode)
+    result.ArgumentBytes = len(bytecodeArgument(device.ResolvePin(pin), bytecode))
+    if result.ArgumentBytes > particleArgumentLimit {
+        result.Error = fmt.Sprintf("setBytecode argument is %d bytes; Particle allows %d", result.ArgumentBytes, particleArgumentLimit)
+        return result
     }
-    return val
+
+    result.Success = true
+    result.SpeedMultiplier = device.StripSpeedMultiplier(pin)
+    return result
+}
+
+// particleArgumentLimit is the longest function argument the Particle Cloud
+// passes to a device
+const particleArgumentLimit = 622
+
+// bytecodeArgument is the setBytecode argument: "pin,<base64 bytecode>"
+func bytecodeArgument(pin int, bytecode []byte) string {
+    return fmt.Sprintf("%d,%s", pin, base64.StdEncoding.EncodeToString(bytecode))
 }
 
-func sendBytecodeToDevice(particleID string, pin int, bytecode []byte, token string) error {
-    // Base64 encode the bytecode
-    encoded := base64.StdEncoding.EncodeToString(bytecode)
-    argument := fmt.Sprintf("%d,%s", pin, encoded)
+func sendBytecodeToDevice(call shared.ParticleCaller, particleID string, pin int, bytecode []byte) error {
+    return call(particleID, "setBytecode", bytecodeArgument(pin, bytecode))
+}
+
+// newTimedCaller calls cloud functions on device under its command timeout
+// (Device.CommandTimeout), noting calls slow enough to warn about. A call
+// that times out is checked against the device's lastCmdId before failing,
+// so a retry doesn't send the pattern twice.
+func newTimedCaller(ctx context.Context, device shared.Device, token string) *shared.TimedCaller {
+    return shared.NewTimedCaller(ctx, device, func(ctx context.Context, particleID, function, argument string) error {
+        return callParticleFunction(ctx, particleID, function, argument, token)
+    }).VerifyWith(func(ctx context.Context, particleID, variable string) (string, error) {
+        return getParticleVariable(ctx, particleID, variable, token)
+    }).SequenceWith(devicesTable)
+}
+
+// getParticleVariable reads a string variable, retrying transient failures
+// (see shared.RetryParticleCall) and giving up when ctx is done
+func getParticleVariable(ctx context.Context, deviceID, variableName, token string) (string, error) {
+    var value string
+    _, err := shared.RetryParticleCall(ctx, variableName, func(ctx context.Context) error {
+        var err error
+        value, err = getParticleVariableOnce(ctx, deviceID, variableName, token)
+        return err
+    })
+    return value, err
+}
+
+// getParticleVariableOnce makes one attempt at reading a variable
+func getParticleVariableOnce(ctx context.Context, deviceID, variableName, token string) (value string, err error) {
+    start := time.Now()
+    defer func() { shared.ObserveParticleCall("variable", start, err) }()
+
+    url := fmt.Sprintf("%s/devices/%s/%s", shared.ParticleAPIBase(), deviceID, variableName)
+    req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+    if err != nil {
+        return "", err
+    }
+    req.Header.Set("Authorization", "Bearer "+token)
+
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        return "", err
+    }
+    defer resp.Body.Close()
+
+    body, _ := io.ReadAll(resp.Body)
+    if resp.StatusCode != http.StatusOK {
+        return "", &particleAPIError{StatusCode: resp.StatusCode, Body: string(body)}
+    }
+
+    var result struct {
+        Result string `json:"result"`
+    }
+    if err := json.Unmarshal(body, &result); err != nil {
+        return "", err
+    }
+    return result.Result, nil
+}
 
-    return callParticleFunction(particleID, "setBytecode", argument, token)
+// callParticleFunction calls a cloud function, retrying transient failures
+// (see shared.RetryParticleCall) and giving up when ctx is done
+func callParticleFunction(ctx context.Context, deviceID, functionName, argument, token string) error {
+    _, err := shared.RetryParticleCall(ctx, functionName, func(ctx context.Context) error {
+        return callParticleFunctionOnce(ctx, deviceID, functionName, argument, token)
+    })
+    return err
 }
 
-func callParticleFunction(deviceID, functionName, argument, token string) error {
-    url := fmt.Sprintf("%s/devices/%s/%s", particleAPIBase, deviceID, functionName)
+// callParticleFunctionOnce makes one attempt at a cloud function call
+func callParticleFunctionOnce(ctx context.Context, deviceID, functionName, argument, token string) (err error) {
+    start := time.Now()
+    defer func() { shared.ObserveParticleCall("function", start, err) }()
+
+    url := fmt.Sprintf("%s/devices/%s/%s", shared.ParticleAPIBase(), deviceID, functionName)
 
     log.Printf("Calling Particle function: %s on device %s", functionName, deviceID)
 
@@ -639,7 +1081,7 @@ func callParticleFunction(deviceID, functionName, argument, token string) error
     }
     jsonData, _ := json.Marshal(data)
 
-    req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+    req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
     if err != nil {
         return err
     }
@@ -647,8 +1089,7 @@ func callParticleFunction(deviceID, functionName, argument, token string) error
     req.Header.Set("Content-Type", "application/json")
     req.Header.Set("Authorization", "Bearer "+token)
 
-    client := &http.Client{Timeout: 30 * time.Second}
-    resp, err := client.Do(req)
+    resp, err := http.DefaultClient.Do(req)
     if err != nil {
         return err
     }
@@ -657,12 +1098,86 @@ func callParticleFunction(deviceID, functionName, argument, token string) error
     body, _ := io.ReadAll(resp.Body)
 
     if resp.StatusCode != http.StatusOK {
-        return fmt.Errorf("Particle API error (status %d): %s", resp.StatusCode, string(body))
+        return &particleAPIError{StatusCode: resp.StatusCode, Body: string(body)}
     }
 
     return nil
 }
 
+// particleAPIError is a non-200 response from the Particle API
+type particleAPIError struct {
+    StatusCode int
+    Body       string
+}
+
+// ParticleStatus is the HTTP status, for shared.IsCommandTimeout and
+// shared.IsRetryableParticleError
+func (e *particleAPIError) ParticleStatus() int {
+    return e.StatusCode
+}
+
+func (e *particleAPIError) Error() string {
+    return fmt.Sprintf("Particle API error (status %d): %s", e.StatusCode, e.Body)
+}
+
+// handleEvent dispatches scheduled lux automation checks, SQS batches (trial
+// reverts, ramp steps, and apply jobs), and API Gateway requests, which share
+// this code
+func handleEvent(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+    var probe struct {
+        Source  string `json:"source"`
+        Records []struct {
+            EventSource string `json:"eventSource"`
+        } `json:"Records"`
+    }
+    err := json.Unmarshal(raw, &probe)
+    if err == nil && probe.Source == "aws.events" {
+        defer shared.FlushMetrics(ctx)
+        return nil, handleLuxAutomationTick(ctx)
+    }
+    if err == nil && len(probe.Records) > 0 && probe.Records[0].EventSource == "aws:sqs" {
+        defer shared.FlushMetrics(ctx)
+
+        var event events.SQSEvent
+        if err := json.Unmarshal(raw, &event); err != nil {
+            return nil, err
+        }
+
+        // Apply job batches come from the worker's own queues, one queue per batch
+        switch source := event.Records[0].EventSourceARN; {
+        case applyJobQueueARN != "" && source == applyJobQueueARN:
+            return handleApplyJobMessages(ctx, event), nil
+        case applyJobDLQARN != "" && source == applyJobDLQARN:
+            return nil, handleApplyJobDeadLetters(ctx, event)
+        }
+
+        // Trial reverts and ramp steps arrive on separate queues
+        var trialRecords, rampRecords []events.SQSMessage
+        for _, record := range event.Records {
+            if rampStepQueueARN != "" && record.EventSourceARN == rampStepQueueARN {
+                rampRecords = append(rampRecords, record)
+            } else {
+                trialRecords = append(trialRecords, record)
+            }
+        }
+        if len(rampRecords) > 0 {
+            if err := handleRampStepMessages(ctx, events.SQSEvent{Records: rampRecords}); err != nil {
+                return nil, err
+            }
+        }
+        if len(trialRecords) > 0 {
+            return nil, handleTrialRevertMessages(ctx, events.SQSEvent{Records: trialRecords})
+        }
+        return nil, nil
+    }
+
+    var request events.APIGatewayProxyRequest
+    if err := json.Unmarshal(raw, &request); err != nil {
+        return nil, err
+    }
+    return shared.WithMetrics("virtualgroups", shared.WithSessionRotation(shared.WithActivityLog(handler)))(ctx, request)
+}
+
 func main() {
-    lambda.Start(handler)
+    lambda.Start(handleEvent)
 }
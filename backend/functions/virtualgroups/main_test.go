@@ -0,0 +1,236 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "net/http"
+    "regexp"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "github.com/aws/aws-lambda-go/events"
+
+    "candle-lights/backend/shared"
+)
+
+// stubDevices stands in for the devices table, honoring the updatedAt
+// condition saveStripPatternIDs writes with
+type stubDevices struct {
+    mu      sync.Mutex
+    items   map[string]shared.Device
+    puts    int
+    onWrite func() // Called before each PutItem is checked, to simulate another writer
+}
+
+func (s *stubDevices) handle(call shared.DynamoDBStubCall) (map[string]interface{}, error) {
+    switch call.Operation {
+    case "GetItem":
+        var key struct {
+            DeviceID string `dynamodbav:"deviceId"`
+        }
+        if err := call.Unmarshal("Key", &key); err != nil {
+            return nil, err
+        }
+        s.mu.Lock()
+        defer s.mu.Unlock()
+        device, ok := s.items[key.DeviceID]
+        if !ok {
+            return nil, nil
+        }
+        return map[string]interface{}{"Item": shared.DynamoDBStubItem(device)}, nil
+    case "PutItem":
+        if s.onWrite != nil {
+            s.onWrite()
+        }
+        var device shared.Device
+        var values struct {
+            LoadedAt time.Time `dynamodbav:":loadedAt"`
+        }
+        if err := call.Unmarshal("Item", &device); err != nil {
+            return nil, err
+        }
+        if err := call.Unmarshal("ExpressionAttributeValues", &values); err != nil {
+            return nil, err
+        }
+        s.mu.Lock()
+        defer s.mu.Unlock()
+        s.puts++
+        if !s.items[device.DeviceID].UpdatedAt.Equal(values.LoadedAt) {
+            return nil, shared.ErrDynamoDBStubConditionFailed
+        }
+        s.items[device.DeviceID] = device
+        return nil, nil
+    }
+    return nil, fmt.Errorf("unexpected %s", call.Operation)
+}
+
+func threeStripDevice() shared.Device {
+    return shared.Device{
+        DeviceID:  "d1",
+        UserID:    "lee",
+        Name:      "Garage",
+        UpdatedAt: time.Now().Add(-time.Minute).UTC(),
+        LEDStrips: []shared.LEDStrip{
+            {Pin: 6, LEDCount: 30, PatternID: "old"},
+            {Pin: 7, LEDCount: 30, PatternID: "old"},
+            {Pin: 8, LEDCount: 30, PatternID: "old"},
+        },
+    }
+}
+
+func TestSaveStripPatternIDsWritesDeviceOnce(t *testing.T) {
+    device := threeStripDevice()
+    store := &stubDevices{items: map[string]shared.Device{"d1": device}}
+    defer shared.StubDynamoDB(store.handle)()
+
+    // Both strips of the device are group members
+    if err := saveStripPatternIDs(context.Background(), device, []int{6, 7}, "sunset"); err != nil {
+        t.Fatal(err)
+    }
+    if store.puts != 1 {
+        t.Errorf("%d device writes, want 1", store.puts)
+    }
+    saved := store.items["d1"].LEDStrips
+    if saved[0].PatternID != "sunset" || saved[1].PatternID != "sunset" || saved[2].PatternID != "old" {
+        t.Errorf("strip patterns = %s, %s, %s; want sunset, sunset, old", saved[0].PatternID, saved[1].PatternID, saved[2].PatternID)
+    }
+}
+
+func TestSaveStripPatternIDsKeepsConcurrentWrite(t *testing.T) {
+    device := threeStripDevice()
+    store := &stubDevices{items: map[string]shared.Device{"d1": device}}
+    defer shared.StubDynamoDB(store.handle)()
+
+    // Another apply changes the third strip between our read and write
+    store.onWrite = func() {
+        store.onWrite = nil
+        store.mu.Lock()
+        defer store.mu.Unlock()
+        other := store.items["d1"]
+        other.LEDStrips = append([]shared.LEDStrip(nil), other.LEDStrips...)
+        other.LEDStrips[2].PatternID = "candle"
+        other.UpdatedAt = time.Now().UTC()
+        store.items["d1"] = other
+    }
+
+    if err := saveStripPatternIDs(context.Background(), device, []int{6, 7}, "sunset"); err != nil {
+        t.Fatal(err)
+    }
+    if store.puts != 2 {
+        t.Errorf("%d device writes, want 2 (one conflict, one retry)", store.puts)
+    }
+    saved := store.items["d1"].LEDStrips
+    if saved[0].PatternID != "sunset" || saved[1].PatternID != "sunset" || saved[2].PatternID != "candle" {
+        t.Errorf("strip patterns = %s, %s, %s; want sunset, sunset, candle", saved[0].PatternID, saved[1].PatternID, saved[2].PatternID)
+    }
+}
+
+func TestForeignResourcesLookMissing(t *testing.T) {
+    defer shared.StubDynamoDB(shared.StubOwnershipHandler("lee", "foreign", "sam"))()
+
+    routes := []struct {
+        method, path, param, body string
+    }{
+        {"GET", "/api/virtual-groups/%s", "groupId", ""},
+        {"PUT", "/api/virtual-groups/%s", "groupId", `{"name":"Porch"}`},
+        {"DELETE", "/api/virtual-groups/%s", "groupId", ""},
+        {"POST", "/api/virtual-groups/%s/apply", "groupId", `{"patternId":"p1"}`},
+        {"GET", "/api/ramps/%s", "rampId", ""},
+        {"POST", "/api/ramps/%s/cancel", "rampId", ""},
+        {"GET", "/api/apply-jobs/%s", "jobId", ""},
+        {"POST", "/api/trials/%s/keep", "trialId", ""},
+        {"POST", "/api/trials/%s/cancel", "trialId", ""},
+        {"GET", "/api/devices/%s/strips/6/ramp", "deviceId", ""},
+        {"POST", "/api/devices/%s/strips/6/ramp", "deviceId", `{"targetBrightnessPercent":50,"durationSeconds":60}`},
+        {"POST", "/api/devices/%s/strips/6/try", "deviceId", `{"patternId":"p1"}`},
+        {"GET", "/api/automations/lux/%s", "automationId", ""},
+        {"GET", "/api/automations/lux/%s/runs", "automationId", ""},
+        {"PUT", "/api/automations/lux/%s", "automationId", `{"name":"Dusk"}`},
+        {"DELETE", "/api/automations/lux/%s", "automationId", ""},
+    }
+    for _, route := range routes {
+        var responses [2]events.APIGatewayProxyResponse
+        for i, id := range []string{"foreign", "missing"} {
+            resp, err := handler(context.Background(), events.APIGatewayProxyRequest{
+                HTTPMethod:     route.method,
+                Path:           fmt.Sprintf(route.path, id),
+                PathParameters: map[string]string{route.param: id, "pin": "6"},
+                Headers:        map[string]string{"Authorization": "Bearer session-lee"},
+                Body:           route.body,
+            })
+            if err != nil {
+                t.Fatalf("%s %s: %v", route.method, route.path, err)
+            }
+            responses[i] = resp
+        }
+        if responses[0].StatusCode != 404 || responses[0].StatusCode != responses[1].StatusCode || responses[0].Body != responses[1].Body {
+            t.Errorf("%s %s: foreign = %d %s, missing = %d %s; want the same 404", route.method, route.path,
+                responses[0].StatusCode, responses[0].Body, responses[1].StatusCode, responses[1].Body)
+        }
+    }
+}
+
+// TestDocumentedRoutesAreRouted checks shared.APIRoutes against the router:
+// every documented virtual-groups route reaches its auth check rather than a 404
+func TestDocumentedRoutesAreRouted(t *testing.T) {
+    param := regexp.MustCompile(`\{([^}]+)\}`)
+    found := 0
+    for _, doc := range shared.APIRoutes {
+        if doc.Service != "virtual-groups" {
+            continue
+        }
+        found++
+        request := events.APIGatewayProxyRequest{HTTPMethod: doc.Method, PathParameters: map[string]string{}}
+        request.Path = param.ReplaceAllStringFunc(doc.Path, func(name string) string {
+            request.PathParameters[name[1:len(name)-1]] = "x"
+            return "x"
+        })
+        resp, err := router.Dispatch(context.Background(), request)
+        if err != nil || resp.StatusCode != 401 {
+            t.Errorf("%s %s without a session = %d, %v; want 401", doc.Method, doc.Path, resp.StatusCode, err)
+        }
+    }
+    if found == 0 {
+        t.Error("no virtual-groups routes in shared.APIRoutes")
+    }
+}
+
+func TestParticleCallsRetryTransientFailures(t *testing.T) {
+    tests := []struct {
+        name         string
+        statuses     []int // Particle's answers in turn, then 200
+        wantAttempts int
+        wantErr      bool
+    }{
+        {"first try", nil, 1, false},
+        {"one 503", []int{503}, 2, false},
+        {"rate limited", []int{429}, 2, false},
+        {"5xx every time", []int{502, 502, 502}, 3, true},
+        {"invalid token", []int{401}, 1, true},
+    }
+    for _, tt := range tests {
+        var requests atomic.Int32
+        restore := shared.StubParticleAPI(func(w http.ResponseWriter, r *http.Request) {
+            if n := int(requests.Add(1)); n <= len(tt.statuses) {
+                w.WriteHeader(tt.statuses[n-1])
+                return
+            }
+            w.Write([]byte(`{"result":"3.1.0","return_value":1}`))
+        })
+
+        ctx, attempts := shared.WithParticleAttempts(context.Background())
+        err := callParticleFunction(ctx, "p1", "setPattern", "6,1", "token")
+        if (err != nil) != tt.wantErr || int(requests.Load()) != tt.wantAttempts || attempts.Attempts() != tt.wantAttempts {
+            t.Errorf("%s: function call = %v after %d requests, %d counted; want %d", tt.name, err, requests.Load(), attempts.Attempts(), tt.wantAttempts)
+        }
+
+        requests.Store(0)
+        value, err := getParticleVariable(context.Background(), "p1", "version", "token")
+        if (err != nil) != tt.wantErr || int(requests.Load()) != tt.wantAttempts || (err == nil && value != "3.1.0") {
+            t.Errorf("%s: variable read = %q, %v after %d requests; want %d", tt.name, value, err, requests.Load(), tt.wantAttempts)
+        }
+        restore()
+    }
+}
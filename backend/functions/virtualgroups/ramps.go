@@ -0,0 +1,548 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "math"
+    "os"
+    "strconv"
+    "time"
+
+    "github.com/aws/aws-lambda-go/events"
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/config"
+    "github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+    "github.com/aws/aws-sdk-go-v2/service/dynamodb"
+    "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+    "github.com/aws/aws-sdk-go-v2/service/sqs"
+    "github.com/google/uuid"
+
+    "candle-lights/backend/shared"
+)
+
+var (
+    rampsTable       = os.Getenv("RAMPS_TABLE")
+    rampStepQueueURL = os.Getenv("RAMP_STEP_QUEUE_URL")
+    rampStepQueueARN = os.Getenv("RAMP_STEP_QUEUE_ARN")
+)
+
+// rampStepMessage is the delayed SQS message that applies one ramp step
+type rampStepMessage struct {
+    RampID string `json:"rampId"`
+    Step   int    `json:"step"`
+}
+
+// RampResponse is returned when a ramp starts or is queried
+type RampResponse struct {
+    Ramp    shared.Ramp    `json:"ramp"`
+    Results []MemberResult `json:"results,omitempty"`
+}
+
+// rampRequest is the body of a ramp start request
+type rampRequest struct {
+    TargetBrightnessPercent *int `json:"targetBrightnessPercent"`
+    FromBrightnessPercent   *int `json:"fromBrightnessPercent"` // Default 100
+    DurationSeconds         int  `json:"durationSeconds"`
+}
+
+// handleStartStripRamp ramps one strip's brightness
+func handleStartStripRamp(ctx context.Context, username, deviceID, pinParam string, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+    pin, err := strconv.Atoi(pinParam)
+    if err != nil {
+        return shared.CreateErrorResponse(400, "Invalid pin"), nil
+    }
+
+    rampReq, errResp := parseRampRequest(request)
+    if errResp != nil {
+        return *errResp, nil
+    }
+
+    deviceKey, _ := attributevalue.MarshalMap(map[string]string{
+        "deviceId": deviceID,
+    })
+
+    var device shared.Device
+    if err := shared.GetItem(ctx, devicesTable, deviceKey, &device); err != nil {
+        log.Printf("Failed to get device: %v", err)
+        return shared.CreateErrorResponse(500, "Database error"), nil
+    }
+
+    if device.DeviceID == "" || device.UserID != username {
+        return shared.CreateErrorResponse(404, "Device not found"), nil
+    }
+
+    hasStrip := false
+    for _, strip := range device.LEDStrips {
+        if strip.Pin == pin {
+            hasStrip = true
+            break
+        }
+    }
+    if !hasStrip {
+        return shared.CreateErrorResponse(404, "No strip configured on that pin"), nil
+    }
+
+    members := []shared.VirtualGroupMember{{DeviceID: deviceID, Pin: pin}}
+    return startRamp(ctx, username, "", []shared.Device{device}, members, rampReq)
+}
+
+// handleStartGroupRamp ramps every strip in a virtual group together
+func handleStartGroupRamp(ctx context.Context, username, groupID string, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+    rampReq, errResp := parseRampRequest(request)
+    if errResp != nil {
+        return *errResp, nil
+    }
+
+    groupKey, _ := attributevalue.MarshalMap(map[string]string{
+        "groupId": groupID,
+    })
+
+    var group shared.VirtualGroup
+    if err := shared.GetItem(ctx, virtualGroupsTable, groupKey, &group); err != nil {
+        log.Printf("Failed to get virtual group: %v", err)
+        return shared.CreateErrorResponse(500, "Database error"), nil
+    }
+
+    if group.GroupID == "" || group.UserID != username {
+        return shared.CreateErrorResponse(404, "Virtual group not found"), nil
+    }
+
+    devices, err := loadMemberDevices(ctx, group.Members)
+    if err != nil {
+        log.Printf("Failed to load group devices: %v", err)
+        return shared.CreateErrorResponse(500, "Database error"), nil
+    }
+
+    return startRamp(ctx, username, groupID, devices, group.Members, rampReq)
+}
+
+// handleGetRamp returns a ramp's progress
+func handleGetRamp(ctx context.Context, username, rampID string) (events.APIGatewayProxyResponse, error) {
+    ramp, errResp := getOwnedRamp(ctx, username, rampID)
+    if errResp != nil {
+        return *errResp, nil
+    }
+
+    return shared.CreateSuccessResponse(200, RampResponse{Ramp: *ramp}), nil
+}
+
+// handleGetStripRamp returns the ramp currently running on a strip
+func handleGetStripRamp(ctx context.Context, username, deviceID, pinParam string) (events.APIGatewayProxyResponse, error) {
+    pin, err := strconv.Atoi(pinParam)
+    if err != nil {
+        return shared.CreateErrorResponse(400, "Invalid pin"), nil
+    }
+
+    pointerKey, _ := attributevalue.MarshalMap(map[string]string{
+        "rampId": shared.RampStripKey(deviceID, pin),
+    })
+
+    var pointer shared.RampStripPointer
+    if err := shared.GetItem(ctx, rampsTable, pointerKey, &pointer); err != nil {
+        log.Printf("Failed to get strip ramp: %v", err)
+        return shared.CreateErrorResponse(500, "Database error"), nil
+    }
+
+    if pointer.ActiveRampID == "" {
+        return shared.CreateErrorResponse(404, "No ramp running on this strip"), nil
+    }
+
+    return handleGetRamp(ctx, username, pointer.ActiveRampID)
+}
+
+// handleCancelRamp stops a ramp, leaving its strips at their current brightness
+func handleCancelRamp(ctx context.Context, username, rampID string) (events.APIGatewayProxyResponse, error) {
+    if _, errResp := getOwnedRamp(ctx, username, rampID); errResp != nil {
+        return *errResp, nil
+    }
+
+    ramp, err := shared.FinishRamp(ctx, rampID, shared.RampStatusCancelled, shared.RampEventCancelled, "cancelled by user")
+    if errors.Is(err, shared.ErrRampNotActive) {
+        return shared.CreateErrorResponse(409, "Ramp is no longer active"), nil
+    }
+    if err != nil {
+        log.Printf("Failed to cancel ramp %s: %v", rampID, err)
+        return shared.CreateErrorResponse(500, "Database error"), nil
+    }
+
+    releaseRampPointers(ctx, *ramp)
+    return shared.CreateSuccessResponse(200, RampResponse{Ramp: *ramp}), nil
+}
+
+// handleRampStepMessages applies the ramp steps whose delay has elapsed and
+// schedules the next one. Steps for ramps that finished, or duplicate
+// deliveries of a step already applied, are skipped.
+func handleRampStepMessages(ctx context.Context, event events.SQSEvent) error {
+    for _, record := range event.Records {
+        var msg rampStepMessage
+        if err := json.Unmarshal([]byte(record.Body), &msg); err != nil || msg.RampID == "" {
+            log.Printf("Ignoring malformed ramp step message %s: %v", record.MessageId, err)
+            continue
+        }
+
+        if err := applyRampStep(ctx, msg); err != nil {
+            // Returning the error lets SQS redeliver the message
+            return fmt.Errorf("failed to apply step %d of ramp %s: %v", msg.Step, msg.RampID, err)
+        }
+    }
+    return nil
+}
+
+func applyRampStep(ctx context.Context, msg rampStepMessage) error {
+    rampKey, _ := attributevalue.MarshalMap(map[string]string{
+        "rampId": msg.RampID,
+    })
+
+    var ramp shared.Ramp
+    if err := shared.GetItem(ctx, rampsTable, rampKey, &ramp); err != nil {
+        return err
+    }
+
+    if ramp.Status != shared.RampStatusActive || msg.Step != ramp.CurrentStep+1 {
+        log.Printf("Skipping step %d of ramp %s (status %s, at step %d)", msg.Step, ramp.RampID, ramp.Status, ramp.CurrentStep)
+        return nil
+    }
+
+    // Strips taken over by another ramp or brightness command drop out
+    members, err := ownedRampMembers(ctx, ramp)
+    if err != nil {
+        return err
+    }
+    if len(members) == 0 {
+        _, err := shared.FinishRamp(ctx, ramp.RampID, shared.RampStatusCancelled, shared.RampEventCancelled, "all strips were taken over by another brightness command")
+        if errors.Is(err, shared.ErrRampNotActive) {
+            return nil
+        }
+        return err
+    }
+
+    user, errResp := getUserWithToken(ctx, ramp.UserID)
+    if errResp != nil {
+        log.Printf("Cannot continue ramp %s: no Particle token for %s", ramp.RampID, ramp.UserID)
+        _, err := shared.FinishRamp(ctx, ramp.RampID, shared.RampStatusCancelled, shared.RampEventCancelled, "Particle token not configured")
+        if err == nil {
+            releaseRampPointers(ctx, ramp)
+        }
+        return nil
+    }
+
+    devices, err := loadMemberDevices(ctx, members)
+    if err != nil {
+        return err
+    }
+
+    percent := ramp.BrightnessAtStep(msg.Step)
+    results, _, failed := setBrightnessForMembers(ctx, devices, members, percent, user.ParticleToken)
+    if failed > 0 {
+        // A missed step is corrected by the next one, so keep going
+        log.Printf("Ramp %s step %d: %d of %d strips failed: %+v", ramp.RampID, msg.Step, failed, len(members), results)
+    }
+
+    if err := advanceRampStep(ctx, ramp.RampID, msg.Step); err != nil {
+        var conflict *types.ConditionalCheckFailedException
+        if errors.As(err, &conflict) {
+            log.Printf("Ramp %s finished while step %d was applied", ramp.RampID, msg.Step)
+            return nil
+        }
+        return err
+    }
+
+    if msg.Step >= ramp.Steps {
+        finished, err := shared.FinishRamp(ctx, ramp.RampID, shared.RampStatusCompleted, shared.RampEventCompleted, fmt.Sprintf("reached %d%%", ramp.TargetPercent))
+        if errors.Is(err, shared.ErrRampNotActive) {
+            return nil
+        }
+        if err != nil {
+            return err
+        }
+        releaseRampPointers(ctx, *finished)
+        log.Printf("Completed ramp %s at %d%%", ramp.RampID, ramp.TargetPercent)
+        return nil
+    }
+
+    return scheduleRampStep(ctx, ramp.RampID, msg.Step+1, ramp.StepSeconds)
+}
+
+// startRamp takes over the members' strips, applies the starting brightness,
+// and schedules the first step
+func startRamp(ctx context.Context, username, groupID string, devices []shared.Device, members []shared.VirtualGroupMember, rampReq rampRequest) (events.APIGatewayProxyResponse, error) {
+    user, errResp := getUserWithToken(ctx, username)
+    if errResp != nil {
+        return *errResp, nil
+    }
+
+    fromPercent := 100
+    if rampReq.FromBrightnessPercent != nil {
+        fromPercent = *rampReq.FromBrightnessPercent
+    }
+
+    steps, stepSeconds := shared.PlanRampSteps(rampReq.DurationSeconds)
+    // Fewer, longer steps keep every device within its rate limit; a ramp
+    // too short for even one step runs late rather than being refused
+    if minSeconds := rampStepSecondsForRateLimit(devices, members); stepSeconds < minSeconds {
+        stepSeconds = minSeconds
+        steps = rampReq.DurationSeconds / stepSeconds
+        if steps < 1 {
+            steps = 1
+        }
+        log.Printf("Stretched ramp to %d steps of %ds to stay within device rate limits", steps, stepSeconds)
+    }
+    now := time.Now()
+    ramp := shared.Ramp{
+        RampID:          uuid.New().String(),
+        UserID:          username,
+        GroupID:         groupID,
+        Targets:         members,
+        FromPercent:     fromPercent,
+        TargetPercent:   *rampReq.TargetBrightnessPercent,
+        DurationSeconds: rampReq.DurationSeconds,
+        Steps:           steps,
+        StepSeconds:     stepSeconds,
+        Status:          shared.RampStatusActive,
+        History:         []shared.RampEvent{{Event: shared.RampEventStarted, At: now, Detail: fmt.Sprintf("%d%% to %d%% over %ds in %d steps", fromPercent, *rampReq.TargetBrightnessPercent, rampReq.DurationSeconds, steps)}},
+        StartedAt:       now,
+        ETA:             now.Add(time.Duration(steps*stepSeconds) * time.Second),
+        UpdatedAt:       now,
+    }
+    ramp.ExpiresAt = shared.RampExpiresAt(ramp.ETA)
+
+    if err := shared.PutItem(ctx, rampsTable, ramp); err != nil {
+        log.Printf("Failed to save ramp: %v", err)
+        return shared.CreateErrorResponse(500, "Failed to save ramp"), nil
+    }
+
+    // A new ramp replaces whatever was running on these strips
+    for _, member := range members {
+        if err := shared.CancelStripRamp(ctx, member.DeviceID, member.Pin, "superseded by ramp "+ramp.RampID); err != nil {
+            log.Printf("Failed to cancel previous ramp on device %s pin %d: %v", member.DeviceID, member.Pin, err)
+        }
+        pointer := shared.RampStripPointer{
+            RampID:       shared.RampStripKey(member.DeviceID, member.Pin),
+            ActiveRampID: ramp.RampID,
+            ExpiresAt:    ramp.ExpiresAt,
+        }
+        if err := shared.PutItem(ctx, rampsTable, pointer); err != nil {
+            log.Printf("Failed to claim device %s pin %d for ramp: %v", member.DeviceID, member.Pin, err)
+        }
+    }
+
+    results, succeeded, _ := setBrightnessForMembers(ctx, devices, members, fromPercent, user.ParticleToken)
+    if succeeded == 0 {
+        if finished, err := shared.FinishRamp(ctx, ramp.RampID, shared.RampStatusCancelled, shared.RampEventCancelled, "no strip accepted the starting brightness"); err == nil {
+            releaseRampPointers(ctx, *finished)
+            ramp = *finished
+        }
+        return shared.CreateSuccessResponse(502, RampResponse{Ramp: ramp, Results: results}), nil
+    }
+
+    if err := scheduleRampStep(ctx, ramp.RampID, 1, stepSeconds); err != nil {
+        log.Printf("Failed to schedule ramp step: %v", err)
+        if _, err := shared.FinishRamp(ctx, ramp.RampID, shared.RampStatusCancelled, shared.RampEventCancelled, "failed to schedule steps"); err == nil {
+            releaseRampPointers(ctx, ramp)
+        }
+        return shared.CreateErrorResponse(500, "Failed to schedule ramp"), nil
+    }
+
+    log.Printf("Started ramp %s on %d strips: %d%% -> %d%% over %ds (%d steps)", ramp.RampID, len(members), fromPercent, ramp.TargetPercent, ramp.DurationSeconds, steps)
+    return shared.CreateSuccessResponse(201, RampResponse{Ramp: ramp, Results: results}), nil
+}
+
+// rampStepSecondsForRateLimit is the shortest step that keeps every device
+// within its sustained command rate, as each step sends one setBright per strip
+func rampStepSecondsForRateLimit(devices []shared.Device, members []shared.VirtualGroupMember) int {
+    stripsPerDevice := make(map[string]int)
+    for _, member := range members {
+        stripsPerDevice[member.DeviceID]++
+    }
+
+    seconds := 0
+    for _, device := range devices {
+        if strips := stripsPerDevice[device.DeviceID]; strips > 0 {
+            if s := int(math.Ceil(device.CommandSpacing(strips).Seconds())); s > seconds {
+                seconds = s
+            }
+        }
+    }
+    return seconds
+}
+
+func parseRampRequest(request events.APIGatewayProxyRequest) (rampRequest, *events.APIGatewayProxyResponse) {
+    var rampReq rampRequest
+
+    body := shared.GetRequestBody(request)
+    if err := json.Unmarshal([]byte(body), &rampReq); err != nil {
+        resp := shared.CreateErrorResponse(400, "Invalid request body")
+        return rampReq, &resp
+    }
+
+    if rampReq.TargetBrightnessPercent == nil || *rampReq.TargetBrightnessPercent < 0 || *rampReq.TargetBrightnessPercent > 100 {
+        resp := shared.CreateErrorResponse(400, "targetBrightnessPercent must be between 0 and 100")
+        return rampReq, &resp
+    }
+
+    if rampReq.FromBrightnessPercent != nil && (*rampReq.FromBrightnessPercent < 0 || *rampReq.FromBrightnessPercent > 100) {
+        resp := shared.CreateErrorResponse(400, "fromBrightnessPercent must be between 0 and 100")
+        return rampReq, &resp
+    }
+
+    if rampReq.DurationSeconds < 1 || rampReq.DurationSeconds > shared.MaxRampSeconds {
+        resp := shared.CreateErrorResponse(400, fmt.Sprintf("durationSeconds must be between 1 and %d", shared.MaxRampSeconds))
+        return rampReq, &resp
+    }
+
+    return rampReq, nil
+}
+
+func getOwnedRamp(ctx context.Context, username, rampID string) (*shared.Ramp, *events.APIGatewayProxyResponse) {
+    key, _ := attributevalue.MarshalMap(map[string]string{
+        "rampId": rampID,
+    })
+
+    var ramp shared.Ramp
+    if err := shared.GetItem(ctx, rampsTable, key, &ramp); err != nil {
+        log.Printf("Failed to get ramp: %v", err)
+        resp := shared.CreateErrorResponse(500, "Database error")
+        return nil, &resp
+    }
+
+    if ramp.RampID == "" || ramp.UserID == "" || ramp.UserID != username {
+        resp := shared.CreateErrorResponse(404, "Ramp not found")
+        return nil, &resp
+    }
+
+    return &ramp, nil
+}
+
+// loadMemberDevices fetches each distinct device referenced by members
+func loadMemberDevices(ctx context.Context, members []shared.VirtualGroupMember) ([]shared.Device, error) {
+    var devices []shared.Device
+    seen := make(map[string]bool)
+    for _, member := range members {
+        if seen[member.DeviceID] {
+            continue
+        }
+        seen[member.DeviceID] = true
+
+        deviceKey, _ := attributevalue.MarshalMap(map[string]string{
+            "deviceId": member.DeviceID,
+        })
+
+        var device shared.Device
+        if err := shared.GetItem(ctx, devicesTable, deviceKey, &device); err != nil {
+            return nil, err
+        }
+        if device.DeviceID != "" {
+            devices = append(devices, device)
+        }
+    }
+    return devices, nil
+}
+
+// ownedRampMembers returns the ramp's strips whose pointer still names this ramp
+func ownedRampMembers(ctx context.Context, ramp shared.Ramp) ([]shared.VirtualGroupMember, error) {
+    var members []shared.VirtualGroupMember
+    for _, member := range ramp.Targets {
+        pointerKey, _ := attributevalue.MarshalMap(map[string]string{
+            "rampId": shared.RampStripKey(member.DeviceID, member.Pin),
+        })
+
+        var pointer shared.RampStripPointer
+        if err := shared.GetItem(ctx, rampsTable, pointerKey, &pointer); err != nil {
+            return nil, err
+        }
+        if pointer.ActiveRampID == ramp.RampID {
+            members = append(members, member)
+        }
+    }
+    return members, nil
+}
+
+// advanceRampStep records step as applied, unless the ramp finished meanwhile
+func advanceRampStep(ctx context.Context, rampID string, step int) error {
+    client, err := shared.InitDynamoDB()
+    if err != nil {
+        return err
+    }
+
+    _, err = client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+        TableName: aws.String(rampsTable),
+        Key: map[string]types.AttributeValue{
+            "rampId": &types.AttributeValueMemberS{Value: rampID},
+        },
+        UpdateExpression:    aws.String("SET currentStep = :step, updatedAt = :now"),
+        ConditionExpression: aws.String("#status = :active AND currentStep = :previous"),
+        ExpressionAttributeNames: map[string]string{
+            "#status": "status",
+        },
+        ExpressionAttributeValues: map[string]types.AttributeValue{
+            ":step":     &types.AttributeValueMemberN{Value: strconv.Itoa(step)},
+            ":previous": &types.AttributeValueMemberN{Value: strconv.Itoa(step - 1)},
+            ":active":   &types.AttributeValueMemberS{Value: shared.RampStatusActive},
+            ":now":      &types.AttributeValueMemberS{Value: time.Now().Format(time.RFC3339Nano)},
+        },
+    })
+    return err
+}
+
+// releaseRampPointers frees the ramp's strips that it still owns
+func releaseRampPointers(ctx context.Context, ramp shared.Ramp) {
+    client, err := shared.InitDynamoDB()
+    if err != nil {
+        log.Printf("Failed to release ramp strips: %v", err)
+        return
+    }
+
+    for _, member := range ramp.Targets {
+        _, err := client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+            TableName: aws.String(rampsTable),
+            Key: map[string]types.AttributeValue{
+                "rampId": &types.AttributeValueMemberS{Value: shared.RampStripKey(member.DeviceID, member.Pin)},
+            },
+            ConditionExpression: aws.String("activeRampId = :rampId"),
+            ExpressionAttributeValues: map[string]types.AttributeValue{
+                ":rampId": &types.AttributeValueMemberS{Value: ramp.RampID},
+            },
+        })
+        if err != nil {
+            var conflict *types.ConditionalCheckFailedException
+            if !errors.As(err, &conflict) {
+                log.Printf("Failed to release device %s pin %d from ramp %s: %v", member.DeviceID, member.Pin, ramp.RampID, err)
+            }
+        }
+    }
+}
+
+// cancelMemberRamps stops ramps on strips about to get a brightness command
+func cancelMemberRamps(ctx context.Context, members []shared.VirtualGroupMember, reason string) {
+    for _, member := range members {
+        if err := shared.CancelStripRamp(ctx, member.DeviceID, member.Pin, reason); err != nil {
+            log.Printf("Failed to cancel ramp on device %s pin %d: %v", member.DeviceID, member.Pin, err)
+        }
+    }
+}
+
+// scheduleRampStep sends the delayed message that applies step
+func scheduleRampStep(ctx context.Context, rampID string, step, delaySeconds int) error {
+    if rampStepQueueURL == "" {
+        return fmt.Errorf("RAMP_STEP_QUEUE_URL is not configured")
+    }
+
+    if sqsClient == nil {
+        cfg, err := config.LoadDefaultConfig(ctx)
+        if err != nil {
+            return err
+        }
+        sqsClient = sqs.NewFromConfig(cfg)
+    }
+
+    body, _ := json.Marshal(rampStepMessage{RampID: rampID, Step: step})
+    _, err := sqsClient.SendMessage(ctx, &sqs.SendMessageInput{
+        QueueUrl:     aws.String(rampStepQueueURL),
+        MessageBody:  aws.String(string(body)),
+        DelaySeconds: int32(delaySeconds),
+    })
+    return err
+}
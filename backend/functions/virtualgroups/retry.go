@@ -0,0 +1,185 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "log"
+    "strings"
+    "time"
+
+    "github.com/aws/aws-lambda-go/events"
+    "github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+
+    "candle-lights/backend/shared"
+)
+
+// attachRetryTokens gives each failed member a token that
+// POST /api/virtual-groups/retry accepts to try that member again. A no-op
+// when retries aren't configured.
+func attachRetryTokens(username, groupID, patternID string, results []MemberResult) {
+    if !shared.ApplyRetryEnabled() {
+        return
+    }
+    now := time.Now()
+    for i := range results {
+        if results[i].Success {
+            continue
+        }
+        token, err := shared.IssueApplyRetryToken(shared.ApplyRetryTarget{
+            UserID:    username,
+            GroupID:   groupID,
+            PatternID: patternID,
+            DeviceID:  results[i].DeviceID,
+            Pin:       results[i].Pin,
+            Colors:    results[i].colors,
+        }, now)
+        if err != nil {
+            log.Printf("Failed to issue retry token for device %s pin %d: %v", results[i].DeviceID, results[i].Pin, err)
+            continue
+        }
+        results[i].RetryToken = token
+    }
+}
+
+// handleRetryApply re-applies a group apply's pattern to just the members
+// named by retryTokens. Every token must come from the same group and
+// pattern. Members since removed from the group fail without being sent
+// to. Bytecode comes from the compile cache when it is still there.
+func handleRetryApply(ctx context.Context, username string, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+    var retryReq struct {
+        RetryTokens []string `json:"retryTokens"`
+    }
+
+    body := shared.GetRequestBody(request)
+    if err := json.Unmarshal([]byte(body), &retryReq); err != nil {
+        return shared.CreateErrorResponse(400, "Invalid request body"), nil
+    }
+
+    if len(retryReq.RetryTokens) == 0 {
+        return shared.CreateErrorResponse(400, "retryTokens is required"), nil
+    }
+
+    if !shared.ApplyRetryEnabled() {
+        return shared.CreateErrorResponse(503, shared.ErrApplyRetryNotConfigured.Error()), nil
+    }
+
+    // Parse every token before doing anything, dropping repeats
+    now := time.Now()
+    var targets []shared.ApplyRetryTarget
+    seen := make(map[string]bool)
+    for i, token := range retryReq.RetryTokens {
+        target, err := shared.ParseApplyRetryToken(token, username, now)
+        if err != nil {
+            return shared.CreateErrorResponse(400, fmt.Sprintf("retryTokens[%d]: %v", i, err)), nil
+        }
+        if len(targets) > 0 && (target.GroupID != targets[0].GroupID || target.PatternID != targets[0].PatternID) {
+            return shared.CreateErrorResponse(400, "retryTokens must all come from the same group apply"), nil
+        }
+        key := shared.ApplyTargetKey(target.DeviceID, target.Pin)
+        if seen[key] {
+            continue
+        }
+        seen[key] = true
+        targets = append(targets, target)
+    }
+
+    groupID := targets[0].GroupID
+    patternID := targets[0].PatternID
+
+    groupKey, _ := attributevalue.MarshalMap(map[string]string{
+        "groupId": groupID,
+    })
+
+    var group shared.VirtualGroup
+    if err := shared.GetItem(ctx, virtualGroupsTable, groupKey, &group); err != nil {
+        log.Printf("Failed to get virtual group: %v", err)
+        return shared.CreateErrorResponse(500, "Database error"), nil
+    }
+
+    if group.GroupID == "" || group.UserID != username {
+        return shared.CreateErrorResponse(404, "Virtual group not found"), nil
+    }
+
+    patternKey, _ := attributevalue.MarshalMap(map[string]string{
+        "patternId": patternID,
+    })
+
+    var pattern shared.Pattern
+    if err := shared.GetItem(ctx, patternsTable, patternKey, &pattern); err != nil {
+        log.Printf("Failed to get pattern: %v", err)
+        return shared.CreateErrorResponse(500, "Database error"), nil
+    }
+
+    if pattern.PatternID == "" || pattern.UserID != username {
+        return shared.CreateErrorResponse(404, "Pattern not found"), nil
+    }
+
+    user, errResp := getUserWithToken(ctx, username)
+    if errResp != nil {
+        return *errResp, nil
+    }
+
+    inGroup := make(map[string]bool, len(group.Members))
+    for _, member := range group.Members {
+        inGroup[shared.ApplyTargetKey(member.DeviceID, member.Pin)] = true
+    }
+
+    // Members that got different colors from an alternateColors variation
+    // are retried in batches of the same colors
+    overrides := shared.GroupOutputOverrides(group)
+    var batchOrder []string
+    batches := make(map[string][]shared.VirtualGroupMember)
+    batchOverrides := make(map[string]shared.OutputOverrides)
+    var removed []MemberResult
+    for _, target := range targets {
+        if !inGroup[shared.ApplyTargetKey(target.DeviceID, target.Pin)] {
+            removed = append(removed, MemberResult{DeviceID: target.DeviceID, Pin: target.Pin, Error: "No longer a member of the group"})
+            continue
+        }
+        batch := strings.Join(target.Colors, "/")
+        if _, ok := batches[batch]; !ok {
+            batchOrder = append(batchOrder, batch)
+            batchOverrides[batch] = retryOverrides(overrides, target)
+        }
+        batches[batch] = append(batches[batch], shared.VirtualGroupMember{DeviceID: target.DeviceID, Pin: target.Pin})
+    }
+
+    log.Printf("Retrying apply of pattern %s to %d members of group %s", patternID, len(targets)-len(removed), groupID)
+
+    var results []MemberResult
+    succeeded, failed := 0, 0
+    for _, batch := range batchOrder {
+        batchResults, batchSucceeded, batchFailed := applyPatternToMembers(ctx, username, batches[batch], pattern, batchOverrides[batch], user.ParticleToken)
+        for i := range batchResults {
+            batchResults[i].colors = batchOverrides[batch].Colors
+            if batchResults[i].Success && batch != "" {
+                batchResults[i].Variation = variationAlternateColors + " " + batch
+            }
+        }
+        results = append(results, batchResults...)
+        succeeded += batchSucceeded
+        failed += batchFailed
+    }
+    attachRetryTokens(username, groupID, patternID, results)
+    results = append(results, removed...)
+    failed += len(removed)
+
+    result := ApplyResult{
+        Success:   failed == 0,
+        PatternID: patternID,
+        Results:   results,
+        Succeeded: succeeded,
+        Failed:    failed,
+    }
+
+    if failed == 0 {
+        result.Message = fmt.Sprintf("Retry applied the pattern to all %d members", succeeded)
+    } else if succeeded == 0 {
+        result.Message = fmt.Sprintf("Retry failed on all %d members", failed)
+    } else {
+        result.Message = fmt.Sprintf("Retry applied the pattern to %d members, failed on %d members", succeeded, failed)
+    }
+
+    return shared.CreateSuccessResponse(200, result), nil
+}
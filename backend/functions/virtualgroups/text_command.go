@@ -0,0 +1,281 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "log"
+    "sort"
+    "strings"
+
+    "github.com/aws/aws-lambda-go/events"
+    "github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+    "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+    "candle-lights/backend/shared"
+)
+
+// offWLEDState blanks a strip; the segment stop is filled in per strip at compile time
+const offWLEDState = `{"on":false,"bri":0,"seg":[{"id":0,"start":0,"fx":0,"col":[[0,0,0]],"on":false}]}`
+
+// TextCommandResult describes what a text command matched and did
+type TextCommandResult struct {
+    Success        bool                        `json:"success"`
+    Message        string                      `json:"message"`
+    Command        *shared.TextCommand         `json:"command,omitempty"`
+    MatchedTarget  *shared.TextMatchCandidate  `json:"matchedTarget,omitempty"`
+    MatchedPattern *shared.TextMatchCandidate  `json:"matchedPattern,omitempty"`
+    Candidates     []shared.TextMatchCandidate `json:"candidates,omitempty"` // Close matches when the command is ambiguous
+    Results        []MemberResult              `json:"results,omitempty"`
+}
+
+// handleTextCommand parses a plain-text command, fuzzy-matches the pattern and
+// target names against the user's resources, and applies it
+func handleTextCommand(ctx context.Context, username string, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+    var cmdReq struct {
+        Text string `json:"text"`
+    }
+
+    body := shared.GetRequestBody(request)
+    if err := json.Unmarshal([]byte(body), &cmdReq); err != nil {
+        return shared.CreateErrorResponse(400, "Invalid request body"), nil
+    }
+
+    cmd, err := shared.ParseTextCommand(cmdReq.Text)
+    if err != nil {
+        return shared.CreateErrorResponse(400, err.Error()), nil
+    }
+
+    log.Printf("Parsed text command: verb=%s, pattern=%q, target=%q", cmd.Verb, cmd.PatternQuery, cmd.TargetQuery)
+
+    // Load the user's resources
+    indexName := "userId-index"
+    keyCondition := "userId = :userId"
+    expressionValues := map[string]types.AttributeValue{
+        ":userId": &types.AttributeValueMemberS{Value: username},
+    }
+
+    var devices []shared.Device
+    if err := shared.Query(ctx, devicesTable, &indexName, keyCondition, expressionValues, &devices); err != nil {
+        log.Printf("Failed to query devices: %v", err)
+        return shared.CreateErrorResponse(500, "Failed to retrieve devices"), nil
+    }
+
+    var groups []shared.VirtualGroup
+    if err := shared.Query(ctx, virtualGroupsTable, &indexName, keyCondition, expressionValues, &groups); err != nil {
+        log.Printf("Failed to query virtual groups: %v", err)
+        return shared.CreateErrorResponse(500, "Failed to retrieve virtual groups"), nil
+    }
+
+    var patterns []shared.Pattern
+    if err := shared.Query(ctx, patternsTable, &indexName, keyCondition, expressionValues, &patterns); err != nil {
+        log.Printf("Failed to query patterns: %v", err)
+        return shared.CreateErrorResponse(500, "Failed to retrieve patterns"), nil
+    }
+
+    result := TextCommandResult{Command: cmd}
+
+    // Resolve target
+    targetCandidates, membersByTarget := buildTextTargets(devices, groups)
+    target, ambiguous := shared.MatchTextCandidates(cmd.TargetQuery, targetCandidates)
+    if target == nil {
+        return textCommandNoMatch(result, "target", cmd.TargetQuery, ambiguous), nil
+    }
+    result.MatchedTarget = target
+    members := membersByTarget[target.Kind+":"+target.ID]
+
+    // Resolve pattern
+    var pattern shared.Pattern
+    switch cmd.Verb {
+    case shared.TextVerbApply:
+        patternCandidates := make([]shared.TextMatchCandidate, 0, len(patterns))
+        for _, p := range patterns {
+            patternCandidates = append(patternCandidates, shared.TextMatchCandidate{ID: p.PatternID, Name: p.Name, Kind: "pattern"})
+        }
+        matched, ambiguous := shared.MatchTextCandidates(cmd.PatternQuery, patternCandidates)
+        if matched == nil {
+            return textCommandNoMatch(result, "pattern", cmd.PatternQuery, ambiguous), nil
+        }
+        result.MatchedPattern = matched
+        pattern = findPattern(patterns, matched.ID)
+
+    case shared.TextVerbNext:
+        if len(patterns) == 0 {
+            return shared.CreateErrorResponse(400, "No patterns to cycle through"), nil
+        }
+        pattern = nextPattern(patterns, currentPatternID(devices, groups, target, members))
+        result.MatchedPattern = &shared.TextMatchCandidate{ID: pattern.PatternID, Name: pattern.Name, Kind: "pattern"}
+
+    case shared.TextVerbOff:
+        pattern = shared.Pattern{Name: "Off", WLEDState: offWLEDState}
+    }
+
+    // Get user's Particle token
+    userKey, _ := attributevalue.MarshalMap(map[string]string{
+        "username": username,
+    })
+
+    var user shared.User
+    if err := shared.GetItem(ctx, usersTable, userKey, &user); err != nil {
+        log.Printf("Failed to get user: %v", err)
+        return shared.CreateErrorResponse(500, "Database error"), nil
+    }
+
+    if err := shared.DecryptParticleToken(ctx, usersTable, &user); err != nil {
+        log.Printf("Failed to decrypt Particle token for %s: %v", username, err)
+        return shared.CreateErrorResponse(500, "Failed to read Particle token"), nil
+    }
+
+    if user.ParticleToken == "" {
+        return shared.CreateErrorResponse(400, "Particle token not configured"), nil
+    }
+
+    var succeeded, failed int
+    if cmd.Verb == shared.TextVerbBrightness {
+        cancelMemberRamps(ctx, members, "superseded by a brightness command")
+        result.Results, succeeded, failed = setBrightnessForMembers(ctx, devices, members, cmd.Brightness, user.ParticleToken)
+    } else {
+        result.Results, succeeded, failed = applyPatternToMembers(ctx, username, members, pattern, shared.OutputOverrides{}, user.ParticleToken)
+    }
+
+    result.Success = failed == 0 && succeeded > 0
+    switch cmd.Verb {
+    case shared.TextVerbBrightness:
+        result.Message = fmt.Sprintf("Set brightness %d%% on %s (%d succeeded, %d failed)", cmd.Brightness, target.Name, succeeded, failed)
+    case shared.TextVerbOff:
+        result.Message = fmt.Sprintf("Turned off %s (%d succeeded, %d failed)", target.Name, succeeded, failed)
+    default:
+        result.Message = fmt.Sprintf("Applied %s to %s (%d succeeded, %d failed)", pattern.Name, target.Name, succeeded, failed)
+    }
+
+    return shared.CreateSuccessResponse(200, result), nil
+}
+
+// textCommandNoMatch builds the response for an unmatched or ambiguous name
+func textCommandNoMatch(result TextCommandResult, what, query string, candidates []shared.TextMatchCandidate) events.APIGatewayProxyResponse {
+    if len(candidates) > 0 {
+        result.Message = fmt.Sprintf("%q matches more than one %s; please be more specific", query, what)
+        result.Candidates = candidates
+        return shared.CreateSuccessResponse(409, result)
+    }
+    result.Message = fmt.Sprintf("No %s matches %q", what, query)
+    return shared.CreateSuccessResponse(404, result)
+}
+
+// buildTextTargets lists every group, device, and strip the user can name,
+// keyed as "<kind>:<id>" to the strips each one covers
+func buildTextTargets(devices []shared.Device, groups []shared.VirtualGroup) ([]shared.TextMatchCandidate, map[string][]shared.VirtualGroupMember) {
+    var candidates []shared.TextMatchCandidate
+    members := make(map[string][]shared.VirtualGroupMember)
+
+    for _, g := range groups {
+        candidates = append(candidates, shared.TextMatchCandidate{ID: g.GroupID, Name: g.Name, Kind: "group"})
+        members["group:"+g.GroupID] = g.Members
+    }
+
+    for _, d := range devices {
+        var deviceMembers []shared.VirtualGroupMember
+        for _, strip := range d.LEDStrips {
+            stripID := fmt.Sprintf("%s:%d", d.DeviceID, strip.Pin)
+            member := shared.VirtualGroupMember{DeviceID: d.DeviceID, Pin: strip.Pin}
+            candidates = append(candidates, shared.TextMatchCandidate{ID: stripID, Name: fmt.Sprintf("%s D%d", d.Name, strip.Pin), Kind: "strip"})
+            members["strip:"+stripID] = []shared.VirtualGroupMember{member}
+            deviceMembers = append(deviceMembers, member)
+        }
+        if len(deviceMembers) > 0 {
+            candidates = append(candidates, shared.TextMatchCandidate{ID: d.DeviceID, Name: d.Name, Kind: "device"})
+            members["device:"+d.DeviceID] = deviceMembers
+        }
+    }
+
+    return candidates, members
+}
+
+func findPattern(patterns []shared.Pattern, patternID string) shared.Pattern {
+    for _, p := range patterns {
+        if p.PatternID == patternID {
+            return p
+        }
+    }
+    return shared.Pattern{}
+}
+
+// currentPatternID returns the pattern currently on the target, if known
+func currentPatternID(devices []shared.Device, groups []shared.VirtualGroup, target *shared.TextMatchCandidate, members []shared.VirtualGroupMember) string {
+    if target.Kind == "group" {
+        for _, g := range groups {
+            if g.GroupID == target.ID {
+                return g.PatternID
+            }
+        }
+    }
+    if len(members) == 0 {
+        return ""
+    }
+    for _, d := range devices {
+        if d.DeviceID != members[0].DeviceID {
+            continue
+        }
+        for _, strip := range d.LEDStrips {
+            if strip.Pin == members[0].Pin {
+                return strip.PatternID
+            }
+        }
+    }
+    return ""
+}
+
+// nextPattern treats the user's patterns, sorted by name, as a playlist and
+// returns the one after currentID (the first one if currentID isn't found)
+func nextPattern(patterns []shared.Pattern, currentID string) shared.Pattern {
+    sorted := make([]shared.Pattern, len(patterns))
+    copy(sorted, patterns)
+    sort.SliceStable(sorted, func(i, j int) bool {
+        return strings.ToLower(sorted[i].Name) < strings.ToLower(sorted[j].Name)
+    })
+
+    for i, p := range sorted {
+        if p.PatternID == currentID {
+            return sorted[(i+1)%len(sorted)]
+        }
+    }
+    return sorted[0]
+}
+
+// setBrightnessForMembers sends setBright to each member strip
+func setBrightnessForMembers(ctx context.Context, devices []shared.Device, members []shared.VirtualGroupMember, percent int, token string) ([]MemberResult, int, int) {
+    results := make([]MemberResult, 0, len(members))
+    succeeded := 0
+    failed := 0
+
+    firmwareBrightness := shared.BrightnessPercent(percent).Byte()
+
+    for _, member := range members {
+        var device *shared.Device
+        for i := range devices {
+            if devices[i].DeviceID == member.DeviceID {
+                device = &devices[i]
+                break
+            }
+        }
+
+        if device == nil {
+            results = append(results, MemberResult{DeviceID: member.DeviceID, Pin: member.Pin, Error: "Device not found"})
+            failed++
+            continue
+        }
+
+        arg := fmt.Sprintf("%d,%d", device.ResolvePin(member.Pin), firmwareBrightness)
+        if err := newTimedCaller(ctx, *device, token).Call(device.ParticleID, "setBright", arg); err != nil {
+            log.Printf("Failed to set brightness on device %s pin %d: %v", device.Name, member.Pin, err)
+            results = append(results, MemberResult{DeviceID: device.DeviceID, DeviceName: device.Name, Pin: member.Pin, Error: err.Error()})
+            failed++
+            continue
+        }
+
+        results = append(results, MemberResult{DeviceID: device.DeviceID, DeviceName: device.Name, Pin: member.Pin, Success: true})
+        succeeded++
+    }
+
+    return results, succeeded, failed
+}
@@ -0,0 +1,571 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "os"
+    "strconv"
+    "time"
+
+    "github.com/aws/aws-lambda-go/events"
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/config"
+    "github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+    "github.com/aws/aws-sdk-go-v2/service/dynamodb"
+    "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+    "github.com/aws/aws-sdk-go-v2/service/sqs"
+    "github.com/google/uuid"
+
+    "candle-lights/backend/shared"
+)
+
+var (
+    trialsTable         = os.Getenv("TRIALS_TABLE")
+    trialRevertQueueURL = os.Getenv("TRIAL_REVERT_QUEUE_URL")
+    sqsClient           *sqs.Client
+)
+
+// trialLockGrace keeps a strip locked a little past its revert time so a
+// slightly late revert message still finds the lock it should release
+const trialLockGrace = 60 * time.Second
+
+// errTrialNotActive means a trial was already kept, cancelled, or reverted
+var errTrialNotActive = errors.New("trial is no longer active")
+
+// trialRevertMessage is the delayed SQS message that ends a trial
+type trialRevertMessage struct {
+    TrialID string `json:"trialId"`
+}
+
+// TrialResponse is returned when a trial starts or finishes
+type TrialResponse struct {
+    Trial    shared.Trial      `json:"trial"`
+    Results  []MemberResult    `json:"results,omitempty"`
+    Warnings []string          `json:"warnings,omitempty"`
+    Window   *shared.LEDWindow `json:"window,omitempty"` // LEDs the trial pattern covers, when started
+}
+
+// handleStartTrial puts a pattern on one strip, or LEDs [startLed, endLed)
+// of it, for durationSeconds, then reverts to whatever the strip had before.
+// With ?preserveRest=true the LEDs outside the window are left as they are
+// instead of turned off.
+func handleStartTrial(ctx context.Context, username, deviceID, pinParam string, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+    pin, err := strconv.Atoi(pinParam)
+    if err != nil {
+        return shared.CreateErrorResponse(400, "Invalid pin"), nil
+    }
+
+    var trialReq struct {
+        PatternID       string `json:"patternId"`
+        WLEDState       string `json:"wledState"`
+        DurationSeconds int    `json:"durationSeconds"`
+        StartLED        *int   `json:"startLed,omitempty"`
+        EndLED          *int   `json:"endLed,omitempty"`
+    }
+
+    body := shared.GetRequestBody(request)
+    if err := json.Unmarshal([]byte(body), &trialReq); err != nil {
+        return shared.CreateErrorResponse(400, "Invalid request body"), nil
+    }
+
+    if (trialReq.PatternID == "") == (trialReq.WLEDState == "") {
+        return shared.CreateErrorResponse(400, "Exactly one of patternId or wledState is required"), nil
+    }
+
+    if trialReq.DurationSeconds == 0 {
+        trialReq.DurationSeconds = shared.DefaultTrialSeconds
+    }
+    if trialReq.DurationSeconds < 1 || trialReq.DurationSeconds > shared.MaxTrialSeconds {
+        return shared.CreateErrorResponse(400, fmt.Sprintf("durationSeconds must be between 1 and %d", shared.MaxTrialSeconds)), nil
+    }
+
+    // Get device
+    deviceKey, _ := attributevalue.MarshalMap(map[string]string{
+        "deviceId": deviceID,
+    })
+
+    var device shared.Device
+    if err := shared.GetItem(ctx, devicesTable, deviceKey, &device); err != nil {
+        log.Printf("Failed to get device: %v", err)
+        return shared.CreateErrorResponse(500, "Database error"), nil
+    }
+
+    if device.DeviceID == "" || device.UserID != username {
+        return shared.CreateErrorResponse(404, "Device not found"), nil
+    }
+
+    var strip *shared.LEDStrip
+    for i := range device.LEDStrips {
+        if device.LEDStrips[i].Pin == pin {
+            strip = &device.LEDStrips[i]
+            break
+        }
+    }
+    if strip == nil {
+        return shared.CreateErrorResponse(404, "No strip configured on that pin"), nil
+    }
+
+    window, err := shared.ResolveLEDWindow(trialReq.StartLED, trialReq.EndLED, strip.LEDCount)
+    if err != nil {
+        return shared.CreateErrorResponse(400, err.Error()), nil
+    }
+    if window != nil && !device.SupportsBytecode() {
+        return shared.CreateErrorResponse(422, shared.ErrLEDWindowUnsupported.Error()), nil
+    }
+    preserveRest := request.QueryStringParameters["preserveRest"] == "true"
+
+    // Resolve the pattern under trial. It is applied without an ID so the
+    // strip's recorded pattern stays the one we revert to.
+    trialPattern := shared.Pattern{Name: "Trial", WLEDState: trialReq.WLEDState}
+    if trialReq.PatternID != "" {
+        patternKey, _ := attributevalue.MarshalMap(map[string]string{
+            "patternId": trialReq.PatternID,
+        })
+
+        var pattern shared.Pattern
+        if err := shared.GetItem(ctx, patternsTable, patternKey, &pattern); err != nil {
+            log.Printf("Failed to get pattern: %v", err)
+            return shared.CreateErrorResponse(500, "Database error"), nil
+        }
+
+        if pattern.PatternID == "" || pattern.UserID != username {
+            return shared.CreateErrorResponse(404, "Pattern not found"), nil
+        }
+
+        trialPattern = pattern
+        trialPattern.PatternID = ""
+    } else if _, err := shared.ParseWLEDJSON(trialReq.WLEDState); err != nil {
+        return shared.CreateErrorResponse(400, "Invalid WLED state: "+err.Error()), nil
+    }
+
+    user, errResp := getUserWithToken(ctx, username)
+    if errResp != nil {
+        return *errResp, nil
+    }
+
+    now := time.Now()
+    trial := shared.Trial{
+        TrialID:           uuid.New().String(),
+        UserID:            username,
+        DeviceID:          deviceID,
+        Pin:               pin,
+        PreviousPatternID: strip.PatternID,
+        TrialPatternID:    trialReq.PatternID,
+        TrialWLEDState:    trialReq.WLEDState,
+        Status:            shared.TrialStatusActive,
+        RevertAt:          now.Add(time.Duration(trialReq.DurationSeconds) * time.Second),
+        CreatedAt:         now,
+        UpdatedAt:         now,
+    }
+    trial.ExpiresAt = shared.TrialExpiresAt(trial.RevertAt)
+
+    // Claim the strip; a concurrent trial holds the lock until it finishes
+    if err := acquireTrialLock(ctx, trial); err != nil {
+        var conflict *types.ConditionalCheckFailedException
+        if errors.As(err, &conflict) {
+            return shared.CreateErrorResponse(409, "A trial is already running on this strip"), nil
+        }
+        log.Printf("Failed to lock strip for trial: %v", err)
+        return shared.CreateErrorResponse(500, "Database error"), nil
+    }
+
+    var results []MemberResult
+    failed := 0
+    if window != nil {
+        result := applyTrialWindow(ctx, device, *strip, *window, preserveRest, trialPattern, user.ParticleToken)
+        results = []MemberResult{result}
+        if !result.Success {
+            failed = 1
+        }
+    } else {
+        members := []shared.VirtualGroupMember{{DeviceID: deviceID, Pin: pin}}
+        results, _, failed = applyPatternToMembers(ctx, username, members, trialPattern, shared.OutputOverrides{}, user.ParticleToken)
+    }
+    if failed > 0 {
+        releaseTrialLock(ctx, trial)
+        resp := shared.CreateSuccessResponse(502, TrialResponse{Trial: trial, Results: results})
+        return resp, nil
+    }
+
+    if err := shared.PutItem(ctx, trialsTable, trial); err != nil {
+        log.Printf("Failed to save trial: %v", err)
+        restorePreviousPattern(ctx, trial, user.ParticleToken)
+        releaseTrialLock(ctx, trial)
+        return shared.CreateErrorResponse(500, "Failed to save trial"), nil
+    }
+
+    if err := scheduleTrialRevert(ctx, trial.TrialID, trialReq.DurationSeconds); err != nil {
+        // Without a scheduled revert the trial would never end; undo it now
+        log.Printf("Failed to schedule trial revert: %v", err)
+        if _, err := finishTrial(ctx, trial.TrialID, shared.TrialStatusCancelled); err == nil {
+            restorePreviousPattern(ctx, trial, user.ParticleToken)
+            releaseTrialLock(ctx, trial)
+        }
+        return shared.CreateErrorResponse(500, "Failed to schedule revert"), nil
+    }
+
+    log.Printf("Started trial %s on device %s pin %d for %ds", trial.TrialID, deviceID, pin, trialReq.DurationSeconds)
+    effective := shared.LEDWindow{Start: 0, End: strip.LEDCount}
+    if window != nil {
+        effective = *window
+    }
+    return shared.CreateSuccessResponse(201, TrialResponse{Trial: trial, Results: results, Window: &effective}), nil
+}
+
+// applyTrialWindow sends the trial pattern to window of the strip.
+// applyPatternToMembers always covers whole strips, so windowed trials are
+// sent from here.
+func applyTrialWindow(ctx context.Context, device shared.Device, strip shared.LEDStrip, window shared.LEDWindow, preserveRest bool, pattern shared.Pattern, token string) MemberResult {
+    result := MemberResult{DeviceID: device.DeviceID, DeviceName: device.Name, Pin: strip.Pin}
+    if !device.IsOnline {
+        result.Error = "Device is offline"
+        return result
+    }
+
+    timed := newTimedCaller(ctx, device, token)
+    warnings, err := shared.ApplyPatternToStripWindow(device, strip.Pin, strip.LEDCount, window, preserveRest, pattern, timed.Call)
+    shared.CountPatternApply("virtualgroups", err == nil)
+    result.Warnings = warnings
+    if err != nil {
+        log.Printf("Failed to apply trial to device %s pin %d LEDs %d-%d: %v", device.Name, strip.Pin, window.Start, window.End, err)
+        result.Error = err.Error()
+        return result
+    }
+
+    if warning := timed.RecordIfSlow(ctx, devicesTable); warning != "" {
+        result.Warnings = append(result.Warnings, warning)
+    }
+    result.Success = true
+    return result
+}
+
+// handleKeepTrial makes the trial pattern the strip's pattern and cancels the revert
+func handleKeepTrial(ctx context.Context, username, trialID string) (events.APIGatewayProxyResponse, error) {
+    trial, errResp := getOwnedTrial(ctx, username, trialID)
+    if errResp != nil {
+        return *errResp, nil
+    }
+
+    updated, err := finishTrial(ctx, trialID, shared.TrialStatusKept)
+    if errors.Is(err, errTrialNotActive) {
+        return shared.CreateErrorResponse(409, "Trial is no longer active"), nil
+    }
+    if err != nil {
+        log.Printf("Failed to keep trial %s: %v", trialID, err)
+        return shared.CreateErrorResponse(500, "Database error"), nil
+    }
+    defer releaseTrialLock(ctx, *updated)
+
+    // Inline trials become a saved pattern so the strip can reference them
+    patternID := trial.TrialPatternID
+    if patternID == "" {
+        now := time.Now()
+        pattern := shared.Pattern{
+            PatternID:     uuid.New().String(),
+            UserID:        username,
+            Name:          "Trial " + now.Format("2006-01-02 15:04"),
+            Type:          shared.PatternSolid,
+            Brightness:    128,
+            WLEDState:     trial.TrialWLEDState,
+            FormatVersion: shared.FormatVersionWLED,
+            CreatedAt:     now,
+            UpdatedAt:     now,
+        }
+        if err := shared.StoreCompiledBinary(&pattern); err != nil {
+            log.Printf("Kept trial pattern saved without a binary: %v", err)
+        }
+        pattern.CompiledCache = shared.PrecompileCommonLEDCounts(&pattern)
+        pattern.CompatibleEffectIDs = shared.ComputeCompatibleEffectIDs(&pattern)
+        if err := shared.PutItem(ctx, patternsTable, pattern); err != nil {
+            log.Printf("Failed to save kept trial pattern: %v", err)
+            return shared.CreateErrorResponse(500, "Failed to save pattern"), nil
+        }
+        patternID = pattern.PatternID
+    }
+
+    if err := setStripPatternID(ctx, trial.DeviceID, trial.Pin, patternID); err != nil {
+        log.Printf("Failed to record kept trial on strip: %v", err)
+        return shared.CreateErrorResponse(500, "Failed to update device"), nil
+    }
+
+    updated.TrialPatternID = patternID
+    log.Printf("Kept trial %s as pattern %s", trialID, patternID)
+    return shared.CreateSuccessResponse(200, TrialResponse{Trial: *updated}), nil
+}
+
+// handleCancelTrial reverts the strip immediately
+func handleCancelTrial(ctx context.Context, username, trialID string) (events.APIGatewayProxyResponse, error) {
+    if _, errResp := getOwnedTrial(ctx, username, trialID); errResp != nil {
+        return *errResp, nil
+    }
+
+    user, errResp := getUserWithToken(ctx, username)
+    if errResp != nil {
+        return *errResp, nil
+    }
+
+    updated, err := finishTrial(ctx, trialID, shared.TrialStatusCancelled)
+    if errors.Is(err, errTrialNotActive) {
+        return shared.CreateErrorResponse(409, "Trial is no longer active"), nil
+    }
+    if err != nil {
+        log.Printf("Failed to cancel trial %s: %v", trialID, err)
+        return shared.CreateErrorResponse(500, "Database error"), nil
+    }
+
+    results := restorePreviousPattern(ctx, *updated, user.ParticleToken)
+    releaseTrialLock(ctx, *updated)
+
+    return shared.CreateSuccessResponse(200, TrialResponse{Trial: *updated, Results: results}), nil
+}
+
+// handleTrialRevertMessages ends trials whose delayed revert message arrived.
+// Trials that were kept or cancelled in the meantime are skipped.
+func handleTrialRevertMessages(ctx context.Context, event events.SQSEvent) error {
+    for _, record := range event.Records {
+        var msg trialRevertMessage
+        if err := json.Unmarshal([]byte(record.Body), &msg); err != nil || msg.TrialID == "" {
+            log.Printf("Ignoring malformed trial revert message %s: %v", record.MessageId, err)
+            continue
+        }
+
+        trial, err := finishTrial(ctx, msg.TrialID, shared.TrialStatusReverted)
+        if errors.Is(err, errTrialNotActive) {
+            log.Printf("Trial %s already finished; nothing to revert", msg.TrialID)
+            continue
+        }
+        if err != nil {
+            // Returning the error lets SQS redeliver the message
+            return fmt.Errorf("failed to finish trial %s: %v", msg.TrialID, err)
+        }
+
+        user, errResp := getUserWithToken(ctx, trial.UserID)
+        if errResp != nil {
+            log.Printf("Cannot revert trial %s: no Particle token for %s", trial.TrialID, trial.UserID)
+            releaseTrialLock(ctx, *trial)
+            continue
+        }
+
+        restorePreviousPattern(ctx, *trial, user.ParticleToken)
+        releaseTrialLock(ctx, *trial)
+        log.Printf("Reverted trial %s on device %s pin %d", trial.TrialID, trial.DeviceID, trial.Pin)
+    }
+    return nil
+}
+
+// restorePreviousPattern puts back the strip's pattern from before the trial,
+// or turns the strip off if it had none
+func restorePreviousPattern(ctx context.Context, trial shared.Trial, token string) []MemberResult {
+    pattern := shared.Pattern{Name: "Off", WLEDState: offWLEDState}
+    if trial.PreviousPatternID != "" {
+        patternKey, _ := attributevalue.MarshalMap(map[string]string{
+            "patternId": trial.PreviousPatternID,
+        })
+
+        var previous shared.Pattern
+        if err := shared.GetItem(ctx, patternsTable, patternKey, &previous); err != nil {
+            log.Printf("Failed to get previous pattern %s: %v", trial.PreviousPatternID, err)
+        } else if previous.PatternID != "" {
+            pattern = previous
+        }
+    }
+
+    members := []shared.VirtualGroupMember{{DeviceID: trial.DeviceID, Pin: trial.Pin}}
+    results, _, failed := applyPatternToMembers(ctx, trial.UserID, members, pattern, shared.OutputOverrides{}, token)
+    if failed > 0 {
+        log.Printf("Failed to restore strip after trial %s: %+v", trial.TrialID, results)
+    }
+    return results
+}
+
+func getOwnedTrial(ctx context.Context, username, trialID string) (*shared.Trial, *events.APIGatewayProxyResponse) {
+    key, _ := attributevalue.MarshalMap(map[string]string{
+        "trialId": trialID,
+    })
+
+    var trial shared.Trial
+    if err := shared.GetItem(ctx, trialsTable, key, &trial); err != nil {
+        log.Printf("Failed to get trial: %v", err)
+        resp := shared.CreateErrorResponse(500, "Database error")
+        return nil, &resp
+    }
+
+    if trial.TrialID == "" || trial.UserID != username {
+        resp := shared.CreateErrorResponse(404, "Trial not found")
+        return nil, &resp
+    }
+
+    return &trial, nil
+}
+
+func getUserWithToken(ctx context.Context, username string) (*shared.User, *events.APIGatewayProxyResponse) {
+    userKey, _ := attributevalue.MarshalMap(map[string]string{
+        "username": username,
+    })
+
+    var user shared.User
+    if err := shared.GetItem(ctx, usersTable, userKey, &user); err != nil {
+        log.Printf("Failed to get user: %v", err)
+        resp := shared.CreateErrorResponse(500, "Database error")
+        return nil, &resp
+    }
+
+    if err := shared.DecryptParticleToken(ctx, usersTable, &user); err != nil {
+        log.Printf("Failed to decrypt Particle token for %s: %v", username, err)
+        resp := shared.CreateErrorResponse(500, "Failed to read Particle token")
+        return nil, &resp
+    }
+
+    if user.ParticleToken == "" {
+        resp := shared.CreateErrorResponse(400, "Particle token not configured")
+        return nil, &resp
+    }
+
+    return &user, nil
+}
+
+// finishTrial moves an active trial to status. Only one of keep, cancel, and
+// revert can win; the others get errTrialNotActive.
+func finishTrial(ctx context.Context, trialID, status string) (*shared.Trial, error) {
+    client, err := shared.InitDynamoDB()
+    if err != nil {
+        return nil, err
+    }
+
+    output, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+        TableName: aws.String(trialsTable),
+        Key: map[string]types.AttributeValue{
+            "trialId": &types.AttributeValueMemberS{Value: trialID},
+        },
+        UpdateExpression:    aws.String("SET #status = :status, updatedAt = :now"),
+        ConditionExpression: aws.String("#status = :active"),
+        ExpressionAttributeNames: map[string]string{
+            "#status": "status",
+        },
+        ExpressionAttributeValues: map[string]types.AttributeValue{
+            ":status": &types.AttributeValueMemberS{Value: status},
+            ":active": &types.AttributeValueMemberS{Value: shared.TrialStatusActive},
+            ":now":    &types.AttributeValueMemberS{Value: time.Now().Format(time.RFC3339Nano)},
+        },
+        ReturnValues: types.ReturnValueAllNew,
+    })
+    if err != nil {
+        var conflict *types.ConditionalCheckFailedException
+        if errors.As(err, &conflict) {
+            return nil, errTrialNotActive
+        }
+        return nil, err
+    }
+
+    var trial shared.Trial
+    if err := attributevalue.UnmarshalMap(output.Attributes, &trial); err != nil {
+        return nil, err
+    }
+    return &trial, nil
+}
+
+// acquireTrialLock claims the trial's strip unless another trial holds it
+func acquireTrialLock(ctx context.Context, trial shared.Trial) error {
+    client, err := shared.InitDynamoDB()
+    if err != nil {
+        return err
+    }
+
+    lockedUntil := trial.RevertAt.Add(trialLockGrace).Unix()
+    item, err := attributevalue.MarshalMap(shared.TrialStripLock{
+        TrialID:       shared.TrialLockKey(trial.DeviceID, trial.Pin),
+        ActiveTrialID: trial.TrialID,
+        LockedUntil:   lockedUntil,
+        ExpiresAt:     trial.ExpiresAt,
+    })
+    if err != nil {
+        return err
+    }
+
+    // Stale locks (revert message lost) can be taken over once they lapse
+    _, err = client.PutItem(ctx, &dynamodb.PutItemInput{
+        TableName:           aws.String(trialsTable),
+        Item:                item,
+        ConditionExpression: aws.String("attribute_not_exists(trialId) OR lockedUntil < :now"),
+        ExpressionAttributeValues: map[string]types.AttributeValue{
+            ":now": &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Unix(), 10)},
+        },
+    })
+    return err
+}
+
+// releaseTrialLock frees the strip if this trial still holds it
+func releaseTrialLock(ctx context.Context, trial shared.Trial) {
+    client, err := shared.InitDynamoDB()
+    if err != nil {
+        log.Printf("Failed to release trial lock: %v", err)
+        return
+    }
+
+    _, err = client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+        TableName: aws.String(trialsTable),
+        Key: map[string]types.AttributeValue{
+            "trialId": &types.AttributeValueMemberS{Value: shared.TrialLockKey(trial.DeviceID, trial.Pin)},
+        },
+        ConditionExpression: aws.String("activeTrialId = :trialId"),
+        ExpressionAttributeValues: map[string]types.AttributeValue{
+            ":trialId": &types.AttributeValueMemberS{Value: trial.TrialID},
+        },
+    })
+    if err != nil {
+        var conflict *types.ConditionalCheckFailedException
+        if !errors.As(err, &conflict) {
+            log.Printf("Failed to release trial lock for %s: %v", trial.TrialID, err)
+        }
+    }
+}
+
+// scheduleTrialRevert sends the delayed message that reverts the trial
+func scheduleTrialRevert(ctx context.Context, trialID string, delaySeconds int) error {
+    if trialRevertQueueURL == "" {
+        return fmt.Errorf("TRIAL_REVERT_QUEUE_URL is not configured")
+    }
+
+    if sqsClient == nil {
+        cfg, err := config.LoadDefaultConfig(ctx)
+        if err != nil {
+            return err
+        }
+        sqsClient = sqs.NewFromConfig(cfg)
+    }
+
+    body, _ := json.Marshal(trialRevertMessage{TrialID: trialID})
+    _, err := sqsClient.SendMessage(ctx, &sqs.SendMessageInput{
+        QueueUrl:     aws.String(trialRevertQueueURL),
+        MessageBody:  aws.String(string(body)),
+        DelaySeconds: int32(delaySeconds),
+    })
+    return err
+}
+
+// setStripPatternID records patternID as the pattern applied to a strip
+func setStripPatternID(ctx context.Context, deviceID string, pin int, patternID string) error {
+    deviceKey, _ := attributevalue.MarshalMap(map[string]string{
+        "deviceId": deviceID,
+    })
+
+    var device shared.Device
+    if err := shared.GetItem(ctx, devicesTable, deviceKey, &device); err != nil {
+        return err
+    }
+
+    if device.DeviceID == "" {
+        return fmt.Errorf("device %s not found", deviceID)
+    }
+
+    for _, strip := range device.LEDStrips {
+        if strip.Pin == pin {
+            return saveStripPatternIDs(ctx, device, []int{pin}, patternID)
+        }
+    }
+
+    return fmt.Errorf("device %s has no strip on pin %d", deviceID, pin)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+    "fmt"
+    "strings"
+
+    "candle-lights/backend/shared"
+)
+
+// Variations a group apply can give its members from one pattern
+const (
+    // Each member gets the next of colorSets in group member order, in
+    // place of the pattern's own segment colors
+    variationAlternateColors = "alternateColors"
+    // Each member starts the pattern a step later than the one before. Needs
+    // firmware that reports phaseSyncCapability.
+    variationOffsetPhase = "offsetPhase"
+)
+
+// phaseSyncCapability is the firmware variable a device would report if it
+// could start a pattern part way through. No firmware reports it yet, so
+// offsetPhase applies the pattern unchanged with a warning.
+const phaseSyncCapability = "phaseSync"
+
+// groupVariation is the optional variation of a group apply request
+type groupVariation struct {
+    Variation string     `json:"variation,omitempty"`
+    ColorSets [][]string `json:"colorSets,omitempty"` // alternateColors only; each set replaces segment colors from the primary on
+}
+
+// validate checks the variation and normalizes its colors to "#RRGGBB"
+func (v *groupVariation) validate() error {
+    switch v.Variation {
+    case "":
+        if len(v.ColorSets) > 0 {
+            return fmt.Errorf("colorSets requires variation %q", variationAlternateColors)
+        }
+        return nil
+    case variationOffsetPhase:
+        if len(v.ColorSets) > 0 {
+            return fmt.Errorf("colorSets is only used with variation %q", variationAlternateColors)
+        }
+        return nil
+    case variationAlternateColors:
+    default:
+        return fmt.Errorf("unknown variation %q; use %q or %q", v.Variation, variationAlternateColors, variationOffsetPhase)
+    }
+
+    if len(v.ColorSets) == 0 {
+        return fmt.Errorf("colorSets is required for variation %q", variationAlternateColors)
+    }
+    for i, set := range v.ColorSets {
+        if len(set) == 0 || len(set) > shared.WLEDBMaxColors {
+            return fmt.Errorf("colorSets[%d] must have 1 to %d colors", i, shared.WLEDBMaxColors)
+        }
+        for j, color := range set {
+            normalized, err := shared.NormalizeHexColor(color)
+            if err != nil {
+                return fmt.Errorf("colorSets[%d][%d]: %v", i, j, err)
+            }
+            set[j] = normalized
+        }
+    }
+    return nil
+}
+
+// forMember returns the overrides for the member at position in the group's
+// member list on device, the variation it gets (empty for none), and a
+// warning when the variation can't be applied to it
+func (v *groupVariation) forMember(device shared.Device, position int, overrides shared.OutputOverrides) (shared.OutputOverrides, string, string) {
+    if v == nil || v.Variation == "" {
+        return overrides, "", ""
+    }
+    if !device.SupportsBytecode() {
+        return overrides, "", fmt.Sprintf("Variation %s skipped: the device's firmware doesn't run bytecode", v.Variation)
+    }
+
+    switch v.Variation {
+    case variationAlternateColors:
+        colors := v.colorsFor(position)
+        overrides.Colors = colors
+        return overrides, v.Variation + " " + strings.Join(colors, "/"), ""
+    case variationOffsetPhase:
+        return overrides, "", fmt.Sprintf("Variation %s skipped: the device's firmware doesn't report %s", v.Variation, phaseSyncCapability)
+    }
+    return overrides, "", ""
+}
+
+// colorsFor returns the colors an alternateColors variation gives the member
+// at position, or nil for other variations
+func (v *groupVariation) colorsFor(position int) []string {
+    if v == nil || v.Variation != variationAlternateColors {
+        return nil
+    }
+    return v.ColorSets[position%len(v.ColorSets)]
+}
+
+// retryOverrides returns overrides with the colors a retry token carries for
+// its member
+func retryOverrides(overrides shared.OutputOverrides, target shared.ApplyRetryTarget) shared.OutputOverrides {
+    if len(target.Colors) > 0 {
+        overrides.Colors = target.Colors
+    }
+    return overrides
+}
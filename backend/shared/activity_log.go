@@ -0,0 +1,99 @@
+package shared
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+var activityLogTable = os.Getenv("ACTIVITY_LOG_TABLE")
+
+// Activity log actions
+const (
+	ActivityRequest              = "request" // A mutating API request
+	ActivityImpersonationStarted = "impersonation_started"
+	ActivitySupportAccessGranted = "support_access_granted"
+	ActivitySupportAccessRevoked = "support_access_revoked"
+	ActivityLuxAutomation        = "lux_automation" // A lux automation's action, applied by the scheduler
+	ActivityAlexaUnlinked        = "alexa_unlinked"
+	ActivityAlexaDirectiveFailed = "alexa_directive_failed" // Keyed by the directive's messageId
+)
+
+// activityRetention is how long activity entries are kept before TTL deletes them
+const activityRetention = 90 * 24 * time.Hour
+
+// ActivityEntry is one line of a user's activity log. Actor made the change;
+// Subject is the account it was made on, which differs from Actor when an
+// admin is impersonating.
+type ActivityEntry struct {
+	ActivityID string    `json:"activityId" dynamodbav:"activityId"`
+	UserID     string    `json:"userId" dynamodbav:"userId"` // Whose log this entry is in
+	Action     string    `json:"action" dynamodbav:"action"`
+	Actor      string    `json:"actor" dynamodbav:"actor"`
+	Subject    string    `json:"subject" dynamodbav:"subject"`
+	Method     string    `json:"method,omitempty" dynamodbav:"method,omitempty"`
+	Path       string    `json:"path,omitempty" dynamodbav:"path,omitempty"`
+	StatusCode int       `json:"statusCode,omitempty" dynamodbav:"statusCode,omitempty"`
+	RunID      string    `json:"runId,omitempty" dynamodbav:"runId,omitempty"`           // Scheduler tick, for ActivityLuxAutomation
+	EndpointID string    `json:"endpointId,omitempty" dynamodbav:"endpointId,omitempty"` // For ActivityAlexaDirectiveFailed, as are the fields below
+	ErrorType  string    `json:"errorType,omitempty" dynamodbav:"errorType,omitempty"`   // Alexa ErrorResponse type
+	Message    string    `json:"message,omitempty" dynamodbav:"message,omitempty"`       // As shown in the Alexa app
+	Detail     string    `json:"detail,omitempty" dynamodbav:"detail,omitempty"`         // The underlying error
+	CreatedAt  time.Time `json:"createdAt" dynamodbav:"createdAt"`
+	ExpiresAt  int64     `json:"-" dynamodbav:"expiresAt"` // TTL
+}
+
+// RecordActivity adds an entry to entry.UserID's activity log. Entries get
+// a random ActivityID unless the caller keys them by one of its own, such as
+// an Alexa messageId.
+func RecordActivity(ctx context.Context, entry ActivityEntry) error {
+	if entry.ActivityID == "" {
+		id := make([]byte, 16)
+		if _, err := rand.Read(id); err != nil {
+			return err
+		}
+		entry.ActivityID = hex.EncodeToString(id)
+	}
+	if entry.CreatedAt.IsZero() {
+		entry.CreatedAt = time.Now()
+	}
+	entry.ExpiresAt = entry.CreatedAt.Add(activityRetention).Unix()
+	return PutItem(ctx, activityLogTable, entry)
+}
+
+// RecordImpersonatedActivity adds entry to the activity logs of both the
+// admin (Actor) and the impersonated user (Subject). Failures are logged, so
+// a logging problem never fails the request being logged.
+func RecordImpersonatedActivity(ctx context.Context, entry ActivityEntry) {
+	entry.CreatedAt = time.Now()
+	for _, username := range []string{entry.Subject, entry.Actor} {
+		entry.UserID = username
+		if err := RecordActivity(ctx, entry); err != nil {
+			log.Printf("RecordImpersonatedActivity: Failed to log %s %s by %s as %s for %s: %v",
+				entry.Method, entry.Path, entry.Actor, entry.Subject, username, err)
+		}
+	}
+}
+
+// GetUserActivity returns a user's activity log, newest first
+func GetUserActivity(ctx context.Context, userID string) ([]ActivityEntry, error) {
+	indexName := "userId-index"
+	expressionValues := map[string]types.AttributeValue{
+		":userId": &types.AttributeValueMemberS{Value: userID},
+	}
+
+	var entries []ActivityEntry
+	if err := Query(ctx, activityLogTable, &indexName, "userId = :userId", expressionValues, &entries); err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].CreatedAt.After(entries[j].CreatedAt)
+	})
+	return entries, nil
+}
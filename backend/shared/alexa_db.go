@@ -123,7 +123,8 @@ func CreateAccessToken(ctx context.Context, userID, scope string) (*OAuthToken,
 	return token, accessToken, nil
 }
 
-// ValidateAccessToken checks if an access token is valid and returns the user ID
+// ValidateAccessToken checks if an access token is valid and returns the user ID.
+// A token belonging to a suspended account fails with ErrAccountSuspended.
 func ValidateAccessToken(ctx context.Context, accessToken string) (string, error) {
 	tokenHash := hashToken(accessToken)
 
@@ -151,13 +152,35 @@ func ValidateAccessToken(ctx context.Context, accessToken string) (string, error
 		return "", nil
 	}
 
+	if err := checkNotSuspended(ctx, token.UserID); err != nil {
+		return "", err
+	}
+
+	return token.UserID, nil
+}
+
+// AccessTokenOwner returns the user an access token was issued to, expired or
+// not, or "" if there's no such token
+func AccessTokenOwner(ctx context.Context, accessToken string) (string, error) {
+	key, err := attributevalue.MarshalMap(map[string]string{
+		"tokenHash": hashToken(accessToken),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	var token OAuthToken
+	if err := GetItem(ctx, alexaTokensTable, key, &token); err != nil {
+		return "", err
+	}
 	return token.UserID, nil
 }
 
-// RefreshAccessToken creates a new access token using a refresh token
+// RefreshAccessToken creates a new access token using a refresh token. A
+// refresh for a suspended account fails with ErrAccountSuspended.
 func RefreshAccessToken(ctx context.Context, refreshToken string) (*OAuthToken, string, error) {
-	// Find token by refresh token (need to scan or use GSI)
-	// For simplicity, we'll scan the table
+	// There's no index on refreshToken, so this scans the whole table. The
+	// table holds one token per linked account, and refreshes are rare.
 	var tokens []OAuthToken
 	if err := Scan(ctx, alexaTokensTable, &tokens); err != nil {
 		return nil, "", err
@@ -176,6 +199,11 @@ func RefreshAccessToken(ctx context.Context, refreshToken string) (*OAuthToken,
 		return nil, "", nil
 	}
 
+	// Suspended accounts keep their link but can't get new tokens
+	if err := checkNotSuspended(ctx, existingToken.UserID); err != nil {
+		return nil, "", err
+	}
+
 	// Delete old token
 	oldKey, _ := attributevalue.MarshalMap(map[string]string{
 		"tokenHash": existingToken.TokenHash,
@@ -186,6 +214,34 @@ func RefreshAccessToken(ctx context.Context, refreshToken string) (*OAuthToken,
 	return CreateAccessToken(ctx, existingToken.UserID, existingToken.Scope)
 }
 
+// RevokeAccessToken deletes an access token (and with it its refresh token)
+func RevokeAccessToken(ctx context.Context, accessToken string) error {
+	key, err := attributevalue.MarshalMap(map[string]string{
+		"tokenHash": hashToken(accessToken),
+	})
+	if err != nil {
+		return err
+	}
+
+	return DeleteItem(ctx, alexaTokensTable, key)
+}
+
+// GetUserAccessTokens retrieves all OAuth access tokens issued to a user
+func GetUserAccessTokens(ctx context.Context, userID string) ([]OAuthToken, error) {
+	indexName := "userId-index"
+	var tokens []OAuthToken
+
+	expressionValues := map[string]types.AttributeValue{
+		":userId": &types.AttributeValueMemberS{Value: userID},
+	}
+
+	if err := Query(ctx, alexaTokensTable, &indexName, "userId = :userId", expressionValues, &tokens); err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
 // SaveAlexaDeviceState saves the state of an Alexa endpoint
 func SaveAlexaDeviceState(ctx context.Context, state *AlexaDeviceState) error {
 	state.LastUpdated = time.Now()
@@ -241,6 +297,105 @@ func DeleteAlexaDeviceState(ctx context.Context, endpointID string) error {
 	return DeleteItem(ctx, alexaStateTable, key)
 }
 
+// AlexaEndpointTombstoneTTL is how long a removed strip's endpoint keeps
+// answering NO_SUCH_ENDPOINT, giving users time to re-run discovery
+const AlexaEndpointTombstoneTTL = 30 * 24 * time.Hour
+
+// alexaTombstonePrefix keys tombstones in the state table apart from the
+// endpoint's own state row. Tombstones have no userId, so they stay out of
+// the userId index.
+const alexaTombstonePrefix = "removed#"
+
+// AlexaEndpointTombstone marks an endpoint whose strip was removed
+type AlexaEndpointTombstone struct {
+	Key        string    `json:"-" dynamodbav:"endpointId"`
+	EndpointID string    `json:"endpointId" dynamodbav:"removedEndpointId"`
+	DeviceID   string    `json:"deviceId" dynamodbav:"deviceId"`
+	Pin        int       `json:"pin" dynamodbav:"pin"`
+	RemovedAt  time.Time `json:"removedAt" dynamodbav:"removedAt"`
+	ExpiresAt  int64     `json:"expiresAt" dynamodbav:"expiresAt"` // TTL
+}
+
+// RemoveAlexaEndpoint cleans up after a strip is removed: the endpoint's
+// state row is deleted and a tombstone recorded so directives to it get
+// NO_SUCH_ENDPOINT rather than ENDPOINT_UNREACHABLE
+func RemoveAlexaEndpoint(ctx context.Context, deviceID string, pin int) error {
+	endpointID := AlexaEndpointID(deviceID, pin)
+	if err := DeleteAlexaDeviceState(ctx, endpointID); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	tombstone := AlexaEndpointTombstone{
+		Key:        alexaTombstonePrefix + endpointID,
+		EndpointID: endpointID,
+		DeviceID:   deviceID,
+		Pin:        pin,
+		RemovedAt:  now,
+		ExpiresAt:  now.Add(AlexaEndpointTombstoneTTL).Unix(),
+	}
+	log.Printf("[ALEXA_DB] Removed endpoint %s", endpointID)
+	return PutItem(ctx, alexaStateTable, tombstone)
+}
+
+// GetAlexaEndpointTombstone returns the tombstone for a removed endpoint, or
+// nil if the endpoint wasn't removed or the grace period has passed
+func GetAlexaEndpointTombstone(ctx context.Context, endpointID string) (*AlexaEndpointTombstone, error) {
+	key, err := attributevalue.MarshalMap(map[string]string{
+		"endpointId": alexaTombstonePrefix + endpointID,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var tombstone AlexaEndpointTombstone
+	if err := GetItem(ctx, alexaStateTable, key, &tombstone); err != nil {
+		return nil, err
+	}
+
+	// TTL deletion lags, so check expiry here too
+	if tombstone.Key == "" || tombstone.ExpiresAt < time.Now().Unix() {
+		return nil, nil
+	}
+
+	return &tombstone, nil
+}
+
+// ClearAlexaEndpointTombstone forgets a removal, for when a strip is added
+// back on the same pin
+func ClearAlexaEndpointTombstone(ctx context.Context, deviceID string, pin int) error {
+	key, err := attributevalue.MarshalMap(map[string]string{
+		"endpointId": alexaTombstonePrefix + AlexaEndpointID(deviceID, pin),
+	})
+	if err != nil {
+		return err
+	}
+
+	return DeleteItem(ctx, alexaStateTable, key)
+}
+
+// StripPinChanges compares a device's strips before and after an edit,
+// returning the pins that were removed and those that were added
+func StripPinChanges(before, after []LEDStrip) (removed, added []int) {
+	beforePins := make(map[int]bool, len(before))
+	for _, strip := range before {
+		beforePins[strip.Pin] = true
+	}
+	afterPins := make(map[int]bool, len(after))
+	for _, strip := range after {
+		afterPins[strip.Pin] = true
+		if !beforePins[strip.Pin] {
+			added = append(added, strip.Pin)
+		}
+	}
+	for _, strip := range before {
+		if !afterPins[strip.Pin] {
+			removed = append(removed, strip.Pin)
+		}
+	}
+	return removed, added
+}
+
 // Helper functions
 
 func generateSecureToken(length int) (string, error) {
@@ -0,0 +1,59 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestValidateAccessTokenRefusesSuspendedAccounts(t *testing.T) {
+	tokens := map[string]string{hashToken("sam-token"): "sam", hashToken("lee-token"): "lee"}
+	users := map[string]User{
+		"sam": {Username: "sam", IsActive: false},
+		"lee": {Username: "lee", IsActive: true},
+	}
+	restore := StubDynamoDB(func(call DynamoDBStubCall) (map[string]interface{}, error) {
+		var key struct {
+			TokenHash string `dynamodbav:"tokenHash"`
+			Username  string `dynamodbav:"username"`
+		}
+		if err := call.Unmarshal("Key", &key); err != nil {
+			return nil, err
+		}
+		if userID, ok := tokens[key.TokenHash]; ok {
+			return map[string]interface{}{"Item": DynamoDBStubItem(OAuthToken{
+				TokenHash: key.TokenHash,
+				UserID:    userID,
+				ExpiresAt: time.Now().Add(time.Hour).Unix(),
+			})}, nil
+		}
+		if user, ok := users[key.Username]; ok {
+			return map[string]interface{}{"Item": DynamoDBStubItem(user)}, nil
+		}
+		return nil, nil
+	})
+	defer restore()
+
+	if _, err := ValidateAccessToken(context.Background(), "sam-token"); !errors.Is(err, ErrAccountSuspended) {
+		t.Errorf("suspended account: err = %v, want ErrAccountSuspended", err)
+	}
+	if userID, err := ValidateAccessToken(context.Background(), "lee-token"); err != nil || userID != "lee" {
+		t.Errorf("active account = %q, %v; want lee", userID, err)
+	}
+}
+
+func TestStripPinChanges(t *testing.T) {
+	before := []LEDStrip{{Pin: 2}, {Pin: 6}, {Pin: 7}}
+	after := []LEDStrip{{Pin: 6}, {Pin: 8}}
+	removed, added := StripPinChanges(before, after)
+	if fmt.Sprint(removed) != "[2 7]" || fmt.Sprint(added) != "[8]" {
+		t.Errorf("removed %v, added %v; want [2 7], [8]", removed, added)
+	}
+
+	removed, added = StripPinChanges(before, nil)
+	if len(removed) != 3 || len(added) != 0 {
+		t.Errorf("deleted device: removed %v, added %v; want every pin removed", removed, added)
+	}
+}
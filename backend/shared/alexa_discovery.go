@@ -0,0 +1,159 @@
+package shared
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Reasons a device produces no Alexa endpoints
+const (
+	AlexaSkipNotReady = "not ready (firmware missing or not reporting cloud variables)"
+	AlexaSkipNoStrips = "no LED strips configured"
+)
+
+// AlexaSkippedDevice records a device that discovery did not expose to Alexa
+type AlexaSkippedDevice struct {
+	DeviceID string `json:"deviceId"`
+	Name     string `json:"name"`
+	Reason   string `json:"reason"`
+}
+
+// AlexaEndpointID builds the endpoint ID for a strip: {deviceId}-strip-D{pin}
+func AlexaEndpointID(deviceID string, pin int) string {
+	return fmt.Sprintf("%s-strip-D%d", deviceID, pin)
+}
+
+// BuildAlexaDiscoveryEndpoints builds one endpoint per LED strip on each ready device,
+// advertising modes (see AlexaModesForPatterns). It is shared by the Alexa
+// discovery directive and the devices debug endpoint. Strips whose names
+// would collide are told apart (see disambiguateFriendlyNames).
+func BuildAlexaDiscoveryEndpoints(devices []Device, modes []string) ([]AlexaDiscoveryEndpoint, []AlexaSkippedDevice) {
+	endpoints := []AlexaDiscoveryEndpoint{}
+	skipped := []AlexaSkippedDevice{}
+	owners := []Device{}
+
+	for _, device := range devices {
+		if !device.IsReady {
+			skipped = append(skipped, AlexaSkippedDevice{DeviceID: device.DeviceID, Name: device.Name, Reason: AlexaSkipNotReady})
+			continue
+		}
+
+		if len(device.LEDStrips) == 0 {
+			skipped = append(skipped, AlexaSkippedDevice{DeviceID: device.DeviceID, Name: device.Name, Reason: AlexaSkipNoStrips})
+			continue
+		}
+
+		for _, strip := range device.LEDStrips {
+			endpoints = append(endpoints, AlexaDiscoveryEndpoint{
+				EndpointID:        AlexaEndpointID(device.DeviceID, strip.Pin),
+				ManufacturerName:  "Garage Lights",
+				FriendlyName:      AlexaStripFriendlyName(device, strip.Pin),
+				Description:       alexaStripDescription(device, strip),
+				DisplayCategories: []string{"LIGHT"},
+				Cookie: Cookie{
+					"deviceId":   device.DeviceID,
+					"particleId": device.ParticleID,
+					"pin":        strconv.Itoa(strip.Pin),
+					"ledCount":   strconv.Itoa(strip.LEDCount),
+					"room":       DeviceRoom(device),
+				},
+				Capabilities: BuildAlexaCapabilities(modes),
+				AdditionalAttributes: &AdditionalAttributes{
+					Manufacturer:    "Garage Lights",
+					Model:           "LED Strip Controller",
+					FirmwareVersion: device.FirmwareVersion,
+				},
+			})
+			owners = append(owners, device)
+		}
+	}
+
+	disambiguateFriendlyNames(endpoints, owners)
+	return endpoints, skipped
+}
+
+// alexaStripDescription describes a strip in the Alexa app, leading with the
+// device's room so strips are easy to sort into Alexa groups
+func alexaStripDescription(device Device, strip LEDStrip) string {
+	desc := fmt.Sprintf("LED strip on pin D%d with %d LEDs", strip.Pin, strip.LEDCount)
+	if device.Room != "" {
+		desc = device.Room + " - " + desc
+	}
+	return desc
+}
+
+// BuildAlexaCapabilities returns the capabilities advertised for every LED strip
+// endpoint. With no modes, only the built-in firmware modes are offered.
+func BuildAlexaCapabilities(modes []string) []AlexaCapability {
+	if len(modes) == 0 {
+		modes = baseAlexaModes
+	}
+
+	return []AlexaCapability{
+		{
+			Type:      "AlexaInterface",
+			Interface: "Alexa",
+			Version:   "3",
+		},
+		{
+			Type:      "AlexaInterface",
+			Interface: "Alexa.PowerController",
+			Version:   "3",
+			Properties: &CapabilityProperties{
+				Supported: []SupportedProperty{
+					{Name: "powerState"},
+				},
+				ProactivelyReported: false,
+				Retrievable:         true,
+			},
+		},
+		{
+			Type:      "AlexaInterface",
+			Interface: "Alexa.BrightnessController",
+			Version:   "3",
+			Properties: &CapabilityProperties{
+				Supported: []SupportedProperty{
+					{Name: "brightness"},
+				},
+				ProactivelyReported: false,
+				Retrievable:         true,
+			},
+		},
+		{
+			Type:      "AlexaInterface",
+			Interface: "Alexa.ColorController",
+			Version:   "3",
+			Properties: &CapabilityProperties{
+				Supported: []SupportedProperty{
+					{Name: "color"},
+				},
+				ProactivelyReported: false,
+				Retrievable:         true,
+			},
+		},
+		{
+			Type:      "AlexaInterface",
+			Interface: "Alexa.ModeController",
+			Instance:  "LightStrip.Pattern",
+			Version:   "3",
+			Properties: &CapabilityProperties{
+				Supported: []SupportedProperty{
+					{Name: "mode"},
+				},
+				ProactivelyReported: false,
+				Retrievable:         true,
+			},
+			CapabilityResources: &CapabilityResources{
+				FriendlyNames: []FriendlyName{
+					{Type: "text", Value: FriendlyNameVal{Text: "pattern", Locale: "en-US"}},
+					{Type: "text", Value: FriendlyNameVal{Text: "effect", Locale: "en-US"}},
+					{Type: "text", Value: FriendlyNameVal{Text: "mode", Locale: "en-US"}},
+				},
+			},
+			Configuration: &ModeConfiguration{
+				Ordered:        false,
+				SupportedModes: buildSupportedModes(modes),
+			},
+		},
+	}
+}
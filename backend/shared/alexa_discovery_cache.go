@@ -0,0 +1,217 @@
+package shared
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// AlexaDiscoveryCacheMaxAge bounds how long a cached discovery response is
+// reused without being marked dirty. Changes that mark it dirty (strips,
+// names, rooms, readiness) show up at once; pattern changes, which only
+// alter the advertised modes, show up within this long.
+const AlexaDiscoveryCacheMaxAge = time.Hour
+
+// alexaDiscoveryCacheTTL is how long an unused cache record is kept
+const alexaDiscoveryCacheTTL = 7 * 24 * time.Hour
+
+// alexaDiscoveryPrefix keys a user's cached discovery response in the state
+// table. Like tombstones, the record has no userId, so it stays out of the
+// userId index.
+const alexaDiscoveryPrefix = "discovery#"
+
+// AlexaDiscoveryCache is a user's last discovery response. Generation is
+// bumped each time the cache is marked dirty, so a response built before
+// the change can't overwrite the mark.
+type AlexaDiscoveryCache struct {
+	Key           string    `dynamodbav:"endpointId"`
+	Endpoints     []byte    `dynamodbav:"endpoints,omitempty"` // Gzipped JSON of the endpoints
+	EndpointCount int       `dynamodbav:"endpointCount"`
+	Hash          string    `dynamodbav:"discoveryHash,omitempty"` // AlexaDiscoveryHash of the endpoints
+	Dirty         bool      `dynamodbav:"dirty"`
+	Generation    int64     `dynamodbav:"generation"`
+	BuiltAt       time.Time `dynamodbav:"builtAt"`
+	ExpiresAt     int64     `dynamodbav:"expiresAt"` // TTL
+}
+
+// Fresh reports whether the cached response can answer a discovery
+func (c *AlexaDiscoveryCache) Fresh(now time.Time) bool {
+	return c != nil && !c.Dirty && len(c.Endpoints) > 0 && now.Sub(c.BuiltAt) < AlexaDiscoveryCacheMaxAge
+}
+
+// DiscoveryEndpoints decodes the cached endpoints
+func (c *AlexaDiscoveryCache) DiscoveryEndpoints() ([]AlexaDiscoveryEndpoint, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(c.Endpoints))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	raw, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	var endpoints []AlexaDiscoveryEndpoint
+	if err := json.Unmarshal(raw, &endpoints); err != nil {
+		return nil, err
+	}
+	return endpoints, nil
+}
+
+// AlexaDiscoveryHash fingerprints a discovery response. It covers everything
+// Alexa is told about each strip, so it changes when a device's strips, name,
+// room, readiness or modes do, but not when a refresh only moves UpdatedAt.
+func AlexaDiscoveryHash(endpoints []AlexaDiscoveryEndpoint) string {
+	raw, _ := json.Marshal(endpoints)
+	hash := sha256.Sum256(raw)
+	return hex.EncodeToString(hash[:])
+}
+
+// GetAlexaDiscoveryCache returns userID's cached discovery response, or nil
+// if there isn't one
+func GetAlexaDiscoveryCache(ctx context.Context, userID string) (*AlexaDiscoveryCache, error) {
+	key, err := attributevalue.MarshalMap(map[string]string{
+		"endpointId": alexaDiscoveryPrefix + userID,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var cache AlexaDiscoveryCache
+	if err := GetItem(ctx, alexaStateTable, key, &cache); err != nil {
+		return nil, err
+	}
+	if cache.Key == "" {
+		return nil, nil
+	}
+	return &cache, nil
+}
+
+// SaveAlexaDiscoveryCache caches endpoints as userID's discovery response.
+// generation is that of the cache read before the endpoints were built (0
+// if there was none); if the cache has been marked dirty since, nothing is
+// saved, as the endpoints may predate the change.
+func SaveAlexaDiscoveryCache(ctx context.Context, userID string, endpoints []AlexaDiscoveryEndpoint, generation int64) error {
+	raw, err := json.Marshal(endpoints)
+	if err != nil {
+		return err
+	}
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	if _, err := writer.Write(raw); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	item, err := attributevalue.MarshalMap(AlexaDiscoveryCache{
+		Key:           alexaDiscoveryPrefix + userID,
+		Endpoints:     compressed.Bytes(),
+		EndpointCount: len(endpoints),
+		Hash:          AlexaDiscoveryHash(endpoints),
+		Generation:    generation,
+		BuiltAt:       now,
+		ExpiresAt:     now.Add(alexaDiscoveryCacheTTL).Unix(),
+	})
+	if err != nil {
+		return err
+	}
+
+	client, err := InitDynamoDB()
+	if err != nil {
+		return err
+	}
+	_, err = client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(alexaStateTable),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(endpointId) OR generation = :generation"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":generation": &types.AttributeValueMemberN{Value: strconv.FormatInt(generation, 10)},
+		},
+	})
+	if err != nil {
+		var changed *types.ConditionalCheckFailedException
+		if errors.As(err, &changed) {
+			log.Printf("[ALEXA_DB] Discovery cache for %s changed while it was built; not saved", userID)
+			return nil
+		}
+		return err
+	}
+	log.Printf("[ALEXA_DB] Cached %d discovery endpoints for %s", len(endpoints), userID)
+	return nil
+}
+
+// MarkAlexaDiscoveryDirty makes the next discovery for userID rebuild its
+// response. The record is created if there isn't one, so a discovery
+// already under way can't cache what it read before the change.
+func MarkAlexaDiscoveryDirty(ctx context.Context, userID string) error {
+	client, err := InitDynamoDB()
+	if err != nil {
+		return err
+	}
+	_, err = client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(alexaStateTable),
+		Key: map[string]types.AttributeValue{
+			"endpointId": &types.AttributeValueMemberS{Value: alexaDiscoveryPrefix + userID},
+		},
+		UpdateExpression: aws.String("SET dirty = :dirty, expiresAt = :expires ADD generation :one"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":dirty":   &types.AttributeValueMemberBOOL{Value: true},
+			":expires": &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Add(alexaDiscoveryCacheTTL).Unix(), 10)},
+			":one":     &types.AttributeValueMemberN{Value: "1"},
+		},
+	})
+	return err
+}
+
+// DeleteAlexaDiscoveryCache forgets userID's cached discovery response
+func DeleteAlexaDiscoveryCache(ctx context.Context, userID string) error {
+	key, err := attributevalue.MarshalMap(map[string]string{
+		"endpointId": alexaDiscoveryPrefix + userID,
+	})
+	if err != nil {
+		return err
+	}
+
+	return DeleteItem(ctx, alexaStateTable, key)
+}
+
+// BuildUserAlexaDiscovery builds userID's discovery response from their
+// devices and patterns. It still succeeds with just the firmware modes if
+// patterns can't be read.
+func BuildUserAlexaDiscovery(ctx context.Context, userID string) ([]AlexaDiscoveryEndpoint, []AlexaSkippedDevice, error) {
+	indexName := "userId-index"
+	expressionValues := map[string]types.AttributeValue{
+		":userId": &types.AttributeValueMemberS{Value: userID},
+	}
+
+	var devices []Device
+	if err := Query(ctx, os.Getenv("DEVICES_TABLE"), &indexName, "userId = :userId", expressionValues, &devices); err != nil {
+		return nil, nil, err
+	}
+
+	var patterns []Pattern
+	if err := Query(ctx, os.Getenv("PATTERNS_TABLE"), &indexName, "userId = :userId", expressionValues, &patterns); err != nil {
+		log.Printf("[ALEXA_DB] Failed to get patterns for %s: %v", userID, err)
+		patterns = nil
+	}
+
+	endpoints, skipped := BuildAlexaDiscoveryEndpoints(devices, AlexaModesForPatterns(patterns))
+	return endpoints, skipped, nil
+}
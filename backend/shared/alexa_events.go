@@ -0,0 +1,365 @@
+package shared
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Proactive events are sent to the Alexa event gateway with a Login with
+// Amazon token for the user, got from the code in the AcceptGrant directive.
+// They're on when ALEXA_EVENTS_CLIENT_ID and ALEXA_EVENTS_CLIENT_SECRET, the
+// skill's Alexa Skill Messaging credentials, are set.
+
+// lwaTokenURL is Login with Amazon's token endpoint
+const lwaTokenURL = "https://api.amazon.com/auth/o2/token"
+
+// alexaReportMaxEndpoints is the most endpoints one AddOrUpdateReport may carry
+const alexaReportMaxEndpoints = 300
+
+// alexaGrantRefreshMargin refreshes a grant's access token this long before
+// it expires, so it can't expire in flight
+const alexaGrantRefreshMargin = time.Minute
+
+// ErrNoAlexaGrant is returned when a user has no grant to send events with
+var ErrNoAlexaGrant = errors.New("no Alexa grant")
+
+// AlexaGrant is the Login with Amazon token pair for sending a user's
+// proactive events
+type AlexaGrant struct {
+	RefreshToken string    `dynamodbav:"refreshToken"`
+	AccessToken  string    `dynamodbav:"accessToken"`
+	ExpiresAt    time.Time `dynamodbav:"expiresAt"`
+}
+
+// lwaTokenResponse is Login with Amazon's answer to a token request
+type lwaTokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	RefreshToken     string `json:"refresh_token"`
+	ExpiresIn        int    `json:"expires_in"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// AlexaEventsEnabled reports whether proactive events can be sent
+func AlexaEventsEnabled() bool {
+	return os.Getenv("ALEXA_EVENTS_CLIENT_ID") != "" && os.Getenv("ALEXA_EVENTS_CLIENT_SECRET") != ""
+}
+
+// ExchangeAlexaGrantCode trades the code from an AcceptGrant directive for
+// the user's token pair
+func ExchangeAlexaGrantCode(ctx context.Context, code string) (*AlexaGrant, error) {
+	return requestLWAToken(ctx, url.Values{
+		"grant_type": {"authorization_code"},
+		"code":       {code},
+	})
+}
+
+// requestLWAToken asks Login with Amazon for a token with the skill's
+// messaging credentials
+func requestLWAToken(ctx context.Context, form url.Values) (*AlexaGrant, error) {
+	form.Set("client_id", os.Getenv("ALEXA_EVENTS_CLIENT_ID"))
+	form.Set("client_secret", os.Getenv("ALEXA_EVENTS_CLIENT_SECRET"))
+
+	ctx, cancel := WithCallTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", lwaTokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, DependencyTimeout("Login with Amazon", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	var token lwaTokenResponse
+	if err := json.Unmarshal(body, &token); err != nil {
+		return nil, fmt.Errorf("failed to parse Login with Amazon response (status %d): %v", resp.StatusCode, err)
+	}
+	if resp.StatusCode != http.StatusOK || token.AccessToken == "" {
+		// The description is Amazon's and never quotes the code or tokens
+		return nil, fmt.Errorf("Login with Amazon token request failed (status %d): %s %s", resp.StatusCode, token.Error, token.ErrorDescription)
+	}
+
+	return &AlexaGrant{
+		RefreshToken: token.RefreshToken,
+		AccessToken:  token.AccessToken,
+		ExpiresAt:    time.Now().Add(time.Duration(token.ExpiresIn) * time.Second),
+	}, nil
+}
+
+// SaveAlexaGrant stores a grant on the user
+func SaveAlexaGrant(ctx context.Context, usersTable, userID string, grant *AlexaGrant) error {
+	av, err := attributevalue.Marshal(grant)
+	if err != nil {
+		return err
+	}
+
+	client, err := InitDynamoDB()
+	if err != nil {
+		return err
+	}
+	_, err = client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(usersTable),
+		Key: map[string]types.AttributeValue{
+			"username": &types.AttributeValueMemberS{Value: userID},
+		},
+		UpdateExpression:    aws.String("SET alexaGrant = :grant"),
+		ConditionExpression: aws.String("attribute_exists(username)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":grant": av,
+		},
+	})
+	return err
+}
+
+// alexaEventsAccessToken returns an access token for user's events,
+// refreshing the grant when it's about to expire. A refreshed grant that
+// can't be saved is still used; the next event refreshes it again.
+func alexaEventsAccessToken(ctx context.Context, usersTable string, user *User) (string, error) {
+	grant := user.AlexaGrant
+	if grant == nil || grant.RefreshToken == "" {
+		return "", ErrNoAlexaGrant
+	}
+	if time.Until(grant.ExpiresAt) > alexaGrantRefreshMargin {
+		return grant.AccessToken, nil
+	}
+
+	refreshed, err := requestLWAToken(ctx, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {grant.RefreshToken},
+	})
+	if err != nil {
+		return "", err
+	}
+	if refreshed.RefreshToken == "" {
+		refreshed.RefreshToken = grant.RefreshToken
+	}
+	if err := SaveAlexaGrant(ctx, usersTable, user.Username, refreshed); err != nil {
+		log.Printf("[ALEXA_EVENTS] Failed to save refreshed grant for %s: %v", user.Username, err)
+	}
+	user.AlexaGrant = refreshed
+	return refreshed.AccessToken, nil
+}
+
+// SendAlexaAddOrUpdateReport tells Alexa about user's new and changed
+// endpoints, so they appear without the user running discovery. Endpoints
+// are sent in batches of alexaReportMaxEndpoints.
+func SendAlexaAddOrUpdateReport(ctx context.Context, usersTable string, user *User, endpoints []AlexaDiscoveryEndpoint) error {
+	token, err := alexaEventsAccessToken(ctx, usersTable, user)
+	if err != nil {
+		return err
+	}
+
+	for start := 0; start < len(endpoints); start += alexaReportMaxEndpoints {
+		end := start + alexaReportMaxEndpoints
+		if end > len(endpoints) {
+			end = len(endpoints)
+		}
+		if err := sendAlexaEvent(ctx, user.AlexaRegion, token, "AddOrUpdateReport", endpoints[start:end]); err != nil {
+			return err
+		}
+	}
+	log.Printf("[ALEXA_EVENTS] Sent AddOrUpdateReport for %s: %d endpoints", user.Username, len(endpoints))
+	return nil
+}
+
+// SendAlexaDeleteReport tells Alexa that user's endpoints with endpointIDs
+// are gone, so they leave the Alexa app
+func SendAlexaDeleteReport(ctx context.Context, usersTable string, user *User, endpointIDs []string) error {
+	token, err := alexaEventsAccessToken(ctx, usersTable, user)
+	if err != nil {
+		return err
+	}
+
+	for start := 0; start < len(endpointIDs); start += alexaReportMaxEndpoints {
+		end := start + alexaReportMaxEndpoints
+		if end > len(endpointIDs) {
+			end = len(endpointIDs)
+		}
+		endpoints := make([]map[string]string, 0, end-start)
+		for _, id := range endpointIDs[start:end] {
+			endpoints = append(endpoints, map[string]string{"endpointId": id})
+		}
+		if err := sendAlexaEvent(ctx, user.AlexaRegion, token, "DeleteReport", endpoints); err != nil {
+			return err
+		}
+	}
+	log.Printf("[ALEXA_EVENTS] Sent DeleteReport for %s: %d endpoints", user.Username, len(endpointIDs))
+	return nil
+}
+
+// diffAlexaEndpoints compares a discovery response with the one before it,
+// returning the endpoints that are new or changed and the IDs of those that
+// are gone
+func diffAlexaEndpoints(before, after []AlexaDiscoveryEndpoint) (changed []AlexaDiscoveryEndpoint, removed []string) {
+	previous := make(map[string]string, len(before))
+	for _, endpoint := range before {
+		previous[endpoint.EndpointID] = AlexaDiscoveryHash([]AlexaDiscoveryEndpoint{endpoint})
+	}
+	current := make(map[string]bool, len(after))
+	for _, endpoint := range after {
+		current[endpoint.EndpointID] = true
+		if hash, ok := previous[endpoint.EndpointID]; !ok || hash != AlexaDiscoveryHash([]AlexaDiscoveryEndpoint{endpoint}) {
+			changed = append(changed, endpoint)
+		}
+	}
+	for _, endpoint := range before {
+		if !current[endpoint.EndpointID] {
+			removed = append(removed, endpoint.EndpointID)
+		}
+	}
+	return changed, removed
+}
+
+// sendAlexaEvent posts one Alexa.Discovery event to the region's gateway
+func sendAlexaEvent(ctx context.Context, region, token, name string, endpoints interface{}) error {
+	messageID, err := generateSecureToken(16)
+	if err != nil {
+		return err
+	}
+	event := map[string]interface{}{
+		"event": map[string]interface{}{
+			"header": AlexaHeader{
+				Namespace:      "Alexa.Discovery",
+				Name:           name,
+				PayloadVersion: "3",
+				MessageID:      messageID,
+			},
+			"payload": map[string]interface{}{
+				"endpoints": endpoints,
+				"scope": AlexaScope{
+					Type:  "BearerToken",
+					Token: token,
+				},
+			},
+		},
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := WithCallTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", AlexaEventGatewayURL(region), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return DependencyTimeout("Alexa event gateway", err)
+	}
+	defer resp.Body.Close()
+
+	// The gateway answers 202 Accepted
+	if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("Alexa event gateway rejected %s (status %d): %s", name, resp.StatusCode, string(respBody))
+	}
+	return nil
+}
+
+// RefreshAlexaDiscovery is called after a change that may alter userID's
+// Alexa endpoints: a strip added or removed, or a device renamed, moved,
+// provisioned or deleted. The cached discovery response is marked dirty so
+// the next discovery rebuilds it. With proactive events on and a grant
+// recorded, the endpoints are rebuilt now and compared with the cached
+// ones: new and changed strips are sent in an AddOrUpdateReport and removed
+// ones in a DeleteReport, so the Alexa app catches up without the user
+// running discovery. Failures are logged, never returned; the change
+// itself has already been saved.
+func RefreshAlexaDiscovery(ctx context.Context, userID string) {
+	previous, err := GetAlexaDiscoveryCache(ctx, userID)
+	if err != nil {
+		log.Printf("[ALEXA_EVENTS] Failed to read discovery cache for %s: %v", userID, err)
+	}
+	if err := MarkAlexaDiscoveryDirty(ctx, userID); err != nil {
+		log.Printf("[ALEXA_EVENTS] Failed to mark discovery dirty for %s: %v", userID, err)
+		return
+	}
+	if !AlexaEventsEnabled() {
+		return
+	}
+
+	usersTable := os.Getenv("USERS_TABLE")
+	key, _ := attributevalue.MarshalMap(map[string]string{
+		"username": userID,
+	})
+	var user User
+	if err := GetItem(ctx, usersTable, key, &user); err != nil {
+		log.Printf("[ALEXA_EVENTS] Failed to load user %s: %v", userID, err)
+		return
+	}
+	if user.AlexaGrant == nil {
+		return
+	}
+
+	// Read back the generation the dirty mark left, so the endpoints built
+	// here can be cached unless something else changes meanwhile
+	current, err := GetAlexaDiscoveryCache(ctx, userID)
+	if err != nil || current == nil {
+		log.Printf("[ALEXA_EVENTS] Failed to read discovery cache for %s: %v", userID, err)
+		return
+	}
+
+	endpoints, _, err := BuildUserAlexaDiscovery(ctx, userID)
+	if err != nil {
+		log.Printf("[ALEXA_EVENTS] Failed to build endpoints for %s: %v", userID, err)
+		return
+	}
+
+	// Without a previous response to compare with, every endpoint is sent
+	changed, removed := endpoints, []string(nil)
+	if previous != nil && len(previous.Endpoints) > 0 {
+		if previous.Hash == AlexaDiscoveryHash(endpoints) {
+			changed = nil
+		} else if before, err := previous.DiscoveryEndpoints(); err == nil {
+			changed, removed = diffAlexaEndpoints(before, endpoints)
+		}
+	}
+
+	// A report that fails leaves the cache dirty, so the next change sends it again
+	if len(changed) > 0 {
+		if err := SendAlexaAddOrUpdateReport(ctx, usersTable, &user, changed); err != nil {
+			log.Printf("[ALEXA_EVENTS] Failed to send AddOrUpdateReport for %s: %v", userID, err)
+			return
+		}
+	}
+	if len(removed) > 0 {
+		if err := SendAlexaDeleteReport(ctx, usersTable, &user, removed); err != nil {
+			log.Printf("[ALEXA_EVENTS] Failed to send DeleteReport for %s: %v", userID, err)
+			return
+		}
+	}
+	if len(changed) == 0 && len(removed) == 0 {
+		log.Printf("[ALEXA_EVENTS] Endpoints for %s unchanged; no report sent", userID)
+	}
+
+	if err := SaveAlexaDiscoveryCache(ctx, userID, endpoints, current.Generation); err != nil {
+		log.Printf("[ALEXA_EVENTS] Failed to cache endpoints for %s: %v", userID, err)
+	}
+}
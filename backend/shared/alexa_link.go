@@ -0,0 +1,150 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Alexa link statuses, reported as linkStatus
+const (
+	AlexaLinked   = "linked"
+	AlexaUnlinked = "unlinked"
+)
+
+// AlexaLinkStatus is the body of GET /api/settings/alexa-link
+type AlexaLinkStatus struct {
+	LinkStatus  string     `json:"linkStatus"`
+	LinkedAt    *time.Time `json:"linkedAt,omitempty"`
+	AlexaRegion string     `json:"alexaRegion,omitempty"`
+}
+
+// AlexaUnlinkResult counts what UnlinkAlexa removed
+type AlexaUnlinkResult struct {
+	TokensRevoked int `json:"tokensRevoked"`
+	StatesDeleted int `json:"statesDeleted"`
+}
+
+// GetAlexaLinkStatus reports whether user has linked the Alexa skill. The
+// link is live while any OAuth token issued to them remains; expired tokens
+// count, as Alexa refreshes them.
+func GetAlexaLinkStatus(ctx context.Context, user *User) (AlexaLinkStatus, error) {
+	tokens, err := GetUserAccessTokens(ctx, user.Username)
+	if err != nil {
+		return AlexaLinkStatus{}, err
+	}
+	if len(tokens) == 0 {
+		return AlexaLinkStatus{LinkStatus: AlexaUnlinked}, nil
+	}
+
+	status := AlexaLinkStatus{
+		LinkStatus:  AlexaLinked,
+		LinkedAt:    user.AlexaLinkedAt,
+		AlexaRegion: user.AlexaRegion,
+	}
+	// Links made before alexaLinkedAt was recorded date from their oldest token
+	if status.LinkedAt == nil {
+		for _, t := range tokens {
+			if status.LinkedAt == nil || t.CreatedAt.Before(*status.LinkedAt) {
+				createdAt := t.CreatedAt
+				status.LinkedAt = &createdAt
+			}
+		}
+	}
+	return status, nil
+}
+
+// UnlinkAlexa forgets userID's Alexa link: every OAuth token issued to them
+// is revoked, so directives fail with INVALID_AUTHORIZATION_CREDENTIAL, their
+// endpoint state rows and cached discovery response are deleted and the
+// Alexa region and grant recorded from the AcceptGrant are cleared. Tokens go first, so a failure part way leaves the
+// skill unusable rather than half linked; calling again finishes the job.
+func UnlinkAlexa(ctx context.Context, usersTable, userID string) (*AlexaUnlinkResult, error) {
+	result := &AlexaUnlinkResult{}
+
+	tokens, err := GetUserAccessTokens(ctx, userID)
+	if err != nil {
+		return result, err
+	}
+	if len(tokens) > 0 {
+		keys := make([]map[string]types.AttributeValue, 0, len(tokens))
+		for _, t := range tokens {
+			keys = append(keys, map[string]types.AttributeValue{
+				"tokenHash": &types.AttributeValueMemberS{Value: t.TokenHash},
+			})
+		}
+		result.TokensRevoked, err = BatchDeleteItems(ctx, alexaTokensTable, keys)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	states, err := GetUserAlexaDeviceStates(ctx, userID)
+	if err != nil {
+		return result, err
+	}
+	if len(states) > 0 {
+		keys := make([]map[string]types.AttributeValue, 0, len(states))
+		for _, s := range states {
+			keys = append(keys, map[string]types.AttributeValue{
+				"endpointId": &types.AttributeValueMemberS{Value: s.EndpointID},
+			})
+		}
+		result.StatesDeleted, err = BatchDeleteItems(ctx, alexaStateTable, keys)
+		if err != nil {
+			return result, err
+		}
+	}
+	if err := DeleteAlexaDiscoveryCache(ctx, userID); err != nil {
+		return result, err
+	}
+
+	client, err := InitDynamoDB()
+	if err != nil {
+		return result, err
+	}
+	_, err = client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(usersTable),
+		Key: map[string]types.AttributeValue{
+			"username": &types.AttributeValueMemberS{Value: userID},
+		},
+		UpdateExpression:    aws.String("REMOVE alexaRegion, alexaLinkedAt, alexaGrant"),
+		ConditionExpression: aws.String("attribute_exists(username)"),
+	})
+	if err != nil {
+		// A deleted user has no link to forget
+		var missing *types.ConditionalCheckFailedException
+		if !errors.As(err, &missing) {
+			return result, err
+		}
+	}
+
+	log.Printf("[ALEXA_DB] Unlinked Alexa for user %s: %d tokens revoked, %d states deleted",
+		userID, result.TokensRevoked, result.StatesDeleted)
+	return result, nil
+}
+
+// RecordAlexaLinked stamps alexaLinkedAt on the user when they link the skill
+func RecordAlexaLinked(ctx context.Context, usersTable, userID string, at time.Time) error {
+	client, err := InitDynamoDB()
+	if err != nil {
+		return err
+	}
+	_, err = client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(usersTable),
+		Key: map[string]types.AttributeValue{
+			"username": &types.AttributeValueMemberS{Value: userID},
+		},
+		UpdateExpression:    aws.String("SET alexaLinkedAt = :at"),
+		ConditionExpression: aws.String("attribute_exists(username)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":at": &types.AttributeValueMemberS{Value: at.UTC().Format(time.RFC3339Nano)},
+		},
+	})
+	return err
+}
@@ -0,0 +1,185 @@
+package shared
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stubLinkTables stands in for the users, OAuth token and Alexa state
+// tables, holding items in wire form by table and key value
+type stubLinkTables struct {
+	keys    map[string]string // Key attribute by table
+	items   map[string]map[string]map[string]interface{}
+	updates []string // UpdateExpressions run against users
+}
+
+func newStubLinkTables() *stubLinkTables {
+	return &stubLinkTables{
+		keys:  map[string]string{"users": "username", alexaTokensTable: "tokenHash", alexaStateTable: "endpointId"},
+		items: map[string]map[string]map[string]interface{}{},
+	}
+}
+
+func (s *stubLinkTables) put(table string, item interface{}) {
+	wire := DynamoDBStubItem(item)
+	key := wire[s.keys[table]].(map[string]interface{})["S"].(string)
+	if s.items[table] == nil {
+		s.items[table] = map[string]map[string]interface{}{}
+	}
+	s.items[table][key] = wire
+}
+
+// left lists the key values still in table, sorted
+func (s *stubLinkTables) left(table string) []string {
+	keys := []string{}
+	for key := range s.items[table] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (s *stubLinkTables) handle(call DynamoDBStubCall) (map[string]interface{}, error) {
+	switch call.Operation {
+	case "GetItem", "DeleteItem":
+		var key map[string]string
+		if err := call.Unmarshal("Key", &key); err != nil {
+			return nil, err
+		}
+		value := key[s.keys[call.Table()]]
+		if call.Operation == "DeleteItem" {
+			delete(s.items[call.Table()], value)
+		} else if item, ok := s.items[call.Table()][value]; ok {
+			return map[string]interface{}{"Item": item}, nil
+		}
+		return nil, nil
+	case "Query":
+		var values struct {
+			UserID string `dynamodbav:":userId"`
+		}
+		if err := call.Unmarshal("ExpressionAttributeValues", &values); err != nil {
+			return nil, err
+		}
+		var items []interface{}
+		for _, item := range s.items[call.Table()] {
+			if owner, ok := item["userId"].(map[string]interface{}); ok && owner["S"] == values.UserID {
+				items = append(items, item)
+			}
+		}
+		return map[string]interface{}{"Items": items, "Count": len(items)}, nil
+	case "BatchWriteItem":
+		var requests map[string][]struct {
+			DeleteRequest struct {
+				Key map[string]map[string]string
+			}
+		}
+		if err := json.Unmarshal(call.Input["RequestItems"], &requests); err != nil {
+			return nil, err
+		}
+		for table, writes := range requests {
+			for _, write := range writes {
+				delete(s.items[table], write.DeleteRequest.Key[s.keys[table]]["S"])
+			}
+		}
+		return nil, nil
+	case "UpdateItem":
+		if call.Table() == "users" {
+			s.updates = append(s.updates, call.String("UpdateExpression"))
+		}
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unexpected %s", call.Operation)
+}
+
+// stubAlexaTableNames gives the Alexa tables distinct names, which they lack
+// without their environment variables
+func stubAlexaTableNames() (restore func()) {
+	tokens, states := alexaTokensTable, alexaStateTable
+	alexaTokensTable, alexaStateTable = "alexa-tokens", "alexa-state"
+	return func() {
+		alexaTokensTable, alexaStateTable = tokens, states
+	}
+}
+
+func TestUnlinkAlexaRemovesEveryRow(t *testing.T) {
+	defer stubAlexaTableNames()()
+	store := newStubLinkTables()
+	defer StubDynamoDB(store.handle)()
+
+	now := time.Now()
+	store.put(alexaTokensTable, OAuthToken{TokenHash: hashToken("lee-current"), UserID: "lee", ExpiresAt: now.Add(time.Hour).Unix()})
+	store.put(alexaTokensTable, OAuthToken{TokenHash: hashToken("lee-expired"), UserID: "lee", ExpiresAt: now.Add(-time.Hour).Unix()})
+	store.put(alexaTokensTable, OAuthToken{TokenHash: hashToken("sam"), UserID: "sam", ExpiresAt: now.Add(time.Hour).Unix()})
+	store.put(alexaStateTable, AlexaDeviceState{EndpointID: AlexaEndpointID("d1", 2), UserID: "lee", DeviceID: "d1", Pin: 2})
+	store.put(alexaStateTable, AlexaDeviceState{EndpointID: AlexaEndpointID("d1", 6), UserID: "lee", DeviceID: "d1", Pin: 6})
+	store.put(alexaStateTable, AlexaDeviceState{EndpointID: AlexaEndpointID("d9", 6), UserID: "sam", DeviceID: "d9", Pin: 6})
+	store.put(alexaStateTable, AlexaDiscoveryCache{Key: alexaDiscoveryPrefix + "lee", EndpointCount: 2})
+	store.put(alexaStateTable, AlexaDiscoveryCache{Key: alexaDiscoveryPrefix + "sam", EndpointCount: 1})
+
+	ctx := context.Background()
+	result, err := UnlinkAlexa(ctx, "users", "lee")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.TokensRevoked != 2 || result.StatesDeleted != 2 {
+		t.Errorf("unlink = %+v, want 2 tokens and 2 states", *result)
+	}
+
+	// Only sam's rows are left
+	if got, want := store.left(alexaTokensTable), []string{hashToken("sam")}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("tokens left = %v, want only sam's", got)
+	}
+	want := []string{AlexaEndpointID("d9", 6), alexaDiscoveryPrefix + "sam"}
+	sort.Strings(want)
+	if got := store.left(alexaStateTable); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("states left = %v, want %v", got, want)
+	}
+	if len(store.updates) != 1 || !strings.Contains(store.updates[0], "REMOVE alexaRegion, alexaLinkedAt") {
+		t.Errorf("user updates = %v, want the region and link time removed", store.updates)
+	}
+
+	// The revoked token no longer authorizes anything
+	if userID, err := ValidateAccessToken(ctx, "lee-current"); userID != "" || err != nil {
+		t.Errorf("revoked token validates as %q, %v", userID, err)
+	}
+	if status, err := GetAlexaLinkStatus(ctx, &User{Username: "lee"}); err != nil || status.LinkStatus != AlexaUnlinked {
+		t.Errorf("lee's link status = %+v, %v; want unlinked", status, err)
+	}
+
+	// Unlinking again finds nothing left to do
+	if result, err := UnlinkAlexa(ctx, "users", "lee"); err != nil || *result != (AlexaUnlinkResult{}) {
+		t.Errorf("second unlink = %+v, %v; want nothing removed", result, err)
+	}
+}
+
+func TestAlexaLinkStatus(t *testing.T) {
+	defer stubAlexaTableNames()()
+	store := newStubLinkTables()
+	defer StubDynamoDB(store.handle)()
+
+	first := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	store.put(alexaTokensTable, OAuthToken{TokenHash: hashToken("a"), UserID: "lee", CreatedAt: first.Add(48 * time.Hour)})
+	store.put(alexaTokensTable, OAuthToken{TokenHash: hashToken("b"), UserID: "lee", CreatedAt: first})
+
+	ctx := context.Background()
+	status, err := GetAlexaLinkStatus(ctx, &User{Username: "lee", AlexaRegion: "NA"})
+	if err != nil || status.LinkStatus != AlexaLinked || status.LinkedAt == nil || !status.LinkedAt.Equal(first) || status.AlexaRegion != "NA" {
+		t.Errorf("status without alexaLinkedAt = %+v, %v; want linked since the oldest token", status, err)
+	}
+
+	linkedAt := first.Add(time.Hour)
+	status, _ = GetAlexaLinkStatus(ctx, &User{Username: "lee", AlexaLinkedAt: &linkedAt})
+	if status.LinkedAt == nil || !status.LinkedAt.Equal(linkedAt) {
+		t.Errorf("linkedAt = %v, want the recorded %v", status.LinkedAt, linkedAt)
+	}
+
+	status, _ = GetAlexaLinkStatus(ctx, &User{Username: "sam"})
+	if status.LinkStatus != AlexaUnlinked || status.LinkedAt != nil {
+		t.Errorf("status without tokens = %+v, want unlinked", status)
+	}
+}
@@ -188,12 +188,12 @@ type ErrorPayload struct {
 
 // SetBrightnessPayload for brightness directives
 type SetBrightnessPayload struct {
-	Brightness int `json:"brightness"`
+	Brightness int `json:"brightness"` // BrightnessPercent, 0-100
 }
 
 // AdjustBrightnessPayload for brightness adjustment
 type AdjustBrightnessPayload struct {
-	BrightnessDelta int `json:"brightnessDelta"`
+	BrightnessDelta int `json:"brightnessDelta"` // Percent points, -100 to 100
 }
 
 // SetColorPayload for color directives
@@ -243,10 +243,11 @@ type AlexaDeviceState struct {
 	DeviceID       string    `json:"deviceId" dynamodbav:"deviceId"`
 	Pin            int       `json:"pin" dynamodbav:"pin"`
 	PowerState     string    `json:"powerState" dynamodbav:"powerState"`         // "ON" or "OFF"
-	Brightness     int       `json:"brightness" dynamodbav:"brightness"`         // 0-100
+	Brightness     int       `json:"brightness" dynamodbav:"brightness"`         // BrightnessPercent, 0-100
 	ColorHue       float64   `json:"colorHue" dynamodbav:"colorHue"`             // 0-360
 	ColorSaturation float64  `json:"colorSaturation" dynamodbav:"colorSaturation"` // 0-1
 	PatternMode    string    `json:"patternMode" dynamodbav:"patternMode"`       // Pattern mode name
+	RestorePatternID string  `json:"restorePatternId,omitempty" dynamodbav:"restorePatternId,omitempty"` // Strip's pattern at TurnOff, replayed by TurnOn
 	LastUpdated    time.Time `json:"lastUpdated" dynamodbav:"lastUpdated"`
 }
 
@@ -0,0 +1,237 @@
+package shared
+
+import (
+	"sort"
+)
+
+// MaxAlexaModes caps the modes advertised per endpoint so the Alexa app's
+// mode list stays usable
+const MaxAlexaModes = 20
+
+// Alexa modes for WLED effects beyond the six firmware patterns
+const (
+	AlexaModeScanner   = "LightEffect.Scanner"
+	AlexaModeSparkle   = "LightEffect.Sparkle"
+	AlexaModeTwinkle   = "LightEffect.Twinkle"
+	AlexaModeChase     = "LightEffect.Chase"
+	AlexaModeWipe      = "LightEffect.Wipe"
+	AlexaModeMeteor    = "LightEffect.Meteor"
+	AlexaModeRipple    = "LightEffect.Ripple"
+	AlexaModeFireworks = "LightEffect.Fireworks"
+	AlexaModeStrobe    = "LightEffect.Strobe"
+	AlexaModeLightning = "LightEffect.Lightning"
+	AlexaModeAurora    = "LightEffect.Aurora"
+	AlexaModeGradient  = "LightEffect.Gradient"
+	AlexaModeBounce    = "LightEffect.Bounce"
+	AlexaModeColorloop = "LightEffect.ColorLoop"
+)
+
+// baseAlexaModes are always advertised; they map to built-in firmware patterns
+var baseAlexaModes = []string{
+	AlexaModeSolid,
+	AlexaModeCandle,
+	AlexaModePulse,
+	AlexaModeWave,
+	AlexaModeRainbow,
+	AlexaModeFire,
+}
+
+// effectAlexaModes maps WLED effect IDs to Alexa modes. Several effects can
+// share a mode; unmapped effects have no Alexa mode.
+var effectAlexaModes = map[int]string{
+	WLEDFXSolid:           AlexaModeSolid,
+	WLEDFXSolidPattern:    AlexaModeFire,
+	WLEDFXSolidPatternTri: AlexaModeWave,
+	WLEDFXCandle:          AlexaModeCandle,
+	WLEDFXBreathe:         AlexaModePulse,
+	WLEDFXFade:            AlexaModePulse,
+	WLEDFXColorwaves:      AlexaModeWave,
+	WLEDFXWaves:           AlexaModeWave,
+	WLEDFXRainbow:         AlexaModeRainbow,
+	WLEDFXRainbowRunner:   AlexaModeRainbow,
+	WLEDFXColorful:        AlexaModeRainbow,
+	WLEDFXFire2012:        AlexaModeFire,
+	WLEDFXScan:            AlexaModeScanner,
+	WLEDFXScanDual:        AlexaModeScanner,
+	WLEDFXScanner:         AlexaModeScanner,
+	WLEDFXScannerDual:     AlexaModeScanner,
+	WLEDFXSinelon:         AlexaModeScanner,
+	WLEDFXSparkle:         AlexaModeSparkle,
+	WLEDFXSparkleFlash:    AlexaModeSparkle,
+	WLEDFXSparklePlus:     AlexaModeSparkle,
+	WLEDFXGlitter:         AlexaModeSparkle,
+	WLEDFXTwinkle:         AlexaModeTwinkle,
+	WLEDFXColortwinkle:    AlexaModeTwinkle,
+	WLEDFXTwinkleFox:      AlexaModeTwinkle,
+	WLEDFXTwinkleCat:      AlexaModeTwinkle,
+	WLEDFXChase:           AlexaModeChase,
+	WLEDFXChaseRandom:     AlexaModeChase,
+	WLEDFXChaseRainbow:    AlexaModeChase,
+	WLEDFXTheater:         AlexaModeChase,
+	WLEDFXTheaterRainbow:  AlexaModeChase,
+	WLEDFXWipe:            AlexaModeWipe,
+	WLEDFXWipeRandom:      AlexaModeWipe,
+	WLEDFXSweep:           AlexaModeWipe,
+	WLEDFXMeteor:          AlexaModeMeteor,
+	WLEDFXMeteorSmooth:    AlexaModeMeteor,
+	WLEDFXMultiComet:      AlexaModeMeteor,
+	WLEDFXRipple:          AlexaModeRipple,
+	WLEDFXRipplePeak:      AlexaModeRipple,
+	WLEDFXFireworks:       AlexaModeFireworks,
+	WLEDFXFireworksStarb:  AlexaModeFireworks,
+	WLEDFXFireworks1D:     AlexaModeFireworks,
+	WLEDFXStrobe:          AlexaModeStrobe,
+	WLEDFXStrobeRainbow:   AlexaModeStrobe,
+	WLEDFXStrobeMega:      AlexaModeStrobe,
+	WLEDFXLightning:       AlexaModeLightning,
+	WLEDFXAurora:          AlexaModeAurora,
+	WLEDFXPride:           AlexaModeGradient,
+	WLEDFXPalette:         AlexaModeGradient,
+	WLEDFXBouncing:        AlexaModeBounce,
+	WLEDFXColorloop:       AlexaModeColorloop,
+}
+
+// alexaModeFriendlyNames are the spoken names for each mode (first is primary)
+var alexaModeFriendlyNames = map[string][]string{
+	AlexaModeSolid:     {"solid", "static"},
+	AlexaModeCandle:    {"candle", "flicker"},
+	AlexaModePulse:     {"pulse", "breathing"},
+	AlexaModeWave:      {"wave"},
+	AlexaModeRainbow:   {"rainbow", "colorful"},
+	AlexaModeFire:      {"fire", "flame"},
+	AlexaModeScanner:   {"scanner", "knight rider"},
+	AlexaModeSparkle:   {"sparkle", "glitter"},
+	AlexaModeTwinkle:   {"twinkle", "stars"},
+	AlexaModeChase:     {"chase", "theater"},
+	AlexaModeWipe:      {"wipe", "sweep"},
+	AlexaModeMeteor:    {"meteor", "comet"},
+	AlexaModeRipple:    {"ripple"},
+	AlexaModeFireworks: {"fireworks"},
+	AlexaModeStrobe:    {"strobe"},
+	AlexaModeLightning: {"lightning", "storm"},
+	AlexaModeAurora:    {"aurora", "northern lights"},
+	AlexaModeGradient:  {"gradient", "palette"},
+	AlexaModeBounce:    {"bounce", "bouncing balls"},
+	AlexaModeColorloop: {"color loop", "color cycle"},
+}
+
+// GetAlexaModeForEffect returns the Alexa mode for a WLED effect ID, or "" if
+// the effect has no Alexa equivalent
+func GetAlexaModeForEffect(effectID int) string {
+	return effectAlexaModes[effectID]
+}
+
+// ComputeCompatibleEffectIDs returns the distinct WLED effect IDs a pattern
+// uses, sorted ascending. It reads the pattern's WLED state or converted LCL
+// spec, falling back to the legacy type mapping (see ResolvePatternFormat).
+func ComputeCompatibleEffectIDs(pattern *Pattern) []int {
+	wledState := pattern.WLEDState
+	switch ResolvePatternFormat(*pattern) {
+	case PatternFormatLegacySimple:
+		if effectID, ok, _ := patternEffectOverride(pattern); ok {
+			return []int{effectID}
+		}
+		if effectID, ok := legacyEffectMap[pattern.Type]; ok {
+			return []int{effectID}
+		}
+		return nil
+	case PatternFormatLCL:
+		converted, _, err := lclSpecToWLEDJSON(pattern.LCLSpec, 8)
+		if err != nil {
+			return nil
+		}
+		wledState = converted
+	}
+
+	state, err := ParseWLEDJSON(wledState)
+	if err != nil {
+		return nil
+	}
+
+	seen := make(map[int]bool)
+	ids := []int{}
+	for _, seg := range state.Segments {
+		if !seen[seg.EffectID] {
+			seen[seg.EffectID] = true
+			ids = append(ids, seg.EffectID)
+		}
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// PatternEffectIDs returns the pattern's stored CompatibleEffectIDs, computing
+// them for patterns saved before the field existed
+func PatternEffectIDs(pattern *Pattern) []int {
+	if len(pattern.CompatibleEffectIDs) > 0 {
+		return pattern.CompatibleEffectIDs
+	}
+	return ComputeCompatibleEffectIDs(pattern)
+}
+
+// AlexaModesForPatterns returns the modes to advertise for a user: the
+// firmware modes, then a mode for each distinct effect in their patterns, in
+// effect ID order, capped at MaxAlexaModes
+func AlexaModesForPatterns(patterns []Pattern) []string {
+	modes := append([]string{}, baseAlexaModes...)
+	seen := make(map[string]bool, len(modes))
+	for _, mode := range modes {
+		seen[mode] = true
+	}
+
+	effectIDs := []int{}
+	seenEffects := make(map[int]bool)
+	for i := range patterns {
+		for _, id := range PatternEffectIDs(&patterns[i]) {
+			if !seenEffects[id] {
+				seenEffects[id] = true
+				effectIDs = append(effectIDs, id)
+			}
+		}
+	}
+	sort.Ints(effectIDs)
+
+	for _, id := range effectIDs {
+		mode := GetAlexaModeForEffect(id)
+		if mode == "" || seen[mode] {
+			continue
+		}
+		if len(modes) >= MaxAlexaModes {
+			break
+		}
+		seen[mode] = true
+		modes = append(modes, mode)
+	}
+
+	return modes
+}
+
+// FindPatternForAlexaMode returns the first pattern whose effects map to mode,
+// or nil. Patterns are checked in the order given.
+func FindPatternForAlexaMode(patterns []Pattern, mode string) *Pattern {
+	for i := range patterns {
+		for _, id := range PatternEffectIDs(&patterns[i]) {
+			if GetAlexaModeForEffect(id) == mode {
+				return &patterns[i]
+			}
+		}
+	}
+	return nil
+}
+
+// buildSupportedModes builds the ModeController mode list for modes
+func buildSupportedModes(modes []string) []SupportedMode {
+	supported := make([]SupportedMode, 0, len(modes))
+	for _, mode := range modes {
+		names := alexaModeFriendlyNames[mode]
+		friendly := make([]FriendlyName, 0, len(names))
+		for _, name := range names {
+			friendly = append(friendly, FriendlyName{Type: "text", Value: FriendlyNameVal{Text: name, Locale: "en-US"}})
+		}
+		supported = append(supported, SupportedMode{
+			Value:         mode,
+			ModeResources: &CapabilityResources{FriendlyNames: friendly},
+		})
+	}
+	return supported
+}
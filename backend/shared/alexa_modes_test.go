@@ -0,0 +1,90 @@
+package shared
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+)
+
+func wledPattern(id string, effects ...int) Pattern {
+	state := `{"on":true,"bri":128,"seg":[`
+	for i, fx := range effects {
+		if i > 0 {
+			state += ","
+		}
+		state += fmt.Sprintf(`{"start":0,"stop":30,"fx":%d,"col":[[255,0,0]]}`, fx)
+	}
+	return Pattern{PatternID: id, Name: id, WLEDState: state + "]}"}
+}
+
+func TestScannerPatternsAdvertiseScannerMode(t *testing.T) {
+	patterns := []Pattern{wledPattern("sweep", WLEDFXScanner)}
+
+	modes := AlexaModesForPatterns(patterns)
+	if !containsMode(modes, AlexaModeScanner) {
+		t.Errorf("modes = %v, want %s", modes, AlexaModeScanner)
+	}
+	if found := FindPatternForAlexaMode(patterns, AlexaModeScanner); found == nil || found.PatternID != "sweep" {
+		t.Errorf("pattern for %s = %v, want sweep", AlexaModeScanner, found)
+	}
+
+	device := Device{DeviceID: "d1", Name: "Garage", IsReady: true, LEDStrips: []LEDStrip{{Pin: 6, LEDCount: 30}}}
+	endpoints, _ := BuildAlexaDiscoveryEndpoints([]Device{device}, modes)
+	if len(endpoints) != 1 {
+		t.Fatalf("%d endpoints, want 1", len(endpoints))
+	}
+	advertised := false
+	for _, capability := range endpoints[0].Capabilities {
+		if capability.Interface != "Alexa.ModeController" || capability.Configuration == nil {
+			continue
+		}
+		for _, mode := range capability.Configuration.SupportedModes {
+			advertised = advertised || mode.Value == AlexaModeScanner
+		}
+	}
+	if !advertised {
+		t.Errorf("discovery doesn't offer %s", AlexaModeScanner)
+	}
+}
+
+func TestAlexaModesForPatterns(t *testing.T) {
+	if modes := AlexaModesForPatterns(nil); fmt.Sprint(modes) != fmt.Sprint(baseAlexaModes) {
+		t.Errorf("modes without patterns = %v, want the firmware modes %v", modes, baseAlexaModes)
+	}
+
+	// Two scanner effects and a sparkle in one pattern add two modes, once each
+	modes := AlexaModesForPatterns([]Pattern{wledPattern("mixed", WLEDFXSparkle, WLEDFXScanner, WLEDFXScan)})
+	want := append(append([]string{}, baseAlexaModes...), AlexaModeScanner, AlexaModeSparkle)
+	if fmt.Sprint(modes) != fmt.Sprint(want) {
+		t.Errorf("modes = %v, want %v", modes, want)
+	}
+
+	var every []Pattern
+	for id := range effectAlexaModes {
+		every = append(every, wledPattern(fmt.Sprint(id), id))
+	}
+	if modes := AlexaModesForPatterns(every); len(modes) > MaxAlexaModes {
+		t.Errorf("%d modes, want at most %d", len(modes), MaxAlexaModes)
+	}
+}
+
+func TestComputeCompatibleEffectIDs(t *testing.T) {
+	pattern := wledPattern("mixed", WLEDFXSparkle, WLEDFXScanner, WLEDFXSparkle)
+	want := []int{WLEDFXScanner, WLEDFXSparkle}
+	sort.Ints(want)
+	if got := ComputeCompatibleEffectIDs(&pattern); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("effect IDs = %v, want %v", got, want)
+	}
+	if got := ComputeCompatibleEffectIDs(&Pattern{Type: PatternCandle}); len(got) != 1 || got[0] != WLEDFXCandle {
+		t.Errorf("legacy candle effect IDs = %v, want [%d]", got, WLEDFXCandle)
+	}
+}
+
+func containsMode(modes []string, want string) bool {
+	for _, mode := range modes {
+		if mode == want {
+			return true
+		}
+	}
+	return false
+}
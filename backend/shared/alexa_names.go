@@ -0,0 +1,98 @@
+package shared
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// friendlyNameIDSuffixLength is how much of the device ID tells apart strips
+// whose names would otherwise collide
+const friendlyNameIDSuffixLength = 4
+
+// NormalizeFriendlyName trims a name and collapses runs of whitespace
+func NormalizeFriendlyName(name string) string {
+	return strings.Join(strings.Fields(name), " ")
+}
+
+// friendlyNameKey is the form in which two names sound the same to Alexa
+func friendlyNameKey(name string) string {
+	return strings.ToLower(NormalizeFriendlyName(name))
+}
+
+// SameFriendlyName reports whether two device names would collide in Alexa
+func SameFriendlyName(a, b string) bool {
+	return friendlyNameKey(a) == friendlyNameKey(b)
+}
+
+// AlexaStripFriendlyName is the name a strip is discovered under before
+// duplicates are told apart: "{device name} Strip D{pin}". The device's
+// AlexaName stands in for a name Alexa would reject; records saved before
+// AlexaName existed are made safe here.
+func AlexaStripFriendlyName(device Device, pin int) string {
+	name := device.AlexaName
+	if name == "" {
+		name = AlexaSafeName(device.Name)
+	}
+	return fmt.Sprintf("%s Strip D%d", name, pin)
+}
+
+// friendlyNameIDSuffix is the short, stable suffix taken from a device ID
+func friendlyNameIDSuffix(deviceID string) string {
+	if len(deviceID) > friendlyNameIDSuffixLength {
+		deviceID = deviceID[len(deviceID)-friendlyNameIDSuffixLength:]
+	}
+	return strings.ToUpper(deviceID)
+}
+
+// disambiguateFriendlyNames renames endpoints whose friendly names collide;
+// owners[i] is the device endpoints[i] belongs to. The oldest device keeps
+// its name, so existing routines keep working. The others get their room
+// appended, or the end of their device ID when that doesn't make the name
+// unique. Nothing depends on the order devices are listed in, so the names
+// are the same on every discovery until the devices themselves change.
+func disambiguateFriendlyNames(endpoints []AlexaDiscoveryEndpoint, owners []Device) {
+	groups := map[string][]int{}
+	for i, endpoint := range endpoints {
+		key := friendlyNameKey(endpoint.FriendlyName)
+		groups[key] = append(groups[key], i)
+	}
+
+	taken := map[string]bool{}
+	var collisions []string
+	for key, indexes := range groups {
+		taken[key] = true
+		if len(indexes) > 1 {
+			collisions = append(collisions, key)
+		}
+	}
+	sort.Strings(collisions)
+
+	for _, key := range collisions {
+		indexes := groups[key]
+		sort.Slice(indexes, func(a, b int) bool {
+			da, db := owners[indexes[a]], owners[indexes[b]]
+			if !da.CreatedAt.Equal(db.CreatedAt) {
+				return da.CreatedAt.Before(db.CreatedAt)
+			}
+			return endpoints[indexes[a]].EndpointID < endpoints[indexes[b]].EndpointID
+		})
+
+		for _, i := range indexes[1:] {
+			base, owner := endpoints[i].FriendlyName, owners[i]
+			candidates := []string{}
+			if owner.Room != "" {
+				candidates = append(candidates, base+" "+owner.Room)
+			}
+			candidates = append(candidates, base+" "+friendlyNameIDSuffix(owner.DeviceID), base+" "+owner.DeviceID)
+
+			for _, name := range candidates {
+				if !taken[friendlyNameKey(name)] {
+					endpoints[i].FriendlyName = name
+					taken[friendlyNameKey(name)] = true
+					break
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// AllOffWLEDState blanks a strip for the panic all-off. Unlike a powered-off
+// state it is drawn, so the strip goes black straight away rather than
+// holding its last frame. The segment stop is filled in per strip.
+const AllOffWLEDState = `{"on":true,"bri":0,"seg":[{"id":0,"start":0,"fx":0,"col":[[0,0,0]],"on":true}]}`
+
+// AllOffDedupWindow is how long after an all-off repeat calls are skipped
+const AllOffDedupWindow = 15 * time.Second
+
+// AllOffPattern is the pattern sent to every strip by an all-off. Legacy
+// firmware gets a black solid pattern at zero brightness.
+func AllOffPattern() Pattern {
+	return Pattern{
+		Name:          "All Off",
+		Type:          PatternSolid,
+		WLEDState:     AllOffWLEDState,
+		FormatVersion: FormatVersionWLED,
+	}
+}
+
+// ClaimAllOff marks an all-off as started for username, reporting false if
+// one started within AllOffDedupWindow so the caller can skip it
+func ClaimAllOff(ctx context.Context, usersTable, username string, now time.Time) (bool, error) {
+	client, err := InitDynamoDB()
+	if err != nil {
+		return false, err
+	}
+
+	_, err = client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(usersTable),
+		Key: map[string]types.AttributeValue{
+			"username": &types.AttributeValueMemberS{Value: username},
+		},
+		UpdateExpression:    aws.String("SET allOffUntil = :until"),
+		ConditionExpression: aws.String("attribute_exists(username) AND (attribute_not_exists(allOffUntil) OR allOffUntil <= :now)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":until": &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Add(AllOffDedupWindow).Unix(), 10)},
+			":now":   &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Unix(), 10)},
+		},
+	})
+	if err != nil {
+		var conflict *types.ConditionalCheckFailedException
+		if errors.As(err, &conflict) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,304 @@
+package shared
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+var apiKeysTable = os.Getenv("API_KEYS_TABLE")
+
+// APIKeyAuthScheme is the Authorization scheme for API keys: "ApiKey <key>"
+const APIKeyAuthScheme = "ApiKey "
+
+// apiKeyPrefix starts every key so leaked keys are easy to recognize
+const apiKeyPrefix = "clk_"
+
+// API key scopes
+const (
+	APIKeyScopeFull     = "full"      // Everything a session can do except managing API keys
+	APIKeyScopeReadOnly = "read-only" // GET requests only
+	APIKeyScopeDevices  = "devices"   // Device, strip, and group control only
+	APIKeyScopeMetrics  = "metrics"   // Metrics scrapes only; the key's owner must be an admin
+)
+
+// Each key gets its own fixed-window rate limit, separate from sessions.
+// lastUsedAt is written when a window opens, so at most once per window.
+const (
+	APIKeyRateLimit  = 120 // Requests per window
+	apiKeyRateWindow = time.Minute
+)
+
+// apiKeyDevicePaths are the route prefixes the devices scope allows
+var apiKeyDevicePaths = []string{
+	"/api/devices",
+	"/api/rooms",
+	"/api/particle",
+	"/api/virtual-groups",
+	"/api/command",
+	"/api/trials",
+	"/api/ramps",
+	"/api/apply-jobs",
+}
+
+// apiKeyMetricsPath is the only route the metrics scope allows
+const apiKeyMetricsPath = "/api/admin/metrics"
+
+// apiKeyManagementPath can only be used with a session, so a key can't mint
+// or revoke keys
+const apiKeyManagementPath = "/api/settings/api-keys"
+
+var (
+	// ErrAPIKeyScope is returned by ValidateAuth when a key's scope doesn't cover the route
+	ErrAPIKeyScope = errors.New("API key scope does not allow this request")
+	// ErrAPIKeyRateLimited is returned by ValidateAuth when a key exceeds APIKeyRateLimit
+	ErrAPIKeyRateLimited = errors.New("API key rate limit exceeded")
+)
+
+// APIKey is a stored API key. Only the SHA-256 of the key is kept; the key
+// itself is returned once, when created.
+type APIKey struct {
+	KeyHash     string     `json:"-" dynamodbav:"keyHash"`
+	KeyID       string     `json:"keyId" dynamodbav:"keyId"`
+	UserID      string     `json:"-" dynamodbav:"userId"`
+	Label       string     `json:"label" dynamodbav:"label"`
+	Scope       string     `json:"scope" dynamodbav:"scope"`
+	Prefix      string     `json:"prefix" dynamodbav:"prefix"` // First characters of the key, for recognizing it
+	CreatedAt   time.Time  `json:"createdAt" dynamodbav:"createdAt"`
+	LastUsedAt  *time.Time `json:"lastUsedAt,omitempty" dynamodbav:"lastUsedAt,omitempty"`
+	WindowStart int64      `json:"-" dynamodbav:"windowStart"` // Unix start of the current rate window
+	WindowCount int        `json:"-" dynamodbav:"windowCount"`
+}
+
+// ValidAPIKeyScope reports whether scope is one of the API key scopes
+func ValidAPIKeyScope(scope string) bool {
+	switch scope {
+	case APIKeyScopeFull, APIKeyScopeReadOnly, APIKeyScopeDevices, APIKeyScopeMetrics:
+		return true
+	}
+	return false
+}
+
+// APIKeyAllows reports whether a key with scope may call method on path
+func APIKeyAllows(scope, method, path string) bool {
+	if strings.HasPrefix(path, apiKeyManagementPath) {
+		return false
+	}
+
+	switch scope {
+	case APIKeyScopeFull:
+		return true
+	case APIKeyScopeReadOnly:
+		return method == "GET" || method == "HEAD"
+	case APIKeyScopeDevices:
+		for _, prefix := range apiKeyDevicePaths {
+			if path == prefix || strings.HasPrefix(path, prefix+"/") {
+				return true
+			}
+		}
+	case APIKeyScopeMetrics:
+		return method == "GET" && path == apiKeyMetricsPath
+	}
+	return false
+}
+
+// HashAPIKey is the table key for an API key
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateAPIKey generates and stores a key for username, returning the stored
+// record and the key itself, which is not recoverable later
+func CreateAPIKey(ctx context.Context, username, label, scope string) (*APIKey, string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", err
+	}
+	key := apiKeyPrefix + base64.RawURLEncoding.EncodeToString(secret)
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, "", err
+	}
+
+	apiKey := &APIKey{
+		KeyHash:   HashAPIKey(key),
+		KeyID:     hex.EncodeToString(id),
+		UserID:    username,
+		Label:     label,
+		Scope:     scope,
+		Prefix:    key[:len(apiKeyPrefix)+6],
+		CreatedAt: time.Now(),
+	}
+
+	if err := PutItem(ctx, apiKeysTable, apiKey); err != nil {
+		return nil, "", err
+	}
+
+	log.Printf("CreateAPIKey: Created key %s (%s) for user %s", apiKey.KeyID, scope, username)
+	return apiKey, key, nil
+}
+
+// ListAPIKeys returns username's keys
+func ListAPIKeys(ctx context.Context, username string) ([]APIKey, error) {
+	indexName := "userId-index"
+	keyCondition := "userId = :userId"
+	expressionValues := map[string]types.AttributeValue{
+		":userId": &types.AttributeValueMemberS{Value: username},
+	}
+
+	var keys []APIKey
+	if err := Query(ctx, apiKeysTable, &indexName, keyCondition, expressionValues, &keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// DeleteAPIKey revokes one of username's keys. It returns false if no such key exists.
+func DeleteAPIKey(ctx context.Context, username, keyID string) (bool, error) {
+	keys, err := ListAPIKeys(ctx, username)
+	if err != nil {
+		return false, err
+	}
+
+	for _, key := range keys {
+		if key.KeyID != keyID {
+			continue
+		}
+		hashKey, _ := attributevalue.MarshalMap(map[string]string{
+			"keyHash": key.KeyHash,
+		})
+		if err := DeleteItem(ctx, apiKeysTable, hashKey); err != nil {
+			return false, err
+		}
+		log.Printf("DeleteAPIKey: Revoked key %s for user %s", keyID, username)
+		return true, nil
+	}
+	return false, nil
+}
+
+// GetAPIKeyFromRequest returns the key from an "Authorization: ApiKey <key>"
+// header. The scheme is case-insensitive, as HTTP auth schemes are.
+func GetAPIKeyFromRequest(headers map[string]string) string {
+	auth := headers["Authorization"]
+	if auth == "" {
+		auth = headers["authorization"]
+	}
+	if len(auth) >= len(APIKeyAuthScheme) && strings.EqualFold(auth[:len(APIKeyAuthScheme)], APIKeyAuthScheme) {
+		return strings.TrimSpace(auth[len(APIKeyAuthScheme):])
+	}
+	return ""
+}
+
+// LookupAPIKey finds the stored record for key, or nil if it was revoked or never existed
+func LookupAPIKey(ctx context.Context, key string) (*APIKey, error) {
+	hashKey, _ := attributevalue.MarshalMap(map[string]string{
+		"keyHash": HashAPIKey(key),
+	})
+
+	var apiKey APIKey
+	if err := GetItem(ctx, apiKeysTable, hashKey, &apiKey); err != nil {
+		return nil, err
+	}
+	if apiKey.KeyHash == "" {
+		return nil, nil
+	}
+	return &apiKey, nil
+}
+
+// CountAPIKeyRequest counts a request against the key's rate window, opening
+// a new window (and recording lastUsedAt) when the current one has passed.
+// Returns ErrAPIKeyRateLimited when the window is full.
+func CountAPIKeyRequest(ctx context.Context, apiKey *APIKey) error {
+	client, err := InitDynamoDB()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	window := now.Truncate(apiKeyRateWindow).Unix()
+	key := map[string]types.AttributeValue{
+		"keyHash": &types.AttributeValueMemberS{Value: apiKey.KeyHash},
+	}
+	windowValue := &types.AttributeValueMemberN{Value: strconv.FormatInt(window, 10)}
+
+	// Same window: count the request if there's room
+	_, err = client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(apiKeysTable),
+		Key:                 key,
+		UpdateExpression:    aws.String("ADD windowCount :one"),
+		ConditionExpression: aws.String("attribute_exists(keyHash) AND windowStart = :window AND windowCount < :limit"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":one":    &types.AttributeValueMemberN{Value: "1"},
+			":window": windowValue,
+			":limit":  &types.AttributeValueMemberN{Value: strconv.Itoa(APIKeyRateLimit)},
+		},
+	})
+	var conflict *types.ConditionalCheckFailedException
+	if err == nil || !errors.As(err, &conflict) {
+		return err
+	}
+
+	// New window: reset the count
+	lastUsed, _ := attributevalue.Marshal(now)
+	_, err = client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(apiKeysTable),
+		Key:                 key,
+		UpdateExpression:    aws.String("SET windowStart = :window, windowCount = :one, lastUsedAt = :now"),
+		ConditionExpression: aws.String("attribute_exists(keyHash) AND (attribute_not_exists(windowStart) OR windowStart <> :window)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":one":    &types.AttributeValueMemberN{Value: "1"},
+			":window": windowValue,
+			":now":    lastUsed,
+		},
+	})
+	if errors.As(err, &conflict) {
+		return ErrAPIKeyRateLimited
+	}
+	return err
+}
+
+// validateAPIKey resolves an API key to its user, enforcing scope and rate
+// limit. The key itself is never logged.
+func validateAPIKey(ctx context.Context, key, method, path string) (string, error) {
+	apiKey, err := LookupAPIKey(ctx, key)
+	if err != nil {
+		log.Printf("ValidateAuth: API key lookup failed: %v", err)
+		return "", err
+	}
+	if apiKey == nil {
+		log.Println("ValidateAuth: API key not found or revoked")
+		return "", nil
+	}
+
+	if !APIKeyAllows(apiKey.Scope, method, path) {
+		log.Printf("ValidateAuth: API key %s (%s) not allowed for %s %s", apiKey.KeyID, apiKey.Scope, method, path)
+		return "", ErrAPIKeyScope
+	}
+
+	if err := CountAPIKeyRequest(ctx, apiKey); err != nil {
+		if !errors.Is(err, ErrAPIKeyRateLimited) {
+			log.Printf("ValidateAuth: API key rate check failed: %v", err)
+		} else {
+			log.Printf("ValidateAuth: API key %s rate limited", apiKey.KeyID)
+		}
+		return "", err
+	}
+
+	log.Printf("ValidateAuth: API key %s validated for user: %s", apiKey.KeyID, apiKey.UserID)
+	return apiKey.UserID, nil
+}
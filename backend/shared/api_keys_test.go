@@ -0,0 +1,57 @@
+package shared
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestGetAPIKeyFromRequestSchemeIsCaseInsensitive(t *testing.T) {
+	tests := []struct {
+		headers map[string]string
+		want    string
+	}{
+		{map[string]string{"Authorization": "ApiKey clk_abc"}, "clk_abc"},
+		{map[string]string{"Authorization": "apikey clk_abc"}, "clk_abc"},
+		{map[string]string{"authorization": "APIKEY  clk_abc "}, "clk_abc"},
+		{map[string]string{"Authorization": "Bearer session"}, ""},
+		{map[string]string{"Authorization": "ApiKe"}, ""},
+		{nil, ""},
+	}
+	for _, tt := range tests {
+		if got := GetAPIKeyFromRequest(tt.headers); got != tt.want {
+			t.Errorf("GetAPIKeyFromRequest(%v) = %q, want %q", tt.headers, got, tt.want)
+		}
+	}
+}
+
+func TestValidateAuthNeverLogsKeys(t *testing.T) {
+	defer StubDynamoDB(func(call DynamoDBStubCall) (map[string]interface{}, error) {
+		return nil, nil
+	})()
+
+	var logs bytes.Buffer
+	saved := log.Writer()
+	log.SetOutput(&logs)
+	defer log.SetOutput(saved)
+
+	const key = "clk_secretkeyvalue"
+	for _, headers := range []map[string]string{
+		{"Authorization": "apikey " + key},
+		{"Authorization": "ApiKey " + key},
+		{"X-Api-Key": key},
+		{"Cookie": "other=" + key},
+	} {
+		username, err := ValidateAuth(context.Background(), events.APIGatewayProxyRequest{HTTPMethod: "GET", Path: "/api/devices", Headers: headers})
+		if username != "" || err != nil {
+			t.Errorf("ValidateAuth(%v) = %q, %v; want refused", headers, username, err)
+		}
+	}
+	if strings.Contains(logs.String(), key) {
+		t.Errorf("key appears in the logs:\n%s", logs.String())
+	}
+}
@@ -0,0 +1,145 @@
+package shared
+
+// Request bodies of routes whose handlers decode into local types. They
+// mirror the handlers' structs for the spec only.
+type (
+	createDeviceBody struct {
+		Name         string `json:"name" openapi:"required,maxLength=80"`
+		ParticleID   string `json:"particleId" openapi:"required"`
+		Manufacturer string `json:"manufacturer,omitempty"`
+		FirmwareType string `json:"firmwareType,omitempty"`
+	}
+	patternIDBody struct {
+		PatternID string `json:"patternId" openapi:"required"`
+	}
+	groupApplyBody struct {
+		PatternID string     `json:"patternId" openapi:"required"`
+		Variation string     `json:"variation,omitempty" openapi:"enum=alternateColors|offsetPhase"`
+		ColorSets [][]string `json:"colorSets,omitempty"`
+	}
+	pinMappingBody struct {
+		CustomPinMapping map[string]int `json:"customPinMapping" openapi:"required"`
+	}
+	assignRoomBody struct {
+		DeviceIDs []string `json:"deviceIds" openapi:"required"`
+	}
+	particleCommandBody struct {
+		DeviceID  string `json:"deviceId" openapi:"required"`
+		PatternID string `json:"patternId,omitempty"`
+		Command   string `json:"command,omitempty"`
+		Argument  string `json:"argument,omitempty"`
+		Pin       *int   `json:"pin,omitempty"`
+		StartLED  *int   `json:"startLed,omitempty" openapi:"minimum=0"`
+		EndLED    *int   `json:"endLed,omitempty" openapi:"minimum=1"`
+	}
+	particleTokenBody struct {
+		ParticleToken string `json:"particleToken" openapi:"required"`
+	}
+	provisionBody struct {
+		Name *string `json:"name,omitempty" openapi:"maxLength=80"`
+		Room *string `json:"room,omitempty"`
+	}
+	provisionAllBody struct {
+		Room   *string `json:"room,omitempty"`
+		DryRun bool    `json:"dryRun,omitempty"`
+	}
+	virtualGroupBody struct {
+		Name              string               `json:"name" openapi:"required,maxLength=80"`
+		Members           []VirtualGroupMember `json:"members" openapi:"required"`
+		BrightnessPercent *int                 `json:"brightnessPercent,omitempty" openapi:"minimum=1,maximum=100"`
+		ColorOverride     *string              `json:"colorOverride,omitempty"`
+		Icon              *string              `json:"icon,omitempty"` // One of DisplayIcons
+		AccentColor       *string              `json:"accentColor,omitempty"`
+	}
+	retryApplyBody struct {
+		RetryTokens []string `json:"retryTokens" openapi:"required,minItems=1"`
+	}
+	textCommandBody struct {
+		Text string `json:"text" openapi:"required"`
+	}
+	trialBody struct {
+		PatternID       string `json:"patternId,omitempty"`
+		WLEDState       string `json:"wledState,omitempty"`
+		DurationSeconds int    `json:"durationSeconds,omitempty"`
+		StartLED        *int   `json:"startLed,omitempty" openapi:"minimum=0"`
+		EndLED          *int   `json:"endLed,omitempty" openapi:"minimum=1"`
+	}
+	rampBody struct {
+		TargetBrightnessPercent *int `json:"targetBrightnessPercent" openapi:"required,minimum=0,maximum=100"`
+		FromBrightnessPercent   *int `json:"fromBrightnessPercent,omitempty" openapi:"minimum=0,maximum=100"`
+		DurationSeconds         int  `json:"durationSeconds" openapi:"required,minimum=1"`
+	}
+)
+
+// APIRoutes documents the routes of the services that route with a switch
+// rather than a Router: patterns, devices, particle, and virtual groups.
+// Add an entry here with every new route, as template.yaml gets one.
+var APIRoutes = []RouteDoc{
+	// Patterns
+	{Method: "GET", Path: "/api/effects", Policy: PolicyAuthenticated, Service: "patterns", Summary: "List the supported WLED effects", Response: []EffectMetadata(nil)},
+	{Method: "GET", Path: "/api/patterns", Policy: PolicyAuthenticated, Service: "patterns", Summary: "List the caller's patterns", Response: []Pattern(nil)},
+	{Method: "POST", Path: "/api/patterns", Policy: PolicyAuthenticated, Service: "patterns", Summary: "Create a pattern", Request: Pattern{}, Response: Pattern{}},
+	{Method: "GET", Path: "/api/patterns/stats", Policy: PolicyAuthenticated, Service: "patterns", Summary: "Pattern usage statistics", Response: PatternStats{}},
+	{Method: "GET", Path: "/api/patterns/favorites", Policy: PolicyAuthenticated, Service: "patterns", Summary: "List favorite patterns", Response: []PatternSummary(nil)},
+	{Method: "POST", Path: "/api/patterns/install-starters", Policy: PolicyAuthenticated, Service: "patterns", Summary: "Install the starter patterns"},
+	{Method: "POST", Path: "/api/patterns/{patternId}/favorite", Policy: PolicyAuthenticated, Service: "patterns", Summary: "Mark a pattern as a favorite", Response: Pattern{}},
+	{Method: "POST", Path: "/api/patterns/{patternId}/unfavorite", Policy: PolicyAuthenticated, Service: "patterns", Summary: "Unmark a favorite pattern", Response: Pattern{}},
+	{Method: "GET", Path: "/api/patterns/{patternId}/decode", Policy: PolicyAuthenticated, Service: "patterns", Summary: "Decode a pattern's bytecode", Response: LCLBytecodeInfo{}},
+	{Method: "POST", Path: "/api/patterns/{patternId}/upgrade-bytecode", Policy: PolicyAuthenticated, Service: "patterns", Summary: "Recompile a pattern to the current bytecode format"},
+	{Method: "GET", Path: "/api/patterns/{patternId}", Policy: PolicyAuthenticated, Service: "patterns", Summary: "Get a pattern", Response: Pattern{}},
+	{Method: "GET", Path: "/api/patterns/{patternId}/preview", Policy: PolicyAuthenticated, Service: "patterns", Summary: "Render a pattern preview"},
+	{Method: "PUT", Path: "/api/patterns/{patternId}", Policy: PolicyAuthenticated, Service: "patterns", Summary: "Update a pattern", Request: Pattern{}, Response: Pattern{}},
+	{Method: "DELETE", Path: "/api/patterns/{patternId}", Policy: PolicyAuthenticated, Service: "patterns", Summary: "Delete a pattern"},
+
+	// Devices
+	{Method: "GET", Path: "/api/devices", Policy: PolicyAuthenticated, Service: "devices", Summary: "List the caller's devices", Response: []Device(nil)},
+	{Method: "POST", Path: "/api/devices", Policy: PolicyAuthenticated, Service: "devices", Summary: "Register a device", Request: createDeviceBody{}, Response: Device{}},
+	{Method: "GET", Path: "/api/devices/alexa-debug", Policy: PolicyAuthenticated, Service: "devices", Summary: "Show what Alexa discovery sees"},
+	{Method: "GET", Path: "/api/devices/{deviceId}", Policy: PolicyAuthenticated, Service: "devices", Summary: "Get a device", Response: Device{}},
+	{Method: "PUT", Path: "/api/devices/{deviceId}", Policy: PolicyAuthenticated, Service: "devices", Summary: "Update a device", Request: Device{}, Response: Device{}},
+	{Method: "DELETE", Path: "/api/devices/{deviceId}", Policy: PolicyAuthenticated, Service: "devices", Summary: "Delete a device"},
+	{Method: "PUT", Path: "/api/devices/{deviceId}/pattern", Policy: PolicyAuthenticated, Service: "devices", Summary: "Assign a pattern to a device", Request: patternIDBody{}, Response: Device{}},
+	{Method: "PUT", Path: "/api/devices/{deviceId}/pin-mapping", Policy: PolicyAuthenticated, Service: "devices", Summary: "Set a device's logical to physical pin mapping", Request: pinMappingBody{}, Response: Device{}},
+	{Method: "GET", Path: "/api/devices/{deviceId}/errors", Policy: PolicyAuthenticated, Service: "devices", Summary: "List a device's recent errors"},
+	{Method: "GET", Path: "/api/rooms", Policy: PolicyAuthenticated, Service: "devices", Summary: "List rooms with device counts", Response: []RoomSummary(nil)},
+	{Method: "POST", Path: "/api/rooms/{room}/devices", Policy: PolicyAuthenticated, Service: "devices", Summary: "Move devices into a room", Request: assignRoomBody{}, Response: []Device(nil)},
+	{Method: "DELETE", Path: "/api/rooms/{room}", Policy: PolicyAuthenticated, Service: "devices", Summary: "Remove a room from its devices"},
+
+	// Particle
+	{Method: "POST", Path: "/api/particle/command", Policy: PolicyAuthenticated, Service: "particle", Summary: "Send a pattern or command to a device", Request: particleCommandBody{}},
+	{Method: "POST", Path: "/api/particle/all-off", Policy: PolicyAuthenticated, Service: "particle", Summary: "Turn off every strip"},
+	{Method: "GET", Path: "/api/particle/device/{deviceId}", Policy: PolicyAuthenticated, Service: "particle", Summary: "Get a device's Particle cloud info"},
+	{Method: "GET", Path: "/api/particle/devices/{deviceId}/variables", Policy: PolicyAuthenticated, Service: "particle", Summary: "Read a device's firmware variables"},
+	{Method: "POST", Path: "/api/particle/devices/{deviceId}/provision", Policy: PolicyAuthenticated, Service: "particle", Summary: "Provision a Particle device", Request: provisionBody{}},
+	{Method: "POST", Path: "/api/particle/devices/provision-all", Policy: PolicyAuthenticated, Service: "particle", Summary: "Provision every new device in the Particle account; see dryRun", Request: provisionAllBody{}},
+	{Method: "GET", Path: "/api/particle/devices/variables", Policy: PolicyAuthenticated, Service: "particle", Summary: "Read firmware variables from every device"},
+	{Method: "POST", Path: "/api/particle/devices/refresh", Policy: PolicyAuthenticated, Service: "particle", Summary: "Refresh devices from Particle; see limit, continuation, and async"},
+	{Method: "POST", Path: "/api/particle/validate-token", Policy: PolicyAuthenticated, Service: "particle", Summary: "Check and save a Particle token", Request: particleTokenBody{}},
+	{Method: "POST", Path: "/api/particle/oauth/initiate", Policy: PolicyAuthenticated, Service: "particle", Summary: "Start Particle OAuth"},
+	{Method: "POST", Path: "/api/particle/events", Policy: PolicyAuthenticated, Service: "particle", Summary: "Record a device event", Request: ParticleWebhookEvent{}},
+
+	// Virtual groups
+	{Method: "GET", Path: "/api/virtual-groups", Policy: PolicyAuthenticated, Service: "virtual-groups", Summary: "List virtual groups", Response: []VirtualGroup(nil)},
+	{Method: "POST", Path: "/api/virtual-groups", Policy: PolicyAuthenticated, Service: "virtual-groups", Summary: "Create a virtual group", Request: virtualGroupBody{}, Response: VirtualGroup{}},
+	{Method: "GET", Path: "/api/virtual-groups/{groupId}", Policy: PolicyAuthenticated, Service: "virtual-groups", Summary: "Get a virtual group", Response: VirtualGroup{}},
+	{Method: "PUT", Path: "/api/virtual-groups/{groupId}", Policy: PolicyAuthenticated, Service: "virtual-groups", Summary: "Update a virtual group", Request: virtualGroupBody{}, Response: VirtualGroup{}},
+	{Method: "DELETE", Path: "/api/virtual-groups/{groupId}", Policy: PolicyAuthenticated, Service: "virtual-groups", Summary: "Delete a virtual group"},
+	{Method: "POST", Path: "/api/virtual-groups/{groupId}/apply", Policy: PolicyAuthenticated, Service: "virtual-groups", Summary: "Apply a pattern to every member; see variation", Request: groupApplyBody{}},
+	{Method: "POST", Path: "/api/virtual-groups/retry", Policy: PolicyAuthenticated, Service: "virtual-groups", Summary: "Retry members that failed a group apply", Request: retryApplyBody{}},
+	{Method: "POST", Path: "/api/command/text", Policy: PolicyAuthenticated, Service: "virtual-groups", Summary: "Run a plain-text lighting command", Request: textCommandBody{}},
+	{Method: "POST", Path: "/api/devices/{deviceId}/strips/{pin}/try", Policy: PolicyAuthenticated, Service: "virtual-groups", Summary: "Try a pattern on a strip for a while", Request: trialBody{}},
+	{Method: "POST", Path: "/api/trials/{trialId}/keep", Policy: PolicyAuthenticated, Service: "virtual-groups", Summary: "Keep a trial pattern"},
+	{Method: "POST", Path: "/api/trials/{trialId}/cancel", Policy: PolicyAuthenticated, Service: "virtual-groups", Summary: "Cancel a trial and revert the strip"},
+	{Method: "POST", Path: "/api/devices/{deviceId}/strips/{pin}/ramp", Policy: PolicyAuthenticated, Service: "virtual-groups", Summary: "Ramp a strip's brightness", Request: rampBody{}},
+	{Method: "GET", Path: "/api/devices/{deviceId}/strips/{pin}/ramp", Policy: PolicyAuthenticated, Service: "virtual-groups", Summary: "Get a strip's running ramp"},
+	{Method: "POST", Path: "/api/virtual-groups/{groupId}/ramp", Policy: PolicyAuthenticated, Service: "virtual-groups", Summary: "Ramp a group's brightness", Request: rampBody{}},
+	{Method: "GET", Path: "/api/ramps/{rampId}", Policy: PolicyAuthenticated, Service: "virtual-groups", Summary: "Get a ramp"},
+	{Method: "POST", Path: "/api/ramps/{rampId}/cancel", Policy: PolicyAuthenticated, Service: "virtual-groups", Summary: "Cancel a ramp"},
+	{Method: "GET", Path: "/api/apply-jobs/{jobId}", Policy: PolicyAuthenticated, Service: "virtual-groups", Summary: "Get the progress of a queued apply or device refresh", Response: ApplyJob{}},
+	{Method: "GET", Path: "/api/automations/lux", Policy: PolicyAuthenticated, Service: "virtual-groups", Summary: "List lux automations", Response: []LuxAutomation(nil)},
+	{Method: "POST", Path: "/api/automations/lux", Policy: PolicyAuthenticated, Service: "virtual-groups", Summary: "Create a lux automation", Request: LuxAutomationRequest{}, Response: LuxAutomation{}},
+	{Method: "GET", Path: "/api/automations/lux/{automationId}", Policy: PolicyAuthenticated, Service: "virtual-groups", Summary: "Get a lux automation", Response: LuxAutomation{}},
+	{Method: "GET", Path: "/api/automations/lux/{automationId}/runs", Policy: PolicyAuthenticated, Service: "virtual-groups", Summary: "List a lux automation's recent scheduler runs; see limit", Response: []LuxAutomationRun(nil)},
+	{Method: "PUT", Path: "/api/automations/lux/{automationId}", Policy: PolicyAuthenticated, Service: "virtual-groups", Summary: "Replace a lux automation's settings", Request: LuxAutomationRequest{}, Response: LuxAutomation{}},
+	{Method: "DELETE", Path: "/api/automations/lux/{automationId}", Policy: PolicyAuthenticated, Service: "virtual-groups", Summary: "Delete a lux automation"},
+}
@@ -0,0 +1,188 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+var applyJobsTable = os.Getenv("APPLY_JOBS_TABLE")
+
+// Apply job and target statuses
+const (
+	ApplyJobRunning   = "running"   // Targets still queued
+	ApplyJobCompleted = "completed" // Every target reached a final status
+
+	ApplyTargetPending   = "pending"
+	ApplyTargetSucceeded = "succeeded"
+	ApplyTargetFailed    = "failed"
+)
+
+// ApplyJobKindDeviceRefresh marks a queued device list refresh. Its targets
+// are keyed by Particle ID with pin 0, and DeviceID holds the Particle ID.
+// Pattern applies leave Kind empty.
+const ApplyJobKindDeviceRefresh = "device-refresh"
+
+// applyJobRetention is how long apply jobs are kept before TTL deletes them
+const applyJobRetention = 24 * time.Hour
+
+// ApplyJobTarget is the progress of one strip in an apply job
+type ApplyJobTarget struct {
+	DeviceID     string   `json:"deviceId" dynamodbav:"deviceId"`
+	DeviceName   string   `json:"deviceName,omitempty" dynamodbav:"deviceName,omitempty"`
+	Pin          int      `json:"pin" dynamodbav:"pin"`
+	Status       string   `json:"status" dynamodbav:"status"`
+	Failures     int      `json:"failures" dynamodbav:"failures"`               // Failed send attempts, including retries
+	Error        string   `json:"error,omitempty" dynamodbav:"error,omitempty"` // Last error, kept while retrying
+	Warnings     []string `json:"warnings,omitempty" dynamodbav:"warnings,omitempty"`
+	Variation    string   `json:"variation,omitempty" dynamodbav:"variation,omitempty"`       // The group apply variation the strip was sent, if any
+	BinarySource string   `json:"binarySource,omitempty" dynamodbav:"binarySource,omitempty"` // Where the bytecode queued for the strip came from (BinarySource*)
+}
+
+// ApplyJob tracks a pattern applied to many strips by the queue worker
+type ApplyJob struct {
+	JobID     string                    `json:"jobId" dynamodbav:"jobId"`
+	UserID    string                    `json:"userId" dynamodbav:"userId"`
+	GroupID   string                    `json:"groupId,omitempty" dynamodbav:"groupId,omitempty"`
+	PatternID string                    `json:"patternId" dynamodbav:"patternId"`
+	Kind      string                    `json:"kind,omitempty" dynamodbav:"kind,omitempty"`
+	Status    string                    `json:"status" dynamodbav:"status"`
+	Total     int                       `json:"total" dynamodbav:"total"`
+	Succeeded int                       `json:"succeeded" dynamodbav:"succeeded"`
+	Failed    int                       `json:"failed" dynamodbav:"failed"`
+	Targets   map[string]ApplyJobTarget `json:"targets" dynamodbav:"targets"` // Keyed by ApplyTargetKey
+	CreatedAt time.Time                 `json:"createdAt" dynamodbav:"createdAt"`
+	UpdatedAt time.Time                 `json:"updatedAt" dynamodbav:"updatedAt"`
+	ExpiresAt int64                     `json:"expiresAt,omitempty" dynamodbav:"expiresAt,omitempty"` // TTL
+}
+
+// ApplyTargetKey is the key of a strip in ApplyJob.Targets
+func ApplyTargetKey(deviceID string, pin int) string {
+	return fmt.Sprintf("%s#%d", deviceID, pin)
+}
+
+// ApplyJobExpiresAt is the TTL for a job created at createdAt
+func ApplyJobExpiresAt(createdAt time.Time) int64 {
+	return createdAt.Add(applyJobRetention).Unix()
+}
+
+// ErrApplyTargetDone means a target already reached a final status, e.g. a
+// duplicate SQS delivery
+var ErrApplyTargetDone = errors.New("apply target already finished")
+
+// RecordApplyFailure counts a failed attempt on a pending target and keeps its
+// error so the dead-letter handler can report it
+func RecordApplyFailure(ctx context.Context, jobID, targetKey, errMsg string) error {
+	return updateApplyTarget(ctx, jobID, targetKey,
+		"SET targets.#target.failures = targets.#target.failures + :one, targets.#target.#error = :error, updatedAt = :now",
+		map[string]types.AttributeValue{
+			":one":   &types.AttributeValueMemberN{Value: "1"},
+			":error": &types.AttributeValueMemberS{Value: errMsg},
+		})
+}
+
+// FinishApplyTarget moves a pending target to succeeded or failed and updates
+// the job's counters. The job completes when its last target finishes.
+func FinishApplyTarget(ctx context.Context, jobID, targetKey, status, errMsg string, warnings []string) (*ApplyJob, error) {
+	counter := "succeeded"
+	if status == ApplyTargetFailed {
+		counter = "failed"
+	}
+
+	values := map[string]types.AttributeValue{
+		":status": &types.AttributeValueMemberS{Value: status},
+		":error":  &types.AttributeValueMemberS{Value: errMsg},
+		":one":    &types.AttributeValueMemberN{Value: "1"},
+	}
+	update := "SET targets.#target.#status = :status, targets.#target.#error = :error, updatedAt = :now ADD " + counter + " :one"
+	if len(warnings) > 0 {
+		warningsValue, err := attributevalue.Marshal(warnings)
+		if err != nil {
+			return nil, err
+		}
+		values[":warnings"] = warningsValue
+		update = "SET targets.#target.#status = :status, targets.#target.#error = :error, targets.#target.warnings = :warnings, updatedAt = :now ADD " + counter + " :one"
+	}
+
+	if err := updateApplyTarget(ctx, jobID, targetKey, update, values); err != nil {
+		return nil, err
+	}
+
+	client, err := InitDynamoDB()
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the update that finishes the last target completes the job
+	output, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(applyJobsTable),
+		Key: map[string]types.AttributeValue{
+			"jobId": &types.AttributeValueMemberS{Value: jobID},
+		},
+		UpdateExpression:    aws.String("SET #status = :completed"),
+		ConditionExpression: aws.String("#status = :running AND succeeded + failed >= #total"),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "status",
+			"#total":  "total",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":completed": &types.AttributeValueMemberS{Value: ApplyJobCompleted},
+			":running":   &types.AttributeValueMemberS{Value: ApplyJobRunning},
+		},
+		ReturnValues: types.ReturnValueAllNew,
+	})
+	if err != nil {
+		var conflict *types.ConditionalCheckFailedException
+		if errors.As(err, &conflict) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var job ApplyJob
+	if err := attributevalue.UnmarshalMap(output.Attributes, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// updateApplyTarget applies update to a target that is still pending
+func updateApplyTarget(ctx context.Context, jobID, targetKey, update string, values map[string]types.AttributeValue) error {
+	client, err := InitDynamoDB()
+	if err != nil {
+		return err
+	}
+
+	values[":pending"] = &types.AttributeValueMemberS{Value: ApplyTargetPending}
+	values[":now"] = &types.AttributeValueMemberS{Value: time.Now().Format(time.RFC3339Nano)}
+
+	_, err = client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(applyJobsTable),
+		Key: map[string]types.AttributeValue{
+			"jobId": &types.AttributeValueMemberS{Value: jobID},
+		},
+		UpdateExpression:    aws.String(update),
+		ConditionExpression: aws.String("targets.#target.#status = :pending"),
+		ExpressionAttributeNames: map[string]string{
+			"#target": targetKey,
+			"#status": "status",
+			"#error":  "error",
+		},
+		ExpressionAttributeValues: values,
+	})
+	if err != nil {
+		var conflict *types.ConditionalCheckFailedException
+		if errors.As(err, &conflict) {
+			return ErrApplyTargetDone
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package shared
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"time"
+)
+
+// applyRetrySecret signs retry tokens. Without it group applies don't hand
+// out retry tokens.
+var applyRetrySecret = os.Getenv("APPLY_RETRY_SECRET")
+
+// ApplyRetryTokenTTL is how long a failed member's retry token is accepted
+const ApplyRetryTokenTTL = 15 * time.Minute
+
+var (
+	// ErrApplyRetryNotConfigured is returned when APPLY_RETRY_SECRET is missing
+	ErrApplyRetryNotConfigured = errors.New("apply retries are not configured")
+	// ErrInvalidRetryToken covers malformed, tampered, and other users' tokens
+	ErrInvalidRetryToken = errors.New("invalid retry token")
+	// ErrRetryTokenExpired is returned for tokens past ApplyRetryTokenTTL
+	ErrRetryTokenExpired = errors.New("retry token has expired")
+)
+
+// ApplyRetryTarget is what a retry token carries: one group member a pattern
+// failed to apply to, for one user
+type ApplyRetryTarget struct {
+	UserID    string   `json:"u"`
+	GroupID   string   `json:"g"`
+	PatternID string   `json:"p"`
+	DeviceID  string   `json:"d"`
+	Pin       int      `json:"n"`
+	Colors    []string `json:"c,omitempty"` // The member's colors from an alternateColors variation
+	ExpiresAt int64    `json:"e"`           // Unix seconds
+}
+
+// ApplyRetryEnabled reports whether retry tokens can be issued
+func ApplyRetryEnabled() bool {
+	return applyRetrySecret != ""
+}
+
+// IssueApplyRetryToken signs t as "<payload>.<signature>", both base64url.
+// ExpiresAt is set from now when zero.
+func IssueApplyRetryToken(t ApplyRetryTarget, now time.Time) (string, error) {
+	if !ApplyRetryEnabled() {
+		return "", ErrApplyRetryNotConfigured
+	}
+	if t.ExpiresAt == 0 {
+		t.ExpiresAt = now.Add(ApplyRetryTokenTTL).Unix()
+	}
+
+	payload, err := json.Marshal(t)
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(signApplyRetry(encoded)), nil
+}
+
+// ParseApplyRetryToken verifies token and returns its target. Tokens issued
+// to anyone but username are rejected as invalid.
+func ParseApplyRetryToken(token, username string, now time.Time) (ApplyRetryTarget, error) {
+	var t ApplyRetryTarget
+	if !ApplyRetryEnabled() {
+		return t, ErrApplyRetryNotConfigured
+	}
+
+	encoded, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return t, ErrInvalidRetryToken
+	}
+	got, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(got, signApplyRetry(encoded)) {
+		return t, ErrInvalidRetryToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || json.Unmarshal(payload, &t) != nil {
+		return ApplyRetryTarget{}, ErrInvalidRetryToken
+	}
+	if t.UserID != username {
+		return ApplyRetryTarget{}, ErrInvalidRetryToken
+	}
+	if now.Unix() > t.ExpiresAt {
+		return ApplyRetryTarget{}, ErrRetryTokenExpired
+	}
+	return t, nil
+}
+
+func signApplyRetry(encoded string) []byte {
+	mac := hmac.New(sha256.New, []byte(applyRetrySecret))
+	mac.Write([]byte(encoded))
+	return mac.Sum(nil)
+}
@@ -1,13 +1,43 @@
 package shared
 
 import (
+    "context"
     "log"
+    "os"
+    "strconv"
 
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/service/dynamodb"
+    "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
     "golang.org/x/crypto/bcrypt"
 )
 
-// PasswordCost is the bcrypt cost parameter for new passwords
-const PasswordCost = 10
+// Allowed bcrypt costs. Each step doubles hashing time; 12 keeps a login
+// well under a second on a Lambda.
+const (
+    MinPasswordCost     = 10
+    MaxPasswordCost     = 14
+    DefaultPasswordCost = 12
+)
+
+// PasswordCost is the bcrypt cost parameter for new passwords, from
+// BCRYPT_COST. Stored hashes with another cost are re-hashed on login.
+var PasswordCost = passwordCostFromEnv()
+
+// passwordCostFromEnv reads BCRYPT_COST, falling back to DefaultPasswordCost
+// when it's unset or outside MinPasswordCost-MaxPasswordCost
+func passwordCostFromEnv() int {
+    raw := os.Getenv("BCRYPT_COST")
+    if raw == "" {
+        return DefaultPasswordCost
+    }
+    cost, err := strconv.Atoi(raw)
+    if err != nil || cost < MinPasswordCost || cost > MaxPasswordCost {
+        log.Printf("[AUTH] Ignoring BCRYPT_COST=%q: must be %d-%d; using %d", raw, MinPasswordCost, MaxPasswordCost, DefaultPasswordCost)
+        return DefaultPasswordCost
+    }
+    return cost
+}
 
 // HashPassword hashes a password using bcrypt
 func HashPassword(password string) (string, error) {
@@ -41,3 +71,46 @@ func CheckPasswordHash(password, hash string) bool {
     log.Println("[AUTH] Password validated successfully")
     return true
 }
+
+// RehashPasswordIfNeeded re-hashes password at PasswordCost when user's stored
+// hash has a different cost, after the password has been checked. Only the
+// hash is written, and only if it hasn't changed since user was read, so a
+// concurrent password change wins. Failures are logged, not returned: the
+// old hash still works.
+func RehashPasswordIfNeeded(ctx context.Context, usersTable string, user *User, password string) {
+    if !NeedsRehash(user.PasswordHash) {
+        return
+    }
+
+    newHash, err := HashPassword(password)
+    if err != nil {
+        log.Printf("[AUTH] Failed to re-hash password for %s: %v", user.Username, err)
+        return
+    }
+
+    client, err := InitDynamoDB()
+    if err != nil {
+        log.Printf("[AUTH] Failed to re-hash password for %s: %v", user.Username, err)
+        return
+    }
+
+    _, err = client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+        TableName: aws.String(usersTable),
+        Key: map[string]types.AttributeValue{
+            "username": &types.AttributeValueMemberS{Value: user.Username},
+        },
+        UpdateExpression:    aws.String("SET passwordHash = :new"),
+        ConditionExpression: aws.String("passwordHash = :old"),
+        ExpressionAttributeValues: map[string]types.AttributeValue{
+            ":new": &types.AttributeValueMemberS{Value: newHash},
+            ":old": &types.AttributeValueMemberS{Value: user.PasswordHash},
+        },
+    })
+    if err != nil {
+        log.Printf("[AUTH] Failed to save re-hashed password for %s: %v", user.Username, err)
+        return
+    }
+
+    user.PasswordHash = newHash
+    log.Printf("[AUTH] Re-hashed password for %s at cost %d", user.Username, PasswordCost)
+}
@@ -0,0 +1,107 @@
+package shared
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestPasswordCostFromEnv(t *testing.T) {
+	saved, had := os.LookupEnv("BCRYPT_COST")
+	defer func() {
+		if had {
+			os.Setenv("BCRYPT_COST", saved)
+		} else {
+			os.Unsetenv("BCRYPT_COST")
+		}
+	}()
+
+	tests := []struct {
+		env  string
+		want int
+	}{
+		{"", DefaultPasswordCost},
+		{"10", 10},
+		{"14", 14},
+		{"9", DefaultPasswordCost},
+		{"15", DefaultPasswordCost},
+		{"fast", DefaultPasswordCost},
+	}
+	for _, tt := range tests {
+		os.Setenv("BCRYPT_COST", tt.env)
+		if got := passwordCostFromEnv(); got != tt.want {
+			t.Errorf("BCRYPT_COST=%q: cost %d, want %d", tt.env, got, tt.want)
+		}
+	}
+}
+
+func TestRehashPasswordOnCostChange(t *testing.T) {
+	saved := PasswordCost
+	defer func() { PasswordCost = saved }()
+	PasswordCost = MinPasswordCost
+
+	oldHash, _ := bcrypt.GenerateFromPassword([]byte("hunter22"), MinPasswordCost+1)
+	stored := string(oldHash)
+	updates := 0
+	defer StubDynamoDB(func(call DynamoDBStubCall) (map[string]interface{}, error) {
+		if call.Operation != "UpdateItem" {
+			return nil, fmt.Errorf("unexpected %s", call.Operation)
+		}
+		var values struct {
+			New string `dynamodbav:":new"`
+			Old string `dynamodbav:":old"`
+		}
+		if err := call.Unmarshal("ExpressionAttributeValues", &values); err != nil {
+			return nil, err
+		}
+		updates++
+		if values.Old != stored {
+			return nil, ErrDynamoDBStubConditionFailed
+		}
+		stored = values.New
+		return nil, nil
+	})()
+
+	user := &User{Username: "lee", PasswordHash: string(oldHash)}
+	RehashPasswordIfNeeded(context.Background(), "users", user, "hunter22")
+	if cost, _ := bcrypt.Cost([]byte(stored)); updates != 1 || cost != MinPasswordCost || user.PasswordHash != stored {
+		t.Fatalf("after login: %d updates, stored cost %d; want one update to cost %d", updates, cost, MinPasswordCost)
+	}
+	if !CheckPasswordHash("hunter22", stored) {
+		t.Errorf("re-hashed password doesn't check")
+	}
+
+	// At the configured cost there's nothing to do
+	RehashPasswordIfNeeded(context.Background(), "users", user, "hunter22")
+	if updates != 1 {
+		t.Errorf("%d updates, want no re-hash at the configured cost", updates)
+	}
+
+	// A password changed meanwhile isn't overwritten
+	stale := &User{Username: "lee", PasswordHash: string(oldHash)}
+	current := stored
+	RehashPasswordIfNeeded(context.Background(), "users", stale, "hunter22")
+	if stored != current || stale.PasswordHash != string(oldHash) {
+		t.Errorf("re-hash overwrote a concurrent password change")
+	}
+}
+
+// BenchmarkLoginHash documents what one login-path password check costs at
+// each supported bcrypt cost. Run with -bench LoginHash.
+func BenchmarkLoginHash(b *testing.B) {
+	for cost := MinPasswordCost; cost <= MaxPasswordCost; cost++ {
+		b.Run(fmt.Sprintf("cost=%d", cost), func(b *testing.B) {
+			hash, err := bcrypt.GenerateFromPassword([]byte("hunter22"), cost)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				bcrypt.CompareHashAndPassword(hash, []byte("hunter22"))
+			}
+		})
+	}
+}
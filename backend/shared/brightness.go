@@ -0,0 +1,69 @@
+package shared
+
+import "math"
+
+// Brightness comes in two units. Patterns, WLED's "bri", and the firmware's
+// setBright take a byte (0-255); Alexa, group overrides, ramps, and the text
+// commands use a percent (0-100). Struct fields stay plain ints so their JSON
+// doesn't change, and say in their docs which unit they hold; convert between
+// the two only with the types below, never with inline *255/100 math.
+
+// BrightnessByte is brightness as the firmware and WLED take it, 0-255
+type BrightnessByte int
+
+// BrightnessPercent is brightness as Alexa and the UI show it, 0-100
+type BrightnessPercent int
+
+// Percent converts to a percent, rounding to the nearest
+func (b BrightnessByte) Percent() BrightnessPercent {
+	if b <= 0 {
+		return 0
+	}
+	if b >= 255 {
+		return 100
+	}
+	return BrightnessPercent(math.Round(float64(b) * 100 / 255))
+}
+
+// Fraction is the brightness as a 0-1 scale factor
+func (b BrightnessByte) Fraction() float64 {
+	return float64(b.Clamp()) / 255
+}
+
+// Clamp limits the brightness to 0-255
+func (b BrightnessByte) Clamp() BrightnessByte {
+	return BrightnessByte(clampByte(int(b)))
+}
+
+// Byte converts to a byte, rounding to the nearest
+func (p BrightnessPercent) Byte() BrightnessByte {
+	if p <= 0 {
+		return 0
+	}
+	if p >= 100 {
+		return 255
+	}
+	return BrightnessByte(math.Round(float64(p) * 255 / 100))
+}
+
+// Fraction is the brightness as Alexa's ColorController carries it, 0-1
+func (p BrightnessPercent) Fraction() float64 {
+	return float64(p.Clamp()) / 100
+}
+
+// Clamp limits the brightness to 0-100
+func (p BrightnessPercent) Clamp() BrightnessPercent {
+	if p < 0 {
+		return 0
+	}
+	if p > 100 {
+		return 100
+	}
+	return p
+}
+
+// BrightnessPercentFromFraction converts a 0-1 brightness, such as Alexa's
+// HSB brightness, to a percent, rounding to the nearest
+func BrightnessPercentFromFraction(fraction float64) BrightnessPercent {
+	return BrightnessPercent(math.Round(fraction * 100)).Clamp()
+}
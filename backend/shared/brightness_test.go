@@ -0,0 +1,94 @@
+package shared
+
+import "testing"
+
+func TestBrightnessByteToPercent(t *testing.T) {
+	tests := []struct {
+		in   BrightnessByte
+		want BrightnessPercent
+	}{
+		{-5, 0},
+		{0, 0},
+		{1, 0},
+		{3, 1},
+		{128, 50},
+		{254, 100},
+		{255, 100},
+		{300, 100},
+	}
+
+	for _, tt := range tests {
+		if got := tt.in.Percent(); got != tt.want {
+			t.Errorf("BrightnessByte(%d).Percent() = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestBrightnessPercentToByte(t *testing.T) {
+	tests := []struct {
+		in   BrightnessPercent
+		want BrightnessByte
+	}{
+		{-1, 0},
+		{0, 0},
+		{1, 3},
+		{50, 128},
+		{99, 252},
+		{100, 255},
+		{150, 255},
+	}
+
+	for _, tt := range tests {
+		if got := tt.in.Byte(); got != tt.want {
+			t.Errorf("BrightnessPercent(%d).Byte() = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestBrightnessPercentRoundTrip(t *testing.T) {
+	for p := BrightnessPercent(0); p <= 100; p++ {
+		if got := p.Byte().Percent(); got != p {
+			t.Errorf("BrightnessPercent(%d) round-trips to %d", p, got)
+		}
+	}
+}
+
+func TestBrightnessFractions(t *testing.T) {
+	tests := []struct {
+		name string
+		got  float64
+		want float64
+	}{
+		{"byte 255", BrightnessByte(255).Fraction(), 1},
+		{"byte over range", BrightnessByte(400).Fraction(), 1},
+		{"byte negative", BrightnessByte(-1).Fraction(), 0},
+		{"percent 50", BrightnessPercent(50).Fraction(), 0.5},
+		{"percent over range", BrightnessPercent(120).Fraction(), 1},
+	}
+
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s: Fraction() = %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestBrightnessPercentFromFraction(t *testing.T) {
+	tests := []struct {
+		in   float64
+		want BrightnessPercent
+	}{
+		{0, 0},
+		{0.333, 33},
+		{0.5, 50},
+		{1, 100},
+		{1.2, 100},
+		{-0.1, 0},
+	}
+
+	for _, tt := range tests {
+		if got := BrightnessPercentFromFraction(tt.in); got != tt.want {
+			t.Errorf("BrightnessPercentFromFraction(%v) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
@@ -2,7 +2,9 @@ package shared
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -16,6 +18,14 @@ import (
 const ClaudeAPIURL = "https://api.anthropic.com/v1/messages"
 const ClaudeAPIVersion = "2023-06-01"
 
+// claudeMessagesURL is where SendMessage posts; tests point it elsewhere
+// (see StubClaudeAPI)
+var claudeMessagesURL = ClaudeAPIURL
+
+// claudeCallTimeout caps each Claude request; the caller's deadline can
+// shorten it
+const claudeCallTimeout = 120 * time.Second
+
 // ClaudeClient wraps the Anthropic Claude API
 type ClaudeClient struct {
 	apiKey     string
@@ -25,10 +35,8 @@ type ClaudeClient struct {
 // NewClaudeClient creates a new Claude API client
 func NewClaudeClient() *ClaudeClient {
 	return &ClaudeClient{
-		apiKey: os.Getenv("CLAUDE_API_KEY"),
-		httpClient: &http.Client{
-			Timeout: 120 * time.Second,
-		},
+		apiKey:     os.Getenv("CLAUDE_API_KEY"),
+		httpClient: &http.Client{},
 	}
 }
 
@@ -73,8 +81,13 @@ type ClaudeError struct {
 	} `json:"error"`
 }
 
-// SendMessage sends a message to Claude and returns the response
-func (c *ClaudeClient) SendMessage(model, systemPrompt string, messages []ClaudeMessage) (*ClaudeResponse, error) {
+// ErrModelNotFound is returned by SendMessage when Claude no longer recognizes
+// the requested model ID, typically because it has been retired
+var ErrModelNotFound = errors.New("Claude model not found")
+
+// SendMessage sends a message to Claude and returns the response. A request
+// cut short by ctx's deadline fails with a DependencyTimeoutError.
+func (c *ClaudeClient) SendMessage(ctx context.Context, model, systemPrompt string, messages []ClaudeMessage) (*ClaudeResponse, error) {
 	if c.apiKey == "" {
 		return nil, fmt.Errorf("CLAUDE_API_KEY environment variable not set")
 	}
@@ -96,7 +109,10 @@ func (c *ClaudeClient) SendMessage(model, systemPrompt string, messages []Claude
 		return nil, fmt.Errorf("failed to marshal request: %w", err)
 	}
 
-	req, err := http.NewRequest("POST", ClaudeAPIURL, bytes.NewBuffer(jsonData))
+	ctx, cancel := WithCallTimeout(ctx, claudeCallTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", claudeMessagesURL, bytes.NewBuffer(jsonData))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
@@ -107,18 +123,22 @@ func (c *ClaudeClient) SendMessage(model, systemPrompt string, messages []Claude
 
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("failed to send request: %w", err)
+		return nil, DependencyTimeout("Claude", fmt.Errorf("failed to send request: %w", err))
 	}
 	defer resp.Body.Close()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read response: %w", err)
+		return nil, DependencyTimeout("Claude", fmt.Errorf("failed to read response: %w", err))
 	}
 
 	if resp.StatusCode != http.StatusOK {
 		var claudeErr ClaudeError
 		if err := json.Unmarshal(body, &claudeErr); err == nil {
+			if resp.StatusCode == http.StatusNotFound && claudeErr.Error.Type == "not_found_error" &&
+				strings.Contains(claudeErr.Error.Message, "model") {
+				return nil, fmt.Errorf("%w: %s", ErrModelNotFound, model)
+			}
 			return nil, fmt.Errorf("Claude API error: %s - %s", claudeErr.Error.Type, claudeErr.Error.Message)
 		}
 		return nil, fmt.Errorf("Claude API error: status %d - %s", resp.StatusCode, string(body))
@@ -128,6 +148,7 @@ func (c *ClaudeClient) SendMessage(model, systemPrompt string, messages []Claude
 	if err := json.Unmarshal(body, &claudeResp); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal response: %w", err)
 	}
+	CountClaudeTokens(claudeResp.Usage.InputTokens, claudeResp.Usage.OutputTokens)
 
 	return &claudeResp, nil
 }
@@ -197,68 +218,65 @@ type ClaudeModelListResponse struct {
 
 
 
-// FetchLatestModels fetches available models and returns the latest ID for each family (opus, sonnet, haiku)
-
-func (c *ClaudeClient) FetchLatestModels() (map[string]string, error) {
+// ListModelIDs returns the set of model IDs the API currently accepts
+func (c *ClaudeClient) ListModelIDs(ctx context.Context) (map[string]bool, error) {
+	listResp, err := c.listModels(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ids := make(map[string]bool, len(listResp.Data))
+	for _, m := range listResp.Data {
+		ids[m.ID] = true
+	}
+	return ids, nil
+}
 
+// listModels fetches the models endpoint
+func (c *ClaudeClient) listModels(ctx context.Context) (*ClaudeModelListResponse, error) {
 	if c.apiKey == "" {
-
 		return nil, fmt.Errorf("CLAUDE_API_KEY environment variable not set")
-
 	}
 
+	ctx, cancel := WithCallTimeout(ctx, claudeCallTimeout)
+	defer cancel()
 
-
-	req, err := http.NewRequest("GET", "https://api.anthropic.com/v1/models", nil)
-
+	req, err := http.NewRequestWithContext(ctx, "GET", "https://api.anthropic.com/v1/models", nil)
 	if err != nil {
-
 		return nil, fmt.Errorf("failed to create request: %w", err)
-
 	}
 
-
-
 	req.Header.Set("x-api-key", c.apiKey)
 	req.Header.Set("anthropic-version", ClaudeAPIVersion)
 
-
-
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
-
-		return nil, fmt.Errorf("failed to fetch models: %w", err)
-
+		return nil, DependencyTimeout("Claude", fmt.Errorf("failed to fetch models: %w", err))
 	}
 	defer resp.Body.Close()
 
-
-
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-
-		return nil, fmt.Errorf("failed to read response body: %w", err)
-
+		return nil, DependencyTimeout("Claude", fmt.Errorf("failed to read response body: %w", err))
 	}
 
-
-
 	if resp.StatusCode != http.StatusOK {
-
 		return nil, fmt.Errorf("failed to list models: status %d - %s", resp.StatusCode, string(body))
-
 	}
 
-
-
 	var listResp ClaudeModelListResponse
 	if err := json.Unmarshal(body, &listResp); err != nil {
-
 		return nil, fmt.Errorf("failed to decode models response: %w", err)
-
 	}
+	return &listResp, nil
+}
 
+// FetchLatestModels fetches available models and returns the latest ID for each family (opus, sonnet, haiku)
 
+func (c *ClaudeClient) FetchLatestModels(ctx context.Context) (map[string]string, error) {
+	listResp, err := c.listModels(ctx)
+	if err != nil {
+		return nil, err
+	}
 
 	// Logic to find latest models
 
@@ -0,0 +1,68 @@
+package shared
+
+import (
+	"strings"
+	"time"
+)
+
+// ModelPricing is a model's token rates in US dollars per million tokens
+type ModelPricing struct {
+	InputPerMTok  float64
+	OutputPerMTok float64
+}
+
+// ClaudeModelPricing holds the rates used to cost new messages. Each message
+// stores its cost when it's created, so changing a rate here never changes
+// stored costs.
+var ClaudeModelPricing = map[string]ModelPricing{
+	ModelClaude37Sonnet: {InputPerMTok: 3, OutputPerMTok: 15},
+	ModelClaude35Sonnet: {InputPerMTok: 3, OutputPerMTok: 15},
+	ModelClaude35Haiku:  {InputPerMTok: 0.80, OutputPerMTok: 4},
+}
+
+// claudeFamilyPricing prices models missing from ClaudeModelPricing (the
+// model list is fetched live) by the family in their ID
+var claudeFamilyPricing = []struct {
+	family  string
+	pricing ModelPricing
+}{
+	{"opus", ModelPricing{InputPerMTok: 15, OutputPerMTok: 75}},
+	{"sonnet", ModelPricing{InputPerMTok: 3, OutputPerMTok: 15}},
+	{"haiku", ModelPricing{InputPerMTok: 0.80, OutputPerMTok: 4}},
+}
+
+// PricingForModel returns the rates for model, falling back to its family
+// and then to DefaultModel
+func PricingForModel(model string) ModelPricing {
+	if p, ok := ClaudeModelPricing[model]; ok {
+		return p
+	}
+	for _, f := range claudeFamilyPricing {
+		if strings.Contains(model, f.family) {
+			return f.pricing
+		}
+	}
+	return ClaudeModelPricing[DefaultModel]
+}
+
+// CostMicrodollars is what tokensIn input and tokensOut output tokens cost
+// at p, in millionths of a dollar, rounded to the nearest
+func (p ModelPricing) CostMicrodollars(tokensIn, tokensOut int) int64 {
+	// Dollars per million tokens is microdollars per token
+	cost := float64(tokensIn)*p.InputPerMTok + float64(tokensOut)*p.OutputPerMTok
+	return int64(cost + 0.5)
+}
+
+// NewAssistantMessage builds the message for a Claude reply from model,
+// costed at the model's current rates
+func NewAssistantMessage(model, content string, tokensIn, tokensOut int, now time.Time) Message {
+	return Message{
+		Role:             "assistant",
+		Content:          content,
+		Model:            model,
+		TokensIn:         tokensIn,
+		TokensOut:        tokensOut,
+		CostMicrodollars: PricingForModel(model).CostMicrodollars(tokensIn, tokensOut),
+		Timestamp:        now,
+	}
+}
@@ -0,0 +1,67 @@
+package shared
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCostMicrodollarsBothDirections(t *testing.T) {
+	sonnet := ModelPricing{InputPerMTok: 3, OutputPerMTok: 15}
+	tests := []struct {
+		name                string
+		tokensIn, tokensOut int
+		want                int64
+	}{
+		{"nothing", 0, 0, 0},
+		{"input only", 1000, 0, 3000},
+		{"output only", 0, 1000, 15000},
+		{"both", 2500, 400, 7500 + 6000},
+		{"a million of each", 1000000, 1000000, 18000000},
+	}
+	for _, tt := range tests {
+		if got := sonnet.CostMicrodollars(tt.tokensIn, tt.tokensOut); got != tt.want {
+			t.Errorf("%s: cost = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+
+	// Fractional rates round to the nearest microdollar
+	haiku := ModelPricing{InputPerMTok: 0.80, OutputPerMTok: 4}
+	if got := haiku.CostMicrodollars(3, 0); got != 2 {
+		t.Errorf("3 haiku input tokens = %d, want 2 (2.4 rounded)", got)
+	}
+	if got := haiku.CostMicrodollars(1, 1); got != 5 {
+		t.Errorf("1 haiku token each way = %d, want 5 (4.8 rounded)", got)
+	}
+}
+
+func TestPricingForModel(t *testing.T) {
+	tests := []struct {
+		model string
+		want  ModelPricing
+	}{
+		{ModelClaude35Haiku, ClaudeModelPricing[ModelClaude35Haiku]},
+		{"claude-opus-4-20250514", ModelPricing{InputPerMTok: 15, OutputPerMTok: 75}},
+		{"claude-sonnet-4-20250514", ModelPricing{InputPerMTok: 3, OutputPerMTok: 15}},
+		{"someone-elses-model", ClaudeModelPricing[DefaultModel]},
+	}
+	for _, tt := range tests {
+		if got := PricingForModel(tt.model); got != tt.want {
+			t.Errorf("PricingForModel(%q) = %+v, want %+v", tt.model, got, tt.want)
+		}
+	}
+}
+
+func TestNewMessagesUseCurrentRates(t *testing.T) {
+	msg := NewAssistantMessage(ModelClaude35Haiku, "hi", 1000, 1000, time.Now())
+	if msg.Model != ModelClaude35Haiku || msg.CostMicrodollars != 4800 {
+		t.Fatalf("message = %s costing %d, want %s costing 4800", msg.Model, msg.CostMicrodollars, ModelClaude35Haiku)
+	}
+
+	saved := ClaudeModelPricing[ModelClaude35Haiku]
+	ClaudeModelPricing[ModelClaude35Haiku] = ModelPricing{InputPerMTok: 1, OutputPerMTok: 5}
+	defer func() { ClaudeModelPricing[ModelClaude35Haiku] = saved }()
+
+	if next := NewAssistantMessage(ModelClaude35Haiku, "hi", 1000, 1000, time.Now()); next.CostMicrodollars != 6000 {
+		t.Errorf("new message cost = %d, want 6000 at the new rates", next.CostMicrodollars)
+	}
+}
@@ -0,0 +1,47 @@
+package shared
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+)
+
+// StubClaudeAPI points SendMessage at an in-process server that answers
+// every request with reply, for tests. It sets CLAUDE_API_KEY if unset;
+// restore puts back the previous URL and key.
+func StubClaudeAPI(reply func(request ClaudeRequest) string) (restore func()) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request ClaudeRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var response ClaudeResponse
+		response.Type = "message"
+		response.Role = "assistant"
+		response.Model = request.Model
+		response.Content = append(response.Content, struct {
+			Type string `json:"type"`
+			Text string `json:"text"`
+		}{"text", reply(request)})
+		response.Usage.InputTokens = 100
+		response.Usage.OutputTokens = 50
+		json.NewEncoder(w).Encode(response)
+	}))
+	previousURL := claudeMessagesURL
+	claudeMessagesURL = server.URL
+	previousKey, hadKey := os.LookupEnv("CLAUDE_API_KEY")
+	if !hadKey {
+		os.Setenv("CLAUDE_API_KEY", "test-key")
+	}
+	return func() {
+		claudeMessagesURL = previousURL
+		if !hadKey {
+			os.Unsetenv("CLAUDE_API_KEY")
+		} else {
+			os.Setenv("CLAUDE_API_KEY", previousKey)
+		}
+		server.Close()
+	}
+}
@@ -120,42 +120,9 @@ var NamedColors = map[string]RGB{
 	"daylight":   {R: 255, G: 255, B: 255},
 }
 
-// BrightnessPercentToFirmware converts Alexa brightness (0-100) to firmware (0-255)
-func BrightnessPercentToFirmware(percent int) int {
-	if percent <= 0 {
-		return 0
-	}
-	if percent >= 100 {
-		return 255
-	}
-	return int(math.Round(float64(percent) * 255 / 100))
-}
-
-// BrightnessFirmwareToPercent converts firmware brightness (0-255) to Alexa (0-100)
-func BrightnessFirmwareToPercent(value int) int {
-	if value <= 0 {
-		return 0
-	}
-	if value >= 255 {
-		return 100
-	}
-	return int(math.Round(float64(value) * 100 / 255))
-}
-
-// ClampBrightness ensures brightness is within valid range
-func ClampBrightness(brightness int) int {
-	if brightness < 0 {
-		return 0
-	}
-	if brightness > 100 {
-		return 100
-	}
-	return brightness
-}
-
-// ApplyBrightnessToRGB scales RGB values by brightness factor
+// ApplyBrightnessToRGB scales RGB values by a brightness percent
 func ApplyBrightnessToRGB(color RGB, brightnessPercent int) RGB {
-	factor := float64(brightnessPercent) / 100
+	factor := BrightnessPercent(brightnessPercent).Fraction()
 	return RGB{
 		R: uint8(math.Round(float64(color.R) * factor)),
 		G: uint8(math.Round(float64(color.G) * factor)),
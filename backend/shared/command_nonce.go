@@ -0,0 +1,77 @@
+package shared
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// CommandNonceSeparator starts the nonce appended to a cloud function
+// argument, e.g. "6,AAEC|=9f86d081". Firmware that predates nonces still
+// parses the argument: its integer fields stop at '|' and its base64 decoder
+// stops at '='.
+const CommandNonceSeparator = "|="
+
+// LastCommandIDVariable is the firmware variable echoing the nonce of the
+// last command that ran successfully
+const LastCommandIDVariable = "lastCmdId"
+
+// commandNonceBytes is the nonce's random length; it's sent as hex and
+// must fit the firmware's 16 character lastCmdId
+const commandNonceBytes = 4
+
+// NewCommandNonce returns a random nonce for AppendCommandNonce, or "" if
+// one couldn't be generated
+func NewCommandNonce() string {
+	b := make([]byte, commandNonceBytes)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// AppendCommandNonce adds nonce to a cloud function argument. An empty
+// nonce leaves the argument as is.
+func AppendCommandNonce(argument, nonce string) string {
+	if nonce == "" {
+		return argument
+	}
+	return argument + CommandNonceSeparator + nonce
+}
+
+// ParseCommandNonce splits an argument built by AppendCommandNonce into the
+// original argument and its nonce, which is "" when there isn't one
+func ParseCommandNonce(argument string) (string, string) {
+	i := strings.LastIndex(argument, CommandNonceSeparator)
+	if i < 0 {
+		return argument, ""
+	}
+	return argument[:i], argument[i+len(CommandNonceSeparator):]
+}
+
+// particleStatusError is an error carrying the Particle API's HTTP status
+type particleStatusError interface {
+	ParticleStatus() int
+}
+
+// IsCommandTimeout reports whether a cloud function call failed by timing
+// out: our deadline passed, the connection timed out, or Particle answered
+// 408. Such a call is ambiguous, as the device may still have run it.
+func IsCommandTimeout(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	var statusErr particleStatusError
+	return errors.As(err, &statusErr) && statusErr.ParticleStatus() == http.StatusRequestTimeout
+}
@@ -0,0 +1,157 @@
+package shared
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// CommandSeqSeparator starts the strip sequence number appended to a
+// setBytecode argument, before any nonce: "6,AAEC|#42|=9f86d081". Firmware
+// that supports sequences ignores a command whose sequence is no higher than
+// the last one it applied to the strip, so a call delivered twice runs once.
+// Commands without a sequence are always applied.
+const CommandSeqSeparator = "|#"
+
+// CommandSeqCapability is the firmware variable echoing the last sequence
+// applied to each strip. Devices whose Capabilities list it are sent
+// sequences; others get arguments as before.
+const CommandSeqCapability = "lastSeq"
+
+// SupportsCommandSeq reports whether the device's firmware honours strip
+// sequence numbers
+func (d Device) SupportsCommandSeq() bool {
+	for _, capability := range d.Capabilities {
+		if capability == CommandSeqCapability {
+			return true
+		}
+	}
+	return false
+}
+
+// AppendCommandSeq adds seq to a cloud function argument
+func AppendCommandSeq(argument string, seq int64) string {
+	return argument + CommandSeqSeparator + strconv.FormatInt(seq, 10)
+}
+
+// ParseCommandSeq splits an argument built by AppendCommandSeq into the
+// original argument and its sequence, reporting whether there is one. Any
+// nonce should be removed first (see ParseCommandNonce).
+func ParseCommandSeq(argument string) (string, int64, bool) {
+	i := strings.LastIndex(argument, CommandSeqSeparator)
+	if i < 0 {
+		return argument, 0, false
+	}
+	seq, err := strconv.ParseInt(argument[i+len(CommandSeqSeparator):], 10, 64)
+	if err != nil {
+		return argument, 0, false
+	}
+	return argument[:i], seq, true
+}
+
+// CarryCommandSeqs copies each previous strip's sequence onto the updated
+// strip with the same pin, so saving a strip list from a client (which
+// doesn't send sequences) doesn't reset them
+func CarryCommandSeqs(previous, updated []LEDStrip) {
+	seqs := make(map[int]int64, len(previous))
+	for _, strip := range previous {
+		seqs[strip.Pin] = strip.CommandSeq
+	}
+	for i := range updated {
+		if seq := seqs[updated[i].Pin]; seq > updated[i].CommandSeq {
+			updated[i].CommandSeq = seq
+		}
+	}
+}
+
+// stripSeqLocks serialises sequenced sends to each strip within this
+// container, so commands leave in the order their sequences were taken.
+// Across containers the firmware's check keeps the highest sequence.
+var stripSeqLocks = struct {
+	sync.Mutex
+	locks map[string]*sync.Mutex
+}{locks: make(map[string]*sync.Mutex)}
+
+func stripSeqLock(deviceID string, pin int) *sync.Mutex {
+	stripSeqLocks.Lock()
+	defer stripSeqLocks.Unlock()
+	key := fmt.Sprintf("%s/%d", deviceID, pin)
+	lock, ok := stripSeqLocks.locks[key]
+	if !ok {
+		lock = &sync.Mutex{}
+		stripSeqLocks.locks[key] = lock
+	}
+	return lock
+}
+
+// NextStripCommandSeq atomically increments the sequence of the device's
+// strip on logical pin and returns the new value. It fails if the strip is
+// no longer at the position the device record was read with.
+func NextStripCommandSeq(ctx context.Context, devicesTable string, device Device, pin int) (int64, error) {
+	index := -1
+	for i, strip := range device.LEDStrips {
+		if strip.Pin == pin {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return 0, fmt.Errorf("device %s has no strip on pin D%d", device.Name, pin)
+	}
+
+	client, err := InitDynamoDB()
+	if err != nil {
+		return 0, err
+	}
+
+	path := fmt.Sprintf("ledStrips[%d]", index)
+	result, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(devicesTable),
+		Key: map[string]types.AttributeValue{
+			"deviceId": &types.AttributeValueMemberS{Value: device.DeviceID},
+		},
+		UpdateExpression:    aws.String(fmt.Sprintf("SET %[1]s.commandSeq = if_not_exists(%[1]s.commandSeq, :zero) + :one", path)),
+		ConditionExpression: aws.String(path + ".pin = :pin"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":zero": &types.AttributeValueMemberN{Value: "0"},
+			":one":  &types.AttributeValueMemberN{Value: "1"},
+			":pin":  &types.AttributeValueMemberN{Value: strconv.Itoa(pin)},
+		},
+		ReturnValues: types.ReturnValueAllNew,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to take a command sequence for %s pin D%d: %w", device.Name, pin, err)
+	}
+
+	var updated struct {
+		LEDStrips []LEDStrip `dynamodbav:"ledStrips"`
+	}
+	if err := attributevalue.UnmarshalMap(result.Attributes, &updated); err != nil {
+		return 0, err
+	}
+	if index >= len(updated.LEDStrips) {
+		return 0, fmt.Errorf("device %s strip D%d missing after taking a command sequence", device.Name, pin)
+	}
+	return updated.LEDStrips[index].CommandSeq, nil
+}
+
+// sequencedPin is the logical pin a setBytecode argument ("pin,base64")
+// addresses, reporting whether it could be read
+func sequencedPin(device Device, argument string) (int, bool) {
+	physical, _, ok := strings.Cut(argument, ",")
+	if !ok {
+		return 0, false
+	}
+	pin, err := strconv.Atoi(physical)
+	if err != nil {
+		return 0, false
+	}
+	return device.LogicalPin(pin), true
+}
@@ -0,0 +1,169 @@
+package shared
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// stubStripSeqs stands in for the devices table's strip sequences,
+// incrementing them the way NextStripCommandSeq's update does
+type stubStripSeqs struct {
+	mu     sync.Mutex
+	device Device
+}
+
+func (s *stubStripSeqs) handle(call DynamoDBStubCall) (map[string]interface{}, error) {
+	if call.Operation != "UpdateItem" || !strings.Contains(call.String("UpdateExpression"), "commandSeq") {
+		return nil, nil // Rate limit reads and writes
+	}
+	var values struct {
+		Pin int `dynamodbav:":pin"`
+	}
+	if err := call.Unmarshal("ExpressionAttributeValues", &values); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.device.LEDStrips {
+		if strings.Contains(call.String("UpdateExpression"), fmt.Sprintf("ledStrips[%d]", i)) {
+			if s.device.LEDStrips[i].Pin != values.Pin {
+				return nil, ErrDynamoDBStubConditionFailed
+			}
+			s.device.LEDStrips[i].CommandSeq++
+			return map[string]interface{}{"Attributes": DynamoDBStubItem(s.device)}, nil
+		}
+	}
+	return nil, ErrDynamoDBStubConditionFailed
+}
+
+// sentSeqs records the sequences of setBytecode calls in the order Particle
+// receives them; -1 for a call without one
+type sentSeqs struct {
+	mu   sync.Mutex
+	seqs []int64
+}
+
+func (s *sentSeqs) serve(t *testing.T) (restore func()) {
+	return StubParticleAPI(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Arg string `json:"arg"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		argument, _, _ := strings.Cut(body.Arg, CommandNonceSeparator)
+		payload, seq, ok := ParseCommandSeq(argument)
+		if payload != "6,AAEC" {
+			t.Errorf("argument %q, want 6,AAEC with a sequence", body.Arg)
+		}
+		if !ok {
+			seq = -1
+		}
+		s.mu.Lock()
+		s.seqs = append(s.seqs, seq)
+		s.mu.Unlock()
+		w.Write([]byte(`{"return_value":1}`))
+	})
+}
+
+func TestConcurrentAppliesSendIncreasingSequences(t *testing.T) {
+	store := &stubStripSeqs{device: Device{
+		DeviceID:     "seq-test",
+		Name:         "garage",
+		ParticleID:   "p1",
+		Capabilities: []string{"setBytecode", CommandSeqCapability},
+		CommandBurst: MaxCommandBurst,
+		LEDStrips:    []LEDStrip{{Pin: 2, LEDCount: 8, CommandSeq: 40}, {Pin: 6, LEDCount: 30, CommandSeq: 7}},
+	}}
+	defer StubDynamoDB(store.handle)()
+	sent := &sentSeqs{}
+	defer sent.serve(t)()
+
+	const applies = 12
+	var wg sync.WaitGroup
+	for i := 0; i < applies; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			timed := NewParticleTimedCaller(context.Background(), store.device, "token", "devices")
+			if err := timed.Call("p1", "setBytecode", "6,AAEC"); err != nil {
+				t.Errorf("apply: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(sent.seqs) != applies {
+		t.Fatalf("%d calls reached Particle, want %d", len(sent.seqs), applies)
+	}
+	for i, seq := range sent.seqs {
+		// Strictly increasing in arrival order, so no duplicates either
+		if want := int64(8 + i); seq != want {
+			t.Errorf("call %d carried sequence %d, want %d (all: %v)", i, seq, want, sent.seqs)
+			break
+		}
+	}
+	if got := store.device.LEDStrips[0].CommandSeq; got != 40 {
+		t.Errorf("the other strip's sequence moved to %d", got)
+	}
+}
+
+func TestSequencesNeedTheCapability(t *testing.T) {
+	store := &stubStripSeqs{device: Device{
+		DeviceID:   "seq-test-old-firmware",
+		Name:       "porch",
+		ParticleID: "p1",
+		LEDStrips:  []LEDStrip{{Pin: 6, LEDCount: 30}},
+	}}
+	defer StubDynamoDB(store.handle)()
+	sent := &sentSeqs{}
+	defer sent.serve(t)()
+
+	timed := NewParticleTimedCaller(context.Background(), store.device, "token", "devices")
+	if err := timed.Call("p1", "setBytecode", "6,AAEC"); err != nil {
+		t.Fatal(err)
+	}
+	if len(sent.seqs) != 1 || sent.seqs[0] != -1 || store.device.LEDStrips[0].CommandSeq != 0 {
+		t.Errorf("sent %v with stored sequence %d, want one call without a sequence", sent.seqs, store.device.LEDStrips[0].CommandSeq)
+	}
+}
+
+func TestNextStripCommandSeqRefusesMovedStrip(t *testing.T) {
+	store := &stubStripSeqs{device: Device{DeviceID: "d1", LEDStrips: []LEDStrip{{Pin: 2}, {Pin: 6}}}}
+	defer StubDynamoDB(store.handle)()
+
+	// Read before strip 6 moved to the front
+	stale := Device{DeviceID: "d1", Name: "garage", LEDStrips: []LEDStrip{{Pin: 6}, {Pin: 2}}}
+	if seq, err := NextStripCommandSeq(context.Background(), "devices", stale, 6); err == nil {
+		t.Errorf("took sequence %d for a strip that moved", seq)
+	}
+	if _, err := NextStripCommandSeq(context.Background(), "devices", stale, 5); err == nil {
+		t.Error("took a sequence for a pin without a strip")
+	}
+}
+
+func TestCommandSeqArguments(t *testing.T) {
+	argument := AppendCommandSeq("6,AAEC", 42)
+	if argument != "6,AAEC|#42" {
+		t.Errorf("AppendCommandSeq = %q", argument)
+	}
+	if payload, seq, ok := ParseCommandSeq(argument); payload != "6,AAEC" || seq != 42 || !ok {
+		t.Errorf("ParseCommandSeq(%q) = %q, %d, %v", argument, payload, seq, ok)
+	}
+	for _, plain := range []string{"6,AAEC", "6,AAEC|#x"} {
+		if payload, _, ok := ParseCommandSeq(plain); payload != plain || ok {
+			t.Errorf("ParseCommandSeq(%q) = %q, %v; want it unchanged", plain, payload, ok)
+		}
+	}
+
+	previous := []LEDStrip{{Pin: 2, CommandSeq: 9}, {Pin: 6, CommandSeq: 3}}
+	updated := []LEDStrip{{Pin: 6}, {Pin: 4}, {Pin: 2, CommandSeq: 12}}
+	CarryCommandSeqs(previous, updated)
+	if updated[0].CommandSeq != 3 || updated[1].CommandSeq != 0 || updated[2].CommandSeq != 12 {
+		t.Errorf("carried sequences = %d, %d, %d; want 3, 0, 12", updated[0].CommandSeq, updated[1].CommandSeq, updated[2].CommandSeq)
+	}
+}
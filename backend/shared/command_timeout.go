@@ -0,0 +1,241 @@
+package shared
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Bounds for Device.CommandTimeoutSeconds. Devices without one get
+// DefaultCommandTimeoutSeconds per cloud function call.
+const (
+	DefaultCommandTimeoutSeconds = 15
+	MinCommandTimeoutSeconds     = 5
+	MaxCommandTimeoutSeconds     = 60
+)
+
+// slowCallFraction is how much of its timeout a successful call can take
+// before the device is flagged as slow
+const slowCallFraction = 0.75
+
+// verifyTimeout bounds the read back of lastCmdId after a call timed out
+const verifyTimeout = 5 * time.Second
+
+// ValidateCommandTimeoutSeconds checks a requested per-device timeout
+func ValidateCommandTimeoutSeconds(seconds int) error {
+	if seconds < MinCommandTimeoutSeconds || seconds > MaxCommandTimeoutSeconds {
+		return fmt.Errorf("commandTimeoutSeconds must be between %d and %d", MinCommandTimeoutSeconds, MaxCommandTimeoutSeconds)
+	}
+	return nil
+}
+
+// CommandTimeout is how long a single cloud function call on the device may
+// take
+func (d *Device) CommandTimeout() time.Duration {
+	if d.CommandTimeoutSeconds == 0 {
+		return DefaultCommandTimeoutSeconds * time.Second
+	}
+	return time.Duration(d.CommandTimeoutSeconds) * time.Second
+}
+
+// IsSlowCall reports whether a call that succeeded in elapsed came close
+// enough to timeout to count as slow
+func IsSlowCall(elapsed, timeout time.Duration) bool {
+	return elapsed > time.Duration(float64(timeout)*slowCallFraction)
+}
+
+// ParticleContextCaller is a ParticleCaller that gives up when ctx is done
+type ParticleContextCaller func(ctx context.Context, particleID, function, argument string) error
+
+// ParticleVariableReader reads a device variable, giving up when ctx is done
+type ParticleVariableReader func(ctx context.Context, particleID, variable string) (string, error)
+
+// TimedCaller calls cloud functions on one device, each under the device's
+// command timeout and within its rate limit (see ReserveDeviceCommand), and
+// remembers the slowest call that succeeded. Call is a ParticleCaller. Not
+// safe for concurrent use.
+type TimedCaller struct {
+	ctx         context.Context
+	device      Device
+	call        ParticleContextCaller
+	read        ParticleVariableReader
+	maxRateWait time.Duration
+	seqTable    string // Devices table strip sequences are kept in; "" sends none
+	slowest     time.Duration
+	verified    string // Function of the last call verified after timing out
+}
+
+// NewTimedCaller returns a TimedCaller for device. Calls also stop when ctx
+// is done.
+func NewTimedCaller(ctx context.Context, device Device, call ParticleContextCaller) *TimedCaller {
+	return &TimedCaller{ctx: ctx, device: device, call: call, maxRateWait: DefaultMaxCommandRateWait}
+}
+
+// AllowRateWait lets each call wait up to maxWait for the device's rate limit,
+// for callers that have planned their calls with DeviceCommandDelay and would
+// rather slow down than fail part way through
+func (t *TimedCaller) AllowRateWait(maxWait time.Duration) *TimedCaller {
+	if maxWait > t.maxRateWait {
+		t.maxRateWait = maxWait
+	}
+	return t
+}
+
+// VerifyWith makes calls carry a command nonce, and a call that times out
+// count as successful when read shows the device's lastCmdId echoing its
+// nonce. Firmware without lastCmdId ignores the nonce, and its timeouts fail
+// as before.
+func (t *TimedCaller) VerifyWith(read ParticleVariableReader) *TimedCaller {
+	t.read = read
+	return t
+}
+
+// SequenceWith makes setBytecode calls carry the strip's next command
+// sequence, taken from devicesTable, when the firmware supports them (see
+// SupportsCommandSeq). If no sequence can be taken the call is sent without
+// one.
+func (t *TimedCaller) SequenceWith(devicesTable string) *TimedCaller {
+	t.seqTable = devicesTable
+	return t
+}
+
+// Call invokes function on the device with the device's command timeout,
+// first waiting for its rate limit. A call that would have to wait too long
+// fails with a *DeviceRateLimitError.
+func (t *TimedCaller) Call(particleID, function, argument string) error {
+	wait, err := ReserveDeviceCommand(t.ctx, t.device, t.maxRateWait)
+	if err != nil {
+		log.Printf("%s on %s refused: %v", function, t.device.Name, err)
+		return err
+	}
+	if wait > 0 {
+		log.Printf("Waiting %v for the rate limit of %s before %s", wait, t.device.Name, function)
+		select {
+		case <-time.After(wait):
+		case <-t.ctx.Done():
+			return t.ctx.Err()
+		}
+	}
+
+	if pin, ok := t.sequenced(function, argument); ok {
+		// Held until the call returns, so this container sends in sequence order
+		lock := stripSeqLock(t.device.DeviceID, pin)
+		lock.Lock()
+		defer lock.Unlock()
+
+		seq, err := NextStripCommandSeq(t.ctx, t.seqTable, t.device, pin)
+		if err != nil {
+			log.Printf("Sending %s to %s without a sequence: %v", function, t.device.Name, err)
+		} else {
+			argument = AppendCommandSeq(argument, seq)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(t.ctx, t.device.CommandTimeout())
+	defer cancel()
+
+	nonce := ""
+	if t.read != nil {
+		nonce = NewCommandNonce()
+	}
+
+	start := time.Now()
+	err = t.call(ctx, particleID, function, AppendCommandNonce(argument, nonce))
+	if err != nil && nonce != "" && IsCommandTimeout(err) && t.ranAfterTimeout(particleID, nonce) {
+		log.Printf("%s on %s timed out but was verified after timeout: %v", function, t.device.Name, err)
+		t.verified = function
+		err = nil
+	}
+	if elapsed := time.Since(start); err == nil && elapsed > t.slowest {
+		t.slowest = elapsed
+	}
+	return err
+}
+
+// sequenced reports whether a call should carry a strip sequence, and the
+// logical pin it addresses
+func (t *TimedCaller) sequenced(function, argument string) (int, bool) {
+	if t.seqTable == "" || function != "setBytecode" || !t.device.SupportsCommandSeq() {
+		return 0, false
+	}
+	return sequencedPin(t.device, argument)
+}
+
+// ranAfterTimeout reports whether the device's lastCmdId shows it ran the
+// command sent with nonce
+func (t *TimedCaller) ranAfterTimeout(particleID, nonce string) bool {
+	ctx, cancel := context.WithTimeout(t.ctx, verifyTimeout)
+	defer cancel()
+
+	lastCmdID, err := t.read(ctx, particleID, LastCommandIDVariable)
+	if err != nil {
+		log.Printf("Failed to read %s from %s to verify a timed out call: %v", LastCommandIDVariable, t.device.Name, err)
+		return false
+	}
+	return lastCmdID == nonce
+}
+
+// SlowWarning describes the slowest call when it came close to the timeout,
+// or is "" when every call was comfortably within it. A call verified after
+// timing out is always reported.
+func (t *TimedCaller) SlowWarning() string {
+	timeout := t.device.CommandTimeout()
+	if t.verified != "" {
+		return fmt.Sprintf("slow device: %s did not answer %s within %ds, but it was verified after timeout; consider raising its command timeout",
+			t.device.Name, t.verified, int(timeout/time.Second))
+	}
+	if !IsSlowCall(t.slowest, timeout) {
+		return ""
+	}
+	return fmt.Sprintf("slow device: %s took %.1fs to respond (timeout %ds); consider raising its command timeout",
+		t.device.Name, t.slowest.Seconds(), int(timeout/time.Second))
+}
+
+// RecordIfSlow bumps the device's slow call counter when any call was slow,
+// returning the warning for the caller's response. Failing to record is
+// logged, not returned: the calls themselves succeeded.
+func (t *TimedCaller) RecordIfSlow(ctx context.Context, devicesTable string) string {
+	warning := t.SlowWarning()
+	if warning == "" {
+		return ""
+	}
+	log.Printf("Device %s: %s", t.device.DeviceID, warning)
+	if err := RecordSlowDeviceCall(ctx, devicesTable, t.device.DeviceID, time.Now().UTC()); err != nil {
+		log.Printf("Failed to record slow call on device %s: %v", t.device.DeviceID, err)
+	}
+	return warning
+}
+
+// RecordSlowDeviceCall adds one to the device's slowCallCount (atomic ADD,
+// like errorCount) and sets lastSlowCallAt
+func RecordSlowDeviceCall(ctx context.Context, devicesTable, deviceID string, at time.Time) error {
+	client, err := InitDynamoDB()
+	if err != nil {
+		return err
+	}
+
+	occurredAt, err := attributevalue.Marshal(at)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(devicesTable),
+		Key: map[string]types.AttributeValue{
+			"deviceId": &types.AttributeValueMemberS{Value: deviceID},
+		},
+		UpdateExpression:    aws.String("ADD slowCallCount :one SET lastSlowCallAt = :at"),
+		ConditionExpression: aws.String("attribute_exists(deviceId)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":one": &types.AttributeValueMemberN{Value: "1"},
+			":at":  occurredAt,
+		},
+	})
+	return err
+}
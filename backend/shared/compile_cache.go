@@ -0,0 +1,327 @@
+package shared
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// CommonLEDCounts are precompiled into Pattern.CompiledCache when a pattern is saved
+var CommonLEDCounts = []int{8, 16, 30, 60, 144}
+
+// maxCompileCacheEntries bounds the in-memory cache of a warm Lambda
+const maxCompileCacheEntries = 256
+
+// legacyEffectMap maps legacy pattern types to WLED effect IDs
+var legacyEffectMap = map[string]int{
+	PatternSolid:   WLEDFXSolid,
+	PatternPulse:   WLEDFXBreathe,
+	PatternWave:    67,
+	PatternRainbow: WLEDFXRainbow,
+	PatternFire:    66,
+	PatternCandle:  WLEDFXCandle,
+}
+
+var (
+	compileCacheMu     sync.Mutex
+	compileCache       = make(map[string][]byte)
+	compileCacheHits   int64
+	compileCacheMisses int64
+)
+
+// CompileCacheKey identifies a compiled pattern. UpdatedAt is part of the key so
+// saving a pattern invalidates every cached compilation of it.
+func CompileCacheKey(pattern *Pattern, ledCount int) string {
+	return fmt.Sprintf("%s:%d:%d", pattern.PatternID, pattern.UpdatedAt.UnixNano(), ledCount)
+}
+
+// NormalizeWLEDJSON returns the canonical form of a WLED JSON state, so
+// semantically identical states (differing only in key order or whitespace)
+// compare and hash equal. encoding/json writes map keys sorted at every depth;
+// numbers are kept as written rather than round-tripped through float64.
+func NormalizeWLEDJSON(jsonStr string) (string, error) {
+	decoder := json.NewDecoder(bytes.NewReader([]byte(jsonStr)))
+	decoder.UseNumber()
+
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return "", fmt.Errorf("invalid WLED JSON: %v", err)
+	}
+	if decoder.More() {
+		return "", fmt.Errorf("invalid WLED JSON: unexpected data after value")
+	}
+
+	normalized, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return string(normalized), nil
+}
+
+// contentCacheKey identifies a compilation by its normalized WLED JSON, for
+// patterns that have no ID (previews, unsaved GlowBlaster output)
+func contentCacheKey(wledJSON string) string {
+	if normalized, err := NormalizeWLEDJSON(wledJSON); err == nil {
+		wledJSON = normalized
+	}
+	sum := sha256.Sum256([]byte(wledJSON))
+	return "wled:" + hex.EncodeToString(sum[:])
+}
+
+// persistedCacheKey keys Pattern.CompiledCache, which is only trusted when it
+// was written for the pattern's current UpdatedAt
+func persistedCacheKey(pattern *Pattern, ledCount int) string {
+	return strconv.Itoa(ledCount) + "@" + strconv.FormatInt(pattern.UpdatedAt.UnixNano(), 10)
+}
+
+// PrepareWLEDForLEDCount returns the WLED JSON for pattern sized to ledCount,
+// built from whichever fields ResolvePatternFormat picks: the WLED state, the
+// LCL spec converted to WLED, or the legacy fields. Warnings describe
+// anything that won't render exactly as authored.
+func PrepareWLEDForLEDCount(pattern *Pattern, ledCount int) (string, []string, error) {
+	var warnings []string
+
+	format := ResolvePatternFormat(*pattern)
+	if format != PatternFormatLegacySimple {
+		wledState := pattern.WLEDState
+		if format == PatternFormatLCL {
+			converted, convertWarnings, err := lclSpecToWLEDJSON(pattern.LCLSpec, ledCount)
+			if err != nil {
+				return "", convertWarnings, err
+			}
+			wledState = converted
+			warnings = append(warnings, convertWarnings...)
+		}
+
+		var wledJson map[string]interface{}
+		if err := json.Unmarshal([]byte(wledState), &wledJson); err != nil {
+			return "", nil, fmt.Errorf("failed to parse WLED state: %v", err)
+		}
+
+		// Update all segment stop values to match device LED count
+		if segs, ok := wledJson["seg"].([]interface{}); ok {
+			for i, seg := range segs {
+				if segMap, ok := seg.(map[string]interface{}); ok {
+					if stop, ok := segMap["stop"].(float64); ok && int(stop) != ledCount {
+						warnings = append(warnings, fmt.Sprintf("Segment %d rescaled from %d to %d LEDs", i, int(stop), ledCount))
+					}
+					segMap["stop"] = ledCount
+
+					if fx, ok := segMap["fx"].(float64); ok && !IsEffectSupported(int(fx)) {
+						warnings = append(warnings, fmt.Sprintf("Segment %d uses effect %d which is not supported by the compiler", i, int(fx)))
+					}
+					if cols, ok := segMap["col"].([]interface{}); ok && len(cols) > WLEDBMaxColors {
+						warnings = append(warnings, segmentColorWarning(i, len(cols)))
+					}
+				}
+			}
+		}
+
+		updated, _ := json.Marshal(wledJson)
+		return string(updated), warnings, nil
+	}
+
+	// Build WLED JSON from pattern fields (legacy patterns)
+	effectID, mapped := legacyEffectMap[pattern.Type]
+	override, hasEffectOverride, overrideWarnings := patternEffectOverride(pattern)
+	warnings = append(warnings, overrideWarnings...)
+	if hasEffectOverride {
+		effectID = override
+	}
+	if !mapped && !hasEffectOverride {
+		warnings = append(warnings, fmt.Sprintf("Pattern type %q has no WLED effect mapping; using solid", pattern.Type))
+	}
+
+	speed := 128
+	intensity := 128
+	custom1 := 128
+
+	if pattern.Metadata != nil {
+		if s, ok := pattern.Metadata["speed"]; ok {
+			fmt.Sscanf(s, "%d", &speed)
+		}
+		if i, ok := pattern.Metadata["intensity"]; ok {
+			fmt.Sscanf(i, "%d", &intensity)
+		}
+		if c, ok := pattern.Metadata["custom1"]; ok {
+			fmt.Sscanf(c, "%d", &custom1)
+		}
+	}
+
+	// Build colors array
+	var colors [][]int
+	if len(pattern.Colors) > 0 {
+		for _, c := range pattern.Colors {
+			colors = append(colors, []int{clampByte(c.R), clampByte(c.G), clampByte(c.B)})
+		}
+		if len(colors) > WLEDBMaxColors {
+			warnings = append(warnings, segmentColorWarning(0, len(colors)))
+		}
+	} else {
+		colors = [][]int{{clampByte(pattern.Red), clampByte(pattern.Green), clampByte(pattern.Blue)}}
+	}
+
+	wledJson := map[string]interface{}{
+		"on":  true,
+		"bri": clampByte(pattern.Brightness),
+		"seg": []map[string]interface{}{
+			{
+				"id":    0,
+				"start": 0,
+				"stop":  ledCount,
+				"fx":    effectID,
+				"sx":    clampByte(speed),
+				"ix":    clampByte(intensity),
+				"c1":    clampByte(custom1),
+				"col":   colors,
+				"on":    true,
+			},
+		},
+	}
+
+	built, _ := json.Marshal(wledJson)
+	return string(built), warnings, nil
+}
+
+// CompileForLEDCount compiles pattern for a strip of ledCount LEDs, reusing a
+// previous compilation when possible: the pattern's stored WLEDBinary when the
+// strip is the length it was authored for, then the in-memory cache of this
+// warm Lambda, then Pattern.CompiledCache. Patterns without an ID are cached
+// in memory by the content of their WLED state.
+func CompileForLEDCount(pattern *Pattern, ledCount int) ([]byte, []string, error) {
+	bytecode, _, warnings, err := compileForLEDCount(pattern, ledCount)
+	return bytecode, warnings, err
+}
+
+// compileForLEDCount is CompileForLEDCount that also returns the
+// BinarySource the bytecode came from
+func compileForLEDCount(pattern *Pattern, ledCount int) ([]byte, string, []string, error) {
+	wledJSON, warnings, err := PrepareWLEDForLEDCount(pattern, ledCount)
+	if err != nil {
+		return nil, "", warnings, err
+	}
+
+	if bytecode, ok := storedBinaryFor(pattern, ledCount); ok {
+		log.Printf("[CompileCache] stored binary pattern=%s ledCount=%d (%d bytes)", pattern.PatternID, ledCount, len(bytecode))
+		return bytecode, BinarySourceStored, warnings, nil
+	}
+
+	if pattern.PatternID == "" {
+		key := contentCacheKey(wledJSON)
+
+		compileCacheMu.Lock()
+		bytecode, ok := compileCache[key]
+		compileCacheMu.Unlock()
+		if ok {
+			logCompileCache("hit (content)", key, true)
+			return bytecode, BinarySourceCached, warnings, nil
+		}
+
+		bytecode, compileWarnings, err := CompileWLED(wledJSON)
+		warnings = appendNewWarnings(warnings, compileWarnings)
+		if err != nil {
+			return nil, "", warnings, fmt.Errorf("failed to compile WLED: %v", err)
+		}
+		storeCompileCache(key, bytecode)
+		logCompileCache("miss (content)", key, false)
+		return bytecode, BinarySourceCompiled, warnings, nil
+	}
+
+	key := CompileCacheKey(pattern, ledCount)
+
+	compileCacheMu.Lock()
+	bytecode, ok := compileCache[key]
+	compileCacheMu.Unlock()
+	if ok {
+		logCompileCache("hit (memory)", key, true)
+		return bytecode, BinarySourceCached, warnings, nil
+	}
+
+	if bytecode, ok := pattern.CompiledCache[persistedCacheKey(pattern, ledCount)]; ok && len(bytecode) > 0 {
+		storeCompileCache(key, bytecode)
+		logCompileCache("hit (pattern item)", key, true)
+		return bytecode, BinarySourceCached, warnings, nil
+	}
+
+	bytecode, compileWarnings, err := CompileWLED(wledJSON)
+	warnings = appendNewWarnings(warnings, compileWarnings)
+	if err != nil {
+		return nil, "", warnings, fmt.Errorf("failed to compile WLED: %v", err)
+	}
+
+	storeCompileCache(key, bytecode)
+	logCompileCache("miss", key, false)
+	return bytecode, BinarySourceCompiled, warnings, nil
+}
+
+// PrecompileCommonLEDCounts builds a fresh CompiledCache for the pattern's
+// current UpdatedAt. Call it after setting UpdatedAt and before saving; it
+// replaces the old map so stale compilations are dropped.
+func PrecompileCommonLEDCounts(pattern *Pattern) map[string][]byte {
+	cache := make(map[string][]byte, len(CommonLEDCounts))
+	var warnings []string
+	for _, ledCount := range CommonLEDCounts {
+		wledJSON, _, err := PrepareWLEDForLEDCount(pattern, ledCount)
+		if err != nil {
+			log.Printf("[CompileCache] Not precompiling pattern %s: %v", pattern.PatternID, err)
+			return nil
+		}
+		bytecode, compileWarnings, err := CompileWLED(wledJSON)
+		if err != nil {
+			log.Printf("[CompileCache] Not precompiling pattern %s: %v", pattern.PatternID, err)
+			return nil
+		}
+		warnings = appendNewWarnings(warnings, compileWarnings)
+		cache[persistedCacheKey(pattern, ledCount)] = bytecode
+	}
+	// Applying the pattern reports these to the user; here they're only logged
+	for _, warning := range warnings {
+		log.Printf("[CompileCache] Pattern %s: %s", pattern.PatternID, warning)
+	}
+	return cache
+}
+
+// appendNewWarnings appends the warnings in more that aren't in warnings
+// already. Compiling repeats some of what preparing the state reported.
+func appendNewWarnings(warnings, more []string) []string {
+	for _, w := range more {
+		seen := false
+		for _, have := range warnings {
+			if have == w {
+				seen = true
+				break
+			}
+		}
+		if !seen {
+			warnings = append(warnings, w)
+		}
+	}
+	return warnings
+}
+
+func storeCompileCache(key string, bytecode []byte) {
+	compileCacheMu.Lock()
+	defer compileCacheMu.Unlock()
+
+	// Entries are tiny; just start over rather than tracking recency
+	if len(compileCache) >= maxCompileCacheEntries {
+		compileCache = make(map[string][]byte)
+	}
+	compileCache[key] = bytecode
+}
+
+func logCompileCache(outcome, key string, hit bool) {
+	if hit {
+		atomic.AddInt64(&compileCacheHits, 1)
+	} else {
+		atomic.AddInt64(&compileCacheMisses, 1)
+	}
+	log.Printf("[CompileCache] %s key=%s (hits=%d, misses=%d)", outcome, key,
+		atomic.LoadInt64(&compileCacheHits), atomic.LoadInt64(&compileCacheMisses))
+}
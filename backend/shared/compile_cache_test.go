@@ -0,0 +1,89 @@
+package shared
+
+import "testing"
+
+func TestNormalizeWLEDJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"sorted keys", `{"on":true,"bri":128}`, `{"bri":128,"on":true}`},
+		{"whitespace", "{ \"bri\" : 128 ,\n \"on\" : true }", `{"bri":128,"on":true}`},
+		{"nested", `{"seg":[{"fx":2,"col":[[255,0,0]]}],"bri":1}`, `{"bri":1,"seg":[{"col":[[255,0,0]],"fx":2}]}`},
+		{"numbers kept as written", `{"bri":1.50,"big":12345678901234567890}`, `{"big":12345678901234567890,"bri":1.50}`},
+	}
+
+	for _, tt := range tests {
+		got, err := NormalizeWLEDJSON(tt.in)
+		if err != nil {
+			t.Errorf("%s: error: %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: NormalizeWLEDJSON(%s) = %s, want %s", tt.name, tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeWLEDJSONRejectsInvalid(t *testing.T) {
+	for _, in := range []string{"", `{"bri":`, `{"bri":1} {"on":true}`} {
+		if _, err := NormalizeWLEDJSON(in); err == nil {
+			t.Errorf("NormalizeWLEDJSON(%q) succeeded, want an error", in)
+		}
+	}
+}
+
+func TestContentCacheKeyIgnoresFormatting(t *testing.T) {
+	a := contentCacheKey(`{"on":true,"bri":128}`)
+	b := contentCacheKey(`{ "bri": 128, "on": true }`)
+	if a != b {
+		t.Errorf("keys differ for equivalent JSON: %s vs %s", a, b)
+	}
+	if c := contentCacheKey(`{"on":true,"bri":127}`); c == a {
+		t.Error("different states got the same key")
+	}
+}
+
+func TestCompileForLEDCountWarnsOnUnmappedEffect(t *testing.T) {
+	pattern := Pattern{Type: "sparkle", Red: 255, Brightness: 128}
+	_, warnings, err := CompileForLEDCount(&pattern, 30)
+	if err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+	want := `Pattern type "sparkle" has no WLED effect mapping; using solid`
+	if !containsWarning(warnings, want) {
+		t.Errorf("warnings = %q, want %q", warnings, want)
+	}
+}
+
+func TestCompileForLEDCountReturnsCompileWarnings(t *testing.T) {
+	pattern := Pattern{WLEDState: `{"on":true,"bri":128,"seg":[{"fx":0,"stop":30,"col":[[255,0,0],[0,255,0],[0,0,255],[255,255,0],[0,255,255]]}]}`}
+	want := segmentColorWarning(0, 5)
+
+	// The first compile is a miss and the second a hit; both report it once
+	for i := 0; i < 2; i++ {
+		_, warnings, err := CompileForLEDCount(&pattern, 30)
+		if err != nil {
+			t.Fatalf("compile %d: %v", i, err)
+		}
+		count := 0
+		for _, w := range warnings {
+			if w == want {
+				count++
+			}
+		}
+		if count != 1 {
+			t.Errorf("compile %d: warnings = %q, want %q once", i, warnings, want)
+		}
+	}
+}
+
+func containsWarning(warnings []string, want string) bool {
+	for _, w := range warnings {
+		if w == want {
+			return true
+		}
+	}
+	return false
+}
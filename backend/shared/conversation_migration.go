@@ -0,0 +1,96 @@
+package shared
+
+import (
+	"context"
+	"log"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// ConversationModelMigrationResult contains retired-model migration statistics
+type ConversationModelMigrationResult struct {
+	Scanned int            `json:"scanned"`
+	Updated int            `json:"updated"`
+	Failed  int            `json:"failed"`
+	To      string         `json:"to"`
+	ByModel map[string]int `json:"byModel,omitempty"` // Retired model ID -> conversations moved off it
+	Errors  []string       `json:"errors,omitempty"`
+}
+
+// MigrateConversationModels scans every conversation and sets the model to
+// DefaultModel wherever the stored model is not in available, the set of
+// model IDs Claude currently accepts. With dryRun set nothing is written.
+func MigrateConversationModels(ctx context.Context, tableName string, available map[string]bool, dryRun bool) (*ConversationModelMigrationResult, error) {
+	client, err := InitDynamoDB()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ConversationModelMigrationResult{
+		To:      DefaultModel,
+		ByModel: make(map[string]int),
+	}
+	paginator := dynamodb.NewScanPaginator(client, &dynamodb.ScanInput{
+		TableName:                aws.String(tableName),
+		ProjectionExpression:     aws.String("conversationId, #model"),
+		ExpressionAttributeNames: map[string]string{"#model": "model"},
+	})
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return result, err
+		}
+
+		for _, item := range page.Items {
+			result.Scanned++
+
+			conversationID, ok := item["conversationId"].(*types.AttributeValueMemberS)
+			if !ok || conversationID.Value == "" {
+				result.Failed++
+				result.Errors = append(result.Errors, "conversation record without a conversationId")
+				continue
+			}
+
+			model := ""
+			if m, ok := item["model"].(*types.AttributeValueMemberS); ok {
+				model = m.Value
+			}
+			if available[model] {
+				continue
+			}
+
+			if dryRun {
+				log.Printf("[DRY RUN] Would move conversation %s from %q to %s", conversationID.Value, model, DefaultModel)
+				result.Updated++
+				result.ByModel[model]++
+				continue
+			}
+
+			_, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+				TableName: aws.String(tableName),
+				Key: map[string]types.AttributeValue{
+					"conversationId": conversationID,
+				},
+				UpdateExpression:         aws.String("SET #model = :model"),
+				ExpressionAttributeNames: map[string]string{"#model": "model"},
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":model": &types.AttributeValueMemberS{Value: DefaultModel},
+				},
+			})
+			if err != nil {
+				log.Printf("Failed to update model for conversation %s: %v", conversationID.Value, err)
+				result.Failed++
+				result.Errors = append(result.Errors, conversationID.Value+": "+err.Error())
+				continue
+			}
+
+			result.Updated++
+			result.ByModel[model]++
+		}
+	}
+
+	return result, nil
+}
@@ -15,10 +15,17 @@ type Conversation struct {
 	CurrentWLEDBin []byte `json:"currentWledBin,omitempty" dynamodbav:"currentWledBin,omitempty"` // Current WLED binary
 	Model          string `json:"model" dynamodbav:"model"`                                       // claude-sonnet-4, claude-3-5-sonnet, claude-3-5-haiku
 	TotalTokens    int    `json:"totalTokens" dynamodbav:"totalTokens"`
+	TotalCost      int64  `json:"totalCost" dynamodbav:"totalCost"`                     // Microdollars, summed from message costs
 	PatternID      string `json:"patternId,omitempty" dynamodbav:"patternId,omitempty"` // Associated saved pattern
-	CreatedAt      time.Time `json:"createdAt" dynamodbav:"createdAt"`
-	UpdatedAt      time.Time `json:"updatedAt" dynamodbav:"updatedAt"`
-	ExpiresAt      int64     `json:"expiresAt,omitempty" dynamodbav:"expiresAt,omitempty"` // TTL (1 year)
+	// Fork lineage - ForkedAtMessageIndex is only meaningful when ForkedFromID is set
+	ForkedFromID         string    `json:"forkedFromId,omitempty" dynamodbav:"forkedFromId,omitempty"`                 // Conversation this was forked from
+	ForkedAtMessageIndex int       `json:"forkedAtMessageIndex,omitempty" dynamodbav:"forkedAtMessageIndex,omitempty"` // Last message index copied from the source
+	CreatedAt            time.Time `json:"createdAt" dynamodbav:"createdAt"`
+	UpdatedAt            time.Time `json:"updatedAt" dynamodbav:"updatedAt"`
+	ExpiresAt            int64     `json:"expiresAt,omitempty" dynamodbav:"expiresAt,omitempty"` // TTL (1 year)
+	// Archived conversations are left out of the list unless asked for
+	Archived   bool       `json:"archived,omitempty" dynamodbav:"archived,omitempty"`
+	ArchivedAt *time.Time `json:"archivedAt,omitempty" dynamodbav:"archivedAt,omitempty"`
 }
 
 // Message represents a single chat message
@@ -28,6 +35,10 @@ type Message struct {
 	TokensIn  int       `json:"tokensIn,omitempty" dynamodbav:"tokensIn,omitempty"`
 	TokensOut int       `json:"tokensOut,omitempty" dynamodbav:"tokensOut,omitempty"`
 	Timestamp time.Time `json:"timestamp" dynamodbav:"timestamp"`
+	// Assistant messages only: the model that replied and what the reply cost
+	// at the rates in effect then (see ClaudeModelPricing)
+	Model            string `json:"model,omitempty" dynamodbav:"model,omitempty"`
+	CostMicrodollars int64  `json:"costMicrodollars,omitempty" dynamodbav:"costMicrodollars,omitempty"`
 }
 
 // ChatRequest represents a request to send a message
@@ -38,18 +49,46 @@ type ChatRequest struct {
 
 // ChatResponse represents the response from a chat message
 type ChatResponse struct {
-	Message     string         `json:"message"`               // AI response text
-	PatternName string         `json:"patternName,omitempty"` // Suggested pattern name from LLM
-	LCL         string         `json:"lcl,omitempty"`         // Updated LCL if pattern changed (legacy)
-	Bytecode    []byte         `json:"bytecode,omitempty"`    // Compiled bytecode for preview (legacy LCL or WLED)
-	WLED        string         `json:"wled,omitempty"`        // WLED JSON state
-	WLEDBinary  []byte         `json:"wledBinary,omitempty"`  // WLED binary for device
-	TokensUsed  int            `json:"tokensUsed"`            // Tokens used in this request
-	TotalTokens int            `json:"totalTokens"`           // Total tokens in conversation
-	Suggestions []string       `json:"suggestions,omitempty"` // Follow-up suggestions
-	Debug       *ChatDebugInfo `json:"debug,omitempty"`       // Debug info (prompt, messages)
+	Message      string         `json:"message"`                // AI response text
+	PatternName  string         `json:"patternName,omitempty"`  // Suggested pattern name from LLM
+	LCL          string         `json:"lcl,omitempty"`          // Updated LCL if pattern changed (legacy)
+	Bytecode     []byte         `json:"bytecode,omitempty"`     // Compiled bytecode for preview (legacy LCL or WLED)
+	WLED         string         `json:"wled,omitempty"`         // WLED JSON state
+	WLEDBinary   []byte         `json:"wledBinary,omitempty"`   // WLED binary for device
+	TokensUsed   int            `json:"tokensUsed"`             // Tokens used in this request
+	TotalTokens  int            `json:"totalTokens"`            // Total tokens in conversation
+	Cost         int64          `json:"cost"`                   // Microdollars for this request
+	TotalCost    int64          `json:"totalCost"`              // Microdollars for the conversation
+	Suggestions  []string       `json:"suggestions,omitempty"`  // Follow-up suggestions
+	Debug        *ChatDebugInfo `json:"debug,omitempty"`        // Debug info (prompt, messages)
+	ModelChanged *ModelChange   `json:"modelChanged,omitempty"` // Set when the conversation was moved off its stored model
+	Context      *ChatContext   `json:"context,omitempty"`      // What was sent to Claude for the final reply
 }
 
+// ChatContext describes the context sent to Claude: the history after
+// trimming, and its estimated size
+type ChatContext struct {
+	EstimatedTokens    int `json:"estimatedTokens"`    // System prompt and messages
+	SystemPromptTokens int `json:"systemPromptTokens"` // Estimate for the system prompt alone
+	MaxMessageTokens   int `json:"maxMessageTokens"`   // Budget for the messages
+	Messages           int `json:"messages"`           // Messages sent
+	DroppedMessages    int `json:"droppedMessages"`    // Oldest messages left out to fit the budget
+	StrippedBlocks     int `json:"strippedBlocks"`     // Code blocks removed from older replies
+}
+
+// ModelChange tells the UI that a conversation's model was replaced
+type ModelChange struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Reason string `json:"reason"`
+}
+
+// Reasons a conversation's model is replaced
+const (
+	ModelChangeInvalid = "invalid" // Stored model ID is malformed
+	ModelChangeRetired = "retired" // Claude no longer recognizes the stored model
+)
+
 // ChatDebugInfo contains debug information about the chat request
 type ChatDebugInfo struct {
 	SystemPrompt string          `json:"systemPrompt"`
@@ -63,10 +102,14 @@ type CompileRequest struct {
 
 // CompileResponse represents the result of LCL compilation
 type CompileResponse struct {
-	Success  bool     `json:"success"`
-	Bytecode []byte   `json:"bytecode,omitempty"`
-	Errors   []string `json:"errors,omitempty"`
-	Warnings []string `json:"warnings,omitempty"`
+	Success            bool       `json:"success"`
+	Bytecode           []byte     `json:"bytecode,omitempty"`
+	Errors             []string   `json:"errors,omitempty"`
+	Warnings           []string   `json:"warnings,omitempty"`
+	Palette            []string   `json:"palette,omitempty"`            // LCL colors after the MaxPaletteColors cap
+	SegmentColors      [][]string `json:"segmentColors,omitempty"`      // WLED colors per segment after the WLEDBMaxColors cap
+	SegmentSpeedLevels []int      `json:"segmentSpeedLevels,omitempty"` // WLED speed per segment as a normalized 0-100 level
+	MergedState        string     `json:"mergedState,omitempty"`        // WLED JSON after ?autoMerge=true merged segments
 }
 
 // CreateConversationRequest represents a request to create a new conversation
@@ -75,17 +118,55 @@ type CreateConversationRequest struct {
 	Model string `json:"model,omitempty"` // Default: claude-sonnet-4
 }
 
+// MaxConversationTitleLength is the longest title a conversation can be given,
+// in characters
+const MaxConversationTitleLength = 100
+
+// UpdateConversationRequest renames or archives a conversation; omitted
+// fields are left as they are
+type UpdateConversationRequest struct {
+	Title    *string `json:"title,omitempty"`
+	Archived *bool   `json:"archived,omitempty"` // false unarchives
+}
+
+// ForkConversationRequest represents a request to fork a conversation
+type ForkConversationRequest struct {
+	MessageIndex *int   `json:"messageIndex,omitempty"` // Last message to copy (default: all)
+	Title        string `json:"title,omitempty"`        // Default: "<source title> (fork)"
+}
+
+// ConversationLineageEntry is one conversation in a fork chain; depth 0 is the
+// requested conversation, depth 1 its source, and so on
+type ConversationLineageEntry struct {
+	ConversationID string `json:"conversationId"`
+	Title          string `json:"title"`
+	Depth          int    `json:"depth"`
+}
+
 // SavePatternRequest represents a request to save a pattern from conversation
 type SavePatternRequest struct {
-	Name           string `json:"name"`
-	Description    string `json:"description,omitempty"`
+	Name           string `json:"name" openapi:"maxLength=80"`
+	Description    string `json:"description,omitempty" openapi:"maxLength=500"`
 	ConversationID string `json:"conversationId,omitempty"`
 	LCL            string `json:"lcl,omitempty"`
 }
 
 // CompactRequest represents a request to compact a conversation
 type CompactRequest struct {
-	KeepRecent int `json:"keepRecent,omitempty"` // Number of recent messages to keep (default: 4)
+	KeepRecent int   `json:"keepRecent,omitempty"` // Number of recent messages to keep (default: 4)
+	Summarize  *bool `json:"summarize,omitempty"`  // Have Claude summarize the older messages; defaults to true when the conversation's model is available
+}
+
+// CompactResponse reports a compaction. Token counts are estimates of the
+// conversation history sent with each chat message, before and after.
+type CompactResponse struct {
+	Message      string `json:"message"`
+	MessageCount int    `json:"messageCount"`
+	Summarized   bool   `json:"summarized"`           // Claude wrote the summary; false for the list of earlier questions
+	TokensUsed   int    `json:"tokensUsed,omitempty"` // Tokens the summarization call used, added to TotalTokens
+	TokensBefore int    `json:"tokensBefore"`
+	TokensAfter  int    `json:"tokensAfter"`
+	TokensSaved  int    `json:"tokensSaved"`
 }
 
 // Available Claude models for Glow Blaster
@@ -2,7 +2,10 @@ package shared
 
 import (
     "context"
+    "errors"
+    "fmt"
     "log"
+    "time"
 
     "github.com/aws/aws-sdk-go-v2/config"
     "github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
@@ -126,6 +129,70 @@ func DeleteItem(ctx context.Context, tableName string, key map[string]types.Attr
     return nil
 }
 
+// batchWriteLimit is the most requests DynamoDB takes in one BatchWriteItem
+const batchWriteLimit = 25
+
+// batchDeleteAttempts bounds the retries of items a batch leaves unprocessed
+const batchDeleteAttempts = 5
+
+// BatchDeleteItems deletes the items with keys from a table, 25 to a request.
+// Items DynamoDB leaves unprocessed (throttling) are retried with exponential
+// backoff. It returns how many were deleted; on error the rest were not.
+func BatchDeleteItems(ctx context.Context, tableName string, keys []map[string]types.AttributeValue) (int, error) {
+    log.Printf("[DB] BatchDeleteItems: table=%s, items=%d", tableName, len(keys))
+
+    client, err := InitDynamoDB()
+    if err != nil {
+        log.Printf("[DB] BatchDeleteItems ERROR: Failed to initialize DynamoDB: %v", err)
+        return 0, err
+    }
+
+    deleted := 0
+    for start := 0; start < len(keys); start += batchWriteLimit {
+        end := start + batchWriteLimit
+        if end > len(keys) {
+            end = len(keys)
+        }
+
+        requests := make([]types.WriteRequest, 0, end-start)
+        for _, key := range keys[start:end] {
+            requests = append(requests, types.WriteRequest{DeleteRequest: &types.DeleteRequest{Key: key}})
+        }
+
+        backoff := 100 * time.Millisecond
+        for attempt := 1; len(requests) > 0; attempt++ {
+            output, err := client.BatchWriteItem(ctx, &dynamodb.BatchWriteItemInput{
+                RequestItems: map[string][]types.WriteRequest{tableName: requests},
+            })
+            if err != nil {
+                log.Printf("[DB] BatchDeleteItems ERROR: Failed to delete from %s: %v", tableName, err)
+                return deleted, err
+            }
+
+            unprocessed := output.UnprocessedItems[tableName]
+            deleted += len(requests) - len(unprocessed)
+            requests = unprocessed
+            if len(requests) == 0 {
+                break
+            }
+            if attempt == batchDeleteAttempts {
+                return deleted, fmt.Errorf("%d items in %s still unprocessed after %d attempts", len(requests), tableName, attempt)
+            }
+
+            log.Printf("[DB] BatchDeleteItems: %d items in %s unprocessed, retrying in %v", len(requests), tableName, backoff)
+            select {
+            case <-ctx.Done():
+                return deleted, ctx.Err()
+            case <-time.After(backoff):
+            }
+            backoff *= 2
+        }
+    }
+
+    log.Printf("[DB] BatchDeleteItems: Successfully deleted %d items from %s", deleted, tableName)
+    return deleted, nil
+}
+
 // Query performs a query on DynamoDB
 func Query(ctx context.Context, tableName string, indexName *string, keyCondition string,
     expressionValues map[string]types.AttributeValue, results interface{}) error {
@@ -167,8 +234,24 @@ func Query(ctx context.Context, tableName string, indexName *string, keyConditio
     return nil
 }
 
-// Scan performs a scan on DynamoDB
+// ScanWarnThreshold is the item count above which a scan logs a warning.
+// Scans read the whole table, so one that returns this many items is worth
+// replacing with a Query on an index.
+const ScanWarnThreshold = 1000
+
+// ErrScanLimitReached is returned by ScanUpTo when the table has more items
+// than maxItems. The results hold the first maxItems.
+var ErrScanLimitReached = errors.New("scan stopped at its item limit")
+
+// Scan reads every item in a table, following LastEvaluatedKey across pages
 func Scan(ctx context.Context, tableName string, results interface{}) error {
+    return ScanUpTo(ctx, tableName, 0, results)
+}
+
+// ScanUpTo is Scan stopping after maxItems items (0 = no limit), returning
+// ErrScanLimitReached when there were more. It also stops, returning the
+// context's error, when ctx is done between pages.
+func ScanUpTo(ctx context.Context, tableName string, maxItems int, results interface{}) error {
     log.Printf("[DB] Scan: table=%s", tableName)
 
     client, err := InitDynamoDB()
@@ -177,20 +260,46 @@ func Scan(ctx context.Context, tableName string, results interface{}) error {
         return err
     }
 
-    output, err := client.Scan(ctx, &dynamodb.ScanInput{
+    var items []map[string]types.AttributeValue
+    var limitErr error
+    pages := 0
+    paginator := dynamodb.NewScanPaginator(client, &dynamodb.ScanInput{
         TableName: &tableName,
     })
-    if err != nil {
-        log.Printf("[DB] Scan ERROR: Failed to scan %s: %v", tableName, err)
-        return err
+    for paginator.HasMorePages() {
+        if err := ctx.Err(); err != nil {
+            log.Printf("[DB] Scan ERROR: Stopped scanning %s after %d pages: %v", tableName, pages, err)
+            return err
+        }
+
+        output, err := paginator.NextPage(ctx)
+        if err != nil {
+            log.Printf("[DB] Scan ERROR: Failed to scan %s: %v", tableName, err)
+            return err
+        }
+        pages++
+        items = append(items, output.Items...)
+
+        if maxItems > 0 && len(items) >= maxItems {
+            if len(items) > maxItems || paginator.HasMorePages() {
+                limitErr = ErrScanLimitReached
+            }
+            if len(items) > maxItems {
+                items = items[:maxItems]
+            }
+            break
+        }
     }
 
-    err = attributevalue.UnmarshalListOfMaps(output.Items, results)
+    err = attributevalue.UnmarshalListOfMaps(items, results)
     if err != nil {
         log.Printf("[DB] Scan ERROR: Failed to unmarshal results from %s: %v", tableName, err)
         return err
     }
 
-    log.Printf("[DB] Scan: Successfully scanned %s, found %d items", tableName, len(output.Items))
-    return nil
+    if len(items) > ScanWarnThreshold {
+        log.Printf("[DB] Scan WARNING: Scanned %d items from %s in %d pages; consider a Query on an index", len(items), tableName, pages)
+    }
+    log.Printf("[DB] Scan: Successfully scanned %s, found %d items", tableName, len(items))
+    return limitErr
 }
@@ -0,0 +1,107 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+type scannedItem struct {
+	DeviceID string `dynamodbav:"deviceId"`
+	Payload  string `dynamodbav:"payload"`
+}
+
+// stubPagedTable answers Scans of count ~1KB items the way DynamoDB does,
+// stopping each page at 1MB of data with a LastEvaluatedKey
+func stubPagedTable(count int) (handler DynamoDBStubHandler, pages *int) {
+	pages = new(int)
+	payload := strings.Repeat("x", 1024)
+	return func(call DynamoDBStubCall) (map[string]interface{}, error) {
+		if call.Operation != "Scan" {
+			return nil, fmt.Errorf("unexpected %s", call.Operation)
+		}
+		start := 0
+		if call.Input["ExclusiveStartKey"] != nil {
+			var key scannedItem
+			if err := call.Unmarshal("ExclusiveStartKey", &key); err != nil {
+				return nil, err
+			}
+			fmt.Sscanf(key.DeviceID, "dev%05d", &start)
+			start++
+		}
+
+		*pages++
+		var items []interface{}
+		size := 0
+		i := start
+		for ; i < count && size < 1<<20; i++ {
+			items = append(items, scannedItem{DeviceID: fmt.Sprintf("dev%05d", i), Payload: payload})
+			size += len(payload) + 20
+		}
+		response := map[string]interface{}{"Items": DynamoDBStubItems(items...), "Count": len(items)}
+		if i < count {
+			response["LastEvaluatedKey"] = DynamoDBStubItem(map[string]string{"deviceId": fmt.Sprintf("dev%05d", i-1)})
+		}
+		return response, nil
+	}, pages
+}
+
+func TestScanReadsEveryPage(t *testing.T) {
+	const count = 2500 // About 2.5MB, three pages
+	handler, pages := stubPagedTable(count)
+	defer StubDynamoDB(handler)()
+
+	var items []scannedItem
+	if err := Scan(context.Background(), "devices", &items); err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != count || *pages != 3 {
+		t.Fatalf("scanned %d items in %d pages, want %d in 3", len(items), *pages, count)
+	}
+	for i, item := range items {
+		if want := fmt.Sprintf("dev%05d", i); item.DeviceID != want {
+			t.Fatalf("item %d is %s, want %s", i, item.DeviceID, want)
+		}
+	}
+}
+
+func TestScanUpToStopsAtItsLimit(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxItems int
+		wantLen  int
+		wantErr  error
+	}{
+		{"within the first page", 10, 10, ErrScanLimitReached},
+		{"across pages", 1500, 1500, ErrScanLimitReached},
+		{"exactly the table", 2500, 2500, nil},
+		{"more than the table", 5000, 2500, nil},
+	}
+	for _, tt := range tests {
+		handler, _ := stubPagedTable(2500)
+		restore := StubDynamoDB(handler)
+		var items []scannedItem
+		err := ScanUpTo(context.Background(), "devices", tt.maxItems, &items)
+		restore()
+		if !errors.Is(err, tt.wantErr) || len(items) != tt.wantLen {
+			t.Errorf("%s: %d items, %v; want %d, %v", tt.name, len(items), err, tt.wantLen, tt.wantErr)
+		}
+		if len(items) > 0 && items[len(items)-1].DeviceID != fmt.Sprintf("dev%05d", len(items)-1) {
+			t.Errorf("%s: last item %s, want the first %d in order", tt.name, items[len(items)-1].DeviceID, len(items))
+		}
+	}
+}
+
+func TestScanStopsWhenContextIsDone(t *testing.T) {
+	handler, pages := stubPagedTable(2500)
+	defer StubDynamoDB(handler)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var items []scannedItem
+	if err := Scan(ctx, "devices", &items); !errors.Is(err, context.Canceled) || *pages != 0 {
+		t.Errorf("scan with a done context = %v after %d pages, want context.Canceled before any", err, *pages)
+	}
+}
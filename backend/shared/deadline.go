@@ -0,0 +1,61 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// DeadlineSafetyMargin is kept back from the invocation deadline when timing
+// an outbound call, so a call that runs out of time still leaves room to
+// return an error before Lambda, and API Gateway in front of it, give up
+const DeadlineSafetyMargin = 2 * time.Second
+
+// WithCallTimeout bounds an outbound call to limit, or to ctx's deadline less
+// DeadlineSafetyMargin when that comes sooner. With no time left the returned
+// context is already done, so the call fails straight away.
+func WithCallTimeout(ctx context.Context, limit time.Duration) (context.Context, context.CancelFunc) {
+	if deadline, ok := ctx.Deadline(); ok {
+		if remaining := time.Until(deadline) - DeadlineSafetyMargin; remaining < limit {
+			limit = remaining
+		}
+	}
+	return context.WithTimeout(ctx, limit)
+}
+
+// DependencyTimeoutError is an outbound call to Dependency that ran out of
+// time
+type DependencyTimeoutError struct {
+	Dependency string // "Particle", "Claude"
+	Err        error
+}
+
+func (e *DependencyTimeoutError) Error() string {
+	return e.Dependency + " did not respond in time"
+}
+
+func (e *DependencyTimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// DependencyTimeout wraps err in a DependencyTimeoutError naming dependency
+// when it is a deadline expiry, and returns it unchanged otherwise
+func DependencyTimeout(dependency string, err error) error {
+	var timeoutErr *DependencyTimeoutError
+	if err == nil || errors.As(err, &timeoutErr) || !errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	return &DependencyTimeoutError{Dependency: dependency, Err: err}
+}
+
+// TimeoutErrorResponse is the 504 for err when it is, or wraps, a
+// DependencyTimeoutError, reporting whether it was one
+func TimeoutErrorResponse(err error) (events.APIGatewayProxyResponse, bool) {
+	var timeoutErr *DependencyTimeoutError
+	if !errors.As(err, &timeoutErr) {
+		return events.APIGatewayProxyResponse{}, false
+	}
+	return CreateErrorResponse(504, timeoutErr.Error()), true
+}
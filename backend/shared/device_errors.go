@@ -0,0 +1,280 @@
+package shared
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+var deviceErrorsTable = os.Getenv("DEVICE_ERRORS_TABLE")
+
+// DeviceErrorEventName is the Particle event the firmware publishes on failure
+const DeviceErrorEventName = "gl/error"
+
+// Device error codes the firmware publishes. Other codes are stored as sent.
+const (
+	DeviceErrorChecksum  = "checksum"   // Bytecode checksum mismatch
+	DeviceErrorOOM       = "oom"        // Allocation failed while loading a pattern
+	DeviceErrorStripInit = "strip_init" // LED strip failed to initialize
+)
+
+// deviceErrorMessages describe codes in terms a user can act on
+var deviceErrorMessages = map[string]string{
+	DeviceErrorChecksum:  "checksum mismatch",
+	DeviceErrorOOM:       "out of memory",
+	DeviceErrorStripInit: "strip failed to initialize",
+}
+
+// DeviceErrorCorrelationWindow is how soon after a backend apply a device
+// error is blamed on that apply
+const DeviceErrorCorrelationWindow = 30 * time.Second
+
+// deviceErrorRetention is how long device errors are kept before TTL deletes them
+const deviceErrorRetention = 30 * 24 * time.Hour
+
+// deviceErrorKeyLayout is a fixed-width UTC timestamp, so sort keys order by time
+const deviceErrorKeyLayout = "2006-01-02T15:04:05.000000000Z"
+
+// ParticleWebhookEvent is the body Particle's default webhook template posts
+type ParticleWebhookEvent struct {
+	Event       string `json:"event"`
+	Data        string `json:"data"`
+	CoreID      string `json:"coreid"`
+	PublishedAt string `json:"published_at"`
+}
+
+// DeviceErrorData is the JSON the firmware publishes as gl/error event data
+type DeviceErrorData struct {
+	Code   string `json:"code"`
+	Detail string `json:"detail,omitempty"`
+	Pin    *int   `json:"pin,omitempty"`
+}
+
+// DeviceError is one error reported by a device. ErrorKey starts with the
+// time so it orders a device's errors; PatternID is set when the error
+// followed a backend apply.
+type DeviceError struct {
+	DeviceID    string    `json:"deviceId" dynamodbav:"deviceId"`
+	ErrorKey    string    `json:"errorKey" dynamodbav:"errorKey"`
+	Code        string    `json:"code" dynamodbav:"code"`
+	Detail      string    `json:"detail,omitempty" dynamodbav:"detail,omitempty"`
+	Pin         *int      `json:"pin,omitempty" dynamodbav:"pin,omitempty"`
+	OccurredAt  time.Time `json:"occurredAt" dynamodbav:"occurredAt"`
+	PatternID   string    `json:"patternId,omitempty" dynamodbav:"patternId,omitempty"`
+	PatternName string    `json:"patternName,omitempty" dynamodbav:"patternName,omitempty"`
+	Message     string    `json:"message" dynamodbav:"message"`
+	ExpiresAt   int64     `json:"-" dynamodbav:"expiresAt"` // TTL
+}
+
+// DeviceApply records the last pattern the backend sent to a device, so an
+// error the device reports shortly after can be tied to it
+type DeviceApply struct {
+	PatternID      string    `json:"patternId,omitempty" dynamodbav:"patternId,omitempty"`
+	PatternName    string    `json:"patternName,omitempty" dynamodbav:"patternName,omitempty"`
+	Pins           []int     `json:"pins,omitempty" dynamodbav:"pins,omitempty"`
+	Source         string    `json:"source" dynamodbav:"source"` // Lambda that sent it
+	At             time.Time `json:"at" dynamodbav:"at"`
+	FailedOnDevice bool      `json:"failedOnDevice,omitempty" dynamodbav:"failedOnDevice,omitempty"`
+	DeviceError    string    `json:"deviceError,omitempty" dynamodbav:"deviceError,omitempty"` // Message of the error that failed it
+}
+
+// ParseDeviceErrorEvent builds a DeviceError for device from a gl/error
+// webhook event. The firmware reports physical pins; they're stored as the
+// logical pins strips use. The event's publish time is used when it parses.
+func ParseDeviceErrorEvent(device Device, event ParticleWebhookEvent, now time.Time) (*DeviceError, error) {
+	if event.Event != DeviceErrorEventName {
+		return nil, fmt.Errorf("unsupported event %q", event.Event)
+	}
+
+	var data DeviceErrorData
+	if err := json.Unmarshal([]byte(event.Data), &data); err != nil {
+		return nil, fmt.Errorf("invalid event data: %w", err)
+	}
+	code := strings.ToLower(strings.TrimSpace(data.Code))
+	if code == "" {
+		return nil, fmt.Errorf("event data has no code")
+	}
+
+	if data.Pin != nil {
+		logical := device.LogicalPin(*data.Pin)
+		data.Pin = &logical
+	}
+
+	occurredAt := now
+	if t, err := time.Parse(time.RFC3339, event.PublishedAt); err == nil {
+		occurredAt = t
+	}
+	occurredAt = occurredAt.UTC()
+
+	// Code and pin keep simultaneous errors apart; a webhook retry of the
+	// same event maps to the same key and overwrites rather than duplicates
+	errorKey := occurredAt.Format(deviceErrorKeyLayout) + "#" + code
+	if data.Pin != nil {
+		errorKey += fmt.Sprintf("#%d", *data.Pin)
+	}
+
+	e := &DeviceError{
+		DeviceID:   device.DeviceID,
+		ErrorKey:   errorKey,
+		Code:       code,
+		Detail:     data.Detail,
+		Pin:        data.Pin,
+		OccurredAt: occurredAt,
+		ExpiresAt:  occurredAt.Add(deviceErrorRetention).Unix(),
+	}
+	e.Message = e.describe()
+	return e, nil
+}
+
+// describe is the user-facing summary of the error
+func (e *DeviceError) describe() string {
+	what, ok := deviceErrorMessages[e.Code]
+	if !ok {
+		what = e.Code
+	}
+	if e.PatternID != "" {
+		return fmt.Sprintf("The device rejected this pattern (%s)", what)
+	}
+	if e.Pin != nil {
+		return fmt.Sprintf("Device error on pin D%d: %s", *e.Pin, what)
+	}
+	return "Device error: " + what
+}
+
+// CorrelateDeviceError ties e to the device's last backend apply when it
+// arrived within DeviceErrorCorrelationWindow of it and, if e names a pin,
+// the apply included that pin. It reports whether it did.
+func CorrelateDeviceError(device Device, e *DeviceError) bool {
+	apply := device.LastApply
+	if apply == nil {
+		return false
+	}
+	since := e.OccurredAt.Sub(apply.At)
+	if since < 0 || since > DeviceErrorCorrelationWindow {
+		return false
+	}
+	if e.Pin != nil && len(apply.Pins) > 0 {
+		found := false
+		for _, pin := range apply.Pins {
+			if pin == *e.Pin {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	e.PatternID = apply.PatternID
+	e.PatternName = apply.PatternName
+	e.Message = e.describe()
+	return true
+}
+
+// RecordDeviceError stores e and bumps the device's error counter. When
+// correlated is set, the device's last apply is marked as failed on the device.
+// A no-op when DEVICE_ERRORS_TABLE isn't configured.
+func RecordDeviceError(ctx context.Context, devicesTable string, e *DeviceError, correlated bool) error {
+	if deviceErrorsTable == "" {
+		return nil
+	}
+
+	if err := PutItem(ctx, deviceErrorsTable, e); err != nil {
+		return err
+	}
+
+	client, err := InitDynamoDB()
+	if err != nil {
+		return err
+	}
+
+	occurredAt, err := attributevalue.Marshal(e.OccurredAt)
+	if err != nil {
+		return err
+	}
+	update := "ADD errorCount :one SET lastErrorAt = :at"
+	values := map[string]types.AttributeValue{
+		":one": &types.AttributeValueMemberN{Value: "1"},
+		":at":  occurredAt,
+	}
+	if correlated {
+		update += ", lastApply.failedOnDevice = :true, lastApply.deviceError = :message"
+		values[":true"] = &types.AttributeValueMemberBOOL{Value: true}
+		values[":message"] = &types.AttributeValueMemberS{Value: e.Message}
+	}
+
+	_, err = client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(devicesTable),
+		Key: map[string]types.AttributeValue{
+			"deviceId": &types.AttributeValueMemberS{Value: e.DeviceID},
+		},
+		UpdateExpression:          aws.String(update),
+		ConditionExpression:       aws.String("attribute_exists(deviceId)"),
+		ExpressionAttributeValues: values,
+	})
+	return err
+}
+
+// RecordDeviceApply notes that the backend just sent a pattern to the device.
+// Written with UpdateItem so it doesn't race the callers' device writes.
+func RecordDeviceApply(ctx context.Context, devicesTable, deviceID string, apply DeviceApply) error {
+	client, err := InitDynamoDB()
+	if err != nil {
+		return err
+	}
+
+	item, err := attributevalue.Marshal(apply)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(devicesTable),
+		Key: map[string]types.AttributeValue{
+			"deviceId": &types.AttributeValueMemberS{Value: deviceID},
+		},
+		UpdateExpression:    aws.String("SET lastApply = :apply"),
+		ConditionExpression: aws.String("attribute_exists(deviceId)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":apply": item,
+		},
+	})
+	return err
+}
+
+// ListDeviceErrors returns the device's errors between from and to, newest
+// first, optionally only those with code
+func ListDeviceErrors(ctx context.Context, deviceID, code string, from, to time.Time) ([]DeviceError, error) {
+	if deviceErrorsTable == "" {
+		return []DeviceError{}, nil
+	}
+
+	keyCondition := "deviceId = :deviceId AND errorKey BETWEEN :from AND :to"
+	expressionValues := map[string]types.AttributeValue{
+		":deviceId": &types.AttributeValueMemberS{Value: deviceID},
+		":from":     &types.AttributeValueMemberS{Value: from.UTC().Format(deviceErrorKeyLayout)},
+		":to":       &types.AttributeValueMemberS{Value: to.UTC().Format(deviceErrorKeyLayout) + "~"}, // After any "#" suffix
+	}
+
+	var stored []DeviceError
+	if err := Query(ctx, deviceErrorsTable, nil, keyCondition, expressionValues, &stored); err != nil {
+		return nil, err
+	}
+
+	errs := make([]DeviceError, 0, len(stored))
+	for i := len(stored) - 1; i >= 0; i-- {
+		if code == "" || stored[i].Code == code {
+			errs = append(errs, stored[i])
+		}
+	}
+	return errs, nil
+}
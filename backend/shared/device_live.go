@@ -0,0 +1,144 @@
+package shared
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// particleDeviceTimeout bounds the live device lookup, which is optional:
+// the stored record is returned without it
+const particleDeviceTimeout = 5 * time.Second
+
+// ParticleDeviceStatus is what the Particle cloud reports about a device
+// right now
+type ParticleDeviceStatus struct {
+	Connected             bool       `json:"connected"`
+	LastHeard             *time.Time `json:"lastHeard,omitempty"`             // When the cloud last heard from the device
+	SystemFirmwareVersion string     `json:"systemFirmwareVersion,omitempty"` // Device OS version
+	Name                  string     `json:"name,omitempty"`                  // Name in the Particle console
+	FetchedAt             time.Time  `json:"fetchedAt"`
+}
+
+// particleDeviceResponse is the part of Particle's device info we use
+type particleDeviceResponse struct {
+	Connected             bool       `json:"connected"`
+	LastHeard             *time.Time `json:"last_heard"`
+	SystemFirmwareVersion string     `json:"system_firmware_version"`
+	Name                  string     `json:"name"`
+}
+
+// particleDeviceError is a non-200 response to a device lookup
+type particleDeviceError struct {
+	StatusCode int
+}
+
+// ParticleStatus is the HTTP status, for IsRetryableParticleError
+func (e *particleDeviceError) ParticleStatus() int {
+	return e.StatusCode
+}
+
+func (e *particleDeviceError) Error() string {
+	return fmt.Sprintf("particle device lookup failed (status %d)", e.StatusCode)
+}
+
+// GetParticleDeviceStatus asks Particle for a device's connection status,
+// retrying transient failures (see RetryParticleCall). A rejected token
+// fails with ErrParticleTokenInvalid.
+func GetParticleDeviceStatus(ctx context.Context, particleID, token string) (*ParticleDeviceStatus, error) {
+	var status *ParticleDeviceStatus
+	_, err := RetryParticleCall(ctx, "device", func(ctx context.Context) (err error) {
+		start := time.Now()
+		defer func() { ObserveParticleCall("device", start, err) }()
+
+		ctx, cancel := WithCallTimeout(ctx, particleDeviceTimeout)
+		defer cancel()
+
+		req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/devices/%s", ParticleAPIBase(), particleID), nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return DependencyTimeout("Particle", err)
+		}
+		defer resp.Body.Close()
+
+		body, _ := io.ReadAll(resp.Body)
+		switch {
+		case resp.StatusCode == http.StatusUnauthorized:
+			return ErrParticleTokenInvalid
+		case resp.StatusCode != http.StatusOK:
+			return &particleDeviceError{StatusCode: resp.StatusCode}
+		}
+
+		var parsed particleDeviceResponse
+		if err := json.Unmarshal(body, &parsed); err != nil {
+			return fmt.Errorf("failed to parse particle device info: %v", err)
+		}
+		status = &ParticleDeviceStatus{
+			Connected:             parsed.Connected,
+			LastHeard:             parsed.LastHeard,
+			SystemFirmwareVersion: parsed.SystemFirmwareVersion,
+			Name:                  parsed.Name,
+			FetchedAt:             time.Now().UTC(),
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// DeviceView is a device as GET /api/devices/{deviceId} returns it: the
+// stored record, and with ?live=true the Particle cloud's view merged on top
+type DeviceView struct {
+	Device
+	CachedAt   time.Time             `json:"cachedAt"`             // When the stored record was last written
+	Live       *ParticleDeviceStatus `json:"live,omitempty"`       // What Particle reported, as of Live.FetchedAt
+	LiveFields []string              `json:"liveFields,omitempty"` // Device fields replaced with values from Live
+}
+
+// MergeLiveDeviceStatus lays live over device: isOnline, and lastSeen when
+// Particle has heard from the device. A nil live leaves the stored record.
+func MergeLiveDeviceStatus(device Device, live *ParticleDeviceStatus) DeviceView {
+	view := DeviceView{Device: device, CachedAt: device.UpdatedAt}
+	if live == nil {
+		return view
+	}
+
+	view.Live = live
+	view.IsOnline = live.Connected
+	view.LiveFields = []string{"isOnline"}
+	if live.LastHeard != nil {
+		view.LastSeen = *live.LastHeard
+		view.LiveFields = append(view.LiveFields, "lastSeen")
+	}
+	return view
+}
+
+// LiveDeviceView fetches the device's live status from Particle and merges
+// it over the stored record. If it can't be fetched the stored record is
+// returned with a warning saying why.
+func LiveDeviceView(ctx context.Context, device Device, token string) (DeviceView, []string) {
+	if device.GetManufacturer() != ManufacturerParticle {
+		return MergeLiveDeviceStatus(device, nil), []string{"Live status is only available for Particle devices; showing stored details"}
+	}
+	if token == "" {
+		return MergeLiveDeviceStatus(device, nil), []string{"Particle token not configured; showing stored details"}
+	}
+
+	live, err := GetParticleDeviceStatus(ctx, device.ParticleID, token)
+	if err != nil {
+		log.Printf("Failed to get live status of device %s: %v", device.DeviceID, err)
+		return MergeLiveDeviceStatus(device, nil), []string{fmt.Sprintf("Couldn't reach Particle (%v); showing stored details from %s", err, device.UpdatedAt.UTC().Format(time.RFC3339))}
+	}
+	return MergeLiveDeviceStatus(device, live), nil
+}
@@ -0,0 +1,144 @@
+package shared
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// PlatformMemoryProfile is what the apply memory check assumes about a
+// Particle platform
+type PlatformMemoryProfile struct {
+	DefaultFreeMemory int `json:"defaultFreeMemory"` // Free heap assumed when the device hasn't reported one
+	ReserveBytes      int `json:"reserveBytes"`      // Headroom kept for the system and cloud connection
+}
+
+// PlatformMemoryProfiles holds the memory check thresholds per platform, as
+// named in deviceInfo. Platforms not listed use DefaultPlatformMemoryProfile.
+var PlatformMemoryProfiles = map[string]PlatformMemoryProfile{
+	"photon":   {DefaultFreeMemory: 20 * 1024, ReserveBytes: 8 * 1024},
+	"electron": {DefaultFreeMemory: 20 * 1024, ReserveBytes: 8 * 1024},
+	"argon":    {DefaultFreeMemory: 60 * 1024, ReserveBytes: 12 * 1024},
+	"boron":    {DefaultFreeMemory: 60 * 1024, ReserveBytes: 12 * 1024},
+	"photon2":  {DefaultFreeMemory: 1024 * 1024, ReserveBytes: 64 * 1024},
+}
+
+// DefaultPlatformMemoryProfile is the most constrained profile, for unknown platforms
+var DefaultPlatformMemoryProfile = PlatformMemoryProfiles["photon"]
+
+// Costs behind EstimateBytecodeMemory, in bytes. They are approximations of
+// what the firmware allocates while loading and running a pattern.
+const (
+	memDecodeOverhead    = 64 // setBytecode argument parsing
+	memDecodedSegment    = 24 // One decoded WLED segment
+	memPixelBytesPerLED  = 3  // NeoPixel buffer
+	memEffectBytesPerLED = 2  // Effect state per LED of each segment
+)
+
+// PlatformMemory returns the memory profile for a platform
+func PlatformMemory(platform string) PlatformMemoryProfile {
+	if profile, ok := PlatformMemoryProfiles[strings.ToLower(strings.TrimSpace(platform))]; ok {
+		return profile
+	}
+	return DefaultPlatformMemoryProfile
+}
+
+// ParseDeviceInfoFreeMemory reads the free memory field of a deviceInfo
+// variable ("version|platform|maxStrips|maxLeds|maxColors|freeMem"). Firmware
+// before the field was added doesn't report it.
+func ParseDeviceInfoFreeMemory(deviceInfo string) (int, bool) {
+	parts := strings.Split(deviceInfo, "|")
+	if len(parts) < 6 {
+		return 0, false
+	}
+	freeMem, err := strconv.Atoi(strings.TrimSpace(parts[5]))
+	if err != nil || freeMem <= 0 {
+		return 0, false
+	}
+	return freeMem, true
+}
+
+// BytecodeMemoryEstimate breaks down the memory a pattern needs on a strip
+type BytecodeMemoryEstimate struct {
+	Bytes     int `json:"bytes"`
+	Segments  int `json:"segments"`
+	Colors    int `json:"colors"`
+	LEDCount  int `json:"ledCount"`
+	Bytecode  int `json:"bytecodeBytes"`
+	Available int `json:"availableBytes"` // Free memory less the platform reserve
+}
+
+// Fits reports whether the estimate is within the available memory
+func (e BytecodeMemoryEstimate) Fits() bool {
+	return e.Bytes <= e.Available
+}
+
+// EstimateBytecodeMemory estimates the memory bytecode needs on a strip of
+// ledCount LEDs: the raw and decoded bytecode plus the pixel and effect
+// buffers. Available is left for the caller.
+func EstimateBytecodeMemory(bytecode []byte, ledCount int) BytecodeMemoryEstimate {
+	est := BytecodeMemoryEstimate{
+		Segments: 1,
+		LEDCount: ledCount,
+		Bytecode: len(bytecode),
+	}
+	effectLEDs := ledCount
+
+	if IsWLEDBinary(bytecode) {
+		if state, err := ParseBinaryToWLED(bytecode); err == nil && len(state.Segments) > 0 {
+			est.Segments = len(state.Segments)
+			effectLEDs = 0
+			for _, seg := range state.Segments {
+				if n := seg.Stop - seg.Start; n > 0 {
+					effectLEDs += n
+				}
+				est.Colors += len(seg.Colors)
+			}
+		}
+	}
+
+	// The decoded argument and the stored copy both hold the bytecode
+	est.Bytes = memDecodeOverhead + 2*len(bytecode) +
+		est.Segments*memDecodedSegment +
+		ledCount*memPixelBytesPerLED +
+		effectLEDs*memEffectBytesPerLED
+	return est
+}
+
+// MemoryLimitError is returned when a pattern is estimated not to fit in a
+// device's memory
+type MemoryLimitError struct {
+	Platform string
+	Estimate BytecodeMemoryEstimate
+}
+
+func (e *MemoryLimitError) Error() string {
+	return fmt.Sprintf("pattern needs about %d bytes (%d segments, %d colors, %d LEDs) but this %s has about %d bytes to spare; use fewer segments or colors",
+		e.Estimate.Bytes, e.Estimate.Segments, e.Estimate.Colors, e.Estimate.LEDCount, e.Platform, e.Estimate.Available)
+}
+
+// CheckBytecodeMemory estimates bytecode's memory on a strip of device and
+// returns a *MemoryLimitError if it exceeds the device's free memory less
+// its platform's reserve. Devices that haven't reported free memory are
+// assumed to have the platform default.
+func CheckBytecodeMemory(device Device, bytecode []byte, ledCount int) (BytecodeMemoryEstimate, error) {
+	profile := PlatformMemory(device.Platform)
+	free := device.FreeMemory
+	if free <= 0 {
+		free = profile.DefaultFreeMemory
+	}
+
+	est := EstimateBytecodeMemory(bytecode, ledCount)
+	est.Available = free - profile.ReserveBytes
+	if est.Available < 0 {
+		est.Available = 0
+	}
+	if !est.Fits() {
+		platform := device.Platform
+		if platform == "" {
+			platform = "device"
+		}
+		return est, &MemoryLimitError{Platform: platform, Estimate: est}
+	}
+	return est, nil
+}
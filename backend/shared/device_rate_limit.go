@@ -0,0 +1,261 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+var deviceRateLimitsTable = os.Getenv("DEVICE_RATE_LIMITS_TABLE")
+
+// Cloud function call rate limits per device: a burst of CommandBurst calls,
+// then CommandsPerMinute sustained. Devices without their own get the
+// defaults, which a Photon handles without locking up.
+const (
+	DefaultCommandBurst      = 5
+	MinCommandBurst          = 1
+	MaxCommandBurst          = 20
+	DefaultCommandsPerMinute = 60
+	MinCommandsPerMinute     = 6
+	MaxCommandsPerMinute     = 300
+)
+
+// DefaultMaxCommandRateWait is how long a TimedCaller waits for the device's
+// rate limit before failing the call with a *DeviceRateLimitError
+const DefaultMaxCommandRateWait = 3 * time.Second
+
+// rateLimitWriteAttempts bounds retries when another invocation updates a
+// device's limit between our read and write
+const rateLimitWriteAttempts = 3
+
+// DeviceRateLimitError is a call refused because the device has been sent
+// too many commands. Handlers return it as 429.
+type DeviceRateLimitError struct {
+	DeviceName string
+	RetryAfter time.Duration
+}
+
+func (e *DeviceRateLimitError) Error() string {
+	return fmt.Sprintf("device %s is being commanded too quickly; retry in %ds", e.DeviceName, int(math.Ceil(e.RetryAfter.Seconds())))
+}
+
+// IsDeviceRateLimited reports whether err is, or wraps, a *DeviceRateLimitError
+func IsDeviceRateLimited(err error) bool {
+	var rateErr *DeviceRateLimitError
+	return errors.As(err, &rateErr)
+}
+
+// ValidateCommandRateLimit checks a requested per-device burst and sustained
+// rate. 0 leaves either at its default.
+func ValidateCommandRateLimit(burst, perMinute int) error {
+	if burst != 0 && (burst < MinCommandBurst || burst > MaxCommandBurst) {
+		return fmt.Errorf("commandBurst must be between %d and %d", MinCommandBurst, MaxCommandBurst)
+	}
+	if perMinute != 0 && (perMinute < MinCommandsPerMinute || perMinute > MaxCommandsPerMinute) {
+		return fmt.Errorf("commandsPerMinute must be between %d and %d", MinCommandsPerMinute, MaxCommandsPerMinute)
+	}
+	return nil
+}
+
+// CommandRateLimit is the device's burst size and the interval between calls
+// at its sustained rate
+func (d Device) CommandRateLimit() (burst int, interval time.Duration) {
+	burst, perMinute := d.CommandBurst, d.CommandsPerMinute
+	if burst == 0 {
+		burst = DefaultCommandBurst
+	}
+	if perMinute == 0 {
+		perMinute = DefaultCommandsPerMinute
+	}
+	return burst, time.Minute / time.Duration(perMinute)
+}
+
+// CommandSpacing is how long the given number of calls to the device take at
+// its sustained rate, once its burst is used up
+func (d Device) CommandSpacing(calls int) time.Duration {
+	_, interval := d.CommandRateLimit()
+	return time.Duration(calls) * interval
+}
+
+// The limit is a token bucket kept as a GCRA theoretical arrival time: each
+// call pushes the device's TAT one interval later (from now, if it's in the
+// past), and a call may go once TAT is no more than burst intervals ahead.
+// Calls that must wait reserve their slot, so concurrent callers queue up
+// rather than all firing when the bucket refills.
+
+// rateReservation is the outcome of taking n slots from a device's bucket
+func rateReservation(tat, now time.Time, calls, burst int, interval time.Duration) (newTAT time.Time, wait time.Duration) {
+	if tat.Before(now) {
+		tat = now
+	}
+	newTAT = tat.Add(time.Duration(calls) * interval)
+	allowAt := newTAT.Add(-time.Duration(burst) * interval)
+	if allowAt.After(now) {
+		wait = allowAt.Sub(now)
+	}
+	return newTAT, wait
+}
+
+// localRateLimits is this container's view of each device's TAT. It answers
+// when DynamoDB can't, and fails floods fast without a round trip.
+var localRateLimits = struct {
+	sync.Mutex
+	tat map[string]time.Time
+}{tat: make(map[string]time.Time)}
+
+func localTAT(deviceID string) time.Time {
+	localRateLimits.Lock()
+	defer localRateLimits.Unlock()
+	return localRateLimits.tat[deviceID]
+}
+
+func setLocalTAT(deviceID string, tat time.Time) {
+	localRateLimits.Lock()
+	defer localRateLimits.Unlock()
+	if tat.After(localRateLimits.tat[deviceID]) {
+		localRateLimits.tat[deviceID] = tat
+	}
+}
+
+// DeviceCommandSchedule is how long from now each of the given number of
+// further calls to the device would have to wait, given the calls already
+// made to it. Nothing is reserved; callers use it to spread planned calls out
+// rather than have them refused part way through.
+func DeviceCommandSchedule(ctx context.Context, device Device, calls int) []time.Duration {
+	burst, interval := device.CommandRateLimit()
+	tat := localTAT(device.DeviceID)
+	if stored, err := storedTAT(ctx, device.DeviceID); err != nil {
+		log.Printf("Failed to read rate limit for device %s, using this container's: %v", device.Name, err)
+	} else if stored.After(tat) {
+		tat = stored
+	}
+
+	now := time.Now()
+	schedule := make([]time.Duration, calls)
+	for i := range schedule {
+		_, schedule[i] = rateReservation(tat, now, i+1, burst, interval)
+	}
+	return schedule
+}
+
+// DeviceCommandDelay is how long from now until the given number of further
+// calls to the device could all have been sent (see DeviceCommandSchedule)
+func DeviceCommandDelay(ctx context.Context, device Device, calls int) time.Duration {
+	if calls < 1 {
+		return 0
+	}
+	schedule := DeviceCommandSchedule(ctx, device, calls)
+	return schedule[calls-1]
+}
+
+// ReserveDeviceCommand takes a call slot from the device's rate limit,
+// returning how long to wait before making the call. If the wait would be
+// longer than maxWait nothing is reserved and a *DeviceRateLimitError is
+// returned. The DynamoDB record is authoritative; if it can't be reached
+// this container's record is used, so an outage doesn't stop every command.
+func ReserveDeviceCommand(ctx context.Context, device Device, maxWait time.Duration) (time.Duration, error) {
+	burst, interval := device.CommandRateLimit()
+	now := time.Now()
+
+	// A flood from this container is turned away without a DynamoDB call
+	newTAT, wait := rateReservation(localTAT(device.DeviceID), now, 1, burst, interval)
+	if wait > maxWait {
+		return 0, &DeviceRateLimitError{DeviceName: device.Name, RetryAfter: wait}
+	}
+
+	for attempt := 1; attempt <= rateLimitWriteAttempts; attempt++ {
+		stored, err := storedTAT(ctx, device.DeviceID)
+		if err != nil {
+			log.Printf("Failed to read rate limit for device %s, using this container's: %v", device.Name, err)
+			break
+		}
+		now = time.Now()
+		newTAT, wait = rateReservation(stored, now, 1, burst, interval)
+		if wait > maxWait {
+			setLocalTAT(device.DeviceID, stored)
+			return 0, &DeviceRateLimitError{DeviceName: device.Name, RetryAfter: wait}
+		}
+
+		err = storeTAT(ctx, device.DeviceID, stored, newTAT)
+		var conflict *types.ConditionalCheckFailedException
+		if errors.As(err, &conflict) {
+			continue
+		}
+		if err != nil {
+			log.Printf("Failed to save rate limit for device %s, using this container's: %v", device.Name, err)
+		}
+		break
+	}
+
+	setLocalTAT(device.DeviceID, newTAT)
+	return wait, nil
+}
+
+// storedTAT reads the device's TAT from DynamoDB; zero when there's none
+func storedTAT(ctx context.Context, deviceID string) (time.Time, error) {
+	client, err := InitDynamoDB()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	result, err := client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(deviceRateLimitsTable),
+		Key: map[string]types.AttributeValue{
+			"deviceId": &types.AttributeValueMemberS{Value: deviceID},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	attr, ok := result.Item["tat"].(*types.AttributeValueMemberN)
+	if !ok {
+		return time.Time{}, nil
+	}
+	ms, err := strconv.ParseInt(attr.Value, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.UnixMilli(ms), nil
+}
+
+// storeTAT replaces the device's TAT, on condition it is still previous
+func storeTAT(ctx context.Context, deviceID string, previous, tat time.Time) error {
+	client, err := InitDynamoDB()
+	if err != nil {
+		return err
+	}
+
+	condition := "attribute_not_exists(tat)"
+	values := map[string]types.AttributeValue{
+		":tat": &types.AttributeValueMemberN{Value: strconv.FormatInt(tat.UnixMilli(), 10)},
+		// Kept a little past the TAT; after that the bucket is full anyway
+		":expires": &types.AttributeValueMemberN{Value: strconv.FormatInt(tat.Add(time.Hour).Unix(), 10)},
+	}
+	if !previous.IsZero() {
+		condition = "tat = :previous"
+		values[":previous"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(previous.UnixMilli(), 10)}
+	}
+
+	_, err = client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(deviceRateLimitsTable),
+		Key: map[string]types.AttributeValue{
+			"deviceId": &types.AttributeValueMemberS{Value: deviceID},
+		},
+		UpdateExpression:          aws.String("SET tat = :tat, expiresAt = :expires"),
+		ConditionExpression:       aws.String(condition),
+		ExpressionAttributeValues: values,
+	})
+	return err
+}
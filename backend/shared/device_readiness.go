@@ -0,0 +1,72 @@
+package shared
+
+import "time"
+
+// Device readiness statuses, stored as Device.ReadinessStatus. Only
+// ReadinessNoFirmwareVariable means the firmware needs flashing.
+const (
+	ReadinessReady              = "ready"                // deviceInfo read and valid
+	ReadinessNoFirmwareVariable = "no_firmware_variable" // Device answered but has no usable deviceInfo
+	ReadinessOffline            = "offline"              // Device isn't connected to the Particle cloud
+	ReadinessTransientError     = "transient_error"      // The check itself failed; try again
+)
+
+// DeviceReadiness is the outcome of one readiness check. The firmware
+// details are set when Status is ReadinessReady.
+type DeviceReadiness struct {
+	Status          string `json:"status"`
+	Message         string `json:"message,omitempty"` // Underlying error, if any
+	FirmwareVersion string `json:"firmwareVersion,omitempty"`
+	Platform        string `json:"platform,omitempty"`
+	FreeMemory      int    `json:"freeMemory,omitempty"`
+	MaxStrips       int    `json:"maxStrips,omitempty"`
+	MaxLEDs         int    `json:"maxLedsPerStrip,omitempty"`
+}
+
+// wasReady reports whether the device's last known status is ready. Records
+// from before ReadinessStatus existed only have IsReady.
+func (d *Device) wasReady() bool {
+	return d.ReadinessStatus == ReadinessReady || (d.ReadinessStatus == "" && d.IsReady)
+}
+
+// ApplyReadiness records a readiness check on the device. A transient error
+// doesn't overwrite a known ready status: the device stays ready, the error
+// is kept in ReadinessMessage, and ReadinessStaleSince marks when checks
+// started failing. Firmware details are only updated from a ready check.
+func (d *Device) ApplyReadiness(r DeviceReadiness, now time.Time) {
+	if r.Status == ReadinessTransientError && d.wasReady() {
+		d.ReadinessStatus = ReadinessReady
+		d.IsReady = true
+		d.ReadinessMessage = r.Message
+		if d.ReadinessStaleSince == nil {
+			d.ReadinessStaleSince = &now
+		}
+		return
+	}
+
+	d.ReadinessStatus = r.Status
+	d.IsReady = r.Status == ReadinessReady
+	d.ReadinessMessage = r.Message
+	d.ReadinessCheckedAt = &now
+	d.ReadinessStaleSince = nil
+
+	if r.Status != ReadinessReady {
+		return
+	}
+	if r.FirmwareVersion != "" {
+		d.FirmwareVersion = r.FirmwareVersion
+	}
+	d.FirmwareAdvisory = FirmwareAdvisoryFor(d.FirmwareVersion)
+	if r.Platform != "" {
+		d.Platform = r.Platform
+	}
+	if r.FreeMemory > 0 {
+		d.FreeMemory = r.FreeMemory
+	}
+	if r.MaxStrips > 0 {
+		d.MaxStrips = r.MaxStrips
+	}
+	if r.MaxLEDs > 0 {
+		d.MaxLEDs = r.MaxLEDs
+	}
+}
@@ -0,0 +1,76 @@
+package shared
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Icons a device or virtual group can show on the dashboard
+var DisplayIcons = []string{
+	"argon", "boron", "bulb", "candle", "door", "garage", "group",
+	"house", "lamp", "photon", "star", "strip", "tree", "wled",
+}
+
+// Icons used when none is set: devices go by platform, groups get "group"
+const (
+	DefaultDeviceIcon = "bulb"
+	DefaultGroupIcon  = "group"
+)
+
+// platformIcons is the default icon for a device platform
+var platformIcons = map[string]string{
+	"photon":   "photon",
+	"photon2":  "photon",
+	"electron": "photon",
+	"argon":    "argon",
+	"boron":    "boron",
+}
+
+// NormalizeIcon validates an icon from a request, lowercased. "" clears it.
+func NormalizeIcon(icon string) (string, error) {
+	icon = strings.ToLower(strings.TrimSpace(icon))
+	if icon == "" {
+		return "", nil
+	}
+	for _, allowed := range DisplayIcons {
+		if icon == allowed {
+			return icon, nil
+		}
+	}
+	return "", fmt.Errorf("icon must be one of: %s", strings.Join(DisplayIcons, ", "))
+}
+
+// NormalizeAccentColor validates an accent color from a request as
+// "#RRGGBB" (see NormalizeHexColor). "" clears it.
+func NormalizeAccentColor(color string) (string, error) {
+	if strings.TrimSpace(color) == "" {
+		return "", nil
+	}
+	normalized, err := NormalizeHexColor(strings.TrimSpace(color))
+	if err != nil {
+		return "", fmt.Errorf("accentColor: %v", err)
+	}
+	return normalized, nil
+}
+
+// DisplayIcon is the device's icon, or the default for its platform
+func (d Device) DisplayIcon() string {
+	if d.Icon != "" {
+		return d.Icon
+	}
+	if d.GetManufacturer() == ManufacturerWLED {
+		return "wled"
+	}
+	if icon, ok := platformIcons[strings.ToLower(d.Platform)]; ok {
+		return icon
+	}
+	return DefaultDeviceIcon
+}
+
+// DisplayIcon is the group's icon, or DefaultGroupIcon
+func (g VirtualGroup) DisplayIcon() string {
+	if g.Icon != "" {
+		return g.Icon
+	}
+	return DefaultGroupIcon
+}
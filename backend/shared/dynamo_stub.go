@@ -0,0 +1,309 @@
+package shared
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// ErrDynamoDBStubConditionFailed, returned by a DynamoDBStubHandler, fails the
+// call with a ConditionalCheckFailedException
+var ErrDynamoDBStubConditionFailed = errors.New("the conditional request failed")
+
+// ErrDynamoDBStubThrottled, returned by a DynamoDBStubHandler, fails the call
+// with a ProvisionedThroughputExceededException
+var ErrDynamoDBStubThrottled = errors.New("the level of configured provisioned throughput for the table was exceeded")
+
+// DynamoDBStubCall is a request made to a stubbed DynamoDB (see StubDynamoDB)
+type DynamoDBStubCall struct {
+	Operation string // "GetItem", "PutItem", "UpdateItem", ...
+	Input     map[string]json.RawMessage
+}
+
+// DynamoDBStubHandler answers a stubbed call with the fields of its response,
+// such as {"Item": DynamoDBStubItem(user)}; nil is an empty response. An
+// error fails the call: ErrDynamoDBStubConditionFailed as a conditional check
+// failure, ErrDynamoDBStubThrottled as throttling, anything else as a
+// ValidationException.
+type DynamoDBStubHandler func(call DynamoDBStubCall) (map[string]interface{}, error)
+
+// StubDynamoDB points the shared DynamoDB client at an in-process server that
+// passes every call to handle, for tests. Calls aren't retried. restore puts
+// back the previous client.
+func StubDynamoDB(handle DynamoDBStubHandler) (restore func()) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		call := DynamoDBStubCall{Operation: r.Header.Get("X-Amz-Target")}
+		if i := strings.LastIndexByte(call.Operation, '.'); i >= 0 {
+			call.Operation = call.Operation[i+1:]
+		}
+		body, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &call.Input); err != nil {
+			writeDynamoDBStubError(w, "SerializationException", err.Error())
+			return
+		}
+
+		response, err := handle(call)
+		switch {
+		case errors.Is(err, ErrDynamoDBStubConditionFailed):
+			writeDynamoDBStubError(w, "ConditionalCheckFailedException", err.Error())
+			return
+		case errors.Is(err, ErrDynamoDBStubThrottled):
+			writeDynamoDBStubError(w, "ProvisionedThroughputExceededException", err.Error())
+			return
+		case err != nil:
+			writeDynamoDBStubError(w, "ValidationException", err.Error())
+			return
+		case response == nil:
+			response = map[string]interface{}{}
+		}
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		json.NewEncoder(w).Encode(response)
+	}))
+
+	previous := dynamoClient
+	dynamoClient = dynamodb.New(dynamodb.Options{
+		Region:           "us-east-1",
+		BaseEndpoint:     aws.String(server.URL),
+		Credentials:      aws.AnonymousCredentials{},
+		RetryMaxAttempts: 1,
+	})
+	return func() {
+		dynamoClient = previous
+		server.Close()
+	}
+}
+
+func writeDynamoDBStubError(w http.ResponseWriter, errorType, message string) {
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{
+		"__type":  "com.amazonaws.dynamodb.v20120810#" + errorType,
+		"message": message,
+	})
+}
+
+// Table is the call's TableName
+func (c DynamoDBStubCall) Table() string {
+	return c.String("TableName")
+}
+
+// String is a string field of the call, such as ConditionExpression; "" when
+// it isn't set
+func (c DynamoDBStubCall) String(field string) string {
+	var s string
+	json.Unmarshal(c.Input[field], &s)
+	return s
+}
+
+// Attributes decodes an attribute map field of the call, such as Key, Item or
+// ExpressionAttributeValues
+func (c DynamoDBStubCall) Attributes(field string) (map[string]types.AttributeValue, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(c.Input[field], &raw); err != nil {
+		return nil, fmt.Errorf("%s: %v", field, err)
+	}
+	return attributeMapFromWire(raw)
+}
+
+// Unmarshal decodes an attribute map field of the call into v, as
+// attributevalue.UnmarshalMap does
+func (c DynamoDBStubCall) Unmarshal(field string, v interface{}) error {
+	attrs, err := c.Attributes(field)
+	if err != nil {
+		return err
+	}
+	return attributevalue.UnmarshalMap(attrs, v)
+}
+
+// DynamoDBStubItem is v as an attribute map in a stub response, marshaled as
+// attributevalue.MarshalMap does. It panics if v can't be marshaled.
+func DynamoDBStubItem(v interface{}) map[string]interface{} {
+	attrs, err := attributevalue.MarshalMap(v)
+	if err != nil {
+		panic(err)
+	}
+	return attributeMapToWire(attrs)
+}
+
+// DynamoDBStubItems is DynamoDBStubItem for each of items, for the Items of a
+// Query or Scan response
+func DynamoDBStubItems(items ...interface{}) []interface{} {
+	wire := make([]interface{}, len(items))
+	for i, item := range items {
+		wire[i] = DynamoDBStubItem(item)
+	}
+	return wire
+}
+
+func attributeMapToWire(attrs map[string]types.AttributeValue) map[string]interface{} {
+	wire := make(map[string]interface{}, len(attrs))
+	for name, attr := range attrs {
+		wire[name] = attributeToWire(attr)
+	}
+	return wire
+}
+
+func attributeToWire(attr types.AttributeValue) interface{} {
+	switch v := attr.(type) {
+	case *types.AttributeValueMemberS:
+		return map[string]interface{}{"S": v.Value}
+	case *types.AttributeValueMemberN:
+		return map[string]interface{}{"N": v.Value}
+	case *types.AttributeValueMemberBOOL:
+		return map[string]interface{}{"BOOL": v.Value}
+	case *types.AttributeValueMemberNULL:
+		return map[string]interface{}{"NULL": true}
+	case *types.AttributeValueMemberB:
+		return map[string]interface{}{"B": base64.StdEncoding.EncodeToString(v.Value)}
+	case *types.AttributeValueMemberSS:
+		return map[string]interface{}{"SS": v.Value}
+	case *types.AttributeValueMemberNS:
+		return map[string]interface{}{"NS": v.Value}
+	case *types.AttributeValueMemberBS:
+		encoded := make([]string, len(v.Value))
+		for i, b := range v.Value {
+			encoded[i] = base64.StdEncoding.EncodeToString(b)
+		}
+		return map[string]interface{}{"BS": encoded}
+	case *types.AttributeValueMemberL:
+		list := make([]interface{}, len(v.Value))
+		for i, item := range v.Value {
+			list[i] = attributeToWire(item)
+		}
+		return map[string]interface{}{"L": list}
+	case *types.AttributeValueMemberM:
+		return map[string]interface{}{"M": attributeMapToWire(v.Value)}
+	}
+	panic(fmt.Sprintf("unsupported attribute value %T", attr))
+}
+
+func attributeMapFromWire(raw map[string]json.RawMessage) (map[string]types.AttributeValue, error) {
+	attrs := make(map[string]types.AttributeValue, len(raw))
+	for name, value := range raw {
+		attr, err := attributeFromWire(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		attrs[name] = attr
+	}
+	return attrs, nil
+}
+
+func attributeFromWire(raw json.RawMessage) (types.AttributeValue, error) {
+	var typed map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &typed); err != nil {
+		return nil, err
+	}
+	if len(typed) != 1 {
+		keys := make([]string, 0, len(typed))
+		for k := range typed {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		return nil, fmt.Errorf("attribute value must have one type, has %v", keys)
+	}
+
+	for kind, value := range typed {
+		switch kind {
+		case "S":
+			var s string
+			err := json.Unmarshal(value, &s)
+			return &types.AttributeValueMemberS{Value: s}, err
+		case "N":
+			var n string
+			err := json.Unmarshal(value, &n)
+			return &types.AttributeValueMemberN{Value: n}, err
+		case "BOOL":
+			var b bool
+			err := json.Unmarshal(value, &b)
+			return &types.AttributeValueMemberBOOL{Value: b}, err
+		case "NULL":
+			return &types.AttributeValueMemberNULL{Value: true}, nil
+		case "B":
+			var b []byte
+			err := json.Unmarshal(value, &b)
+			return &types.AttributeValueMemberB{Value: b}, err
+		case "SS":
+			var ss []string
+			err := json.Unmarshal(value, &ss)
+			return &types.AttributeValueMemberSS{Value: ss}, err
+		case "NS":
+			var ns []string
+			err := json.Unmarshal(value, &ns)
+			return &types.AttributeValueMemberNS{Value: ns}, err
+		case "BS":
+			var bs [][]byte
+			err := json.Unmarshal(value, &bs)
+			return &types.AttributeValueMemberBS{Value: bs}, err
+		case "L":
+			var items []json.RawMessage
+			if err := json.Unmarshal(value, &items); err != nil {
+				return nil, err
+			}
+			list := make([]types.AttributeValue, len(items))
+			for i, item := range items {
+				attr, err := attributeFromWire(item)
+				if err != nil {
+					return nil, err
+				}
+				list[i] = attr
+			}
+			return &types.AttributeValueMemberL{Value: list}, nil
+		case "M":
+			var m map[string]json.RawMessage
+			if err := json.Unmarshal(value, &m); err != nil {
+				return nil, err
+			}
+			attrs, err := attributeMapFromWire(m)
+			return &types.AttributeValueMemberM{Value: attrs}, err
+		default:
+			return nil, fmt.Errorf("unsupported attribute type %q", kind)
+		}
+	}
+	return nil, nil
+}
+
+// StubOwnershipHandler is a DynamoDBStubHandler for tests of how handlers
+// treat other users' resources. The session "session-"+username signs in
+// username; a GetItem whose key value is foreignID finds an item with just
+// that key, owned by owner. Everything else reads as missing.
+func StubOwnershipHandler(username, foreignID, owner string) DynamoDBStubHandler {
+	return func(call DynamoDBStubCall) (map[string]interface{}, error) {
+		if call.Operation != "GetItem" {
+			return nil, nil
+		}
+		var key map[string]interface{}
+		if err := call.Unmarshal("Key", &key); err != nil {
+			return nil, err
+		}
+		switch {
+		case key["sessionId"] == "session-"+username:
+			return map[string]interface{}{"Item": DynamoDBStubItem(Session{
+				SessionID: "session-" + username,
+				Username:  username,
+				CreatedAt: time.Now(),
+				ExpiresAt: time.Now().Add(time.Hour).Unix(),
+			})}, nil
+		case key["username"] == username:
+			return map[string]interface{}{"Item": DynamoDBStubItem(User{Username: username, IsActive: true})}, nil
+		}
+		for name, value := range key {
+			if value == foreignID {
+				return map[string]interface{}{"Item": DynamoDBStubItem(map[string]string{name: foreignID, "userId": owner})}, nil
+			}
+		}
+		return nil, nil
+	}
+}
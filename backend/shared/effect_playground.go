@@ -0,0 +1,185 @@
+package shared
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Defaults for CompileParams fields left out of a request
+const (
+	PlaygroundDefaultLEDCount   = 8
+	PlaygroundDefaultBrightness = 255
+	playgroundDefaultParam      = 128 // sx and ix, as WLED defaults them
+)
+
+// CompileParamsRequest is the body of POST /api/glowblaster/compile-params:
+// one effect's raw parameters, compiled without a saved pattern so the
+// pattern editor can preview as sliders move. Parameters the effect doesn't
+// use are dropped with a warning.
+type CompileParamsRequest struct {
+	EffectID   *int     `json:"effectId,omitempty"`   // WLED effect ID; takes precedence over EffectName
+	EffectName string   `json:"effectName,omitempty"` // Effect name ("fire") or display name ("Fire 2012")
+	Speed      *int     `json:"speed,omitempty"`      // sx, 0-255; 128 when the effect uses it and it's omitted
+	Intensity  *int     `json:"intensity,omitempty"`  // ix, 0-255; 128 when the effect uses it and it's omitted
+	Custom1    *int     `json:"custom1,omitempty"`    // c1, 0-255
+	Custom2    *int     `json:"custom2,omitempty"`    // c2, 0-255
+	Custom3    *int     `json:"custom3,omitempty"`    // c3, 0-255
+	Colors     []string `json:"colors,omitempty"`     // Hex colors ("#FF8800"); white (then black) when omitted
+	PaletteID  *int     `json:"paletteId,omitempty"`  // WLED palette ID
+	LEDCount   int      `json:"ledCount,omitempty"`   // 1 to MaxLEDsCeiling; PlaygroundDefaultLEDCount when omitted
+	Brightness *int     `json:"brightness,omitempty"` // A BrightnessByte (0-255); full when omitted
+}
+
+// CompileParamsResponse is the result of compiling a CompileParamsRequest
+type CompileParamsResponse struct {
+	Success  bool       `json:"success"`
+	Bytecode []byte     `json:"bytecode,omitempty"`
+	Errors   []string   `json:"errors,omitempty"`
+	Warnings []string   `json:"warnings,omitempty"`
+	State    *WLEDState `json:"state,omitempty"`  // The single-segment state that was compiled
+	Frames   [][]string `json:"frames,omitempty"` // With ?includeFrames=N, N simulated frames of hex colors, SimulatorFrameMs apart
+}
+
+// ResolveEffect finds an effect by ID, or failing that by name: a short
+// name from EffectNameMap or the effect's display name, in any case
+func ResolveEffect(id *int, name string) (EffectMetadata, error) {
+	if id != nil {
+		meta, ok := GetEffectMetadata(*id)
+		if !ok {
+			return EffectMetadata{}, fmt.Errorf("unsupported effect ID %d", *id)
+		}
+		return meta, nil
+	}
+
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return EffectMetadata{}, fmt.Errorf("effectId or effectName is required")
+	}
+	if effectID, ok := GetEffectByName(name); ok {
+		if meta, ok := GetEffectMetadata(effectID); ok {
+			return meta, nil
+		}
+	}
+	for _, meta := range SupportedEffects {
+		if strings.EqualFold(meta.Name, name) {
+			return meta, nil
+		}
+	}
+	return EffectMetadata{}, fmt.Errorf("unknown effect %q", name)
+}
+
+// BuildPlaygroundState builds the single-segment WLED state for req,
+// checked against the effect's metadata. Out-of-range values are errors;
+// parameters the effect doesn't use are left out, with a warning each.
+func BuildPlaygroundState(req CompileParamsRequest) (*WLEDState, []string, []string) {
+	var warnings, errors []string
+
+	meta, err := ResolveEffect(req.EffectID, req.EffectName)
+	if err != nil {
+		return nil, nil, []string{err.Error()}
+	}
+
+	// param applies value to a parameter the effect may not use
+	param := func(name string, value *int, used bool, fallback int) int {
+		if value == nil {
+			if used {
+				return fallback
+			}
+			return 0
+		}
+		if !used {
+			warnings = append(warnings, fmt.Sprintf("%s doesn't use %s; ignored", meta.Name, name))
+			return 0
+		}
+		if *value < 0 || *value > 255 {
+			errors = append(errors, fmt.Sprintf("%s %d out of range (0-255)", name, *value))
+		}
+		return *value
+	}
+
+	seg := WLEDSegment{
+		EffectID:  meta.ID,
+		Speed:     param("speed", req.Speed, meta.HasSpeed, playgroundDefaultParam),
+		Intensity: param("intensity", req.Intensity, meta.HasIntensity, playgroundDefaultParam),
+		Custom1:   param("custom1", req.Custom1, meta.HasCustom1, 0),
+		Custom2:   param("custom2", req.Custom2, meta.HasCustom2, 0),
+		Custom3:   param("custom3", req.Custom3, meta.HasCustom3, 0),
+		PaletteID: param("paletteId", req.PaletteID, meta.UsesPalette, 0),
+		On:        true,
+	}
+
+	colors := req.Colors
+	if meta.MaxColors > 0 && len(colors) > meta.MaxColors {
+		warnings = append(warnings, fmt.Sprintf("%s uses only the first %d of %d colors; the rest were ignored", meta.Name, meta.MaxColors, len(colors)))
+		colors = colors[:meta.MaxColors]
+	}
+	if len(colors) < meta.MinColors && len(colors) > 0 {
+		errors = append(errors, fmt.Sprintf("%s needs at least %d colors", meta.Name, meta.MinColors))
+	}
+	for i, hex := range colors {
+		r, g, b, err := parseHexColor(hex)
+		if err != nil {
+			errors = append(errors, fmt.Sprintf("colors[%d]: invalid hex color %q", i, hex))
+			continue
+		}
+		seg.Colors = append(seg.Colors, []int{int(r), int(g), int(b)})
+	}
+	if len(req.Colors) == 0 {
+		// White, then black for any further colors the effect needs
+		seg.Colors = [][]int{{255, 255, 255}}
+		for len(seg.Colors) < meta.MinColors {
+			seg.Colors = append(seg.Colors, []int{0, 0, 0})
+		}
+	}
+
+	ledCount := req.LEDCount
+	if ledCount == 0 {
+		ledCount = PlaygroundDefaultLEDCount
+	}
+	if ledCount < 0 || ledCount > MaxLEDsCeiling {
+		errors = append(errors, fmt.Sprintf("ledCount must be between 1 and %d", MaxLEDsCeiling))
+	}
+	seg.Stop = ledCount
+
+	brightness := PlaygroundDefaultBrightness
+	if req.Brightness != nil {
+		brightness = *req.Brightness
+	}
+
+	state := &WLEDState{
+		On:         true,
+		Brightness: brightness,
+		Segments:   []WLEDSegment{seg},
+	}
+	if len(errors) == 0 {
+		_, errors = ValidateWLEDState(state)
+	}
+	return state, warnings, errors
+}
+
+// CompilePlaygroundState compiles a state from BuildPlaygroundState,
+// returning the binary and any color warnings
+func CompilePlaygroundState(state *WLEDState) ([]byte, []string, error) {
+	binary, err := CompileWLEDToBinary(state)
+	if err != nil {
+		return nil, nil, err
+	}
+	return binary, wledColorWarnings(state), nil
+}
+
+// SimulateWLEDFramesHex is SimulateWLEDFrames with each LED as a hex color
+func SimulateWLEDFramesHex(state *WLEDState, frameCount, ledCount int) ([][]string, error) {
+	frames, err := SimulateWLEDFrames(state, frameCount, ledCount)
+	if err != nil {
+		return nil, err
+	}
+
+	hexFrames := make([][]string, len(frames))
+	for i, frame := range frames {
+		hexFrames[i] = make([]string, len(frame))
+		for j, c := range frame {
+			hexFrames[i][j] = fmt.Sprintf("#%02X%02X%02X", c.R, c.G, c.B)
+		}
+	}
+	return hexFrames, nil
+}
@@ -0,0 +1,93 @@
+package shared
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// emailLinkSecret signs the unsubscribe links in emails. Without it emails
+// that need one aren't sent.
+var emailLinkSecret = os.Getenv("EMAIL_LINK_SECRET")
+
+// Emails a user can unsubscribe from with a link
+const (
+	EmailWeeklySummary = "weekly_summary"
+)
+
+var (
+	// ErrEmailLinksNotConfigured is returned when EMAIL_LINK_SECRET is missing
+	ErrEmailLinksNotConfigured = errors.New("email links are not configured")
+	// ErrInvalidUnsubscribeToken covers malformed and tampered tokens
+	ErrInvalidUnsubscribeToken = errors.New("invalid unsubscribe link")
+)
+
+// UnsubscribeTarget is what an unsubscribe token carries: the user and the
+// email they stop receiving. Tokens don't expire, so old emails keep working.
+type UnsubscribeTarget struct {
+	UserID string `json:"u"`
+	Email  string `json:"e"` // EmailWeeklySummary
+}
+
+// EmailLinksEnabled reports whether unsubscribe tokens can be issued
+func EmailLinksEnabled() bool {
+	return emailLinkSecret != ""
+}
+
+// IssueUnsubscribeToken signs t as "<payload>.<signature>", both base64url
+func IssueUnsubscribeToken(t UnsubscribeTarget) (string, error) {
+	if !EmailLinksEnabled() {
+		return "", ErrEmailLinksNotConfigured
+	}
+
+	payload, err := json.Marshal(t)
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(signEmailLink(encoded)), nil
+}
+
+// ParseUnsubscribeToken verifies token and returns its target
+func ParseUnsubscribeToken(token string) (UnsubscribeTarget, error) {
+	var t UnsubscribeTarget
+	if !EmailLinksEnabled() {
+		return t, ErrEmailLinksNotConfigured
+	}
+
+	encoded, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return t, ErrInvalidUnsubscribeToken
+	}
+	got, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(got, signEmailLink(encoded)) {
+		return t, ErrInvalidUnsubscribeToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || json.Unmarshal(payload, &t) != nil || t.UserID == "" {
+		return UnsubscribeTarget{}, ErrInvalidUnsubscribeToken
+	}
+	return t, nil
+}
+
+// UnsubscribeURL is the link for an unsubscribe token
+func UnsubscribeURL(token string) string {
+	path := "/api/notifications/unsubscribe?token=" + url.QueryEscape(token)
+	domain := os.Getenv("DOMAIN_NAME")
+	if domain == "" {
+		return path
+	}
+	return "https://" + domain + path
+}
+
+func signEmailLink(encoded string) []byte {
+	mac := hmac.New(sha256.New, []byte(emailLinkSecret))
+	mac.Write([]byte(encoded))
+	return mac.Sum(nil)
+}
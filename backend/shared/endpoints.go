@@ -0,0 +1,96 @@
+package shared
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// DefaultParticleAPIBase is the Particle cloud API every Lambda talks to
+// unless PARTICLE_API_BASE names another, such as an on-prem or staging
+// cloud
+const DefaultParticleAPIBase = "https://api.particle.io/v1"
+
+var particleAPIBase = resolveParticleAPIBase(os.Getenv("PARTICLE_API_BASE"))
+
+// ParticleAPIBase is the Particle API base URL, without a trailing slash
+func ParticleAPIBase() string {
+	return particleAPIBase
+}
+
+// ValidateParticleAPIBase checks a PARTICLE_API_BASE value: an https URL
+// with a host, no trailing slash, query or fragment
+func ValidateParticleAPIBase(raw string) error {
+	u, err := url.Parse(raw)
+	switch {
+	case err != nil:
+		return fmt.Errorf("not a URL: %v", err)
+	case u.Scheme != "https":
+		return fmt.Errorf("must be https")
+	case u.Host == "":
+		return fmt.Errorf("has no host")
+	case strings.HasSuffix(raw, "/"):
+		return fmt.Errorf("must not end with a slash")
+	case u.RawQuery != "" || u.Fragment != "":
+		return fmt.Errorf("must not have a query or fragment")
+	}
+	return nil
+}
+
+// resolveParticleAPIBase returns override when it's valid, and
+// DefaultParticleAPIBase when it's unset or invalid. An invalid override is
+// logged rather than fatal so a bad setting can't take the Lambdas down.
+func resolveParticleAPIBase(override string) string {
+	if override == "" {
+		return DefaultParticleAPIBase
+	}
+	if err := ValidateParticleAPIBase(override); err != nil {
+		log.Printf("WARNING: ignoring PARTICLE_API_BASE %q (%v); using %s", override, err, DefaultParticleAPIBase)
+		return DefaultParticleAPIBase
+	}
+	return override
+}
+
+// Alexa regions, each with its own event gateway for proactive reports
+const (
+	AlexaRegionNA = "NA" // North America
+	AlexaRegionEU = "EU" // Europe and India
+	AlexaRegionFE = "FE" // Far East
+)
+
+// alexaEventGatewayHosts are the event gateway hosts by Alexa region
+var alexaEventGatewayHosts = map[string]string{
+	AlexaRegionNA: "api.amazonalexa.com",
+	AlexaRegionEU: "api.eu.amazonalexa.com",
+	AlexaRegionFE: "api.fe.amazonalexa.com",
+}
+
+// alexaRegionsByAWSRegion maps the AWS region Alexa invokes a smart home
+// skill Lambda in to the Alexa region of the user's account
+var alexaRegionsByAWSRegion = map[string]string{
+	"us-east-1": AlexaRegionNA,
+	"eu-west-1": AlexaRegionEU,
+	"us-west-2": AlexaRegionFE,
+}
+
+// AlexaRegionForAWSRegion returns the Alexa region whose users are served
+// from awsRegion, or "" for a region Alexa doesn't invoke skills from
+func AlexaRegionForAWSRegion(awsRegion string) string {
+	return alexaRegionsByAWSRegion[awsRegion]
+}
+
+// AlexaEventGatewayHost returns the event gateway host for an Alexa region,
+// North America's when the region is unknown or wasn't recorded
+func AlexaEventGatewayHost(region string) string {
+	if host, ok := alexaEventGatewayHosts[region]; ok {
+		return host
+	}
+	return alexaEventGatewayHosts[AlexaRegionNA]
+}
+
+// AlexaEventGatewayURL is where proactive events for a user in region go
+func AlexaEventGatewayURL(region string) string {
+	return "https://" + AlexaEventGatewayHost(region) + "/v3/events"
+}
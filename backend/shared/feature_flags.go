@@ -0,0 +1,162 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+)
+
+// Feature flags gate experimental functionality. A feature is off unless
+// FEATURE_FLAGS turns it on for everyone ("zones=true,sync=false") or the
+// user's record does; a user's own setting wins over the global default
+// either way.
+const (
+	FeaturePlaylists = "playlists"
+	FeatureSync      = "sync"
+	FeatureZones     = "zones"
+)
+
+// KnownFeatures lists every feature that can be flagged
+var KnownFeatures = []string{FeaturePlaylists, FeatureSync, FeatureZones}
+
+// ErrFeatureNotEnabled is the error of a request for a feature that's off
+// for the caller
+var ErrFeatureNotEnabled = errors.New("feature not enabled")
+
+// featureFlagCacheTTL bounds how long a warm Lambda trusts a user's flags.
+// ValidateAuth refreshes them on every request it loads the user for, so
+// this only matters for callers that check flags without authenticating.
+const featureFlagCacheTTL = time.Minute
+
+type cachedFeatureFlags struct {
+	flags    map[string]bool
+	cachedAt time.Time
+}
+
+var (
+	featureFlagCacheMu sync.Mutex
+	featureFlagCache   = make(map[string]cachedFeatureFlags)
+)
+
+// IsKnownFeature reports whether feature is in KnownFeatures
+func IsKnownFeature(feature string) bool {
+	for _, known := range KnownFeatures {
+		if known == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// GlobalFeatureDefaults returns the defaults set by FEATURE_FLAGS
+func GlobalFeatureDefaults() map[string]bool {
+	return parseFeatureDefaults(os.Getenv("FEATURE_FLAGS"))
+}
+
+// parseFeatureDefaults reads "zones=true,sync" style defaults; a bare name
+// turns the feature on. Unknown features and unparseable values are ignored.
+func parseFeatureDefaults(raw string) map[string]bool {
+	defaults := make(map[string]bool)
+	for _, entry := range strings.Split(raw, ",") {
+		name, value, hasValue := strings.Cut(strings.TrimSpace(entry), "=")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !IsKnownFeature(name) {
+			continue
+		}
+		enabled := true
+		if hasValue {
+			parsed, err := strconv.ParseBool(strings.TrimSpace(value))
+			if err != nil {
+				continue
+			}
+			enabled = parsed
+		}
+		defaults[name] = enabled
+	}
+	return defaults
+}
+
+// FeatureEnabled resolves one feature: the user's flag if they have one,
+// else the global default, else off
+func FeatureEnabled(defaults, userFlags map[string]bool, feature string) bool {
+	if enabled, ok := userFlags[feature]; ok {
+		return enabled
+	}
+	return defaults[feature]
+}
+
+// ResolveFeatureFlags resolves every known feature for a user with userFlags
+func ResolveFeatureFlags(defaults, userFlags map[string]bool) map[string]bool {
+	resolved := make(map[string]bool, len(KnownFeatures))
+	for _, feature := range KnownFeatures {
+		resolved[feature] = FeatureEnabled(defaults, userFlags, feature)
+	}
+	return resolved
+}
+
+// Features resolves every known feature for the user
+func (u User) Features() map[string]bool {
+	return ResolveFeatureFlags(GlobalFeatureDefaults(), u.FeatureFlags)
+}
+
+// IsFeatureEnabled reports whether feature is on for username, from the
+// cached user record when it's fresh
+func IsFeatureEnabled(ctx context.Context, username, feature string) (bool, error) {
+	flags, err := userFeatureFlags(ctx, username)
+	if err != nil {
+		return false, err
+	}
+	return FeatureEnabled(GlobalFeatureDefaults(), flags, feature), nil
+}
+
+// userFeatureFlags returns username's own flags, loading the user on a cache miss
+func userFeatureFlags(ctx context.Context, username string) (map[string]bool, error) {
+	featureFlagCacheMu.Lock()
+	cached, ok := featureFlagCache[username]
+	featureFlagCacheMu.Unlock()
+	if ok && time.Since(cached.cachedAt) < featureFlagCacheTTL {
+		return cached.flags, nil
+	}
+
+	key, _ := attributevalue.MarshalMap(map[string]string{
+		"username": username,
+	})
+
+	var user User
+	if err := GetItem(ctx, os.Getenv("USERS_TABLE"), key, &user); err != nil {
+		return nil, err
+	}
+	cacheFeatureFlags(username, user.FeatureFlags)
+	return user.FeatureFlags, nil
+}
+
+// cacheFeatureFlags records a freshly loaded user's flags
+func cacheFeatureFlags(username string, flags map[string]bool) {
+	featureFlagCacheMu.Lock()
+	defer featureFlagCacheMu.Unlock()
+	featureFlagCache[username] = cachedFeatureFlags{flags: flags, cachedAt: time.Now()}
+}
+
+// SortedFeatureFlags lists flags' features in order, for logs
+func SortedFeatureFlags(flags map[string]bool) []string {
+	entries := make([]string, 0, len(flags))
+	for feature, enabled := range flags {
+		entries = append(entries, feature+"="+strconv.FormatBool(enabled))
+	}
+	sort.Strings(entries)
+	return entries
+}
+
+// FeatureNotEnabledResponse is the response for a request to a feature
+// that's off for the caller
+func FeatureNotEnabledResponse() events.APIGatewayProxyResponse {
+	return CreateErrorResponse(403, ErrFeatureNotEnabled.Error())
+}
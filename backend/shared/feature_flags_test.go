@@ -0,0 +1,106 @@
+package shared
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestUserFlagOverridesGlobalDefault(t *testing.T) {
+	on, off := true, false
+	tests := []struct {
+		name       string
+		defaultSet *bool
+		userSet    *bool
+		want       bool
+	}{
+		{"neither set", nil, nil, false},
+		{"default on", &on, nil, true},
+		{"default off", &off, nil, false},
+		{"user on", nil, &on, true},
+		{"user off", nil, &off, false},
+		{"user on over default off", &off, &on, true},
+		{"user off over default on", &on, &off, false},
+	}
+	for _, tt := range tests {
+		defaults, userFlags := map[string]bool{}, map[string]bool{}
+		if tt.defaultSet != nil {
+			defaults[FeatureZones] = *tt.defaultSet
+		}
+		if tt.userSet != nil {
+			userFlags[FeatureZones] = *tt.userSet
+		}
+		if got := FeatureEnabled(defaults, userFlags, FeatureZones); got != tt.want {
+			t.Errorf("%s: zones enabled = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseFeatureDefaults(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want map[string]bool
+	}{
+		{"", map[string]bool{}},
+		{"zones=true,sync=false", map[string]bool{FeatureZones: true, FeatureSync: false}},
+		{" Zones , playlists = 1 ", map[string]bool{FeatureZones: true, FeaturePlaylists: true}},
+		{"zones=maybe,teleport=true", map[string]bool{}},
+	}
+	for _, tt := range tests {
+		if got := parseFeatureDefaults(tt.raw); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseFeatureDefaults(%q) = %v, want %v", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestUserFeaturesResolveEveryKnownFeature(t *testing.T) {
+	t.Setenv("FEATURE_FLAGS", "sync=true,playlists=true")
+	user := User{Username: "lee", FeatureFlags: map[string]bool{FeaturePlaylists: false, FeatureZones: true}}
+	want := map[string]bool{FeaturePlaylists: false, FeatureSync: true, FeatureZones: true}
+	if got := user.Features(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Features() = %v, want %v", got, want)
+	}
+}
+
+func TestIsFeatureEnabledCachesUserFlags(t *testing.T) {
+	t.Setenv("FEATURE_FLAGS", "zones=true")
+	featureFlagCacheMu.Lock()
+	featureFlagCache = make(map[string]cachedFeatureFlags)
+	featureFlagCacheMu.Unlock()
+
+	lookups := 0
+	stored := map[string]bool{FeatureZones: false}
+	defer StubDynamoDB(func(call DynamoDBStubCall) (map[string]interface{}, error) {
+		lookups++
+		return map[string]interface{}{"Item": DynamoDBStubItem(User{Username: "lee", IsActive: true, FeatureFlags: stored})}, nil
+	})()
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		if enabled, err := IsFeatureEnabled(ctx, "lee", FeatureZones); enabled || err != nil {
+			t.Fatalf("zones for lee = %v, %v; want their flag to turn off the default", enabled, err)
+		}
+	}
+	if lookups != 1 {
+		t.Errorf("%d user lookups for three checks, want 1", lookups)
+	}
+
+	// A flag change is seen once the cached flags go stale, without a redeploy
+	stored = map[string]bool{FeatureZones: true}
+	featureFlagCacheMu.Lock()
+	featureFlagCache["lee"] = cachedFeatureFlags{flags: featureFlagCache["lee"].flags, cachedAt: time.Now().Add(-featureFlagCacheTTL)}
+	featureFlagCacheMu.Unlock()
+	if enabled, _ := IsFeatureEnabled(ctx, "lee", FeatureZones); !enabled || lookups != 2 {
+		t.Errorf("zones after the change = %v with %d lookups, want on after a second lookup", enabled, lookups)
+	}
+
+	// Authenticating loads the user anyway, refreshing the cache
+	stored = map[string]bool{FeatureZones: false}
+	if _, _, err := userAccountStatus(ctx, "lee"); err != nil {
+		t.Fatal(err)
+	}
+	if enabled, _ := IsFeatureEnabled(ctx, "lee", FeatureZones); enabled || lookups != 3 {
+		t.Errorf("zones after authenticating = %v with %d lookups, want off from the auth lookup", enabled, lookups)
+	}
+}
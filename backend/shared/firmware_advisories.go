@@ -0,0 +1,220 @@
+package shared
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Firmware advisory severities, least to most severe
+const (
+	AdvisorySeverityInfo     = "info"     // Worth knowing; nothing to do
+	AdvisorySeverityWarning  = "warning"  // Some features misbehave; update when convenient
+	AdvisorySeverityCritical = "critical" // The device can't be relied on; update now
+)
+
+// advisorySeverityRank orders severities so the worst advisory wins
+var advisorySeverityRank = map[string]int{
+	AdvisorySeverityInfo:     1,
+	AdvisorySeverityWarning:  2,
+	AdvisorySeverityCritical: 3,
+}
+
+// FirmwareAdvisory is a known issue with a firmware version, as set on
+// Device.FirmwareAdvisory
+type FirmwareAdvisory struct {
+	ID       string `json:"id" dynamodbav:"id"`
+	Severity string `json:"severity" dynamodbav:"severity"` // One of the AdvisorySeverity constants
+	Message  string `json:"message" dynamodbav:"message"`
+	FixedIn  string `json:"fixedIn,omitempty" dynamodbav:"fixedIn,omitempty"` // First version without the issue
+}
+
+// knownFirmwareIssue is an advisory and the versions it applies to:
+// Introduced up to, but not including, FixedIn. Pre-releases sort before
+// their release, so 1.4.3-beta.1 is still affected by an issue fixed in
+// 1.4.3; name the pre-release in FixedIn if it carried the fix.
+type knownFirmwareIssue struct {
+	Introduced string
+	FixedIn    string // "" while unfixed
+	Advisory   FirmwareAdvisory
+}
+
+// knownFirmwareIssues are the firmware versions with known problems. Add an
+// entry when a bad version ships; devices pick it up on their next refresh.
+var knownFirmwareIssues = []knownFirmwareIssue{
+	{
+		Introduced: "1.4.2",
+		FixedIn:    "1.4.3",
+		Advisory: FirmwareAdvisory{
+			ID:       "bytecode-checksum-1.4.2",
+			Severity: AdvisorySeverityCritical,
+			Message:  "Firmware 1.4.2 miscalculates bytecode checksums and rejects valid patterns; update the firmware",
+		},
+	},
+}
+
+// FirmwareVersion is a parsed firmware version: MAJOR.MINOR.PATCH with an
+// optional "v" prefix, "-pre.release" suffix and "+build" metadata, which
+// is ignored. A missing minor or patch number is 0.
+type FirmwareVersion struct {
+	Major, Minor, Patch int
+	PreRelease          []string // Dot-separated pre-release identifiers; empty for a release
+}
+
+// ParseFirmwareVersion parses a version such as "3.0.0", "v1.4.2" or
+// "1.5.0-rc.2"
+func ParseFirmwareVersion(s string) (FirmwareVersion, error) {
+	var v FirmwareVersion
+
+	rest := strings.TrimPrefix(strings.TrimSpace(s), "v")
+	if i := strings.IndexByte(rest, '+'); i >= 0 {
+		rest = rest[:i]
+	}
+	core := rest
+	if i := strings.IndexByte(rest, '-'); i >= 0 {
+		core = rest[:i]
+		pre := rest[i+1:]
+		if pre == "" {
+			return v, fmt.Errorf("invalid firmware version %q: empty pre-release", s)
+		}
+		v.PreRelease = strings.Split(pre, ".")
+		for _, id := range v.PreRelease {
+			if id == "" {
+				return v, fmt.Errorf("invalid firmware version %q: empty pre-release identifier", s)
+			}
+		}
+	}
+
+	parts := strings.Split(core, ".")
+	if len(parts) > 3 {
+		return v, fmt.Errorf("invalid firmware version %q", s)
+	}
+	numbers := []*int{&v.Major, &v.Minor, &v.Patch}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return v, fmt.Errorf("invalid firmware version %q", s)
+		}
+		*numbers[i] = n
+	}
+	return v, nil
+}
+
+// String formats the version without a "v" prefix
+func (v FirmwareVersion) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if len(v.PreRelease) > 0 {
+		s += "-" + strings.Join(v.PreRelease, ".")
+	}
+	return s
+}
+
+// Compare returns -1, 0 or 1 as v is older than, the same as, or newer than
+// other, by semantic versioning precedence: a pre-release is older than its
+// release, and pre-release identifiers compare numerically when both are
+// numbers, otherwise as text, with numbers before text
+func (v FirmwareVersion) Compare(other FirmwareVersion) int {
+	if c := compareInts(v.Major, other.Major); c != 0 {
+		return c
+	}
+	if c := compareInts(v.Minor, other.Minor); c != 0 {
+		return c
+	}
+	if c := compareInts(v.Patch, other.Patch); c != 0 {
+		return c
+	}
+
+	switch {
+	case len(v.PreRelease) == 0 && len(other.PreRelease) == 0:
+		return 0
+	case len(v.PreRelease) == 0:
+		return 1
+	case len(other.PreRelease) == 0:
+		return -1
+	}
+	for i := 0; i < len(v.PreRelease) && i < len(other.PreRelease); i++ {
+		if c := comparePreRelease(v.PreRelease[i], other.PreRelease[i]); c != 0 {
+			return c
+		}
+	}
+	return compareInts(len(v.PreRelease), len(other.PreRelease))
+}
+
+// CompareFirmwareVersions compares two version strings as Compare does.
+// Unparseable versions sort before parseable ones, and as text among
+// themselves.
+func CompareFirmwareVersions(a, b string) int {
+	va, errA := ParseFirmwareVersion(a)
+	vb, errB := ParseFirmwareVersion(b)
+	switch {
+	case errA != nil && errB != nil:
+		return strings.Compare(a, b)
+	case errA != nil:
+		return -1
+	case errB != nil:
+		return 1
+	}
+	return va.Compare(vb)
+}
+
+func comparePreRelease(a, b string) int {
+	na, errA := strconv.Atoi(a)
+	nb, errB := strconv.Atoi(b)
+	switch {
+	case errA == nil && errB == nil:
+		return compareInts(na, nb)
+	case errA == nil:
+		return -1
+	case errB == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+func compareInts(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// affects reports whether the issue applies to version v
+func (issue knownFirmwareIssue) affects(v FirmwareVersion) bool {
+	introduced, err := ParseFirmwareVersion(issue.Introduced)
+	if err != nil || v.Compare(introduced) < 0 {
+		return false
+	}
+	if issue.FixedIn == "" {
+		return true
+	}
+	fixed, err := ParseFirmwareVersion(issue.FixedIn)
+	return err == nil && v.Compare(fixed) < 0
+}
+
+// FirmwareAdvisoryFor returns the most severe known issue with version, or
+// nil if there is none or the version can't be parsed
+func FirmwareAdvisoryFor(version string) *FirmwareAdvisory {
+	if version == "" {
+		return nil
+	}
+	v, err := ParseFirmwareVersion(version)
+	if err != nil {
+		return nil
+	}
+
+	var worst *FirmwareAdvisory
+	for _, issue := range knownFirmwareIssues {
+		if !issue.affects(v) {
+			continue
+		}
+		if worst == nil || advisorySeverityRank[issue.Advisory.Severity] > advisorySeverityRank[worst.Severity] {
+			advisory := issue.Advisory
+			advisory.FixedIn = issue.FixedIn
+			worst = &advisory
+		}
+	}
+	return worst
+}
@@ -0,0 +1,99 @@
+package shared
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseFirmwareVersion(t *testing.T) {
+	tests := []struct {
+		in   string
+		want FirmwareVersion
+	}{
+		{"3.0.0", FirmwareVersion{Major: 3}},
+		{"v1.4.2", FirmwareVersion{Major: 1, Minor: 4, Patch: 2}},
+		{" 2.1 ", FirmwareVersion{Major: 2, Minor: 1}},
+		{"1.5.0-rc.2", FirmwareVersion{Major: 1, Minor: 5, PreRelease: []string{"rc", "2"}}},
+		{"1.5.0+build.7", FirmwareVersion{Major: 1, Minor: 5}},
+		{"1.5.0-beta+exp.sha", FirmwareVersion{Major: 1, Minor: 5, PreRelease: []string{"beta"}}},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseFirmwareVersion(tt.in)
+		if err != nil {
+			t.Errorf("ParseFirmwareVersion(%q) error: %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseFirmwareVersion(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseFirmwareVersionInvalid(t *testing.T) {
+	for _, in := range []string{"", "abc", "1.2.3.4", "1.-2.0", "1.2.3-", "1.2.3-rc..1", "1.x"} {
+		if v, err := ParseFirmwareVersion(in); err == nil {
+			t.Errorf("ParseFirmwareVersion(%q) = %+v, want an error", in, v)
+		}
+	}
+}
+
+func TestCompareFirmwareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.4.2", "1.4.2", 0},
+		{"v1.4.2", "1.4.2+build.1", 0},
+		{"1.4", "1.4.0", 0},
+		{"1.4.2", "1.4.10", -1},
+		{"1.10.0", "1.9.9", 1},
+		{"2.0.0", "1.99.99", 1},
+		{"1.4.3-beta.1", "1.4.3", -1},
+		{"1.0.0-alpha", "1.0.0-alpha.1", -1},
+		{"1.0.0-alpha.1", "1.0.0-alpha.beta", -1},
+		{"1.0.0-beta.2", "1.0.0-beta.11", -1},
+		{"1.0.0-rc.1", "1.0.0-beta.11", 1},
+		{"garbage", "0.0.1", -1},
+		{"0.0.1", "garbage", 1},
+		{"abc", "abd", -1},
+	}
+
+	for _, tt := range tests {
+		if got := CompareFirmwareVersions(tt.a, tt.b); got != tt.want {
+			t.Errorf("CompareFirmwareVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+		if got := CompareFirmwareVersions(tt.b, tt.a); got != -tt.want {
+			t.Errorf("CompareFirmwareVersions(%q, %q) = %d, want %d", tt.b, tt.a, got, -tt.want)
+		}
+	}
+}
+
+func TestFirmwareAdvisoryFor(t *testing.T) {
+	tests := []struct {
+		version string
+		wantID  string
+	}{
+		{"", ""},
+		{"not a version", ""},
+		{"1.4.1", ""},
+		{"1.4.2-rc.1", ""},
+		{"1.4.2", "bytecode-checksum-1.4.2"},
+		{"v1.4.2+build.3", "bytecode-checksum-1.4.2"},
+		{"1.4.3-beta.1", "bytecode-checksum-1.4.2"},
+		{"1.4.3", ""},
+		{"2.0.0", ""},
+	}
+
+	for _, tt := range tests {
+		got := FirmwareAdvisoryFor(tt.version)
+		switch {
+		case tt.wantID == "" && got != nil:
+			t.Errorf("FirmwareAdvisoryFor(%q) = %+v, want nil", tt.version, got)
+		case tt.wantID != "" && got == nil:
+			t.Errorf("FirmwareAdvisoryFor(%q) = nil, want %s", tt.version, tt.wantID)
+		case got != nil && (got.ID != tt.wantID || got.FixedIn != "1.4.3"):
+			t.Errorf("FirmwareAdvisoryFor(%q) = %+v, want %s fixed in 1.4.3", tt.version, got, tt.wantID)
+		}
+	}
+}
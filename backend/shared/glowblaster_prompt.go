@@ -241,3 +241,17 @@ Common colors in RGB format:
 ` + "```" + `
 *Vibe: Sparse white stars twinkling against a deep navy night sky.*
 `
+
+// GlowBlasterCompactPrompt is the system prompt for summarizing the older
+// part of a Glow Blaster conversation when it's compacted
+const GlowBlasterCompactPrompt = `You summarize the earlier part of a conversation between a user and Pan Galactic Glowblaster, an AI that designs LED patterns as WLED JSON. The summary replaces those messages, so the assistant must be able to carry on from it alone.
+
+Keep:
+- Every decision the user made or accepted: effects, colors (with hex values), palettes, brightness, speed, intensity, segments and LED counts
+- What the user rejected or asked to change, so it isn't suggested again
+- The user's stated goals, the occasion or mood, and their device setup
+- Open questions and anything the assistant promised to do next
+
+Leave out greetings, explanations of WLED, and superseded attempts unless the user referred back to them. Don't include WLED JSON; the current pattern is attached separately.
+
+Write plain bullet points, most recent decisions last, in at most 300 words.`
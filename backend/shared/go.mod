@@ -7,6 +7,7 @@ require (
     github.com/aws/aws-sdk-go-v2/config v1.26.1
     github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue v1.12.13
     github.com/aws/aws-sdk-go-v2/service/dynamodb v1.26.7
+    github.com/aws/aws-sdk-go-v2/service/kms v1.27.5
     github.com/golang-jwt/jwt/v5 v5.2.0
     golang.org/x/crypto v0.17.0
     github.com/aws/aws-lambda-go v1.41.0
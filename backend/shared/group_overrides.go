@@ -0,0 +1,181 @@
+package shared
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// OutputOverrides adjust what a pattern shows without changing the pattern.
+// A nil field leaves the pattern's own value.
+type OutputOverrides struct {
+	BrightnessPercent *int     // Replaces the master brightness; a BrightnessPercent (0-100)
+	Color             *string  // Replaces each segment's primary color ("#RRGGBB")
+	SpeedMultiplier   *float64 // Scales each segment's effect speed (sx), clamped to 0-255
+	Colors            []string // Replace each segment's colors in slot order ("#RRGGBB"), after Color
+}
+
+// GroupOutputOverrides returns the overrides a virtual group applies to
+// patterns applied through it
+func GroupOutputOverrides(group VirtualGroup) OutputOverrides {
+	return OutputOverrides{
+		BrightnessPercent: group.BrightnessPercent,
+		Color:             group.ColorOverride,
+	}
+}
+
+// IsZero reports whether the overrides change nothing
+func (o OutputOverrides) IsZero() bool {
+	return o.BrightnessPercent == nil && o.Color == nil && o.SpeedMultiplier == nil && len(o.Colors) == 0
+}
+
+// String describes the overrides for messages, e.g. "brightness 40%, color #FFA040"
+func (o OutputOverrides) String() string {
+	var parts []string
+	if o.BrightnessPercent != nil {
+		parts = append(parts, fmt.Sprintf("brightness %d%%", *o.BrightnessPercent))
+	}
+	if o.Color != nil {
+		parts = append(parts, "color "+*o.Color)
+	}
+	if o.SpeedMultiplier != nil {
+		parts = append(parts, fmt.Sprintf("speed x%g", *o.SpeedMultiplier))
+	}
+	if len(o.Colors) > 0 {
+		parts = append(parts, "colors "+strings.Join(o.Colors, "/"))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// ValidateBrightnessPercent checks a brightness override is 0-100
+func ValidateBrightnessPercent(percent int) error {
+	if percent < 0 || percent > 100 {
+		return fmt.Errorf("brightnessPercent must be between 0 and 100")
+	}
+	return nil
+}
+
+// NormalizeHexColor validates a "#RRGGBB" or "#RGB" color (the # is optional)
+// and returns it as uppercase "#RRGGBB"
+func NormalizeHexColor(s string) (string, error) {
+	r, g, b, err := parseHexColor(s)
+	if err != nil {
+		return "", fmt.Errorf("invalid hex color %q", s)
+	}
+	return fmt.Sprintf("#%02X%02X%02X", r, g, b), nil
+}
+
+// ApplyOutputOverrides sets the overridden brightness and segment colors, and
+// scales effect speeds, on a prepared WLED state (see PrepareWLEDForLEDCount). Other fields, including
+// any the WLEDState type doesn't model, are kept as they are.
+func ApplyOutputOverrides(wledJSON string, o OutputOverrides) (string, error) {
+	if o.IsZero() {
+		return wledJSON, nil
+	}
+
+	var state map[string]interface{}
+	if err := json.Unmarshal([]byte(wledJSON), &state); err != nil {
+		return "", fmt.Errorf("failed to parse WLED state: %v", err)
+	}
+
+	if o.BrightnessPercent != nil {
+		state["bri"] = BrightnessPercent(*o.BrightnessPercent).Byte()
+	}
+
+	if o.SpeedMultiplier != nil {
+		if segs, ok := state["seg"].([]interface{}); ok {
+			for _, seg := range segs {
+				segMap, ok := seg.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				if sx, ok := segMap["sx"].(float64); ok {
+					segMap["sx"] = ScaleEffectSpeed(int(sx), *o.SpeedMultiplier)
+				}
+			}
+		}
+	}
+
+	if o.Color != nil {
+		r, g, b, err := parseHexColor(*o.Color)
+		if err != nil {
+			return "", fmt.Errorf("invalid color override %q: %v", *o.Color, err)
+		}
+		primary := []interface{}{int(r), int(g), int(b)}
+
+		if segs, ok := state["seg"].([]interface{}); ok {
+			for _, seg := range segs {
+				segMap, ok := seg.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				cols, _ := segMap["col"].([]interface{})
+				if len(cols) == 0 {
+					cols = []interface{}{primary}
+				} else {
+					cols[0] = primary
+				}
+				segMap["col"] = cols
+			}
+		}
+	}
+
+	if len(o.Colors) > 0 {
+		colors := make([]interface{}, len(o.Colors))
+		for i, color := range o.Colors {
+			r, g, b, err := parseHexColor(color)
+			if err != nil {
+				return "", fmt.Errorf("invalid color override %q: %v", color, err)
+			}
+			colors[i] = []interface{}{int(r), int(g), int(b)}
+		}
+
+		if segs, ok := state["seg"].([]interface{}); ok {
+			for _, seg := range segs {
+				segMap, ok := seg.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				cols, _ := segMap["col"].([]interface{})
+				for i, color := range colors {
+					if i < len(cols) {
+						cols[i] = color
+					} else {
+						cols = append(cols, color)
+					}
+				}
+				segMap["col"] = cols
+			}
+		}
+	}
+
+	updated, err := json.Marshal(state)
+	if err != nil {
+		return "", err
+	}
+	return string(updated), nil
+}
+
+// CompileForLEDCountWithOverrides is CompileForLEDCount with output overrides
+// applied to the prepared WLED state, also returning the BinarySource the
+// bytecode came from. The overridden state is compiled as an unnamed
+// pattern, so it is cached by content and never replaces the pattern's own
+// cached bytecode; a pattern's stored binary is only sent without overrides.
+func CompileForLEDCountWithOverrides(pattern *Pattern, ledCount int, o OutputOverrides) ([]byte, string, []string, error) {
+	if o.IsZero() {
+		return compileForLEDCount(pattern, ledCount)
+	}
+
+	wledJSON, warnings, err := PrepareWLEDForLEDCount(pattern, ledCount)
+	if err != nil {
+		return nil, "", warnings, err
+	}
+
+	overridden, err := ApplyOutputOverrides(wledJSON, o)
+	if err != nil {
+		return nil, "", warnings, err
+	}
+
+	bytecode, source, compileWarnings, err := compileForLEDCount(&Pattern{WLEDState: overridden}, ledCount)
+	return bytecode, source, appendNewWarnings(warnings, compileWarnings), err
+}
@@ -0,0 +1,191 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+)
+
+// Support access grant lengths. A user grants DefaultSupportAccessDuration
+// unless they ask for another length, up to MaxSupportAccessDuration.
+const (
+	DefaultSupportAccessDuration = 24 * time.Hour
+	MaxSupportAccessDuration     = 7 * 24 * time.Hour
+)
+
+// ErrImpersonationForbidden is returned by ValidateAuth when an impersonation
+// session makes a request only the account owner may make
+var ErrImpersonationForbidden = errors.New("not allowed while impersonating")
+
+// impersonationBlockedPaths are the routes an impersonation session can't
+// change: credentials, tokens, support access itself, and admin actions
+var impersonationBlockedPaths = []string{
+	"/api/auth/2fa/",
+	"/api/settings/particle",
+	"/api/settings/api-keys",
+	"/api/settings/support-access",
+	"/api/settings/alexa-link",
+	"/api/particle/validate-token",
+	"/api/particle/oauth/",
+	"/api/admin/",
+}
+
+// SupportAccessActive reports whether the user has granted support access
+// that hasn't expired or been revoked
+func (u User) SupportAccessActive(now time.Time) bool {
+	return u.SupportAccessExpiresAt != nil && now.Before(*u.SupportAccessExpiresAt)
+}
+
+// impersonationBlocked reports whether an impersonation session may not make
+// a request. Reads are always allowed.
+func impersonationBlocked(method, path string) bool {
+	if method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions {
+		return false
+	}
+	for _, prefix := range impersonationBlockedPaths {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// isMutatingMethod reports whether a request can change data
+func isMutatingMethod(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// checkImpersonation allows an impersonation session only while the target's
+// support access grant that was active when it was issued still is, and only
+// for requests impersonationBlocked allows
+func checkImpersonation(ctx context.Context, session *Session, request events.APIGatewayProxyRequest) error {
+	key, _ := attributevalue.MarshalMap(map[string]string{
+		"username": session.Username,
+	})
+	var user User
+	if err := GetItem(ctx, os.Getenv("USERS_TABLE"), key, &user); err != nil {
+		log.Printf("ValidateAuth: User lookup failed: %v", err)
+		return err
+	}
+	now := time.Now()
+	if user.Username == "" || !user.SupportAccessActive(now) ||
+		user.SupportAccessGrantedAt == nil || session.CreatedAt.Before(*user.SupportAccessGrantedAt) {
+		log.Printf("ValidateAuth: Support access for %s is no longer active; rejecting impersonation by %s", session.Username, session.ImpersonatedBy)
+		return ErrImpersonationForbidden
+	}
+	if impersonationBlocked(request.HTTPMethod, request.Path) {
+		log.Printf("ValidateAuth: Blocked %s %s by %s impersonating %s", request.HTTPMethod, request.Path, session.ImpersonatedBy, session.Username)
+		return ErrImpersonationForbidden
+	}
+	return nil
+}
+
+// CreateImpersonationSession issues admin a session acting as target, ending
+// when target's support access grant does
+func CreateImpersonationSession(ctx context.Context, target *User, admin, userAgent, ipAddress string) (*Session, error) {
+	sessionID, err := generateSessionID()
+	if err != nil {
+		log.Printf("CreateImpersonationSession: Failed to generate session ID: %v", err)
+		return nil, err
+	}
+
+	now := time.Now()
+	session := &Session{
+		SessionID:      sessionID,
+		Username:       target.Username,
+		CreatedAt:      now,
+		ExpiresAt:      now.Add(SessionDuration).Unix(),
+		UserAgent:      userAgent,
+		IPAddress:      ipAddress,
+		Impersonation:  true,
+		ImpersonatedBy: admin,
+	}
+	if target.SupportAccessExpiresAt != nil && target.SupportAccessExpiresAt.Unix() < session.ExpiresAt {
+		session.ExpiresAt = target.SupportAccessExpiresAt.Unix()
+	}
+
+	if err := PutItem(ctx, sessionsTable, session); err != nil {
+		log.Printf("CreateImpersonationSession: Failed to save session: %v", err)
+		return nil, err
+	}
+
+	log.Printf("CreateImpersonationSession: %s is impersonating %s until %v", admin, target.Username, time.Unix(session.ExpiresAt, 0))
+	return session, nil
+}
+
+type impersonationKey struct{}
+
+// requestImpersonation records the impersonation session ValidateAuth
+// accepted during a request
+type requestImpersonation struct {
+	mu       sync.Mutex
+	admin    string
+	username string
+}
+
+// WithActivityLog records every mutating request made through an
+// impersonation session in the activity logs of both the impersonated user
+// and the admin. Handlers can call ImpersonatorFromContext to see who is
+// acting.
+func WithActivityLog(handler APIHandler) APIHandler {
+	return func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		impersonation := &requestImpersonation{}
+		response, err := handler(context.WithValue(ctx, impersonationKey{}, impersonation), request)
+
+		impersonation.mu.Lock()
+		admin, username := impersonation.admin, impersonation.username
+		impersonation.mu.Unlock()
+		if admin != "" && isMutatingMethod(request.HTTPMethod) {
+			status := response.StatusCode
+			if err != nil {
+				status = http.StatusInternalServerError
+			}
+			RecordImpersonatedActivity(ctx, ActivityEntry{
+				Action:     ActivityRequest,
+				Actor:      admin,
+				Subject:    username,
+				Method:     request.HTTPMethod,
+				Path:       request.Path,
+				StatusCode: status,
+			})
+		}
+		return response, err
+	}
+}
+
+// recordImpersonation notes an accepted impersonation session for
+// WithActivityLog
+func recordImpersonation(ctx context.Context, session *Session) {
+	impersonation, ok := ctx.Value(impersonationKey{}).(*requestImpersonation)
+	if !ok {
+		return
+	}
+	impersonation.mu.Lock()
+	impersonation.admin = session.ImpersonatedBy
+	impersonation.username = session.Username
+	impersonation.mu.Unlock()
+}
+
+// ImpersonatorFromContext returns the admin acting through an impersonation
+// session in this request, or "" if the user is acting for themselves
+func ImpersonatorFromContext(ctx context.Context) string {
+	impersonation, ok := ctx.Value(impersonationKey{}).(*requestImpersonation)
+	if !ok {
+		return ""
+	}
+	impersonation.mu.Lock()
+	defer impersonation.mu.Unlock()
+	return impersonation.admin
+}
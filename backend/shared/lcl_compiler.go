@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 // LCL Bytecode Format Version 4 - Expanded Fixed Format
@@ -100,11 +101,12 @@ var effectTypes = map[string]byte{
 // PatternSpec is the Specification Layer (Intermediate Representation)
 // This maps directly to the compiled bytecode parameters
 type PatternSpec struct {
-	Effect          string   `json:"effect"`               // Required
-	Colors          []string `json:"colors"`               // Required: array of hex colors
-	BackgroundColor string   `json:"background_color"`     // Optional: secondary color
-	Brightness      int      `json:"brightness,omitempty"` // 0-255
+	Effect          string   `json:"effect,omitempty"`           // Required
+	Colors          []string `json:"colors,omitempty"`           // Required: array of hex colors
+	BackgroundColor string   `json:"background_color,omitempty"` // Optional: secondary color
+	Brightness      int      `json:"brightness,omitempty"` // BrightnessByte, 0-255
 	Speed           int      `json:"speed,omitempty"`      // 0-255
+	SpeedLevel      *int     `json:"speed_level,omitempty"` // 0-100 from a speed word; mapped per effect when converting to WLED
 	
 	// Param1
 	Density    int      `json:"density,omitempty"`    // 0-255 (Sparkle)
@@ -120,8 +122,26 @@ type PatternSpec struct {
 	TailLength int      `json:"tail_length,omitempty"` // 0-20 (Scanner/Chase)
 	
 	// Param4
-	Direction  int      `json:"direction,omitempty"`  // 0=forward, 1=reverse
+	Direction  *int     `json:"direction,omitempty"`  // nil=default, 0=forward, 1=reverse
 	Style      int      `json:"style,omitempty"`      // 0=smooth, 1=bounce...
+
+	// Layers over parts of the strip, each with its own effect (see
+	// lcl_segments.go). The fields above then describe the first segment,
+	// which is all LCL bytecode can play; Brightness stays the pattern's.
+	Segments []SegmentSpec `json:"segments,omitempty"`
+}
+
+// GetDirection returns the effective direction (0=forward when unset)
+func (s *PatternSpec) GetDirection() int {
+	if s.Direction == nil {
+		return 0
+	}
+	return *s.Direction
+}
+
+// SetDirection sets an explicit direction, so it survives JSON round-trips
+func (s *PatternSpec) SetDirection(direction int) {
+	s.Direction = &direction
 }
 
 // CompileLCLv4 compiles a PatternSpec to fixed-format bytecode
@@ -243,7 +263,7 @@ func getEffectParamsV4(effectID byte, spec *PatternSpec) (byte, byte, byte, byte
 	p1, p2, p3, p4 := byte(0), byte(0), byte(0), byte(0)
 
 	// Common Direction mapping for P4
-	p4 = byte(spec.Direction & 0x01) // Default
+	p4 = byte(spec.GetDirection() & 0x01) // Default
 
 	switch effectID {
 	case EffectSparkle:
@@ -285,6 +305,11 @@ func getEffectParamsV4(effectID byte, spec *PatternSpec) (byte, byte, byte, byte
 	return p1, p2, p3, p4
 }
 
+// PaletteTruncationWarning describes colors dropped because a format has fewer slots
+func PaletteTruncationWarning(from, to int) string {
+	return fmt.Sprintf("palette truncated from %d to %d colors", from, to)
+}
+
 // parseHexColor parses a hex color string
 func parseHexColor(s string) (byte, byte, byte, error) {
 	s = strings.TrimPrefix(s, "#")
@@ -323,11 +348,11 @@ func ParseIntentYAML(yamlStr string) (*PatternSpec, error) {
 	spec := &PatternSpec{
 		Brightness: 200,
 		Speed:      128,
-		Direction:  0,
 	}
 
 	lines := strings.Split(yamlStr, "\n")
 	currentSection := ""
+	segments := &intentSegmentParser{}
 
 	for _, line := range lines {
 		// Remove comments
@@ -346,30 +371,29 @@ func ParseIntentYAML(yamlStr string) (*PatternSpec, error) {
 			continue
 		}
 
-		// Parse Key-Value pairs
-		parts := strings.SplitN(trimmed, ":", 2)
-		if len(parts) != 2 {
+		// The segments list keeps its own sections per entry, and ends at the
+		// next unindented key
+		if currentSection == "segments" && !strings.HasPrefix(line, " ") && !strings.HasPrefix(trimmed, "-") {
+			currentSection = ""
+		}
+		if currentSection == "segments" {
+			if err := segments.parseLine(line); err != nil {
+				return nil, err
+			}
 			continue
 		}
 
-		key := strings.TrimSpace(parts[0])
-		value := strings.TrimSpace(parts[1])
-		value = strings.Trim(value, "'\"")
+		// Parse Key-Value pairs
+		key, value, ok := splitIntentLine(trimmed)
+		if !ok {
+			continue
+		}
+		applyIntentKey(currentSection, key, value, spec)
+	}
 
-		// Route based on section
-		switch currentSection {
-		case "", "root":
-			if key == "effect" {
-				spec.Effect = value
-			}
-		case "behavior":
-			mapBehavior(key, value, spec)
-		case "appearance":
-			mapAppearance(key, value, spec)
-		case "timing":
-			mapTiming(key, value, spec)
-		case "spatial":
-			mapSpatial(key, value, spec)
+	if len(segments.segments) > 0 {
+		if err := segments.apply(spec); err != nil {
+			return nil, err
 		}
 	}
 
@@ -380,6 +404,36 @@ func ParseIntentYAML(yamlStr string) (*PatternSpec, error) {
 	return spec, nil
 }
 
+// splitIntentLine splits a trimmed "key: value" line, unquoting the value
+func splitIntentLine(trimmed string) (key, value string, ok bool) {
+	parts := strings.SplitN(trimmed, ":", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	key = strings.TrimSpace(parts[0])
+	value = strings.TrimSpace(parts[1])
+	value = strings.Trim(value, "'\"")
+	return key, value, true
+}
+
+// applyIntentKey maps one key of an intent section onto spec
+func applyIntentKey(section, key, value string, spec *PatternSpec) {
+	switch section {
+	case "", "root":
+		if key == "effect" {
+			spec.Effect = value
+		}
+	case "behavior":
+		mapBehavior(key, value, spec)
+	case "appearance":
+		mapAppearance(key, value, spec)
+	case "timing":
+		mapTiming(key, value, spec)
+	case "spatial":
+		mapSpatial(key, value, spec)
+	}
+}
+
 // Semantic Mappings
 
 func mapBehavior(key, value string, spec *PatternSpec) {
@@ -435,6 +489,9 @@ func mapBehavior(key, value string, spec *PatternSpec) {
 		case "frantic": spec.Speed = 220
 		default: spec.Speed = 128
 		}
+		if level, ok := RhythmWordLevels[value]; ok {
+			spec.SpeedLevel = &level
+		}
 	
 	// Scanner / Chase (New in v4)
 	case "eye_size", "head_size":
@@ -507,6 +564,12 @@ func mapTiming(key, value string, spec *PatternSpec) {
 				spec.Speed = v
 			}
 		}
+		// Words are normalized per effect; a number is raw sx
+		if level, ok := SpeedWordLevel(value); ok {
+			spec.SpeedLevel = &level
+		} else {
+			spec.SpeedLevel = nil
+		}
 	}
 }
 
@@ -514,9 +577,9 @@ func mapSpatial(key, value string, spec *PatternSpec) {
 	if key == "direction" {
 		switch value {
 		case "forward", "up", "right", "clockwise", "outward":
-			spec.Direction = 0
+			spec.SetDirection(0)
 		case "backward", "reverse", "down", "left", "counterclockwise", "inward":
-			spec.Direction = 1
+			spec.SetDirection(1)
 		}
 	}
 }
@@ -577,30 +640,53 @@ func resolveColor(s string) string {
 // MAIN ENTRY POINT
 // =============================================================================
 
-// CompileLCL compiles LCL text (YAML or JSON) to bytecode
-func CompileLCL(input string) ([]byte, []string, error) {
+// ParseLCLSpec parses LCL text (YAML or JSON) into a PatternSpec
+func ParseLCLSpec(input string) (*PatternSpec, error) {
 	input = strings.TrimSpace(input)
 	var spec *PatternSpec
 	var err error
-	var warnings []string
 
 	// Detect format
 	if strings.HasPrefix(input, "{") {
 		// JSON (Legacy or Specification Layer)
 		if err := json.Unmarshal([]byte(input), &spec); err != nil {
-			return nil, nil, fmt.Errorf("JSON parse error: %v", err)
+			return nil, fmt.Errorf("JSON parse error: %v", err)
+		}
+		if spec != nil && len(spec.Segments) > 0 {
+			if err := resolveSegmentSpecs(spec); err != nil {
+				return nil, err
+			}
 		}
 	} else {
 		// YAML (Intent Layer)
 		spec, err = ParseIntentYAML(input)
 		if err != nil {
-			return nil, nil, fmt.Errorf("LCL parse error: %v", err)
+			return nil, fmt.Errorf("LCL parse error: %v", err)
 		}
 	}
 
 	// Validate
-	if spec.Effect == "" {
-		return nil, nil, fmt.Errorf("effect is required")
+	if spec == nil || spec.Effect == "" {
+		return nil, fmt.Errorf("effect is required")
+	}
+
+	return spec, nil
+}
+
+// CompileLCL compiles LCL text (YAML or JSON) to bytecode
+func CompileLCL(input string) ([]byte, []string, error) {
+	var warnings []string
+
+	spec, err := ParseLCLSpec(input)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(spec.Colors) > MaxPaletteColors {
+		warnings = append(warnings, PaletteTruncationWarning(len(spec.Colors), MaxPaletteColors))
+	}
+	if len(spec.Segments) > 1 {
+		warnings = append(warnings, fmt.Sprintf("LCL bytecode plays only the first of %d segments; convert the pattern to WLED for all of them", len(spec.Segments)))
 	}
 
 	// Compile - USE V4
@@ -612,6 +698,42 @@ func CompileLCL(input string) ([]byte, []string, error) {
 	return bytecode, warnings, nil
 }
 
+// compileBatchWorkers is the number of goroutines CompileBatch uses
+const compileBatchWorkers = 4
+
+// CompileBatch compiles many specs concurrently. bytecodes[i] and errs[i]
+// correspond to specs[i]; exactly one of them is non-nil per position.
+func CompileBatch(specs []PatternSpec) ([][]byte, []error) {
+	bytecodes := make([][]byte, len(specs))
+	errs := make([]error, len(specs))
+
+	work := make(chan int, len(specs))
+	for i := range specs {
+		work <- i
+	}
+	close(work)
+
+	var wg sync.WaitGroup
+	for w := 0; w < compileBatchWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				// Compile a copy - CompileLCLv4 fills in defaults on the spec it's given
+				spec := specs[i]
+				if spec.Effect == "" {
+					errs[i] = fmt.Errorf("effect is required")
+					continue
+				}
+				bytecodes[i], errs[i] = CompileLCLv4(&spec)
+			}
+		}()
+	}
+	wg.Wait()
+
+	return bytecodes, errs
+}
+
 // ValidateLCL validates without compiling
 func ValidateLCL(input string) (bool, []string) {
 	_, _, err := CompileLCL(input)
@@ -0,0 +1,86 @@
+package shared
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestPatternSpecJSONOmitsEmptyFields(t *testing.T) {
+	tests := []struct {
+		name string
+		spec PatternSpec
+		want string
+	}{
+		{"empty", PatternSpec{}, `{}`},
+		{"effect only", PatternSpec{Effect: "solid", Colors: []string{"#FF0000"}}, `{"effect":"solid","colors":["#FF0000"]}`},
+		{"explicit forward", PatternSpec{Effect: "chase", Direction: intPtr(0)}, `{"effect":"chase","direction":0}`},
+		{"reverse", PatternSpec{Effect: "chase", Direction: intPtr(1)}, `{"effect":"chase","direction":1}`},
+	}
+
+	for _, tt := range tests {
+		data, err := json.Marshal(tt.spec)
+		if err != nil {
+			t.Fatalf("%s: Marshal error: %v", tt.name, err)
+		}
+		if string(data) != tt.want {
+			t.Errorf("%s: Marshal = %s, want %s", tt.name, data, tt.want)
+		}
+
+		var back PatternSpec
+		if err := json.Unmarshal(data, &back); err != nil {
+			t.Fatalf("%s: Unmarshal error: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(back, tt.spec) {
+			t.Errorf("%s: round-trip = %+v, want %+v", tt.name, back, tt.spec)
+		}
+	}
+}
+
+func TestPatternSpecDirection(t *testing.T) {
+	var spec PatternSpec
+	if got := spec.GetDirection(); got != 0 {
+		t.Errorf("unset GetDirection() = %d, want 0", got)
+	}
+	spec.SetDirection(1)
+	if got := spec.GetDirection(); got != 1 {
+		t.Errorf("GetDirection() after SetDirection(1) = %d, want 1", got)
+	}
+}
+
+func TestCompileBatchReportsErrorsByIndex(t *testing.T) {
+	specs := make([]PatternSpec, 20)
+	for i := range specs {
+		specs[i] = PatternSpec{Effect: "candle", Colors: []string{fmt.Sprintf("#%02X8000", i*10)}, Brightness: 200, Speed: 128}
+	}
+	invalid := map[int]bool{3: true, 17: true}
+	specs[3].Effect = "no-such-effect"
+	specs[17].Effect = ""
+
+	bytecodes, errs := CompileBatch(specs)
+	if len(bytecodes) != len(specs) || len(errs) != len(specs) {
+		t.Fatalf("got %d bytecodes and %d errors for %d specs", len(bytecodes), len(errs), len(specs))
+	}
+	for i := range specs {
+		if invalid[i] {
+			if errs[i] == nil || bytecodes[i] != nil {
+				t.Errorf("spec %d: bytecode %v, err %v; want only an error", i, bytecodes[i] != nil, errs[i])
+			}
+			continue
+		}
+		if errs[i] != nil || bytecodes[i] == nil {
+			t.Errorf("spec %d: bytecode %v, err %v; want only bytecode", i, bytecodes[i] != nil, errs[i])
+			continue
+		}
+		spec := specs[i]
+		want, _ := CompileLCLv4(&spec)
+		if !reflect.DeepEqual(bytecodes[i], want) {
+			t.Errorf("spec %d: batch bytecode differs from CompileLCLv4", i)
+		}
+	}
+}
+
+func intPtr(v int) *int {
+	return &v
+}
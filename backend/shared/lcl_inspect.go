@@ -0,0 +1,406 @@
+package shared
+
+import (
+	"fmt"
+	"strings"
+)
+
+// LCL bytecode versions seen in stored patterns. v2 is the original
+// stack-machine format (opcode, flags, operands - see LED_CONTROL_LANGUAGE.md);
+// v4 is the fixed-offset format current firmware runs.
+const (
+	LCLVersion2 = 0x02
+	LCLVersion4 = LCLVersion
+)
+
+// LCL bytecode format names reported by InspectLCLBytecode
+const (
+	LCLFormatOpcode = "opcode"
+	LCLFormatFixed  = "fixed"
+)
+
+// LCLBytecodeInfo describes what a piece of LCL bytecode contains
+type LCLBytecodeInfo struct {
+	Version            int            `json:"version"`
+	Format             string         `json:"format"` // "opcode" (v2) or "fixed" (v4)
+	FirmwareCompatible bool           `json:"firmwareCompatible"`
+	Effect             string         `json:"effect"`
+	EffectID           int            `json:"effectId"` // ID in this version's effect table
+	Brightness         int            `json:"brightness"`
+	Speed              int            `json:"speed"`
+	SpeedLevel         int            `json:"speedLevel"` // Speed as a normalized 0-100 level on the matching WLED effect's curve
+	Colors             []string       `json:"colors"`
+	BackgroundColor    string         `json:"backgroundColor,omitempty"`
+	Params             map[string]int `json:"params,omitempty"` // Effect parameters by PatternSpec field name
+	Warnings           []string       `json:"warnings,omitempty"`
+}
+
+// v4 effect IDs back to their canonical names
+var lclV4EffectNames = map[byte]string{
+	EffectSolid:    "solid",
+	EffectPulse:    "pulse",
+	EffectSparkle:  "sparkle",
+	EffectGradient: "gradient",
+	EffectFire:     "fire",
+	EffectCandle:   "candle",
+	EffectWave:     "wave",
+	EffectRainbow:  "rainbow",
+	EffectScanner:  "scanner",
+	EffectWipe:     "wipe",
+}
+
+// v2 effect IDs (LED_CONTROL_LANGUAGE.md Appendix B)
+var lclV2EffectNames = map[int]string{
+	0x01: "solid",
+	0x02: "gradient",
+	0x03: "wave",
+	0x04: "chase",
+	0x05: "sparkle",
+	0x06: "breathe",
+	0x07: "fire",
+	0x08: "plasma",
+	0x09: "ripple",
+	0x0A: "radar",
+	0x0B: "honeycomb",
+	0x0C: "matrix",
+	0x0D: "noise",
+	0x0E: "strobe",
+	0x0F: "rainbow",
+	0x10: "twinkle",
+	0x11: "meteor",
+	0x12: "scan",
+	0x13: "larson",
+	0x14: "theater",
+}
+
+// v2 effects with no v4 equivalent, mapped to the closest v4 effect
+var lclV2EffectFallbacks = map[string]string{
+	"twinkle": "sparkle",
+	"scan":    "scanner",
+	"larson":  "scanner",
+	"meteor":  "scanner",
+	"theater": "wave",
+	"strobe":  "pulse",
+	"ripple":  "wave",
+	"radar":   "scanner",
+}
+
+// v2 opcodes the inspector understands (LED_CONTROL_LANGUAGE.md Appendix A)
+const (
+	lclOpNop        = 0x00
+	lclOpPushU8     = 0x01
+	lclOpPushU16    = 0x02
+	lclOpPushI16    = 0x03
+	lclOpPushF16    = 0x04
+	lclOpPushColor  = 0x05
+	lclOpPop        = 0x06
+	lclOpSetPattern = 0x50
+	lclOpSetParam   = 0x51
+	lclOpHalt       = 0x67
+)
+
+// v2 SET_PARAM IDs (match the legacy PARAM_* defines in firmware)
+const (
+	lclParamRed        = 0x01
+	lclParamGreen      = 0x02
+	lclParamBlue       = 0x03
+	lclParamBrightness = 0x04
+	lclParamSpeed      = 0x05
+	lclParamCooling    = 0x06
+	lclParamSparking   = 0x07
+	lclParamDirection  = 0x08
+	lclParamWaveCount  = 0x09
+	lclParamHeadSize   = 0x0A
+	lclParamTailLen    = 0x0B
+	lclParamDensity    = 0x0C
+)
+
+var lclV2ParamNames = map[int]string{
+	lclParamCooling:   "cooling",
+	lclParamSparking:  "sparking",
+	lclParamDirection: "direction",
+	lclParamWaveCount: "wave_count",
+	lclParamHeadSize:  "eye_size",
+	lclParamTailLen:   "tail_length",
+	lclParamDensity:   "density",
+}
+
+// Defaults firmware uses when bytecode doesn't set a value
+const (
+	lclDefaultBrightness = 200
+	lclDefaultSpeed      = 128
+)
+
+// InspectLCLBytecode decodes v2 (opcode) or v4 (fixed) LCL bytecode into its
+// effect, brightness, speed, and colors. Problems that don't prevent decoding,
+// such as a bad checksum, are reported as warnings.
+func InspectLCLBytecode(bytecode []byte) (*LCLBytecodeInfo, error) {
+	if len(bytecode) < LCLHeaderSize || string(bytecode[OffsetMagic:OffsetMagic+3]) != LCLMagic {
+		return nil, fmt.Errorf("not LCL bytecode")
+	}
+
+	version := int(bytecode[OffsetVersion])
+	info := &LCLBytecodeInfo{
+		Version:            version,
+		FirmwareCompatible: version >= LCLVersion4,
+		Brightness:         lclDefaultBrightness,
+		Speed:              lclDefaultSpeed,
+		Colors:             []string{},
+	}
+
+	declared := int(bytecode[OffsetLength])<<8 | int(bytecode[OffsetLength+1])
+	if declared != len(bytecode)-LCLHeaderSize {
+		info.Warnings = append(info.Warnings, fmt.Sprintf("header length %d does not match body length %d", declared, len(bytecode)-LCLHeaderSize))
+	}
+	checksum := byte(0)
+	for _, b := range bytecode[LCLHeaderSize:] {
+		checksum ^= b
+	}
+	if checksum != bytecode[OffsetChecksum] {
+		info.Warnings = append(info.Warnings, "checksum mismatch")
+	}
+
+	switch version {
+	case LCLVersion4:
+		info.Format = LCLFormatFixed
+		if err := inspectLCLv4(bytecode, info); err != nil {
+			return nil, err
+		}
+	case LCLVersion2:
+		info.Format = LCLFormatOpcode
+		inspectLCLv2(bytecode, info)
+	default:
+		return nil, fmt.Errorf("unsupported LCL bytecode version %d", version)
+	}
+
+	wledFX, ok := LCLToWLEDEffectMap[info.Effect]
+	if !ok {
+		wledFX = WLEDFXSolid
+	}
+	info.SpeedLevel = SxToSpeedLevel(wledFX, info.Speed)
+
+	return info, nil
+}
+
+func inspectLCLv4(bytecode []byte, info *LCLBytecodeInfo) error {
+	if len(bytecode) < OffsetPalette {
+		return fmt.Errorf("v4 bytecode too short: %d bytes", len(bytecode))
+	}
+
+	effectID := bytecode[OffsetEffect]
+	info.EffectID = int(effectID)
+	info.Effect = lclV4EffectNames[effectID]
+	if info.Effect == "" {
+		info.Effect = "unknown"
+		info.Warnings = append(info.Warnings, fmt.Sprintf("unknown effect ID 0x%02X", effectID))
+	}
+	info.Brightness = int(bytecode[OffsetBrightness])
+	info.Speed = int(bytecode[OffsetSpeed])
+
+	p1, p2, p3, p4 := int(bytecode[OffsetParam1]), int(bytecode[OffsetParam2]), int(bytecode[OffsetParam3]), int(bytecode[OffsetParam4])
+	params := map[string]int{"direction": p4 & 0x01}
+	switch effectID {
+	case EffectSparkle:
+		params["density"] = p1
+	case EffectPulse:
+		params["rhythm"] = p1
+	case EffectFire, EffectCandle:
+		params["cooling"] = p1
+		params["sparking"] = p2
+	case EffectWave:
+		params["wave_count"] = p1
+		params["eye_size"] = p2
+		params["tail_length"] = p3
+	case EffectScanner:
+		params["eye_size"] = p2
+		params["tail_length"] = p3
+	}
+	info.Params = params
+
+	count := int(bytecode[OffsetColorCount])
+	if count > MaxPaletteColors {
+		info.Warnings = append(info.Warnings, fmt.Sprintf("palette count %d exceeds maximum %d", count, MaxPaletteColors))
+		count = MaxPaletteColors
+	}
+	for i := 0; i < count; i++ {
+		offset := OffsetPalette + i*3
+		if offset+3 > len(bytecode) {
+			info.Warnings = append(info.Warnings, fmt.Sprintf("palette truncated after %d colors", i))
+			break
+		}
+		info.Colors = append(info.Colors, lclHexColor(bytecode[offset], bytecode[offset+1], bytecode[offset+2]))
+	}
+	if len(info.Colors) == 0 {
+		p := bytecode[OffsetPrimaryColor:]
+		info.Colors = append(info.Colors, lclHexColor(p[0], p[1], p[2]))
+	}
+
+	s := bytecode[OffsetSecondaryColor:]
+	if s[0] != 0 || s[1] != 0 || s[2] != 0 {
+		info.BackgroundColor = lclHexColor(s[0], s[1], s[2])
+	}
+
+	return nil
+}
+
+// inspectLCLv2 runs the literal parts of a v2 program: pushes, SET_PATTERN and
+// SET_PARAM. Anything computed at runtime (math, loops, per-LED drawing) can't
+// be expressed as fixed parameters, so it is skipped with a warning.
+func inspectLCLv2(bytecode []byte, info *LCLBytecodeInfo) {
+	var stack []int
+	pop := func() (int, bool) {
+		if len(stack) == 0 {
+			return 0, false
+		}
+		v := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		return v, true
+	}
+
+	var primary [3]int
+	primarySet := false
+	skipped := map[byte]bool{}
+	params := map[string]int{}
+
+	pc := LCLHeaderSize
+loop:
+	for pc+1 < len(bytecode) {
+		opcode := bytecode[pc]
+		pc += 2 // opcode + flags
+
+		operandLen := 0
+		switch opcode {
+		case lclOpPushU8:
+			operandLen = 1
+		case lclOpPushU16, lclOpPushI16, lclOpPushF16:
+			operandLen = 2
+		case lclOpPushColor:
+			operandLen = 3
+		}
+		if pc+operandLen > len(bytecode) {
+			info.Warnings = append(info.Warnings, fmt.Sprintf("truncated instruction 0x%02X at offset %d", opcode, pc-2))
+			break
+		}
+		operands := bytecode[pc : pc+operandLen]
+		pc += operandLen
+
+		switch opcode {
+		case lclOpNop:
+		case lclOpPushU8:
+			stack = append(stack, int(operands[0]))
+		case lclOpPushU16, lclOpPushF16:
+			stack = append(stack, int(operands[0])<<8|int(operands[1]))
+		case lclOpPushI16:
+			stack = append(stack, int(int16(uint16(operands[0])<<8|uint16(operands[1]))))
+		case lclOpPushColor:
+			stack = append(stack, int(operands[0])<<16|int(operands[1])<<8|int(operands[2]))
+			info.Colors = append(info.Colors, lclHexColor(operands[0], operands[1], operands[2]))
+		case lclOpPop:
+			pop()
+		case lclOpSetPattern:
+			effectID, ok := pop()
+			if !ok {
+				info.Warnings = append(info.Warnings, fmt.Sprintf("SET_PATTERN with empty stack at offset %d", pc-2))
+				continue
+			}
+			info.EffectID = effectID
+			info.Effect = lclV2EffectNames[effectID]
+			if info.Effect == "" {
+				info.Effect = "unknown"
+				info.Warnings = append(info.Warnings, fmt.Sprintf("unknown v2 effect ID 0x%02X", effectID))
+			}
+		case lclOpSetParam:
+			param, ok1 := pop()
+			value, ok2 := pop()
+			if !ok1 || !ok2 {
+				info.Warnings = append(info.Warnings, fmt.Sprintf("SET_PARAM with empty stack at offset %d", pc-2))
+				continue
+			}
+			switch param {
+			case lclParamRed, lclParamGreen, lclParamBlue:
+				primary[param-lclParamRed] = clampByte(value)
+				primarySet = true
+			case lclParamBrightness:
+				info.Brightness = clampByte(value)
+			case lclParamSpeed:
+				info.Speed = clampByte(value)
+			default:
+				if name, ok := lclV2ParamNames[param]; ok {
+					params[name] = value
+				} else {
+					info.Warnings = append(info.Warnings, fmt.Sprintf("unknown v2 parameter 0x%02X ignored", param))
+				}
+			}
+		case lclOpHalt:
+			break loop
+		default:
+			skipped[opcode] = true
+		}
+	}
+
+	if primarySet {
+		info.Colors = append([]string{lclHexColor(byte(primary[0]), byte(primary[1]), byte(primary[2]))}, info.Colors...)
+	}
+	if len(params) > 0 {
+		info.Params = params
+	}
+	if info.Effect == "" {
+		info.Effect = "solid"
+		info.EffectID = 0x01
+		info.Warnings = append(info.Warnings, "no SET_PATTERN instruction; assuming solid")
+	}
+	if len(skipped) > 0 {
+		ops := make([]string, 0, len(skipped))
+		for op := 0; op < 256; op++ {
+			if skipped[byte(op)] {
+				ops = append(ops, fmt.Sprintf("0x%02X", op))
+			}
+		}
+		info.Warnings = append(info.Warnings, fmt.Sprintf("runtime instructions (%s) cannot be represented as fixed parameters and were ignored", strings.Join(ops, ", ")))
+	}
+}
+
+// ToPatternSpec reconstructs a PatternSpec that compiles to equivalent v4
+// bytecode. The returned warnings list anything that could not carry over.
+func (info *LCLBytecodeInfo) ToPatternSpec() (*PatternSpec, []string) {
+	var warnings []string
+
+	effect := info.Effect
+	if _, ok := effectTypes[effect]; !ok {
+		if fallback, ok := lclV2EffectFallbacks[effect]; ok {
+			warnings = append(warnings, fmt.Sprintf("v2 effect %q has no v4 equivalent; using %q", effect, fallback))
+			effect = fallback
+		} else {
+			warnings = append(warnings, fmt.Sprintf("effect %q has no v4 equivalent; using solid", effect))
+			effect = "solid"
+		}
+	}
+
+	spec := &PatternSpec{
+		Effect:          effect,
+		Colors:          append([]string(nil), info.Colors...),
+		BackgroundColor: info.BackgroundColor,
+		Brightness:      info.Brightness,
+		Speed:           info.Speed,
+		Density:         info.Params["density"],
+		Cooling:         info.Params["cooling"],
+		WaveCount:       info.Params["wave_count"],
+		Rhythm:          info.Params["rhythm"],
+		Sparking:        info.Params["sparking"],
+		EyeSize:         info.Params["eye_size"],
+		TailLength:      info.Params["tail_length"],
+	}
+	if direction, ok := info.Params["direction"]; ok {
+		spec.SetDirection(direction & 0x01)
+	}
+	if len(spec.Colors) > MaxPaletteColors {
+		warnings = append(warnings, fmt.Sprintf("only the first %d of %d colors fit the v4 palette", MaxPaletteColors, len(spec.Colors)))
+		spec.Colors = spec.Colors[:MaxPaletteColors]
+	}
+
+	return spec, warnings
+}
+
+func lclHexColor(r, g, b byte) string {
+	return fmt.Sprintf("#%02X%02X%02X", r, g, b)
+}
@@ -0,0 +1,222 @@
+package shared
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SegmentSpec is one layer of a multi-segment LCL pattern: an effect with
+// its own behavior and appearance over a percent range of the strip, such as
+// fire on the left half and solid blue on the right. In the intent layer:
+//
+//	segments:
+//	  - range: 0-50%
+//	    effect: fire
+//	    behavior:
+//	      flame_height: tall
+//	  - range: 50-100%
+//	    effect: solid
+//	    appearance:
+//	      color: blue
+//
+// Ranges may not overlap. When no segment gives one, the strip is split
+// evenly between them.
+type SegmentSpec struct {
+	PatternSpec
+	Start int `json:"start"`          // Percent of the strip, 0-99
+	Stop  int `json:"stop,omitempty"` // Percent, exclusive; 0 when the range was left out
+}
+
+// LEDRange is the segment's LEDs on a strip of ledCount LEDs. Neighbouring
+// segments round their shared boundary the same way, so they never overlap;
+// on a short strip a narrow segment can come out empty.
+func (s SegmentSpec) LEDRange(ledCount int) (start, stop int) {
+	return (ledCount*s.Start + 50) / 100, (ledCount*s.Stop + 50) / 100
+}
+
+// parseSegmentRange reads a percent range such as "0-50%" or "50%-100%"
+func parseSegmentRange(value string) (int, int, error) {
+	parts := strings.SplitN(strings.ReplaceAll(value, "%", ""), "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("range %q must look like 0-50%%", value)
+	}
+	start, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return 0, 0, fmt.Errorf("range %q must look like 0-50%%", value)
+	}
+	stop, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return 0, 0, fmt.Errorf("range %q must look like 0-50%%", value)
+	}
+	return start, stop, nil
+}
+
+// intentSegmentParser collects the entries of an intent document's segments
+// list, line by line
+type intentSegmentParser struct {
+	segments   []SegmentSpec
+	itemIndent int    // Column of the current entry's own keys
+	section    string // Section within the current entry
+}
+
+func (p *intentSegmentParser) parseLine(line string) error {
+	indent := len(line) - len(strings.TrimLeft(line, " "))
+	trimmed := strings.TrimSpace(line)
+
+	// "- " starts an entry; its keys line up with the text after the dash
+	if strings.HasPrefix(trimmed, "-") {
+		rest := trimmed[1:]
+		p.itemIndent = indent + 1 + len(rest) - len(strings.TrimLeft(rest, " "))
+		p.section = ""
+		p.segments = append(p.segments, SegmentSpec{PatternSpec: PatternSpec{Brightness: 200, Speed: 128}})
+		trimmed = strings.TrimSpace(rest)
+		indent = p.itemIndent
+		if trimmed == "" {
+			return nil
+		}
+	}
+	if len(p.segments) == 0 {
+		return fmt.Errorf("each entry under segments must start with \"- \"")
+	}
+	seg := &p.segments[len(p.segments)-1]
+
+	if strings.HasSuffix(trimmed, ":") {
+		if indent <= p.itemIndent {
+			p.section = strings.TrimSuffix(trimmed, ":")
+		}
+		return nil
+	}
+
+	key, value, ok := splitIntentLine(trimmed)
+	if !ok {
+		return nil
+	}
+	if indent > p.itemIndent {
+		applyIntentKey(p.section, key, value, &seg.PatternSpec)
+		return nil
+	}
+
+	p.section = ""
+	switch key {
+	case "range":
+		start, stop, err := parseSegmentRange(value)
+		if err != nil {
+			return fmt.Errorf("segment %d: %v", len(p.segments)-1, err)
+		}
+		seg.Start, seg.Stop = start, stop
+	default:
+		applyIntentKey("", key, value, &seg.PatternSpec)
+	}
+	return nil
+}
+
+// apply sets the parsed segments on spec
+func (p *intentSegmentParser) apply(spec *PatternSpec) error {
+	spec.Segments = p.segments
+	return resolveSegmentSpecs(spec)
+}
+
+// resolveSegmentSpecs checks spec's segments, splits the strip evenly when
+// none has a range, and, when spec has no effect of its own, copies the
+// first segment into it for LCL bytecode
+func resolveSegmentSpecs(spec *PatternSpec) error {
+	segments := spec.Segments
+	ranged := 0
+	for i, seg := range segments {
+		if seg.Effect == "" {
+			return fmt.Errorf("segment %d: effect is required", i)
+		}
+		if len(seg.Segments) > 0 {
+			return fmt.Errorf("segment %d: segments can't be nested", i)
+		}
+		if seg.Stop != 0 {
+			ranged++
+		}
+	}
+	switch ranged {
+	case 0:
+		for i := range segments {
+			segments[i].Start = i * 100 / len(segments)
+			segments[i].Stop = (i + 1) * 100 / len(segments)
+		}
+	case len(segments):
+	default:
+		return fmt.Errorf("give every segment a range, or none to split the strip evenly")
+	}
+
+	if err := ValidateSegmentSpecs(segments); err != nil {
+		return err
+	}
+
+	if spec.Effect == "" {
+		brightness := spec.Brightness
+		first := segments[0].PatternSpec
+		*spec = first
+		spec.Brightness = brightness
+		spec.Segments = segments
+	}
+	return nil
+}
+
+// ValidateSegmentSpecs checks segments fit WLEDb: no more than
+// WLEDBMaxSegments, each range within 0-100% and not empty, and no two
+// ranges overlapping
+func ValidateSegmentSpecs(segments []SegmentSpec) error {
+	if len(segments) > WLEDBMaxSegments {
+		return fmt.Errorf("too many segments: %d (max %d)", len(segments), WLEDBMaxSegments)
+	}
+
+	order := make([]int, len(segments))
+	for i, seg := range segments {
+		if seg.Start < 0 || seg.Stop > 100 || seg.Start >= seg.Stop {
+			return fmt.Errorf("segment %d: range %d-%d%% must run forwards within 0-100%%", i, seg.Start, seg.Stop)
+		}
+		order[i] = i
+	}
+
+	sort.Slice(order, func(a, b int) bool { return segments[order[a]].Start < segments[order[b]].Start })
+	for k := 1; k < len(order); k++ {
+		prev, cur := segments[order[k-1]], segments[order[k]]
+		if cur.Start < prev.Stop {
+			return fmt.Errorf("segment %d (%d-%d%%) overlaps segment %d (%d-%d%%)",
+				order[k], cur.Start, cur.Stop, order[k-1], prev.Start, prev.Stop)
+		}
+	}
+	return nil
+}
+
+// convertLCLSegmentsToWLED converts each of spec's segments to a WLED
+// segment over its share of ledCount LEDs. Segments too narrow to get an LED
+// on this strip are left out.
+func convertLCLSegmentsToWLED(spec *PatternSpec, ledCount int) (*WLEDState, error) {
+	if err := ValidateSegmentSpecs(spec.Segments); err != nil {
+		return nil, err
+	}
+
+	state := &WLEDState{
+		On:         true,
+		Brightness: spec.Brightness,
+	}
+	for i, seg := range spec.Segments {
+		layer := seg.PatternSpec
+		layer.Segments = nil
+		converted, err := ConvertLCLToWLED(&layer, ledCount)
+		if err != nil {
+			return nil, fmt.Errorf("segment %d: %v", i, err)
+		}
+
+		wledSeg := converted.Segments[0]
+		wledSeg.Start, wledSeg.Stop = seg.LEDRange(ledCount)
+		if wledSeg.Start >= wledSeg.Stop {
+			continue
+		}
+		wledSeg.ID = len(state.Segments)
+		state.Segments = append(state.Segments, wledSeg)
+	}
+	if len(state.Segments) == 0 {
+		return nil, fmt.Errorf("no segment covers an LED of a %d-LED strip", ledCount)
+	}
+	return state, nil
+}
@@ -0,0 +1,194 @@
+package shared
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const fireAndIce = `name: "Fire and Ice"
+
+appearance:
+  brightness: full
+
+segments:
+  - range: 0-50%     # Left half
+    effect: fire
+    behavior:
+      flame_height: tall
+  - range: 50%-100%
+    effect: solid
+    appearance:
+      color: blue
+    timing:
+      speed: slow
+
+spatial:
+  origin: bottom
+`
+
+func TestParseTwoSegmentDocument(t *testing.T) {
+	spec, err := ParseIntentYAML(fireAndIce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(spec.Segments) != 2 {
+		t.Fatalf("parsed %d segments, want 2", len(spec.Segments))
+	}
+	left, right := spec.Segments[0], spec.Segments[1]
+	if left.Effect != "fire" || left.Start != 0 || left.Stop != 50 {
+		t.Errorf("left segment = %s %d-%d%%, want fire 0-50%%", left.Effect, left.Start, left.Stop)
+	}
+	if right.Effect != "solid" || right.Start != 50 || right.Stop != 100 || right.Speed != 70 ||
+		!reflect.DeepEqual(right.Colors, []string{resolveColor("blue")}) {
+		t.Errorf("right segment = %s %d-%d%% speed %d colors %v, want slow solid blue over 50-100%%",
+			right.Effect, right.Start, right.Stop, right.Speed, right.Colors)
+	}
+	if left.Colors != nil || left.Speed != 128 {
+		t.Errorf("the right segment's appearance leaked into the left: %+v", left.PatternSpec)
+	}
+
+	// The pattern plays the first segment in LCL bytecode, at its own brightness
+	if spec.Effect != "fire" || spec.Brightness != 255 {
+		t.Errorf("pattern effect %q brightness %d, want fire at 255", spec.Effect, spec.Brightness)
+	}
+
+	state, err := ConvertLCLToWLED(spec, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Brightness != 255 || len(state.Segments) != 2 {
+		t.Fatalf("WLED state brightness %d with %d segments, want 255 and 2", state.Brightness, len(state.Segments))
+	}
+	want := []struct{ id, start, stop, fx int }{{0, 0, 15, WLEDFXFire2012}, {1, 15, 30, WLEDFXSolid}}
+	for i, w := range want {
+		seg := state.Segments[i]
+		if seg.ID != w.id || seg.Start != w.start || seg.Stop != w.stop || seg.EffectID != w.fx {
+			t.Errorf("WLED segment %d = id %d LEDs %d-%d fx %d, want id %d LEDs %d-%d fx %d",
+				i, seg.ID, seg.Start, seg.Stop, seg.EffectID, w.id, w.start, w.stop, w.fx)
+		}
+	}
+	if _, err := CompileWLEDToBinary(state); err != nil {
+		t.Errorf("combined state doesn't compile: %v", err)
+	}
+}
+
+func TestSegmentDocumentErrors(t *testing.T) {
+	tests := []struct {
+		name, segments, wantErr string
+	}{
+		{"overlapping ranges", `
+  - range: 0-60%
+    effect: candle
+  - range: 40-100%
+    effect: sparkle`, "overlaps"},
+		{"range on only some entries", `
+  - range: 0-50%
+    effect: candle
+  - effect: sparkle`, "every segment a range"},
+		{"backwards range", `
+  - range: 70-20%
+    effect: candle`, "must run forwards"},
+		{"range past the strip", `
+  - range: 50-120%
+    effect: candle`, "must run forwards"},
+		{"unreadable range", `
+  - range: left half
+    effect: candle`, "must look like"},
+		{"missing effect", `
+  - range: 0-100%
+    appearance:
+      color: red`, "effect is required"},
+		{"too many segments", strings.Repeat(`
+  - effect: candle`, WLEDBMaxSegments+1), "too many segments"},
+	}
+	for _, tt := range tests {
+		_, err := ParseIntentYAML("name: test\nsegments:" + tt.segments + "\n")
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: %v, want an error containing %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestSegmentsWithoutRangesSplitEvenly(t *testing.T) {
+	spec, err := ParseIntentYAML("segments:\n  - effect: candle\n  - effect: sparkle\n  - effect: wave\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ranges [][2]int
+	for _, seg := range spec.Segments {
+		ranges = append(ranges, [2]int{seg.Start, seg.Stop})
+	}
+	if want := [][2]int{{0, 33}, {33, 66}, {66, 100}}; !reflect.DeepEqual(ranges, want) {
+		t.Errorf("ranges = %v, want %v", ranges, want)
+	}
+
+	// On a strip too short for every segment the narrow ones are left out
+	spec.Segments[0].Stop, spec.Segments[1].Start, spec.Segments[1].Stop = 98, 98, 99
+	spec.Segments[2].Start = 99
+	state, err := ConvertLCLToWLED(spec, 10)
+	if err != nil || len(state.Segments) != 1 || state.Segments[0].Stop != 10 {
+		t.Errorf("10-LED conversion = %+v, %v; want the first segment over the whole strip", state, err)
+	}
+}
+
+func TestSingleEffectDocumentsAreUnchanged(t *testing.T) {
+	doc := `effect: candle
+behavior:
+  flicker: strong
+appearance:
+  color: warm_white
+  brightness: medium
+timing:
+  speed: slow
+`
+	spec, err := ParseIntentYAML(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec.Segments != nil || spec.Effect != "candle" || spec.Brightness != 128 || spec.Speed != 70 {
+		t.Errorf("single-effect spec = %+v", spec)
+	}
+	state, err := ConvertLCLToWLED(spec, 30)
+	if err != nil || len(state.Segments) != 1 || state.Segments[0].Start != 0 || state.Segments[0].Stop != 30 {
+		t.Errorf("single-effect conversion = %+v, %v; want one segment over the strip", state, err)
+	}
+	if _, warnings, err := CompileLCL(doc); err != nil || len(warnings) != 0 {
+		t.Errorf("CompileLCL = %v, %v; want no warnings", warnings, err)
+	}
+}
+
+func TestSpecificationLayerSegments(t *testing.T) {
+	spec, err := ParseLCLSpec(`{"brightness": 180, "segments": [{"effect": "fire", "start": 0, "stop": 50}, {"effect": "solid", "start": 50, "stop": 100}]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec.Effect != "fire" || spec.Brightness != 180 || len(spec.Segments) != 2 {
+		t.Errorf("JSON spec = effect %q brightness %d with %d segments", spec.Effect, spec.Brightness, len(spec.Segments))
+	}
+	if _, err := ParseLCLSpec(`{"segments": [{"effect": "fire", "start": 0, "stop": 60}, {"effect": "solid", "start": 50, "stop": 100}]}`); err == nil {
+		t.Error("overlapping JSON segments were accepted")
+	}
+
+	_, warnings, err := CompileLCL(fireAndIce)
+	if err != nil || len(warnings) != 1 || !strings.Contains(warnings[0], "first of 2 segments") {
+		t.Errorf("CompileLCL warnings = %v, %v; want the first-segment warning", warnings, err)
+	}
+}
+
+func TestSegmentLEDRangesDontOverlap(t *testing.T) {
+	segments := []SegmentSpec{{Start: 0, Stop: 33}, {Start: 33, Stop: 67}, {Start: 67, Stop: 100}}
+	for _, ledCount := range []int{1, 7, 8, 30, 144, 300} {
+		prevStop := 0
+		for i, seg := range segments {
+			start, stop := seg.LEDRange(ledCount)
+			if start != prevStop || stop < start {
+				t.Errorf("%d LEDs: segment %d covers %d-%d after %d", ledCount, i, start, stop, prevStop)
+			}
+			prevStop = stop
+		}
+		if prevStop != ledCount {
+			t.Errorf("%d LEDs: segments end at %d", ledCount, prevStop)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package shared
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+)
+
+// FirmwareMaxSegments is how many segments the firmware runs at once
+// (WLED_MAX_SEGMENTS); segments past it are dropped on the device
+const FirmwareMaxSegments = 4
+
+// ErrLEDWindowUnsupported is returned when a window is applied to firmware
+// that can't run WLED segments
+var ErrLEDWindowUnsupported = errors.New("applying to part of a strip is not supported on this device")
+
+// ErrLEDWindowTooManySegments means the windowed pattern, with its off
+// segments, needs more segments than the firmware runs
+var ErrLEDWindowTooManySegments = errors.New("too many segments for the firmware")
+
+// LEDWindow is the part of a strip [Start, End) a pattern is applied to
+type LEDWindow struct {
+	Start int `json:"startLed"`
+	End   int `json:"endLed"` // Exclusive
+}
+
+// Len is the number of LEDs in the window
+func (w LEDWindow) Len() int {
+	return w.End - w.Start
+}
+
+// ResolveLEDWindow validates optional startLed/endLed against a strip of
+// ledCount LEDs. A missing start is 0 and a missing end is ledCount; nil is
+// returned when neither is given.
+func ResolveLEDWindow(startLED, endLED *int, ledCount int) (*LEDWindow, error) {
+	if startLED == nil && endLED == nil {
+		return nil, nil
+	}
+
+	w := LEDWindow{Start: 0, End: ledCount}
+	if startLED != nil {
+		w.Start = *startLED
+	}
+	if endLED != nil {
+		w.End = *endLED
+	}
+
+	if w.Start < 0 || w.End > ledCount {
+		return nil, fmt.Errorf("window %d-%d is outside the strip's %d LEDs", w.Start, w.End, ledCount)
+	}
+	if w.Start >= w.End {
+		return nil, fmt.Errorf("startLed (%d) must be less than endLed (%d)", w.Start, w.End)
+	}
+	return &w, nil
+}
+
+// WindowWLEDState moves the segments of wledJSON, sized to the window, into
+// the window on a strip of ledCount LEDs. The rest of the strip gets off
+// segments unless preserveRest is set; the firmware only draws LEDs inside a
+// segment, so those keep whatever they were showing.
+func WindowWLEDState(wledJSON string, ledCount int, w LEDWindow, preserveRest bool) (string, error) {
+	state, err := ParseWLEDJSON(wledJSON)
+	if err != nil {
+		return "", err
+	}
+
+	segments := make([]WLEDSegment, 0, len(state.Segments)+2)
+	off := func(start, stop int) WLEDSegment {
+		return WLEDSegment{Start: start, Stop: stop, EffectID: WLEDFXSolid, Colors: [][]int{{0, 0, 0}}, On: true}
+	}
+	if !preserveRest && w.Start > 0 {
+		segments = append(segments, off(0, w.Start))
+	}
+	for _, seg := range state.Segments {
+		seg.Start += w.Start
+		seg.Stop += w.Start
+		if seg.Stop > w.End {
+			seg.Stop = w.End
+		}
+		segments = append(segments, seg)
+	}
+	if !preserveRest && w.End < ledCount {
+		segments = append(segments, off(w.End, ledCount))
+	}
+
+	if len(segments) > FirmwareMaxSegments {
+		return "", fmt.Errorf("%w: pattern needs %d segments in this window; the firmware runs at most %d", ErrLEDWindowTooManySegments, len(segments), FirmwareMaxSegments)
+	}
+	for i := range segments {
+		segments[i].ID = i
+	}
+	state.Segments = segments
+	return WLEDStateToJSON(state)
+}
+
+// CompileForLEDWindow compiles pattern for window w of a strip of ledCount
+// LEDs, with o applied. Windowed bytecode isn't cached: it is compiled
+// straight from the windowed state, since CompileForLEDCount would stretch
+// every segment back to the full strip.
+func CompileForLEDWindow(pattern *Pattern, ledCount int, w LEDWindow, preserveRest bool, o OutputOverrides) ([]byte, []string, error) {
+	wledJSON, warnings, err := PrepareWLEDForLEDCount(pattern, w.Len())
+	if err != nil {
+		return nil, warnings, err
+	}
+
+	wledJSON, err = ApplyOutputOverrides(wledJSON, o)
+	if err != nil {
+		return nil, warnings, err
+	}
+
+	windowed, err := WindowWLEDState(wledJSON, ledCount, w, preserveRest)
+	if err != nil {
+		return nil, warnings, err
+	}
+
+	bytecode, compileWarnings, err := CompileWLED(windowed)
+	return bytecode, append(warnings, compileWarnings...), err
+}
+
+// ApplyPatternToStripWindow is ApplyPatternToStrip for window w of the strip.
+// Firmware without bytecode support gets ErrLEDWindowUnsupported.
+func ApplyPatternToStripWindow(device Device, pin, ledCount int, w LEDWindow, preserveRest bool, pattern Pattern, call ParticleCaller) ([]string, error) {
+	if !device.SupportsBytecode() {
+		return nil, ErrLEDWindowUnsupported
+	}
+
+	bytecode, warnings, err := CompileForLEDWindow(&pattern, ledCount, w, preserveRest, StripOutputOverrides(device, pin, OutputOverrides{}))
+	if err != nil {
+		return warnings, err
+	}
+
+	if _, err := CheckBytecodeMemory(device, bytecode, ledCount); err != nil {
+		return warnings, err
+	}
+
+	physical := device.ResolvePin(pin)
+	log.Printf("Sending setBytecode to %s pin D%d LEDs %d-%d (%d bytes)", device.Name, physical, w.Start, w.End, len(bytecode))
+	arg := fmt.Sprintf("%d,%s", physical, base64.StdEncoding.EncodeToString(bytecode))
+	return warnings, call(device.ParticleID, "setBytecode", arg)
+}
@@ -0,0 +1,368 @@
+package shared
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+var luxAutomationsTable = os.Getenv("LUX_AUTOMATIONS_TABLE")
+
+// LuxEventName is the Particle event firmware publishes ambient light
+// readings as. The data is the reading in lux, either bare ("42.5") or as
+// {"lux": 42.5}.
+const LuxEventName = "gl/lux"
+
+// LuxReadingMaxAge is how old a device's last reading can be and still drive
+// an automation; a sensor that has gone quiet doesn't switch lights
+const LuxReadingMaxAge = 30 * time.Minute
+
+// Lux automation limits
+const (
+	MaxLuxThreshold            = 100000
+	DefaultLuxCooldownMinutes  = 30
+	MaxLuxCooldownMinutes      = 24 * 60
+	MaxLuxAutomationsPerUser   = 20
+	luxAutomationNameMaxLength = 100
+	luxReadingMaxAbsoluteValue = 200000 // Direct sunlight is about 100k lux
+)
+
+// Lux automation states: which side of its thresholds the light level was on
+// when the automation last acted
+const (
+	LuxStateBelow = "below"
+	LuxStateAbove = "above"
+)
+
+// LuxReading is the last ambient light level a device published
+type LuxReading struct {
+	Lux float64   `json:"lux" dynamodbav:"lux"`
+	At  time.Time `json:"at" dynamodbav:"at"`
+}
+
+// LuxAction is what a lux automation does to a virtual group: apply
+// PatternID, or turn the group off
+type LuxAction struct {
+	GroupID   string `json:"groupId" dynamodbav:"groupId"`
+	PatternID string `json:"patternId,omitempty" dynamodbav:"patternId,omitempty"`
+	Off       bool   `json:"off,omitempty" dynamodbav:"off,omitempty"`
+}
+
+// LuxAutomation switches lights on the light level a device reports. It acts
+// once the level falls to Threshold or below, and once it rises to
+// Threshold+Hysteresis or above; readings in between change nothing, so a
+// level hovering around the threshold doesn't flap the lights. After a
+// manual command to a member of the target group it waits CooldownMinutes
+// before acting, so it doesn't fight the user.
+type LuxAutomation struct {
+	AutomationID    string     `json:"automationId" dynamodbav:"automationId"`
+	UserID          string     `json:"userId" dynamodbav:"userId"`
+	Name            string     `json:"name" dynamodbav:"name"`
+	DeviceID        string     `json:"deviceId" dynamodbav:"deviceId"` // Device publishing the readings
+	Threshold       float64    `json:"threshold" dynamodbav:"threshold"`
+	Hysteresis      float64    `json:"hysteresis" dynamodbav:"hysteresis"`
+	Below           *LuxAction `json:"below,omitempty" dynamodbav:"below,omitempty"` // When it gets dark
+	Above           *LuxAction `json:"above,omitempty" dynamodbav:"above,omitempty"` // When it gets light
+	CooldownMinutes int        `json:"cooldownMinutes" dynamodbav:"cooldownMinutes"`
+	Enabled         bool       `json:"enabled" dynamodbav:"enabled"`
+
+	// Evaluation state, kept by the scheduler
+	State        string     `json:"state,omitempty" dynamodbav:"state,omitempty"`
+	LastActionAt *time.Time `json:"lastActionAt,omitempty" dynamodbav:"lastActionAt,omitempty"`
+	LastResult   string     `json:"lastResult,omitempty" dynamodbav:"lastResult,omitempty"`
+
+	CreatedAt time.Time `json:"createdAt" dynamodbav:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt" dynamodbav:"updatedAt"`
+}
+
+// LuxAutomationRequest creates or replaces a lux automation's settings
+type LuxAutomationRequest struct {
+	Name            string     `json:"name"`
+	DeviceID        string     `json:"deviceId"`
+	Threshold       float64    `json:"threshold"`
+	Hysteresis      float64    `json:"hysteresis"`
+	Below           *LuxAction `json:"below,omitempty"`
+	Above           *LuxAction `json:"above,omitempty"`
+	CooldownMinutes *int       `json:"cooldownMinutes,omitempty"` // Default 30
+	Enabled         *bool      `json:"enabled,omitempty"`         // Default true
+}
+
+// Validate checks a lux automation request. It doesn't check that the
+// device, groups, and patterns exist or belong to the user.
+func (r *LuxAutomationRequest) Validate() error {
+	r.Name = strings.TrimSpace(r.Name)
+	if len(r.Name) > luxAutomationNameMaxLength {
+		return fmt.Errorf("name must be at most %d characters", luxAutomationNameMaxLength)
+	}
+	if r.DeviceID == "" {
+		return fmt.Errorf("deviceId is required")
+	}
+	if r.Threshold < 0 || r.Threshold > MaxLuxThreshold {
+		return fmt.Errorf("threshold must be between 0 and %d lux", MaxLuxThreshold)
+	}
+	if r.Hysteresis <= 0 || r.Threshold+r.Hysteresis > MaxLuxThreshold {
+		return fmt.Errorf("hysteresis must be greater than 0, with threshold + hysteresis at most %d lux", MaxLuxThreshold)
+	}
+	if r.Below == nil && r.Above == nil {
+		return fmt.Errorf("at least one of below and above is required")
+	}
+	for name, action := range map[string]*LuxAction{"below": r.Below, "above": r.Above} {
+		if action == nil {
+			continue
+		}
+		if action.GroupID == "" {
+			return fmt.Errorf("%s.groupId is required", name)
+		}
+		if (action.PatternID == "") == !action.Off {
+			return fmt.Errorf("%s needs exactly one of patternId and off", name)
+		}
+	}
+	if r.CooldownMinutes != nil && (*r.CooldownMinutes < 0 || *r.CooldownMinutes > MaxLuxCooldownMinutes) {
+		return fmt.Errorf("cooldownMinutes must be between 0 and %d", MaxLuxCooldownMinutes)
+	}
+	return nil
+}
+
+// Apply copies the request's settings onto a, resetting its evaluation
+// state so the new thresholds are judged from the next reading
+func (r LuxAutomationRequest) Apply(a *LuxAutomation) {
+	a.Name = r.Name
+	if a.Name == "" {
+		a.Name = "Lux automation"
+	}
+	a.DeviceID = r.DeviceID
+	a.Threshold = r.Threshold
+	a.Hysteresis = r.Hysteresis
+	a.Below = r.Below
+	a.Above = r.Above
+	a.CooldownMinutes = DefaultLuxCooldownMinutes
+	if r.CooldownMinutes != nil {
+		a.CooldownMinutes = *r.CooldownMinutes
+	}
+	a.Enabled = r.Enabled == nil || *r.Enabled
+	a.State = ""
+}
+
+// LuxState is which side of the automation's thresholds lux is on, or "" in
+// the hysteresis band between them
+func (a LuxAutomation) LuxState(lux float64) string {
+	switch {
+	case lux <= a.Threshold:
+		return LuxStateBelow
+	case lux >= a.Threshold+a.Hysteresis:
+		return LuxStateAbove
+	}
+	return ""
+}
+
+// Action is what the automation does on entering state, or nil
+func (a LuxAutomation) Action(state string) *LuxAction {
+	switch state {
+	case LuxStateBelow:
+		return a.Below
+	case LuxStateAbove:
+		return a.Above
+	}
+	return nil
+}
+
+// Transition is the state a reading moves the automation into, or "" if it
+// should do nothing: the reading is in the hysteresis band or on the side it
+// last acted on
+func (a LuxAutomation) Transition(lux float64) string {
+	state := a.LuxState(lux)
+	if state == "" || state == a.State {
+		return ""
+	}
+	return state
+}
+
+// CooldownRemaining is how much longer a manual command at manualAt holds
+// the automation off. Commands the automation sent itself, which come before
+// its LastActionAt, don't count.
+func (a LuxAutomation) CooldownRemaining(manualAt, now time.Time) time.Duration {
+	if manualAt.IsZero() || (a.LastActionAt != nil && !manualAt.After(*a.LastActionAt)) {
+		return 0
+	}
+	remaining := manualAt.Add(time.Duration(a.CooldownMinutes) * time.Minute).Sub(now)
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// ParseLuxEvent reads a gl/lux webhook event. The event's publish time is
+// used when it parses.
+func ParseLuxEvent(event ParticleWebhookEvent, now time.Time) (LuxReading, error) {
+	if event.Event != LuxEventName {
+		return LuxReading{}, fmt.Errorf("unsupported event %q", event.Event)
+	}
+
+	data := strings.TrimSpace(event.Data)
+	lux, err := strconv.ParseFloat(data, 64)
+	if err != nil {
+		var payload struct {
+			Lux *float64 `json:"lux"`
+		}
+		if jsonErr := json.Unmarshal([]byte(data), &payload); jsonErr != nil || payload.Lux == nil {
+			return LuxReading{}, fmt.Errorf("event data must be a lux value or {\"lux\": value}")
+		}
+		lux = *payload.Lux
+	}
+	if math.IsNaN(lux) || lux < 0 || lux > luxReadingMaxAbsoluteValue {
+		return LuxReading{}, fmt.Errorf("lux %v is out of range", lux)
+	}
+
+	at := now
+	if t, err := time.Parse(time.RFC3339, event.PublishedAt); err == nil {
+		at = t
+	}
+	return LuxReading{Lux: lux, At: at.UTC()}, nil
+}
+
+// RecordLuxReading saves a device's latest light reading
+func RecordLuxReading(ctx context.Context, devicesTable, deviceID string, reading LuxReading) error {
+	client, err := InitDynamoDB()
+	if err != nil {
+		return err
+	}
+
+	item, err := attributevalue.Marshal(reading)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(devicesTable),
+		Key: map[string]types.AttributeValue{
+			"deviceId": &types.AttributeValueMemberS{Value: deviceID},
+		},
+		UpdateExpression:    aws.String("SET lastLux = :reading"),
+		ConditionExpression: aws.String("attribute_exists(deviceId)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":reading": item,
+		},
+	})
+	return err
+}
+
+// GetUserLuxAutomations returns a user's lux automations
+func GetUserLuxAutomations(ctx context.Context, userID string) ([]LuxAutomation, error) {
+	indexName := "userId-index"
+	expressionValues := map[string]types.AttributeValue{
+		":userId": &types.AttributeValueMemberS{Value: userID},
+	}
+
+	var automations []LuxAutomation
+	if err := Query(ctx, luxAutomationsTable, &indexName, "userId = :userId", expressionValues, &automations); err != nil {
+		return nil, err
+	}
+	return automations, nil
+}
+
+// GetLuxAutomation returns a lux automation, or nil if there's none with id
+func GetLuxAutomation(ctx context.Context, id string) (*LuxAutomation, error) {
+	key, _ := attributevalue.MarshalMap(map[string]string{
+		"automationId": id,
+	})
+
+	var automation LuxAutomation
+	if err := GetItem(ctx, luxAutomationsTable, key, &automation); err != nil {
+		return nil, err
+	}
+	if automation.AutomationID == "" {
+		return nil, nil
+	}
+	return &automation, nil
+}
+
+// SaveLuxAutomation writes a lux automation
+func SaveLuxAutomation(ctx context.Context, automation LuxAutomation) error {
+	return PutItem(ctx, luxAutomationsTable, automation)
+}
+
+// DeleteLuxAutomation removes a lux automation
+func DeleteLuxAutomation(ctx context.Context, id string) error {
+	key, _ := attributevalue.MarshalMap(map[string]string{
+		"automationId": id,
+	})
+	return DeleteItem(ctx, luxAutomationsTable, key)
+}
+
+// ListEnabledLuxAutomations returns every user's enabled lux automations,
+// for the scheduler
+func ListEnabledLuxAutomations(ctx context.Context) ([]LuxAutomation, error) {
+	client, err := InitDynamoDB()
+	if err != nil {
+		return nil, err
+	}
+
+	var automations []LuxAutomation
+	paginator := dynamodb.NewScanPaginator(client, &dynamodb.ScanInput{
+		TableName:        aws.String(luxAutomationsTable),
+		FilterExpression: aws.String("enabled = :enabled"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":enabled": &types.AttributeValueMemberBOOL{Value: true},
+		},
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var batch []LuxAutomation
+		if err := attributevalue.UnmarshalListOfMaps(page.Items, &batch); err != nil {
+			return nil, err
+		}
+		automations = append(automations, batch...)
+	}
+	return automations, nil
+}
+
+// SaveLuxAutomationState records the outcome of an evaluation without
+// touching the settings, which the user may be editing at the same time
+func SaveLuxAutomationState(ctx context.Context, automation LuxAutomation) error {
+	client, err := InitDynamoDB()
+	if err != nil {
+		return err
+	}
+
+	update := "SET lastResult = :result"
+	var names map[string]string
+	values := map[string]types.AttributeValue{
+		":result":    &types.AttributeValueMemberS{Value: automation.LastResult},
+		":updatedAt": &types.AttributeValueMemberS{Value: automation.UpdatedAt.Format(time.RFC3339Nano)},
+	}
+	if automation.State != "" {
+		update += ", #state = :state"
+		names = map[string]string{"#state": "state"}
+		values[":state"] = &types.AttributeValueMemberS{Value: automation.State}
+	}
+	if automation.LastActionAt != nil {
+		update += ", lastActionAt = :actionAt"
+		values[":actionAt"] = &types.AttributeValueMemberS{Value: automation.LastActionAt.Format(time.RFC3339Nano)}
+	}
+
+	// Settings saved since the evaluation started reset the state; keep that
+	_, err = client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(luxAutomationsTable),
+		Key: map[string]types.AttributeValue{
+			"automationId": &types.AttributeValueMemberS{Value: automation.AutomationID},
+		},
+		UpdateExpression:          aws.String(update),
+		ConditionExpression:       aws.String("updatedAt = :updatedAt"),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	})
+	return err
+}
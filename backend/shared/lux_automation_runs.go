@@ -0,0 +1,115 @@
+package shared
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+var luxAutomationRunsTable = os.Getenv("LUX_AUTOMATION_RUNS_TABLE")
+
+// luxAutomationRunRetention is how long run history is kept before TTL
+// deletes it
+const luxAutomationRunRetention = 30 * 24 * time.Hour
+
+// MaxLuxAutomationRuns caps the runs GET .../runs returns
+const MaxLuxAutomationRuns = 100
+
+// What the scheduler decided for an automation on one check
+const (
+	LuxRunFired   = "fired"   // The action reached at least one strip
+	LuxRunSkipped = "skipped" // Nothing to do, or held off; Reason says why
+	LuxRunFailed  = "failed"  // The action was due but couldn't be carried out
+)
+
+// LuxAutomationRun is one scheduler check of one automation. Every check
+// records a run, so a missed action shows whether the scheduler skipped it
+// or the apply failed.
+type LuxAutomationRun struct {
+	AutomationID string               `json:"automationId" dynamodbav:"automationId"`
+	RunKey       string               `json:"-" dynamodbav:"runKey"`    // evaluatedAt then runId, so runs sort by time
+	RunID        string               `json:"runId" dynamodbav:"runId"` // Shared by every automation checked in the same tick
+	UserID       string               `json:"-" dynamodbav:"userId"`
+	EvaluatedAt  time.Time            `json:"evaluatedAt" dynamodbav:"evaluatedAt"`
+	Decision     string               `json:"decision" dynamodbav:"decision"`
+	Reason       string               `json:"reason,omitempty" dynamodbav:"reason,omitempty"`
+	Lux          *float64             `json:"lux,omitempty" dynamodbav:"lux,omitempty"`
+	State        string               `json:"state,omitempty" dynamodbav:"state,omitempty"` // The side of the thresholds acted on
+	GroupID      string               `json:"groupId,omitempty" dynamodbav:"groupId,omitempty"`
+	PatternID    string               `json:"patternId,omitempty" dynamodbav:"patternId,omitempty"` // Empty for off
+	Succeeded    int                  `json:"succeeded,omitempty" dynamodbav:"succeeded,omitempty"`
+	Failed       int                  `json:"failed,omitempty" dynamodbav:"failed,omitempty"`
+	Members      []LuxRunMemberResult `json:"members,omitempty" dynamodbav:"members,omitempty"` // The apply's per-strip results
+	ExpiresAt    int64                `json:"-" dynamodbav:"expiresAt"`                         // TTL
+}
+
+// LuxRunMemberResult is the apply result for one group member in a run
+type LuxRunMemberResult struct {
+	DeviceID string `json:"deviceId" dynamodbav:"deviceId"`
+	Pin      int    `json:"pin" dynamodbav:"pin"`
+	Success  bool   `json:"success" dynamodbav:"success"`
+	Error    string `json:"error,omitempty" dynamodbav:"error,omitempty"`
+}
+
+// NewLuxRunID returns an ID for one scheduler tick
+func NewLuxRunID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// luxRunKeyLayout is a fixed-width UTC timestamp, so run keys order by time
+const luxRunKeyLayout = "2006-01-02T15:04:05.000000000Z"
+
+// RecordLuxAutomationRun saves run, setting its key and expiry. Without
+// LUX_AUTOMATION_RUNS_TABLE it does nothing.
+func RecordLuxAutomationRun(ctx context.Context, run LuxAutomationRun) error {
+	if luxAutomationRunsTable == "" {
+		return nil
+	}
+	if run.EvaluatedAt.IsZero() {
+		run.EvaluatedAt = time.Now()
+	}
+	run.RunKey = run.EvaluatedAt.UTC().Format(luxRunKeyLayout) + "#" + run.RunID
+	run.ExpiresAt = run.EvaluatedAt.Add(luxAutomationRunRetention).Unix()
+	return PutItem(ctx, luxAutomationRunsTable, run)
+}
+
+// ListLuxAutomationRuns returns the automation's most recent runs, up to
+// limit, newest first
+func ListLuxAutomationRuns(ctx context.Context, automationID string, limit int) ([]LuxAutomationRun, error) {
+	if luxAutomationRunsTable == "" {
+		return []LuxAutomationRun{}, nil
+	}
+
+	client, err := InitDynamoDB()
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := client.Query(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(luxAutomationRunsTable),
+		KeyConditionExpression: aws.String("automationId = :automationId"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":automationId": &types.AttributeValueMemberS{Value: automationID},
+		},
+		ScanIndexForward: aws.Bool(false),
+		Limit:            aws.Int32(int32(limit)),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	runs := []LuxAutomationRun{}
+	if err := attributevalue.UnmarshalListOfMaps(output.Items, &runs); err != nil {
+		return nil, err
+	}
+	return runs, nil
+}
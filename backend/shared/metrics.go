@@ -0,0 +1,351 @@
+package shared
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+var metricsTable = os.Getenv("METRICS_TABLE")
+
+// Metric names. Labels are limited to values from small fixed sets (function,
+// route template, status code, call kind, outcome) so series stay bounded;
+// never label by device, user, or pattern.
+const (
+	// MetricHTTPRequests counts API requests. Labels: function, route (the API
+	// Gateway resource, e.g. /api/devices/{deviceId}), status.
+	MetricHTTPRequests = "candle_http_requests_total"
+	// MetricParticleCalls counts Particle Cloud API calls. Labels: kind
+	// (function, variable, device, devices), outcome (success, error).
+	MetricParticleCalls = "candle_particle_calls_total"
+	// MetricParticleCallDuration is a histogram of Particle Cloud API call
+	// durations in seconds. Labels: kind.
+	MetricParticleCallDuration = "candle_particle_call_duration_seconds"
+	// MetricClaudeTokens counts Claude API tokens. Labels: direction (input, output).
+	MetricClaudeTokens = "candle_claude_tokens_total"
+	// MetricPatternApplies counts patterns sent to strips. Labels: source
+	// (the function that applied it), outcome (success, failure).
+	MetricPatternApplies = "candle_pattern_applies_total"
+	// MetricDevicesOnline is the number of devices last seen online. It is
+	// read from the devices table at scrape time, not accumulated.
+	MetricDevicesOnline = "candle_devices_online"
+)
+
+// MetricDefinition describes a metric family for the exposition format
+type MetricDefinition struct {
+	Name string
+	Type string // counter, histogram, or gauge
+	Help string
+}
+
+// MetricDefinitions lists every exported metric, in exposition order
+var MetricDefinitions = []MetricDefinition{
+	{MetricHTTPRequests, "counter", "API requests by function, route, and status code."},
+	{MetricParticleCalls, "counter", "Particle Cloud API calls by kind and outcome."},
+	{MetricParticleCallDuration, "histogram", "Particle Cloud API call duration in seconds."},
+	{MetricClaudeTokens, "counter", "Claude API tokens by direction."},
+	{MetricPatternApplies, "counter", "Pattern applies to strips by source and outcome."},
+	{MetricDevicesOnline, "gauge", "Devices last seen online."},
+}
+
+// particleCallBuckets are the MetricParticleCallDuration bucket bounds in seconds
+var particleCallBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// Durable aggregates are kept under an all-time partition, which scrapes
+// read, and a daily partition that expires after metricsDailyRetention
+const (
+	metricsTotalPeriod    = "total"
+	metricsDailyRetention = 90 * 24 * time.Hour
+)
+
+// metricsRegistry holds the counter deltas recorded since the last flush,
+// keyed by series ("name{label=\"value\",...}")
+type metricsRegistry struct {
+	mu     sync.Mutex
+	deltas map[string]float64
+}
+
+var registry = &metricsRegistry{deltas: make(map[string]float64)}
+
+func (r *metricsRegistry) add(series string, value float64) {
+	r.mu.Lock()
+	r.deltas[series] += value
+	r.mu.Unlock()
+}
+
+// take returns and clears the pending deltas
+func (r *metricsRegistry) take() map[string]float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	deltas := r.deltas
+	r.deltas = make(map[string]float64)
+	return deltas
+}
+
+// metricSeries builds a series key from a name and label name/value pairs
+func metricSeries(name string, labels ...string) string {
+	if len(labels) < 2 {
+		return name
+	}
+	var b strings.Builder
+	b.WriteString(name)
+	b.WriteByte('{')
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=%q", labels[i], labels[i+1])
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// CountRequest records an API request
+func CountRequest(function, route string, status int) {
+	if route == "" {
+		route = "unknown"
+	}
+	registry.add(metricSeries(MetricHTTPRequests, "function", function, "route", route, "status", strconv.Itoa(status)), 1)
+}
+
+// ObserveParticleCall records a Particle Cloud API call of kind that started
+// at start and failed with err, if not nil
+func ObserveParticleCall(kind string, start time.Time, err error) {
+	outcome := "success"
+	if err != nil {
+		outcome = "error"
+	}
+	registry.add(metricSeries(MetricParticleCalls, "kind", kind, "outcome", outcome), 1)
+
+	seconds := time.Since(start).Seconds()
+	for _, bound := range particleCallBuckets {
+		if seconds <= bound {
+			registry.add(metricSeries(MetricParticleCallDuration+"_bucket", "kind", kind, "le", formatMetricValue(bound)), 1)
+		}
+	}
+	registry.add(metricSeries(MetricParticleCallDuration+"_bucket", "kind", kind, "le", "+Inf"), 1)
+	registry.add(metricSeries(MetricParticleCallDuration+"_sum", "kind", kind), seconds)
+	registry.add(metricSeries(MetricParticleCallDuration+"_count", "kind", kind), 1)
+}
+
+// CountClaudeTokens records the tokens used by a Claude API call
+func CountClaudeTokens(input, output int) {
+	registry.add(metricSeries(MetricClaudeTokens, "direction", "input"), float64(input))
+	registry.add(metricSeries(MetricClaudeTokens, "direction", "output"), float64(output))
+}
+
+// CountPatternApply records a pattern sent, or failing to be sent, to a strip
+func CountPatternApply(source string, success bool) {
+	outcome := "success"
+	if !success {
+		outcome = "failure"
+	}
+	registry.add(metricSeries(MetricPatternApplies, "source", source, "outcome", outcome), 1)
+}
+
+// FlushMetrics adds the deltas recorded since the last flush to the durable
+// aggregates. Lambda may freeze the process between invocations, so call it
+// before each invocation returns. Deltas that fail to write are kept for the
+// next flush.
+func FlushMetrics(ctx context.Context) {
+	deltas := registry.take()
+	if len(deltas) == 0 || metricsTable == "" {
+		return
+	}
+
+	client, err := InitDynamoDB()
+	if err != nil {
+		log.Printf("[METRICS] Failed to initialize DynamoDB: %v", err)
+		for series, value := range deltas {
+			registry.add(series, value)
+		}
+		return
+	}
+
+	now := time.Now().UTC()
+	day := "day#" + now.Format("2006-01-02")
+	expiresAt := now.Add(metricsDailyRetention).Unix()
+
+	for series, value := range deltas {
+		if err := addMetric(ctx, client, metricsTotalPeriod, series, value, 0); err != nil {
+			log.Printf("[METRICS] Failed to flush %s: %v", series, err)
+			registry.add(series, value)
+			continue
+		}
+		if err := addMetric(ctx, client, day, series, value, expiresAt); err != nil {
+			// The all-time total is what scrapes read; a missed daily delta isn't retried
+			log.Printf("[METRICS] Failed to flush daily %s: %v", series, err)
+		}
+	}
+}
+
+// addMetric atomically adds value to one stored series
+func addMetric(ctx context.Context, client *dynamodb.Client, period, series string, value float64, expiresAt int64) error {
+	update := "ADD #value :delta"
+	values := map[string]types.AttributeValue{
+		":delta": &types.AttributeValueMemberN{Value: formatMetricValue(value)},
+	}
+	if expiresAt > 0 {
+		update += " SET expiresAt = if_not_exists(expiresAt, :expiresAt)"
+		values[":expiresAt"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(expiresAt, 10)}
+	}
+
+	_, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(metricsTable),
+		Key: map[string]types.AttributeValue{
+			"period": &types.AttributeValueMemberS{Value: period},
+			"series": &types.AttributeValueMemberS{Value: series},
+		},
+		UpdateExpression:          aws.String(update),
+		ExpressionAttributeNames:  map[string]string{"#value": "value"},
+		ExpressionAttributeValues: values,
+	})
+	return err
+}
+
+// WithMetrics counts function's API requests and flushes the metrics recorded
+// while handling each one
+func WithMetrics(function string, handler APIHandler) APIHandler {
+	return func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		response, err := handler(ctx, request)
+
+		status := response.StatusCode
+		if err != nil {
+			status = 500
+		}
+		CountRequest(function, request.Resource, status)
+		FlushMetrics(ctx)
+		return response, err
+	}
+}
+
+// storedMetric is one series in the metrics table
+type storedMetric struct {
+	Period string  `dynamodbav:"period"`
+	Series string  `dynamodbav:"series"`
+	Value  float64 `dynamodbav:"value"`
+}
+
+// LoadMetricTotals reads the all-time value of every stored series
+func LoadMetricTotals(ctx context.Context) (map[string]float64, error) {
+	if metricsTable == "" {
+		return nil, fmt.Errorf("METRICS_TABLE is not configured")
+	}
+
+	client, err := InitDynamoDB()
+	if err != nil {
+		return nil, err
+	}
+
+	totals := make(map[string]float64)
+	paginator := dynamodb.NewQueryPaginator(client, &dynamodb.QueryInput{
+		TableName:              aws.String(metricsTable),
+		KeyConditionExpression: aws.String("period = :period"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":period": &types.AttributeValueMemberS{Value: metricsTotalPeriod},
+		},
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var items []storedMetric
+		if err := attributevalue.UnmarshalListOfMaps(page.Items, &items); err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			totals[item.Series] = item.Value
+		}
+	}
+	return totals, nil
+}
+
+// RenderPrometheus writes series in the Prometheus text exposition format,
+// grouped by MetricDefinitions with HELP and TYPE lines. Series of unknown
+// metrics are skipped.
+func RenderPrometheus(series map[string]float64) string {
+	byFamily := make(map[string][]string)
+	for key := range series {
+		family := metricFamily(key)
+		byFamily[family] = append(byFamily[family], key)
+	}
+
+	var b strings.Builder
+	for _, def := range MetricDefinitions {
+		keys := byFamily[def.Name]
+		if len(keys) == 0 {
+			continue
+		}
+		sort.Slice(keys, func(i, j int) bool { return seriesLess(keys[i], keys[j]) })
+
+		fmt.Fprintf(&b, "# HELP %s %s\n", def.Name, def.Help)
+		fmt.Fprintf(&b, "# TYPE %s %s\n", def.Name, def.Type)
+		for _, key := range keys {
+			fmt.Fprintf(&b, "%s %s\n", key, formatMetricValue(series[key]))
+		}
+	}
+	return b.String()
+}
+
+// metricFamily returns the metric a series belongs to, mapping histogram
+// _bucket, _sum, and _count series to their histogram
+func metricFamily(series string) string {
+	name := series
+	if i := strings.IndexByte(series, '{'); i >= 0 {
+		name = series[:i]
+	}
+	for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+		if base := strings.TrimSuffix(name, suffix); base != name && base == MetricParticleCallDuration {
+			return base
+		}
+	}
+	return name
+}
+
+// seriesLess orders series by name and labels, with histogram buckets in
+// increasing le order
+func seriesLess(a, b string) bool {
+	aBase, aLE := splitBucketBound(a)
+	bBase, bLE := splitBucketBound(b)
+	if aBase != bBase {
+		return aBase < bBase
+	}
+	return aLE < bLE
+}
+
+// splitBucketBound removes the le label from a series, returning the rest and
+// the bound (+Inf when absent)
+func splitBucketBound(series string) (string, float64) {
+	i := strings.Index(series, `le="`)
+	if i < 0 {
+		return series, math.Inf(1)
+	}
+	end := strings.IndexByte(series[i+4:], '"')
+	if end < 0 {
+		return series, math.Inf(1)
+	}
+	raw := series[i+4 : i+4+end]
+	bound, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		bound = math.Inf(1)
+	}
+	return series[:i] + series[i+4+end+1:], bound
+}
+
+func formatMetricValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
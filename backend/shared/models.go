@@ -1,21 +1,63 @@
 package shared
 
-import "time"
+import (
+    "fmt"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+    "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
 
 // User represents a user in the system
 type User struct {
-    Username      string    `json:"username" dynamodbav:"username"`
-    PasswordHash  string    `json:"-" dynamodbav:"passwordHash"`
-    ParticleToken string    `json:"-" dynamodbav:"particleToken,omitempty"`
-    CreatedAt     time.Time `json:"createdAt" dynamodbav:"createdAt"`
-    UpdatedAt     time.Time `json:"updatedAt" dynamodbav:"updatedAt"`
+    Username         string    `json:"username" dynamodbav:"username"`
+    PasswordHash     string    `json:"-" dynamodbav:"passwordHash"`
+    ParticleToken    string    `json:"-" dynamodbav:"particleToken,omitempty"`
+    ParticleTokenExpiresAt *time.Time `json:"particleTokenExpiresAt,omitempty" dynamodbav:"particleTokenExpiresAt,omitempty"` // From Particle when the token was saved; nil if it never expires or wasn't known
+    IsAdmin          bool      `json:"isAdmin,omitempty" dynamodbav:"isAdmin"`
+    IsServiceAccount bool      `json:"isServiceAccount,omitempty" dynamodbav:"isServiceAccount"`
+    EmailVerified    bool      `json:"emailVerified" dynamodbav:"emailVerified"`
+    IsActive         bool      `json:"isActive" dynamodbav:"isActive"` // False when suspended; new users start active
+    Email            string    `json:"email,omitempty" dynamodbav:"email,omitempty"`
+    NotificationSettings *NotificationSettings `json:"notificationSettings,omitempty" dynamodbav:"notificationSettings,omitempty"`
+    TwoFactor        *TwoFactor `json:"-" dynamodbav:"twoFactor,omitempty"` // TOTP state; see two_factor.go
+    AllOffUntil      int64     `json:"-" dynamodbav:"allOffUntil,omitempty"` // Unix seconds; repeat all-off calls before this are skipped (see ClaimAllOff)
+    SupportAccessGrantedAt *time.Time `json:"-" dynamodbav:"supportAccessGrantedAt,omitempty"` // Admins may impersonate the user until SupportAccessExpiresAt
+    SupportAccessExpiresAt *time.Time `json:"-" dynamodbav:"supportAccessExpiresAt,omitempty"`
+    AlexaRegion      string    `json:"alexaRegion,omitempty" dynamodbav:"alexaRegion,omitempty"` // AlexaRegionNA/EU/FE, from the Alexa account linking; picks the event gateway
+    AlexaLinkedAt    *time.Time `json:"alexaLinkedAt,omitempty" dynamodbav:"alexaLinkedAt,omitempty"` // When the Alexa skill was last linked; cleared on unlink
+    AlexaGrant       *AlexaGrant `json:"-" dynamodbav:"alexaGrant,omitempty"` // Login with Amazon tokens for proactive events, from the AcceptGrant; cleared on unlink
+    FeatureFlags     map[string]bool `json:"featureFlags,omitempty" dynamodbav:"featureFlags,omitempty"` // Per-user overrides of FEATURE_FLAGS (see IsFeatureEnabled)
+    CreatedAt        time.Time `json:"createdAt" dynamodbav:"createdAt"`
+    UpdatedAt        time.Time `json:"updatedAt" dynamodbav:"updatedAt"`
+}
+
+// UnmarshalDynamoDBAttributeValue treats records written before isActive
+// existed as active, so saving them back doesn't suspend the account
+func (u *User) UnmarshalDynamoDBAttributeValue(av types.AttributeValue) error {
+    type plainUser User
+    var decoded plainUser
+    if err := attributevalue.Unmarshal(av, &decoded); err != nil {
+        return err
+    }
+
+    if m, ok := av.(*types.AttributeValueMemberM); ok {
+        if _, present := m.Value["isActive"]; !present {
+            decoded.IsActive = true
+        }
+    }
+
+    *u = User(decoded)
+    return nil
 }
 
 // PatternColor represents a single color with percentage for multi-color patterns
 type PatternColor struct {
-    R          int `json:"r" dynamodbav:"r"`
-    G          int `json:"g" dynamodbav:"g"`
-    B          int `json:"b" dynamodbav:"b"`
+    R          int `json:"r" dynamodbav:"r" openapi:"minimum=0,maximum=255"`
+    G          int `json:"g" dynamodbav:"g" openapi:"minimum=0,maximum=255"`
+    B          int `json:"b" dynamodbav:"b" openapi:"minimum=0,maximum=255"`
     Percentage int `json:"percentage" dynamodbav:"percentage"`
 }
 
@@ -23,16 +65,17 @@ type PatternColor struct {
 type Pattern struct {
     PatternID   string            `json:"patternId" dynamodbav:"patternId"`
     UserID      string            `json:"userId" dynamodbav:"userId"`
-    Name        string            `json:"name" dynamodbav:"name"`
-    Description string            `json:"description" dynamodbav:"description"`
+    Name        string            `json:"name" dynamodbav:"name" openapi:"maxLength=80"`
+    Description string            `json:"description" dynamodbav:"description" openapi:"maxLength=500"`
     Type        string            `json:"type" dynamodbav:"type"` // candle, solid, pulse, wave, rainbow, fire, glowblaster
-    Red         int               `json:"red" dynamodbav:"red"`
-    Green       int               `json:"green" dynamodbav:"green"`
-    Blue        int               `json:"blue" dynamodbav:"blue"`
+    Red         int               `json:"red" dynamodbav:"red" openapi:"minimum=0,maximum=255"`
+    Green       int               `json:"green" dynamodbav:"green" openapi:"minimum=0,maximum=255"`
+    Blue        int               `json:"blue" dynamodbav:"blue" openapi:"minimum=0,maximum=255"`
     Colors      []PatternColor    `json:"colors,omitempty" dynamodbav:"colors,omitempty"`
-    Brightness  int               `json:"brightness" dynamodbav:"brightness"`
+    Brightness  int               `json:"brightness" dynamodbav:"brightness"` // BrightnessByte, 0-255
     Speed       int               `json:"speed" dynamodbav:"speed"`
     Metadata    map[string]string `json:"metadata,omitempty" dynamodbav:"metadata"`
+    EffectID    *int              `json:"effectId,omitempty" dynamodbav:"effectId,omitempty"` // WLED effect replacing the type's for legacy patterns; see NormalizePatternEffectID
     // Glow Blaster fields (LCL v4 - legacy)
     Category       string `json:"category,omitempty" dynamodbav:"category,omitempty"`             // "standard" or "glowblaster"
     LCLSpec        string `json:"lclSpec,omitempty" dynamodbav:"lclSpec,omitempty"`               // GlowBlaster Language specification text
@@ -41,8 +84,14 @@ type Pattern struct {
     ConversationID string `json:"conversationId,omitempty" dynamodbav:"conversationId,omitempty"` // Source conversation ID
     // WLED fields (new format)
     WLEDState     string `json:"wledState,omitempty" dynamodbav:"wledState,omitempty"`         // WLED JSON state string
-    WLEDBinary    []byte `json:"wledBinary,omitempty" dynamodbav:"wledBinary,omitempty"`       // Compact WLED binary
+    WLEDBinary    []byte `json:"wledBinary,omitempty" dynamodbav:"wledBinary,omitempty"`       // WLEDState compiled as authored (see StoreCompiledBinary)
+    BinarySizeBytes int  `json:"binarySizeBytes,omitempty" dynamodbav:"-"`                     // len(WLEDBinary), on list responses (see FillBinarySizes)
     FormatVersion int    `json:"formatVersion,omitempty" dynamodbav:"formatVersion,omitempty"` // 1=LCL, 2=WLED
+    PreviewFrameCount int `json:"previewFrameCount,omitempty" dynamodbav:"previewFrameCount,omitempty"` // Frames in animated preview (0 = default)
+    CompiledCache     map[string][]byte `json:"-" dynamodbav:"compiledCache,omitempty"`             // Precompiled bytecode keyed by "<ledCount>@<updatedAt>"
+    CompatibleEffectIDs []int           `json:"compatibleEffectIds,omitempty" dynamodbav:"compatibleEffectIds,omitempty"` // Distinct WLED effects used (for Alexa modes)
+    ApplyCount          int             `json:"applyCount" dynamodbav:"applyCount"`                                       // Times successfully sent to hardware (atomic ADD)
+    IsFavorite          bool            `json:"isFavorite" dynamodbav:"isFavorite"`                                       // Shown in the quick-access bar; toggling doesn't touch UpdatedAt
     CreatedAt     time.Time         `json:"createdAt" dynamodbav:"createdAt"`
     UpdatedAt     time.Time         `json:"updatedAt" dynamodbav:"updatedAt"`
 }
@@ -52,6 +101,8 @@ type LEDStrip struct {
     Pin       int    `json:"pin" dynamodbav:"pin"`                                 // Pin number (0-7 for D0-D7)
     LEDCount  int    `json:"ledCount" dynamodbav:"ledCount"`                       // Number of LEDs on this strip
     PatternID string `json:"patternId,omitempty" dynamodbav:"patternId,omitempty"` // Assigned pattern ID for this strip
+    SpeedMultiplier float64 `json:"speedMultiplier,omitempty" dynamodbav:"speedMultiplier,omitempty" openapi:"minimum=0,maximum=4"` // Scales effect speed on this strip (0 = 1.0); see StripOutputOverrides
+    CommandSeq      int64   `json:"commandSeq,omitempty" dynamodbav:"commandSeq,omitempty"` // Last command sequence taken for the strip (see NextStripCommandSeq)
 }
 
 // Device represents a Particle Argon device
@@ -59,14 +110,42 @@ type Device struct {
     DeviceID        string     `json:"deviceId" dynamodbav:"deviceId"`
     UserID          string     `json:"userId" dynamodbav:"userId"`
     Name            string     `json:"name" dynamodbav:"name"`
+    AlexaName       string     `json:"alexaName,omitempty" dynamodbav:"alexaName,omitempty"` // Name as Alexa is told it when Name has characters Alexa rejects (see SetName)
     ParticleID      string     `json:"particleId" dynamodbav:"particleId"`
+    Room            string     `json:"room,omitempty" dynamodbav:"room,omitempty"` // "" means Unassigned
     AssignedPattern string     `json:"assignedPattern,omitempty" dynamodbav:"assignedPattern"`
     LEDStrips       []LEDStrip `json:"ledStrips,omitempty" dynamodbav:"ledStrips,omitempty"`
     IsOnline        bool       `json:"isOnline" dynamodbav:"isOnline"`
     IsReady         bool       `json:"isReady" dynamodbav:"isReady"`                           // Device has valid firmware with cloud variables
+    ReadinessStatus     string     `json:"readinessStatus,omitempty" dynamodbav:"readinessStatus,omitempty"`         // ready, no_firmware_variable, offline, or transient_error (see ApplyReadiness)
+    ReadinessMessage    string     `json:"readinessMessage,omitempty" dynamodbav:"readinessMessage,omitempty"`       // Error from the last check, if any
+    ReadinessCheckedAt  *time.Time `json:"readinessCheckedAt,omitempty" dynamodbav:"readinessCheckedAt,omitempty"`   // When ReadinessStatus was last determined
+    ReadinessStaleSince *time.Time `json:"readinessStaleSince,omitempty" dynamodbav:"readinessStaleSince,omitempty"` // Set while transient errors keep a last-known-good ready status
     FirmwareVersion string     `json:"firmwareVersion,omitempty" dynamodbav:"firmwareVersion"` // Firmware version from deviceInfo
+    FirmwareAdvisory *FirmwareAdvisory `json:"firmwareAdvisory,omitempty" dynamodbav:"firmwareAdvisory,omitempty"` // Known issue with FirmwareVersion, if any (see FirmwareAdvisoryFor)
     Platform        string     `json:"platform,omitempty" dynamodbav:"platform"`               // Device platform (argon, photon, etc.)
+    FreeMemory      int        `json:"freeMemory,omitempty" dynamodbav:"freeMemory,omitempty"` // Free heap bytes from deviceInfo at last refresh (0 if not reported)
+    MaxStrips       int        `json:"maxStrips,omitempty" dynamodbav:"maxStrips,omitempty"`             // Strip limit from deviceInfo (0 if not reported)
+    MaxLEDs         int        `json:"maxLedsPerStrip,omitempty" dynamodbav:"maxLedsPerStrip,omitempty"` // Per-strip LED limit from deviceInfo (0 if not reported; see LEDLimit)
+    Manufacturer    string     `json:"manufacturer,omitempty" dynamodbav:"manufacturer,omitempty"` // "particle" (default) or "wled"
+    FirmwareType    string     `json:"firmwareType,omitempty" dynamodbav:"firmwareType,omitempty"` // "candle-lights" (default) or "wled"
+    CustomPinMapping map[string]int `json:"customPinMapping,omitempty" dynamodbav:"customPinMapping,omitempty"` // Logical strip name ("strip1") -> physical pin
+    PlatformPins    *PlatformPinDefaults `json:"pinDefaults,omitempty" dynamodbav:"-"` // Platform's default and supported pins, on GET /api/devices/{id} (see PinDefaults)
+    Capabilities    []string   `json:"capabilities,omitempty" dynamodbav:"capabilities,omitempty"` // Cloud functions the firmware registers, plus CommandSeqCapability (from the Particle device info)
     IsHidden        bool       `json:"isHidden" dynamodbav:"isHidden"`
+    Icon            string     `json:"icon,omitempty" dynamodbav:"icon,omitempty"`               // Dashboard icon from DisplayIcons ("" = DisplayIcon's platform default)
+    AccentColor     string     `json:"accentColor,omitempty" dynamodbav:"accentColor,omitempty"` // Dashboard accent "#RRGGBB"
+    OfflineAlertSentAt *time.Time `json:"offlineAlertSentAt,omitempty" dynamodbav:"offlineAlertSentAt,omitempty"` // Set while an offline alert is outstanding
+    OfflineAlertCount  int        `json:"offlineAlertCount,omitempty" dynamodbav:"offlineAlertCount,omitempty"`   // Offline episodes alerted on, ever (the weekly summary reports the change)
+    ErrorCount      int          `json:"errorCount,omitempty" dynamodbav:"errorCount,omitempty"`   // Errors the device has reported (atomic ADD)
+    LastErrorAt     *time.Time   `json:"lastErrorAt,omitempty" dynamodbav:"lastErrorAt,omitempty"` // When the device last reported an error
+    LastApply       *DeviceApply `json:"lastApply,omitempty" dynamodbav:"lastApply,omitempty"`     // Last pattern the backend sent, for error correlation
+    LastLux         *LuxReading  `json:"lastLux,omitempty" dynamodbav:"lastLux,omitempty"`         // Latest gl/lux light reading (see LuxAutomation)
+    CommandTimeoutSeconds int        `json:"commandTimeoutSeconds,omitempty" dynamodbav:"commandTimeoutSeconds,omitempty"` // Per-call timeout (0 = DefaultCommandTimeoutSeconds)
+    SlowCallCount         int        `json:"slowCallCount,omitempty" dynamodbav:"slowCallCount,omitempty"`                 // Applies where a call took most of the timeout (atomic ADD)
+    LastSlowCallAt        *time.Time `json:"lastSlowCallAt,omitempty" dynamodbav:"lastSlowCallAt,omitempty"`
+    CommandBurst          int        `json:"commandBurst,omitempty" dynamodbav:"commandBurst,omitempty"`           // Calls allowed at once (0 = DefaultCommandBurst)
+    CommandsPerMinute     int        `json:"commandsPerMinute,omitempty" dynamodbav:"commandsPerMinute,omitempty"` // Sustained call rate (0 = DefaultCommandsPerMinute)
     LastSeen        time.Time  `json:"lastSeen" dynamodbav:"lastSeen"`
     CreatedAt       time.Time  `json:"createdAt" dynamodbav:"createdAt"`
     UpdatedAt       time.Time  `json:"updatedAt" dynamodbav:"updatedAt"`
@@ -78,18 +157,28 @@ type APIResponse struct {
     Message string      `json:"message,omitempty"`
     Data    interface{} `json:"data,omitempty"`
     Error   string      `json:"error,omitempty"`
+
+    // Set when data is missing details a secondary lookup couldn't supply (see PartialResults)
+    Partial  bool     `json:"partial,omitempty"`
+    Warnings []string `json:"warnings,omitempty"`
 }
 
 // LoginRequest represents a login request
 type LoginRequest struct {
-    Username string `json:"username"`
-    Password string `json:"password"`
+    Username   string `json:"username"`
+    Password   string `json:"password"`
+    RememberMe bool   `json:"rememberMe,omitempty"` // Longer-lived session (RememberMeSessionDuration)
 }
 
 // LoginResponse represents a login response
 type LoginResponse struct {
-    Token    string `json:"token"`
-    Username string `json:"username"`
+    Token     string `json:"token"`
+    Username  string `json:"username"`
+    ExpiresAt int64  `json:"expiresAt"` // Session expiry (Unix seconds)
+    ExpiresIn int64  `json:"expiresIn"` // Seconds until expiry, for cookie Max-Age
+
+    Impersonation  bool   `json:"impersonation,omitempty"` // An admin acting as Username
+    ImpersonatedBy string `json:"impersonatedBy,omitempty"`
 }
 
 // PatternType constants
@@ -109,6 +198,110 @@ const (
     CategoryGlowBlaster = "glowblaster"
 )
 
+// Device manufacturer and firmware type constants
+const (
+    ManufacturerParticle     = "particle"
+    ManufacturerWLED         = "wled"
+    FirmwareTypeCandleLights = "candle-lights"
+    FirmwareTypeWLED         = "wled"
+)
+
+// GetManufacturer returns the device manufacturer, defaulting to Particle for older records
+func (d Device) GetManufacturer() string {
+    if d.Manufacturer == "" {
+        return ManufacturerParticle
+    }
+    return d.Manufacturer
+}
+
+// GetFirmwareType returns the firmware type, defaulting to candle-lights for older records
+func (d Device) GetFirmwareType() string {
+    if d.FirmwareType == "" {
+        return FirmwareTypeCandleLights
+    }
+    return d.FirmwareType
+}
+
+// SetName sets the device's display name and, when the name has characters
+// Alexa rejects, the AlexaName it's discovered under. name should already
+// have passed ValidateName.
+func (d *Device) SetName(name string) {
+    d.Name = name
+    d.AlexaName = AlexaNameFor(name)
+}
+
+// BytecodeFirmwareMajor is the first firmware major version that runs bytecode
+// only (setBytecode, no setPattern/setColor)
+const BytecodeFirmwareMajor = 3
+
+// SupportsBytecode reports whether the device runs bytecode. The registered
+// cloud functions decide when known; otherwise the firmware version does.
+func (d Device) SupportsBytecode() bool {
+    if len(d.Capabilities) > 0 {
+        for _, fn := range d.Capabilities {
+            if fn == "setBytecode" {
+                return true
+            }
+        }
+        return false
+    }
+
+    major, err := strconv.Atoi(strings.SplitN(strings.TrimPrefix(d.FirmwareVersion, "v"), ".", 2)[0])
+    return err == nil && major >= BytecodeFirmwareMajor
+}
+
+// MaxPhysicalPin is the highest GPIO number accepted in a custom pin mapping (Argon range)
+const MaxPhysicalPin = 31
+
+// StripLogicalName is the CustomPinMapping key for the strip whose configured pin is pin
+func StripLogicalName(pin int) string {
+    return "strip" + strconv.Itoa(pin)
+}
+
+// ResolvePin returns the physical pin for a strip's configured pin. Without a
+// custom mapping (or an entry for this strip) the configured pin is physical.
+func (d Device) ResolvePin(pin int) int {
+    if physical, ok := d.CustomPinMapping[StripLogicalName(pin)]; ok {
+        return physical
+    }
+    return pin
+}
+
+// LogicalPin is the inverse of ResolvePin, used to map pins reported by the firmware
+func (d Device) LogicalPin(physical int) int {
+    for name, p := range d.CustomPinMapping {
+        if p != physical {
+            continue
+        }
+        if logical, err := strconv.Atoi(strings.TrimPrefix(name, "strip")); err == nil {
+            return logical
+        }
+    }
+    return physical
+}
+
+// ValidatePinMapping checks that keys look like "strip<N>" and that physical
+// pins are in range and not shared between strips
+func ValidatePinMapping(mapping map[string]int) error {
+    used := make(map[int]string, len(mapping))
+    for name, pin := range mapping {
+        if !strings.HasPrefix(name, "strip") {
+            return fmt.Errorf("invalid strip name %q: must look like strip1", name)
+        }
+        if n, err := strconv.Atoi(strings.TrimPrefix(name, "strip")); err != nil || n < 0 {
+            return fmt.Errorf("invalid strip name %q: must look like strip1", name)
+        }
+        if pin < 0 || pin > MaxPhysicalPin {
+            return fmt.Errorf("pin %d for %s must be between 0 and %d", pin, name, MaxPhysicalPin)
+        }
+        if other, ok := used[pin]; ok {
+            return fmt.Errorf("pin %d is mapped to both %s and %s", pin, other, name)
+        }
+        used[pin] = name
+    }
+    return nil
+}
+
 // ParticleCommandRequest represents a command to send to Particle device
 type ParticleCommandRequest struct {
     DeviceID string `json:"deviceId"`
@@ -129,6 +322,15 @@ type VirtualGroup struct {
     Name      string               `json:"name" dynamodbav:"name"`
     Members   []VirtualGroupMember `json:"members" dynamodbav:"members"`
     PatternID string               `json:"patternId,omitempty" dynamodbav:"patternId,omitempty"`
-    CreatedAt time.Time            `json:"createdAt" dynamodbav:"createdAt"`
-    UpdatedAt time.Time            `json:"updatedAt" dynamodbav:"updatedAt"`
+
+    // Overrides applied on top of any pattern applied to the group (see OutputOverrides)
+    BrightnessPercent *int    `json:"brightnessPercent,omitempty" dynamodbav:"brightnessPercent,omitempty"` // BrightnessPercent, 0-100
+    ColorOverride     *string `json:"colorOverride,omitempty" dynamodbav:"colorOverride,omitempty"`         // "#RRGGBB" primary color
+
+    // Dashboard display, validated by NormalizeIcon and NormalizeAccentColor
+    Icon        string `json:"icon,omitempty" dynamodbav:"icon,omitempty"`
+    AccentColor string `json:"accentColor,omitempty" dynamodbav:"accentColor,omitempty"` // "#RRGGBB"
+
+    CreatedAt time.Time `json:"createdAt" dynamodbav:"createdAt"`
+    UpdatedAt time.Time `json:"updatedAt" dynamodbav:"updatedAt"`
 }
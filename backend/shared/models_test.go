@@ -0,0 +1,57 @@
+package shared
+
+import "testing"
+
+func TestDevicePinMapping(t *testing.T) {
+	device := Device{CustomPinMapping: map[string]int{"strip6": 2, "strip2": 7}}
+
+	tests := []struct {
+		logical, physical int
+	}{
+		{6, 2},
+		{2, 7},
+		{4, 4}, // Unmapped pins pass through
+	}
+
+	for _, tt := range tests {
+		if got := device.ResolvePin(tt.logical); got != tt.physical {
+			t.Errorf("ResolvePin(%d) = %d, want %d", tt.logical, got, tt.physical)
+		}
+		if got := device.LogicalPin(tt.physical); got != tt.logical {
+			t.Errorf("LogicalPin(%d) = %d, want %d", tt.physical, got, tt.logical)
+		}
+	}
+}
+
+func TestDevicePinMappingUnset(t *testing.T) {
+	var device Device
+	if got := device.ResolvePin(6); got != 6 {
+		t.Errorf("ResolvePin(6) without a mapping = %d, want 6", got)
+	}
+	if got := device.LogicalPin(6); got != 6 {
+		t.Errorf("LogicalPin(6) without a mapping = %d, want 6", got)
+	}
+}
+
+func TestValidatePinMapping(t *testing.T) {
+	tests := []struct {
+		name    string
+		mapping map[string]int
+		wantErr bool
+	}{
+		{"nil", nil, false},
+		{"valid", map[string]int{"strip6": 2, "strip2": 7}, false},
+		{"highest pin", map[string]int{"strip1": MaxPhysicalPin}, false},
+		{"bad name", map[string]int{"led1": 2}, true},
+		{"non-numeric name", map[string]int{"stripA": 2}, true},
+		{"negative pin", map[string]int{"strip1": -1}, true},
+		{"pin out of range", map[string]int{"strip1": MaxPhysicalPin + 1}, true},
+		{"shared pin", map[string]int{"strip1": 3, "strip2": 3}, true},
+	}
+
+	for _, tt := range tests {
+		if err := ValidatePinMapping(tt.mapping); (err != nil) != tt.wantErr {
+			t.Errorf("%s: ValidatePinMapping error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
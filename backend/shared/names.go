@@ -0,0 +1,104 @@
+package shared
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Longest names and descriptions accepted, in characters
+const (
+	MaxNameLength        = 80
+	MaxDescriptionLength = 500
+)
+
+// alexaFallbackName is the Alexa name of a device whose name has no letters
+// or numbers at all; discovery tells duplicates apart
+const alexaFallbackName = "Light"
+
+// invisibleRune reports control and formatting characters (zero-width
+// joiners, direction overrides) that have no place in a name
+func invisibleRune(r rune) bool {
+	return unicode.IsControl(r) || unicode.Is(unicode.Cf, r)
+}
+
+// NormalizeName strips control and formatting characters from a name, trims
+// it and collapses runs of whitespace to one space
+func NormalizeName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsSpace(r):
+			return ' '
+		case invisibleRune(r):
+			return -1
+		}
+		return r
+	}, name)
+	return strings.Join(strings.Fields(name), " ")
+}
+
+// ValidateName normalizes the name of a kind of thing ("pattern", "device",
+// "group") and checks it's neither empty nor longer than MaxNameLength
+func ValidateName(kind, name string) (string, error) {
+	name = NormalizeName(name)
+	if name == "" {
+		return "", fmt.Errorf("%s name is required", kind)
+	}
+	if utf8.RuneCountInString(name) > MaxNameLength {
+		return "", fmt.Errorf("%s name must be at most %d characters", kind, MaxNameLength)
+	}
+	return name, nil
+}
+
+// ValidateDescription strips control and formatting characters from a
+// description, keeping line breaks, trims it and checks it's no longer than
+// MaxDescriptionLength. An empty description is fine.
+func ValidateDescription(description string) (string, error) {
+	description = strings.Map(func(r rune) rune {
+		if r == '\n' {
+			return r
+		}
+		if r == '\t' {
+			return ' '
+		}
+		if invisibleRune(r) {
+			return -1
+		}
+		return r
+	}, description)
+	description = strings.TrimSpace(description)
+	if utf8.RuneCountInString(description) > MaxDescriptionLength {
+		return "", fmt.Errorf("description must be at most %d characters", MaxDescriptionLength)
+	}
+	return description, nil
+}
+
+// AlexaSafeName is name as Alexa accepts friendly names: letters, numbers
+// and spaces. Apostrophes are dropped ("Jo's Lamp" is "Jos Lamp") and other
+// characters become spaces.
+func AlexaSafeName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsLetter(r), unicode.IsNumber(r):
+			return r
+		case r == '\'' || r == '’':
+			return -1
+		}
+		return ' '
+	}, name)
+	name = strings.Join(strings.Fields(name), " ")
+	if name == "" {
+		return alexaFallbackName
+	}
+	return name
+}
+
+// AlexaNameFor is the alexaName stored alongside a display name: its
+// AlexaSafeName when that differs, and empty when the name is already safe
+func AlexaNameFor(name string) string {
+	if safe := AlexaSafeName(name); safe != name {
+		return safe
+	}
+	return ""
+}
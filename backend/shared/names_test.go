@@ -0,0 +1,112 @@
+package shared
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalizeName(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"  Garage   Door ", "Garage Door"},
+		{"Porch\tLights\nLeft", "Porch Lights Left"},
+		{"Bad\x00\x07Name", "BadName"},
+		{"Zero\u200bWidth\u202eFlip", "ZeroWidthFlip"},
+		{"Jo's Lamp", "Jo's Lamp"},
+		{"\u200b \x01 ", ""},
+	}
+	for _, tt := range tests {
+		if got := NormalizeName(tt.in); got != tt.want {
+			t.Errorf("NormalizeName(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestValidateName(t *testing.T) {
+	atLimit := strings.Repeat("é", MaxNameLength) // Counted in characters, not bytes
+	tests := []struct {
+		in, want string
+		wantErr  bool
+	}{
+		{" Candle\u200b Flicker ", "Candle Flicker", false},
+		{atLimit, atLimit, false},
+		{atLimit + "x", "", true},
+		{"", "", true},
+		{" \t\u200b\x00", "", true},
+	}
+	for _, tt := range tests {
+		got, err := ValidateName("pattern", tt.in)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("ValidateName(%q) = %q, %v; want %q, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+		if err != nil && !strings.HasPrefix(err.Error(), "pattern name") {
+			t.Errorf("ValidateName(%q) error %q doesn't name the kind", tt.in, err)
+		}
+	}
+}
+
+func TestValidateDescription(t *testing.T) {
+	atLimit := strings.Repeat("d", MaxDescriptionLength)
+	tests := []struct {
+		in, want string
+		wantErr  bool
+	}{
+		{"", "", false},
+		{"  Warm glow\nfor evenings\t ok \u200b ", "Warm glow\nfor evenings  ok", false},
+		{"beep\x07\x1b[31m", "beep[31m", false},
+		{atLimit, atLimit, false},
+		{atLimit + "d", "", true},
+	}
+	for _, tt := range tests {
+		got, err := ValidateDescription(tt.in)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("ValidateDescription(%q) = %q, %v; want %q, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestAlexaSafeName(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"Garage Door", "Garage Door"},
+		{"Jo's Lamp", "Jos Lamp"},
+		{"Jo\u2019s Lamp", "Jos Lamp"},
+		{"Porch-Lights #2 (left)", "Porch Lights 2 left"},
+		{"Café Lights", "Café Lights"},
+		{"***", alexaFallbackName},
+		{"", alexaFallbackName},
+	}
+	for _, tt := range tests {
+		if got := AlexaSafeName(tt.in); got != tt.want {
+			t.Errorf("AlexaSafeName(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestDeviceSetNameKeepsAlexaName(t *testing.T) {
+	var device Device
+	device.SetName("Jo's Lamp")
+	if device.Name != "Jo's Lamp" || device.AlexaName != "Jos Lamp" {
+		t.Errorf("SetName(\"Jo's Lamp\") = %q, %q; want the name kept and Alexa name Jos Lamp", device.Name, device.AlexaName)
+	}
+	if got := AlexaStripFriendlyName(device, 6); got != "Jos Lamp Strip D6" {
+		t.Errorf("friendly name = %q, want Jos Lamp Strip D6", got)
+	}
+
+	// A safe name needs no separate Alexa name
+	device.SetName("Garage")
+	if device.AlexaName != "" {
+		t.Errorf("SetName(\"Garage\") left Alexa name %q", device.AlexaName)
+	}
+	if got := AlexaStripFriendlyName(device, 2); got != "Garage Strip D2" {
+		t.Errorf("friendly name = %q, want Garage Strip D2", got)
+	}
+
+	// Devices saved before alexaName existed fall back to the safe name
+	legacy := Device{Name: "Kid's Room!"}
+	if got := AlexaStripFriendlyName(legacy, 4); got != "Kids Room Strip D4" {
+		t.Errorf("legacy friendly name = %q, want Kids Room Strip D4", got)
+	}
+}
@@ -0,0 +1,196 @@
+package shared
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+var notificationsTable = os.Getenv("NOTIFICATIONS_TABLE")
+
+// Notification types
+const (
+	NotificationDeviceOffline   = "device_offline"
+	NotificationDeviceRecovered = "device_recovered"
+)
+
+// Offline alert threshold limits, in minutes
+const (
+	DefaultOfflineThresholdMinutes = 60
+	MinOfflineThresholdMinutes     = 5
+	MaxOfflineThresholdMinutes     = 7 * 24 * 60
+)
+
+// notificationRetention is how long in-app notifications are kept before TTL deletes them
+const notificationRetention = 30 * 24 * time.Hour
+
+// NotificationSettings are a user's alert preferences
+type NotificationSettings struct {
+	OfflineAlerts    bool   `json:"offlineAlerts" dynamodbav:"offlineAlerts"`
+	ThresholdMinutes int    `json:"thresholdMinutes" dynamodbav:"thresholdMinutes"`                   // Offline this long before alerting
+	QuietHoursStart  string `json:"quietHoursStart,omitempty" dynamodbav:"quietHoursStart,omitempty"` // "HH:MM", alerts held until quiet hours end
+	QuietHoursEnd    string `json:"quietHoursEnd,omitempty" dynamodbav:"quietHoursEnd,omitempty"`     // "HH:MM"
+	Timezone         string `json:"timezone,omitempty" dynamodbav:"timezone,omitempty"`               // IANA name for quiet hours (default UTC)
+	WeeklySummary    bool   `json:"weeklySummary" dynamodbav:"weeklySummary,omitempty"`               // Sunday activity email; needs an email address
+}
+
+// Notification is an in-app alert for users without an email address
+type Notification struct {
+	NotificationID string    `json:"notificationId" dynamodbav:"notificationId"`
+	UserID         string    `json:"userId" dynamodbav:"userId"`
+	Type           string    `json:"type" dynamodbav:"type"`
+	DeviceID       string    `json:"deviceId,omitempty" dynamodbav:"deviceId,omitempty"`
+	Title          string    `json:"title" dynamodbav:"title"`
+	Message        string    `json:"message" dynamodbav:"message"`
+	Read           bool      `json:"read" dynamodbav:"read"`
+	CreatedAt      time.Time `json:"createdAt" dynamodbav:"createdAt"`
+	ExpiresAt      int64     `json:"-" dynamodbav:"expiresAt"` // TTL
+}
+
+// Threshold returns how long a device must be offline before alerting
+func (s NotificationSettings) Threshold() time.Duration {
+	minutes := s.ThresholdMinutes
+	if minutes <= 0 {
+		minutes = DefaultOfflineThresholdMinutes
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+// Validate checks the threshold, quiet hours, and timezone
+func (s NotificationSettings) Validate() error {
+	if s.ThresholdMinutes != 0 && (s.ThresholdMinutes < MinOfflineThresholdMinutes || s.ThresholdMinutes > MaxOfflineThresholdMinutes) {
+		return fmt.Errorf("thresholdMinutes must be between %d and %d", MinOfflineThresholdMinutes, MaxOfflineThresholdMinutes)
+	}
+	if (s.QuietHoursStart == "") != (s.QuietHoursEnd == "") {
+		return fmt.Errorf("quietHoursStart and quietHoursEnd must be set together")
+	}
+	for _, v := range []string{s.QuietHoursStart, s.QuietHoursEnd} {
+		if v == "" {
+			continue
+		}
+		if _, err := time.Parse("15:04", v); err != nil {
+			return fmt.Errorf("invalid quiet hours time %q (use HH:MM)", v)
+		}
+	}
+	if s.Timezone != "" {
+		if _, err := time.LoadLocation(s.Timezone); err != nil {
+			return fmt.Errorf("unknown timezone %q", s.Timezone)
+		}
+	}
+	return nil
+}
+
+// InQuietHours reports whether t falls in the quiet hours window. Windows
+// may wrap midnight ("22:00" to "07:00").
+func (s NotificationSettings) InQuietHours(t time.Time) bool {
+	if s.QuietHoursStart == "" || s.QuietHoursEnd == "" {
+		return false
+	}
+	start, err1 := time.Parse("15:04", s.QuietHoursStart)
+	end, err2 := time.Parse("15:04", s.QuietHoursEnd)
+	if err1 != nil || err2 != nil {
+		return false
+	}
+
+	loc := time.UTC
+	if s.Timezone != "" {
+		if l, err := time.LoadLocation(s.Timezone); err == nil {
+			loc = l
+		}
+	}
+
+	local := t.In(loc)
+	now := local.Hour()*60 + local.Minute()
+	from := start.Hour()*60 + start.Minute()
+	to := end.Hour()*60 + end.Minute()
+
+	if from <= to {
+		return now >= from && now < to
+	}
+	return now >= from || now < to
+}
+
+// CreateNotification stores an in-app notification
+func CreateNotification(ctx context.Context, notification *Notification) error {
+	if notification.CreatedAt.IsZero() {
+		notification.CreatedAt = time.Now()
+	}
+	notification.ExpiresAt = notification.CreatedAt.Add(notificationRetention).Unix()
+	return PutItem(ctx, notificationsTable, notification)
+}
+
+// GetUserNotifications returns a user's notifications
+func GetUserNotifications(ctx context.Context, userID string) ([]Notification, error) {
+	indexName := "userId-index"
+	expressionValues := map[string]types.AttributeValue{
+		":userId": &types.AttributeValueMemberS{Value: userID},
+	}
+
+	var notifications []Notification
+	if err := Query(ctx, notificationsTable, &indexName, "userId = :userId", expressionValues, &notifications); err != nil {
+		return nil, err
+	}
+	return notifications, nil
+}
+
+// DashboardURL is the link included in alert emails
+func DashboardURL() string {
+	domain := os.Getenv("DOMAIN_NAME")
+	if domain == "" {
+		return "/dashboard"
+	}
+	return "https://" + domain + "/dashboard"
+}
+
+// AlertEmail is the rendered content of an alert email
+type AlertEmail struct {
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// BuildDeviceAlert renders the offline or recovery alert for a device, used
+// both for email and for in-app notifications
+func BuildDeviceAlert(notificationType, deviceName string, lastSeen time.Time) AlertEmail {
+	lastSeenText := "unknown"
+	if !lastSeen.IsZero() {
+		lastSeenText = lastSeen.UTC().Format("Jan 2, 2006 15:04 MST")
+	}
+	dashboard := DashboardURL()
+
+	var subject, summary string
+	if notificationType == NotificationDeviceRecovered {
+		subject = fmt.Sprintf("%s is back online", deviceName)
+		summary = fmt.Sprintf("Your device %s has reconnected.", deviceName)
+	} else {
+		subject = fmt.Sprintf("%s is offline", deviceName)
+		summary = fmt.Sprintf("Your device %s has not been seen since %s.", deviceName, lastSeenText)
+	}
+
+	text := strings.Join([]string{
+		summary,
+		"",
+		"Device: " + deviceName,
+		"Last seen: " + lastSeenText,
+		"",
+		"Dashboard: " + dashboard,
+	}, "\n")
+
+	html := fmt.Sprintf(`<p>%s</p>
+<table>
+<tr><td><strong>Device</strong></td><td>%s</td></tr>
+<tr><td><strong>Last seen</strong></td><td>%s</td></tr>
+</table>
+<p><a href="%s">Open the dashboard</a></p>`,
+		htmlEscape(summary), htmlEscape(deviceName), htmlEscape(lastSeenText), htmlEscape(dashboard))
+
+	return AlertEmail{Subject: subject, Text: text, HTML: html}
+}
+
+func htmlEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;", "'", "&#39;").Replace(s)
+}
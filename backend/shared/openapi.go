@@ -0,0 +1,280 @@
+package shared
+
+import (
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RouteDoc describes an API route for the OpenAPI spec. Request and Response
+// are values of the body types (zero values are fine); their schemas come
+// from the json tags by reflection. An openapi tag adds constraints, e.g.
+// `openapi:"required,minimum=0,maximum=255"` or `openapi:"enum=on|off"`.
+type RouteDoc struct {
+	Method   string
+	Path     string // API Gateway path template, e.g. /api/patterns/{patternId}
+	Policy   AuthPolicy
+	Service  string // Tag the route is grouped under
+	Summary  string
+	Request  interface{} // Request body, nil for none
+	Response interface{} // The "data" of a success response, nil when free-form
+}
+
+// openAPIVersion is the OpenAPI version BuildOpenAPISpec emits
+const openAPIVersion = "3.0.3"
+
+var pathParamPattern = regexp.MustCompile(`\{([^}]+)\}`)
+
+// BuildOpenAPISpec returns an OpenAPI 3.0 document describing routes.
+// Responses are wrapped in the APIResponse envelope.
+func BuildOpenAPISpec(title, version string, routes []RouteDoc) map[string]interface{} {
+	b := &schemaBuilder{schemas: make(map[string]interface{})}
+	errorSchema := b.schemaFor(reflect.TypeOf(APIResponse{}))
+
+	paths := make(map[string]map[string]interface{})
+	for _, rt := range routes {
+		op := map[string]interface{}{
+			"summary":       rt.Summary,
+			"operationId":   operationID(rt),
+			"security":      routeSecurity(rt.Policy),
+			"x-auth-policy": rt.Policy.String(),
+		}
+		if rt.Service != "" {
+			op["tags"] = []string{rt.Service}
+		}
+
+		var params []interface{}
+		for _, m := range pathParamPattern.FindAllStringSubmatch(rt.Path, -1) {
+			params = append(params, map[string]interface{}{
+				"name":     m[1],
+				"in":       "path",
+				"required": true,
+				"schema":   map[string]interface{}{"type": "string"},
+			})
+		}
+		if len(params) > 0 {
+			op["parameters"] = params
+		}
+
+		if rt.Request != nil {
+			op["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content":  jsonContent(b.schemaFor(reflect.TypeOf(rt.Request))),
+			}
+		}
+
+		data := map[string]interface{}{}
+		if rt.Response != nil {
+			data = b.schemaFor(reflect.TypeOf(rt.Response))
+		}
+		op["responses"] = map[string]interface{}{
+			"2XX": map[string]interface{}{
+				"description": "Success",
+				"content": jsonContent(map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"success": map[string]interface{}{"type": "boolean"},
+						"data":    data,
+					},
+				}),
+			},
+			"default": map[string]interface{}{
+				"description": "Error",
+				"content":     jsonContent(errorSchema),
+			},
+		}
+
+		if paths[rt.Path] == nil {
+			paths[rt.Path] = make(map[string]interface{})
+		}
+		paths[rt.Path][strings.ToLower(rt.Method)] = op
+	}
+
+	return map[string]interface{}{
+		"openapi": openAPIVersion,
+		"info": map[string]interface{}{
+			"title":   title,
+			"version": version,
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": b.schemas,
+			"securitySchemes": map[string]interface{}{
+				"session": map[string]interface{}{
+					"type":        "http",
+					"scheme":      "bearer",
+					"description": "Session ID or API key",
+				},
+				"webhookSignature": map[string]interface{}{
+					"type":        "apiKey",
+					"in":          "header",
+					"name":        WebhookSignatureHeader,
+					"description": "sha256=<hex HMAC-SHA256 of the body>",
+				},
+			},
+		},
+	}
+}
+
+// operationID is a stable ID for a route, e.g. get_api_patterns_patternId
+func operationID(rt RouteDoc) string {
+	return strings.ToLower(rt.Method) + strings.NewReplacer("/", "_", "{", "", "}", "", "-", "_", ".", "_").Replace(rt.Path)
+}
+
+// routeSecurity is the security requirement for a policy
+func routeSecurity(policy AuthPolicy) []map[string][]string {
+	switch policy {
+	case PolicyAuthenticated, PolicyAdmin:
+		return []map[string][]string{{"session": {}}}
+	case PolicyWebhookSigned:
+		return []map[string][]string{{"webhookSignature": {}}}
+	default:
+		return []map[string][]string{}
+	}
+}
+
+func jsonContent(schema map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"application/json": map[string]interface{}{"schema": schema},
+	}
+}
+
+// schemaBuilder turns Go types into schemas, collecting named structs as
+// components
+type schemaBuilder struct {
+	schemas map[string]interface{}
+}
+
+func (b *schemaBuilder) schemaFor(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == reflect.TypeOf(time.Time{}) {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Int64:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"} // Base64, as encoding/json does
+		}
+		return map[string]interface{}{"type": "array", "items": b.schemaFor(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": b.schemaFor(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.objectSchema(t)
+		}
+		if _, ok := b.schemas[t.Name()]; !ok {
+			b.schemas[t.Name()] = map[string]interface{}{} // Placeholder so recursive types terminate
+			b.schemas[t.Name()] = b.objectSchema(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return map[string]interface{}{} // interface{}: any value
+}
+
+func (b *schemaBuilder) objectSchema(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	var required []string
+	b.addFields(t, properties, &required)
+
+	schema := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		sort.Strings(required)
+		schema["required"] = required
+	}
+	return schema
+}
+
+// addFields adds t's fields the way encoding/json sees them, including the
+// fields of embedded structs
+func (b *schemaBuilder) addFields(t reflect.Type, properties map[string]interface{}, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				b.addFields(ft, properties, required)
+				continue
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+
+		schema := b.schemaFor(f.Type)
+		if constraints := f.Tag.Get("openapi"); constraints != "" {
+			if applyConstraints(schema, constraints) {
+				*required = append(*required, name)
+			}
+		}
+		properties[name] = schema
+	}
+}
+
+// applyConstraints adds an openapi tag's constraints to schema and reports
+// whether the field is required. Constraints on a $ref are dropped, as
+// OpenAPI 3.0 ignores siblings of $ref.
+func applyConstraints(schema map[string]interface{}, tag string) bool {
+	required := false
+	_, isRef := schema["$ref"]
+	for _, part := range strings.Split(tag, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "required":
+			required = true
+		case "minimum", "maximum":
+			if n, err := strconv.ParseFloat(value, 64); err == nil && !isRef {
+				schema[key] = n
+			}
+		case "minLength", "maxLength", "minItems", "maxItems":
+			if n, err := strconv.Atoi(value); err == nil && !isRef {
+				schema[key] = n
+			}
+		case "enum":
+			if isRef {
+				continue
+			}
+			var values []interface{}
+			for _, v := range strings.Split(value, "|") {
+				if schema["type"] == "integer" {
+					if n, err := strconv.Atoi(v); err == nil {
+						values = append(values, n)
+					}
+					continue
+				}
+				values = append(values, v)
+			}
+			schema["enum"] = values
+		}
+	}
+	return required
+}
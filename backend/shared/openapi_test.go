@@ -0,0 +1,198 @@
+package shared
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+type specInner struct {
+	Level int `json:"level" openapi:"minimum=0,maximum=255"`
+}
+
+type specEmbedded struct {
+	Shared string `json:"shared"`
+}
+
+type specBody struct {
+	specEmbedded
+	Name     string         `json:"name" openapi:"required,maxLength=80"`
+	Mode     string         `json:"mode,omitempty" openapi:"enum=on|off"`
+	Speed    int            `json:"speed,omitempty" openapi:"enum=1|2"`
+	Secret   string         `json:"-"`
+	When     time.Time      `json:"when"`
+	Data     []byte         `json:"data"`
+	Pin      *int           `json:"pin,omitempty"`
+	Inner    specInner      `json:"inner" openapi:"required,minimum=3"`
+	Tags     []string       `json:"tags" openapi:"maxItems=4"`
+	Mapping  map[string]int `json:"mapping"`
+	Any      interface{}    `json:"any"`
+	Untagged bool
+	hidden   string
+}
+
+// specJSON round-trips a spec through JSON, as clients see it
+func specJSON(t *testing.T, routes []RouteDoc) map[string]interface{} {
+	t.Helper()
+	body, err := json.Marshal(BuildOpenAPISpec("test", "1", routes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spec map[string]interface{}
+	if err := json.Unmarshal(body, &spec); err != nil {
+		t.Fatal(err)
+	}
+	return spec
+}
+
+// lookup follows a path of object keys through a decoded spec
+func lookup(v interface{}, keys ...string) interface{} {
+	for _, key := range keys {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[key]
+	}
+	return v
+}
+
+func TestOpenAPISchemasFollowJSONTags(t *testing.T) {
+	spec := specJSON(t, []RouteDoc{{Method: "POST", Path: "/api/things", Policy: PolicyAuthenticated, Request: specBody{}}})
+
+	if ref := lookup(spec, "paths", "/api/things", "post", "requestBody", "content", "application/json", "schema", "$ref"); ref != "#/components/schemas/specBody" {
+		t.Fatalf("request body schema = %v, want a specBody $ref", ref)
+	}
+	schema := lookup(spec, "components", "schemas", "specBody")
+	properties, _ := lookup(schema, "properties").(map[string]interface{})
+
+	var names []string
+	for name := range properties {
+		names = append(names, name)
+	}
+	wantNames := []string{"Untagged", "any", "data", "inner", "mapping", "mode", "name", "pin", "shared", "speed", "tags", "when"}
+	sort.Strings(names)
+	if !reflect.DeepEqual(names, wantNames) {
+		t.Errorf("properties = %v, want %v", names, wantNames)
+	}
+	if got := lookup(schema, "required"); !reflect.DeepEqual(got, []interface{}{"inner", "name"}) {
+		t.Errorf("required = %v, want [inner name]", got)
+	}
+
+	tests := []struct {
+		property string
+		want     map[string]interface{}
+	}{
+		{"name", map[string]interface{}{"type": "string", "maxLength": 80.0}},
+		{"mode", map[string]interface{}{"type": "string", "enum": []interface{}{"on", "off"}}},
+		{"speed", map[string]interface{}{"type": "integer", "enum": []interface{}{1.0, 2.0}}},
+		{"when", map[string]interface{}{"type": "string", "format": "date-time"}},
+		{"data", map[string]interface{}{"type": "string", "format": "byte"}},
+		{"pin", map[string]interface{}{"type": "integer"}},
+		{"inner", map[string]interface{}{"$ref": "#/components/schemas/specInner"}}, // No minimum beside a $ref
+		{"tags", map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}, "maxItems": 4.0}},
+		{"mapping", map[string]interface{}{"type": "object", "additionalProperties": map[string]interface{}{"type": "integer"}}},
+		{"any", map[string]interface{}{}},
+	}
+	for _, tt := range tests {
+		if got := properties[tt.property]; !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s = %v, want %v", tt.property, got, tt.want)
+		}
+	}
+
+	if got := lookup(spec, "components", "schemas", "specInner", "properties", "level"); !reflect.DeepEqual(got, map[string]interface{}{"type": "integer", "minimum": 0.0, "maximum": 255.0}) {
+		t.Errorf("specInner.level = %v, want an integer from 0 to 255", got)
+	}
+}
+
+func TestOpenAPIOperations(t *testing.T) {
+	spec := specJSON(t, []RouteDoc{
+		{Method: "GET", Path: "/api/things/{thingId}/parts/{partId}", Policy: PolicyPublic, Service: "things", Summary: "Get a part", Response: []specInner(nil)},
+		{Method: "DELETE", Path: "/api/things/{thingId}/parts/{partId}", Policy: PolicyAdmin},
+		{Method: "POST", Path: "/api/hooks/build", Policy: PolicyWebhookSigned},
+	})
+
+	get := lookup(spec, "paths", "/api/things/{thingId}/parts/{partId}", "get")
+	if got := lookup(get, "operationId"); got != "get_api_things_thingId_parts_partId" {
+		t.Errorf("operationId = %v", got)
+	}
+	if got := lookup(get, "tags"); !reflect.DeepEqual(got, []interface{}{"things"}) {
+		t.Errorf("tags = %v, want [things]", got)
+	}
+	params, _ := lookup(get, "parameters").([]interface{})
+	if len(params) != 2 || lookup(params[0], "name") != "thingId" || lookup(params[1], "name") != "partId" ||
+		lookup(params[0], "in") != "path" || lookup(params[0], "required") != true {
+		t.Errorf("parameters = %v, want required path parameters thingId and partId", params)
+	}
+	if got := lookup(get, "requestBody"); got != nil {
+		t.Errorf("GET has a request body: %v", got)
+	}
+	if got := lookup(get, "responses", "2XX", "content", "application/json", "schema", "properties", "data", "items", "$ref"); got != "#/components/schemas/specInner" {
+		t.Errorf("response data items = %v, want a specInner $ref", got)
+	}
+
+	security := []struct {
+		path, method, policy string
+		want                 []interface{}
+	}{
+		{"/api/things/{thingId}/parts/{partId}", "get", "public", []interface{}{}},
+		{"/api/things/{thingId}/parts/{partId}", "delete", "admin", []interface{}{map[string]interface{}{"session": []interface{}{}}}},
+		{"/api/hooks/build", "post", "webhook-signed", []interface{}{map[string]interface{}{"webhookSignature": []interface{}{}}}},
+	}
+	for _, tt := range security {
+		op := lookup(spec, "paths", tt.path, tt.method)
+		if got := lookup(op, "x-auth-policy"); got != tt.policy {
+			t.Errorf("%s %s x-auth-policy = %v, want %s", tt.method, tt.path, got, tt.policy)
+		}
+		if got := lookup(op, "security"); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s %s security = %v, want %v", tt.method, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestAPIRoutesAreComplete(t *testing.T) {
+	seen := make(map[string]bool)
+	for _, doc := range APIRoutes {
+		key := doc.Method + " " + doc.Path
+		if seen[key] {
+			t.Errorf("%s is listed twice", key)
+		}
+		seen[key] = true
+		if doc.Policy <= PolicyUnset || doc.Policy > PolicyWebhookSigned {
+			t.Errorf("%s has no auth policy", key)
+		}
+		if !strings.HasPrefix(doc.Path, "/api/") || doc.Service == "" || doc.Summary == "" {
+			t.Errorf("%s needs an /api/ path, a service and a summary", key)
+		}
+	}
+	// Every route makes it into the document
+	spec := specJSON(t, APIRoutes)
+	for _, doc := range APIRoutes {
+		if lookup(spec, "paths", doc.Path, strings.ToLower(doc.Method)) == nil {
+			t.Errorf("%s %s is missing from the spec", doc.Method, doc.Path)
+		}
+	}
+}
+
+func TestRequireDocsRefusesUndocumentedRoutes(t *testing.T) {
+	r := NewRouter("test")
+	r.RequireDocs()
+	if err := r.Handle("GET", PathEquals("/x"), PolicyPublic, okHandler); err == nil {
+		t.Error("Handle accepted an undocumented route")
+	}
+	if err := r.HandleDoc(RouteDoc{Method: "GET", Policy: PolicyPublic}, PathEquals("/x"), okHandler); err == nil {
+		t.Error("HandleDoc accepted a route without a path")
+	}
+	if err := r.HandleDoc(RouteDoc{Method: "GET", Path: "/x"}, PathEquals("/x"), okHandler); err == nil {
+		t.Error("HandleDoc accepted a route without a policy")
+	}
+	if err := r.HandleDoc(RouteDoc{Method: "GET", Path: "/x", Policy: PolicyPublic}, PathEquals("/x"), okHandler); err != nil {
+		t.Errorf("HandleDoc refused a documented route: %v", err)
+	}
+	if docs := r.Docs(); len(docs) != 1 || docs[0].Path != "/x" {
+		t.Errorf("Docs() = %+v, want the one documented route", docs)
+	}
+}
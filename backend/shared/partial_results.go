@@ -0,0 +1,63 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// EnrichmentTimeout bounds each best-effort lookup an endpoint joins onto its
+// primary data, so one slow table doesn't stall the response
+const EnrichmentTimeout = 3 * time.Second
+
+// PartialResults collects the enrichment lookups that failed while building
+// a response. The primary data is still returned, flagged partial, with a
+// warning naming each lookup that is missing.
+type PartialResults struct {
+	Warnings []string
+}
+
+// Enrich runs fetch with EnrichmentTimeout. If it fails the failure is logged
+// and recorded as a warning ("<what> unavailable: <reason>"), and false is
+// returned so the caller can fall back.
+func (p *PartialResults) Enrich(ctx context.Context, what string, fetch func(ctx context.Context) error) bool {
+	fetchCtx, cancel := context.WithTimeout(ctx, EnrichmentTimeout)
+	defer cancel()
+
+	err := fetch(fetchCtx)
+	if err == nil {
+		return true
+	}
+	log.Printf("Enrichment %q failed: %v", what, err)
+	p.Warnings = append(p.Warnings, what+" unavailable: "+enrichmentFailureReason(err))
+	return false
+}
+
+// Response is CreateSuccessResponse, marked partial with the warnings when
+// any enrichment failed
+func (p *PartialResults) Response(statusCode int, data interface{}) events.APIGatewayProxyResponse {
+	response := APIResponse{
+		Success:  true,
+		Data:     data,
+		Partial:  len(p.Warnings) > 0,
+		Warnings: p.Warnings,
+	}
+	return CreateResponse(statusCode, response)
+}
+
+// enrichmentFailureReason describes a failed lookup without leaking internals
+func enrichmentFailureReason(err error) string {
+	var throughput *types.ProvisionedThroughputExceededException
+	var requestLimit *types.RequestLimitExceeded
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timed out"
+	case errors.As(err, &throughput), errors.As(err, &requestLimit):
+		return "throttled"
+	}
+	return "lookup failed"
+}
@@ -0,0 +1,72 @@
+package shared
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEnrichRecordsFailures(t *testing.T) {
+	defer StubDynamoDB(func(call DynamoDBStubCall) (map[string]interface{}, error) {
+		return nil, ErrDynamoDBStubThrottled
+	})()
+
+	var partial PartialResults
+	ctx := context.Background()
+	if !partial.Enrich(ctx, "names", func(ctx context.Context) error { return nil }) {
+		t.Error("a successful lookup reported failure")
+	}
+	if partial.Enrich(ctx, "states", func(ctx context.Context) error {
+		var states []AlexaDeviceState
+		return Query(ctx, "states", nil, "userId = :userId", nil, &states)
+	}) {
+		t.Error("a throttled lookup reported success")
+	}
+	partial.Enrich(ctx, "modes", func(ctx context.Context) error {
+		if deadline, ok := ctx.Deadline(); !ok || time.Until(deadline) > EnrichmentTimeout {
+			t.Errorf("lookup deadline = %v, %v; want within %v", deadline, ok, EnrichmentTimeout)
+		}
+		return context.DeadlineExceeded // As a dependency that never answers fails
+	})
+	partial.Enrich(ctx, "tokens", func(ctx context.Context) error { return errors.New("table tokens-prod: access denied") })
+
+	want := []string{"states unavailable: throttled", "modes unavailable: timed out", "tokens unavailable: lookup failed"}
+	if !reflect.DeepEqual(partial.Warnings, want) {
+		t.Errorf("warnings = %q, want %q", partial.Warnings, want)
+	}
+}
+
+func TestPartialResultsResponse(t *testing.T) {
+	tests := []struct {
+		name         string
+		warnings     []string
+		wantPartial  bool
+		wantWarnings []string
+	}{
+		{"complete", nil, false, nil},
+		{"partial", []string{"states unavailable: throttled"}, true, []string{"states unavailable: throttled"}},
+	}
+	for _, tt := range tests {
+		partial := PartialResults{Warnings: tt.warnings}
+		resp := partial.Response(200, map[string]int{"devices": 2})
+
+		var body struct {
+			Success  bool           `json:"success"`
+			Data     map[string]int `json:"data"`
+			Partial  bool           `json:"partial"`
+			Warnings []string       `json:"warnings"`
+		}
+		if err := json.Unmarshal([]byte(resp.Body), &body); err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != 200 || !body.Success || body.Data["devices"] != 2 {
+			t.Errorf("%s: %d %s, want the data with 200", tt.name, resp.StatusCode, resp.Body)
+		}
+		if body.Partial != tt.wantPartial || !reflect.DeepEqual(body.Warnings, tt.wantWarnings) {
+			t.Errorf("%s: partial %v with warnings %q, want %v with %q", tt.name, body.Partial, body.Warnings, tt.wantPartial, tt.wantWarnings)
+		}
+	}
+}
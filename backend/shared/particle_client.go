@@ -0,0 +1,277 @@
+package shared
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// particleVariableTimeout caps each attempt at reading a variable; function
+// calls made through a TimedCaller are capped by the device's command timeout
+const particleVariableTimeout = 10 * time.Second
+
+// ParticleAPIError is a non-200 response from the Particle API
+type ParticleAPIError struct {
+	StatusCode int
+	Message    string // Particle's "error" field, when it sent one
+}
+
+// NewParticleAPIError builds the error for a non-200 response with body
+func NewParticleAPIError(statusCode int, body []byte) *ParticleAPIError {
+	var parsed struct {
+		Error string `json:"error"`
+	}
+	json.Unmarshal(body, &parsed)
+	return &ParticleAPIError{StatusCode: statusCode, Message: parsed.Error}
+}
+
+// ParticleStatus is the HTTP status, for IsCommandTimeout and
+// IsRetryableParticleError
+func (e *ParticleAPIError) ParticleStatus() int {
+	return e.StatusCode
+}
+
+func (e *ParticleAPIError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("particle API status %d: %s", e.StatusCode, e.Message)
+	}
+	return fmt.Sprintf("particle API status %d", e.StatusCode)
+}
+
+// CallParticleFunction calls a cloud function with token, retrying transient
+// failures (see RetryParticleCall). The call gives up when ctx is done,
+// failing with a *DependencyTimeoutError if it ran out of time.
+func CallParticleFunction(ctx context.Context, particleID, function, argument, token string) error {
+	_, err := RetryParticleCall(ctx, function, func(ctx context.Context) error {
+		return callParticleFunctionOnce(ctx, particleID, function, argument, token)
+	})
+	return err
+}
+
+// callParticleFunctionOnce makes one attempt at a cloud function call
+func callParticleFunctionOnce(ctx context.Context, particleID, function, argument, token string) (err error) {
+	start := time.Now()
+	defer func() { ObserveParticleCall("function", start, err) }()
+
+	url := fmt.Sprintf("%s/devices/%s/%s", ParticleAPIBase(), particleID, function)
+	log.Printf("Calling Particle function %s on device %s", function, particleID)
+
+	jsonData, _ := json.Marshal(map[string]string{"arg": argument})
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return DependencyTimeout("Particle", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("Particle API error calling %s (status %d): %s", function, resp.StatusCode, string(body))
+		return NewParticleAPIError(resp.StatusCode, body)
+	}
+	return nil
+}
+
+// GetParticleVariable reads a device variable with token, retrying transient
+// failures (see RetryParticleCall) and giving up when ctx is done
+func GetParticleVariable(ctx context.Context, particleID, variable, token string) (string, error) {
+	var value string
+	_, err := RetryParticleCall(ctx, variable, func(ctx context.Context) error {
+		var err error
+		value, err = getParticleVariableOnce(ctx, particleID, variable, token)
+		return err
+	})
+	return value, err
+}
+
+// getParticleVariableOnce makes one attempt at reading a variable, under
+// particleVariableTimeout
+func getParticleVariableOnce(ctx context.Context, particleID, variable, token string) (value string, err error) {
+	start := time.Now()
+	defer func() { ObserveParticleCall("variable", start, err) }()
+
+	ctx, cancel := WithCallTimeout(ctx, particleVariableTimeout)
+	defer cancel()
+
+	url := fmt.Sprintf("%s/devices/%s/%s", ParticleAPIBase(), particleID, variable)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", DependencyTimeout("Particle", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return "", NewParticleAPIError(resp.StatusCode, body)
+	}
+
+	var result struct {
+		Result interface{} `json:"result"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return "", err
+	}
+	switch v := result.Result.(type) {
+	case nil:
+		return "", fmt.Errorf("no result in response")
+	case string:
+		return v, nil
+	case float64:
+		return fmt.Sprintf("%.0f", v), nil
+	default:
+		return fmt.Sprintf("%v", v), nil
+	}
+}
+
+// NewParticleTimedCaller is a TimedCaller that calls device's cloud functions
+// with token through CallParticleFunction. Calls that time out are checked
+// against lastCmdId, and setBytecode calls are sequenced in devicesTable.
+func NewParticleTimedCaller(ctx context.Context, device Device, token, devicesTable string) *TimedCaller {
+	return NewTimedCaller(ctx, device, func(ctx context.Context, particleID, function, argument string) error {
+		return CallParticleFunction(ctx, particleID, function, argument, token)
+	}).VerifyWith(func(ctx context.Context, particleID, variable string) (string, error) {
+		return GetParticleVariable(ctx, particleID, variable, token)
+	}).SequenceWith(devicesTable)
+}
+
+// Device listing is fetched a page at a time up to MaxParticleDevices.
+// The user endpoint usually returns everything at once; larger accounts and
+// product endpoints page, either with a Link header or with meta.total_pages.
+const (
+	particleDevicesPerPage = 100
+	MaxParticleDevices     = 500
+)
+
+// particleListTimeout caps each page of a device listing
+const particleListTimeout = 10 * time.Second
+
+// ListParticleDevices lists all of token's devices, following pages until
+// one comes back short, adds nothing new, or MaxParticleDevices is reached.
+// Running out of time fails with a *DependencyTimeoutError.
+func ListParticleDevices(ctx context.Context, token string) (devices []map[string]interface{}, err error) {
+	start := time.Now()
+	defer func() { ObserveParticleCall("devices", start, err) }()
+
+	seen := make(map[string]bool)
+	url := fmt.Sprintf("%s/devices?page=1&per_page=%d", ParticleAPIBase(), particleDevicesPerPage)
+	for page := 1; url != "" && len(devices) < MaxParticleDevices; page++ {
+		pageDevices, next, totalPages, err := listParticleDevicesPage(ctx, url, token)
+		if err != nil {
+			return nil, DependencyTimeout("Particle", err)
+		}
+
+		added := 0
+		for _, d := range pageDevices {
+			if id, _ := d["id"].(string); id != "" {
+				if seen[id] {
+					continue
+				}
+				seen[id] = true
+			}
+			devices = append(devices, d)
+			added++
+		}
+		log.Printf("Particle devices page %d: %d devices (%d new)", page, len(pageDevices), added)
+
+		// An endpoint that ignores page returns the same list again
+		if added == 0 {
+			break
+		}
+
+		switch {
+		case next != "":
+			url = next
+		case totalPages > page:
+			url = fmt.Sprintf("%s/devices?page=%d&per_page=%d", ParticleAPIBase(), page+1, particleDevicesPerPage)
+		case totalPages == 0 && len(pageDevices) >= particleDevicesPerPage:
+			url = fmt.Sprintf("%s/devices?page=%d&per_page=%d", ParticleAPIBase(), page+1, particleDevicesPerPage)
+		default:
+			url = ""
+		}
+	}
+
+	if len(devices) > MaxParticleDevices {
+		devices = devices[:MaxParticleDevices]
+	}
+	if len(devices) == MaxParticleDevices {
+		log.Printf("WARNING: Particle device listing stopped at %d devices", MaxParticleDevices)
+	}
+	return devices, nil
+}
+
+// listParticleDevicesPage fetches one page of devices. The body is either a
+// bare array or {"devices": [...], "meta": {"total_pages": n}}; next is the
+// Link header's rel="next" URL, if any.
+func listParticleDevicesPage(ctx context.Context, url, token string) (devices []map[string]interface{}, next string, totalPages int, err error) {
+	ctx, cancel := WithCallTimeout(ctx, particleListTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("Particle API error listing devices (status %d): %s", resp.StatusCode, string(body))
+		return nil, "", 0, NewParticleAPIError(resp.StatusCode, body)
+	}
+
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '{' {
+		var paged struct {
+			Devices []map[string]interface{} `json:"devices"`
+			Meta    struct {
+				TotalPages int `json:"total_pages"`
+			} `json:"meta"`
+		}
+		if err := json.Unmarshal(body, &paged); err != nil {
+			return nil, "", 0, err
+		}
+		devices, totalPages = paged.Devices, paged.Meta.TotalPages
+	} else if err := json.Unmarshal(body, &devices); err != nil {
+		return nil, "", 0, err
+	}
+
+	return devices, nextLink(resp.Header.Get("Link")), totalPages, nil
+}
+
+// nextLink returns the rel="next" URL from a Link header
+func nextLink(header string) string {
+	for _, part := range strings.Split(header, ",") {
+		sections := strings.Split(part, ";")
+		if len(sections) < 2 {
+			continue
+		}
+		for _, param := range sections[1:] {
+			if strings.TrimSpace(param) == `rel="next"` {
+				return strings.Trim(strings.TrimSpace(sections[0]), "<>")
+			}
+		}
+	}
+	return ""
+}
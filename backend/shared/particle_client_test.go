@@ -0,0 +1,160 @@
+package shared
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+func TestParticleTimedCallerRetriesAndRateLimits(t *testing.T) {
+	defer StubDynamoDB(func(call DynamoDBStubCall) (map[string]interface{}, error) {
+		return nil, nil
+	})()
+
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/devices/p1/setBright" || r.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("request %s with %q", r.URL.Path, r.Header.Get("Authorization"))
+		}
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"return_value":1}`))
+	}))
+	defer server.Close()
+	saved := particleAPIBase
+	particleAPIBase = server.URL
+	defer func() { particleAPIBase = saved }()
+
+	device := Device{DeviceID: "timed-caller-test", Name: "garage", CommandBurst: 1, CommandsPerMinute: 6}
+	timed := NewParticleTimedCaller(context.Background(), device, "token", "devices")
+
+	if err := timed.Call("p1", "setBright", "0,128"); err != nil {
+		t.Fatalf("first call: %v", err)
+	}
+	if calls.Load() != 2 {
+		t.Errorf("%d requests for the first call, want 2 (one retry)", calls.Load())
+	}
+
+	// The burst of 1 is used up and the next slot is 10s away
+	if err := timed.Call("p1", "setBright", "0,64"); !IsDeviceRateLimited(err) {
+		t.Errorf("second call: err = %v, want a rate limit error", err)
+	}
+	if calls.Load() != 2 {
+		t.Errorf("rate limited call reached Particle")
+	}
+}
+
+func TestCallParticleFunctionReportsAPIError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"error":"invalid_token"}`))
+	}))
+	defer server.Close()
+	saved := particleAPIBase
+	particleAPIBase = server.URL
+	defer func() { particleAPIBase = saved }()
+
+	err := CallParticleFunction(context.Background(), "p1", "setBright", "0,128", "token")
+	var apiErr *ParticleAPIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized || apiErr.Message != "invalid_token" {
+		t.Errorf("err = %v, want a 401 ParticleAPIError", err)
+	}
+}
+
+func TestListParticleDevicesFollowsPages(t *testing.T) {
+	page := func(from, to int) []map[string]interface{} {
+		var devices []map[string]interface{}
+		for i := from; i < to; i++ {
+			devices = append(devices, map[string]interface{}{"id": fmt.Sprintf("dev%03d", i)})
+		}
+		return devices
+	}
+
+	tests := []struct {
+		name  string
+		serve func(w http.ResponseWriter, r *http.Request, server string)
+		want  int
+	}{
+		{
+			name: "single array",
+			serve: func(w http.ResponseWriter, r *http.Request, server string) {
+				json.NewEncoder(w).Encode(page(0, 3))
+			},
+			want: 3,
+		},
+		{
+			name: "meta total_pages",
+			serve: func(w http.ResponseWriter, r *http.Request, server string) {
+				n, _ := strconv.Atoi(r.URL.Query().Get("page"))
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"devices": page((n-1)*25, n*25),
+					"meta":    map[string]int{"total_pages": 3},
+				})
+			},
+			want: 75,
+		},
+		{
+			name: "link header",
+			serve: func(w http.ResponseWriter, r *http.Request, server string) {
+				n, _ := strconv.Atoi(r.URL.Query().Get("cursor"))
+				if n < 2 {
+					w.Header().Set("Link", fmt.Sprintf(`<%s/devices?cursor=%d>; rel="next"`, server, n+1))
+				}
+				json.NewEncoder(w).Encode(page(n*10, n*10+10))
+			},
+			want: 30,
+		},
+		{
+			name: "full pages up to the cap",
+			serve: func(w http.ResponseWriter, r *http.Request, server string) {
+				n, _ := strconv.Atoi(r.URL.Query().Get("page"))
+				json.NewEncoder(w).Encode(page((n-1)*particleDevicesPerPage, n*particleDevicesPerPage))
+			},
+			want: MaxParticleDevices,
+		},
+		{
+			name: "page ignored",
+			serve: func(w http.ResponseWriter, r *http.Request, server string) {
+				json.NewEncoder(w).Encode(page(0, particleDevicesPerPage))
+			},
+			want: particleDevicesPerPage,
+		},
+	}
+	for _, tt := range tests {
+		var requests atomic.Int32
+		var server *httptest.Server
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests.Add(1)
+			tt.serve(w, r, server.URL)
+		}))
+		saved := particleAPIBase
+		particleAPIBase = server.URL
+
+		devices, err := ListParticleDevices(context.Background(), "token")
+		particleAPIBase = saved
+		server.Close()
+
+		if err != nil || len(devices) != tt.want {
+			t.Errorf("%s: %d devices, %v; want %d", tt.name, len(devices), err, tt.want)
+			continue
+		}
+		seen := map[interface{}]bool{}
+		for _, d := range devices {
+			if seen[d["id"]] {
+				t.Errorf("%s: %v listed twice", tt.name, d["id"])
+			}
+			seen[d["id"]] = true
+		}
+		if requests.Load() > MaxParticleDevices/particleDevicesPerPage+1 {
+			t.Errorf("%s: %d requests", tt.name, requests.Load())
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Particle calls are tried up to ParticleMaxAttempts times. The wait before
+// retry n (from 1) is particleRetryBaseDelay doubled n-1 times, with jitter.
+const (
+	ParticleMaxAttempts    = 3
+	particleRetryBaseDelay = 250 * time.Millisecond
+)
+
+// IsRetryableParticleError reports whether a failed Particle call may succeed
+// if sent again: a network error or timeout, a 5xx, a 408, or a 429 (rate
+// limited; the backoff gives Particle room). Other 4xx responses, such as
+// an invalid token, fail the same way every time. Cancellation is never
+// retried.
+func IsRetryableParticleError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var statusErr particleStatusError
+	if errors.As(err, &statusErr) {
+		status := statusErr.ParticleStatus()
+		return status == http.StatusRequestTimeout || status == http.StatusTooManyRequests || status >= 500
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// ParticleRetryDelay is the wait before retry n (from 1): half the
+// exponential delay, plus a random part of the other half, so devices that
+// failed together don't all retry together
+func ParticleRetryDelay(n int) time.Duration {
+	delay := particleRetryBaseDelay << (n - 1)
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// RetryParticleCall runs call, retrying a retryable failure (see
+// IsRetryableParticleError) up to ParticleMaxAttempts in all. It stops early
+// when ctx is done or its deadline leaves no time to wait and try again. It
+// returns the attempts made and the last error, and adds the attempts to any
+// ParticleAttempts on ctx.
+//
+// Only use it for calls that are safe to repeat. The firmware's cloud
+// functions are: each sets state rather than changing it.
+func RetryParticleCall(ctx context.Context, name string, call func(ctx context.Context) error) (int, error) {
+	counter, _ := ctx.Value(particleAttemptsKey{}).(*ParticleAttempts)
+	counter.addCall()
+
+	attempt := 1
+	for ; ; attempt++ {
+		counter.addAttempt()
+		err := call(ctx)
+		if err == nil || attempt == ParticleMaxAttempts || !IsRetryableParticleError(err) || ctx.Err() != nil {
+			return attempt, err
+		}
+
+		delay := ParticleRetryDelay(attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline)-DeadlineSafetyMargin < delay {
+			log.Printf("Particle %s failed (attempt %d) with no time left to retry: %v", name, attempt, err)
+			return attempt, err
+		}
+		log.Printf("Particle %s failed (attempt %d of %d), retrying in %v: %v", name, attempt, ParticleMaxAttempts, delay, err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return attempt, err
+		}
+	}
+}
+
+// particleAttemptsKey is the context key for a request's ParticleAttempts
+type particleAttemptsKey struct{}
+
+// ParticleAttempts counts the Particle calls made through RetryParticleCall
+// with a context from WithParticleAttempts, and the attempts they took. Safe
+// for concurrent use; a nil *ParticleAttempts counts nothing.
+type ParticleAttempts struct {
+	calls    atomic.Int64
+	attempts atomic.Int64
+}
+
+// WithParticleAttempts returns ctx with a new ParticleAttempts attached
+func WithParticleAttempts(ctx context.Context) (context.Context, *ParticleAttempts) {
+	counter := &ParticleAttempts{}
+	return context.WithValue(ctx, particleAttemptsKey{}, counter), counter
+}
+
+// Attempts is how many requests were sent to Particle, retries included
+func (a *ParticleAttempts) Attempts() int {
+	if a == nil {
+		return 0
+	}
+	return int(a.attempts.Load())
+}
+
+// Retries is how many of the attempts were retries
+func (a *ParticleAttempts) Retries() int {
+	if a == nil {
+		return 0
+	}
+	return int(a.attempts.Load() - a.calls.Load())
+}
+
+func (a *ParticleAttempts) addCall() {
+	if a != nil {
+		a.calls.Add(1)
+	}
+}
+
+func (a *ParticleAttempts) addAttempt() {
+	if a != nil {
+		a.attempts.Add(1)
+	}
+}
@@ -0,0 +1,133 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIsRetryableParticleError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"canceled", context.Canceled, false},
+		{"500", &particleDeviceError{StatusCode: 500}, true},
+		{"503", &particleDeviceError{StatusCode: 503}, true},
+		{"408", &particleDeviceError{StatusCode: 408}, true},
+		{"429", &particleDeviceError{StatusCode: 429}, true},
+		{"400", &particleDeviceError{StatusCode: 400}, false},
+		{"403", &particleDeviceError{StatusCode: 403}, false},
+		{"404", &particleDeviceError{StatusCode: 404}, false},
+		{"plain error", errors.New("bad response"), false},
+	}
+
+	for _, tt := range tests {
+		if got := IsRetryableParticleError(tt.err); got != tt.want {
+			t.Errorf("%s: IsRetryableParticleError = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRetryParticleCall(t *testing.T) {
+	tests := []struct {
+		name         string
+		statuses     []int // Status of each attempt; 0 succeeds
+		wantAttempts int
+		wantErr      bool
+	}{
+		{"success", []int{0}, 1, false},
+		{"5xx then success", []int{502, 0}, 2, false},
+		{"429 then success", []int{429, 429, 0}, 3, false},
+		{"4xx is not retried", []int{404, 0}, 1, true},
+		{"stops at the attempt cap", []int{500, 500, 500, 0}, ParticleMaxAttempts, true},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			ctx, counter := WithParticleAttempts(context.Background())
+
+			calls := 0
+			attempts, err := RetryParticleCall(ctx, "test", func(ctx context.Context) error {
+				status := tt.statuses[calls]
+				calls++
+				if status == 0 {
+					return nil
+				}
+				return &particleDeviceError{StatusCode: status}
+			})
+
+			if attempts != tt.wantAttempts || calls != tt.wantAttempts {
+				t.Errorf("attempts = %d (calls %d), want %d", attempts, calls, tt.wantAttempts)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if counter.Attempts() != tt.wantAttempts || counter.Retries() != tt.wantAttempts-1 {
+				t.Errorf("counter attempts/retries = %d/%d, want %d/%d", counter.Attempts(), counter.Retries(), tt.wantAttempts, tt.wantAttempts-1)
+			}
+		})
+	}
+}
+
+func TestRetryParticleCallStopsWithoutTimeToRetry(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), DeadlineSafetyMargin+10*time.Millisecond)
+	defer cancel()
+
+	calls := 0
+	attempts, err := RetryParticleCall(ctx, "test", func(ctx context.Context) error {
+		calls++
+		return &particleDeviceError{StatusCode: 503}
+	})
+	if attempts != 1 || calls != 1 || err == nil {
+		t.Errorf("attempts = %d, calls = %d, err = %v; want one failed attempt", attempts, calls, err)
+	}
+}
+
+func TestGetParticleDeviceStatusRetries(t *testing.T) {
+	tests := []struct {
+		name      string
+		statuses  []int
+		wantCalls int32
+		wantErr   bool
+	}{
+		{"429 then ok", []int{429, 200}, 2, false},
+		{"5xx until the cap", []int{500, 502, 503, 200}, ParticleMaxAttempts, true},
+		{"401 is not retried", []int{401, 200}, 1, true},
+	}
+
+	for _, tt := range tests {
+		var calls atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			status := tt.statuses[calls.Add(1)-1]
+			w.WriteHeader(status)
+			if status == http.StatusOK {
+				w.Write([]byte(`{"connected":true,"name":"garage"}`))
+			}
+		}))
+
+		saved := particleAPIBase
+		particleAPIBase = server.URL
+		status, err := GetParticleDeviceStatus(context.Background(), "dev1", "token")
+		particleAPIBase = saved
+		server.Close()
+
+		if calls.Load() != tt.wantCalls {
+			t.Errorf("%s: %d requests, want %d", tt.name, calls.Load(), tt.wantCalls)
+		}
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: err = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+		if !tt.wantErr && (status == nil || !status.Connected || status.Name != "garage") {
+			t.Errorf("%s: status = %+v, want connected garage", tt.name, status)
+		}
+	}
+}
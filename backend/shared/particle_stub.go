@@ -0,0 +1,19 @@
+package shared
+
+import (
+	"net/http"
+	"net/http/httptest"
+)
+
+// StubParticleAPI points the shared Particle client at an in-process server
+// that passes every request to handle, for tests. restore puts back the
+// previous API base.
+func StubParticleAPI(handle http.HandlerFunc) (restore func()) {
+	server := httptest.NewServer(handle)
+	previous := particleAPIBase
+	particleAPIBase = server.URL
+	return func() {
+		particleAPIBase = previous
+		server.Close()
+	}
+}
@@ -0,0 +1,180 @@
+package shared
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// particleTokenInfoPath describes the access token a request is made with
+const particleTokenInfoPath = "/access_tokens/current"
+
+// ParticleFunctionCallScope is the scope a limited token needs to call
+// cloud functions. Tokens without scopes have full access.
+const ParticleFunctionCallScope = "devices.function:call"
+
+// ParticleTokenExpiryWarning is how long before a Particle token expires
+// users are warned to replace it
+const ParticleTokenExpiryWarning = 7 * 24 * time.Hour
+
+// ErrParticleTokenInvalid is returned when Particle rejects a token
+var ErrParticleTokenInvalid = errors.New("particle token is invalid or expired")
+
+// ParticleTokenInfo is what Particle reports about an access token
+type ParticleTokenInfo struct {
+	ExpiresAt *time.Time `json:"expires_at"` // Nil for tokens that never expire
+	Scopes    []string   `json:"scopes"`     // Empty for full access
+}
+
+// CanCallFunctions reports whether the token may call device functions,
+// which setting patterns needs
+func (i ParticleTokenInfo) CanCallFunctions() bool {
+	if len(i.Scopes) == 0 {
+		return true
+	}
+	for _, scope := range i.Scopes {
+		if scope == ParticleFunctionCallScope {
+			return true
+		}
+	}
+	return false
+}
+
+// GetParticleTokenInfo asks Particle for token's expiry and scopes
+func GetParticleTokenInfo(ctx context.Context, token string) (info *ParticleTokenInfo, err error) {
+	start := time.Now()
+	defer func() { ObserveParticleCall("access_token", start, err) }()
+
+	ctx, cancel := WithCallTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", ParticleAPIBase()+particleTokenInfoPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, DependencyTimeout("Particle", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized:
+		return nil, ErrParticleTokenInvalid
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("particle token info failed (status %d): %s", resp.StatusCode, string(body))
+	}
+
+	info = &ParticleTokenInfo{}
+	if err := json.Unmarshal(body, info); err != nil {
+		return nil, fmt.Errorf("failed to parse particle token info: %v", err)
+	}
+	return info, nil
+}
+
+// ParticleTokenExpiryMessage warns when user's Particle token has expired
+// or will within ParticleTokenExpiryWarning, and is empty otherwise
+func ParticleTokenExpiryMessage(user User, now time.Time) string {
+	expiresAt := user.ParticleTokenExpiresAt
+	if expiresAt == nil {
+		return ""
+	}
+	switch {
+	case !expiresAt.After(now):
+		return "Your Particle token has expired; add a new one in Settings"
+	case expiresAt.Sub(now) <= ParticleTokenExpiryWarning:
+		return fmt.Sprintf("Your Particle token expires %s; add a new one in Settings", expiresAt.UTC().Format("Jan 2 at 15:04 UTC"))
+	}
+	return ""
+}
+
+// SaveParticleToken saves user with token as their Particle token,
+// encrypted, noting when it expires so they can be warned before it does. A
+// token whose info can't be read is saved without one. user.ParticleToken is
+// left holding the ciphertext; the token itself is never stored.
+func SaveParticleToken(ctx context.Context, usersTable string, user *User, token string) error {
+	encrypted, err := EncryptSecret(ctx, token)
+	if err != nil {
+		return err
+	}
+	user.ParticleToken = encrypted
+	user.ParticleTokenExpiresAt = nil
+	if info, err := GetParticleTokenInfo(ctx, token); err != nil {
+		log.Printf("Failed to get Particle token info for %s: %v", user.Username, err)
+	} else {
+		user.ParticleTokenExpiresAt = info.ExpiresAt
+	}
+	user.UpdatedAt = time.Now()
+	return PutItem(ctx, usersTable, user)
+}
+
+// DecryptParticleToken replaces user's stored Particle token with the token
+// itself. A token saved before tokens were encrypted is used as is, and
+// re-saved encrypted if it hasn't changed since user was read; failing that
+// is logged, not returned. A token that can't be decrypted is an error.
+//
+// Only call it where user isn't saved whole afterwards, or the plaintext
+// token would be.
+func DecryptParticleToken(ctx context.Context, usersTable string, user *User) error {
+	stored := user.ParticleToken
+	if stored == "" {
+		return nil
+	}
+
+	token, err := DecryptSecret(ctx, stored)
+	if errors.Is(err, ErrSecretNotEncrypted) {
+		encryptStoredParticleToken(ctx, usersTable, user.Username, stored)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	user.ParticleToken = token
+	return nil
+}
+
+// encryptStoredParticleToken replaces a plaintext Particle token in the
+// users table with its encryption
+func encryptStoredParticleToken(ctx context.Context, usersTable, username, plaintext string) {
+	encrypted, err := EncryptSecret(ctx, plaintext)
+	if err != nil {
+		log.Printf("Failed to encrypt stored Particle token for %s: %v", username, err)
+		return
+	}
+
+	client, err := InitDynamoDB()
+	if err != nil {
+		log.Printf("Failed to encrypt stored Particle token for %s: %v", username, err)
+		return
+	}
+
+	_, err = client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(usersTable),
+		Key: map[string]types.AttributeValue{
+			"username": &types.AttributeValueMemberS{Value: username},
+		},
+		UpdateExpression:    aws.String("SET particleToken = :new"),
+		ConditionExpression: aws.String("particleToken = :old"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":new": &types.AttributeValueMemberS{Value: encrypted},
+			":old": &types.AttributeValueMemberS{Value: plaintext},
+		},
+	})
+	if err != nil {
+		log.Printf("Failed to save encrypted Particle token for %s: %v", username, err)
+		return
+	}
+	log.Printf("Encrypted stored Particle token for %s", username)
+}
@@ -0,0 +1,181 @@
+package shared
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Where the bytecode sent to a strip came from, reported by applies as
+// binarySource
+const (
+	BinarySourceStored   = "stored"   // The pattern's WLEDBinary, sent as authored
+	BinarySourceCached   = "cached"   // An earlier compilation for the strip's LED count
+	BinarySourceCompiled = "compiled" // Compiled for this apply
+)
+
+// StoreCompiledBinary sets a WLED pattern's WLEDBinary to its WLED state
+// compiled as authored, and clears it on patterns of other formats. Call it
+// whenever the pattern's content is saved so the binary never goes stale.
+func StoreCompiledBinary(pattern *Pattern) error {
+	if ResolvePatternFormat(*pattern) != PatternFormatWLED {
+		pattern.WLEDBinary = nil
+		return nil
+	}
+	binary, _, err := CompileWLED(pattern.WLEDState)
+	if err != nil {
+		return fmt.Errorf("failed to compile WLED: %v", err)
+	}
+	pattern.WLEDBinary = binary
+	return nil
+}
+
+// FillBinarySizes sets BinarySizeBytes on each pattern, so a list can warn
+// about patterns whose setBytecode argument (the binary in base64, plus the
+// pin) is close to Particle's function argument limit
+func FillBinarySizes(patterns []Pattern) {
+	for i := range patterns {
+		patterns[i].BinarySizeBytes = len(patterns[i].WLEDBinary)
+	}
+}
+
+// AuthoredLEDCount is the strip length a WLED pattern was written for: the
+// stop every one of its segments shares. It's 0 when the segments stop at
+// different LEDs or the pattern isn't WLED, as no strip gets it unchanged.
+func AuthoredLEDCount(pattern *Pattern) int {
+	if ResolvePatternFormat(*pattern) != PatternFormatWLED {
+		return 0
+	}
+	state, err := ParseWLEDJSON(pattern.WLEDState)
+	if err != nil {
+		return 0
+	}
+	return sharedSegmentStop(state)
+}
+
+// sharedSegmentStop is the stop all of state's segments share, or 0
+func sharedSegmentStop(state *WLEDState) int {
+	if len(state.Segments) == 0 {
+		return 0
+	}
+	stop := state.Segments[0].Stop
+	for _, seg := range state.Segments[1:] {
+		if seg.Stop != stop {
+			return 0
+		}
+	}
+	return stop
+}
+
+// storedBinaryFor returns the pattern's WLEDBinary when it can go to a strip
+// of ledCount LEDs as is: the pattern was authored for ledCount, so
+// PrepareWLEDForLEDCount would leave its state unchanged, and the binary
+// decodes to segments of that length too
+func storedBinaryFor(pattern *Pattern, ledCount int) ([]byte, bool) {
+	if len(pattern.WLEDBinary) == 0 || AuthoredLEDCount(pattern) != ledCount {
+		return nil, false
+	}
+	state, err := ParseBinaryToWLED(pattern.WLEDBinary)
+	if err != nil || sharedSegmentStop(state) != ledCount {
+		return nil, false
+	}
+	return pattern.WLEDBinary, true
+}
+
+// BinaryBackfillResult contains WLEDBinary backfill statistics
+type BinaryBackfillResult struct {
+	Scanned       int      `json:"scanned"`
+	Backfilled    int      `json:"backfilled"` // WLED patterns that had no binary
+	Refreshed     int      `json:"refreshed"`  // Binaries that no longer matched the WLED state
+	Failed        int      `json:"failed"`
+	BackfilledIDs []string `json:"backfilledIds,omitempty"`
+	Invalid       []string `json:"invalid,omitempty"` // WLED states that don't compile; left as they are
+	Errors        []string `json:"errors,omitempty"`
+}
+
+// BackfillPatternBinaries stores the compiled WLEDBinary on WLED patterns
+// without one, and replaces binaries that don't match the current state
+// (patterns edited before every save stored it). Only wledBinary is written,
+// on the condition the state hasn't changed since it was read, so updatedAt
+// and the compiled cache are untouched. With dryRun set nothing is written.
+func BackfillPatternBinaries(ctx context.Context, tableName string, dryRun bool) (*BinaryBackfillResult, error) {
+	client, err := InitDynamoDB()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &BinaryBackfillResult{}
+	paginator := dynamodb.NewScanPaginator(client, &dynamodb.ScanInput{
+		TableName:            aws.String(tableName),
+		ProjectionExpression: aws.String("patternId, wledState, wledBinary"),
+	})
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return result, err
+		}
+
+		for _, item := range page.Items {
+			result.Scanned++
+
+			var pattern Pattern
+			if err := attributevalue.UnmarshalMap(item, &pattern); err != nil || pattern.PatternID == "" {
+				result.Failed++
+				result.Errors = append(result.Errors, fmt.Sprintf("unreadable pattern record: %v", err))
+				continue
+			}
+			if ResolvePatternFormat(pattern) != PatternFormatWLED {
+				continue
+			}
+
+			binary, _, err := CompileWLED(pattern.WLEDState)
+			if err != nil {
+				result.Invalid = append(result.Invalid, pattern.PatternID+": "+err.Error())
+				continue
+			}
+			missing := len(pattern.WLEDBinary) == 0
+			if !missing && bytes.Equal(binary, pattern.WLEDBinary) {
+				continue
+			}
+
+			if dryRun {
+				log.Printf("[DRY RUN] Would store %d-byte binary on pattern %s (missing=%v)", len(binary), pattern.PatternID, missing)
+			} else {
+				_, err = client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+					TableName: aws.String(tableName),
+					Key: map[string]types.AttributeValue{
+						"patternId": &types.AttributeValueMemberS{Value: pattern.PatternID},
+					},
+					UpdateExpression:    aws.String("SET wledBinary = :bin"),
+					ConditionExpression: aws.String("wledState = :state"),
+					ExpressionAttributeValues: map[string]types.AttributeValue{
+						":bin":   &types.AttributeValueMemberB{Value: binary},
+						":state": &types.AttributeValueMemberS{Value: pattern.WLEDState},
+					},
+				})
+				if err != nil {
+					log.Printf("Failed to backfill binary for pattern %s: %v", pattern.PatternID, err)
+					result.Failed++
+					result.Errors = append(result.Errors, pattern.PatternID+": "+err.Error())
+					continue
+				}
+			}
+
+			if missing {
+				result.Backfilled++
+			} else {
+				result.Refreshed++
+			}
+			result.BackfilledIDs = append(result.BackfilledIDs, pattern.PatternID)
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,146 @@
+package shared
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// PatternColorConflictError is returned when a save sets both red/green/blue
+// and a colors array whose first entry is a different color
+type PatternColorConflictError struct {
+	RGB   PatternColor
+	First PatternColor
+}
+
+func (e *PatternColorConflictError) Error() string {
+	return fmt.Sprintf("red/green/blue (%s) conflict with colors[0] (%s); send only colors (preferred, used by current firmware) or only red/green/blue",
+		hexPatternColor(e.RGB), hexPatternColor(e.First))
+}
+
+func hexPatternColor(c PatternColor) string {
+	return fmt.Sprintf("#%02X%02X%02X", c.R, c.G, c.B)
+}
+
+// ReconcilePatternColors keeps a pattern's legacy Red/Green/Blue and its
+// Colors array in agreement on save. rgbSet and colorsSet say which of them
+// the request explicitly provided:
+//   - colors only: Red/Green/Blue are taken from the first color
+//   - red/green/blue only: Colors becomes that single color
+//   - both: they must match, else a *PatternColorConflictError
+func ReconcilePatternColors(p *Pattern, rgbSet, colorsSet bool) error {
+	colorsSet = colorsSet && len(p.Colors) > 0
+
+	switch {
+	case colorsSet && rgbSet:
+		first := p.Colors[0]
+		if first.R != p.Red || first.G != p.Green || first.B != p.Blue {
+			return &PatternColorConflictError{
+				RGB:   PatternColor{R: p.Red, G: p.Green, B: p.Blue},
+				First: first,
+			}
+		}
+	case colorsSet:
+		p.Red, p.Green, p.Blue = p.Colors[0].R, p.Colors[0].G, p.Colors[0].B
+	case rgbSet:
+		p.Colors = []PatternColor{{R: p.Red, G: p.Green, B: p.Blue, Percentage: 100}}
+	}
+	return nil
+}
+
+// PatternColorsConflict reports whether a stored pattern's Red/Green/Blue
+// differ from its first color
+func PatternColorsConflict(p *Pattern) bool {
+	if len(p.Colors) == 0 {
+		return false
+	}
+	first := p.Colors[0]
+	return first.R != p.Red || first.G != p.Green || first.B != p.Blue
+}
+
+// PatternColorFixResult contains pattern color fix-up statistics
+type PatternColorFixResult struct {
+	Scanned  int      `json:"scanned"`
+	Fixed    int      `json:"fixed"`
+	Failed   int      `json:"failed"`
+	FixedIDs []string `json:"fixedIds,omitempty"`
+	Errors   []string `json:"errors,omitempty"`
+}
+
+// FixPatternColorConflicts scans every pattern and, where Red/Green/Blue
+// disagree with the first entry of Colors, rewrites Red/Green/Blue from
+// Colors (what compiled patterns show). Only the color fields are written so
+// updatedAt and the compiled cache are untouched. With dryRun set nothing is
+// written.
+func FixPatternColorConflicts(ctx context.Context, tableName string, dryRun bool) (*PatternColorFixResult, error) {
+	client, err := InitDynamoDB()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &PatternColorFixResult{}
+	paginator := dynamodb.NewScanPaginator(client, &dynamodb.ScanInput{
+		TableName:            aws.String(tableName),
+		ProjectionExpression: aws.String("patternId, red, green, blue, colors"),
+	})
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return result, err
+		}
+
+		for _, item := range page.Items {
+			result.Scanned++
+
+			var pattern Pattern
+			if err := attributevalue.UnmarshalMap(item, &pattern); err != nil || pattern.PatternID == "" {
+				result.Failed++
+				result.Errors = append(result.Errors, fmt.Sprintf("unreadable pattern record: %v", err))
+				continue
+			}
+
+			if !PatternColorsConflict(&pattern) {
+				continue
+			}
+
+			first := pattern.Colors[0]
+			if dryRun {
+				log.Printf("[DRY RUN] Would set pattern %s RGB from %s to %s", pattern.PatternID,
+					hexPatternColor(PatternColor{R: pattern.Red, G: pattern.Green, B: pattern.Blue}), hexPatternColor(first))
+				result.Fixed++
+				result.FixedIDs = append(result.FixedIDs, pattern.PatternID)
+				continue
+			}
+
+			_, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+				TableName: aws.String(tableName),
+				Key: map[string]types.AttributeValue{
+					"patternId": &types.AttributeValueMemberS{Value: pattern.PatternID},
+				},
+				UpdateExpression: aws.String("SET red = :r, green = :g, blue = :b"),
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":r": &types.AttributeValueMemberN{Value: fmt.Sprint(first.R)},
+					":g": &types.AttributeValueMemberN{Value: fmt.Sprint(first.G)},
+					":b": &types.AttributeValueMemberN{Value: fmt.Sprint(first.B)},
+				},
+			})
+			if err != nil {
+				log.Printf("Failed to fix colors for pattern %s: %v", pattern.PatternID, err)
+				result.Failed++
+				result.Errors = append(result.Errors, pattern.PatternID+": "+err.Error())
+				continue
+			}
+
+			result.Fixed++
+			result.FixedIDs = append(result.FixedIDs, pattern.PatternID)
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,102 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestReconcilePatternColors(t *testing.T) {
+	orange := PatternColor{R: 255, G: 120, B: 0, Percentage: 100}
+
+	// Colors only: RGB follows the first color
+	p := Pattern{Colors: []PatternColor{orange, {B: 255, Percentage: 50}}}
+	if err := ReconcilePatternColors(&p, false, true); err != nil || p.Red != 255 || p.Green != 120 || p.Blue != 0 {
+		t.Errorf("colors only: rgb = %d,%d,%d, %v; want 255,120,0", p.Red, p.Green, p.Blue, err)
+	}
+
+	// RGB only: a single color is synthesized
+	p = Pattern{Red: 255, Green: 120}
+	if err := ReconcilePatternColors(&p, true, false); err != nil || len(p.Colors) != 1 || p.Colors[0] != orange {
+		t.Errorf("rgb only: colors = %v, %v; want [%v]", p.Colors, err, orange)
+	}
+
+	// Both, agreeing
+	p = Pattern{Red: 255, Green: 120, Colors: []PatternColor{orange}}
+	if err := ReconcilePatternColors(&p, true, true); err != nil {
+		t.Errorf("matching rgb and colors: %v", err)
+	}
+
+	// Both, conflicting
+	p = Pattern{Red: 0, Green: 0, Blue: 255, Colors: []PatternColor{orange}}
+	err := ReconcilePatternColors(&p, true, true)
+	var conflict *PatternColorConflictError
+	if !errors.As(err, &conflict) {
+		t.Fatalf("conflicting rgb and colors: err = %v, want a PatternColorConflictError", err)
+	}
+	if want := "red/green/blue (#0000FF) conflict with colors[0] (#FF7800)"; !strings.HasPrefix(err.Error(), want) {
+		t.Errorf("error = %q, want it to start %q", err, want)
+	}
+	if p.Red != 0 || p.Blue != 255 || len(p.Colors) != 1 {
+		t.Errorf("a rejected save changed the pattern")
+	}
+
+	// An empty colors array counts as not sent
+	p = Pattern{Red: 9, Colors: []PatternColor{}}
+	if err := ReconcilePatternColors(&p, true, true); err != nil || len(p.Colors) != 1 || p.Colors[0].R != 9 {
+		t.Errorf("rgb with empty colors = %v, %v; want a synthesized color", p.Colors, err)
+	}
+}
+
+func TestFixPatternColorConflicts(t *testing.T) {
+	stored := []Pattern{
+		{PatternID: "agree", Red: 255, Colors: []PatternColor{{R: 255, Percentage: 100}}},
+		{PatternID: "conflict", Blue: 255, Colors: []PatternColor{{R: 255, G: 120, Percentage: 100}}},
+		{PatternID: "legacy", Red: 10},
+	}
+	for _, dryRun := range []bool{true, false} {
+		var updates []string
+		restore := StubDynamoDB(func(call DynamoDBStubCall) (map[string]interface{}, error) {
+			switch call.Operation {
+			case "Scan":
+				items := make([]interface{}, len(stored))
+				for i := range stored {
+					items[i] = stored[i]
+				}
+				return map[string]interface{}{"Items": DynamoDBStubItems(items...)}, nil
+			case "UpdateItem":
+				var key struct {
+					PatternID string `dynamodbav:"patternId"`
+				}
+				var values struct {
+					R int `dynamodbav:":r"`
+					G int `dynamodbav:":g"`
+					B int `dynamodbav:":b"`
+				}
+				if err := call.Unmarshal("Key", &key); err != nil {
+					return nil, err
+				}
+				if err := call.Unmarshal("ExpressionAttributeValues", &values); err != nil {
+					return nil, err
+				}
+				updates = append(updates, fmt.Sprintf("%s %d,%d,%d", key.PatternID, values.R, values.G, values.B))
+				return nil, nil
+			}
+			return nil, fmt.Errorf("unexpected %s", call.Operation)
+		})
+		result, err := FixPatternColorConflicts(context.Background(), "patterns", dryRun)
+		restore()
+
+		if err != nil || result.Scanned != 3 || result.Fixed != 1 || len(result.FixedIDs) != 1 || result.FixedIDs[0] != "conflict" {
+			t.Errorf("dryRun=%v: result = %+v, %v; want conflict fixed out of 3", dryRun, result, err)
+		}
+		if dryRun && len(updates) != 0 {
+			t.Errorf("dry run wrote %v", updates)
+		}
+		if !dryRun && (len(updates) != 1 || updates[0] != "conflict 255,120,0") {
+			t.Errorf("updates = %v, want conflict set to 255,120,0", updates)
+		}
+	}
+}
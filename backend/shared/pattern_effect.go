@@ -0,0 +1,189 @@
+package shared
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// metadataEffectIDKey is the Metadata key legacy patterns used to override
+// their WLED effect before Pattern.EffectID existed. It's still read when
+// EffectID is unset, but new patterns should set EffectID.
+const metadataEffectIDKey = "effectId"
+
+// ValidateEffectID checks that a WLED effect can be used as a pattern's
+// effect override
+func ValidateEffectID(id int) error {
+	if IsEffectSupported(id) {
+		return nil
+	}
+	ids := GetSupportedEffectIDs()
+	sort.Ints(ids)
+	allowed := make([]string, len(ids))
+	for i, supported := range ids {
+		allowed[i] = strconv.Itoa(supported)
+	}
+	return fmt.Errorf("effectId %d is not supported; use one of %s", id, strings.Join(allowed, ", "))
+}
+
+// parseMetadataEffectID reads the deprecated Metadata effectId, reporting
+// whether one is present
+func parseMetadataEffectID(p *Pattern) (int, bool, error) {
+	raw, ok := p.Metadata[metadataEffectIDKey]
+	if !ok {
+		return 0, false, nil
+	}
+	id, err := strconv.Atoi(strings.TrimSpace(raw))
+	if err != nil {
+		return 0, true, fmt.Errorf("metadata effectId %q is not a number", raw)
+	}
+	return id, true, nil
+}
+
+// NormalizePatternEffectID validates a pattern's effect override when it is
+// saved. On legacy patterns a valid Metadata effectId is copied into EffectID
+// when EffectID is unset; an invalid override in either place is an error,
+// rather than a silent fallback to solid when the pattern is applied. WLED
+// and LCL patterns carry their own effects, so their Metadata is left alone.
+func NormalizePatternEffectID(p *Pattern) error {
+	if p.EffectID != nil {
+		return ValidateEffectID(*p.EffectID)
+	}
+	if ResolvePatternFormat(*p) != PatternFormatLegacySimple {
+		return nil
+	}
+
+	id, ok, err := parseMetadataEffectID(p)
+	if err != nil || !ok {
+		return err
+	}
+	if err := ValidateEffectID(id); err != nil {
+		return fmt.Errorf("metadata %v", err)
+	}
+	p.EffectID = &id
+	return nil
+}
+
+// patternEffectOverride is the WLED effect a legacy pattern asks for in place
+// of its type's mapping: EffectID, or the deprecated Metadata effectId. An
+// unusable override is ignored with a warning.
+func patternEffectOverride(p *Pattern) (int, bool, []string) {
+	if p.EffectID != nil {
+		if !IsEffectSupported(*p.EffectID) {
+			return 0, false, []string{fmt.Sprintf("Effect override %d is not supported; ignoring it", *p.EffectID)}
+		}
+		return *p.EffectID, true, nil
+	}
+
+	id, ok, err := parseMetadataEffectID(p)
+	if !ok {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, []string{fmt.Sprintf("Ignoring %v", err)}
+	}
+	if !IsEffectSupported(id) {
+		return 0, false, []string{fmt.Sprintf("Metadata effectId %d is not supported; ignoring it", id)}
+	}
+	log.Printf("Pattern %s uses the deprecated metadata effectId %d; save it again or run the effectId migration to set effectId", p.PatternID, id)
+	return id, true, nil
+}
+
+// EffectIDMigrationResult contains Metadata effectId migration statistics
+type EffectIDMigrationResult struct {
+	Scanned     int      `json:"scanned"`
+	Migrated    int      `json:"migrated"`
+	Failed      int      `json:"failed"`
+	MigratedIDs []string `json:"migratedIds,omitempty"`
+	Invalid     []string `json:"invalid,omitempty"` // Patterns whose Metadata effectId can't be used; left as they are
+	Errors      []string `json:"errors,omitempty"`
+}
+
+// MigrateMetadataEffectIDs copies each legacy pattern's Metadata effectId
+// into EffectID where EffectID is unset. Only effectId is written, so updatedAt
+// and the compiled cache are untouched: the override compiles the same
+// either way. Invalid overrides are reported, not migrated. With dryRun set
+// nothing is written.
+func MigrateMetadataEffectIDs(ctx context.Context, tableName string, dryRun bool) (*EffectIDMigrationResult, error) {
+	client, err := InitDynamoDB()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &EffectIDMigrationResult{}
+	paginator := dynamodb.NewScanPaginator(client, &dynamodb.ScanInput{
+		TableName:            aws.String(tableName),
+		ProjectionExpression: aws.String("patternId, metadata, effectId, wledState, lclSpec"),
+	})
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return result, err
+		}
+
+		for _, item := range page.Items {
+			result.Scanned++
+
+			var pattern Pattern
+			if err := attributevalue.UnmarshalMap(item, &pattern); err != nil || pattern.PatternID == "" {
+				result.Failed++
+				result.Errors = append(result.Errors, fmt.Sprintf("unreadable pattern record: %v", err))
+				continue
+			}
+
+			if pattern.EffectID != nil || ResolvePatternFormat(pattern) != PatternFormatLegacySimple {
+				continue
+			}
+			id, ok, err := parseMetadataEffectID(&pattern)
+			if !ok {
+				continue
+			}
+			if err == nil {
+				err = ValidateEffectID(id)
+			}
+			if err != nil {
+				result.Invalid = append(result.Invalid, pattern.PatternID+": "+err.Error())
+				continue
+			}
+
+			if dryRun {
+				log.Printf("[DRY RUN] Would set pattern %s effectId to %d", pattern.PatternID, id)
+				result.Migrated++
+				result.MigratedIDs = append(result.MigratedIDs, pattern.PatternID)
+				continue
+			}
+
+			_, err = client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+				TableName: aws.String(tableName),
+				Key: map[string]types.AttributeValue{
+					"patternId": &types.AttributeValueMemberS{Value: pattern.PatternID},
+				},
+				UpdateExpression:    aws.String("SET effectId = :id"),
+				ConditionExpression: aws.String("attribute_exists(patternId) AND attribute_not_exists(effectId)"),
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":id": &types.AttributeValueMemberN{Value: strconv.Itoa(id)},
+				},
+			})
+			if err != nil {
+				log.Printf("Failed to migrate effectId for pattern %s: %v", pattern.PatternID, err)
+				result.Failed++
+				result.Errors = append(result.Errors, pattern.PatternID+": "+err.Error())
+				continue
+			}
+
+			result.Migrated++
+			result.MigratedIDs = append(result.MigratedIDs, pattern.PatternID)
+		}
+	}
+
+	return result, nil
+}
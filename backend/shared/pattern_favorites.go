@@ -0,0 +1,122 @@
+package shared
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Pattern list orderings for the sortBy query parameter
+const (
+	PatternSortFavoritesFirst = "favoritesFirst" // Default: favorites, then the rest, each by name
+	PatternSortName           = "name"
+	PatternSortCreatedAt      = "createdAt" // Newest first
+	PatternSortUpdatedAt      = "updatedAt" // Most recently edited first
+	PatternSortApplyCount     = "applyCount"
+)
+
+// PatternSummary is the lightweight form of a pattern for quick-access lists
+type PatternSummary struct {
+	PatternID    string `json:"patternId"`
+	Name         string `json:"name"`
+	Type         string `json:"type"`
+	ThumbnailURL string `json:"thumbnailUrl"` // Animated preview GIF
+}
+
+// SummarizePattern builds the quick-access form of a pattern
+func SummarizePattern(p Pattern) PatternSummary {
+	return PatternSummary{
+		PatternID:    p.PatternID,
+		Name:         p.Name,
+		Type:         p.Type,
+		ThumbnailURL: "/api/patterns/" + p.PatternID + "/preview",
+	}
+}
+
+// SortPatterns orders patterns by one of the PatternSort* values ("" means
+// favoritesFirst). Ties are broken by name so the order is stable.
+func SortPatterns(patterns []Pattern, sortBy string) error {
+	var less func(a, b *Pattern) bool
+	switch sortBy {
+	case "", PatternSortFavoritesFirst:
+		less = func(a, b *Pattern) bool {
+			if a.IsFavorite != b.IsFavorite {
+				return a.IsFavorite
+			}
+			return a.Name < b.Name
+		}
+	case PatternSortName:
+		less = func(a, b *Pattern) bool { return a.Name < b.Name }
+	case PatternSortCreatedAt:
+		less = func(a, b *Pattern) bool {
+			if !a.CreatedAt.Equal(b.CreatedAt) {
+				return a.CreatedAt.After(b.CreatedAt)
+			}
+			return a.Name < b.Name
+		}
+	case PatternSortUpdatedAt:
+		less = func(a, b *Pattern) bool {
+			if !a.UpdatedAt.Equal(b.UpdatedAt) {
+				return a.UpdatedAt.After(b.UpdatedAt)
+			}
+			return a.Name < b.Name
+		}
+	case PatternSortApplyCount:
+		SortPatternsByApplyCount(patterns)
+		return nil
+	default:
+		return fmt.Errorf("unsupported sortBy %q", sortBy)
+	}
+
+	sort.SliceStable(patterns, func(i, j int) bool {
+		return less(&patterns[i], &patterns[j])
+	})
+	return nil
+}
+
+// SetPatternFavorite sets a pattern's isFavorite flag. Only that attribute is
+// written: updatedAt keys the compiled cache, and a favorite isn't an edit.
+func SetPatternFavorite(ctx context.Context, tableName, patternID string, favorite bool) (*Pattern, error) {
+	client, err := InitDynamoDB()
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"patternId": &types.AttributeValueMemberS{Value: patternID},
+		},
+		UpdateExpression:    aws.String("SET isFavorite = :favorite"),
+		ConditionExpression: aws.String("attribute_exists(patternId)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":favorite": &types.AttributeValueMemberBOOL{Value: favorite},
+		},
+		ReturnValues: types.ReturnValueAllNew,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var pattern Pattern
+	if err := attributevalue.UnmarshalMap(output.Attributes, &pattern); err != nil {
+		return nil, err
+	}
+	return &pattern, nil
+}
+
+// FilterFavoritePatterns returns only the patterns marked as favorites
+func FilterFavoritePatterns(patterns []Pattern) []Pattern {
+	favorites := make([]Pattern, 0, len(patterns))
+	for _, p := range patterns {
+		if p.IsFavorite {
+			favorites = append(favorites, p)
+		}
+	}
+	return favorites
+}
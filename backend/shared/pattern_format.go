@@ -0,0 +1,237 @@
+package shared
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+)
+
+// PatternFormat is where a pattern's content comes from when it is compiled
+type PatternFormat int
+
+const (
+	PatternFormatLegacySimple PatternFormat = iota // Type, colors, brightness, and speed
+	PatternFormatLCL                               // LCLSpec
+	PatternFormatWLED                              // WLEDState
+)
+
+func (f PatternFormat) String() string {
+	switch f {
+	case PatternFormatWLED:
+		return "wled"
+	case PatternFormatLCL:
+		return "lcl"
+	}
+	return "legacy"
+}
+
+// FormatVersion is the Pattern.FormatVersion stored for the format (0 for legacy)
+func (f PatternFormat) FormatVersion() int {
+	switch f {
+	case PatternFormatWLED:
+		return FormatVersionWLED
+	case PatternFormatLCL:
+		return FormatVersionLCL
+	}
+	return 0
+}
+
+// ResolvePatternFormat decides which fields a pattern is compiled from. It is
+// the only place that decision is made: a WLEDState wins, then an LCLSpec,
+// then the legacy fields. Type, Category, FormatVersion, and the compiled
+// Bytecode/WLEDBinary are never consulted, as older records can leave them
+// stale.
+func ResolvePatternFormat(p Pattern) PatternFormat {
+	switch {
+	case strings.TrimSpace(p.WLEDState) != "":
+		return PatternFormatWLED
+	case strings.TrimSpace(p.LCLSpec) != "":
+		return PatternFormatLCL
+	}
+	return PatternFormatLegacySimple
+}
+
+// ValidatePatternFormat checks that the field ResolvePatternFormat picks can
+// be compiled
+func ValidatePatternFormat(p Pattern) error {
+	switch ResolvePatternFormat(p) {
+	case PatternFormatWLED:
+		state, err := ParseWLEDJSON(p.WLEDState)
+		if err != nil {
+			return fmt.Errorf("invalid WLED state: %v", err)
+		}
+		if len(state.Segments) > WLEDBMaxSegments {
+			return fmt.Errorf("invalid WLED state: %s", segmentCapError(state))
+		}
+	case PatternFormatLCL:
+		if _, err := ParseLCLSpec(p.LCLSpec); err != nil {
+			return fmt.Errorf("invalid LCL spec: %v", err)
+		}
+	}
+	return nil
+}
+
+// NormalizePatternFormat makes a pattern's descriptive fields agree with its
+// resolved format and returns a description of each change:
+//
+//   - LCL text saved in WLEDState by older Glow Blaster saves is moved to LCLSpec
+//   - FormatVersion is set from the format (cleared for legacy patterns)
+//   - Glow Blaster patterns with WLED or LCL content get the glowblaster Type
+//     and Category, whichever of the two they were missing
+//   - LCL patterns without a Category are Glow Blaster's, the only LCL source
+//
+// Patterns with a glowblaster Type but no WLED or LCL content are left alone;
+// ValidatePatternFormat can't tell what they should be.
+func NormalizePatternFormat(p *Pattern) []string {
+	var changes []string
+
+	if p.WLEDState != "" && !json.Valid([]byte(p.WLEDState)) {
+		if _, err := ParseLCLSpec(p.WLEDState); err == nil && p.LCLSpec == "" {
+			p.LCLSpec = p.WLEDState
+			p.WLEDState = ""
+			p.WLEDBinary = nil
+			changes = append(changes, "moved LCL text from wledState to lclSpec")
+		}
+	}
+
+	format := ResolvePatternFormat(*p)
+
+	if version := format.FormatVersion(); p.FormatVersion != version {
+		changes = append(changes, fmt.Sprintf("formatVersion %d -> %d", p.FormatVersion, version))
+		p.FormatVersion = version
+	}
+
+	if format == PatternFormatLegacySimple {
+		return changes
+	}
+
+	glowBlaster := p.Category == CategoryGlowBlaster || p.Type == PatternGlowBlaster ||
+		(format == PatternFormatLCL && p.Category == "")
+	if !glowBlaster {
+		return changes
+	}
+	if p.Type != PatternGlowBlaster {
+		changes = append(changes, fmt.Sprintf("type %q -> %q", p.Type, PatternGlowBlaster))
+		p.Type = PatternGlowBlaster
+	}
+	if p.Category != CategoryGlowBlaster {
+		changes = append(changes, fmt.Sprintf("category %q -> %q", p.Category, CategoryGlowBlaster))
+		p.Category = CategoryGlowBlaster
+	}
+	return changes
+}
+
+// lclSpecToWLEDJSON converts an LCL spec to WLED JSON for ledCount LEDs
+func lclSpecToWLEDJSON(lclSpec string, ledCount int) (string, []string, error) {
+	spec, err := ParseLCLSpec(lclSpec)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to parse LCL spec: %v", err)
+	}
+	warnings := ConvertLCLToWLEDWarnings(spec)
+
+	state, err := ConvertLCLToWLED(spec, ledCount)
+	if err != nil {
+		return "", warnings, fmt.Errorf("failed to convert LCL spec: %v", err)
+	}
+	wledJSON, err := json.Marshal(state)
+	if err != nil {
+		return "", warnings, err
+	}
+	return string(wledJSON), warnings, nil
+}
+
+// PatternFormatFix describes the changes NormalizePatternFormat made to one pattern
+type PatternFormatFix struct {
+	PatternID string   `json:"patternId"`
+	Name      string   `json:"name"`
+	Format    string   `json:"format"`
+	Changes   []string `json:"changes"`
+}
+
+// PatternFormatFixResult contains pattern format fix-up statistics
+type PatternFormatFixResult struct {
+	Scanned int                `json:"scanned"`
+	Fixed   int                `json:"fixed"`
+	Failed  int                `json:"failed"`
+	Invalid []string           `json:"invalid,omitempty"` // Patterns whose content still fails ValidatePatternFormat
+	Fixes   []PatternFormatFix `json:"fixes,omitempty"`
+	Errors  []string           `json:"errors,omitempty"`
+}
+
+// FixPatternFormats scans every pattern, applies NormalizePatternFormat, and
+// saves the ones it changed. updatedAt is left alone; the compiled cache and
+// effect IDs are rebuilt when the content moved fields. With dryRun set
+// nothing is written and the result reports what would change.
+func FixPatternFormats(ctx context.Context, tableName string, dryRun bool) (*PatternFormatFixResult, error) {
+	client, err := InitDynamoDB()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &PatternFormatFixResult{}
+	paginator := dynamodb.NewScanPaginator(client, &dynamodb.ScanInput{
+		TableName: aws.String(tableName),
+	})
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return result, err
+		}
+
+		for _, item := range page.Items {
+			result.Scanned++
+
+			var pattern Pattern
+			if err := attributevalue.UnmarshalMap(item, &pattern); err != nil || pattern.PatternID == "" {
+				result.Failed++
+				result.Errors = append(result.Errors, fmt.Sprintf("unreadable pattern record: %v", err))
+				continue
+			}
+
+			previousFormat := ResolvePatternFormat(pattern)
+			changes := NormalizePatternFormat(&pattern)
+			if err := ValidatePatternFormat(pattern); err != nil {
+				result.Invalid = append(result.Invalid, pattern.PatternID+": "+err.Error())
+			}
+			if len(changes) == 0 {
+				continue
+			}
+
+			fix := PatternFormatFix{
+				PatternID: pattern.PatternID,
+				Name:      pattern.Name,
+				Format:    ResolvePatternFormat(pattern).String(),
+				Changes:   changes,
+			}
+			if dryRun {
+				log.Printf("[DRY RUN] Would normalize pattern %s: %s", pattern.PatternID, strings.Join(changes, "; "))
+				result.Fixed++
+				result.Fixes = append(result.Fixes, fix)
+				continue
+			}
+
+			if ResolvePatternFormat(pattern) != previousFormat {
+				pattern.CompiledCache = PrecompileCommonLEDCounts(&pattern)
+				pattern.CompatibleEffectIDs = ComputeCompatibleEffectIDs(&pattern)
+			}
+			if err := PutItem(ctx, tableName, pattern); err != nil {
+				log.Printf("Failed to normalize pattern %s: %v", pattern.PatternID, err)
+				result.Failed++
+				result.Errors = append(result.Errors, pattern.PatternID+": "+err.Error())
+				continue
+			}
+
+			result.Fixed++
+			result.Fixes = append(result.Fixes, fix)
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,69 @@
+package shared
+
+import (
+	"context"
+	"sort"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// PatternStats summarizes how often a user's patterns have been applied
+type PatternStats struct {
+	TotalPatterns      int      `json:"totalPatterns"`
+	TotalApplyCount    int      `json:"totalApplyCount"`
+	AveragePerPattern  float64  `json:"averageAppliesPerPattern"`
+	MostAppliedPattern *Pattern `json:"mostAppliedPattern,omitempty"` // Nil until something has been applied
+}
+
+// IncrementPatternApplyCount atomically adds one to a pattern's applyCount.
+// ADD creates the attribute on first use; the condition keeps it from
+// creating an item for a pattern that was deleted meanwhile.
+func IncrementPatternApplyCount(ctx context.Context, tableName, patternID string) error {
+	client, err := InitDynamoDB()
+	if err != nil {
+		return err
+	}
+
+	_, err = client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"patternId": &types.AttributeValueMemberS{Value: patternID},
+		},
+		UpdateExpression:    aws.String("ADD applyCount :one"),
+		ConditionExpression: aws.String("attribute_exists(patternId)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":one": &types.AttributeValueMemberN{Value: "1"},
+		},
+	})
+	return err
+}
+
+// SortPatternsByApplyCount orders patterns most-applied first, breaking ties by name
+func SortPatternsByApplyCount(patterns []Pattern) {
+	sort.SliceStable(patterns, func(i, j int) bool {
+		if patterns[i].ApplyCount != patterns[j].ApplyCount {
+			return patterns[i].ApplyCount > patterns[j].ApplyCount
+		}
+		return patterns[i].Name < patterns[j].Name
+	})
+}
+
+// ComputePatternStats totals apply counts across patterns
+func ComputePatternStats(patterns []Pattern) PatternStats {
+	stats := PatternStats{TotalPatterns: len(patterns)}
+
+	for i := range patterns {
+		stats.TotalApplyCount += patterns[i].ApplyCount
+		if patterns[i].ApplyCount > 0 && (stats.MostAppliedPattern == nil || patterns[i].ApplyCount > stats.MostAppliedPattern.ApplyCount) {
+			stats.MostAppliedPattern = &patterns[i]
+		}
+	}
+
+	if stats.TotalPatterns > 0 {
+		stats.AveragePerPattern = float64(stats.TotalApplyCount) / float64(stats.TotalPatterns)
+	}
+
+	return stats
+}
@@ -0,0 +1,98 @@
+package shared
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestIncrementPatternApplyCountIsAtomic(t *testing.T) {
+	var mu sync.Mutex
+	counts := map[string]int{"p1": 0}
+	defer StubDynamoDB(func(call DynamoDBStubCall) (map[string]interface{}, error) {
+		// The increment has to happen in DynamoDB, not as a read followed by a write
+		if call.Operation != "UpdateItem" || call.String("UpdateExpression") != "ADD applyCount :one" {
+			t.Errorf("%s %q, want an ADD update", call.Operation, call.String("UpdateExpression"))
+			return nil, nil
+		}
+		var key struct {
+			PatternID string `dynamodbav:"patternId"`
+		}
+		var values struct {
+			One int `dynamodbav:":one"`
+		}
+		if err := call.Unmarshal("Key", &key); err != nil {
+			return nil, err
+		}
+		if err := call.Unmarshal("ExpressionAttributeValues", &values); err != nil {
+			return nil, err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if _, ok := counts[key.PatternID]; !ok {
+			return nil, ErrDynamoDBStubConditionFailed
+		}
+		counts[key.PatternID] += values.One
+		return nil, nil
+	})()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := IncrementPatternApplyCount(context.Background(), "patterns", "p1"); err != nil {
+				t.Errorf("increment: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if counts["p1"] != 10 {
+		t.Errorf("applyCount = %d after 10 concurrent applies, want 10", counts["p1"])
+	}
+
+	if err := IncrementPatternApplyCount(context.Background(), "patterns", "deleted"); err == nil {
+		t.Errorf("incrementing a deleted pattern succeeded")
+	}
+	if _, ok := counts["deleted"]; ok {
+		t.Errorf("incrementing a deleted pattern created it")
+	}
+}
+
+func TestComputePatternStats(t *testing.T) {
+	if stats := ComputePatternStats(nil); stats.TotalPatterns != 0 || stats.AveragePerPattern != 0 || stats.MostAppliedPattern != nil {
+		t.Errorf("stats without patterns = %+v, want zeros", stats)
+	}
+
+	patterns := []Pattern{
+		{PatternID: "a", Name: "Amber", ApplyCount: 2},
+		{PatternID: "b", Name: "Blue", ApplyCount: 5},
+		{PatternID: "c", Name: "Cyan"},
+		{PatternID: "d", Name: "Dusk", ApplyCount: 5},
+	}
+	stats := ComputePatternStats(patterns)
+	if stats.TotalPatterns != 4 || stats.TotalApplyCount != 12 || stats.AveragePerPattern != 3 {
+		t.Errorf("stats = %+v, want 4 patterns, 12 applies, 3 on average", stats)
+	}
+	if stats.MostAppliedPattern == nil || stats.MostAppliedPattern.PatternID != "b" {
+		t.Errorf("most applied = %v, want b, the first of the tied patterns", stats.MostAppliedPattern)
+	}
+}
+
+func TestSortPatternsByApplyCount(t *testing.T) {
+	patterns := []Pattern{
+		{Name: "Cyan"},
+		{Name: "Dusk", ApplyCount: 5},
+		{Name: "Amber", ApplyCount: 2},
+		{Name: "Blue", ApplyCount: 5},
+	}
+	SortPatternsByApplyCount(patterns)
+	var got string
+	for _, p := range patterns {
+		got += p.Name + ":" + strconv.Itoa(p.ApplyCount) + " "
+	}
+	if want := "Blue:5 Dusk:5 Amber:2 Cyan:0 "; got != want {
+		t.Errorf("order = %q, want %q", got, want)
+	}
+}
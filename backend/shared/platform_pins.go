@@ -0,0 +1,112 @@
+package shared
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// PlatformPinDefaults is what a Particle platform offers strips, as the
+// firmware drives it: the pin a strip goes on when none is configured, and
+// the pins strips may use
+type PlatformPinDefaults struct {
+	Platform      string   `json:"platform"`      // As named in deviceInfo; "" when unknown
+	DefaultPin    int      `json:"defaultPin"`    // Pin assumed for a device with no strips configured
+	MaxPins       int      `json:"maxPins"`       // How many strips the platform can drive at once
+	SupportedPins []int    `json:"supportedPins"` // Pins a strip may be configured on
+	PinLabels     []string `json:"pinLabels"`     // SupportedPins as the board labels them ("D2")
+}
+
+// Pins for the platforms the firmware reports in deviceInfo. The firmware
+// drives D0-D7. Photon and Electron put the LED data line on D6 by
+// convention. Gen 3 boards and the Photon 2 use D2 instead, and keep D0 and
+// D1 for I2C.
+var platformPinDefaults = map[string]PlatformPinDefaults{
+	"photon":   newPlatformPinDefaults("photon", 6, 0, 7),
+	"electron": newPlatformPinDefaults("electron", 6, 0, 7),
+	"argon":    newPlatformPinDefaults("argon", 2, 2, 7),
+	"boron":    newPlatformPinDefaults("boron", 2, 2, 7),
+	"photon2":  newPlatformPinDefaults("photon2", 2, 2, 7),
+}
+
+// fallbackPinDefaults is the long-standing assumption of D6 and D0-D7, for
+// platforms not in platformPinDefaults
+var fallbackPinDefaults = newPlatformPinDefaults("", 6, 0, 7)
+
+func newPlatformPinDefaults(platform string, defaultPin, first, last int) PlatformPinDefaults {
+	d := PlatformPinDefaults{Platform: platform, DefaultPin: defaultPin}
+	for pin := first; pin <= last; pin++ {
+		d.SupportedPins = append(d.SupportedPins, pin)
+		d.PinLabels = append(d.PinLabels, PinLabel(pin))
+	}
+	d.MaxPins = len(d.SupportedPins)
+	return d
+}
+
+// PinLabel is a pin as the board labels it ("D6")
+func PinLabel(pin int) string {
+	return "D" + strconv.Itoa(pin)
+}
+
+// PinDefaultsForPlatform returns the pin defaults for a platform as named in
+// deviceInfo. Unknown platforms get the D6 fallback, with a warning logged.
+func PinDefaultsForPlatform(platform string) PlatformPinDefaults {
+	if defaults, ok := platformPinDefaults[strings.ToLower(strings.TrimSpace(platform))]; ok {
+		return defaults
+	}
+	log.Printf("WARNING: no pin defaults for platform %q; assuming %s and pins %s-%s", platform,
+		PinLabel(fallbackPinDefaults.DefaultPin), fallbackPinDefaults.PinLabels[0],
+		fallbackPinDefaults.PinLabels[len(fallbackPinDefaults.PinLabels)-1])
+	return fallbackPinDefaults
+}
+
+// PinDefaults returns the pin defaults for the device's platform
+func (d Device) PinDefaults() PlatformPinDefaults {
+	return PinDefaultsForPlatform(d.Platform)
+}
+
+// DefaultStrips is the strip assumed on a device with none configured: 8
+// LEDs on the platform's default pin
+func (p PlatformPinDefaults) DefaultStrips() []LEDStrip {
+	return []LEDStrip{{Pin: p.DefaultPin, LEDCount: 8}}
+}
+
+// SupportsPin reports whether a strip may be configured on pin
+func (p PlatformPinDefaults) SupportsPin(pin int) bool {
+	for _, supported := range p.SupportedPins {
+		if supported == pin {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateStripPins checks strips only use pins the device's platform
+// supports, and no more of them than it can drive. Strips with a
+// CustomPinMapping entry are on the physical pin the mapping names, so
+// aren't checked against the platform's pins.
+func ValidateStripPins(device Device, strips []LEDStrip) error {
+	defaults := device.PinDefaults()
+	if len(strips) > defaults.MaxPins {
+		return fmt.Errorf("%d strips configured; %s supports at most %d", len(strips), platformLabel(defaults), defaults.MaxPins)
+	}
+	for _, strip := range strips {
+		if _, mapped := device.CustomPinMapping[StripLogicalName(strip.Pin)]; mapped {
+			continue
+		}
+		if !defaults.SupportsPin(strip.Pin) {
+			return fmt.Errorf("pin %s isn't supported on %s; use one of %s",
+				PinLabel(strip.Pin), platformLabel(defaults), strings.Join(defaults.PinLabels, ", "))
+		}
+	}
+	return nil
+}
+
+// platformLabel names a platform in messages
+func platformLabel(p PlatformPinDefaults) string {
+	if p.Platform == "" {
+		return "this device"
+	}
+	return p.Platform
+}
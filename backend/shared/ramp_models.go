@@ -0,0 +1,200 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+var rampsTable = os.Getenv("RAMPS_TABLE")
+
+// Ramp statuses
+const (
+	RampStatusActive    = "active"    // Steps still pending
+	RampStatusCompleted = "completed" // Target brightness reached
+	RampStatusCancelled = "cancelled" // Stopped by the user, a new ramp, or another brightness command
+)
+
+// Ramp history events
+const (
+	RampEventStarted   = "started"
+	RampEventCancelled = "cancelled"
+	RampEventCompleted = "completed"
+)
+
+// Ramp limits. Steps are spread evenly over the duration but never closer
+// than MinRampStepSeconds, and never more than MaxRampSteps setBright calls.
+const (
+	MaxRampSeconds     = 3600
+	MaxRampSteps       = 20
+	MinRampStepSeconds = 5
+)
+
+// rampRetention is how long finished ramps are kept before TTL deletes them
+const rampRetention = 24 * time.Hour
+
+// RampEvent is one entry in a ramp's history
+type RampEvent struct {
+	Event  string    `json:"event" dynamodbav:"event"`
+	At     time.Time `json:"at" dynamodbav:"at"`
+	Detail string    `json:"detail,omitempty" dynamodbav:"detail,omitempty"`
+}
+
+// Ramp gradually changes the brightness of one strip or a group's strips
+type Ramp struct {
+	RampID          string               `json:"rampId" dynamodbav:"rampId"`
+	UserID          string               `json:"userId" dynamodbav:"userId"`
+	GroupID         string               `json:"groupId,omitempty" dynamodbav:"groupId,omitempty"`
+	Targets         []VirtualGroupMember `json:"targets" dynamodbav:"targets"`
+	FromPercent     int                  `json:"fromBrightnessPercent" dynamodbav:"fromPercent"`     // BrightnessPercent, 0-100
+	TargetPercent   int                  `json:"targetBrightnessPercent" dynamodbav:"targetPercent"` // BrightnessPercent, 0-100
+	DurationSeconds int                  `json:"durationSeconds" dynamodbav:"durationSeconds"`
+	Steps           int                  `json:"steps" dynamodbav:"steps"`
+	StepSeconds     int                  `json:"stepSeconds" dynamodbav:"stepSeconds"`
+	CurrentStep     int                  `json:"currentStep" dynamodbav:"currentStep"` // 0 = start level applied
+	Status          string               `json:"status" dynamodbav:"status"`
+	History         []RampEvent          `json:"history" dynamodbav:"history"`
+	StartedAt       time.Time            `json:"startedAt" dynamodbav:"startedAt"`
+	ETA             time.Time            `json:"eta" dynamodbav:"eta"` // When the final step is due
+	UpdatedAt       time.Time            `json:"updatedAt" dynamodbav:"updatedAt"`
+	ExpiresAt       int64                `json:"expiresAt,omitempty" dynamodbav:"expiresAt,omitempty"` // TTL
+}
+
+// RampStripPointer records which ramp currently owns a strip's brightness.
+// It lives in the ramps table under a "strip#" key; a newer ramp overwrites it
+// and other brightness commands delete it.
+type RampStripPointer struct {
+	RampID       string `json:"rampId" dynamodbav:"rampId"` // Key from RampStripKey
+	ActiveRampID string `json:"activeRampId" dynamodbav:"activeRampId"`
+	ExpiresAt    int64  `json:"expiresAt" dynamodbav:"expiresAt"` // TTL
+}
+
+// RampStripKey is the ramps table key of the pointer for a strip
+func RampStripKey(deviceID string, pin int) string {
+	return fmt.Sprintf("strip#%s#%d", deviceID, pin)
+}
+
+// PlanRampSteps splits a duration into evenly spaced steps within the limits
+func PlanRampSteps(durationSeconds int) (steps, stepSeconds int) {
+	steps = durationSeconds / MinRampStepSeconds
+	if steps > MaxRampSteps {
+		steps = MaxRampSteps
+	}
+	if steps < 1 {
+		steps = 1
+	}
+	return steps, durationSeconds / steps
+}
+
+// BrightnessAtStep is the brightness percent a ramp sets at step (0..Steps)
+func (r Ramp) BrightnessAtStep(step int) int {
+	if step >= r.Steps || r.Steps == 0 {
+		return r.TargetPercent
+	}
+	return r.FromPercent + (r.TargetPercent-r.FromPercent)*step/r.Steps
+}
+
+// RampExpiresAt is the TTL for a ramp due to finish at eta
+func RampExpiresAt(eta time.Time) int64 {
+	return eta.Add(rampRetention).Unix()
+}
+
+// CancelStripRamp stops any ramp running on a strip, recording reason in the
+// ramp's history. Call it before sending a brightness command so the ramp's
+// next step doesn't override it. A no-op when ramps aren't configured.
+func CancelStripRamp(ctx context.Context, deviceID string, pin int, reason string) error {
+	if rampsTable == "" {
+		return nil
+	}
+
+	client, err := InitDynamoDB()
+	if err != nil {
+		return err
+	}
+
+	output, err := client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(rampsTable),
+		Key: map[string]types.AttributeValue{
+			"rampId": &types.AttributeValueMemberS{Value: RampStripKey(deviceID, pin)},
+		},
+		ReturnValues: types.ReturnValueAllOld,
+	})
+	if err != nil {
+		return err
+	}
+	if len(output.Attributes) == 0 {
+		return nil
+	}
+
+	var pointer RampStripPointer
+	if err := attributevalue.UnmarshalMap(output.Attributes, &pointer); err != nil {
+		return err
+	}
+
+	_, err = FinishRamp(ctx, pointer.ActiveRampID, RampStatusCancelled, RampEventCancelled, reason)
+	if errors.Is(err, ErrRampNotActive) {
+		return nil
+	}
+	if err == nil {
+		log.Printf("Cancelled ramp %s on device %s pin %d: %s", pointer.ActiveRampID, deviceID, pin, reason)
+	}
+	return err
+}
+
+// ErrRampNotActive means a ramp already completed or was cancelled
+var ErrRampNotActive = errors.New("ramp is no longer active")
+
+// FinishRamp moves an active ramp to status and appends a history event. Only
+// one caller can finish a ramp; the others get ErrRampNotActive.
+func FinishRamp(ctx context.Context, rampID, status, event, detail string) (*Ramp, error) {
+	client, err := InitDynamoDB()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	entry, err := attributevalue.Marshal([]RampEvent{{Event: event, At: now, Detail: detail}})
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(rampsTable),
+		Key: map[string]types.AttributeValue{
+			"rampId": &types.AttributeValueMemberS{Value: rampID},
+		},
+		UpdateExpression:    aws.String("SET #status = :status, updatedAt = :now, history = list_append(history, :event)"),
+		ConditionExpression: aws.String("#status = :active"),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "status",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":status": &types.AttributeValueMemberS{Value: status},
+			":active": &types.AttributeValueMemberS{Value: RampStatusActive},
+			":now":    &types.AttributeValueMemberS{Value: now.Format(time.RFC3339Nano)},
+			":event":  entry,
+		},
+		ReturnValues: types.ReturnValueAllNew,
+	})
+	if err != nil {
+		var conflict *types.ConditionalCheckFailedException
+		if errors.As(err, &conflict) {
+			return nil, ErrRampNotActive
+		}
+		return nil, err
+	}
+
+	var ramp Ramp
+	if err := attributevalue.UnmarshalMap(output.Attributes, &ramp); err != nil {
+		return nil, err
+	}
+	return &ramp, nil
+}
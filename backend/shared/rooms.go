@@ -0,0 +1,83 @@
+package shared
+
+import (
+	"sort"
+	"strings"
+)
+
+// UnassignedRoom is how devices without a room are listed and filtered
+const UnassignedRoom = "Unassigned"
+
+// MaxRoomNameLength bounds room names
+const MaxRoomNameLength = 50
+
+// RoomSummary is a room with its device and strip counts
+type RoomSummary struct {
+	Name        string `json:"name"`
+	DeviceCount int    `json:"deviceCount"`
+	StripCount  int    `json:"stripCount"`
+}
+
+// NormalizeRoom trims a room name and maps "Unassigned" (any case) to "",
+// the stored form of no room
+func NormalizeRoom(room string) string {
+	room = strings.TrimSpace(room)
+	if strings.EqualFold(room, UnassignedRoom) {
+		return ""
+	}
+	return room
+}
+
+// DeviceRoom returns the room a device is listed under
+func DeviceRoom(device Device) string {
+	if device.Room == "" {
+		return UnassignedRoom
+	}
+	return device.Room
+}
+
+// InRoom reports whether a device is in room, compared case-insensitively.
+// "Unassigned" matches devices with no room.
+func InRoom(device Device, room string) bool {
+	return strings.EqualFold(device.Room, NormalizeRoom(room))
+}
+
+// FilterDevicesByRoom returns the devices in room
+func FilterDevicesByRoom(devices []Device, room string) []Device {
+	filtered := make([]Device, 0, len(devices))
+	for _, d := range devices {
+		if InRoom(d, room) {
+			filtered = append(filtered, d)
+		}
+	}
+	return filtered
+}
+
+// SummarizeRooms counts devices and strips per room, sorted by name with
+// Unassigned last
+func SummarizeRooms(devices []Device) []RoomSummary {
+	byName := map[string]*RoomSummary{}
+	for _, d := range devices {
+		name := DeviceRoom(d)
+		key := strings.ToLower(name)
+		summary, ok := byName[key]
+		if !ok {
+			summary = &RoomSummary{Name: name}
+			byName[key] = summary
+		}
+		summary.DeviceCount++
+		summary.StripCount += len(d.LEDStrips)
+	}
+
+	rooms := make([]RoomSummary, 0, len(byName))
+	for _, summary := range byName {
+		rooms = append(rooms, *summary)
+	}
+	sort.Slice(rooms, func(i, j int) bool {
+		if (rooms[i].Name == UnassignedRoom) != (rooms[j].Name == UnassignedRoom) {
+			return rooms[j].Name == UnassignedRoom
+		}
+		return strings.ToLower(rooms[i].Name) < strings.ToLower(rooms[j].Name)
+	})
+	return rooms
+}
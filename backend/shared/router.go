@@ -0,0 +1,277 @@
+package shared
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+)
+
+// AuthPolicy declares who is allowed to call a route
+type AuthPolicy int
+
+const (
+	PolicyUnset         AuthPolicy = iota // Zero value - rejected at registration
+	PolicyPublic                          // No authentication
+	PolicyAuthenticated                   // Valid session required
+	PolicyAdmin                           // Valid session for a user with IsAdmin set
+	PolicyWebhookSigned                   // HMAC-SHA256 body signature required
+)
+
+// WebhookSignatureHeader carries "sha256=<hex hmac of body>" for webhook-signed routes
+const WebhookSignatureHeader = "X-Signature-256"
+
+// String returns the policy name for logging
+func (p AuthPolicy) String() string {
+	switch p {
+	case PolicyPublic:
+		return "public"
+	case PolicyAuthenticated:
+		return "authenticated"
+	case PolicyAdmin:
+		return "admin"
+	case PolicyWebhookSigned:
+		return "webhook-signed"
+	default:
+		return "unset"
+	}
+}
+
+// RequestContext is passed to route handlers after the route's policy has been enforced.
+// Username is empty for public and webhook-signed routes.
+type RequestContext struct {
+	Ctx      context.Context
+	Request  events.APIGatewayProxyRequest
+	Username string
+}
+
+// RouteHandler handles a request that has already passed its auth policy
+type RouteHandler func(rc *RequestContext) (events.APIGatewayProxyResponse, error)
+
+// RouteMatcher reports whether a request belongs to a route
+type RouteMatcher func(request events.APIGatewayProxyRequest) bool
+
+type route struct {
+	method  string
+	match   RouteMatcher
+	policy  AuthPolicy
+	handler RouteHandler
+	doc     *RouteDoc
+}
+
+// Router dispatches API Gateway requests to handlers, enforcing each route's auth policy
+type Router struct {
+	name          string
+	routes        []route
+	webhookSecret string
+	usersTable    string
+	requireDocs   bool
+}
+
+// NewRouter creates a router; name is used in log lines
+func NewRouter(name string) *Router {
+	return &Router{
+		name:          name,
+		webhookSecret: os.Getenv("WEBHOOK_SECRET"),
+		usersTable:    os.Getenv("USERS_TABLE"),
+	}
+}
+
+// RequireDocs makes Handle reject routes without a RouteDoc, so the router's
+// routes can't be left out of the OpenAPI spec
+func (r *Router) RequireDocs() {
+	r.requireDocs = true
+}
+
+// Handle registers a route. Every route must declare a policy explicitly so
+// unauthenticated endpoints can't be added by accident.
+func (r *Router) Handle(method string, match RouteMatcher, policy AuthPolicy, handler RouteHandler) error {
+	if r.requireDocs {
+		return fmt.Errorf("route %s registered without a RouteDoc", method)
+	}
+	return r.handle(method, match, policy, handler, nil)
+}
+
+// HandleDoc registers a route described by doc, taking the method and policy
+// from it
+func (r *Router) HandleDoc(doc RouteDoc, match RouteMatcher, handler RouteHandler) error {
+	if doc.Path == "" {
+		return fmt.Errorf("route %s documented without a path", doc.Method)
+	}
+	return r.handle(doc.Method, match, doc.Policy, handler, &doc)
+}
+
+func (r *Router) handle(method string, match RouteMatcher, policy AuthPolicy, handler RouteHandler, doc *RouteDoc) error {
+	if policy <= PolicyUnset || policy > PolicyWebhookSigned {
+		return fmt.Errorf("route %s registered without an auth policy", method)
+	}
+	if match == nil || handler == nil {
+		return fmt.Errorf("route %s requires a matcher and a handler", method)
+	}
+	r.routes = append(r.routes, route{method: method, match: match, policy: policy, handler: handler, doc: doc})
+	return nil
+}
+
+// MustHandle registers a route and panics if registration fails, so a
+// misconfigured Lambda fails at cold start instead of serving the route
+func (r *Router) MustHandle(method string, match RouteMatcher, policy AuthPolicy, handler RouteHandler) {
+	if err := r.Handle(method, match, policy, handler); err != nil {
+		panic(err)
+	}
+}
+
+// MustHandleDoc is HandleDoc, panicking if registration fails
+func (r *Router) MustHandleDoc(doc RouteDoc, match RouteMatcher, handler RouteHandler) {
+	if err := r.HandleDoc(doc, match, handler); err != nil {
+		panic(err)
+	}
+}
+
+// Docs returns the RouteDoc of every documented route, in registration order
+func (r *Router) Docs() []RouteDoc {
+	var docs []RouteDoc
+	for _, rt := range r.routes {
+		if rt.doc != nil {
+			docs = append(docs, *rt.doc)
+		}
+	}
+	return docs
+}
+
+// Dispatch finds the first matching route, enforces its policy, and calls its handler
+func (r *Router) Dispatch(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	for _, rt := range r.routes {
+		if rt.method != request.HTTPMethod || !rt.match(request) {
+			continue
+		}
+
+		rc := &RequestContext{Ctx: ctx, Request: request}
+
+		switch rt.policy {
+		case PolicyPublic:
+			// Nothing to check
+		case PolicyAuthenticated, PolicyAdmin:
+			username, err := ValidateAuth(ctx, request)
+			if err != nil || username == "" {
+				log.Printf("[%s] Authentication failed: err=%v", r.name, err)
+				return AuthErrorResponse(err), nil
+			}
+			if rt.policy == PolicyAdmin {
+				if _, errResp := RequireAdmin(ctx, r.usersTable, username); errResp != nil {
+					return *errResp, nil
+				}
+			}
+			rc.Username = username
+		case PolicyWebhookSigned:
+			if !r.verifyWebhookSignature(request) {
+				log.Printf("[%s] Webhook signature verification failed", r.name)
+				return CreateErrorResponse(401, "Invalid signature"), nil
+			}
+		default:
+			// Unreachable - Handle rejects unset policies - but fail closed anyway
+			return CreateErrorResponse(500, "Route has no auth policy"), nil
+		}
+
+		log.Printf("[%s] %s %s (policy=%s, user=%s)", r.name, request.HTTPMethod, request.Path, rt.policy, rc.Username)
+		return rt.handler(rc)
+	}
+
+	log.Printf("[%s] No matching route for path: %s, method: %s", r.name, request.Path, request.HTTPMethod)
+	return CreateErrorResponse(404, "Not found"), nil
+}
+
+// RequireAdmin loads username's record from usersTable and returns it if
+// they are an admin. Otherwise it returns the response to send: 500 if the
+// lookup fails, 403 if they aren't an admin. PolicyAdmin routes get this
+// check from Dispatch; handlers outside a Router call it directly.
+func RequireAdmin(ctx context.Context, usersTable, username string) (*User, *events.APIGatewayProxyResponse) {
+	key, _ := attributevalue.MarshalMap(map[string]string{
+		"username": username,
+	})
+
+	var user User
+	if err := GetItem(ctx, usersTable, key, &user); err != nil {
+		log.Printf("Admin lookup failed for %s: %v", username, err)
+		resp := CreateErrorResponse(500, "Database error")
+		return nil, &resp
+	}
+	if !user.IsAdmin {
+		log.Printf("User %s is not an admin", username)
+		resp := CreateErrorResponse(403, "Access denied")
+		return nil, &resp
+	}
+	return &user, nil
+}
+
+func (r *Router) verifyWebhookSignature(request events.APIGatewayProxyRequest) bool {
+	if r.webhookSecret == "" {
+		return false
+	}
+
+	signature := request.Headers[WebhookSignatureHeader]
+	if signature == "" {
+		signature = request.Headers[strings.ToLower(WebhookSignatureHeader)]
+	}
+	signature = strings.TrimPrefix(signature, "sha256=")
+
+	expected, err := hex.DecodeString(signature)
+	if err != nil || len(expected) == 0 {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(r.webhookSecret))
+	mac.Write([]byte(GetRequestBody(request)))
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+// PathEquals matches requests for an exact path
+func PathEquals(path string) RouteMatcher {
+	return func(request events.APIGatewayProxyRequest) bool {
+		return request.Path == path
+	}
+}
+
+// PathSuffix matches requests whose path ends with suffix
+func PathSuffix(suffix string) RouteMatcher {
+	return func(request events.APIGatewayProxyRequest) bool {
+		return strings.HasSuffix(request.Path, suffix)
+	}
+}
+
+// PathPrefix matches requests whose path starts with prefix
+func PathPrefix(prefix string) RouteMatcher {
+	return func(request events.APIGatewayProxyRequest) bool {
+		return strings.HasPrefix(request.Path, prefix)
+	}
+}
+
+// HasPathParams matches requests that carry all the named path parameters
+func HasPathParams(names ...string) RouteMatcher {
+	return func(request events.APIGatewayProxyRequest) bool {
+		for _, name := range names {
+			if request.PathParameters[name] == "" {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// MatchAll matches requests accepted by every matcher
+func MatchAll(matchers ...RouteMatcher) RouteMatcher {
+	return func(request events.APIGatewayProxyRequest) bool {
+		for _, m := range matchers {
+			if !m(request) {
+				return false
+			}
+		}
+		return true
+	}
+}
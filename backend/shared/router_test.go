@@ -0,0 +1,85 @@
+package shared
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func okHandler(rc *RequestContext) (events.APIGatewayProxyResponse, error) {
+	return CreateSuccessResponse(200, nil), nil
+}
+
+func TestRouterHandleRejectsMissingPolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy AuthPolicy
+	}{
+		{"unset", PolicyUnset},
+		{"zero value", AuthPolicy(0)},
+		{"out of range", PolicyWebhookSigned + 1},
+	}
+
+	for _, tt := range tests {
+		r := NewRouter("test")
+		if err := r.Handle("GET", PathEquals("/x"), tt.policy, okHandler); err == nil {
+			t.Errorf("%s: Handle accepted a route without an auth policy", tt.name)
+		}
+		if len(r.routes) != 0 {
+			t.Errorf("%s: rejected route was still registered", tt.name)
+		}
+	}
+}
+
+func TestRouterHandleRejectsMissingHandler(t *testing.T) {
+	r := NewRouter("test")
+	if err := r.Handle("GET", PathEquals("/x"), PolicyPublic, nil); err == nil {
+		t.Error("Handle accepted a route without a handler")
+	}
+	if err := r.Handle("GET", nil, PolicyPublic, okHandler); err == nil {
+		t.Error("Handle accepted a route without a matcher")
+	}
+}
+
+func TestRouterDispatchRejectsUnauthenticated(t *testing.T) {
+	tests := []struct {
+		policy     AuthPolicy
+		wantStatus int
+	}{
+		{PolicyAuthenticated, 401},
+		{PolicyAdmin, 401},
+		{PolicyWebhookSigned, 401},
+		{PolicyPublic, 200},
+	}
+
+	for _, tt := range tests {
+		called := false
+		r := NewRouter("test")
+		r.MustHandle("GET", PathEquals("/x"), tt.policy, func(rc *RequestContext) (events.APIGatewayProxyResponse, error) {
+			called = true
+			return okHandler(rc)
+		})
+
+		resp, err := r.Dispatch(context.Background(), events.APIGatewayProxyRequest{HTTPMethod: "GET", Path: "/x"})
+		if err != nil {
+			t.Fatalf("%s: Dispatch error: %v", tt.policy, err)
+		}
+		if resp.StatusCode != tt.wantStatus {
+			t.Errorf("%s: status = %d, want %d", tt.policy, resp.StatusCode, tt.wantStatus)
+		}
+		if wantCalled := tt.wantStatus == 200; called != wantCalled {
+			t.Errorf("%s: handler called = %v, want %v", tt.policy, called, wantCalled)
+		}
+	}
+}
+
+func TestRouterDispatchNotFound(t *testing.T) {
+	r := NewRouter("test")
+	r.MustHandle("GET", PathEquals("/x"), PolicyPublic, okHandler)
+
+	resp, _ := r.Dispatch(context.Background(), events.APIGatewayProxyRequest{HTTPMethod: "POST", Path: "/x"})
+	if resp.StatusCode != 404 {
+		t.Errorf("status = %d, want 404", resp.StatusCode)
+	}
+}
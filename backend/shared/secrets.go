@@ -0,0 +1,108 @@
+package shared
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+)
+
+// secretsKeyARN is the KMS key that encrypts secrets stored in DynamoDB,
+// such as Particle tokens
+var secretsKeyARN = os.Getenv("SECRETS_KMS_KEY_ARN")
+
+// encryptedSecretPrefix marks a stored value as KMS ciphertext (base64
+// after the prefix), so values saved before encryption can be told apart
+const encryptedSecretPrefix = "kms:v1:"
+
+var (
+	// ErrSecretsNotConfigured is returned by EncryptSecret when SECRETS_KMS_KEY_ARN is missing
+	ErrSecretsNotConfigured = errors.New("secret encryption is not configured")
+	// ErrSecretNotEncrypted is returned by DecryptSecret for a value stored as plaintext
+	ErrSecretNotEncrypted = errors.New("secret is not encrypted")
+)
+
+// KMSAPI is the part of the KMS client that secrets use, so a stub can
+// stand in for KMS
+type KMSAPI interface {
+	Encrypt(ctx context.Context, params *kms.EncryptInput, optFns ...func(*kms.Options)) (*kms.EncryptOutput, error)
+	Decrypt(ctx context.Context, params *kms.DecryptInput, optFns ...func(*kms.Options)) (*kms.DecryptOutput, error)
+}
+
+var kmsClient KMSAPI
+
+// InitKMS initializes the KMS client
+func InitKMS(ctx context.Context) (KMSAPI, error) {
+	if kmsClient != nil {
+		return kmsClient, nil
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	kmsClient = kms.NewFromConfig(cfg)
+	return kmsClient, nil
+}
+
+// SetKMSClient replaces the KMS client, for stubbing KMS
+func SetKMSClient(client KMSAPI) {
+	kmsClient = client
+}
+
+// IsEncryptedSecret reports whether stored came from EncryptSecret
+func IsEncryptedSecret(stored string) bool {
+	return strings.HasPrefix(stored, encryptedSecretPrefix)
+}
+
+// EncryptSecret encrypts plaintext with the SECRETS_KMS_KEY_ARN key into a
+// value for storing. DecryptSecret reverses it.
+func EncryptSecret(ctx context.Context, plaintext string) (string, error) {
+	if secretsKeyARN == "" {
+		return "", ErrSecretsNotConfigured
+	}
+
+	client, err := InitKMS(ctx)
+	if err != nil {
+		return "", err
+	}
+	out, err := client.Encrypt(ctx, &kms.EncryptInput{
+		KeyId:     aws.String(secretsKeyARN),
+		Plaintext: []byte(plaintext),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to encrypt secret: %w", err)
+	}
+	return encryptedSecretPrefix + base64.StdEncoding.EncodeToString(out.CiphertextBlob), nil
+}
+
+// DecryptSecret decrypts a value from EncryptSecret. A value that was never
+// encrypted fails with ErrSecretNotEncrypted; any other failure means the
+// ciphertext couldn't be decrypted, and the value mustn't be used as is.
+func DecryptSecret(ctx context.Context, stored string) (string, error) {
+	if !IsEncryptedSecret(stored) {
+		return "", ErrSecretNotEncrypted
+	}
+	blob, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(stored, encryptedSecretPrefix))
+	if err != nil {
+		return "", fmt.Errorf("failed to decode secret: %w", err)
+	}
+
+	client, err := InitKMS(ctx)
+	if err != nil {
+		return "", err
+	}
+	// The ciphertext names its key, so keys can be rotated without
+	// re-encrypting what's stored
+	out, err := client.Decrypt(ctx, &kms.DecryptInput{CiphertextBlob: blob})
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt secret: %w", err)
+	}
+	return string(out.Plaintext), nil
+}
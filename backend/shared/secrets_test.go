@@ -0,0 +1,146 @@
+package shared
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+)
+
+// stubKMS "encrypts" by flipping every byte, so ciphertext never contains
+// the plaintext
+type stubKMS struct {
+	mu       sync.Mutex
+	encrypts int
+}
+
+func (k *stubKMS) Encrypt(ctx context.Context, params *kms.EncryptInput, optFns ...func(*kms.Options)) (*kms.EncryptOutput, error) {
+	k.mu.Lock()
+	k.encrypts++
+	k.mu.Unlock()
+	if params.KeyId == nil || *params.KeyId != secretsKeyARN {
+		return nil, errors.New("wrong key")
+	}
+	return &kms.EncryptOutput{CiphertextBlob: flipBytes(params.Plaintext)}, nil
+}
+
+func (k *stubKMS) Decrypt(ctx context.Context, params *kms.DecryptInput, optFns ...func(*kms.Options)) (*kms.DecryptOutput, error) {
+	return &kms.DecryptOutput{Plaintext: flipBytes(params.CiphertextBlob)}, nil
+}
+
+func flipBytes(b []byte) []byte {
+	out := make([]byte, len(b))
+	for i, c := range b {
+		out[i] = ^c
+	}
+	return out
+}
+
+func withStubKMS(t *testing.T) *stubKMS {
+	stub := &stubKMS{}
+	previousKey, previousClient := secretsKeyARN, kmsClient
+	secretsKeyARN = "arn:aws:kms:us-east-1:111122223333:key/test"
+	SetKMSClient(stub)
+	t.Cleanup(func() {
+		secretsKeyARN = previousKey
+		SetKMSClient(previousClient)
+	})
+	return stub
+}
+
+func TestSaveParticleTokenNeverStoresPlaintext(t *testing.T) {
+	withStubKMS(t)
+	const token = "particle-plaintext-token"
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"expires_at":"2030-01-01T00:00:00Z","scopes":[]}`))
+	}))
+	defer server.Close()
+	saved := particleAPIBase
+	particleAPIBase = server.URL
+	defer func() { particleAPIBase = saved }()
+
+	var puts [][]byte
+	defer StubDynamoDB(func(call DynamoDBStubCall) (map[string]interface{}, error) {
+		if call.Operation != "PutItem" {
+			return nil, errors.New("unexpected " + call.Operation)
+		}
+		puts = append(puts, call.Input["Item"])
+		return nil, nil
+	})()
+
+	user := User{Username: "lee", IsActive: true}
+	if err := SaveParticleToken(context.Background(), "users", &user, token); err != nil {
+		t.Fatalf("SaveParticleToken: %v", err)
+	}
+	if len(puts) != 1 {
+		t.Fatalf("%d PutItem calls, want 1", len(puts))
+	}
+	if bytes.Contains(puts[0], []byte(token)) {
+		t.Errorf("PutItem carried the plaintext token: %s", puts[0])
+	}
+	if !IsEncryptedSecret(user.ParticleToken) || user.ParticleTokenExpiresAt == nil {
+		t.Errorf("saved user = %+v, want an encrypted token with its expiry", user)
+	}
+
+	if err := DecryptParticleToken(context.Background(), "users", &user); err != nil || user.ParticleToken != token {
+		t.Errorf("DecryptParticleToken = %q, %v; want the original token", user.ParticleToken, err)
+	}
+}
+
+func TestDecryptParticleTokenMigratesPlaintext(t *testing.T) {
+	stub := withStubKMS(t)
+	const token = "particle-legacy-token"
+
+	var updates []DynamoDBStubCall
+	defer StubDynamoDB(func(call DynamoDBStubCall) (map[string]interface{}, error) {
+		if call.Operation != "UpdateItem" {
+			return nil, errors.New("unexpected " + call.Operation)
+		}
+		updates = append(updates, call)
+		return nil, nil
+	})()
+
+	user := User{Username: "lee", ParticleToken: token}
+	if err := DecryptParticleToken(context.Background(), "users", &user); err != nil || user.ParticleToken != token {
+		t.Fatalf("DecryptParticleToken = %q, %v; want the plaintext token as is", user.ParticleToken, err)
+	}
+	if len(updates) != 1 {
+		t.Fatalf("%d UpdateItem calls, want 1 re-saving the token encrypted", len(updates))
+	}
+
+	update := updates[0]
+	if got := update.String("ConditionExpression"); got != "particleToken = :old" {
+		t.Errorf("condition = %q, want the token unchanged since it was read", got)
+	}
+	attrs, err := update.Attributes("ExpressionAttributeValues")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var values struct {
+		New string `dynamodbav:":new"`
+		Old string `dynamodbav:":old"`
+	}
+	if err := attributevalue.UnmarshalMap(attrs, &values); err != nil {
+		t.Fatal(err)
+	}
+	if !IsEncryptedSecret(values.New) || strings.Contains(values.New, token) || values.Old != token {
+		t.Errorf("update sets %q where %q, want the token encrypted", values.New, values.Old)
+	}
+
+	// The migrated value decrypts without another migration
+	migrated := User{Username: "lee", ParticleToken: values.New}
+	if err := DecryptParticleToken(context.Background(), "users", &migrated); err != nil || migrated.ParticleToken != token {
+		t.Errorf("decrypting the migrated token = %q, %v; want the original token", migrated.ParticleToken, err)
+	}
+	if len(updates) != 1 || stub.encrypts != 1 {
+		t.Errorf("an encrypted token was migrated again (%d updates, %d encrypts)", len(updates), stub.encrypts)
+	}
+}
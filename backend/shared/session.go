@@ -4,10 +4,15 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/base64"
+	"errors"
 	"log"
 	"os"
+	"strconv"
+	"sync"
 	"time"
 
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
@@ -15,6 +20,35 @@ import (
 
 var sessionsTable = os.Getenv("SESSIONS_TABLE")
 
+// Session lifetimes. SessionDuration applies by default; RememberMeSessionDuration
+// when the user asked to be remembered at login.
+const (
+	SessionDuration           = 24 * time.Hour
+	RememberMeSessionDuration = 30 * 24 * time.Hour
+)
+
+// A session is rotated once it is past SessionRotationPoint of its lifetime.
+// The old ID keeps working for SessionRotationGrace so requests already in
+// flight with it don't fail.
+const (
+	SessionRotationPoint = 0.75
+	SessionRotationGrace = time.Minute
+)
+
+// Response headers carrying a rotated session to the caller, which should
+// replace its stored session ID (the frontend copies them into the cookie)
+const (
+	SessionTokenHeader     = "X-Session-Token"
+	SessionExpiresAtHeader = "X-Session-Expires-At" // Unix seconds
+)
+
+// SessionCookieName is the session cookie over plain HTTP; SecureSessionCookieName
+// is used over HTTPS, where the __Host- prefix pins it to this host and Secure
+const (
+	SessionCookieName       = "session_id"
+	SecureSessionCookieName = "__Host-session_id"
+)
+
 // Session represents a user session
 type Session struct {
 	SessionID string    `json:"sessionId" dynamodbav:"sessionId"`
@@ -23,10 +57,37 @@ type Session struct {
 	ExpiresAt int64     `json:"expiresAt" dynamodbav:"expiresAt"` // Unix timestamp for TTL
 	UserAgent string    `json:"userAgent,omitempty" dynamodbav:"userAgent,omitempty"`
 	IPAddress string    `json:"ipAddress,omitempty" dynamodbav:"ipAddress,omitempty"`
+
+	RememberMe bool   `json:"rememberMe,omitempty" dynamodbav:"rememberMe,omitempty"`
+	RotatedTo  string `json:"-" dynamodbav:"rotatedTo,omitempty"` // Successor session ID once rotated
+
+	// Set on sessions an admin uses to act as Username (see CreateImpersonationSession)
+	Impersonation  bool   `json:"impersonation,omitempty" dynamodbav:"impersonation,omitempty"`
+	ImpersonatedBy string `json:"impersonatedBy,omitempty" dynamodbav:"impersonatedBy,omitempty"`
 }
 
-// CreateSession creates a new session for a user
-func CreateSession(ctx context.Context, username, userAgent, ipAddress string) (*Session, error) {
+// Lifetime is how long the session lasts from when it is issued
+func (s Session) Lifetime() time.Duration {
+	if s.RememberMe {
+		return RememberMeSessionDuration
+	}
+	return SessionDuration
+}
+
+// NeedsRotation reports whether the session is past SessionRotationPoint of
+// its lifetime and hasn't been rotated yet. Impersonation sessions are never
+// rotated; they end with the support access grant.
+func (s Session) NeedsRotation(now time.Time) bool {
+	if s.RotatedTo != "" || s.Impersonation {
+		return false
+	}
+	remaining := time.Unix(s.ExpiresAt, 0).Sub(now)
+	return remaining < time.Duration(float64(s.Lifetime())*(1-SessionRotationPoint))
+}
+
+// CreateSession creates a new session for a user, lasting
+// RememberMeSessionDuration if rememberMe is set and SessionDuration otherwise
+func CreateSession(ctx context.Context, username, userAgent, ipAddress string, rememberMe bool) (*Session, error) {
 	sessionID, err := generateSessionID()
 	if err != nil {
 		log.Printf("CreateSession: Failed to generate session ID: %v", err)
@@ -34,13 +95,14 @@ func CreateSession(ctx context.Context, username, userAgent, ipAddress string) (
 	}
 
 	session := &Session{
-		SessionID: sessionID,
-		Username:  username,
-		CreatedAt: time.Now(),
-		ExpiresAt: time.Now().Add(24 * time.Hour).Unix(), // 24 hour expiration
-		UserAgent: userAgent,
-		IPAddress: ipAddress,
+		SessionID:  sessionID,
+		Username:   username,
+		CreatedAt:  time.Now(),
+		UserAgent:  userAgent,
+		IPAddress:  ipAddress,
+		RememberMe: rememberMe,
 	}
+	session.ExpiresAt = session.CreatedAt.Add(session.Lifetime()).Unix()
 
 	log.Printf("CreateSession: Creating session for user %s, sessionID: %s (first 10 chars)", username, safeDisplay(sessionID, 10))
 
@@ -86,6 +148,184 @@ func GetSession(ctx context.Context, sessionID string) (*Session, error) {
 	return &session, nil
 }
 
+// RefreshSession replaces a valid session with a new one lasting its full
+// lifetime from now (see RotateSession). Refreshing an already rotated session
+// refreshes its successor. Returns nil if the session doesn't exist or has
+// already expired.
+func RefreshSession(ctx context.Context, sessionID string) (*Session, error) {
+	session, err := GetSession(ctx, sessionID)
+	if err != nil || session == nil {
+		return nil, err
+	}
+
+	if session.RotatedTo != "" {
+		return RefreshSession(ctx, session.RotatedTo)
+	}
+
+	return RotateSession(ctx, session)
+}
+
+// RotateSession issues a successor to session with a new ID and a full
+// lifetime, and cuts the old session down to SessionRotationGrace. When
+// several requests rotate the same session at once only one successor is
+// kept; the others are discarded and every caller gets the winner.
+func RotateSession(ctx context.Context, session *Session) (*Session, error) {
+	sessionID, err := generateSessionID()
+	if err != nil {
+		log.Printf("RotateSession: Failed to generate session ID: %v", err)
+		return nil, err
+	}
+
+	now := time.Now()
+	successor := &Session{
+		SessionID:  sessionID,
+		Username:   session.Username,
+		CreatedAt:  now,
+		ExpiresAt:  now.Add(session.Lifetime()).Unix(),
+		UserAgent:  session.UserAgent,
+		IPAddress:  session.IPAddress,
+		RememberMe: session.RememberMe,
+
+		Impersonation:  session.Impersonation,
+		ImpersonatedBy: session.ImpersonatedBy,
+	}
+	if session.Impersonation && successor.ExpiresAt > session.ExpiresAt {
+		successor.ExpiresAt = session.ExpiresAt
+	}
+
+	// Save the successor before claiming the rotation, so its ID is never
+	// handed out before it can be looked up
+	if err := PutItem(ctx, sessionsTable, successor); err != nil {
+		log.Printf("RotateSession: Failed to save successor session: %v", err)
+		return nil, err
+	}
+
+	graceExpiresAt := now.Add(SessionRotationGrace).Unix()
+	if session.ExpiresAt < graceExpiresAt {
+		graceExpiresAt = session.ExpiresAt
+	}
+
+	key, err := attributevalue.MarshalMap(map[string]string{
+		"sessionId": session.SessionID,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := InitDynamoDB()
+	if err != nil {
+		log.Printf("RotateSession: Failed to init DynamoDB: %v", err)
+		return nil, err
+	}
+
+	_, err = client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           &sessionsTable,
+		Key:                 key,
+		UpdateExpression:    aws.String("SET rotatedTo = :next, expiresAt = :grace"),
+		ConditionExpression: aws.String("attribute_exists(sessionId) AND attribute_not_exists(rotatedTo)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":next":  &types.AttributeValueMemberS{Value: successor.SessionID},
+			":grace": &types.AttributeValueMemberN{Value: strconv.FormatInt(graceExpiresAt, 10)},
+		},
+	})
+	var conflict *types.ConditionalCheckFailedException
+	if errors.As(err, &conflict) {
+		// Another request rotated (or logged out) this session first
+		if err := DeleteSession(ctx, successor.SessionID); err != nil {
+			log.Printf("RotateSession: Failed to discard losing successor: %v", err)
+		}
+		return rotationWinner(ctx, session.SessionID)
+	}
+	if err != nil {
+		log.Printf("RotateSession: Failed to retire session: %v", err)
+		if err := DeleteSession(ctx, successor.SessionID); err != nil {
+			log.Printf("RotateSession: Failed to discard successor: %v", err)
+		}
+		return nil, err
+	}
+
+	session.RotatedTo = successor.SessionID
+	session.ExpiresAt = graceExpiresAt
+	log.Printf("RotateSession: Rotated session for user %s, new session expires %v", successor.Username, time.Unix(successor.ExpiresAt, 0))
+	return successor, nil
+}
+
+// rotationWinner returns the successor another request recorded for
+// sessionID, or nil if the session is gone
+func rotationWinner(ctx context.Context, sessionID string) (*Session, error) {
+	session, err := GetSession(ctx, sessionID)
+	if err != nil || session == nil || session.RotatedTo == "" {
+		return nil, err
+	}
+	return GetSession(ctx, session.RotatedTo)
+}
+
+// APIHandler is the signature of an API Gateway Lambda handler
+type APIHandler func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error)
+
+type sessionRotationKey struct{}
+
+// sessionRotation collects the session ValidateAuth rotated during a request
+type sessionRotation struct {
+	mu      sync.Mutex
+	session *Session
+}
+
+// WithSessionRotation lets ValidateAuth rotate sessions during handler's
+// requests. A replacement session is returned in the SessionTokenHeader and
+// SessionExpiresAtHeader response headers. Without this wrapper ValidateAuth
+// never rotates, since the caller would have no way to learn the new ID.
+func WithSessionRotation(handler APIHandler) APIHandler {
+	return func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		rotation := &sessionRotation{}
+		response, err := handler(context.WithValue(ctx, sessionRotationKey{}, rotation), request)
+
+		rotation.mu.Lock()
+		successor := rotation.session
+		rotation.mu.Unlock()
+		if err == nil && successor != nil {
+			if response.Headers == nil {
+				response.Headers = map[string]string{}
+			}
+			response.Headers[SessionTokenHeader] = successor.SessionID
+			response.Headers[SessionExpiresAtHeader] = strconv.FormatInt(successor.ExpiresAt, 10)
+		}
+		return response, err
+	}
+}
+
+// rotateSessionIfDue rotates a session that is past its rotation point, or
+// looks up the successor of one that was already rotated, and records it for
+// WithSessionRotation. Failures are logged; the current session stays valid.
+func rotateSessionIfDue(ctx context.Context, session *Session) {
+	rotation, ok := ctx.Value(sessionRotationKey{}).(*sessionRotation)
+	if !ok {
+		return
+	}
+
+	var successor *Session
+	var err error
+	switch {
+	case session.RotatedTo != "":
+		successor, err = GetSession(ctx, session.RotatedTo)
+	case session.NeedsRotation(time.Now()):
+		successor, err = RotateSession(ctx, session)
+	default:
+		return
+	}
+	if err != nil {
+		log.Printf("rotateSessionIfDue: Failed to rotate session for user %s: %v", session.Username, err)
+		return
+	}
+	if successor == nil {
+		return
+	}
+
+	rotation.mu.Lock()
+	rotation.session = successor
+	rotation.mu.Unlock()
+}
+
 // DeleteSession deletes a session
 func DeleteSession(ctx context.Context, sessionID string) error {
 	log.Printf("DeleteSession: Deleting session: %s (first 10 chars)", safeDisplay(sessionID, 10))
@@ -0,0 +1,120 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+)
+
+// stubSessionStore stands in for the sessions table, applying RotateSession's
+// condition the way DynamoDB would
+type stubSessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]Session
+}
+
+func (s *stubSessionStore) handle(call DynamoDBStubCall) (map[string]interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var key struct {
+		SessionID string `dynamodbav:"sessionId"`
+	}
+	switch call.Operation {
+	case "PutItem":
+		var session Session
+		if err := call.Unmarshal("Item", &session); err != nil {
+			return nil, err
+		}
+		s.sessions[session.SessionID] = session
+		return nil, nil
+	case "GetItem":
+		if err := call.Unmarshal("Key", &key); err != nil {
+			return nil, err
+		}
+		session, ok := s.sessions[key.SessionID]
+		if !ok {
+			return nil, nil
+		}
+		return map[string]interface{}{"Item": DynamoDBStubItem(session)}, nil
+	case "UpdateItem":
+		if err := call.Unmarshal("Key", &key); err != nil {
+			return nil, err
+		}
+		session, ok := s.sessions[key.SessionID]
+		if !ok || session.RotatedTo != "" {
+			return nil, ErrDynamoDBStubConditionFailed
+		}
+		attrs, err := call.Attributes("ExpressionAttributeValues")
+		if err != nil {
+			return nil, err
+		}
+		var values struct {
+			Next  string `dynamodbav:":next"`
+			Grace int64  `dynamodbav:":grace"`
+		}
+		if err := attributevalue.UnmarshalMap(attrs, &values); err != nil {
+			return nil, err
+		}
+		session.RotatedTo = values.Next
+		session.ExpiresAt = values.Grace
+		s.sessions[key.SessionID] = session
+		return nil, nil
+	case "DeleteItem":
+		if err := call.Unmarshal("Key", &key); err != nil {
+			return nil, err
+		}
+		delete(s.sessions, key.SessionID)
+		return nil, nil
+	}
+	return nil, errors.New("unexpected " + call.Operation)
+}
+
+func TestParallelRotationsLeaveOneSuccessor(t *testing.T) {
+	now := time.Now()
+	original := Session{
+		SessionID: "original",
+		Username:  "lee",
+		CreatedAt: now.Add(-20 * time.Hour),
+		ExpiresAt: now.Add(4 * time.Hour).Unix(),
+	}
+	store := &stubSessionStore{sessions: map[string]Session{original.SessionID: original}}
+	defer StubDynamoDB(store.handle)()
+
+	const rotations = 4
+	successors := make([]*Session, rotations)
+	errs := make([]error, rotations)
+	var wg sync.WaitGroup
+	for i := 0; i < rotations; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			session := original
+			successors[i], errs[i] = RotateSession(context.Background(), &session)
+		}(i)
+	}
+	wg.Wait()
+
+	retired := store.sessions[original.SessionID]
+	if retired.RotatedTo == "" {
+		t.Fatal("original session was not rotated")
+	}
+	for i := 0; i < rotations; i++ {
+		if errs[i] != nil || successors[i] == nil {
+			t.Fatalf("rotation %d: %v, %v", i, successors[i], errs[i])
+		}
+		if successors[i].SessionID != retired.RotatedTo {
+			t.Errorf("rotation %d got successor %s, want the recorded %s", i, successors[i].SessionID, retired.RotatedTo)
+		}
+	}
+	if len(store.sessions) != 2 {
+		t.Errorf("%d sessions left, want the original and one successor", len(store.sessions))
+	}
+	if successor, ok := store.sessions[retired.RotatedTo]; !ok || successor.Username != "lee" {
+		t.Errorf("successor %s = %+v, want lee's session", retired.RotatedTo, successor)
+	}
+}
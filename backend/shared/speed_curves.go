@@ -0,0 +1,148 @@
+package shared
+
+import (
+	"math"
+	"strings"
+)
+
+// Speed curve kinds. A curve maps a normalized speed level (0 = slowest,
+// 100 = fastest) to an effect's sx between the curve's Min and Max anchors.
+const (
+	SpeedCurveLinear  = "linear"  // sx rises evenly with the level
+	SpeedCurveInverse = "inverse" // sx falls as the level rises (higher sx is slower)
+	SpeedCurveLog     = "log"     // sx rises geometrically, giving finer control at the slow end
+)
+
+// SpeedCurve is how an effect's sx relates to perceived speed
+type SpeedCurve struct {
+	Kind string `json:"kind"`
+	Min  int    `json:"min"` // sx at level 0
+	Max  int    `json:"max"` // sx at level 100
+}
+
+// DefaultSpeedCurve spreads levels over the full sx range, for effects
+// without their own curve
+var DefaultSpeedCurve = SpeedCurve{Kind: SpeedCurveLinear, Min: 0, Max: 255}
+
+// Speed words and the normalized level each means. With the curves in
+// SupportedEffects, "slow" (25) compiles to sx 65 on Breathe, 36 on Scanner,
+// and 105 on Fire 2012.
+var SpeedWordLevels = map[string]int{
+	"frozen":    0,
+	"glacial":   8,
+	"very_slow": 16,
+	"slow":      25,
+	"medium":    50,
+	"fast":      75,
+	"very_fast": 88,
+	"frantic":   100,
+}
+
+// Breathe rhythm words and their normalized levels
+var RhythmWordLevels = map[string]int{
+	"calm":      25,
+	"relaxed":   38,
+	"steady":    50,
+	"energetic": 75,
+	"frantic":   88,
+}
+
+// SpeedWordLevel returns the normalized level for a speed word
+func SpeedWordLevel(word string) (int, bool) {
+	level, ok := SpeedWordLevels[strings.ToLower(strings.TrimSpace(word))]
+	return level, ok
+}
+
+// EffectSpeedCurve returns the speed curve for a WLED effect
+func EffectSpeedCurve(effectID int) SpeedCurve {
+	if meta, ok := SupportedEffects[effectID]; ok && meta.SpeedCurve.Kind != "" {
+		return meta.SpeedCurve
+	}
+	return DefaultSpeedCurve
+}
+
+// ToSx maps a normalized level (clamped to 0-100) to sx
+func (c SpeedCurve) ToSx(level int) int {
+	t := float64(clampLevel(level)) / 100
+	lo, hi := float64(c.Min), float64(c.Max)
+
+	var sx float64
+	switch c.Kind {
+	case SpeedCurveInverse:
+		sx = hi - (hi-lo)*t
+	case SpeedCurveLog:
+		if lo < 1 {
+			lo = 1
+		}
+		sx = lo * math.Pow(hi/lo, t)
+	default:
+		sx = lo + (hi-lo)*t
+	}
+	return clampByte(int(math.Round(sx)))
+}
+
+// ToLevel maps sx back to the nearest normalized level, for display. Values
+// outside the curve's anchors clamp to 0 or 100.
+func (c SpeedCurve) ToLevel(sx int) int {
+	v, lo, hi := float64(sx), float64(c.Min), float64(c.Max)
+	if hi == lo {
+		return 50
+	}
+
+	var t float64
+	switch c.Kind {
+	case SpeedCurveInverse:
+		t = (hi - v) / (hi - lo)
+	case SpeedCurveLog:
+		if lo < 1 {
+			lo = 1
+		}
+		if v < 1 {
+			v = 1
+		}
+		t = math.Log(v/lo) / math.Log(hi/lo)
+	default:
+		t = (v - lo) / (hi - lo)
+	}
+	return clampLevel(int(math.Round(t * 100)))
+}
+
+// NormalizedSpeedToSx maps a normalized level to sx for a WLED effect
+func NormalizedSpeedToSx(effectID, level int) int {
+	return EffectSpeedCurve(effectID).ToSx(level)
+}
+
+// SxToSpeedLevel maps an effect's sx back to a normalized level
+func SxToSpeedLevel(effectID, sx int) int {
+	return EffectSpeedCurve(effectID).ToLevel(sx)
+}
+
+// WLEDSegmentSpeedLevels returns each segment's speed as a normalized level
+func WLEDSegmentSpeedLevels(state *WLEDState) []int {
+	levels := make([]int, len(state.Segments))
+	for i, seg := range state.Segments {
+		levels[i] = SxToSpeedLevel(seg.EffectID, seg.Speed)
+	}
+	return levels
+}
+
+// resolveSegmentSpeedLevels sets sx from speedLevel on segments that give a
+// level and no sx. An explicit sx is raw and always wins.
+func resolveSegmentSpeedLevels(state *WLEDState) {
+	for i := range state.Segments {
+		seg := &state.Segments[i]
+		if seg.SpeedLevel != nil && seg.Speed == 0 {
+			seg.Speed = NormalizedSpeedToSx(seg.EffectID, *seg.SpeedLevel)
+		}
+	}
+}
+
+func clampLevel(level int) int {
+	if level < 0 {
+		return 0
+	}
+	if level > 100 {
+		return 100
+	}
+	return level
+}
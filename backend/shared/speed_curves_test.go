@@ -0,0 +1,81 @@
+package shared
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestSlowMeansTheDocumentedSx(t *testing.T) {
+	slow, ok := SpeedWordLevel("Slow")
+	if !ok || slow != 25 {
+		t.Fatalf("SpeedWordLevel(Slow) = %d, %v; want 25", slow, ok)
+	}
+
+	tests := []struct {
+		effect string
+		fx     int
+		want   int
+	}{
+		{"breathe", WLEDFXBreathe, 65},
+		{"scanner", WLEDFXScanner, 36},
+		{"fire", WLEDFXFire2012, 105},
+	}
+	for _, tt := range tests {
+		if got := NormalizedSpeedToSx(tt.fx, slow); got != tt.want {
+			t.Errorf("%s: slow = sx %d, want %d", tt.effect, got, tt.want)
+		}
+
+		// Through the LCL speed word
+		state, err := ConvertLCLToWLED(&PatternSpec{Effect: tt.effect, Colors: []string{"#FF0000"}, SpeedLevel: &slow}, 30)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.effect, err)
+		}
+		if got := state.Segments[0].Speed; got != tt.want {
+			t.Errorf("%s: LCL speed slow = sx %d, want %d", tt.effect, got, tt.want)
+		}
+
+		// Through speedLevel in WLED JSON, and back for display
+		state, err = ParseWLEDJSON(`{"on":true,"seg":[{"start":0,"stop":30,"fx":` + strconv.Itoa(tt.fx) + `,"speedLevel":25}]}`)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.effect, err)
+		}
+		if got := state.Segments[0].Speed; got != tt.want {
+			t.Errorf("%s: speedLevel 25 = sx %d, want %d", tt.effect, got, tt.want)
+		}
+		// sx is whole numbers, so the level can come back one off
+		if got := WLEDSegmentSpeedLevels(state)[0]; got < slow-1 || got > slow+1 {
+			t.Errorf("%s: sx %d displays as level %d, want about %d", tt.effect, tt.want, got, slow)
+		}
+	}
+}
+
+func TestRawSxBypassesSpeedCurve(t *testing.T) {
+	state, err := ParseWLEDJSON(`{"on":true,"seg":[{"start":0,"stop":30,"fx":39,"sx":200,"speedLevel":25}]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Segments[0].Speed != 200 {
+		t.Errorf("sx = %d, want the raw 200", state.Segments[0].Speed)
+	}
+}
+
+func TestSpeedCurveRoundTrips(t *testing.T) {
+	curves := []SpeedCurve{
+		DefaultSpeedCurve,
+		{Kind: SpeedCurveInverse, Min: 20, Max: 220},
+		{Kind: SpeedCurveLog, Min: 20, Max: 200},
+	}
+	for _, c := range curves {
+		if c.ToSx(-5) != c.ToSx(0) || c.ToSx(150) != c.ToSx(100) {
+			t.Errorf("%s: levels outside 0-100 aren't clamped", c.Kind)
+		}
+		for _, level := range []int{0, 25, 50, 75, 100} {
+			if got := c.ToLevel(c.ToSx(level)); got < level-1 || got > level+1 {
+				t.Errorf("%s: level %d -> sx %d -> level %d", c.Kind, level, c.ToSx(level), got)
+			}
+		}
+	}
+	if inverse := curves[1]; inverse.ToSx(0) != 220 || inverse.ToSx(100) != 20 {
+		t.Errorf("inverse curve runs %d..%d, want 220..20", inverse.ToSx(0), inverse.ToSx(100))
+	}
+}
@@ -0,0 +1,148 @@
+package shared
+
+import (
+	"fmt"
+	"time"
+)
+
+// Starter patterns are tagged in Metadata so they can be found (and removed
+// in bulk) later, and keyed so a re-install skips the ones a user has
+const (
+	StarterPatternTag         = "starter"
+	patternMetadataTag        = "tag"
+	patternMetadataStarterKey = "starterKey"
+)
+
+// StarterPattern is a curated pattern offered to new users
+type StarterPattern struct {
+	Key         string
+	Name        string
+	Description string
+	State       WLEDState
+}
+
+// starterSegment is a single full-strip segment for the 8 LEDs the Glow
+// Blaster prompt defaults to; patterns are rescaled to the strip when applied
+func starterSegment(fx, sx, ix, c1 int, colors ...[]int) []WLEDSegment {
+	return []WLEDSegment{{
+		Start:     0,
+		Stop:      8,
+		EffectID:  fx,
+		Speed:     sx,
+		Intensity: ix,
+		Custom1:   c1,
+		Colors:    colors,
+		On:        true,
+	}}
+}
+
+// StarterPatterns is the starter set. The first four are the worked examples
+// from GlowBlasterSystemPrompt, so they match what Glow Blaster produces.
+var StarterPatterns = []StarterPattern{
+	{
+		Key:         "kitt-scanner",
+		Name:        "KITT Scanner",
+		Description: "Knight Rider red eye sweeping back and forth",
+		State:       WLEDState{On: true, Brightness: 100, Segments: starterSegment(WLEDFXScanner, 180, 50, 128, []int{255, 0, 0}, []int{0, 0, 0})},
+	},
+	{
+		Key:         "cozy-fireplace",
+		Name:        "Cozy Fireplace",
+		Description: "Warm flickering flames with occasional sparks",
+		State:       WLEDState{On: true, Brightness: 100, Segments: starterSegment(WLEDFXFire2012, 100, 55, 120, []int{255, 100, 0}, []int{255, 50, 0}, []int{0, 0, 0})},
+	},
+	{
+		Key:         "ocean-breath",
+		Name:        "Ocean Breath",
+		Description: "Calm blue breathing pulse",
+		State:       WLEDState{On: true, Brightness: 100, Segments: starterSegment(WLEDFXBreathe, 80, 20, 0, []int{0, 100, 255})},
+	},
+	{
+		Key:         "starry-night",
+		Name:        "Starry Night",
+		Description: "White stars twinkling on a deep navy sky",
+		State:       WLEDState{On: true, Brightness: 100, Segments: starterSegment(WLEDFXSparkle, 100, 80, 0, []int{255, 255, 255}, []int{0, 0, 30})},
+	},
+	{
+		Key:         "warm-candle",
+		Name:        "Warm Candle",
+		Description: "Gentle candle flicker in warm amber",
+		State:       WLEDState{On: true, Brightness: 100, Segments: starterSegment(WLEDFXCandle, 96, 128, 0, []int{255, 147, 41})},
+	},
+	{
+		Key:         "ocean-wave",
+		Name:        "Ocean Wave",
+		Description: "Flowing waves of blue and teal",
+		State:       WLEDState{On: true, Brightness: 100, Segments: starterSegment(WLEDFXColorwaves, 80, 128, 0, []int{0, 60, 255}, []int{0, 200, 180}, []int{0, 20, 80})},
+	},
+	{
+		Key:         "rainbow",
+		Name:        "Rainbow",
+		Description: "Full spectrum cycling along the strip",
+		State:       WLEDState{On: true, Brightness: 100, Segments: starterSegment(WLEDFXRainbow, 128, 128, 0, []int{255, 0, 0})},
+	},
+	{
+		Key:         "gentle-breathe",
+		Name:        "Gentle Breathe",
+		Description: "Slow warm white pulse",
+		State:       WLEDState{On: true, Brightness: 100, Segments: starterSegment(WLEDFXBreathe, 50, 50, 0, []int{255, 244, 229})},
+	},
+	{
+		Key:         "meteor-shower",
+		Name:        "Meteor Shower",
+		Description: "Shooting star with a fading trail",
+		State:       WLEDState{On: true, Brightness: 100, Segments: starterSegment(WLEDFXMeteor, 128, 128, 128, []int{200, 220, 255}, []int{0, 0, 0})},
+	},
+	{
+		Key:         "holiday-chase",
+		Name:        "Holiday Chase",
+		Description: "Red and green theater chase",
+		State:       WLEDState{On: true, Brightness: 100, Segments: starterSegment(WLEDFXChase, 100, 128, 0, []int{255, 0, 0}, []int{0, 255, 0})},
+	},
+}
+
+// StarterKey returns the starter a pattern was installed from, or "" for
+// patterns the user made
+func StarterKey(p Pattern) string {
+	if p.Metadata[patternMetadataTag] != StarterPatternTag {
+		return ""
+	}
+	return p.Metadata[patternMetadataStarterKey]
+}
+
+// BuildPattern compiles the starter into a new pattern for username. The
+// caller sets PatternID before saving.
+func (s StarterPattern) BuildPattern(username string, now time.Time) (Pattern, error) {
+	wledJSON, err := WLEDStateToJSON(&s.State)
+	if err != nil {
+		return Pattern{}, fmt.Errorf("starter %s: %w", s.Key, err)
+	}
+	binary, _, err := CompileWLED(wledJSON)
+	if err != nil {
+		return Pattern{}, fmt.Errorf("starter %s: %w", s.Key, err)
+	}
+
+	pattern := Pattern{
+		UserID:        username,
+		Name:          s.Name,
+		Description:   s.Description,
+		Type:          PatternGlowBlaster,
+		Category:      CategoryGlowBlaster,
+		WLEDState:     wledJSON,
+		WLEDBinary:    binary,
+		Bytecode:      binary, // Also set legacy field for backwards compatibility
+		FormatVersion: FormatVersionWLED,
+		Brightness:    s.State.Brightness,
+		Speed:         128,
+		Metadata: map[string]string{
+			patternMetadataTag:        StarterPatternTag,
+			patternMetadataStarterKey: s.Key,
+		},
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	NormalizePatternFormat(&pattern)
+	pattern.CompiledCache = PrecompileCommonLEDCounts(&pattern)
+	pattern.CompatibleEffectIDs = ComputeCompatibleEffectIDs(&pattern)
+	return pattern, nil
+}
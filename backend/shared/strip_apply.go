@@ -0,0 +1,103 @@
+package shared
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+)
+
+// ParticleCaller invokes a cloud function on a Particle device
+type ParticleCaller func(particleID, function, argument string) error
+
+// legacyPatternNumbers maps pattern types to the setPattern numbers of
+// pre-bytecode firmware
+var legacyPatternNumbers = map[string]int{
+	PatternCandle:  1,
+	PatternSolid:   2,
+	PatternPulse:   3,
+	PatternWave:    4,
+	PatternRainbow: 5,
+	PatternFire:    6,
+}
+
+// ApplyPatternToStrip sends pattern to the strip on logical pin. Bytecode
+// firmware gets compiled WLED binary via setBytecode (legacy patterns are
+// converted from their type, color, brightness, and speed); older firmware
+// gets the setPattern/setColor/setBright sequence. Bytecode estimated not to
+// fit in the device's memory isn't sent; a *MemoryLimitError is returned
+// instead. The caller saves the config once all strips are sent. The
+// returned warnings describe anything the strip can't reproduce.
+func ApplyPatternToStrip(device Device, pin, ledCount int, pattern Pattern, call ParticleCaller) ([]string, error) {
+	warnings, _, err := ApplyPatternToStripWithSource(device, pin, ledCount, pattern, call)
+	return warnings, err
+}
+
+// ApplyPatternToStripWithSource is ApplyPatternToStrip that also returns the
+// BinarySource of the bytecode sent, or "" for legacy firmware
+func ApplyPatternToStripWithSource(device Device, pin, ledCount int, pattern Pattern, call ParticleCaller) ([]string, string, error) {
+	if device.SupportsBytecode() {
+		return applyBytecodeToStrip(device, pin, ledCount, pattern, call)
+	}
+	warnings, err := applyLegacyToStrip(device, pin, pattern, call)
+	return warnings, "", err
+}
+
+func applyBytecodeToStrip(device Device, pin, ledCount int, pattern Pattern, call ParticleCaller) ([]string, string, error) {
+	var warnings []string
+	switch ResolvePatternFormat(pattern) {
+	case PatternFormatLegacySimple:
+		warnings = append(warnings, fmt.Sprintf("Legacy %s pattern converted to WLED for bytecode firmware", pattern.Type))
+	case PatternFormatLCL:
+		warnings = append(warnings, "LCL pattern converted to WLED for bytecode firmware")
+	}
+
+	bytecode, source, compileWarnings, err := CompileForLEDCountWithOverrides(&pattern, ledCount, StripOutputOverrides(device, pin, OutputOverrides{}))
+	warnings = append(warnings, compileWarnings...)
+	if err != nil {
+		return warnings, "", err
+	}
+
+	// Bytecode too big for the device's memory resets it, so reject it before sending
+	if _, err := CheckBytecodeMemory(device, bytecode, ledCount); err != nil {
+		return warnings, source, err
+	}
+
+	physical := device.ResolvePin(pin)
+	log.Printf("Sending setBytecode to %s pin D%d (%d bytes, %s)", device.Name, physical, len(bytecode), source)
+	arg := fmt.Sprintf("%d,%s", physical, base64.StdEncoding.EncodeToString(bytecode))
+	return warnings, source, call(device.ParticleID, "setBytecode", arg)
+}
+
+func applyLegacyToStrip(device Device, pin int, pattern Pattern, call ParticleCaller) ([]string, error) {
+	var warnings []string
+	if format := ResolvePatternFormat(pattern); format != PatternFormatLegacySimple {
+		warnings = append(warnings, fmt.Sprintf("Pattern is in %s format but this firmware only runs legacy patterns; sending its type and primary color instead", format))
+	}
+	patternNum, ok := legacyPatternNumbers[pattern.Type]
+	if !ok {
+		patternNum = legacyPatternNumbers[PatternSolid]
+		warnings = append(warnings, fmt.Sprintf("Pattern type %q is not supported by the legacy firmware commands; using solid", pattern.Type))
+	}
+
+	// Legacy commands only carry a single color
+	if len(pattern.Colors) > 1 {
+		warnings = append(warnings, fmt.Sprintf("Pattern has %d colors; only the primary color is sent", len(pattern.Colors)))
+	}
+	if m := device.StripSpeedMultiplier(pin); m != 1 {
+		warnings = append(warnings, fmt.Sprintf("Strip speed multiplier x%g is not supported by the legacy firmware commands", m))
+	}
+
+	physical := device.ResolvePin(pin)
+	commands := []struct{ function, arg string }{
+		{"setPattern", fmt.Sprintf("%d,%d,%d", physical, patternNum, pattern.Speed)},                 // "pin,pattern,speed"
+		{"setColor", fmt.Sprintf("%d,%d,%d,%d", physical, pattern.Red, pattern.Green, pattern.Blue)}, // "pin,R,G,B"
+		{"setBright", fmt.Sprintf("%d,%d", physical, pattern.Brightness)},                            // "pin,brightness"
+	}
+	for _, cmd := range commands {
+		log.Printf("Sending %s to %s with arg: %s", cmd.function, device.Name, cmd.arg)
+		if err := call(device.ParticleID, cmd.function, cmd.arg); err != nil {
+			return warnings, fmt.Errorf("%s failed for pin D%d: %v", cmd.function, physical, err)
+		}
+	}
+	return warnings, nil
+}
@@ -0,0 +1,121 @@
+package shared
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeParticle records the cloud function calls it receives. Functions not in
+// registered answer 404, as Particle does for a function the firmware lacks.
+type fakeParticle struct {
+	mu         sync.Mutex
+	registered map[string]bool
+	calls      []string // "function(argument)"
+}
+
+func (f *fakeParticle) serve() (caller ParticleCaller, restore func()) {
+	restore = StubParticleAPI(func(w http.ResponseWriter, r *http.Request) {
+		function := r.URL.Path[strings.LastIndexByte(r.URL.Path, '/')+1:]
+		var body struct {
+			Arg string `json:"arg"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		f.mu.Lock()
+		f.calls = append(f.calls, function+"("+body.Arg+")")
+		f.mu.Unlock()
+		if !f.registered[function] {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":"Function ` + function + ` not found"}`))
+			return
+		}
+		w.Write([]byte(`{"return_value":1}`))
+	})
+	caller = func(particleID, function, argument string) error {
+		return CallParticleFunction(context.Background(), particleID, function, argument, "token")
+	}
+	return caller, restore
+}
+
+func TestApplyLegacyPatternByFirmwareGeneration(t *testing.T) {
+	pattern := Pattern{Type: PatternCandle, Red: 255, Green: 120, Blue: 20, Brightness: 200, Speed: 50}
+
+	tests := []struct {
+		name       string
+		device     Device
+		registered []string
+		want       []string // Functions called, in order
+	}{
+		{
+			name:       "legacy firmware",
+			device:     Device{FirmwareVersion: "v2.4.0"},
+			registered: []string{"setPattern", "setColor", "setBright"},
+			want:       []string{"setPattern", "setColor", "setBright"},
+		},
+		{
+			name:       "bytecode firmware by version",
+			device:     Device{FirmwareVersion: "v3.0.0"},
+			registered: []string{"setBytecode"},
+			want:       []string{"setBytecode"},
+		},
+		{
+			name:       "bytecode firmware by capabilities",
+			device:     Device{FirmwareVersion: "v2.9.0", Capabilities: []string{"setBytecode", "setBright"}},
+			registered: []string{"setBytecode", "setBright"},
+			want:       []string{"setBytecode"},
+		},
+	}
+	for _, tt := range tests {
+		fake := &fakeParticle{registered: map[string]bool{}}
+		for _, fn := range tt.registered {
+			fake.registered[fn] = true
+		}
+		call, restore := fake.serve()
+
+		tt.device.Name = "garage"
+		tt.device.ParticleID = "p1"
+		tt.device.LEDStrips = []LEDStrip{{Pin: 6, LEDCount: 30}}
+		warnings, err := ApplyPatternToStrip(tt.device, 6, 30, pattern, call)
+		restore()
+		if err != nil {
+			t.Errorf("%s: %v (calls %v)", tt.name, err, fake.calls)
+			continue
+		}
+
+		var functions []string
+		for _, c := range fake.calls {
+			functions = append(functions, c[:strings.IndexByte(c, '(')])
+		}
+		if strings.Join(functions, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%s: called %v, want %v", tt.name, fake.calls, tt.want)
+		}
+		converted := containsWarning(warnings, "Legacy candle pattern converted to WLED for bytecode firmware")
+		if bytecode := tt.want[0] == "setBytecode"; converted != bytecode {
+			t.Errorf("%s: warnings %v, want a conversion warning only for bytecode firmware", tt.name, warnings)
+		}
+	}
+}
+
+func TestApplyLegacyPatternSendsLegacyArguments(t *testing.T) {
+	fake := &fakeParticle{registered: map[string]bool{"setPattern": true, "setColor": true, "setBright": true}}
+	call, restore := fake.serve()
+	defer restore()
+
+	device := Device{Name: "garage", ParticleID: "p1", FirmwareVersion: "v2.4.0", CustomPinMapping: map[string]int{StripLogicalName(6): 2}}
+	pattern := Pattern{Type: PatternSolid, Red: 10, Green: 20, Blue: 30, Brightness: 99, Speed: 7}
+	if _, err := ApplyPatternToStrip(device, 6, 30, pattern, call); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"setPattern(2," + strconv.Itoa(legacyPatternNumbers[PatternSolid]) + ",7)",
+		"setColor(2,10,20,30)",
+		"setBright(2,99)",
+	}
+	if strings.Join(fake.calls, " ") != strings.Join(want, " ") {
+		t.Errorf("calls = %v, want %v", fake.calls, want)
+	}
+}
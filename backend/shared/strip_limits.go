@@ -0,0 +1,94 @@
+package shared
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// DefaultMaxLEDsCeiling is the absolute LED count per strip when
+// MAX_LEDS_PER_STRIP is unset. It's the backstop for devices whose
+// deviceInfo hasn't reported maxLeds.
+const DefaultMaxLEDsCeiling = 1000
+
+// MaxLEDsCeiling is the absolute LED count per strip, from
+// MAX_LEDS_PER_STRIP. A firmware-reported limit can only lower it.
+var MaxLEDsCeiling = maxLEDsCeilingFromEnv()
+
+// maxLEDsCeilingFromEnv reads MAX_LEDS_PER_STRIP, falling back to
+// DefaultMaxLEDsCeiling when it's unset or not a positive number
+func maxLEDsCeilingFromEnv() int {
+	raw := os.Getenv("MAX_LEDS_PER_STRIP")
+	if raw == "" {
+		return DefaultMaxLEDsCeiling
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 1 {
+		log.Printf("Ignoring MAX_LEDS_PER_STRIP=%q: must be a positive number; using %d", raw, DefaultMaxLEDsCeiling)
+		return DefaultMaxLEDsCeiling
+	}
+	return n
+}
+
+// StripLimitError is a strip configuration over a device limit. Handlers
+// return it as 422.
+type StripLimitError struct {
+	Limit  string // "maxStrips" or "maxLedsPerStrip"
+	Max    int
+	Actual int
+	Pin    int    // The offending strip, for maxLedsPerStrip
+	Source string // "firmware" when the device reported Max, else "ceiling"
+}
+
+func (e *StripLimitError) Error() string {
+	if e.Limit == "maxStrips" {
+		return fmt.Sprintf("%d strips configured; the device supports at most %d (maxStrips, from %s)", e.Actual, e.Max, e.Source)
+	}
+	return fmt.Sprintf("strip on pin %d has %d LEDs; the limit is %d (maxLedsPerStrip, from %s)", e.Pin, e.Actual, e.Max, e.Source)
+}
+
+// LEDLimit is the most LEDs a strip on the device can have: the
+// firmware-reported limit, capped by MaxLEDsCeiling, and where it came from
+func (d Device) LEDLimit() (int, string) {
+	if d.MaxLEDs > 0 && d.MaxLEDs <= MaxLEDsCeiling {
+		return d.MaxLEDs, "firmware"
+	}
+	return MaxLEDsCeiling, "ceiling"
+}
+
+// ValidateStripLimits checks strips against the device's firmware-reported
+// maxStrips and maxLedsPerStrip (see ApplyReadiness), falling back to
+// MaxLEDsCeiling for LED counts when the device hasn't reported limits.
+// It returns a *StripLimitError for the first limit exceeded.
+func ValidateStripLimits(device Device, strips []LEDStrip) error {
+	if device.MaxStrips > 0 && len(strips) > device.MaxStrips {
+		return &StripLimitError{Limit: "maxStrips", Max: device.MaxStrips, Actual: len(strips), Source: "firmware"}
+	}
+	maxLEDs, source := device.LEDLimit()
+	for _, strip := range strips {
+		if strip.LEDCount > maxLEDs {
+			return &StripLimitError{Limit: "maxLedsPerStrip", Max: maxLEDs, Actual: strip.LEDCount, Pin: strip.Pin, Source: source}
+		}
+	}
+	return nil
+}
+
+// ParseDeviceInfoLimits reads the maxStrips and maxLeds fields of a
+// deviceInfo variable ("version|platform|maxStrips|maxLeds|maxColors|freeMem").
+// Either is 0 when missing or invalid.
+func ParseDeviceInfoLimits(deviceInfo string) (maxStrips, maxLEDs int) {
+	parts := strings.Split(deviceInfo, "|")
+	if len(parts) > 2 {
+		if n, err := strconv.Atoi(strings.TrimSpace(parts[2])); err == nil && n > 0 {
+			maxStrips = n
+		}
+	}
+	if len(parts) > 3 {
+		if n, err := strconv.Atoi(strings.TrimSpace(parts[3])); err == nil && n > 0 {
+			maxLEDs = n
+		}
+	}
+	return maxStrips, maxLEDs
+}
@@ -0,0 +1,89 @@
+package shared
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidateStripLimits(t *testing.T) {
+	strips := func(ledCounts ...int) []LEDStrip {
+		var out []LEDStrip
+		for i, n := range ledCounts {
+			out = append(out, LEDStrip{Pin: i + 2, LEDCount: n})
+		}
+		return out
+	}
+	reported := Device{MaxStrips: 2, MaxLEDs: 300}
+	unreported := Device{} // No deviceInfo yet
+
+	tests := []struct {
+		name   string
+		device Device
+		strips []LEDStrip
+		want   *StripLimitError
+	}{
+		{"LEDs at the firmware limit", reported, strips(300, 300), nil},
+		{"LEDs one over the firmware limit", reported, strips(300, 301),
+			&StripLimitError{Limit: "maxLedsPerStrip", Max: 300, Actual: 301, Pin: 3, Source: "firmware"}},
+		{"strips at the firmware limit", reported, strips(8, 8), nil},
+		{"strips one over the firmware limit", reported, strips(8, 8, 8),
+			&StripLimitError{Limit: "maxStrips", Max: 2, Actual: 3, Source: "firmware"}},
+		{"no deviceInfo, at the ceiling", unreported, strips(DefaultMaxLEDsCeiling, 8, 8, 8), nil},
+		{"no deviceInfo, one over the ceiling", unreported, strips(8, DefaultMaxLEDsCeiling+1),
+			&StripLimitError{Limit: "maxLedsPerStrip", Max: DefaultMaxLEDsCeiling, Actual: DefaultMaxLEDsCeiling + 1, Pin: 3, Source: "ceiling"}},
+		{"firmware limit above the ceiling", Device{MaxLEDs: 5000}, strips(DefaultMaxLEDsCeiling + 1),
+			&StripLimitError{Limit: "maxLedsPerStrip", Max: DefaultMaxLEDsCeiling, Actual: DefaultMaxLEDsCeiling + 1, Pin: 2, Source: "ceiling"}},
+		{"no strips", reported, nil, nil},
+	}
+
+	for _, tt := range tests {
+		err := ValidateStripLimits(tt.device, tt.strips)
+		if tt.want == nil {
+			if err != nil {
+				t.Errorf("%s: %v, want no error", tt.name, err)
+			}
+			continue
+		}
+		var limitErr *StripLimitError
+		if !errors.As(err, &limitErr) || *limitErr != *tt.want {
+			t.Errorf("%s: %v, want %+v", tt.name, err, *tt.want)
+		}
+	}
+}
+
+func TestParseDeviceInfoLimits(t *testing.T) {
+	tests := []struct {
+		deviceInfo           string
+		wantStrips, wantLEDs int
+	}{
+		{"3.1.0|argon|4|300|16|41000", 4, 300},
+		{"3.1.0|argon| 4 | 300 ", 4, 300},
+		{"3.1.0|argon|4", 4, 0},
+		{"3.1.0|argon|x|-5", 0, 0},
+		{"", 0, 0},
+	}
+	for _, tt := range tests {
+		strips, leds := ParseDeviceInfoLimits(tt.deviceInfo)
+		if strips != tt.wantStrips || leds != tt.wantLEDs {
+			t.Errorf("ParseDeviceInfoLimits(%q) = %d, %d; want %d, %d", tt.deviceInfo, strips, leds, tt.wantStrips, tt.wantLEDs)
+		}
+	}
+}
+
+func TestMaxLEDsCeilingFromEnv(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want int
+	}{
+		{"", DefaultMaxLEDsCeiling},
+		{"600", 600},
+		{"0", DefaultMaxLEDsCeiling},
+		{"lots", DefaultMaxLEDsCeiling},
+	}
+	for _, tt := range tests {
+		t.Setenv("MAX_LEDS_PER_STRIP", tt.raw)
+		if got := maxLEDsCeilingFromEnv(); got != tt.want {
+			t.Errorf("MAX_LEDS_PER_STRIP=%q: ceiling %d, want %d", tt.raw, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package shared
+
+import (
+	"fmt"
+	"math"
+)
+
+// Bounds for LEDStrip.SpeedMultiplier. Effect speed is per LED, so strips of
+// different densities run the same pattern at different visible speeds.
+const (
+	MinSpeedMultiplier = 0.25
+	MaxSpeedMultiplier = 4.0
+)
+
+// ValidateSpeedMultiplier checks a strip's speed multiplier. 0 means unset.
+func ValidateSpeedMultiplier(m float64) error {
+	if m == 0 {
+		return nil
+	}
+	if math.IsNaN(m) || m < MinSpeedMultiplier || m > MaxSpeedMultiplier {
+		return fmt.Errorf("speedMultiplier must be between %g and %g", MinSpeedMultiplier, MaxSpeedMultiplier)
+	}
+	return nil
+}
+
+// EffectiveSpeedMultiplier is the strip's multiplier, 1.0 when unset
+func (s LEDStrip) EffectiveSpeedMultiplier() float64 {
+	if s.SpeedMultiplier == 0 {
+		return 1
+	}
+	return s.SpeedMultiplier
+}
+
+// StripSpeedMultiplier is the multiplier of the strip on logical pin, 1.0
+// when the pin has no strip or the strip has none
+func (d *Device) StripSpeedMultiplier(pin int) float64 {
+	for _, strip := range d.LEDStrips {
+		if strip.Pin == pin {
+			return strip.EffectiveSpeedMultiplier()
+		}
+	}
+	return 1
+}
+
+// StripOutputOverrides adds the speed multiplier of the strip on pin to o.
+// A multiplier of 1.0 is left out, so the bytecode is exactly what the
+// pattern compiles to without one.
+func StripOutputOverrides(device Device, pin int, o OutputOverrides) OutputOverrides {
+	if m := device.StripSpeedMultiplier(pin); m != 1 {
+		o.SpeedMultiplier = &m
+	}
+	return o
+}
+
+// ScaleEffectSpeed multiplies an sx value by m, rounded and clamped to 0-255
+func ScaleEffectSpeed(sx int, m float64) int {
+	scaled := int(math.Round(float64(sx) * m))
+	if scaled < 0 {
+		return 0
+	}
+	if scaled > 255 {
+		return 255
+	}
+	return scaled
+}
@@ -0,0 +1,94 @@
+package shared
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestScaleEffectSpeedClamps(t *testing.T) {
+	tests := []struct {
+		sx   int
+		m    float64
+		want int
+	}{
+		{128, 1, 128},
+		{200, MaxSpeedMultiplier, 255},
+		{255, MaxSpeedMultiplier, 255},
+		{1, MinSpeedMultiplier, 0},
+		{0, MinSpeedMultiplier, 0},
+		{255, MinSpeedMultiplier, 64},
+		{-10, 2, 0},
+	}
+	for _, tt := range tests {
+		if got := ScaleEffectSpeed(tt.sx, tt.m); got != tt.want {
+			t.Errorf("ScaleEffectSpeed(%d, %g) = %d, want %d", tt.sx, tt.m, got, tt.want)
+		}
+	}
+}
+
+func TestStripSpeedMultiplierClampsSegmentSpeed(t *testing.T) {
+	state := `{"on":true,"bri":128,"seg":[{"fx":2,"sx":200},{"fx":2,"sx":4}]}`
+	tests := []struct {
+		m    float64
+		want []int
+	}{
+		{MaxSpeedMultiplier, []int{255, 16}},
+		{MinSpeedMultiplier, []int{50, 1}},
+	}
+	for _, tt := range tests {
+		device := Device{LEDStrips: []LEDStrip{{Pin: 6, LEDCount: 30, SpeedMultiplier: tt.m}}}
+		overridden, err := ApplyOutputOverrides(state, StripOutputOverrides(device, 6, OutputOverrides{}))
+		if err != nil {
+			t.Fatalf("x%g: %v", tt.m, err)
+		}
+		var got struct {
+			Seg []struct {
+				SX int `json:"sx"`
+			} `json:"seg"`
+		}
+		if err := json.Unmarshal([]byte(overridden), &got); err != nil {
+			t.Fatalf("x%g: %v", tt.m, err)
+		}
+		for i, seg := range got.Seg {
+			if seg.SX != tt.want[i] {
+				t.Errorf("x%g: segment %d sx = %d, want %d", tt.m, i, seg.SX, tt.want[i])
+			}
+		}
+	}
+}
+
+func TestDefaultSpeedMultiplierIsNoOp(t *testing.T) {
+	pattern := Pattern{WLEDState: `{"on":true,"bri":128,"seg":[{"fx":2,"sx":150,"col":[[255,0,0]]}]}`}
+	want, _, err := CompileForLEDCount(&pattern, 30)
+	if err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+
+	for _, m := range []float64{0, 1} {
+		device := Device{
+			Name:            "garage",
+			ParticleID:      "p1",
+			FirmwareVersion: "v3.0.0",
+			LEDStrips:       []LEDStrip{{Pin: 6, LEDCount: 30, SpeedMultiplier: m}},
+		}
+		if o := StripOutputOverrides(device, 6, OutputOverrides{}); !o.IsZero() {
+			t.Errorf("multiplier %g: overrides %s, want none", m, o)
+		}
+
+		var sent string
+		call := func(particleID, function, argument string) error {
+			sent = argument
+			return nil
+		}
+		if _, err := ApplyPatternToStrip(device, 6, 30, pattern, call); err != nil {
+			t.Fatalf("multiplier %g: apply: %v", m, err)
+		}
+		_, payload, _ := strings.Cut(sent, ",")
+		if got, _ := base64.StdEncoding.DecodeString(payload); !bytes.Equal(got, want) {
+			t.Errorf("multiplier %g: sent bytecode differs from the pattern compiled without a multiplier", m)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package shared
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Text command verbs
+const (
+	TextVerbApply      = "apply"
+	TextVerbOff        = "off"
+	TextVerbBrightness = "brightness"
+	TextVerbNext       = "next"
+)
+
+// Fuzzy matching thresholds
+const (
+	TextMatchThreshold    = 0.5  // Minimum score for a candidate to count as a match
+	TextAmbiguityMargin   = 0.1  // Candidates within this margin of the best are ambiguous
+	TextExactMatchScore   = 1.0  // Score for a case-insensitive exact match
+	textContainsBaseScore = 0.75 // Base score when one string contains the other
+)
+
+// TextCommand is a parsed plain-text command such as "apply warm candle to garage left"
+type TextCommand struct {
+	Verb         string `json:"verb"`
+	PatternQuery string `json:"patternQuery,omitempty"` // Pattern name to fuzzy-match (apply only)
+	TargetQuery  string `json:"targetQuery"`            // Device, strip, or group name to fuzzy-match
+	Brightness   int    `json:"brightness,omitempty"`   // BrightnessPercent, 0-100 (brightness only)
+}
+
+// TextMatchCandidate is something a text command can refer to by name
+type TextMatchCandidate struct {
+	ID    string  `json:"id"`
+	Name  string  `json:"name"`
+	Kind  string  `json:"kind"` // "pattern", "group", "device", "strip"
+	Score float64 `json:"score"`
+}
+
+var (
+	// A brightness value is a number with a % sign, or a bare number right
+	// after a word that introduces one ("brightness 50", "dim to 30"). Numbers
+	// inside names such as "garage2" are neither.
+	brightnessPercentRegex = regexp.MustCompile(`(?:^|\s)(\d{1,3})\s*%`)
+	brightnessKeywordRegex = regexp.MustCompile(`(?:^|\s)(?:brightness|dim|to|at)\s+(\d{1,3})(?:\s|$)`)
+	applySplitRegex        = regexp.MustCompile(`\s+(?:to|on|for)\s+`)
+)
+
+// ParseTextCommand parses the supported verbs:
+//
+//	apply|set <pattern> to|on <target>
+//	off <target> | turn|switch off <target> | turn|switch <target> off
+//	brightness N% <target> | set <target> brightness to N%
+//	next <target>
+func ParseTextCommand(text string) (*TextCommand, error) {
+	normalized := strings.Join(strings.Fields(strings.ToLower(text)), " ")
+	if normalized == "" {
+		return nil, fmt.Errorf("command text is required")
+	}
+
+	words := strings.Fields(normalized)
+
+	switch {
+	case containsWord(words, "brightness") || words[0] == "dim":
+		match := brightnessPercentRegex.FindStringSubmatchIndex(normalized)
+		if match == nil {
+			match = brightnessKeywordRegex.FindStringSubmatchIndex(normalized)
+		}
+		if match == nil {
+			return nil, fmt.Errorf("brightness command needs a value, e.g. \"brightness 50%% garage\"")
+		}
+		value, _ := strconv.Atoi(normalized[match[2]:match[3]])
+		if value < 0 || value > 100 {
+			return nil, fmt.Errorf("brightness must be between 0 and 100")
+		}
+		// Drop the number and any % sign, keeping the words before it
+		rest := normalized[:match[2]] + " " + normalized[match[1]:]
+		target := stripFillerWords(rest, "set", "brightness", "dim", "to", "of", "on", "for", "the", "at")
+		if target == "" {
+			return nil, fmt.Errorf("brightness command needs a target")
+		}
+		return &TextCommand{Verb: TextVerbBrightness, TargetQuery: target, Brightness: value}, nil
+
+	case offTargetWords(words) != nil:
+		target := stripFillerWords(strings.Join(offTargetWords(words), " "), "the")
+		if target == "" {
+			return nil, fmt.Errorf("off command needs a target")
+		}
+		return &TextCommand{Verb: TextVerbOff, TargetQuery: target}, nil
+
+	case words[0] == "next":
+		target := stripFillerWords(normalized, "next", "pattern", "on", "for", "the")
+		if target == "" {
+			return nil, fmt.Errorf("next command needs a target")
+		}
+		return &TextCommand{Verb: TextVerbNext, TargetQuery: target}, nil
+
+	case words[0] == "apply" || words[0] == "set":
+		rest := strings.TrimSpace(strings.TrimPrefix(strings.TrimPrefix(normalized, words[0]), " "))
+		parts := applySplitRegex.Split(rest, 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("apply command must look like \"apply <pattern> to <target>\"")
+		}
+		return &TextCommand{
+			Verb:         TextVerbApply,
+			PatternQuery: stripFillerWords(parts[0], "the", "pattern"),
+			TargetQuery:  stripFillerWords(parts[1], "the"),
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unrecognized command; supported verbs are apply/set, off, brightness, next")
+}
+
+// offTargetWords returns the target words of an off command, or nil if words
+// isn't one. "off" is only the verb when it starts the command or goes with
+// "turn" or "switch", so names ending in "off" ("drop off") aren't commands.
+func offTargetWords(words []string) []string {
+	switchVerb := words[0] == "turn" || words[0] == "switch"
+	switch {
+	case words[0] == "off":
+		return words[1:]
+	case switchVerb && len(words) > 1 && words[1] == "off":
+		return words[2:]
+	case switchVerb && len(words) > 2 && words[1] != "on" && words[len(words)-1] == "off":
+		return words[1 : len(words)-1]
+	}
+	return nil
+}
+
+func containsWord(words []string, word string) bool {
+	for _, w := range words {
+		if w == word {
+			return true
+		}
+	}
+	return false
+}
+
+// stripFillerWords removes the given words and collapses whitespace
+func stripFillerWords(text string, filler ...string) string {
+	skip := make(map[string]bool, len(filler))
+	for _, f := range filler {
+		skip[f] = true
+	}
+	var kept []string
+	for _, w := range strings.Fields(text) {
+		if !skip[w] {
+			kept = append(kept, w)
+		}
+	}
+	return strings.Join(kept, " ")
+}
+
+// FuzzyMatchScore scores how well query matches name (0-1), case-insensitively.
+// Exact matches score 1, substring matches score by length ratio, and anything
+// else scores by the fraction of query words that prefix a word in name.
+func FuzzyMatchScore(query, name string) float64 {
+	q := strings.Join(strings.Fields(strings.ToLower(query)), " ")
+	n := strings.Join(strings.Fields(strings.ToLower(name)), " ")
+	if q == "" || n == "" {
+		return 0
+	}
+	if q == n {
+		return TextExactMatchScore
+	}
+
+	if strings.Contains(n, q) || strings.Contains(q, n) {
+		shorter, longer := len(q), len(n)
+		if shorter > longer {
+			shorter, longer = longer, shorter
+		}
+		return textContainsBaseScore + (TextExactMatchScore-textContainsBaseScore-0.01)*float64(shorter)/float64(longer)
+	}
+
+	queryWords := strings.Fields(q)
+	nameWords := strings.Fields(n)
+	matched := 0
+	for _, qw := range queryWords {
+		for _, nw := range nameWords {
+			if strings.HasPrefix(nw, qw) || strings.HasPrefix(qw, nw) {
+				matched++
+				break
+			}
+		}
+	}
+	return textContainsBaseScore * float64(matched) / float64(len(queryWords))
+}
+
+// MatchTextCandidates scores candidates against query. It returns the best match
+// when exactly one candidate clears the threshold by a clear margin, otherwise
+// the close candidates for disambiguation (empty when nothing matches).
+func MatchTextCandidates(query string, candidates []TextMatchCandidate) (*TextMatchCandidate, []TextMatchCandidate) {
+	var scored []TextMatchCandidate
+	for _, c := range candidates {
+		c.Score = FuzzyMatchScore(query, c.Name)
+		if c.Score >= TextMatchThreshold {
+			scored = append(scored, c)
+		}
+	}
+
+	if len(scored) == 0 {
+		return nil, nil
+	}
+
+	sort.SliceStable(scored, func(i, j int) bool {
+		return scored[i].Score > scored[j].Score
+	})
+
+	best := scored[0]
+	var closeMatches []TextMatchCandidate
+	for _, c := range scored {
+		if best.Score-c.Score <= TextAmbiguityMargin {
+			closeMatches = append(closeMatches, c)
+		}
+	}
+
+	// An exact match always wins over partial ones
+	if len(closeMatches) == 1 || (best.Score == TextExactMatchScore && scored[1].Score < TextExactMatchScore) {
+		return &best, nil
+	}
+
+	return nil, closeMatches
+}
@@ -0,0 +1,53 @@
+package shared
+
+import "testing"
+
+func TestParseTextCommand(t *testing.T) {
+	tests := []struct {
+		text string
+		want TextCommand
+	}{
+		{"apply warm candle to garage left", TextCommand{Verb: TextVerbApply, PatternQuery: "warm candle", TargetQuery: "garage left"}},
+		{"set the fire pattern on porch", TextCommand{Verb: TextVerbApply, PatternQuery: "fire", TargetQuery: "porch"}},
+		{"off garage", TextCommand{Verb: TextVerbOff, TargetQuery: "garage"}},
+		{"turn off the porch", TextCommand{Verb: TextVerbOff, TargetQuery: "porch"}},
+		{"switch off drop off", TextCommand{Verb: TextVerbOff, TargetQuery: "drop off"}},
+		{"turn the garage lights off", TextCommand{Verb: TextVerbOff, TargetQuery: "garage lights"}},
+		{"brightness 50% garage", TextCommand{Verb: TextVerbBrightness, TargetQuery: "garage", Brightness: 50}},
+		{"set garage2 brightness to 50%", TextCommand{Verb: TextVerbBrightness, TargetQuery: "garage2", Brightness: 50}},
+		{"set garage2 brightness to 50", TextCommand{Verb: TextVerbBrightness, TargetQuery: "garage2", Brightness: 50}},
+		{"brightness 30 on bay 2", TextCommand{Verb: TextVerbBrightness, TargetQuery: "bay 2", Brightness: 30}},
+		{"dim porch to 0", TextCommand{Verb: TextVerbBrightness, TargetQuery: "porch", Brightness: 0}},
+		{"next pattern on garage", TextCommand{Verb: TextVerbNext, TargetQuery: "garage"}},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseTextCommand(tt.text)
+		if err != nil {
+			t.Errorf("ParseTextCommand(%q) error: %v", tt.text, err)
+			continue
+		}
+		if *got != tt.want {
+			t.Errorf("ParseTextCommand(%q) = %+v, want %+v", tt.text, *got, tt.want)
+		}
+	}
+}
+
+func TestParseTextCommandErrors(t *testing.T) {
+	tests := []string{
+		"",
+		"off",
+		"turn on lights in drop off",
+		"garage off",
+		"brightness garage2",
+		"brightness 150% garage",
+		"brightness 50%",
+		"apply warm candle",
+	}
+
+	for _, text := range tests {
+		if got, err := ParseTextCommand(text); err == nil {
+			t.Errorf("ParseTextCommand(%q) = %+v, want an error", text, *got)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+var trialsTable = os.Getenv("TRIALS_TABLE")
+
+// Trial statuses
+const (
+	TrialStatusActive    = "active"    // Trial pattern is on the strip, revert pending
+	TrialStatusKept      = "kept"      // Trial pattern was made the strip's pattern
+	TrialStatusReverted  = "reverted"  // Timer expired and the strip was restored
+	TrialStatusCancelled = "cancelled" // User restored the strip early
+)
+
+// Trial duration limits
+const (
+	DefaultTrialSeconds = 30
+	MaxTrialSeconds     = 300
+)
+
+// trialRetention is how long finished trials are kept before TTL deletes them
+const trialRetention = 24 * time.Hour
+
+// Trial is a temporary pattern on one strip that reverts automatically
+type Trial struct {
+	TrialID           string    `json:"trialId" dynamodbav:"trialId"`
+	UserID            string    `json:"userId" dynamodbav:"userId"`
+	DeviceID          string    `json:"deviceId" dynamodbav:"deviceId"`
+	Pin               int       `json:"pin" dynamodbav:"pin"`
+	PreviousPatternID string    `json:"previousPatternId,omitempty" dynamodbav:"previousPatternId,omitempty"` // Restored on revert (empty = strip was off)
+	TrialPatternID    string    `json:"trialPatternId,omitempty" dynamodbav:"trialPatternId,omitempty"`       // Saved pattern under trial
+	TrialWLEDState    string    `json:"trialWledState,omitempty" dynamodbav:"trialWledState,omitempty"`       // Inline WLED state under trial
+	Status            string    `json:"status" dynamodbav:"status"`
+	RevertAt          time.Time `json:"revertAt" dynamodbav:"revertAt"`
+	CreatedAt         time.Time `json:"createdAt" dynamodbav:"createdAt"`
+	UpdatedAt         time.Time `json:"updatedAt" dynamodbav:"updatedAt"`
+	ExpiresAt         int64     `json:"expiresAt,omitempty" dynamodbav:"expiresAt,omitempty"` // TTL
+}
+
+// TrialStripLock marks a strip as having an active trial. It lives in the
+// trials table under a "strip#" key so it can be claimed with a conditional put.
+type TrialStripLock struct {
+	TrialID       string `json:"trialId" dynamodbav:"trialId"` // Lock key from TrialLockKey
+	ActiveTrialID string `json:"activeTrialId" dynamodbav:"activeTrialId"`
+	LockedUntil   int64  `json:"lockedUntil" dynamodbav:"lockedUntil"` // Unix seconds; stale after this
+	ExpiresAt     int64  `json:"expiresAt" dynamodbav:"expiresAt"`     // TTL
+}
+
+// TrialLockKey is the trials table key of the lock for a strip
+func TrialLockKey(deviceID string, pin int) string {
+	return fmt.Sprintf("strip#%s#%d", deviceID, pin)
+}
+
+// TrialExpiresAt is the TTL for a trial that reverts at revertAt
+func TrialExpiresAt(revertAt time.Time) int64 {
+	return revertAt.Add(trialRetention).Unix()
+}
+
+// CancelStripTrial ends any trial running on a strip without restoring the
+// previous pattern, for callers that are about to set the strip themselves.
+// The trial's scheduled revert then finds it inactive and does nothing. A
+// no-op when trials aren't configured.
+func CancelStripTrial(ctx context.Context, deviceID string, pin int) error {
+	if trialsTable == "" {
+		return nil
+	}
+
+	client, err := InitDynamoDB()
+	if err != nil {
+		return err
+	}
+
+	output, err := client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(trialsTable),
+		Key: map[string]types.AttributeValue{
+			"trialId": &types.AttributeValueMemberS{Value: TrialLockKey(deviceID, pin)},
+		},
+		ReturnValues: types.ReturnValueAllOld,
+	})
+	if err != nil {
+		return err
+	}
+	if len(output.Attributes) == 0 {
+		return nil
+	}
+
+	var lock TrialStripLock
+	if err := attributevalue.UnmarshalMap(output.Attributes, &lock); err != nil {
+		return err
+	}
+
+	_, err = client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(trialsTable),
+		Key: map[string]types.AttributeValue{
+			"trialId": &types.AttributeValueMemberS{Value: lock.ActiveTrialID},
+		},
+		UpdateExpression:    aws.String("SET #status = :status, updatedAt = :now"),
+		ConditionExpression: aws.String("#status = :active"),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "status",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":status": &types.AttributeValueMemberS{Value: TrialStatusCancelled},
+			":active": &types.AttributeValueMemberS{Value: TrialStatusActive},
+			":now":    &types.AttributeValueMemberS{Value: time.Now().Format(time.RFC3339Nano)},
+		},
+	})
+	if err != nil {
+		var conflict *types.ConditionalCheckFailedException
+		if errors.As(err, &conflict) {
+			return nil
+		}
+		return err
+	}
+	log.Printf("Cancelled trial %s on device %s pin %d", lock.ActiveTrialID, deviceID, pin)
+	return nil
+}
@@ -0,0 +1,502 @@
+package shared
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// twoFactorKey is the base64 AES-256 key that encrypts TOTP secrets at rest
+var twoFactorKey = os.Getenv("TWO_FACTOR_ENCRYPTION_KEY")
+
+// TOTPIssuer names the account in authenticator apps
+const TOTPIssuer = "Garage Lights"
+
+// TOTP parameters (RFC 6238 defaults, which every authenticator app supports)
+const (
+	totpStepSeconds = 30
+	totpDigits      = 6
+	totpDriftSteps  = 1 // Codes from one step either side are accepted for clock drift
+	totpSecretBytes = 20
+)
+
+// Recovery codes are issued when 2FA is confirmed; each works once
+const (
+	RecoveryCodeCount = 10
+	recoveryCodeBytes = 5 // 8 base32 characters, shown as xxxx-xxxx
+)
+
+// Verification attempts per user are limited to TwoFactorAttemptLimit in a
+// fixed window, covering login, confirm, and OAuth authorize
+const (
+	TwoFactorAttemptLimit  = 5
+	twoFactorAttemptWindow = 5 * time.Minute
+)
+
+// TwoFactorPendingLoginDuration is how long a pendingToken from login can be
+// exchanged for a session
+const TwoFactorPendingLoginDuration = 5 * time.Minute
+
+var (
+	// ErrTwoFactorNotConfigured is returned when TWO_FACTOR_ENCRYPTION_KEY is missing or invalid
+	ErrTwoFactorNotConfigured = errors.New("two-factor authentication is not configured")
+	// ErrTwoFactorRateLimited is returned by CountTwoFactorAttempt when the window is full
+	ErrTwoFactorRateLimited = errors.New("too many two-factor attempts; try again later")
+	// ErrTwoFactorAlreadyEnabled is returned by StartTwoFactorSetup for users who already use 2FA
+	ErrTwoFactorAlreadyEnabled = errors.New("two-factor authentication is already enabled")
+	// ErrTwoFactorCodeUsed is returned by SaveTwoFactorUse when a parallel
+	// check already used the code or finished the pending login
+	ErrTwoFactorCodeUsed = errors.New("two-factor code already used")
+)
+
+// TwoFactor is a user's TOTP state. Secrets are encrypted with
+// TWO_FACTOR_ENCRYPTION_KEY; recovery codes and pending login tokens are
+// stored as SHA-256 hashes.
+type TwoFactor struct {
+	Enabled               bool       `dynamodbav:"enabled"`
+	Secret                string     `dynamodbav:"secret,omitempty"`        // Encrypted secret in use once enabled
+	PendingSecret         string     `dynamodbav:"pendingSecret,omitempty"` // Encrypted secret from setup, until confirmed
+	RecoveryCodeHashes    []string   `dynamodbav:"recoveryCodeHashes,omitempty"`
+	LastStep              int64      `dynamodbav:"lastStep,omitempty"` // Last accepted TOTP step, so a code can't be replayed
+	EnabledAt             *time.Time `dynamodbav:"enabledAt,omitempty"`
+	PendingLoginHash      string     `dynamodbav:"pendingLoginHash,omitempty"`
+	PendingLoginExpiresAt int64      `dynamodbav:"pendingLoginExpiresAt,omitempty"`
+	PendingRememberMe     bool       `dynamodbav:"pendingRememberMe,omitempty"`
+	AttemptWindowStart    int64      `dynamodbav:"attemptWindowStart,omitempty"`
+	AttemptCount          int        `dynamodbav:"attemptCount,omitempty"`
+}
+
+// TwoFactorEnabled reports whether the user must pass a TOTP check to log in
+func (u User) TwoFactorEnabled() bool {
+	return u.TwoFactor != nil && u.TwoFactor.Enabled
+}
+
+// GenerateTOTPSecret returns a new random base32 TOTP secret
+func GenerateTOTPSecret() (string, error) {
+	secret := make([]byte, totpSecretBytes)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret), nil
+}
+
+// TOTPProvisioningURI is the otpauth:// URI authenticator apps scan
+func TOTPProvisioningURI(username, secret string) string {
+	label := url.PathEscape(TOTPIssuer + ":" + username)
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", TOTPIssuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", strconv.Itoa(totpDigits))
+	params.Set("period", strconv.Itoa(totpStepSeconds))
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// totpCode is the RFC 6238 code for step
+func totpCode(key []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod)
+}
+
+// VerifyTOTP checks code against secret at now, allowing totpDriftSteps of
+// clock drift. Steps at or before lastStep are refused so a code can't be
+// used twice. It returns the matched step, which the caller stores as the
+// new lastStep.
+func VerifyTOTP(secret, code string, now time.Time, lastStep int64) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return 0, false
+	}
+
+	current := now.Unix() / totpStepSeconds
+	for drift := int64(-totpDriftSteps); drift <= totpDriftSteps; drift++ {
+		step := current + drift
+		if step <= lastStep {
+			continue
+		}
+		if hmac.Equal([]byte(totpCode(key, step)), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// twoFactorCipher builds the AES-GCM cipher from TWO_FACTOR_ENCRYPTION_KEY
+func twoFactorCipher() (cipher.AEAD, error) {
+	key, err := base64.StdEncoding.DecodeString(twoFactorKey)
+	if err != nil || len(key) != 32 {
+		return nil, ErrTwoFactorNotConfigured
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// EncryptTwoFactorSecret encrypts a TOTP secret for storage
+func EncryptTwoFactorSecret(secret string) (string, error) {
+	gcm, err := twoFactorCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(secret), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// DecryptTwoFactorSecret reverses EncryptTwoFactorSecret
+func DecryptTwoFactorSecret(encrypted string) (string, error) {
+	gcm, err := twoFactorCipher()
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil || len(sealed) < gcm.NonceSize() {
+		return "", fmt.Errorf("malformed two-factor secret")
+	}
+	plain, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+// GenerateRecoveryCodes returns RecoveryCodeCount new codes and their hashes
+func GenerateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, RecoveryCodeCount)
+	hashes := make([]string, 0, RecoveryCodeCount)
+	for i := 0; i < RecoveryCodeCount; i++ {
+		raw := make([]byte, recoveryCodeBytes)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, nil, err
+		}
+		encoded := strings.ToLower(base32.StdEncoding.EncodeToString(raw))
+		code := encoded[:4] + "-" + encoded[4:]
+		codes = append(codes, code)
+		hashes = append(hashes, HashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// HashRecoveryCode is the stored form of a recovery code. Case, spaces, and
+// dashes are ignored so codes can be typed loosely.
+func HashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+// UseRecoveryCode removes code from tf if it matches an unused recovery code,
+// reporting whether it did. The caller saves tf to burn the code.
+func UseRecoveryCode(tf *TwoFactor, code string) bool {
+	hash := HashRecoveryCode(code)
+	for i, stored := range tf.RecoveryCodeHashes {
+		if hmac.Equal([]byte(stored), []byte(hash)) {
+			tf.RecoveryCodeHashes = append(tf.RecoveryCodeHashes[:i], tf.RecoveryCodeHashes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// TwoFactorUse is what a successful second-factor check used up, for
+// SaveTwoFactorUse to record
+type TwoFactorUse struct {
+	Step             int64  // Accepted TOTP step; 0 when a recovery code was used
+	RecoveryCodeHash string // Hash of the recovery code used, if any
+	PendingLoginHash string // Pending login the check finishes, if any
+}
+
+// VerifySecondFactor accepts either a current TOTP code or an unused
+// recovery code for a user with 2FA enabled, updating tf (last step or
+// remaining recovery codes) on success. The caller saves tf with the use.
+func VerifySecondFactor(tf *TwoFactor, code string, now time.Time) (TwoFactorUse, bool, error) {
+	secret, err := DecryptTwoFactorSecret(tf.Secret)
+	if err != nil {
+		return TwoFactorUse{}, false, err
+	}
+	if step, ok := VerifyTOTP(secret, code, now, tf.LastStep); ok {
+		tf.LastStep = step
+		return TwoFactorUse{Step: step}, true, nil
+	}
+	if UseRecoveryCode(tf, code) {
+		return TwoFactorUse{RecoveryCodeHash: HashRecoveryCode(code)}, true, nil
+	}
+	return TwoFactorUse{}, false, nil
+}
+
+// NewPendingLoginToken returns a token for finishing a 2FA login and the hash
+// to store. The username is carried in the token so verify can find the user.
+func NewPendingLoginToken(username string) (string, string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", err
+	}
+	token := hex.EncodeToString(secret) + "." + username
+	sum := sha256.Sum256([]byte(token))
+	return token, hex.EncodeToString(sum[:]), nil
+}
+
+// ParsePendingLoginToken returns the username in a pending login token and
+// the hash to compare with the stored one
+func ParsePendingLoginToken(token string) (string, string, bool) {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 || len(parts[0]) != 64 || parts[1] == "" {
+		return "", "", false
+	}
+	sum := sha256.Sum256([]byte(token))
+	return parts[1], hex.EncodeToString(sum[:]), true
+}
+
+// CountTwoFactorAttempt counts a verification attempt against the user's
+// window, opening a new window when the current one has passed. Returns
+// ErrTwoFactorRateLimited when the window is full. The user must already
+// have a twoFactor record.
+func CountTwoFactorAttempt(ctx context.Context, usersTable, username string) error {
+	client, err := InitDynamoDB()
+	if err != nil {
+		return err
+	}
+
+	window := time.Now().Truncate(twoFactorAttemptWindow).Unix()
+	key := map[string]types.AttributeValue{
+		"username": &types.AttributeValueMemberS{Value: username},
+	}
+	windowValue := &types.AttributeValueMemberN{Value: strconv.FormatInt(window, 10)}
+
+	// Same window: count the attempt if there's room
+	_, err = client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(usersTable),
+		Key:                 key,
+		UpdateExpression:    aws.String("ADD twoFactor.attemptCount :one"),
+		ConditionExpression: aws.String("twoFactor.attemptWindowStart = :window AND twoFactor.attemptCount < :limit"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":one":    &types.AttributeValueMemberN{Value: "1"},
+			":window": windowValue,
+			":limit":  &types.AttributeValueMemberN{Value: strconv.Itoa(TwoFactorAttemptLimit)},
+		},
+	})
+	var conflict *types.ConditionalCheckFailedException
+	if err == nil || !errors.As(err, &conflict) {
+		return err
+	}
+
+	// New window: reset the count
+	_, err = client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(usersTable),
+		Key:                 key,
+		UpdateExpression:    aws.String("SET twoFactor.attemptWindowStart = :window, twoFactor.attemptCount = :one"),
+		ConditionExpression: aws.String("attribute_exists(twoFactor) AND (attribute_not_exists(twoFactor.attemptWindowStart) OR twoFactor.attemptWindowStart <> :window)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":one":    &types.AttributeValueMemberN{Value: "1"},
+			":window": windowValue,
+		},
+	})
+	if errors.As(err, &conflict) {
+		return ErrTwoFactorRateLimited
+	}
+	return err
+}
+
+// The functions below write single twoFactor attributes rather than putting
+// the whole user, so they don't undo attempts counted meanwhile.
+
+// StartTwoFactorSetup stores a pending encrypted secret for a user who hasn't
+// enabled 2FA, replacing any earlier unconfirmed setup
+func StartTwoFactorSetup(ctx context.Context, usersTable, username, encryptedSecret string) error {
+	client, err := InitDynamoDB()
+	if err != nil {
+		return err
+	}
+
+	tf, err := attributevalue.Marshal(TwoFactor{PendingSecret: encryptedSecret})
+	if err != nil {
+		return err
+	}
+
+	_, err = client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(usersTable),
+		Key: map[string]types.AttributeValue{
+			"username": &types.AttributeValueMemberS{Value: username},
+		},
+		UpdateExpression:    aws.String("SET twoFactor = :tf"),
+		ConditionExpression: aws.String("attribute_exists(username) AND (attribute_not_exists(twoFactor) OR twoFactor.enabled = :false)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":tf":    tf,
+			":false": &types.AttributeValueMemberBOOL{Value: false},
+		},
+	})
+	var conflict *types.ConditionalCheckFailedException
+	if errors.As(err, &conflict) {
+		return ErrTwoFactorAlreadyEnabled
+	}
+	return err
+}
+
+// EnableTwoFactor promotes the pending secret after a code was confirmed,
+// storing the recovery code hashes and the step the code used
+func EnableTwoFactor(ctx context.Context, usersTable, username string, tf *TwoFactor, recoveryCodeHashes []string, step int64) error {
+	client, err := InitDynamoDB()
+	if err != nil {
+		return err
+	}
+
+	hashes, err := attributevalue.Marshal(recoveryCodeHashes)
+	if err != nil {
+		return err
+	}
+	enabledAt, err := attributevalue.Marshal(time.Now())
+	if err != nil {
+		return err
+	}
+
+	_, err = client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(usersTable),
+		Key: map[string]types.AttributeValue{
+			"username": &types.AttributeValueMemberS{Value: username},
+		},
+		UpdateExpression: aws.String("SET twoFactor.enabled = :true, twoFactor.secret = :secret, " +
+			"twoFactor.recoveryCodeHashes = :hashes, twoFactor.lastStep = :step, twoFactor.enabledAt = :now " +
+			"REMOVE twoFactor.pendingSecret"),
+		// The pending secret must still be the one that was verified
+		ConditionExpression: aws.String("twoFactor.pendingSecret = :secret"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":true":   &types.AttributeValueMemberBOOL{Value: true},
+			":secret": &types.AttributeValueMemberS{Value: tf.PendingSecret},
+			":hashes": hashes,
+			":step":   &types.AttributeValueMemberN{Value: strconv.FormatInt(step, 10)},
+			":now":    enabledAt,
+		},
+	})
+	return err
+}
+
+// StartTwoFactorLogin records a pending login after a correct password and
+// returns the token that POST /api/auth/2fa/verify exchanges for a session
+func StartTwoFactorLogin(ctx context.Context, usersTable, username string, rememberMe bool) (string, error) {
+	token, hash, err := NewPendingLoginToken(username)
+	if err != nil {
+		return "", err
+	}
+
+	client, err := InitDynamoDB()
+	if err != nil {
+		return "", err
+	}
+
+	expiresAt := time.Now().Add(TwoFactorPendingLoginDuration).Unix()
+	_, err = client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(usersTable),
+		Key: map[string]types.AttributeValue{
+			"username": &types.AttributeValueMemberS{Value: username},
+		},
+		UpdateExpression: aws.String("SET twoFactor.pendingLoginHash = :hash, " +
+			"twoFactor.pendingLoginExpiresAt = :expiresAt, twoFactor.pendingRememberMe = :rememberMe"),
+		ConditionExpression: aws.String("twoFactor.enabled = :true"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":hash":       &types.AttributeValueMemberS{Value: hash},
+			":expiresAt":  &types.AttributeValueMemberN{Value: strconv.FormatInt(expiresAt, 10)},
+			":rememberMe": &types.AttributeValueMemberBOOL{Value: rememberMe},
+			":true":       &types.AttributeValueMemberBOOL{Value: true},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// SaveTwoFactorUse records a successful second-factor check: the TOTP step
+// used or the remaining recovery codes, and the pending login it finished.
+// The update only applies if nothing else used the same step, recovery code
+// or pending login first; otherwise it returns ErrTwoFactorCodeUsed.
+func SaveTwoFactorUse(ctx context.Context, usersTable, username string, tf *TwoFactor, use TwoFactorUse) error {
+	client, err := InitDynamoDB()
+	if err != nil {
+		return err
+	}
+
+	conditions := []string{"twoFactor.enabled = :true"}
+	values := map[string]types.AttributeValue{
+		":true": &types.AttributeValueMemberBOOL{Value: true},
+	}
+	var update string
+	if use.RecoveryCodeHash != "" {
+		hashes, err := attributevalue.Marshal(append([]string{}, tf.RecoveryCodeHashes...))
+		if err != nil {
+			return err
+		}
+		// The stored list must be the one the code was taken from, so two
+		// codes used at once can't put each other back
+		update = "SET twoFactor.recoveryCodeHashes = :hashes"
+		conditions = append(conditions, "contains(twoFactor.recoveryCodeHashes, :used)",
+			"size(twoFactor.recoveryCodeHashes) = :count")
+		values[":hashes"] = hashes
+		values[":used"] = &types.AttributeValueMemberS{Value: use.RecoveryCodeHash}
+		values[":count"] = &types.AttributeValueMemberN{Value: strconv.Itoa(len(tf.RecoveryCodeHashes) + 1)}
+	} else {
+		update = "SET twoFactor.lastStep = :step"
+		conditions = append(conditions, "(attribute_not_exists(twoFactor.lastStep) OR twoFactor.lastStep < :step)")
+		values[":step"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(use.Step, 10)}
+	}
+	if use.PendingLoginHash != "" {
+		update += " REMOVE twoFactor.pendingLoginHash, twoFactor.pendingLoginExpiresAt, twoFactor.pendingRememberMe"
+		conditions = append(conditions, "twoFactor.pendingLoginHash = :pending")
+		values[":pending"] = &types.AttributeValueMemberS{Value: use.PendingLoginHash}
+	}
+
+	_, err = client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(usersTable),
+		Key: map[string]types.AttributeValue{
+			"username": &types.AttributeValueMemberS{Value: username},
+		},
+		UpdateExpression:          aws.String(update),
+		ConditionExpression:       aws.String(strings.Join(conditions, " AND ")),
+		ExpressionAttributeValues: values,
+	})
+	var conflict *types.ConditionalCheckFailedException
+	if errors.As(err, &conflict) {
+		return ErrTwoFactorCodeUsed
+	}
+	return err
+}
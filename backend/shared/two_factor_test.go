@@ -0,0 +1,140 @@
+package shared
+
+import (
+	"context"
+	"encoding/base32"
+	"encoding/base64"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+)
+
+// stubTwoFactorStore stands in for one user's stored twoFactor record,
+// applying SaveTwoFactorUse's conditions the way DynamoDB would
+type stubTwoFactorStore struct {
+	lastStep int64
+	hashes   []string
+	pending  string
+}
+
+func (s *stubTwoFactorStore) handle(call DynamoDBStubCall) (map[string]interface{}, error) {
+	if call.Operation != "UpdateItem" {
+		return nil, errors.New("unexpected " + call.Operation)
+	}
+	attrs, err := call.Attributes("ExpressionAttributeValues")
+	if err != nil {
+		return nil, err
+	}
+	var values struct {
+		Step    *int64   `dynamodbav:":step"`
+		Used    string   `dynamodbav:":used"`
+		Count   int      `dynamodbav:":count"`
+		Hashes  []string `dynamodbav:":hashes"`
+		Pending string   `dynamodbav:":pending"`
+	}
+	if err := attributevalue.UnmarshalMap(attrs, &values); err != nil {
+		return nil, err
+	}
+
+	if values.Pending != "" && values.Pending != s.pending {
+		return nil, ErrDynamoDBStubConditionFailed
+	}
+	if values.Step != nil && *values.Step <= s.lastStep {
+		return nil, ErrDynamoDBStubConditionFailed
+	}
+	if values.Used != "" {
+		found := false
+		for _, hash := range s.hashes {
+			found = found || hash == values.Used
+		}
+		if !found || len(s.hashes) != values.Count {
+			return nil, ErrDynamoDBStubConditionFailed
+		}
+	}
+
+	if values.Step != nil {
+		s.lastStep = *values.Step
+	}
+	if values.Used != "" {
+		s.hashes = values.Hashes
+	}
+	if values.Pending != "" {
+		s.pending = ""
+	}
+	return nil, nil
+}
+
+func withTwoFactorKey(t *testing.T) {
+	previous := twoFactorKey
+	twoFactorKey = base64.StdEncoding.EncodeToString(make([]byte, 32))
+	t.Cleanup(func() { twoFactorKey = previous })
+}
+
+func TestSaveTwoFactorUseRefusesParallelTOTPUse(t *testing.T) {
+	withTwoFactorKey(t)
+	secret, _ := GenerateTOTPSecret()
+	encrypted, err := EncryptTwoFactorSecret(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	now := time.Now()
+	code := totpCode(key, now.Unix()/totpStepSeconds)
+
+	store := &stubTwoFactorStore{lastStep: 1, pending: "pending-hash"}
+	defer StubDynamoDB(store.handle)()
+
+	// Both requests read the record before either saves
+	for i, want := range []error{nil, ErrTwoFactorCodeUsed} {
+		tf := &TwoFactor{Enabled: true, Secret: encrypted, LastStep: 1, PendingLoginHash: "pending-hash"}
+		use, valid, err := VerifySecondFactor(tf, code, now)
+		if err != nil || !valid {
+			t.Fatalf("request %d: VerifySecondFactor = %v, %v", i, valid, err)
+		}
+		use.PendingLoginHash = "pending-hash"
+		if err := SaveTwoFactorUse(context.Background(), "users", "sam", tf, use); !errors.Is(err, want) {
+			t.Errorf("request %d: SaveTwoFactorUse = %v, want %v", i, err, want)
+		}
+	}
+}
+
+func TestSaveTwoFactorUseRefusesParallelRecoveryCodeUse(t *testing.T) {
+	withTwoFactorKey(t)
+	encrypted, err := EncryptTwoFactorSecret("JBSWY3DPEHPK3PXP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes, hashes, err := GenerateRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := &stubTwoFactorStore{hashes: append([]string{}, hashes...)}
+	defer StubDynamoDB(store.handle)()
+
+	for i, want := range []error{nil, ErrTwoFactorCodeUsed} {
+		tf := &TwoFactor{Enabled: true, Secret: encrypted, RecoveryCodeHashes: append([]string{}, hashes...)}
+		use, valid, err := VerifySecondFactor(tf, codes[0], time.Now())
+		if err != nil || !valid {
+			t.Fatalf("request %d: VerifySecondFactor = %v, %v", i, valid, err)
+		}
+		if use.RecoveryCodeHash != hashes[0] {
+			t.Fatalf("request %d: used hash %q, want %q", i, use.RecoveryCodeHash, hashes[0])
+		}
+		if err := SaveTwoFactorUse(context.Background(), "users", "sam", tf, use); !errors.Is(err, want) {
+			t.Errorf("request %d: SaveTwoFactorUse = %v, want %v", i, err, want)
+		}
+	}
+	if len(store.hashes) != RecoveryCodeCount-1 {
+		t.Errorf("%d recovery codes left, want %d", len(store.hashes), RecoveryCodeCount-1)
+	}
+
+	// A different code read before the first was burned can't restore it
+	tf := &TwoFactor{Enabled: true, Secret: encrypted, RecoveryCodeHashes: append([]string{}, hashes...)}
+	use, _, _ := VerifySecondFactor(tf, codes[1], time.Now())
+	if err := SaveTwoFactorUse(context.Background(), "users", "sam", tf, use); !errors.Is(err, ErrTwoFactorCodeUsed) {
+		t.Errorf("stale recovery code list: SaveTwoFactorUse = %v, want ErrTwoFactorCodeUsed", err)
+	}
+}
@@ -0,0 +1,88 @@
+package shared
+
+import (
+	"context"
+	"log"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// userFieldDefaultsExpression adds the boolean User fields to records written
+// before they existed, leaving any value that is already set untouched
+const userFieldDefaultsExpression = "SET isAdmin = if_not_exists(isAdmin, :false), " +
+	"isServiceAccount = if_not_exists(isServiceAccount, :false), " +
+	"emailVerified = if_not_exists(emailVerified, :false), " +
+	"isActive = if_not_exists(isActive, :true)"
+
+// UserMigrationResult contains user table migration statistics
+type UserMigrationResult struct {
+	Scanned  int      `json:"scanned"`
+	Migrated int      `json:"migrated"`
+	Failed   int      `json:"failed"`
+	Errors   []string `json:"errors,omitempty"`
+}
+
+// MigrateUserTable scans every user and backfills isAdmin, isServiceAccount,
+// and emailVerified as false and isActive as true where missing, so index
+// queries on those attributes find older records. With dryRun set nothing is
+// written.
+func MigrateUserTable(ctx context.Context, tableName string, dryRun bool) (*UserMigrationResult, error) {
+	client, err := InitDynamoDB()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &UserMigrationResult{}
+	paginator := dynamodb.NewScanPaginator(client, &dynamodb.ScanInput{
+		TableName:            aws.String(tableName),
+		ProjectionExpression: aws.String("username"),
+	})
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return result, err
+		}
+
+		for _, item := range page.Items {
+			result.Scanned++
+
+			username, ok := item["username"].(*types.AttributeValueMemberS)
+			if !ok || username.Value == "" {
+				result.Failed++
+				result.Errors = append(result.Errors, "user record without a username")
+				continue
+			}
+
+			if dryRun {
+				log.Printf("[DRY RUN] Would backfill user fields for %s", username.Value)
+				result.Migrated++
+				continue
+			}
+
+			_, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+				TableName: aws.String(tableName),
+				Key: map[string]types.AttributeValue{
+					"username": username,
+				},
+				UpdateExpression: aws.String(userFieldDefaultsExpression),
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":false": &types.AttributeValueMemberBOOL{Value: false},
+					":true":  &types.AttributeValueMemberBOOL{Value: true},
+				},
+			})
+			if err != nil {
+				log.Printf("Failed to backfill user fields for %s: %v", username.Value, err)
+				result.Failed++
+				result.Errors = append(result.Errors, username.Value+": "+err.Error())
+				continue
+			}
+
+			result.Migrated++
+		}
+	}
+
+	return result, nil
+}
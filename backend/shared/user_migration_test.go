@@ -0,0 +1,95 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+// ifNotExistsClause matches "attr = if_not_exists(attr, :value)" in an
+// update expression
+var ifNotExistsClause = regexp.MustCompile(`(\w+) = if_not_exists\((\w+), (:\w+)\)`)
+
+// stubUserTable stands in for the users table, evaluating the
+// if_not_exists clauses of MigrateUserTable's updates
+type stubUserTable struct {
+	users map[string]map[string]interface{}
+}
+
+func (s *stubUserTable) handle(call DynamoDBStubCall) (map[string]interface{}, error) {
+	switch call.Operation {
+	case "Scan":
+		var items []interface{}
+		for username := range s.users {
+			items = append(items, map[string]string{"username": username})
+		}
+		return map[string]interface{}{"Items": DynamoDBStubItems(items...), "Count": len(items)}, nil
+	case "UpdateItem":
+		var key struct {
+			Username string `dynamodbav:"username"`
+		}
+		if err := call.Unmarshal("Key", &key); err != nil {
+			return nil, err
+		}
+		var values map[string]interface{}
+		if err := call.Unmarshal("ExpressionAttributeValues", &values); err != nil {
+			return nil, err
+		}
+		user := s.users[key.Username]
+		for _, clause := range ifNotExistsClause.FindAllStringSubmatch(call.String("UpdateExpression"), -1) {
+			if clause[1] != clause[2] {
+				return nil, errors.New("if_not_exists of another attribute: " + clause[0])
+			}
+			if _, ok := user[clause[1]]; !ok {
+				user[clause[1]] = values[clause[3]]
+			}
+		}
+		return nil, nil
+	}
+	return nil, errors.New("unexpected " + call.Operation)
+}
+
+func (s *stubUserTable) snapshot() map[string]map[string]interface{} {
+	copied := make(map[string]map[string]interface{}, len(s.users))
+	for username, attrs := range s.users {
+		copied[username] = make(map[string]interface{}, len(attrs))
+		for name, value := range attrs {
+			copied[username][name] = value
+		}
+	}
+	return copied
+}
+
+func TestMigrateUserTableIsIdempotent(t *testing.T) {
+	table := &stubUserTable{users: map[string]map[string]interface{}{
+		"old":       {"username": "old"},
+		"admin":     {"username": "admin", "isAdmin": true},
+		"suspended": {"username": "suspended", "isActive": false, "emailVerified": true},
+	}}
+	defer StubDynamoDB(table.handle)()
+
+	result, err := MigrateUserTable(context.Background(), "users", false)
+	if err != nil || result.Scanned != 3 || result.Failed != 0 {
+		t.Fatalf("first run = %+v, %v", result, err)
+	}
+
+	want := map[string]map[string]interface{}{
+		"old":       {"username": "old", "isAdmin": false, "isServiceAccount": false, "emailVerified": false, "isActive": true},
+		"admin":     {"username": "admin", "isAdmin": true, "isServiceAccount": false, "emailVerified": false, "isActive": true},
+		"suspended": {"username": "suspended", "isAdmin": false, "isServiceAccount": false, "emailVerified": true, "isActive": false},
+	}
+	if !reflect.DeepEqual(table.users, want) {
+		t.Errorf("after the first run:\n%v\nwant:\n%v", table.users, want)
+	}
+
+	migrated := table.snapshot()
+	result, err = MigrateUserTable(context.Background(), "users", false)
+	if err != nil || result.Failed != 0 {
+		t.Fatalf("second run = %+v, %v", result, err)
+	}
+	if !reflect.DeepEqual(table.users, migrated) {
+		t.Errorf("second run changed records:\n%v\nwas:\n%v", table.users, migrated)
+	}
+}
@@ -4,12 +4,18 @@ import (
     "context"
     "encoding/base64"
     "encoding/json"
+    "errors"
     "log"
     "os"
 
     "github.com/aws/aws-lambda-go/events"
+    "github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 )
 
+// ErrAccountSuspended is returned by ValidateAuth for a valid session whose
+// user has been suspended
+var ErrAccountSuspended = errors.New("account suspended")
+
 // GetEnv retrieves an environment variable or returns a default value
 func GetEnv(key, defaultValue string) string {
     if value := os.Getenv(key); value != "" {
@@ -46,6 +52,18 @@ func CreateSuccessResponse(statusCode int, data interface{}) events.APIGatewayPr
     return CreateResponse(statusCode, response)
 }
 
+// CreateSuccessResponseWithWarnings creates a success response that also
+// carries warnings the user should see, e.g. about a setting that was saved
+// but may not behave as they expect
+func CreateSuccessResponseWithWarnings(statusCode int, data interface{}, warnings []string) events.APIGatewayProxyResponse {
+    response := APIResponse{
+        Success:  true,
+        Data:     data,
+        Warnings: warnings,
+    }
+    return CreateResponse(statusCode, response)
+}
+
 // CreateErrorResponse creates an error response
 func CreateErrorResponse(statusCode int, message string) events.APIGatewayProxyResponse {
     response := APIResponse{
@@ -75,7 +93,10 @@ func GetSessionID(request events.APIGatewayProxyRequest) string {
     if cookie != "" {
         // Parse cookies (simple parsing for session_id cookie)
         cookiePairs := parseCookies(cookie)
-        if sessionID, ok := cookiePairs["session_id"]; ok {
+        if sessionID, ok := cookiePairs[SecureSessionCookieName]; ok {
+            return sessionID
+        }
+        if sessionID, ok := cookiePairs[SessionCookieName]; ok {
             return sessionID
         }
     }
@@ -147,13 +168,21 @@ func trimSpace(s string) string {
     return s[start:end]
 }
 
-// ValidateAuth validates the session and returns the username
+// ValidateAuth validates the session or API key and returns the username
 func ValidateAuth(ctx context.Context, request events.APIGatewayProxyRequest) (string, error) {
+    // API keys are checked first, so a key is never looked up as a session
+    if key := GetAPIKeyFromRequest(request.Headers); key != "" {
+        username, err := validateAPIKey(ctx, key, request.HTTPMethod, request.Path)
+        if err != nil || username == "" {
+            return "", err
+        }
+        return checkAccountActive(ctx, username)
+    }
+
     sessionID := GetSessionID(request)
     if sessionID == "" {
+        // Never log the headers: they may carry a key or session in any form
         log.Println("ValidateAuth: No session ID found in request")
-        log.Printf("ValidateAuth: Headers: %+v", request.Headers)
-        log.Printf("ValidateAuth: Cookies: %+v", request.Headers["Cookie"])
         return "", nil
     }
 
@@ -170,8 +199,103 @@ func ValidateAuth(ctx context.Context, request events.APIGatewayProxyRequest) (s
         return "", nil
     }
 
-    log.Printf("ValidateAuth: Session validated successfully for user: %s", session.Username)
-    return session.Username, nil
+    if session.Impersonation {
+        if err := checkImpersonation(ctx, session, request); err != nil {
+            return "", err
+        }
+    }
+
+    username, err := checkAccountActive(ctx, session.Username)
+    if username != "" {
+        log.Printf("ValidateAuth: Session validated successfully for user: %s", username)
+        if session.Impersonation {
+            recordImpersonation(ctx, session)
+        }
+        rotateSessionIfDue(ctx, session)
+    }
+    return username, err
+}
+
+// checkAccountActive returns username if the user still exists and isn't suspended
+func checkAccountActive(ctx context.Context, username string) (string, error) {
+    active, found, err := userAccountStatus(ctx, username)
+    if err != nil {
+        log.Printf("ValidateAuth: User lookup failed: %v", err)
+        return "", err
+    }
+
+    if !found {
+        log.Printf("ValidateAuth: User %s no longer exists", username)
+        return "", nil
+    }
+
+    if !active {
+        log.Printf("ValidateAuth: Account suspended for user: %s", username)
+        return "", ErrAccountSuspended
+    }
+
+    return username, nil
+}
+
+// userAccountStatus reports whether a user exists and is active
+func userAccountStatus(ctx context.Context, username string) (active bool, found bool, err error) {
+    key, _ := attributevalue.MarshalMap(map[string]string{
+        "username": username,
+    })
+
+    var user User
+    if err := GetItem(ctx, os.Getenv("USERS_TABLE"), key, &user); err != nil {
+        return false, false, err
+    }
+
+    if user.Username == "" {
+        return false, false, nil
+    }
+
+    // Saves IsFeatureEnabled a lookup later in the request
+    cacheFeatureFlags(username, user.FeatureFlags)
+
+    return user.IsActive, true, nil
+}
+
+// IsAccountSuspended reports whether an existing user has been suspended
+func IsAccountSuspended(ctx context.Context, username string) (bool, error) {
+    active, found, err := userAccountStatus(ctx, username)
+    if err != nil {
+        return false, err
+    }
+    return found && !active, nil
+}
+
+// checkNotSuspended returns ErrAccountSuspended if username is an existing,
+// suspended user, for credentials ValidateAuth doesn't see (Alexa tokens)
+func checkNotSuspended(ctx context.Context, username string) error {
+    suspended, err := IsAccountSuspended(ctx, username)
+    if err != nil {
+        return err
+    }
+    if suspended {
+        log.Printf("Account suspended for user: %s", username)
+        return ErrAccountSuspended
+    }
+    return nil
+}
+
+// AuthErrorResponse is the response for a request ValidateAuth rejected:
+// 403 for suspended accounts, out-of-scope API keys, and requests an
+// impersonation session can't make, 429 for rate-limited API keys, 401 otherwise
+func AuthErrorResponse(err error) events.APIGatewayProxyResponse {
+    switch {
+    case errors.Is(err, ErrAccountSuspended):
+        return CreateErrorResponse(403, "account suspended")
+    case errors.Is(err, ErrAPIKeyScope):
+        return CreateErrorResponse(403, ErrAPIKeyScope.Error())
+    case errors.Is(err, ErrImpersonationForbidden):
+        return CreateErrorResponse(403, ErrImpersonationForbidden.Error())
+    case errors.Is(err, ErrAPIKeyRateLimited):
+        return CreateErrorResponse(429, ErrAPIKeyRateLimited.Error())
+    }
+    return CreateErrorResponse(401, "Unauthorized")
 }
 
 // GetRequestBody returns the request body, decoding from base64 if needed
@@ -19,7 +19,7 @@ func CompileWLEDToBinary(state *WLEDState) ([]byte, error) {
 		return nil, errors.New("at least one segment is required")
 	}
 	if len(state.Segments) > WLEDBMaxSegments {
-		return nil, fmt.Errorf("too many segments: %d (max %d)", len(state.Segments), WLEDBMaxSegments)
+		return nil, errors.New(segmentCapError(state))
 	}
 
 	// Calculate total size
@@ -254,7 +254,7 @@ func ValidateWLEDState(state *WLEDState) (bool, []string) {
 	}
 
 	if len(state.Segments) > WLEDBMaxSegments {
-		errors = append(errors, fmt.Sprintf("too many segments: %d (max %d)", len(state.Segments), WLEDBMaxSegments))
+		errors = append(errors, segmentCapError(state))
 	}
 
 	for i, seg := range state.Segments {
@@ -317,6 +317,7 @@ func ParseWLEDJSON(jsonStr string) (*WLEDState, error) {
 			state.Segments[i].On = true
 		}
 	}
+	resolveSegmentSpeedLevels(&state)
 
 	return &state, nil
 }
@@ -411,22 +412,74 @@ func DetectBinaryFormat(data []byte) int {
 
 // CompileWLED is the main entry point - takes JSON string, returns binary
 func CompileWLED(jsonStr string) ([]byte, []string, error) {
+	binary, warnings, _, err := CompileWLEDWithMerge(jsonStr, false)
+	return binary, warnings, err
+}
+
+// CompileWLEDWithMerge is CompileWLED that, with autoMerge, first merges
+// adjacent identical segments of a state over WLEDBMaxSegments (see
+// MergeAdjacentSegments). The merged state is returned when that happened,
+// with a warning describing each merge.
+func CompileWLEDWithMerge(jsonStr string, autoMerge bool) ([]byte, []string, *WLEDState, error) {
 	state, err := ParseWLEDJSON(jsonStr)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
+	}
+
+	var merged *WLEDState
+	var mergeWarnings []string
+	if autoMerge && len(state.Segments) > WLEDBMaxSegments {
+		state, mergeWarnings = MergeAdjacentSegments(state)
+		if len(mergeWarnings) > 0 {
+			merged = state
+		}
 	}
 
 	valid, errors := ValidateWLEDState(state)
 	if !valid {
-		return nil, errors, fmt.Errorf("validation failed: %v", errors)
+		return nil, errors, nil, fmt.Errorf("validation failed: %v", errors)
 	}
 
 	binary, err := CompileWLEDToBinary(state)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 
-	return binary, nil, nil
+	return binary, append(mergeWarnings, wledColorWarnings(state)...), merged, nil
+}
+
+// wledColorWarnings reports segments whose colors don't fit the WLEDb color slots
+func wledColorWarnings(state *WLEDState) []string {
+	var warnings []string
+	for i, seg := range state.Segments {
+		if len(seg.Colors) > WLEDBMaxColors {
+			warnings = append(warnings, segmentColorWarning(i, len(seg.Colors)))
+		}
+	}
+	return warnings
+}
+
+// segmentColorWarning reports segment i's colors beyond the WLEDb color slots
+func segmentColorWarning(i, colors int) string {
+	return fmt.Sprintf("Segment %d: %s; use a WLED palette (\"pal\") for more colors",
+		i, PaletteTruncationWarning(colors, WLEDBMaxColors))
+}
+
+// WLEDSegmentColorsHex lists each segment's colors as hex strings, as the
+// device will show them
+func WLEDSegmentColorsHex(state *WLEDState) [][]string {
+	segments := make([][]string, len(state.Segments))
+	for i, seg := range state.Segments {
+		colors := make([]string, 0, len(seg.Colors))
+		for _, c := range seg.Colors {
+			if len(c) < 3 {
+				continue
+			}
+			colors = append(colors, fmt.Sprintf("#%02X%02X%02X", clampByte(c[0]), clampByte(c[1]), clampByte(c[2])))
+		}
+		segments[i] = colors
+	}
+	return segments
 }
 
 // Helper function to clamp values to byte range
@@ -463,12 +516,32 @@ func CreateDefaultWLEDState(ledCount int) *WLEDState {
 	}
 }
 
+// ConvertLCLToWLEDWarnings reports what ConvertLCLToWLED drops from spec
+func ConvertLCLToWLEDWarnings(spec *PatternSpec) []string {
+	if spec != nil && len(spec.Segments) > 0 {
+		var warnings []string
+		for i := range spec.Segments {
+			for _, w := range ConvertLCLToWLEDWarnings(&spec.Segments[i].PatternSpec) {
+				warnings = append(warnings, fmt.Sprintf("segment %d: %s", i, w))
+			}
+		}
+		return warnings
+	}
+	if spec == nil || len(spec.Colors) <= WLEDBMaxColors {
+		return nil
+	}
+	return []string{PaletteTruncationWarning(len(spec.Colors), WLEDBMaxColors) + "; use a WLED palette (\"pal\") for more colors"}
+}
+
 // ConvertLCLToWLED attempts to convert an LCL PatternSpec to WLEDState
 // This is used for migration of existing patterns
 func ConvertLCLToWLED(spec *PatternSpec, ledCount int) (*WLEDState, error) {
 	if spec == nil {
 		return nil, errors.New("spec is nil")
 	}
+	if len(spec.Segments) > 0 {
+		return convertLCLSegmentsToWLED(spec, ledCount)
+	}
 
 	// Map LCL effect to WLED effect
 	wledFX, ok := LCLToWLEDEffectMap[strings.ToLower(spec.Effect)]
@@ -476,10 +549,10 @@ func ConvertLCLToWLED(spec *PatternSpec, ledCount int) (*WLEDState, error) {
 		wledFX = WLEDFXSolid // Default to solid
 	}
 
-	// Build colors array
-	colors := make([][]int, 0, 3)
+	// Build colors array (WLEDb has WLEDBMaxColors slots; see ConvertLCLToWLEDWarnings)
+	colors := make([][]int, 0, WLEDBMaxColors)
 	for i, colorStr := range spec.Colors {
-		if i >= 3 {
+		if i >= WLEDBMaxColors {
 			break
 		}
 		r, g, b, err := parseHexColor(colorStr)
@@ -504,9 +577,12 @@ func ConvertLCLToWLED(spec *PatternSpec, ledCount int) (*WLEDState, error) {
 		}
 	}
 
-	// Map LCL parameters to WLED parameters
+	// Map LCL parameters to WLED parameters. Speed words go through the
+	// effect's speed curve; numeric speeds are raw sx.
 	speed := spec.Speed
-	if speed == 0 {
+	if spec.SpeedLevel != nil {
+		speed = NormalizedSpeedToSx(wledFX, *spec.SpeedLevel)
+	} else if speed == 0 {
 		speed = 128
 	}
 
@@ -564,7 +640,7 @@ func ConvertLCLToWLED(spec *PatternSpec, ledCount int) (*WLEDState, error) {
 	}
 
 	// Handle direction
-	if spec.Direction == 1 {
+	if spec.GetDirection() == 1 {
 		seg.Reverse = true
 	}
 
@@ -112,6 +112,7 @@ type EffectMetadata struct {
 	Custom1Desc string   // Description of c1
 	Custom2Desc string   // Description of c2
 	Custom3Desc string   // Description of c3
+	SpeedCurve  SpeedCurve // Maps normalized speed (0-100) to sx; zero value means DefaultSpeedCurve
 }
 
 // SupportedEffects contains metadata for effects we support in the firmware
@@ -133,6 +134,7 @@ var SupportedEffects = map[int]EffectMetadata{
 		MaxColors:   2,
 		SpeedDesc:   "Breath rate",
 		IntensDesc:  "Minimum brightness",
+		SpeedCurve:  SpeedCurve{Kind: SpeedCurveLinear, Min: 10, Max: 230},
 	},
 	WLEDFXWipe: {
 		ID:          WLEDFXWipe,
@@ -177,6 +179,7 @@ var SupportedEffects = map[int]EffectMetadata{
 		SpeedDesc:   "Scan speed",
 		IntensDesc:  "Eye width",
 		Custom1Desc: "Trail length",
+		SpeedCurve:  SpeedCurve{Kind: SpeedCurveLog, Min: 20, Max: 200}, // Frantic well before sx 255
 	},
 	WLEDFXRainbow: {
 		ID:          WLEDFXRainbow,
@@ -213,6 +216,7 @@ var SupportedEffects = map[int]EffectMetadata{
 		SpeedDesc:   "Flame speed",
 		IntensDesc:  "Cooling (flame height)",
 		Custom1Desc: "Sparking (new flames)",
+		SpeedCurve:  SpeedCurve{Kind: SpeedCurveLinear, Min: 60, Max: 240}, // Flames look frozen below ~60
 	},
 	WLEDFXCandle: {
 		ID:          WLEDFXCandle,
@@ -0,0 +1,169 @@
+package shared
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SegmentMerge is a run of segments that touch end to end and have identical
+// settings, so they can play as one segment over their combined range
+type SegmentMerge struct {
+	Segments []int // Indexes into WLEDState.Segments, in LED order
+	Start    int
+	Stop     int
+}
+
+// FindSegmentMerges returns the runs of adjacent segments with identical
+// effect, parameters, colors, palette, and flags
+func FindSegmentMerges(state *WLEDState) []SegmentMerge {
+	order := make([]int, len(state.Segments))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return state.Segments[order[a]].Start < state.Segments[order[b]].Start
+	})
+
+	var merges []SegmentMerge
+	var run []int
+	flush := func() {
+		if len(run) > 1 {
+			merges = append(merges, SegmentMerge{
+				Segments: run,
+				Start:    state.Segments[run[0]].Start,
+				Stop:     state.Segments[run[len(run)-1]].Stop,
+			})
+		}
+	}
+	for _, i := range order {
+		if len(run) > 0 {
+			last := state.Segments[run[len(run)-1]]
+			if last.Stop == state.Segments[i].Start && sameSegmentSettings(state.Segments[run[0]], state.Segments[i]) {
+				run = append(run, i)
+				continue
+			}
+		}
+		flush()
+		run = []int{i}
+	}
+	flush()
+	return merges
+}
+
+// sameSegmentSettings reports whether two segments differ only in ID and
+// LED range. SpeedLevel is ignored as ParseWLEDJSON has resolved it into sx.
+func sameSegmentSettings(a, b WLEDSegment) bool {
+	a.ID, a.Start, a.Stop, a.SpeedLevel = 0, 0, 0, nil
+	b.ID, b.Start, b.Stop, b.SpeedLevel = 0, 0, 0, nil
+	return reflect.DeepEqual(a, b)
+}
+
+// MergeAdjacentSegments returns a copy of state with each run from
+// FindSegmentMerges replaced by one segment, and a description of each
+// merge. The merged segment takes the place of the run's first segment.
+// Effects then animate across the combined range rather than per segment.
+func MergeAdjacentSegments(state *WLEDState) (*WLEDState, []string) {
+	merges := FindSegmentMerges(state)
+	merged := *state
+	if len(merges) == 0 {
+		return &merged, nil
+	}
+
+	replace := make(map[int]SegmentMerge)
+	drop := make(map[int]bool)
+	var changes []string
+	for _, m := range merges {
+		first := m.Segments[0]
+		for _, i := range m.Segments {
+			if i < first {
+				first = i
+			}
+		}
+		for _, i := range m.Segments {
+			drop[i] = i != first
+		}
+		replace[first] = m
+		changes = append(changes, fmt.Sprintf("Merged segments %s into one (LEDs %d-%d)", segmentList(m.Segments), m.Start, m.Stop))
+	}
+
+	merged.Segments = nil
+	for i, seg := range state.Segments {
+		if drop[i] {
+			continue
+		}
+		if m, ok := replace[i]; ok {
+			seg.Start, seg.Stop = m.Start, m.Stop
+		}
+		merged.Segments = append(merged.Segments, seg)
+	}
+	return &merged, changes
+}
+
+// segmentCapError explains a state with more segments than
+// WLEDBMaxSegments: which segments are over the cap, and which adjacent
+// segments could be merged to get under it
+func segmentCapError(state *WLEDState) string {
+	count := len(state.Segments)
+	over := make([]int, 0, count-WLEDBMaxSegments)
+	for i := WLEDBMaxSegments; i < count; i++ {
+		over = append(over, i)
+	}
+	msg := fmt.Sprintf("too many segments: %d (max %d); segments %s are over the cap", count, WLEDBMaxSegments, segmentList(over))
+
+	merges := FindSegmentMerges(state)
+	if len(merges) == 0 {
+		return msg + "; no adjacent segments share settings, so combine or remove segments in the editor"
+	}
+
+	saved := 0
+	var suggestions []string
+	for _, m := range merges {
+		saved += len(m.Segments) - 1
+		suggestions = append(suggestions, fmt.Sprintf("segments %s (LEDs %d-%d)", segmentList(m.Segments), m.Start, m.Stop))
+	}
+	msg += "; these adjacent segments have identical settings and can be merged: " + strings.Join(suggestions, ", ")
+	if remaining := count - saved; remaining > WLEDBMaxSegments {
+		return msg + fmt.Sprintf("; merging leaves %d segments, so remove or combine %d more", remaining, remaining-WLEDBMaxSegments)
+	}
+	return msg + "; retry with autoMerge=true to merge them"
+}
+
+// segmentList formats segment indexes as "2, 3, 4"
+func segmentList(indexes []int) string {
+	parts := make([]string, len(indexes))
+	for i, n := range indexes {
+		parts[i] = strconv.Itoa(n)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// AutoMergePatternSegments merges adjacent identical segments of a WLED
+// pattern that has more than WLEDBMaxSegments, rewriting its WLEDState. It
+// returns a description of each merge; patterns within the cap, and other
+// formats, are left alone.
+func AutoMergePatternSegments(p *Pattern) ([]string, error) {
+	if ResolvePatternFormat(*p) != PatternFormatWLED {
+		return nil, nil
+	}
+	state, err := ParseWLEDJSON(p.WLEDState)
+	if err != nil {
+		return nil, fmt.Errorf("invalid WLED state: %v", err)
+	}
+	if len(state.Segments) <= WLEDBMaxSegments {
+		return nil, nil
+	}
+
+	merged, changes := MergeAdjacentSegments(state)
+	if len(changes) == 0 {
+		return nil, nil
+	}
+	wledJSON, err := WLEDStateToJSON(merged)
+	if err != nil {
+		return nil, err
+	}
+	p.WLEDState = wledJSON
+	return changes, nil
+}
@@ -0,0 +1,216 @@
+package shared
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+)
+
+// RGBColor is a single simulated LED color
+type RGBColor = RGB
+
+// SimulatorFrameMs is the simulated time between preview frames
+const SimulatorFrameMs = 50
+
+// Preview frame count limits
+const (
+	DefaultPreviewFrames = 20
+	MaxPreviewFrames     = 200
+)
+
+// SimulateWLEDFrames approximates how a WLED state animates on a strip.
+// It returns frameCount frames of ledCount colors, advancing 50ms per frame.
+// Effects without a dedicated simulation render as solid.
+func SimulateWLEDFrames(state *WLEDState, frameCount int, ledCount int) ([][]RGBColor, error) {
+	if state == nil {
+		return nil, fmt.Errorf("state is required")
+	}
+	if frameCount <= 0 || frameCount > MaxPreviewFrames {
+		return nil, fmt.Errorf("frame count must be 1-%d", MaxPreviewFrames)
+	}
+	if ledCount <= 0 {
+		return nil, fmt.Errorf("LED count must be positive")
+	}
+
+	frames := make([][]RGBColor, frameCount)
+	for f := 0; f < frameCount; f++ {
+		frame := make([]RGBColor, ledCount)
+		if state.On {
+			for _, seg := range state.Segments {
+				if seg.On {
+					simulateSegment(frame, &seg, f)
+				}
+			}
+			scaleFrame(frame, BrightnessByte(state.Brightness).Fraction())
+		}
+		frames[f] = frame
+	}
+
+	return frames, nil
+}
+
+// simulateSegment renders one segment of a frame in place
+func simulateSegment(frame []RGBColor, seg *WLEDSegment, frameIndex int) {
+	start := seg.Start
+	if start < 0 {
+		start = 0
+	}
+	stop := seg.Stop
+	if stop > len(frame) || stop <= start {
+		stop = len(frame)
+	}
+	length := stop - start
+	if length <= 0 {
+		return
+	}
+
+	primary := segmentColor(seg, 0, RGBColor{R: 255, G: 255, B: 255})
+	secondary := segmentColor(seg, 1, RGBColor{})
+	timeMs := frameIndex * SimulatorFrameMs
+	periodMs := simulatorPeriodMs(seg.Speed)
+	intensity := clampByte(seg.Intensity)
+
+	pixels := make([]RGBColor, length)
+
+	switch seg.EffectID {
+	case WLEDFXBreathe:
+		phase := float64(timeMs%periodMs) / float64(periodMs)
+		level := 0.1 + 0.9*(1-math.Cos(2*math.Pi*phase))/2
+		for i := range pixels {
+			pixels[i] = scaleColor(primary, level)
+		}
+
+	case WLEDFXBlink:
+		on := timeMs%periodMs < periodMs/2
+		for i := range pixels {
+			if on {
+				pixels[i] = primary
+			} else {
+				pixels[i] = secondary
+			}
+		}
+
+	case WLEDFXScanner, WLEDFXScan:
+		// Eye moves back and forth, one bounce per period
+		phase := float64(timeMs%periodMs) / float64(periodMs)
+		travel := phase * 2
+		if travel > 1 {
+			travel = 2 - travel
+		}
+		eye := int(math.Round(travel * float64(length-1)))
+		tail := 1 + intensity*length/512
+		for i := range pixels {
+			dist := i - eye
+			if dist < 0 {
+				dist = -dist
+			}
+			if dist <= tail {
+				pixels[i] = blendColor(secondary, primary, 1-float64(dist)/float64(tail+1))
+			} else {
+				pixels[i] = secondary
+			}
+		}
+
+	case WLEDFXFire2012:
+		// Deterministic per frame so previews are reproducible
+		rng := rand.New(rand.NewSource(int64(frameIndex)))
+		cooling := 55 + intensity/4
+		for i := range pixels {
+			heat := 255 - (i*cooling*2)/length - rng.Intn(cooling)
+			if heat < 0 {
+				heat = 0
+			}
+			pixels[i] = heatColor(heat)
+		}
+
+	case WLEDFXCandle:
+		rng := rand.New(rand.NewSource(int64(frameIndex)))
+		for i := range pixels {
+			pixels[i] = scaleColor(primary, 0.6+0.4*rng.Float64())
+		}
+
+	case WLEDFXSparkle:
+		rng := rand.New(rand.NewSource(int64(frameIndex)))
+		for i := range pixels {
+			pixels[i] = secondary
+		}
+		pixels[rng.Intn(length)] = primary
+
+	case WLEDFXRainbow, WLEDFXColorloop:
+		hue := math.Mod(float64(timeMs)/float64(periodMs)*360, 360)
+		for i := range pixels {
+			pixels[i] = HSBToRGB(hue, 1, 1)
+		}
+
+	case WLEDFXRainbowRunner, WLEDFXColorwaves:
+		offset := float64(timeMs) / float64(periodMs) * 360
+		for i := range pixels {
+			hue := math.Mod(offset+float64(i)*360/float64(length), 360)
+			pixels[i] = HSBToRGB(hue, 1, 1)
+		}
+
+	default:
+		for i := range pixels {
+			pixels[i] = primary
+		}
+	}
+
+	for i, c := range pixels {
+		idx := i
+		if seg.Reverse {
+			idx = length - 1 - i
+		}
+		frame[start+idx] = c
+	}
+}
+
+// simulatorPeriodMs is the cycle length of an effect at speed. WLED speed
+// 0-255 maps to roughly a 5s (slow) to 0.5s (fast) cycle; values outside
+// that range are clamped, so the period is always positive.
+func simulatorPeriodMs(speed int) int {
+	return 5000 - (clampByte(speed) * 4500 / 255)
+}
+
+func segmentColor(seg *WLEDSegment, index int, fallback RGBColor) RGBColor {
+	if index >= len(seg.Colors) || len(seg.Colors[index]) < 3 {
+		return fallback
+	}
+	c := seg.Colors[index]
+	return RGBColor{R: uint8(clampByte(c[0])), G: uint8(clampByte(c[1])), B: uint8(clampByte(c[2]))}
+}
+
+func scaleColor(c RGBColor, factor float64) RGBColor {
+	return RGBColor{
+		R: uint8(float64(c.R) * factor),
+		G: uint8(float64(c.G) * factor),
+		B: uint8(float64(c.B) * factor),
+	}
+}
+
+func scaleFrame(frame []RGBColor, factor float64) {
+	for i := range frame {
+		frame[i] = scaleColor(frame[i], factor)
+	}
+}
+
+// blendColor mixes from a toward b by amount (0-1)
+func blendColor(a, b RGBColor, amount float64) RGBColor {
+	mix := func(x, y uint8) uint8 {
+		return uint8(float64(x) + (float64(y)-float64(x))*amount)
+	}
+	return RGBColor{R: mix(a.R, b.R), G: mix(a.G, b.G), B: mix(a.B, b.B)}
+}
+
+// heatColor maps a 0-255 heat value to black -> red -> yellow -> white, as Fire2012 does
+func heatColor(heat int) RGBColor {
+	t := heat * 191 / 255
+	ramp := uint8((t & 0x3F) << 2)
+	switch {
+	case t > 0x80:
+		return RGBColor{R: 255, G: 255, B: ramp}
+	case t > 0x40:
+		return RGBColor{R: 255, G: ramp, B: 0}
+	default:
+		return RGBColor{R: ramp, G: 0, B: 0}
+	}
+}
@@ -0,0 +1,105 @@
+package shared
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSimulateWLEDFramesCounts(t *testing.T) {
+	state := &WLEDState{On: true, Brightness: 255, Segments: []WLEDSegment{
+		{Start: 0, Stop: 10, EffectID: WLEDFXSolid, On: true, Colors: [][]int{{255, 0, 0}}},
+	}}
+
+	for _, frameCount := range []int{1, DefaultPreviewFrames, MaxPreviewFrames} {
+		frames, err := SimulateWLEDFrames(state, frameCount, 10)
+		if err != nil {
+			t.Fatalf("%d frames: %v", frameCount, err)
+		}
+		if len(frames) != frameCount {
+			t.Errorf("got %d frames, want %d", len(frames), frameCount)
+		}
+		for i, frame := range frames {
+			if len(frame) != 10 {
+				t.Fatalf("frame %d has %d LEDs, want 10", i, len(frame))
+			}
+		}
+	}
+
+	for _, tt := range []struct {
+		state      *WLEDState
+		frameCount int
+		ledCount   int
+	}{
+		{nil, 1, 10},
+		{state, 0, 10},
+		{state, MaxPreviewFrames + 1, 10},
+		{state, 1, 0},
+	} {
+		if _, err := SimulateWLEDFrames(tt.state, tt.frameCount, tt.ledCount); err == nil {
+			t.Errorf("SimulateWLEDFrames(%v, %d, %d) succeeded, want an error", tt.state, tt.frameCount, tt.ledCount)
+		}
+	}
+}
+
+func TestSimulateWLEDFramesTiming(t *testing.T) {
+	red, black := RGBColor{R: 255}, RGBColor{}
+	blink := func(speed int) *WLEDState {
+		return &WLEDState{On: true, Brightness: 255, Segments: []WLEDSegment{
+			{Start: 0, Stop: 4, EffectID: WLEDFXBlink, Speed: speed, On: true, Colors: [][]int{{255, 0, 0}, {0, 0, 0}}},
+		}}
+	}
+
+	// At full speed a cycle is 500ms: 5 frames on, then 5 off
+	frames, err := SimulateWLEDFrames(blink(255), 20, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, frame := range frames {
+		want := red
+		if (i*SimulatorFrameMs)%500 >= 250 {
+			want = black
+		}
+		if frame[0] != want {
+			t.Errorf("frame %d (%dms) = %v, want %v", i, i*SimulatorFrameMs, frame[0], want)
+		}
+	}
+
+	// At speed 0 the 5s cycle stays on for the whole 1s preview
+	frames, err = SimulateWLEDFrames(blink(0), 20, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, frame := range frames {
+		if frame[0] != red {
+			t.Errorf("slow frame %d = %v, want %v", i, frame[0], red)
+		}
+	}
+}
+
+func TestSimulateWLEDFramesClampsSpeed(t *testing.T) {
+	if got := simulatorPeriodMs(255); got != 500 {
+		t.Errorf("period at 255 = %dms, want 500", got)
+	}
+	if got := simulatorPeriodMs(0); got != 5000 {
+		t.Errorf("period at 0 = %dms, want 5000", got)
+	}
+
+	for _, effect := range []int{WLEDFXBreathe, WLEDFXBlink, WLEDFXScanner, WLEDFXFire2012, WLEDFXRainbow, WLEDFXRainbowRunner} {
+		simulate := func(speed, intensity int) [][]RGBColor {
+			state := &WLEDState{On: true, Brightness: 255, Segments: []WLEDSegment{
+				{Start: 0, Stop: 8, EffectID: effect, Speed: speed, Intensity: intensity, On: true, Colors: [][]int{{255, 0, 0}}},
+			}}
+			frames, err := SimulateWLEDFrames(state, 12, 8)
+			if err != nil {
+				t.Fatalf("effect %d at speed %d: %v", effect, speed, err)
+			}
+			return frames
+		}
+		if !reflect.DeepEqual(simulate(1000, 5000), simulate(255, 255)) {
+			t.Errorf("effect %d: speed 1000 differs from 255", effect)
+		}
+		if !reflect.DeepEqual(simulate(-300, -300), simulate(0, 0)) {
+			t.Errorf("effect %d: speed -300 differs from 0", effect)
+		}
+	}
+}
@@ -7,7 +7,7 @@ package shared
 // WLEDState represents the top-level WLED state object
 type WLEDState struct {
 	On         bool          `json:"on"`                    // Master power state
-	Brightness int           `json:"bri"`                   // Global brightness (0-255)
+	Brightness int           `json:"bri"`                   // Global brightness; a BrightnessByte (0-255)
 	Transition int           `json:"transition,omitempty"`  // Transition time in 100ms units
 	Segments   []WLEDSegment `json:"seg"`                   // Segment configurations
 }
@@ -19,6 +19,7 @@ type WLEDSegment struct {
 	Stop      int     `json:"stop"`           // Stop LED index (exclusive)
 	EffectID  int     `json:"fx"`             // WLED effect ID
 	Speed     int     `json:"sx,omitempty"`   // Effect speed (0-255)
+	SpeedLevel *int   `json:"speedLevel,omitempty"` // Normalized speed (0-100); sets sx through the effect's curve when sx is absent
 	Intensity int     `json:"ix,omitempty"`   // Effect intensity (0-255)
 	Custom1   int     `json:"c1,omitempty"`   // Custom parameter 1
 	Custom2   int     `json:"c2,omitempty"`   // Custom parameter 2
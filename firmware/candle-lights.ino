@@ -272,6 +272,8 @@ struct StripRuntime {
     #define DEVICE_PLATFORM_NAME "photon"
 #elif PLATFORM_ID == PLATFORM_ELECTRON
     #define DEVICE_PLATFORM_NAME "electron"
+#elif PLATFORM_ID == PLATFORM_P2
+    #define DEVICE_PLATFORM_NAME "photon2"
 #elif PLATFORM_ID == PLATFORM_ARGON
     #define DEVICE_PLATFORM_NAME "argon"
 #elif PLATFORM_ID == PLATFORM_BORON
@@ -287,12 +289,19 @@ uint8_t numStrips = 0;
 
 // Timing
 unsigned long lastUpdate = 0;
+unsigned long lastDeviceInfoUpdate = 0;
+#define DEVICE_INFO_INTERVAL_MS 10000  // How often deviceInfo's free memory is refreshed
 
 // Cloud variables (622 char max each)
 char deviceInfo[128];
 char stripInfo[622];    // Strip configs: "D6:8:1:128:50:2;D2:12:5:255:30:1"
 char colorsInfo[622];   // All colors: "6=255,0,0,50;0,255,0,50|2=255,100,0,100"
 char queryResult[622];  // Result buffer for getStrip/getColors queries
+char lastCmdId[17] = "";  // Nonce of the last command that succeeded
+
+// Commands may end with a nonce: "6,AAEC|=9f86d081". It's echoed in lastCmdId
+// so the backend can tell whether a call that timed out actually ran.
+#define COMMAND_NONCE_SEPARATOR "|="
 
 // Pin mapping helper
 uint16_t pinFromNumber(uint8_t num) {
@@ -418,12 +427,17 @@ void updateColorsInfo() {
     }
 }
 
+// Update deviceInfo: "version|platform|maxStrips|maxLeds|maxColors|freeMem".
+// Free memory changes as strips and patterns load, so loop() refreshes it.
+void updateDeviceInfo() {
+    snprintf(deviceInfo, sizeof(deviceInfo), "%s|%s|%d|%d|%d|%lu",
+             FIRMWARE_VERSION, DEVICE_PLATFORM_NAME, MAX_STRIPS, MAX_LEDS_PER_STRIP,
+             MAX_COLORS_PER_STRIP, (unsigned long)System.freeMemory());
+}
+
 // Update all info variables
 void updateAllInfo() {
-    // Populate deviceInfo: "version|platform|maxStrips|maxLeds"
-    snprintf(deviceInfo, sizeof(deviceInfo), "%s|%s|%d|%d",
-             FIRMWARE_VERSION, DEVICE_PLATFORM_NAME, MAX_STRIPS, MAX_LEDS_PER_STRIP);
-
+    updateDeviceInfo();
     updateStripInfo();
     updateColorsInfo();
 }
@@ -546,6 +560,24 @@ void destroyAllStrips() {
 // CLOUD FUNCTIONS
 // =============================================================================
 
+// Run a cloud function on its command with any nonce split off, recording
+// the nonce in lastCmdId when the function succeeds
+int runCommand(int (*fn)(String), String command) {
+    String nonce = "";
+    int sep = command.lastIndexOf(COMMAND_NONCE_SEPARATOR);
+    if (sep >= 0) {
+        nonce = command.substring(sep + strlen(COMMAND_NONCE_SEPARATOR));
+        command = command.substring(0, sep);
+    }
+
+    int result = fn(command);
+    if (result >= 0 && nonce.length() > 0) {
+        strncpy(lastCmdId, nonce.c_str(), sizeof(lastCmdId) - 1);
+        lastCmdId[sizeof(lastCmdId) - 1] = '\0';
+    }
+    return result;
+}
+
 // Add or update a strip: "pin,ledCount" e.g., "6,8" for D6 with 8 LEDs
 int addStrip(String command) {
     int comma = command.indexOf(',');
@@ -2822,6 +2854,13 @@ void runPattern(int idx) {
     strip->show();
 }
 
+// Registered cloud functions, accepting a command nonce
+int addStripCommand(String command) { return runCommand(addStrip, command); }
+int removeStripCommand(String command) { return runCommand(removeStrip, command); }
+int setBytecodeCommand(String command) { return runCommand(setBytecode, command); }
+int saveConfigCommand(String command) { return runCommand(saveConfig, command); }
+int clearAllCommand(String command) { return runCommand(clearAll, command); }
+
 void setup() {
     Serial.begin(9600);
     delay(1000);
@@ -2832,15 +2871,16 @@ void setup() {
     updateAllInfo();
 
     // Register cloud functions
-    Particle.function("addStrip", addStrip);
-    Particle.function("removeStrip", removeStrip);
-    Particle.function("setBytecode", setBytecode);
-    Particle.function("saveConfig", saveConfig);
-    Particle.function("clearAll", clearAll);
+    Particle.function("addStrip", addStripCommand);
+    Particle.function("removeStrip", removeStripCommand);
+    Particle.function("setBytecode", setBytecodeCommand);
+    Particle.function("saveConfig", saveConfigCommand);
+    Particle.function("clearAll", clearAllCommand);
     
     // Register variables
     Particle.variable("deviceInfo", deviceInfo);
     Particle.variable("strips", stripInfo);
+    Particle.variable("lastCmdId", lastCmdId);
 }
 
 void loop() {
@@ -2851,4 +2891,8 @@ void loop() {
             runPattern(i);
         }
     }
+    if (now - lastDeviceInfoUpdate >= DEVICE_INFO_INTERVAL_MS) {
+        lastDeviceInfoUpdate = now;
+        updateDeviceInfo();
+    }
 }
\ No newline at end of file
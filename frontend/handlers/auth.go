@@ -10,11 +10,14 @@ import (
 	"time"
 
 	"github.com/gofiber/fiber/v2"
+
+	"candle-lights/frontend/middleware"
 )
 
 type LoginRequest struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
+	Username   string `json:"username"`
+	Password   string `json:"password"`
+	RememberMe bool   `json:"rememberMe"`
 }
 
 type RegisterRequest struct {
@@ -28,9 +31,15 @@ type RegisterRequest struct {
 type AuthResponse struct {
 	Success bool   `json:"success"`
 	Data    struct {
-		Token    string `json:"token"`
-		Username string `json:"username"`
-		Email    string `json:"email"`
+		Token     string `json:"token"`
+		Username  string `json:"username"`
+		Email     string `json:"email"`
+		ExpiresAt int64  `json:"expiresAt"`
+		ExpiresIn int64  `json:"expiresIn"`
+
+		// Set instead of a session when the account uses two-factor auth
+		TwoFactorRequired bool   `json:"twoFactorRequired"`
+		PendingToken      string `json:"pendingToken"`
 	} `json:"data"`
 	Error string `json:"error"`
 }
@@ -62,7 +71,10 @@ func LoginHandler(c *fiber.Ctx) error {
 		})
 	}
 
-	httpReq, err := http.NewRequest("POST", apiURL, bytes.NewBuffer(jsonData))
+	ctx, cancel := apiCallContext(c, apiCallBudget)
+	defer cancel()
+
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", apiURL, bytes.NewBuffer(jsonData))
 	if err != nil {
 		log.Printf("LoginHandler: Failed to create HTTP request: %v", err)
 		return c.Status(500).JSON(fiber.Map{
@@ -73,13 +85,12 @@ func LoginHandler(c *fiber.Ctx) error {
 
 	httpReq.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{
-		Timeout: 30 * time.Second,
-	}
-
-	resp, err := client.Do(httpReq)
+	resp, err := http.DefaultClient.Do(httpReq)
 	if err != nil {
 		log.Printf("LoginHandler: Failed to call backend API: %v", err)
+		if timedOut, err := apiTimeout(c, err); timedOut {
+			return err
+		}
 		return c.Status(500).JSON(fiber.Map{
 			"success": false,
 			"error":   fmt.Sprintf("Failed to authenticate: %v", err),
@@ -125,6 +136,17 @@ func LoginHandler(c *fiber.Ctx) error {
 		})
 	}
 
+	// The password was right; the page asks for a code and posts it to
+	// TwoFactorVerifyHandler with the pending token
+	if authResp.Data.TwoFactorRequired {
+		log.Printf("LoginHandler: Two-factor code required")
+		return c.JSON(fiber.Map{
+			"success":           false,
+			"twoFactorRequired": true,
+			"pendingToken":      authResp.Data.PendingToken,
+		})
+	}
+
 	if !authResp.Success || authResp.Data.Token == "" {
 		log.Printf("LoginHandler: Invalid response from backend: success=%v, token=%s", authResp.Success, authResp.Data.Token)
 		return c.Status(500).JSON(fiber.Map{
@@ -135,29 +157,82 @@ func LoginHandler(c *fiber.Ctx) error {
 
 	log.Printf("LoginHandler: Login successful for user: %s", authResp.Data.Username)
 
-	// Set session ID cookie (HTTP-only, secure)
-	c.Cookie(&fiber.Cookie{
-		Name:     "session_id",
-		Value:    authResp.Data.Token, // Token field now contains session ID
-		Expires:  time.Now().Add(24 * time.Hour),
-		HTTPOnly: true,
-		Secure:   false, // Allow both HTTP and HTTPS for better compatibility
-		SameSite: "Lax",  // Allow OAuth redirects while maintaining CSRF protection
-		Path:     "/",
-	})
+	// Cookie lifetime follows the backend session TTL
+	middleware.SetSessionCookies(c, authResp.Data.Token, authResp.Data.Username, int(authResp.Data.ExpiresIn))
+
+	log.Printf("LoginHandler: Session cookie set, returning success response")
 
-	// Set username cookie (readable by JavaScript)
-	c.Cookie(&fiber.Cookie{
-		Name:     "username",
-		Value:    authResp.Data.Username,
-		Expires:  time.Now().Add(24 * time.Hour),
-		HTTPOnly: false,
-		Secure:   false, // Allow both HTTP and HTTPS for better compatibility
-		SameSite: "Lax",  // Allow OAuth redirects while maintaining CSRF protection
-		Path:     "/",
+	return c.JSON(fiber.Map{
+		"success":  true,
+		"redirect": "/dashboard",
 	})
+}
 
-	log.Printf("LoginHandler: Session cookie set, returning success response")
+// TwoFactorVerifyHandler finishes a two-factor login: it exchanges the
+// pending token from LoginHandler and a code for a session
+func TwoFactorVerifyHandler(c *fiber.Ctx) error {
+	ctx, cancel := apiCallContext(c, apiCallBudget)
+	defer cancel()
+
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", apiEndpoint+"/api/auth/2fa/verify", bytes.NewBuffer(c.Body()))
+	if err != nil {
+		log.Printf("TwoFactorVerifyHandler: Failed to create HTTP request: %v", err)
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"error":   "Internal server error",
+		})
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		log.Printf("TwoFactorVerifyHandler: Failed to call backend API: %v", err)
+		if timedOut, err := apiTimeout(c, err); timedOut {
+			return err
+		}
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"error":   "Failed to verify code",
+		})
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		log.Printf("TwoFactorVerifyHandler: Failed to read response body: %v", err)
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"error":   "Failed to read response",
+		})
+	}
+
+	var authResp AuthResponse
+	if err := json.Unmarshal(body, &authResp); err != nil {
+		log.Printf("TwoFactorVerifyHandler: Failed to parse response: %v", err)
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"error":   "Failed to parse response",
+		})
+	}
+
+	if resp.StatusCode != 200 || !authResp.Success || authResp.Data.Token == "" {
+		errorMsg := authResp.Error
+		if errorMsg == "" {
+			errorMsg = "Verification failed"
+		}
+		log.Printf("TwoFactorVerifyHandler: Verification failed with status %d: %s", resp.StatusCode, errorMsg)
+		status := resp.StatusCode
+		if status == 200 {
+			status = 500
+		}
+		return c.Status(status).JSON(fiber.Map{
+			"success": false,
+			"error":   errorMsg,
+		})
+	}
+
+	// Cookie lifetime follows the backend session TTL
+	middleware.SetSessionCookies(c, authResp.Data.Token, authResp.Data.Username, int(authResp.Data.ExpiresIn))
 
 	return c.JSON(fiber.Map{
 		"success":  true,
@@ -192,7 +267,10 @@ func RegisterHandler(c *fiber.Ctx) error {
 		})
 	}
 
-	httpReq, err := http.NewRequest("POST", apiURL, bytes.NewBuffer(jsonData))
+	ctx, cancel := apiCallContext(c, apiCallBudget)
+	defer cancel()
+
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", apiURL, bytes.NewBuffer(jsonData))
 	if err != nil {
 		log.Printf("RegisterHandler: Failed to create HTTP request: %v", err)
 		return c.Status(500).JSON(fiber.Map{
@@ -203,13 +281,12 @@ func RegisterHandler(c *fiber.Ctx) error {
 
 	httpReq.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{
-		Timeout: 30 * time.Second,
-	}
-
-	resp, err := client.Do(httpReq)
+	resp, err := http.DefaultClient.Do(httpReq)
 	if err != nil {
 		log.Printf("RegisterHandler: Failed to call backend API: %v", err)
+		if timedOut, err := apiTimeout(c, err); timedOut {
+			return err
+		}
 		return c.Status(500).JSON(fiber.Map{
 			"success": false,
 			"error":   fmt.Sprintf("Failed to register: %v", err),
@@ -257,27 +334,8 @@ func RegisterHandler(c *fiber.Ctx) error {
 
 	log.Printf("RegisterHandler: Registration successful for user: %s", authResp.Data.Username)
 
-	// Set session ID cookie (HTTP-only, secure)
-	c.Cookie(&fiber.Cookie{
-		Name:     "session_id",
-		Value:    authResp.Data.Token, // Token field now contains session ID
-		Expires:  time.Now().Add(24 * time.Hour),
-		HTTPOnly: true,
-		Secure:   false, // Allow both HTTP and HTTPS for better compatibility
-		SameSite: "Lax",  // Allow OAuth redirects while maintaining CSRF protection
-		Path:     "/",
-	})
-
-	// Set username cookie (readable by JavaScript)
-	c.Cookie(&fiber.Cookie{
-		Name:     "username",
-		Value:    authResp.Data.Username,
-		Expires:  time.Now().Add(24 * time.Hour),
-		HTTPOnly: false,
-		Secure:   false, // Allow both HTTP and HTTPS for better compatibility
-		SameSite: "Lax",  // Allow OAuth redirects while maintaining CSRF protection
-		Path:     "/",
-	})
+	// Cookie lifetime follows the backend session TTL
+	middleware.SetSessionCookies(c, authResp.Data.Token, authResp.Data.Username, int(authResp.Data.ExpiresIn))
 
 	log.Printf("RegisterHandler: Session cookie set, returning success response")
 
@@ -290,25 +348,73 @@ func RegisterHandler(c *fiber.Ctx) error {
 func LogoutHandler(c *fiber.Ctx) error {
 	log.Println("LogoutHandler: Logging out user")
 
-	// Clear session ID cookie
-	c.Cookie(&fiber.Cookie{
-		Name:     "session_id",
-		Value:    "",
-		Expires:  time.Now().Add(-1 * time.Hour),
-		HTTPOnly: true,
-		Path:     "/",
-	})
-
-	// Clear username cookie
-	c.Cookie(&fiber.Cookie{
-		Name:     "username",
-		Value:    "",
-		Expires:  time.Now().Add(-1 * time.Hour),
-		HTTPOnly: false,
-		Path:     "/",
-	})
+	middleware.ClearSessionCookies(c)
 
 	log.Println("LogoutHandler: Session cookie cleared, redirecting to home")
 
 	return c.Redirect("/")
 }
+
+// RefreshHandler extends the backend session (sliding expiration) and re-issues
+// the cookies with the new lifetime
+func RefreshHandler(c *fiber.Ctx) error {
+	sessionID := middleware.SessionID(c)
+	if sessionID == "" {
+		return c.Status(401).JSON(fiber.Map{
+			"success": false,
+			"error":   "Unauthorized - No session",
+		})
+	}
+
+	ctx, cancel := apiCallContext(c, 10*time.Second)
+	defer cancel()
+
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", apiEndpoint+"/api/auth/refresh", nil)
+	if err != nil {
+		log.Printf("RefreshHandler: Failed to create HTTP request: %v", err)
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"error":   "Internal server error",
+		})
+	}
+	httpReq.Header.Set("Authorization", "Bearer "+sessionID)
+
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		log.Printf("RefreshHandler: Failed to call backend API: %v", err)
+		if timedOut, err := apiTimeout(c, err); timedOut {
+			return err
+		}
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"error":   "Failed to refresh session",
+		})
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		log.Printf("RefreshHandler: Failed to read response body: %v", err)
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"error":   "Failed to read response",
+		})
+	}
+
+	var authResp AuthResponse
+	if err := json.Unmarshal(body, &authResp); err != nil || resp.StatusCode != 200 || !authResp.Success {
+		log.Printf("RefreshHandler: Refresh failed with status %d", resp.StatusCode)
+		middleware.ClearSessionCookies(c)
+		return c.Status(401).JSON(fiber.Map{
+			"success": false,
+			"error":   "Session expired",
+		})
+	}
+
+	middleware.SetSessionCookies(c, authResp.Data.Token, authResp.Data.Username, int(authResp.Data.ExpiresIn))
+
+	return c.JSON(fiber.Map{
+		"success":   true,
+		"expiresAt": authResp.Data.ExpiresAt,
+	})
+}
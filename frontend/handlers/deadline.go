@@ -0,0 +1,35 @@
+package handlers
+
+import (
+    "context"
+    "errors"
+    "time"
+
+    "github.com/gofiber/fiber/v2"
+)
+
+// apiCallBudget caps each backend API call, a little under API Gateway's 29
+// second integration timeout so the frontend answers before it does
+var apiCallBudget = 27 * time.Second
+
+// apiCallContext bounds a backend API call to limit, or apiCallBudget when
+// that is shorter. It derives from the request's context, so the call also
+// stops if the caller goes away.
+func apiCallContext(c *fiber.Ctx, limit time.Duration) (context.Context, context.CancelFunc) {
+    if limit > apiCallBudget {
+        limit = apiCallBudget
+    }
+    return context.WithTimeout(c.UserContext(), limit)
+}
+
+// apiTimeout answers 504 when err is a backend API call running out of time,
+// reporting whether it did
+func apiTimeout(c *fiber.Ctx, err error) (bool, error) {
+    if !errors.Is(err, context.DeadlineExceeded) {
+        return false, nil
+    }
+    return true, c.Status(fiber.StatusGatewayTimeout).JSON(fiber.Map{
+        "success": false,
+        "error":   "The backend API did not respond in time",
+    })
+}
@@ -0,0 +1,94 @@
+package handlers
+
+import (
+    "encoding/json"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+
+    "github.com/gofiber/fiber/v2"
+    "github.com/stretchr/testify/assert"
+
+    "candle-lights/frontend/middleware"
+)
+
+// slowAPI stands in for a backend that takes delay to answer
+func slowAPI(t *testing.T, delay time.Duration) {
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        select {
+        case <-time.After(delay):
+            w.Header().Set("Content-Type", "application/json")
+            w.Write([]byte(`{"success":true,"data":[]}`))
+        case <-r.Context().Done():
+        }
+    }))
+    previous := apiEndpoint
+    SetAPIEndpoint(server.URL)
+    t.Cleanup(func() {
+        SetAPIEndpoint(previous)
+        server.Close()
+    })
+}
+
+// withCallBudget shortens apiCallBudget for one test
+func withCallBudget(t *testing.T, budget time.Duration) {
+    previous := apiCallBudget
+    apiCallBudget = budget
+    t.Cleanup(func() { apiCallBudget = previous })
+}
+
+func proxyTestApp() *fiber.App {
+    app := fiber.New()
+    app.Get("/api/patterns", GetPatternsHandler)
+    return app
+}
+
+func proxyTestRequest() *http.Request {
+    req := httptest.NewRequest("GET", "/api/patterns", nil)
+    req.AddCookie(&http.Cookie{Name: middleware.SessionCookieName, Value: "test-session"})
+    return req
+}
+
+func TestProxyRequestTimesOutWith504(t *testing.T) {
+    slowAPI(t, 2*time.Second)
+    withCallBudget(t, 50*time.Millisecond)
+
+    start := time.Now()
+    resp, err := proxyTestApp().Test(proxyTestRequest(), -1)
+    assert.NoError(t, err)
+    assert.Less(t, time.Since(start), time.Second, "the call should give up at its budget")
+    assert.Equal(t, fiber.StatusGatewayTimeout, resp.StatusCode)
+
+    body, _ := io.ReadAll(resp.Body)
+    var result map[string]interface{}
+    assert.NoError(t, json.Unmarshal(body, &result))
+    assert.Equal(t, false, result["success"])
+    assert.Contains(t, result["error"], "backend API")
+}
+
+func TestProxyRequestWithinBudget(t *testing.T) {
+    slowAPI(t, 10*time.Millisecond)
+    withCallBudget(t, time.Second)
+
+    resp, err := proxyTestApp().Test(proxyTestRequest(), -1)
+    assert.NoError(t, err)
+    assert.Equal(t, 200, resp.StatusCode)
+}
+
+func TestAPICallContextUsesShorterLimit(t *testing.T) {
+    withCallBudget(t, time.Hour)
+
+    app := fiber.New()
+    app.Get("/", func(c *fiber.Ctx) error {
+        ctx, cancel := apiCallContext(c, time.Minute)
+        defer cancel()
+        deadline, ok := ctx.Deadline()
+        assert.True(t, ok)
+        assert.LessOrEqual(t, time.Until(deadline), time.Minute)
+        return c.SendStatus(204)
+    })
+    _, err := app.Test(httptest.NewRequest("GET", "/", nil), -1)
+    assert.NoError(t, err)
+}
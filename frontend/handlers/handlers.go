@@ -7,10 +7,17 @@ import (
     "os"
 
     "github.com/gofiber/fiber/v2"
+
+    "candle-lights/frontend/middleware"
 )
 
 var apiEndpoint = os.Getenv("API_ENDPOINT")
 
+// SetAPIEndpoint overrides API_ENDPOINT, for running outside Lambda
+func SetAPIEndpoint(endpoint string) {
+    apiEndpoint = endpoint
+}
+
 // indexHandler renders the homepage
 func IndexHandler(c *fiber.Ctx) error {
     return c.Render("templates/index", fiber.Map{
@@ -80,7 +87,44 @@ func GlowBlasterHandler(c *fiber.Ctx) error {
 // API handlers that proxy to backend Lambda functions
 
 func GetPatternsHandler(c *fiber.Ctx) error {
-    return proxyRequest(c, "GET", "/api/patterns", nil)
+    // Pass through sortBy/limit
+    path := "/api/patterns"
+    if query := string(c.Request().URI().QueryString()); query != "" {
+        path += "?" + query
+    }
+    return proxyRequest(c, "GET", path, nil)
+}
+
+func GetPatternStatsHandler(c *fiber.Ctx) error {
+    return proxyRequest(c, "GET", "/api/patterns/stats", nil)
+}
+
+func GetFavoritePatternsHandler(c *fiber.Ctx) error {
+    return proxyRequest(c, "GET", "/api/patterns/favorites", nil)
+}
+
+func InstallStarterPatternsHandler(c *fiber.Ctx) error {
+    return proxyRequest(c, "POST", "/api/patterns/install-starters", nil)
+}
+
+func FavoritePatternHandler(c *fiber.Ctx) error {
+    id := c.Params("id")
+    return proxyRequest(c, "POST", "/api/patterns/"+id+"/favorite", nil)
+}
+
+func UnfavoritePatternHandler(c *fiber.Ctx) error {
+    id := c.Params("id")
+    return proxyRequest(c, "POST", "/api/patterns/"+id+"/unfavorite", nil)
+}
+
+func DecodePatternBytecodeHandler(c *fiber.Ctx) error {
+    id := c.Params("id")
+    return proxyRequest(c, "GET", "/api/patterns/"+id+"/decode", nil)
+}
+
+func UpgradePatternBytecodeHandler(c *fiber.Ctx) error {
+    id := c.Params("id")
+    return proxyRequest(c, "POST", "/api/patterns/"+id+"/upgrade-bytecode", nil)
 }
 
 func CreatePatternHandler(c *fiber.Ctx) error {
@@ -100,7 +144,12 @@ func DeletePatternHandler(c *fiber.Ctx) error {
 }
 
 func GetDevicesHandler(c *fiber.Ctx) error {
-    return proxyRequest(c, "GET", "/api/devices", nil)
+    // Pass through the room filter
+    path := "/api/devices"
+    if query := string(c.Request().URI().QueryString()); query != "" {
+        path += "?" + query
+    }
+    return proxyRequest(c, "GET", path, nil)
 }
 
 func CreateDeviceHandler(c *fiber.Ctx) error {
@@ -108,20 +157,75 @@ func CreateDeviceHandler(c *fiber.Ctx) error {
     return proxyRequest(c, "POST", "/api/devices", body)
 }
 
+func AlexaDebugHandler(c *fiber.Ctx) error {
+    return proxyRequest(c, "GET", "/api/devices/alexa-debug", nil)
+}
+
 func AssignPatternHandler(c *fiber.Ctx) error {
     id := c.Params("id")
     body := c.Body()
     return proxyRequest(c, "PUT", "/api/devices/"+id+"/pattern", body)
 }
 
+func UpdatePinMappingHandler(c *fiber.Ctx) error {
+    id := c.Params("id")
+    body := c.Body()
+    return proxyRequest(c, "PUT", "/api/devices/"+id+"/pin-mapping", body)
+}
+
+func GetRoomsHandler(c *fiber.Ctx) error {
+    return proxyRequest(c, "GET", "/api/rooms", nil)
+}
+
+func AssignRoomHandler(c *fiber.Ctx) error {
+    room := c.Params("room")
+    body := c.Body()
+    return proxyRequest(c, "POST", "/api/rooms/"+room+"/devices", body)
+}
+
+func DeleteRoomHandler(c *fiber.Ctx) error {
+    room := c.Params("room")
+    return proxyRequest(c, "DELETE", "/api/rooms/"+room, nil)
+}
+
+func GetAllDeviceVariablesHandler(c *fiber.Ctx) error {
+    return proxyRequest(c, "GET", "/api/particle/devices/variables", nil)
+}
+
+func ProvisionDeviceHandler(c *fiber.Ctx) error {
+    particleID := c.Params("particleId")
+    body := c.Body()
+    return proxyRequest(c, "POST", "/api/particle/devices/"+particleID+"/provision", body)
+}
+
+// ProvisionAllDevicesHandler provisions every new device in the Particle account
+func ProvisionAllDevicesHandler(c *fiber.Ctx) error {
+    return proxyRequest(c, "POST", "/api/particle/devices/provision-all", c.Body())
+}
+
+// AllOffHandler turns off every strip the user owns
+func AllOffHandler(c *fiber.Ctx) error {
+    return proxyRequest(c, "POST", "/api/particle/all-off", nil)
+}
+
 func SendCommandHandler(c *fiber.Ctx) error {
     body := c.Body()
-    return proxyRequest(c, "POST", "/api/particle/command", body)
+    // Pass through preserveRest for single-strip applies
+    path := "/api/particle/command"
+    if query := string(c.Request().URI().QueryString()); query != "" {
+        path += "?" + query
+    }
+    return proxyRequest(c, "POST", path, body)
 }
 
 func RefreshDevicesHandler(c *fiber.Ctx) error {
     body := c.Body()
-    return proxyRequest(c, "POST", "/api/particle/devices/refresh", body)
+    // Pass through limit, continuation, and async for chunked refreshes
+    path := "/api/particle/devices/refresh"
+    if query := string(c.Request().URI().QueryString()); query != "" {
+        path += "?" + query
+    }
+    return proxyRequest(c, "POST", path, body)
 }
 
 func UpdateParticleSettingsHandler(c *fiber.Ctx) error {
@@ -129,6 +233,63 @@ func UpdateParticleSettingsHandler(c *fiber.Ctx) error {
     return proxyRequest(c, "POST", "/api/settings/particle", body)
 }
 
+func GetNotificationSettingsHandler(c *fiber.Ctx) error {
+    return proxyRequest(c, "GET", "/api/settings/notifications", nil)
+}
+
+func UpdateNotificationSettingsHandler(c *fiber.Ctx) error {
+    body := c.Body()
+    return proxyRequest(c, "PUT", "/api/settings/notifications", body)
+}
+
+func GetAPIKeysHandler(c *fiber.Ctx) error {
+    return proxyRequest(c, "GET", "/api/settings/api-keys", nil)
+}
+
+func CreateAPIKeyHandler(c *fiber.Ctx) error {
+    body := c.Body()
+    return proxyRequest(c, "POST", "/api/settings/api-keys", body)
+}
+
+func DeleteAPIKeyHandler(c *fiber.Ctx) error {
+    id := c.Params("id")
+    return proxyRequest(c, "DELETE", "/api/settings/api-keys/"+id, nil)
+}
+
+func GetAlexaLinkHandler(c *fiber.Ctx) error {
+    return proxyRequest(c, "GET", "/api/settings/alexa-link", nil)
+}
+
+func UnlinkAlexaHandler(c *fiber.Ctx) error {
+    return proxyRequest(c, "DELETE", "/api/settings/alexa-link", nil)
+}
+
+func GetFeaturesHandler(c *fiber.Ctx) error {
+    return proxyRequest(c, "GET", "/api/settings/features", nil)
+}
+
+func TwoFactorSetupHandler(c *fiber.Ctx) error {
+    return proxyRequest(c, "POST", "/api/auth/2fa/setup", nil)
+}
+
+func TwoFactorConfirmHandler(c *fiber.Ctx) error {
+    body := c.Body()
+    return proxyRequest(c, "POST", "/api/auth/2fa/confirm", body)
+}
+
+func GetNotificationsHandler(c *fiber.Ctx) error {
+    path := "/api/notifications"
+    if c.Query("unread") == "true" {
+        path += "?unread=true"
+    }
+    return proxyRequest(c, "GET", path, nil)
+}
+
+func MarkNotificationReadHandler(c *fiber.Ctx) error {
+    id := c.Params("id")
+    return proxyRequest(c, "POST", "/api/notifications/"+id+"/read", nil)
+}
+
 func ValidateParticleTokenHandler(c *fiber.Ctx) error {
     body := c.Body()
     return proxyRequest(c, "POST", "/api/particle/validate-token", body)
@@ -171,11 +332,38 @@ func GlowBlasterCompactHandler(c *fiber.Ctx) error {
     return proxyRequest(c, "POST", "/api/glowblaster/conversations/"+id+"/compact", nil)
 }
 
+func DeleteGlowBlasterMessageHandler(c *fiber.Ctx) error {
+    id := c.Params("id")
+    index := c.Params("index")
+    return proxyRequest(c, "DELETE", "/api/glowblaster/conversations/"+id+"/messages/"+index, nil)
+}
+
+func ForkGlowBlasterConversationHandler(c *fiber.Ctx) error {
+    id := c.Params("id")
+    body := c.Body()
+    return proxyRequest(c, "POST", "/api/glowblaster/conversations/"+id+"/fork", body)
+}
+
+func GetGlowBlasterLineageHandler(c *fiber.Ctx) error {
+    id := c.Params("id")
+    return proxyRequest(c, "GET", "/api/glowblaster/conversations/"+id+"/lineage", nil)
+}
+
 func GlowBlasterCompileHandler(c *fiber.Ctx) error {
     body := c.Body()
     return proxyRequest(c, "POST", "/api/glowblaster/compile", body)
 }
 
+func GlowBlasterCompileParamsHandler(c *fiber.Ctx) error {
+    body := c.Body()
+    // Pass through includeFrames for simulated preview frames
+    path := "/api/glowblaster/compile-params"
+    if query := string(c.Request().URI().QueryString()); query != "" {
+        path += "?" + query
+    }
+    return proxyRequest(c, "POST", path, body)
+}
+
 func GetGlowBlasterPatternsHandler(c *fiber.Ctx) error {
     return proxyRequest(c, "GET", "/api/glowblaster/patterns", nil)
 }
@@ -190,7 +378,7 @@ func GetGlowBlasterModelsHandler(c *fiber.Ctx) error {
 }
 
 func proxyRequest(c *fiber.Ctx, method, path string, body []byte) error {
-    sessionID := c.Cookies("session_id")
+    sessionID := middleware.SessionID(c)
     if sessionID == "" {
         return c.Status(401).JSON(fiber.Map{
             "success": false,
@@ -200,13 +388,16 @@ func proxyRequest(c *fiber.Ctx, method, path string, body []byte) error {
 
     url := apiEndpoint + path
 
+    ctx, cancel := apiCallContext(c, apiCallBudget)
+    defer cancel()
+
     var req *http.Request
     var err error
 
     if body != nil {
-        req, err = http.NewRequest(method, url, bytes.NewBuffer(body))
+        req, err = http.NewRequestWithContext(ctx, method, url, bytes.NewBuffer(body))
     } else {
-        req, err = http.NewRequest(method, url, nil)
+        req, err = http.NewRequestWithContext(ctx, method, url, nil)
     }
 
     if err != nil {
@@ -220,9 +411,11 @@ func proxyRequest(c *fiber.Ctx, method, path string, body []byte) error {
     req.Header.Set("Authorization", "Bearer "+sessionID)
     req.Header.Set("Content-Type", "application/json")
 
-    client := &http.Client{}
-    resp, err := client.Do(req)
+    resp, err := http.DefaultClient.Do(req)
     if err != nil {
+        if timedOut, err := apiTimeout(c, err); timedOut {
+            return err
+        }
         return c.Status(500).JSON(fiber.Map{
             "success": false,
             "error":   "Failed to send request",
@@ -232,12 +425,18 @@ func proxyRequest(c *fiber.Ctx, method, path string, body []byte) error {
 
     respBody, err := io.ReadAll(resp.Body)
     if err != nil {
+        if timedOut, err := apiTimeout(c, err); timedOut {
+            return err
+        }
         return c.Status(500).JSON(fiber.Map{
             "success": false,
             "error":   "Failed to read response",
         })
     }
 
+    username, _ := c.Locals("username").(string)
+    middleware.ApplyRotatedSession(c, resp.Header, username)
+
     c.Set("Content-Type", "application/json")
     return c.Status(resp.StatusCode).Send(respBody)
 }
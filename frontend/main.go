@@ -7,6 +7,7 @@ import (
     "log"
     "net/http"
     "os"
+    "path/filepath"
 
     "github.com/aws/aws-lambda-go/events"
     "github.com/aws/aws-lambda-go/lambda"
@@ -29,9 +30,21 @@ var staticFiles embed.FS
 
 var fiberLambda *fiberadapter.FiberLambda
 
-func init() {
-    // Create template engine
-    engine := html.NewFileSystem(http.FS(templates), ".html")
+// defaultLocalAPIEndpoint is the backend used locally when API_ENDPOINT is unset
+const defaultLocalAPIEndpoint = "http://localhost:8080"
+
+// buildApp creates the Fiber app with its template engine, static files,
+// middleware, and routes. assetDir serves templates and static files from
+// disk (reloaded on every request) instead of the embedded copies; pass ""
+// to use the embedded ones.
+func buildApp(assetDir string) *fiber.App {
+    var engine *html.Engine
+    if assetDir != "" {
+        engine = html.New(assetDir, ".html")
+        engine.Reload(true)
+    } else {
+        engine = html.NewFileSystem(http.FS(templates), ".html")
+    }
 
     // Create Fiber app
     app := fiber.New(fiber.Config{
@@ -57,19 +70,40 @@ func init() {
     })
 
     // Static files
-    staticFS, err := fs.Sub(staticFiles, "static")
-    if err != nil {
-        panic(err)
+    if assetDir != "" {
+        app.Use("/static", filesystem.New(filesystem.Config{
+            Root: http.Dir(filepath.Join(assetDir, "static")),
+        }))
+    } else {
+        staticFS, err := fs.Sub(staticFiles, "static")
+        if err != nil {
+            panic(err)
+        }
+        app.Use("/static", filesystem.New(filesystem.Config{
+            Root: http.FS(staticFS),
+        }))
     }
-    app.Use("/static", filesystem.New(filesystem.Config{
-        Root: http.FS(staticFS),
-    }))
 
     // Routes
     setupRoutes(app)
 
-    // Create Lambda adapter
-    fiberLambda = fiberadapter.New(app)
+    return app
+}
+
+// localAssetDir finds the frontend directory on disk for local mode:
+// FRONTEND_DIR if set, else the working directory (go run .) or ./frontend
+// (go run ./frontend from the repo root). Empty means use the embedded files.
+func localAssetDir() string {
+    candidates := []string{".", "frontend"}
+    if dir := os.Getenv("FRONTEND_DIR"); dir != "" {
+        candidates = []string{dir}
+    }
+    for _, dir := range candidates {
+        if info, err := os.Stat(filepath.Join(dir, "templates")); err == nil && info.IsDir() {
+            return dir
+        }
+    }
+    return ""
 }
 
 func setupRoutes(app *fiber.App) {
@@ -90,30 +124,63 @@ func setupRoutes(app *fiber.App) {
     app.Post("/auth/login", handlers.LoginHandler)
     app.Post("/auth/register", handlers.RegisterHandler)
     app.Get("/auth/logout", handlers.LogoutHandler)
+    app.Post("/auth/refresh", handlers.RefreshHandler)
+    app.Post("/auth/2fa/verify", handlers.TwoFactorVerifyHandler)
 
     // API routes (used by JavaScript - proxy to backend)
     app.Post("/api/auth/login", handlers.LoginHandler)
     app.Post("/api/auth/register", handlers.RegisterHandler)
+    app.Post("/api/auth/2fa/verify", handlers.TwoFactorVerifyHandler)
+    app.Post("/api/auth/2fa/setup", middleware.APIAuthMiddleware, handlers.TwoFactorSetupHandler)
+    app.Post("/api/auth/2fa/confirm", middleware.APIAuthMiddleware, handlers.TwoFactorConfirmHandler)
 
     // API routes for patterns (protected)
     app.Get("/api/patterns", middleware.APIAuthMiddleware, handlers.GetPatternsHandler)
+    app.Get("/api/patterns/stats", middleware.APIAuthMiddleware, handlers.GetPatternStatsHandler)
+    app.Get("/api/patterns/favorites", middleware.APIAuthMiddleware, handlers.GetFavoritePatternsHandler)
     app.Post("/api/patterns", middleware.APIAuthMiddleware, handlers.CreatePatternHandler)
+    app.Post("/api/patterns/install-starters", middleware.APIAuthMiddleware, handlers.InstallStarterPatternsHandler)
     app.Put("/api/patterns/:id", middleware.APIAuthMiddleware, handlers.UpdatePatternHandler)
     app.Delete("/api/patterns/:id", middleware.APIAuthMiddleware, handlers.DeletePatternHandler)
+    app.Get("/api/patterns/:id/decode", middleware.APIAuthMiddleware, handlers.DecodePatternBytecodeHandler)
+    app.Post("/api/patterns/:id/upgrade-bytecode", middleware.APIAuthMiddleware, handlers.UpgradePatternBytecodeHandler)
+    app.Post("/api/patterns/:id/favorite", middleware.APIAuthMiddleware, handlers.FavoritePatternHandler)
+    app.Post("/api/patterns/:id/unfavorite", middleware.APIAuthMiddleware, handlers.UnfavoritePatternHandler)
 
     // API routes for devices (protected)
     app.Get("/api/devices", middleware.APIAuthMiddleware, handlers.GetDevicesHandler)
     app.Post("/api/devices", middleware.APIAuthMiddleware, handlers.CreateDeviceHandler)
+    app.Get("/api/devices/alexa-debug", middleware.APIAuthMiddleware, handlers.AlexaDebugHandler)
     app.Put("/api/devices/:id/pattern", middleware.APIAuthMiddleware, handlers.AssignPatternHandler)
+    app.Put("/api/devices/:id/pin-mapping", middleware.APIAuthMiddleware, handlers.UpdatePinMappingHandler)
+    app.Get("/api/rooms", middleware.APIAuthMiddleware, handlers.GetRoomsHandler)
+    app.Post("/api/rooms/:room/devices", middleware.APIAuthMiddleware, handlers.AssignRoomHandler)
+    app.Delete("/api/rooms/:room", middleware.APIAuthMiddleware, handlers.DeleteRoomHandler)
 
     // API routes for particle commands (protected)
     app.Post("/api/particle/command", middleware.APIAuthMiddleware, handlers.SendCommandHandler)
+    app.Post("/api/particle/all-off", middleware.APIAuthMiddleware, handlers.AllOffHandler)
     app.Post("/api/particle/devices/refresh", middleware.APIAuthMiddleware, handlers.RefreshDevicesHandler)
+    app.Get("/api/particle/devices/variables", middleware.APIAuthMiddleware, handlers.GetAllDeviceVariablesHandler)
+    app.Post("/api/particle/devices/provision-all", middleware.APIAuthMiddleware, handlers.ProvisionAllDevicesHandler)
+    app.Post("/api/particle/devices/:particleId/provision", middleware.APIAuthMiddleware, handlers.ProvisionDeviceHandler)
     app.Post("/api/particle/validate-token", middleware.APIAuthMiddleware, handlers.ValidateParticleTokenHandler)
     app.Post("/api/particle/oauth/initiate", middleware.APIAuthMiddleware, handlers.ParticleOAuthInitiateHandler)
 
     // API routes for settings (protected)
     app.Post("/api/settings/particle", middleware.APIAuthMiddleware, handlers.UpdateParticleSettingsHandler)
+    app.Get("/api/settings/notifications", middleware.APIAuthMiddleware, handlers.GetNotificationSettingsHandler)
+    app.Put("/api/settings/notifications", middleware.APIAuthMiddleware, handlers.UpdateNotificationSettingsHandler)
+    app.Get("/api/settings/api-keys", middleware.APIAuthMiddleware, handlers.GetAPIKeysHandler)
+    app.Post("/api/settings/api-keys", middleware.APIAuthMiddleware, handlers.CreateAPIKeyHandler)
+    app.Delete("/api/settings/api-keys/:id", middleware.APIAuthMiddleware, handlers.DeleteAPIKeyHandler)
+    app.Get("/api/settings/alexa-link", middleware.APIAuthMiddleware, handlers.GetAlexaLinkHandler)
+    app.Delete("/api/settings/alexa-link", middleware.APIAuthMiddleware, handlers.UnlinkAlexaHandler)
+    app.Get("/api/settings/features", middleware.APIAuthMiddleware, handlers.GetFeaturesHandler)
+
+    // API routes for notifications (protected)
+    app.Get("/api/notifications", middleware.APIAuthMiddleware, handlers.GetNotificationsHandler)
+    app.Post("/api/notifications/:id/read", middleware.APIAuthMiddleware, handlers.MarkNotificationReadHandler)
 
     // API routes for Glow Blaster (protected)
     app.Get("/api/glowblaster/conversations", middleware.APIAuthMiddleware, handlers.GetGlowBlasterConversationsHandler)
@@ -122,7 +189,11 @@ func setupRoutes(app *fiber.App) {
     app.Delete("/api/glowblaster/conversations/:id", middleware.APIAuthMiddleware, handlers.DeleteGlowBlasterConversationHandler)
     app.Post("/api/glowblaster/conversations/:id/chat", middleware.APIAuthMiddleware, handlers.GlowBlasterChatHandler)
     app.Post("/api/glowblaster/conversations/:id/compact", middleware.APIAuthMiddleware, handlers.GlowBlasterCompactHandler)
+    app.Delete("/api/glowblaster/conversations/:id/messages/:index", middleware.APIAuthMiddleware, handlers.DeleteGlowBlasterMessageHandler)
+    app.Post("/api/glowblaster/conversations/:id/fork", middleware.APIAuthMiddleware, handlers.ForkGlowBlasterConversationHandler)
+    app.Get("/api/glowblaster/conversations/:id/lineage", middleware.APIAuthMiddleware, handlers.GetGlowBlasterLineageHandler)
     app.Post("/api/glowblaster/compile", middleware.APIAuthMiddleware, handlers.GlowBlasterCompileHandler)
+    app.Post("/api/glowblaster/compile-params", middleware.APIAuthMiddleware, handlers.GlowBlasterCompileParamsHandler)
     app.Get("/api/glowblaster/patterns", middleware.APIAuthMiddleware, handlers.GetGlowBlasterPatternsHandler)
     app.Post("/api/glowblaster/patterns", middleware.APIAuthMiddleware, handlers.SaveGlowBlasterPatternHandler)
     app.Get("/api/glowblaster/models", middleware.APIAuthMiddleware, handlers.GetGlowBlasterModelsHandler)
@@ -143,11 +214,36 @@ func handler(ctx context.Context, req events.APIGatewayProxyRequest) (events.API
 func main() {
     if os.Getenv("AWS_LAMBDA_FUNCTION_NAME") != "" {
         // Running in Lambda
+        fiberLambda = fiberadapter.New(buildApp(""))
         lambda.Start(handler)
-    } else {
-        // Running locally
-        app := fiber.New()
-        setupRoutes(app)
-        log.Fatal(app.Listen(":3000"))
+        return
+    }
+
+    // Running locally
+    endpoint := os.Getenv("API_ENDPOINT")
+    if endpoint == "" {
+        endpoint = defaultLocalAPIEndpoint
+    }
+    handlers.SetAPIEndpoint(endpoint)
+    middleware.SetAPIEndpoint(endpoint)
+
+    // APP_ENV=local serves templates and static files from disk so edits show
+    // up on reload; otherwise the embedded copies are used
+    assetDir := ""
+    if os.Getenv("APP_ENV") == "local" {
+        assetDir = localAssetDir()
+        if assetDir != "" {
+            log.Printf("Serving templates and static files from %s", assetDir)
+        } else {
+            log.Println("Frontend directory not found; serving embedded templates and static files")
+        }
+    }
+
+    port := os.Getenv("PORT")
+    if port == "" {
+        port = "3000"
     }
+
+    log.Printf("Frontend listening on :%s (API %s)", port, endpoint)
+    log.Fatal(buildApp(assetDir).Listen(":" + port))
 }
@@ -3,11 +3,14 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"net/http"
 	"net/http/httptest"
 	"testing"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/stretchr/testify/assert"
+
+	"candle-lights/frontend/middleware"
 )
 
 func setupTestApp() *fiber.App {
@@ -71,6 +74,7 @@ func TestAPIRoutesExist(t *testing.T) {
 		{"POST", "/api/devices", "Create Device"},
 		{"POST", "/api/particle/command", "Send Command"},
 		{"POST", "/api/particle/devices/refresh", "Refresh Devices"},
+		{"POST", "/auth/refresh", "Refresh Session"},
 	}
 
 	for _, tt := range tests {
@@ -107,3 +111,114 @@ func TestDashboardRequiresAuth(t *testing.T) {
 	// Should redirect to login (302) since no auth cookie
 	assert.Equal(t, 302, resp.StatusCode, "Dashboard should require authentication")
 }
+
+func setupCookieTestApp() *fiber.App {
+	app := fiber.New()
+	app.Get("/set", func(c *fiber.Ctx) error {
+		middleware.SetSessionCookies(c, "test-session", "testuser", 3600)
+		return c.SendStatus(200)
+	})
+	return app
+}
+
+func TestSessionCookieOverHTTP(t *testing.T) {
+	app := setupCookieTestApp()
+
+	req := httptest.NewRequest("GET", "http://localhost/set", nil)
+	resp, err := app.Test(req, -1)
+	assert.NoError(t, err)
+
+	cookies := resp.Cookies()
+	var session, username *http.Cookie
+	for _, c := range cookies {
+		switch c.Name {
+		case middleware.SessionCookieName:
+			session = c
+		case middleware.UsernameCookieName:
+			username = c
+		case middleware.SecureSessionCookieName:
+			t.Errorf("__Host- cookie must not be set over plain HTTP")
+		}
+	}
+
+	if assert.NotNil(t, session, "session cookie should be set") {
+		assert.Equal(t, "test-session", session.Value)
+		assert.False(t, session.Secure, "session cookie should not be Secure over HTTP")
+		assert.True(t, session.HttpOnly)
+		assert.Equal(t, 3600, session.MaxAge)
+		assert.Equal(t, "/", session.Path)
+	}
+	if assert.NotNil(t, username, "username cookie should be set") {
+		assert.False(t, username.HttpOnly, "username cookie must be readable by JavaScript")
+	}
+}
+
+func TestSessionCookieOverForwardedHTTPS(t *testing.T) {
+	app := setupCookieTestApp()
+
+	req := httptest.NewRequest("GET", "http://localhost/set", nil)
+	req.Header.Set("X-Forwarded-Proto", "https")
+	resp, err := app.Test(req, -1)
+	assert.NoError(t, err)
+
+	var session, username *http.Cookie
+	for _, c := range resp.Cookies() {
+		switch c.Name {
+		case middleware.SecureSessionCookieName:
+			session = c
+		case middleware.UsernameCookieName:
+			username = c
+		case middleware.SessionCookieName:
+			t.Errorf("unprefixed session cookie must not be set over HTTPS")
+		}
+	}
+
+	if assert.NotNil(t, session, "__Host- session cookie should be set") {
+		assert.True(t, session.Secure, "session cookie should be Secure over HTTPS")
+		assert.True(t, session.HttpOnly)
+		assert.Equal(t, 3600, session.MaxAge)
+		assert.Equal(t, "/", session.Path, "__Host- cookies require Path=/")
+		assert.Empty(t, session.Domain, "__Host- cookies must not set Domain")
+	}
+	if assert.NotNil(t, username, "username cookie should be set") {
+		assert.True(t, username.Secure)
+	}
+}
+
+func TestSessionIDFollowsRequestScheme(t *testing.T) {
+	app := fiber.New()
+	app.Get("/session", func(c *fiber.Ctx) error {
+		return c.SendString(middleware.SessionID(c))
+	})
+
+	tests := []struct {
+		name    string
+		https   bool
+		cookies []*http.Cookie
+		want    string
+	}{
+		{"http plain cookie", false, []*http.Cookie{{Name: middleware.SessionCookieName, Value: "plain"}}, "plain"},
+		{"https __Host- cookie", true, []*http.Cookie{{Name: middleware.SecureSessionCookieName, Value: "secure"}}, "secure"},
+		{"https ignores plain cookie", true, []*http.Cookie{{Name: middleware.SessionCookieName, Value: "injected"}}, ""},
+		{"https prefers __Host- cookie", true, []*http.Cookie{
+			{Name: middleware.SessionCookieName, Value: "injected"},
+			{Name: middleware.SecureSessionCookieName, Value: "secure"},
+		}, "secure"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "http://localhost/session", nil)
+		if tt.https {
+			req.Header.Set("X-Forwarded-Proto", "https")
+		}
+		for _, cookie := range tt.cookies {
+			req.AddCookie(cookie)
+		}
+		resp, err := app.Test(req, -1)
+		if !assert.NoError(t, err, tt.name) {
+			continue
+		}
+		body := new(bytes.Buffer)
+		body.ReadFrom(resp.Body)
+		assert.Equal(t, tt.want, body.String(), tt.name)
+	}
+}
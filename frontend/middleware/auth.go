@@ -2,7 +2,9 @@ package middleware
 
 import (
     "bytes"
+    "context"
     "encoding/json"
+    "errors"
     "io"
     "log"
     "net/http"
@@ -14,11 +16,19 @@ import (
 
 var apiEndpoint = os.Getenv("API_ENDPOINT")
 
+// SetAPIEndpoint overrides API_ENDPOINT, for running outside Lambda
+func SetAPIEndpoint(endpoint string) {
+    apiEndpoint = endpoint
+}
+
+// validateTimeout caps the session validation call
+const validateTimeout = 10 * time.Second
+
 // AuthMiddleware validates the session
 func AuthMiddleware(c *fiber.Ctx) error {
     log.Printf("AuthMiddleware: Validating session for path: %s", c.Path())
 
-    sessionID := c.Cookies("session_id")
+    sessionID := SessionID(c)
     if sessionID == "" {
         log.Println("AuthMiddleware: No session cookie found, redirecting to login")
         return c.Redirect("/login")
@@ -28,17 +38,17 @@ func AuthMiddleware(c *fiber.Ctx) error {
     apiURL := apiEndpoint + "/api/auth/validate"
     log.Printf("AuthMiddleware: Calling validation API at: %s", apiURL)
 
-    req, err := http.NewRequest("POST", apiURL, nil)
+    ctx, cancel := context.WithTimeout(c.UserContext(), validateTimeout)
+    defer cancel()
+
+    req, err := http.NewRequestWithContext(ctx, "POST", apiURL, nil)
     if err != nil {
         log.Printf("AuthMiddleware: Failed to create request: %v", err)
         return c.Redirect("/login")
     }
     req.Header.Set("Authorization", "Bearer "+sessionID)
 
-    client := &http.Client{
-        Timeout: 10 * time.Second,
-    }
-    resp, err := client.Do(req)
+    resp, err := http.DefaultClient.Do(req)
     if err != nil {
         log.Printf("AuthMiddleware: Validation request failed: %v", err)
         return c.Redirect("/login")
@@ -79,6 +89,7 @@ func AuthMiddleware(c *fiber.Ctx) error {
 
     // Store username in context
     c.Locals("username", result.Data.Username)
+    ApplyRotatedSession(c, resp.Header, result.Data.Username)
 
     return c.Next()
 }
@@ -87,7 +98,7 @@ func AuthMiddleware(c *fiber.Ctx) error {
 func APIAuthMiddleware(c *fiber.Ctx) error {
     log.Printf("APIAuthMiddleware: Validating session for API path: %s", c.Path())
 
-    sessionID := c.Cookies("session_id")
+    sessionID := SessionID(c)
     if sessionID == "" {
         log.Println("APIAuthMiddleware: No session cookie found")
         return c.Status(401).JSON(fiber.Map{
@@ -100,7 +111,10 @@ func APIAuthMiddleware(c *fiber.Ctx) error {
     apiURL := apiEndpoint + "/api/auth/validate"
     log.Printf("APIAuthMiddleware: Calling validation API at: %s", apiURL)
 
-    req, err := http.NewRequest("POST", apiURL, bytes.NewBuffer([]byte{}))
+    ctx, cancel := context.WithTimeout(c.UserContext(), validateTimeout)
+    defer cancel()
+
+    req, err := http.NewRequestWithContext(ctx, "POST", apiURL, bytes.NewBuffer([]byte{}))
     if err != nil {
         log.Printf("APIAuthMiddleware: Failed to create request: %v", err)
         return c.Status(401).JSON(fiber.Map{
@@ -110,12 +124,16 @@ func APIAuthMiddleware(c *fiber.Ctx) error {
     }
     req.Header.Set("Authorization", "Bearer "+sessionID)
 
-    client := &http.Client{
-        Timeout: 10 * time.Second,
-    }
-    resp, err := client.Do(req)
+    resp, err := http.DefaultClient.Do(req)
     if err != nil {
         log.Printf("APIAuthMiddleware: Validation request failed: %v", err)
+        if errors.Is(err, context.DeadlineExceeded) {
+            // The session may well be fine; don't make the client log out
+            return c.Status(fiber.StatusGatewayTimeout).JSON(fiber.Map{
+                "success": false,
+                "error":   "The backend API did not respond in time",
+            })
+        }
         return c.Status(401).JSON(fiber.Map{
             "success": false,
             "error":   "Unauthorized",
@@ -169,6 +187,7 @@ func APIAuthMiddleware(c *fiber.Ctx) error {
 
     // Store username in context
     c.Locals("username", result.Data.Username)
+    ApplyRotatedSession(c, resp.Header, result.Data.Username)
 
     return c.Next()
 }
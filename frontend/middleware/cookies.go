@@ -0,0 +1,144 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Session cookie names. Over HTTPS the __Host- prefix makes browsers require
+// Secure, Path=/ and no Domain, so the cookie can't be set or read over HTTP.
+const (
+	SessionCookieName       = "session_id"
+	SecureSessionCookieName = "__Host-session_id"
+	UsernameCookieName      = "username"
+)
+
+// Backend response headers carrying a rotated session, which replaces the
+// one in the cookie
+const (
+	SessionTokenHeader     = "X-Session-Token"
+	SessionExpiresAtHeader = "X-Session-Expires-At" // Unix seconds
+)
+
+// IsSecureRequest reports whether the client connected over HTTPS, either
+// directly or through a proxy that sets X-Forwarded-Proto
+func IsSecureRequest(c *fiber.Ctx) bool {
+	if proto := c.Get("X-Forwarded-Proto"); proto != "" {
+		// Proxies may append; the first entry is the client-facing scheme
+		first := strings.TrimSpace(strings.Split(proto, ",")[0])
+		return strings.EqualFold(first, "https")
+	}
+	return c.Protocol() == "https"
+}
+
+// SessionID returns the session ID for the request: a session rotated earlier
+// in the request, or else the session cookie for the request scheme. Over
+// HTTPS only the __Host- cookie counts; a plain session_id there could have
+// been injected over HTTP.
+func SessionID(c *fiber.Ctx) string {
+	if sessionID, ok := c.Locals("sessionID").(string); ok && sessionID != "" {
+		return sessionID
+	}
+	if IsSecureRequest(c) {
+		return c.Cookies(SecureSessionCookieName)
+	}
+	return c.Cookies(SessionCookieName)
+}
+
+// SetSessionCookies sets the session and username cookies to expire after
+// maxAgeSeconds (browser-session cookies if it's not positive). Secure, and
+// the __Host- name, follow the request scheme.
+func SetSessionCookies(c *fiber.Ctx, sessionID, username string, maxAgeSeconds int) {
+	secure := IsSecureRequest(c)
+	name := SessionCookieName
+	if secure {
+		name = SecureSessionCookieName
+	}
+	var expires time.Time
+	if maxAgeSeconds > 0 {
+		expires = time.Now().Add(time.Duration(maxAgeSeconds) * time.Second)
+	} else {
+		maxAgeSeconds = 0
+	}
+
+	// Session ID cookie (HTTP-only)
+	c.Cookie(&fiber.Cookie{
+		Name:     name,
+		Value:    sessionID,
+		Expires:  expires,
+		MaxAge:   maxAgeSeconds,
+		HTTPOnly: true,
+		Secure:   secure,
+		SameSite: "Lax", // Allow OAuth redirects while maintaining CSRF protection
+		Path:     "/",
+	})
+
+	// Username cookie (readable by JavaScript)
+	c.Cookie(&fiber.Cookie{
+		Name:     UsernameCookieName,
+		Value:    username,
+		Expires:  expires,
+		MaxAge:   maxAgeSeconds,
+		HTTPOnly: false,
+		Secure:   secure,
+		SameSite: "Lax",
+		Path:     "/",
+	})
+}
+
+// ApplyRotatedSession refreshes the session cookies if a backend response
+// carries a rotated session, and uses the new ID for the rest of the request
+func ApplyRotatedSession(c *fiber.Ctx, header http.Header, username string) {
+	sessionID := header.Get(SessionTokenHeader)
+	if sessionID == "" {
+		return
+	}
+
+	maxAge := 0
+	if expiresAt, err := strconv.ParseInt(header.Get(SessionExpiresAtHeader), 10, 64); err == nil {
+		maxAge = int(expiresAt - time.Now().Unix())
+	}
+	if username == "" {
+		username = c.Cookies(UsernameCookieName)
+	}
+
+	SetSessionCookies(c, sessionID, username, maxAge)
+	c.Locals("sessionID", sessionID)
+}
+
+// ClearSessionCookies expires every session cookie variant
+func ClearSessionCookies(c *fiber.Ctx) {
+	secure := IsSecureRequest(c)
+	expired := time.Now().Add(-1 * time.Hour)
+
+	c.Cookie(&fiber.Cookie{
+		Name:     SessionCookieName,
+		Value:    "",
+		Expires:  expired,
+		HTTPOnly: true,
+		Secure:   secure,
+		Path:     "/",
+	})
+	if secure {
+		c.Cookie(&fiber.Cookie{
+			Name:     SecureSessionCookieName,
+			Value:    "",
+			Expires:  expired,
+			HTTPOnly: true,
+			Secure:   true,
+			Path:     "/",
+		})
+	}
+	c.Cookie(&fiber.Cookie{
+		Name:     UsernameCookieName,
+		Value:    "",
+		Expires:  expired,
+		HTTPOnly: false,
+		Secure:   secure,
+		Path:     "/",
+	})
+}
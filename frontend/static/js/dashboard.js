@@ -4,9 +4,11 @@ function dashboard() {
         patterns: [],
         virtualGroups: [],
         particleStatus: 'checking',
+        tokenWarning: '',
         selectedPatternId: '',
         isLoading: true,
         isApplyingGroup: null,
+        isTurningAllOff: false,
 
         get deviceCount() {
             return this.devices.filter(d => !d.isHidden).length;
@@ -22,10 +24,26 @@ function dashboard() {
             return this.devices.filter(d => !d.isHidden && d.isOnline && !d.isReady).length;
         },
 
+        // Not-ready devices that actually need the firmware flashed (see devices.js)
+        get needsFirmwareCount() {
+            return this.devices.filter(d => !d.isHidden && d.isOnline && !d.isReady &&
+                (d.readinessStatus ? d.readinessStatus === 'no_firmware_variable' : !d.firmwareVersion)).length;
+        },
+
         get offlineCount() {
             return this.devices.filter(d => !d.isHidden && !d.isOnline).length;
         },
 
+        // Dashboard icons (the backend's DisplayIcons); list responses fill in defaults
+        iconGlyph(icon) {
+            const glyphs = {
+                argon: '📡', boron: '📶', bulb: '💡', candle: '🕯️', door: '🚪',
+                garage: '🚗', group: '🔗', house: '🏠', lamp: '🛋️', photon: '🔌',
+                star: '⭐', strip: '〰️', tree: '🎄', wled: '🌈'
+            };
+            return glyphs[icon] || glyphs.bulb;
+        },
+
         init() {
             this.checkParticleConnection();
             this.loadDevices();
@@ -43,6 +61,7 @@ function dashboard() {
                 const data = await resp.json();
                 if (data.success) {
                     this.particleStatus = 'connected';
+                    this.tokenWarning = data.data?.tokenWarning || '';
                 } else {
                     this.particleStatus = 'error';
                 }
@@ -359,6 +378,34 @@ function dashboard() {
             } finally {
                 this.isApplyingGroup = null;
             }
+        },
+
+        async allOff() {
+            this.isTurningAllOff = true;
+            try {
+                const resp = await fetch('/api/particle/all-off', {
+                    method: 'POST',
+                    credentials: 'same-origin'
+                });
+
+                const data = await resp.json();
+                if (!data.success) {
+                    NotificationBanner.error('Error: ' + (data.error || 'Unknown error'));
+                } else if (data.data.duplicate) {
+                    NotificationBanner.info('All off was just sent');
+                } else if (data.data.failed === 0) {
+                    NotificationBanner.success(`Turned off ${data.data.off} strips`);
+                } else {
+                    const missed = data.data.strips
+                        .filter(s => s.status !== 'off')
+                        .map(s => `${s.deviceName} D${s.pin} (${s.status})`);
+                    NotificationBanner.warning(`Turned off ${data.data.off} strips; not reached: ${missed.join(', ')}`);
+                }
+            } catch (err) {
+                NotificationBanner.error('Error turning everything off: ' + err.message);
+            } finally {
+                this.isTurningAllOff = false;
+            }
         }
     }
 }
@@ -43,6 +43,15 @@ function devicesPage() {
                 .sort((a, b) => a.name.localeCompare(b.name));
         },
 
+        // Only a device that answered without usable deviceInfo needs flashing;
+        // records from before readinessStatus fall back to the firmware version
+        needsFirmware(device) {
+            if (device.readinessStatus) {
+                return device.readinessStatus === 'no_firmware_variable';
+            }
+            return !device.firmwareVersion;
+        },
+
         get offlineDevices() {
             return this.filteredDevices
                 .filter(d => !d.isOnline)
@@ -86,25 +95,43 @@ function devicesPage() {
             this.isRefreshing = true;
             this.refreshMessage = '';
             try {
-                const resp = await fetch('/api/particle/devices/refresh', {
-                    method: 'POST',
-                    headers: {'Content-Type': 'application/json'},
-                    credentials: 'same-origin'
-                });
+                // Large accounts are refreshed in chunks; keep calling with
+                // the continuation token until the server returns none
+                let count = 0;
+                let continuation = '';
+                do {
+                    const url = continuation
+                        ? '/api/particle/devices/refresh?continuation=' + encodeURIComponent(continuation)
+                        : '/api/particle/devices/refresh';
+                    const resp = await fetch(url, {
+                        method: 'POST',
+                        headers: {'Content-Type': 'application/json'},
+                        credentials: 'same-origin'
+                    });
 
-                const data = await resp.json();
+                    const data = await resp.json();
 
-                if (data.success) {
-                    const count = data.count || 0;
-                    this.refreshMessage = `Successfully refreshed! Found ${count} device(s) from Particle.io`;
-                    await this.loadDevices();
-                    // Clear message after 5 seconds
-                    setTimeout(() => {
-                        this.refreshMessage = '';
-                    }, 5000);
-                } else {
-                    this.refreshMessage = 'Error refreshing devices: ' + (data.error || 'Unknown error');
-                }
+                    if (!data.success) {
+                        this.refreshMessage = 'Error refreshing devices: ' + (data.error || 'Unknown error');
+                        if (count > 0) {
+                            await this.loadDevices();
+                        }
+                        return;
+                    }
+                    const result = data.data || {};
+                    count += result.count || 0;
+                    continuation = result.continuation || '';
+                    if (continuation) {
+                        this.refreshMessage = `Refreshing... ${count} of ${result.total} device(s) so far`;
+                    }
+                } while (continuation);
+
+                this.refreshMessage = `Successfully refreshed! Found ${count} device(s) from Particle.io`;
+                await this.loadDevices();
+                // Clear message after 5 seconds
+                setTimeout(() => {
+                    this.refreshMessage = '';
+                }, 5000);
             } catch (err) {
                 this.refreshMessage = 'Error refreshing devices: ' + err.message;
             } finally {
@@ -133,10 +160,15 @@ function devicesPage() {
             // Fetch device variables to check current firmware status
             try {
                 const vars = await this.fetchDeviceVariables(device.deviceId);
-                if (vars && vars.firmwareVersion) {
+                const status = vars?.readiness?.status;
+                if (vars && vars.firmwareVersion && status === 'ready') {
                     NotificationBanner.info(`Device ${device.name}: Firmware ${vars.firmwareVersion}, Platform ${vars.platform || 'Unknown'}, Strips: ${vars.numStrips || 0}. Click "Refresh from Particle.io" to update.`);
+                } else if (status === 'no_firmware_variable') {
+                    NotificationBanner.warning('The device responded but has no firmware info. Flash the LED controller firmware to enable configuration.');
+                } else if (status === 'offline') {
+                    NotificationBanner.warning('The device did not respond. It may have just gone offline.');
                 } else {
-                    NotificationBanner.warning('Could not read firmware info from device. The device may be offline or not running the LED controller firmware.');
+                    NotificationBanner.warning('Could not check the device right now. Try again in a moment.');
                 }
             } catch (err) {
                 NotificationBanner.error('Error checking device: ' + err.message);
@@ -381,10 +413,16 @@ function devicesPage() {
 
             // Use the strips from device variables
             if (this.deviceVariables.strips && this.deviceVariables.strips.length > 0) {
-                this.stripConfig = this.deviceVariables.strips.map(s => ({
-                    pin: s.pin,
-                    ledCount: s.ledCount
-                }));
+                // Speed multipliers only live in the database; keep them by pin
+                const previous = this.stripConfig;
+                this.stripConfig = this.deviceVariables.strips.map(s => {
+                    const existing = previous.find(p => p.pin === s.pin);
+                    return {
+                        pin: s.pin,
+                        ledCount: s.ledCount,
+                        speedMultiplier: existing?.speedMultiplier
+                    };
+                });
             } else {
                 this.stripConfig = [];
             }
@@ -436,7 +474,12 @@ function devicesPage() {
                     method: 'PUT',
                     headers: {'Content-Type': 'application/json'},
                     credentials: 'same-origin',
-                    body: JSON.stringify({ ledStrips: this.stripConfig })
+                    body: JSON.stringify({
+                        ledStrips: this.stripConfig.map(s => ({
+                            ...s,
+                            speedMultiplier: Number(s.speedMultiplier) || 0
+                        }))
+                    })
                 });
 
                 const data = await resp.json();
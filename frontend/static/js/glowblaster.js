@@ -12,6 +12,7 @@ function glowBlasterPage() {
         userMessage: '',
         isLoading: false,
         totalTokens: 0,
+        totalCost: 0, // Microdollars
         selectedModel: 'claude-sonnet-4-20250514',
         models: [],
 
@@ -210,6 +211,7 @@ function glowBlasterPage() {
                     this.currentWLED = data.data.currentWled || '';
                     this.currentBytecode = null; // Reset bytecode so updatePreview recompiles
                     this.totalTokens = data.data.totalTokens || 0;
+                    this.totalCost = data.data.totalCost || 0;
                     this.selectedModel = data.data.model || 'claude-sonnet-4-20250514';
 
                     console.log('[LoadConversation] State after load:', {
@@ -315,6 +317,16 @@ function glowBlasterPage() {
                     }
 
                     this.totalTokens = data.data.totalTokens || this.totalTokens;
+                    this.totalCost = data.data.totalCost || this.totalCost;
+
+                    // The stored model was retired or invalid; the backend switched it
+                    if (data.data.modelChanged) {
+                        this.selectedModel = data.data.modelChanged.to;
+                        NotificationBanner.warning(
+                            `Model ${data.data.modelChanged.from || '(none)'} is no longer available; ` +
+                            `this conversation now uses ${data.data.modelChanged.to}`
+                        );
+                    }
 
                     // Store debug info
                     if (data.data.debug) {
@@ -508,7 +520,11 @@ function glowBlasterPage() {
                 const data = await resp.json();
                 if (data.success) {
                     await this.loadConversation(this.activeConversation.conversationId);
-                    NotificationBanner.success('Conversation compacted');
+                    const saved = data.data && data.data.tokensSaved;
+                    NotificationBanner.success(saved > 0
+                        ? `Conversation compacted, about ${saved.toLocaleString()} fewer tokens per message`
+                        : 'Conversation compacted');
+                    (data.warnings || []).forEach(w => NotificationBanner.warning(w));
                 }
             } catch (err) {
                 NotificationBanner.error('Failed to compact conversation');
@@ -536,6 +552,7 @@ function glowBlasterPage() {
                         this.currentWLED = data.data.currentWled || pattern.wledState || '';
                         this.currentBytecode = null;
                         this.totalTokens = data.data.totalTokens || 0;
+                        this.totalCost = data.data.totalCost || 0;
                         this.selectedModel = data.data.model || 'claude-sonnet-4-20250514';
 
                         if (this.currentWLED) {
@@ -716,6 +733,12 @@ function glowBlasterPage() {
             return date.toLocaleDateString();
         },
 
+        // Format a microdollar amount as dollars, with cents for larger amounts
+        formatCost(microdollars) {
+            const dollars = (microdollars || 0) / 1000000;
+            return '$' + dollars.toFixed(dollars < 1 ? 4 : 2);
+        },
+
         viewConversation() {
             if (!this.activeConversation) return;
             // Prepare JSON
@@ -6,6 +6,8 @@ function patternsPage() {
         palettes: [],
         isLoading: true,
         isSaving: false,
+        startersAvailable: false,
+        isInstallingStarters: false,
 
         // Modal state
         showModal: false,
@@ -83,6 +85,7 @@ function patternsPage() {
                 const resp = await fetch('/api/patterns', { credentials: 'same-origin' });
                 const data = await resp.json();
                 if (data.success) {
+                    this.startersAvailable = !!data.startersAvailable;
                     this.patterns = (data.data || []).map(p => {
                         // Ensure colors array exists
                         if (!p.colors && p.red !== undefined) {
@@ -97,9 +100,10 @@ function patternsPage() {
         },
 
         getEffectName(pattern) {
-            // Try to find effect by ID in metadata
-            if (pattern.metadata?.effectId) {
-                const effect = this.effects.find(e => e.id === parseInt(pattern.metadata.effectId));
+            // Try to find effect by ID (effectId, or the older metadata copy)
+            const effectId = pattern.effectId ?? pattern.metadata?.effectId;
+            if (effectId !== undefined && effectId !== '') {
+                const effect = this.effects.find(e => e.id === parseInt(effectId));
                 if (effect) return effect.name;
             }
             // Map old type to effect name
@@ -134,9 +138,9 @@ function patternsPage() {
                 'fire': 49
             };
 
-            const effectId = pattern.metadata?.effectId
+            const effectId = pattern.effectId ?? (pattern.metadata?.effectId
                 ? parseInt(pattern.metadata.effectId)
-                : (typeToEffectId[pattern.type] || 71);
+                : (typeToEffectId[pattern.type] || 71));
 
             this.form = {
                 name: pattern.name || '',
@@ -473,6 +477,28 @@ function patternsPage() {
             }
         },
 
+        async installStarters() {
+            this.isInstallingStarters = true;
+            try {
+                const resp = await fetch('/api/patterns/install-starters', {
+                    method: 'POST',
+                    credentials: 'same-origin'
+                });
+                const data = await resp.json();
+
+                if (data.success) {
+                    await this.loadPatterns();
+                    NotificationBanner.success(`Added ${data.data.installed.length} starter patterns`);
+                } else {
+                    NotificationBanner.error('Error: ' + (data.error || 'Failed to add starter patterns'));
+                }
+            } catch (err) {
+                NotificationBanner.error('Failed to add starter patterns');
+            } finally {
+                this.isInstallingStarters = false;
+            }
+        },
+
         editInGlowBlaster(pattern) {
             window.location.href = `/glowblaster?patternId=${pattern.patternId}`;
         }